@@ -14,6 +14,7 @@ import (
 	"github.com/ubuntu/authd-oidc-brokers/internal/broker"
 	"github.com/ubuntu/authd-oidc-brokers/internal/daemon"
 	"github.com/ubuntu/authd-oidc-brokers/internal/dbusservice"
+	"github.com/ubuntu/authd-oidc-brokers/internal/log"
 )
 
 // App encapsulate commands and options of the daemon, which can be controlled by env variables and config files.
@@ -22,8 +23,9 @@ type App struct {
 	viper   *viper.Viper
 	config  daemonConfig
 
-	daemon *daemon.Daemon
-	name   string
+	daemon  *daemon.Daemon
+	service *dbusservice.Service
+	name    string
 
 	ready chan struct{}
 }
@@ -37,8 +39,9 @@ type systemPaths struct {
 
 // daemonConfig defines configuration parameters of the daemon.
 type daemonConfig struct {
-	Verbosity int
-	Paths     systemPaths
+	Verbosity     int
+	UseSessionBus bool
+	Paths         systemPaths
 }
 
 // New registers commands and return a new App.
@@ -104,11 +107,17 @@ func New(name string) *App {
 
 	installVerbosityFlag(&a.rootCmd, a.viper)
 	installConfigFlag(&a.rootCmd)
+	installSessionBusFlag(&a.rootCmd, a.viper)
 	// FIXME: This option is for the viper path configuration. We should merge --config and this one in the future.
 	a.rootCmd.PersistentFlags().StringP("paths-config", "", "", "use a specific paths configuration file")
 
 	// subcommands
 	a.installVersion()
+	a.installValidate()
+	a.installDryRun()
+	a.installInspectToken()
+	a.installListUsers()
+	a.installRemoveUser()
 
 	return &a
 }
@@ -139,16 +148,32 @@ func (a *App) serve(config daemonConfig) error {
 		return fmt.Errorf("error initializing broker configuration directory %q: %v", brokerConfigDir, err)
 	}
 
+	logCfg, err := broker.ParseLogConfig(config.Paths.BrokerConf)
+	if err != nil {
+		return err
+	}
+	// The verbosity flags take precedence over the configured level.
+	if logCfg.Level != nil && config.Verbosity == 0 {
+		log.SetLevel(*logCfg.Level)
+	}
+	logger := log.New(os.Stderr, logCfg.Format)
+	slog.SetDefault(logger)
+
 	b, err := broker.New(broker.Config{
 		ConfigFile:            config.Paths.BrokerConf,
 		DataDir:               config.Paths.DataDir,
 		OldEncryptedTokensDir: config.Paths.OldEncryptedTokensDir,
-	})
+	}, broker.WithLogger(logger))
 	if err != nil {
 		return err
 	}
 
-	s, err := dbusservice.New(ctx, b)
+	dbusopts := []dbusservice.Option{dbusservice.WithLogger(logger)}
+	if config.UseSessionBus {
+		logger.Info("Using the session bus")
+		dbusopts = append(dbusopts, dbusservice.WithSessionBus())
+	}
+	s, err := dbusservice.New(ctx, b, dbusopts...)
 	if err != nil {
 		return err
 	}
@@ -161,6 +186,7 @@ func (a *App) serve(config daemonConfig) error {
 	}
 
 	a.daemon = daemon
+	a.service = s
 	closeFunc()
 
 	return daemon.Serve(ctx)
@@ -177,6 +203,17 @@ func installVerbosityFlag(cmd *cobra.Command, viper *viper.Viper) *int {
 	return r
 }
 
+// installSessionBusFlag adds the --session-bus option to connect to the session bus instead of the system bus.
+func installSessionBusFlag(cmd *cobra.Command, viper *viper.Viper) *bool {
+	r := cmd.PersistentFlags().Bool("session-bus", false /*i18n.G(*/, "connect to the session bus instead of the system bus, for development purposes") //)
+
+	if err := viper.BindPFlag("usesessionbus", cmd.PersistentFlags().Lookup("session-bus")); err != nil {
+		slog.Warn(err.Error())
+	}
+
+	return r
+}
+
 // Run executes the command and associated process. It returns an error on syntax/usage error.
 func (a *App) Run() error {
 	return a.rootCmd.Execute()
@@ -187,11 +224,25 @@ func (a App) UsageError() bool {
 	return !a.rootCmd.SilenceUsage
 }
 
-// Hup prints all goroutine stack traces and return false to signal you shouldn't quit.
-func (a App) Hup() (shouldQuit bool) {
+// Hup prints all goroutine stack traces, reloads the broker configuration if the service is running and return false
+// to signal you shouldn't quit.
+func (a *App) Hup() (shouldQuit bool) {
 	buf := make([]byte, 1<<16)
 	runtime.Stack(buf, true)
 	fmt.Printf("%s", buf)
+
+	// Only reload once the service is ready, without waiting for it.
+	select {
+	case <-a.ready:
+		if a.service == nil {
+			break
+		}
+		if err := a.service.Reload(); err != nil {
+			slog.Warn(err.Error())
+		}
+	default:
+	}
+
 	return false
 }
 
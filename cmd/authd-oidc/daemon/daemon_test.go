@@ -54,6 +54,50 @@ func TestVersion(t *testing.T) {
 	require.Equal(t, consts.Version, fields[1], "Wrong version")
 }
 
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		brokerConfig string
+		checkIssuers bool
+
+		wantErr bool
+	}{
+		"Successfully_validate_config":                 {},
+		"Successfully_validate_config_and_its_issuers": {checkIssuers: true},
+
+		"Error_when_required_settings_are_missing": {brokerConfig: "[oidc]\n", wantErr: true},
+		"Error_when_a_value_is_invalid":            {brokerConfig: "[oidc]\nissuer = https://issuer.url.com\nclient_id = client_id\noffline_credential_ttl = soon\n", wantErr: true},
+		"Error_when_log_level_is_invalid":          {brokerConfig: "[authd]\nlog_level = trace\n[oidc]\nissuer = https://issuer.url.com\nclient_id = client_id\n", wantErr: true},
+		"Error_when_issuer_is_not_reachable":       {brokerConfig: "[oidc]\nissuer = http://127.0.0.1:1\nclient_id = client_id\n", checkIssuers: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			args := []string{"validate"}
+			if tc.brokerConfig != "" {
+				brokerConf := filepath.Join(t.TempDir(), "broker.conf")
+				err := os.WriteFile(brokerConf, []byte(tc.brokerConfig), 0600)
+				require.NoError(t, err, "Setup: could not write broker configuration")
+				args = append(args, "--config", brokerConf)
+			}
+			if tc.checkIssuers {
+				args = append(args, "--check-issuers")
+			}
+			a := daemon.NewForTests(t, nil, issuerURL, args...)
+
+			getStdout := captureStdout(t)
+
+			err := a.Run()
+			out := getStdout()
+			if tc.wantErr {
+				require.Error(t, err, "Run should return an error for an invalid configuration")
+				require.Empty(t, out, "Nothing should be printed on stdout for an invalid configuration")
+				return
+			}
+			require.NoError(t, err, "Run should not return an error for a valid configuration")
+			require.Equal(t, "OK\n", out, "OK should be printed for a valid configuration")
+		})
+	}
+}
+
 func TestNoUsageError(t *testing.T) {
 	a := daemon.NewForTests(t, nil, issuerURL, "completion", "bash")
 
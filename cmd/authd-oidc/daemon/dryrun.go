@@ -0,0 +1,54 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker"
+)
+
+func (a *App) installDryRun() {
+	cmd := &cobra.Command{
+		Use:                                                                                              "dry-run USERNAME",
+		Short:/*i18n.G(*/ "Authenticates the user with the provider and prints what the broker resolved", /*)*/
+		Args:                                                                                             cobra.ExactArgs(1),
+		RunE:                                                                                             func(cmd *cobra.Command, args []string) error { return a.dryRun(cmd, args[0]) },
+	}
+	a.rootCmd.AddCommand(cmd)
+}
+
+// dryRun authenticates the user with the device code flow of the configured provider and prints the claims of the ID
+// token and the user info with the groups, without caching the token nor creating the user.
+func (a *App) dryRun(cmd *cobra.Command, username string) error {
+	b, err := broker.NewReadOnly(broker.Config{
+		ConfigFile: a.config.Paths.BrokerConf,
+		DataDir:    a.config.Paths.DataDir,
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := b.DryRun(cmd.Context(), username, func(verificationURI, userCode string) {
+		fmt.Printf( /*i18n.G(*/ "Access %q and use the login code %q" /*)*/ +"\n", verificationURI, userCode)
+	})
+	if err != nil {
+		return err
+	}
+
+	claims, err := json.MarshalIndent(res.Claims, "", "  ")
+	if err != nil {
+		return err
+	}
+	userInfo, err := json.MarshalIndent(res.UserInfo, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf( /*i18n.G(*/ "ID token claims:" /*)*/ +"\n%s\n", claims)
+	fmt.Printf( /*i18n.G(*/ "User info:" /*)*/ +"\n%s\n", userInfo)
+	if !res.GroupsAllowed {
+		fmt.Println( /*i18n.G(*/ "The user is not a member of any allowed group and would be denied." /*)*/)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package daemon
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker"
+)
+
+func (a *App) installInspectToken() {
+	cmd := &cobra.Command{
+		Use:                                                                                               "inspect-token USERNAME",
+		Short:/*i18n.G(*/ "Prints what the cached token of the user tells, without the tokens themselves", /*)*/
+		Args:                                                                                              cobra.ExactArgs(1),
+		RunE:                                                                                              func(cmd *cobra.Command, args []string) error { return a.inspectToken(args[0]) },
+	}
+	a.rootCmd.AddCommand(cmd)
+}
+
+// inspectToken prints the subject, username, groups and expiry of the cached token of the user. It fails if the cache
+// can not be read or decrypted, e.g. if the encryption key changed.
+func (a *App) inspectToken(username string) error {
+	b, err := broker.NewReadOnly(broker.Config{
+		ConfigFile: a.config.Paths.BrokerConf,
+		DataDir:    a.config.Paths.DataDir,
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := b.InspectToken(username)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf( /*i18n.G(*/ "Token cache: %s" /*)*/ +"\n", res.Path)
+	fmt.Printf( /*i18n.G(*/ "Subject: %s" /*)*/ +"\n", res.Subject)
+	fmt.Printf( /*i18n.G(*/ "Issuer: %s" /*)*/ +"\n", res.Issuer)
+	fmt.Printf( /*i18n.G(*/ "Username: %s" /*)*/ +"\n", res.Username)
+	fmt.Printf( /*i18n.G(*/ "Groups: %s" /*)*/ +"\n", strings.Join(res.Groups, ", "))
+	fmt.Printf( /*i18n.G(*/ "Access token expiry: %s" /*)*/ +"\n", formatExpiry(res.Expiry))
+	fmt.Printf( /*i18n.G(*/ "ID token expiry: %s" /*)*/ +"\n", formatExpiry(res.IDTokenExpiry))
+	if res.HasRefreshToken {
+		fmt.Println( /*i18n.G(*/ "Refresh token: present" /*)*/)
+	} else {
+		fmt.Println( /*i18n.G(*/ "Refresh token: absent" /*)*/)
+	}
+
+	return nil
+}
+
+// formatExpiry returns the expiry time, telling whether it already passed.
+func formatExpiry(expiry time.Time) string {
+	if expiry.IsZero() {
+		return /*i18n.G(*/ "none" /*)*/
+	}
+	if time.Now().After(expiry) {
+		return fmt.Sprintf( /*i18n.G(*/ "%s (expired)" /*)*/, expiry.Format(time.RFC3339))
+	}
+	return expiry.Format(time.RFC3339)
+}
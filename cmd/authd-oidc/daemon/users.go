@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker"
+)
+
+func (a *App) installListUsers() {
+	cmd := &cobra.Command{
+		Use:                                                                                                      "list-users",
+		Short:/*i18n.G(*/ "Prints the local users provisioned by the broker, with their provider and last login", /*)*/
+		Args:                                                                                                     cobra.NoArgs,
+		RunE:                                                                                                     func(cmd *cobra.Command, args []string) error { return a.listUsers() },
+	}
+	a.rootCmd.AddCommand(cmd)
+}
+
+// listUsers prints a table of the users managed by the broker, which are the ones whose username was recorded when they
+// were granted access.
+func (a *App) listUsers() error {
+	b, err := broker.NewReadOnly(broker.Config{
+		ConfigFile: a.config.Paths.BrokerConf,
+		DataDir:    a.config.Paths.DataDir,
+	})
+	if err != nil {
+		return err
+	}
+
+	users, err := b.ManagedUsers()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w /*i18n.G(*/, "USERNAME\tPROVIDER\tSUBJECT\tLAST LOGIN\tREMOVED AT PROVIDER" /*)*/)
+	for _, u := range users {
+		lastLogin := /*i18n.G(*/ "never" /*)*/
+		if !u.LastLogin.IsZero() {
+			lastLogin = u.LastLogin.Format(time.RFC3339)
+		}
+		removed := /*i18n.G(*/ "no" /*)*/
+		if u.RemovedAtProvider {
+			removed = /*i18n.G(*/ "yes" /*)*/
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", u.Username, u.Issuer, u.Subject, lastLogin, removed)
+	}
+	return w.Flush()
+}
+
+func (a *App) installRemoveUser() {
+	cmd := &cobra.Command{
+		Use:                                                                                                             "remove-user USERNAME",
+		Short:/*i18n.G(*/ "Forgets a user removed at the provider, and keeps, archives or deletes their home directory", /*)*/
+		Args:                                                                                                            cobra.ExactArgs(1),
+		RunE:                                                                                                            func(cmd *cobra.Command, args []string) error { return a.removeUser(args[0]) },
+	}
+	a.rootCmd.AddCommand(cmd)
+}
+
+// removeUser removes the cached data of the user and keeps, archives or deletes their home directory, as configured.
+// The local user itself is managed by authd, so it is not deleted.
+func (a *App) removeUser(username string) error {
+	b, err := broker.NewReadOnly(broker.Config{
+		ConfigFile: a.config.Paths.BrokerConf,
+		DataDir:    a.config.Paths.DataDir,
+	})
+	if err != nil {
+		return err
+	}
+	return b.RemoveUser(username)
+}
@@ -0,0 +1,49 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker"
+)
+
+func (a *App) installValidate() {
+	var checkIssuers bool
+	cmd := &cobra.Command{
+		Use:                                                                                           "validate",
+		Short:/*i18n.G(*/ "Validates the broker configuration without starting the service and exits", /*)*/
+		Args:                                                                                          cobra.NoArgs,
+		RunE:                                                                                          func(cmd *cobra.Command, args []string) error { return a.validateConfig(cmd, checkIssuers) },
+	}
+	cmd.Flags().BoolVar(&checkIssuers, "check-issuers", false /*i18n.G(*/, "also check that the configured issuers are reachable" /*)*/)
+	a.rootCmd.AddCommand(cmd)
+}
+
+// validateConfig prints OK if the broker configuration is valid, or else each error found by the validation.
+func (a *App) validateConfig(cmd *cobra.Command, checkIssuers bool) error {
+	err := broker.ValidateConfig(cmd.Context(), a.config.Paths.BrokerConf, checkIssuers)
+	if err == nil {
+		fmt.Println("OK")
+		return nil
+	}
+
+	for _, e := range flattenErrors(err) {
+		fmt.Fprintln(os.Stderr, e)
+	}
+	return fmt.Errorf("configuration %q is invalid", a.config.Paths.BrokerConf)
+}
+
+// flattenErrors returns the errors joined in err, recursively, so that they can be printed one per line.
+func flattenErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, flattenErrors(e)...)
+	}
+	return errs
+}
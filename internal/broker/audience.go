@@ -0,0 +1,52 @@
+package broker
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// audienceParamResource is the parameter naming the audience of the access tokens at the v1 endpoints of Microsoft
+	// Entra ID and at AD FS.
+	audienceParamResource = "resource"
+	// audienceParamAudience is the parameter naming the audience of the access tokens at the other providers, e.g. Auth0.
+	audienceParamAudience = "audience"
+	// audienceScopeSuffix makes a scope of the audience at the v2 endpoints of Microsoft Entra ID, which asks for all
+	// the permissions granted to the client on the API.
+	audienceScopeSuffix = "/.default"
+)
+
+// audienceInScopes returns true if the audience of the access tokens is requested as a scope at the token endpoint,
+// like at the v2 endpoints of Microsoft Entra ID, which reject the resource parameter.
+func audienceInScopes(endpoint oauth2.Endpoint) bool {
+	u, err := url.Parse(endpoint.TokenURL)
+	return err == nil && strings.Contains(u.Path, "/v2.0/")
+}
+
+// audienceParam returns the parameter naming the audience of the access tokens at the token endpoint.
+func audienceParam(endpoint oauth2.Endpoint) string {
+	if u, err := url.Parse(endpoint.TokenURL); err == nil && strings.HasSuffix(u.Path, "/oauth2/token") {
+		return audienceParamResource
+	}
+	return audienceParamAudience
+}
+
+// audienceScope returns the scope asking for access tokens of the audience.
+func audienceScope(audience string) string {
+	if strings.HasSuffix(audience, audienceScopeSuffix) {
+		return audience
+	}
+	return strings.TrimSuffix(audience, "/") + audienceScopeSuffix
+}
+
+// tokenAudienceAuthOptions returns the parameter of the device authorization and token requests asking for access
+// tokens of the audience, unless the endpoint takes it as a scope. The refresh requests can not be given extra
+// parameters, but the providers issue the refreshed tokens for the same audience.
+func tokenAudienceAuthOptions(audience string, endpoint oauth2.Endpoint) []oauth2.AuthCodeOption {
+	if audience == "" || audienceInScopes(endpoint) {
+		return nil
+	}
+	return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam(audienceParam(endpoint), audience)}
+}
@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// defaultAuditLogMaxSize is the size, in megabytes, above which the audit log is rotated, unless configured
+	// otherwise.
+	defaultAuditLogMaxSize = 10
+	// defaultAuditLogMaxFiles is how many rotated audit logs are kept, unless configured otherwise.
+	defaultAuditLogMaxFiles = 5
+)
+
+// auditRecord is a line of the audit log, recording an authorization decision. It must never hold the tokens, the
+// device codes or the challenges of the users.
+type auditRecord struct {
+	// Time is when the decision was made.
+	Time time.Time `json:"time"`
+	// Username is the name of the user who authenticated.
+	Username string `json:"username"`
+	// Provider is the issuer of the provider of the user.
+	Provider string `json:"provider"`
+	// Mode is the authentication mode the user authenticated with.
+	Mode string `json:"mode"`
+	// Outcome is the access returned to authd: granted, denied, or retry if the user can try again.
+	Outcome string `json:"outcome"`
+	// Reason is the reason of the failure, one of the failure reasons of the metrics, if access was not granted.
+	Reason string `json:"reason,omitempty"`
+	// Message is the message shown to the user, if access was not granted.
+	Message string `json:"message,omitempty"`
+}
+
+// auditDecision appends the decision made for the session to the audit log, if one is configured. The authentication
+// steps which lead to another one, and the cancelled ones, are not decisions.
+func (b *Broker) auditDecision(session *session, access string, data isAuthenticatedDataResponse) {
+	if b.cfg.auditLog == "" || (access != AuthGranted && access != AuthDenied && access != AuthRetry) {
+		return
+	}
+
+	r := auditRecord{
+		Time:     time.Now(),
+		Username: session.username,
+		Provider: session.issuerURL,
+		Mode:     session.selectedMode,
+		Outcome:  access,
+	}
+	if access != AuthGranted {
+		r.Reason = FailureOther
+		if msg, ok := data.(errorMessage); ok {
+			r.Reason = failureReason(msg.err)
+			r.Message = msg.Message
+		}
+	}
+
+	if err := b.writeAuditRecord(r); err != nil {
+		b.logger.Error(fmt.Sprintf("Could not record the authorization decision of user %q: %v", session.username, err))
+	}
+}
+
+// writeAuditRecord appends the record to the audit log as a JSON line, rotating it first if it would get larger than
+// the maximum size. The file is synced before returning, so that the decision is not lost if the broker crashes.
+func (b *Broker) writeAuditRecord(r auditRecord) (err error) {
+	defer decorate.OnError(&err, "could not write to the audit log %q", b.cfg.auditLog)
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	b.auditMu.Lock()
+	defer b.auditMu.Unlock()
+
+	if err := b.rotateAuditLog(int64(len(line))); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.cfg.auditLog), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(b.cfg.auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	return f.Close()
+}
+
+// rotateAuditLog renames the audit log to <audit_log>.1, after renaming the previous ones to the next number and
+// removing the oldest one, if appending size bytes would make it larger than the maximum size. auditMu must be held by
+// the caller.
+func (b *Broker) rotateAuditLog(size int64) error {
+	if b.cfg.auditLogMaxSize == 0 {
+		return nil
+	}
+	fi, err := os.Stat(b.cfg.auditLog)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 || fi.Size()+size <= int64(b.cfg.auditLogMaxSize)<<20 {
+		return nil
+	}
+
+	rotated := func(n int) string { return fmt.Sprintf("%s.%d", b.cfg.auditLog, n) }
+	if err := os.Remove(rotated(b.cfg.auditLogMaxFiles)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for n := b.cfg.auditLogMaxFiles - 1; n > 0; n-- {
+		if err := os.Rename(rotated(n), rotated(n+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if b.cfg.auditLogMaxFiles == 0 {
+		return os.Remove(b.cfg.auditLog)
+	}
+	return os.Rename(b.cfg.auditLog, rotated(1))
+}
@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// errNoAuthTime is the error returned when the ID token does not tell when the provider authenticated the user, while
+// the maximum age of the authentication is configured.
+var errNoAuthTime = errors.New("the ID token has no auth_time claim")
+
+// authenticationContextClaims are the claims of the ID token which tell how the provider authenticated the user.
+type authenticationContextClaims struct {
+	// AMR is the amr claim, which some providers return as a single string instead of an array.
+	AMR any    `json:"amr"`
+	ACR string `json:"acr"`
+	// AuthTime is the time when the provider authenticated the user, in seconds since the epoch.
+	AuthTime int64 `json:"auth_time"`
+}
+
+// amr returns the authentication methods of the amr claim, whether it is a string or an array of strings.
+func (c authenticationContextClaims) amr() []string {
+	switch v := c.AMR.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var methods []string
+		for _, m := range v {
+			if s, ok := m.(string); ok {
+				methods = append(methods, s)
+			}
+		}
+		return methods
+	}
+	return nil
+}
+
+// checkAuthenticationContext returns an error if the ID token does not show that the provider authenticated the user
+// with one of the required authentication methods and context classes, if any is configured.
+func (b *Broker) checkAuthenticationContext(rawIDToken string) error {
+	if len(b.cfg.requiredAMR) == 0 && len(b.cfg.requiredACR) == 0 {
+		return nil
+	}
+
+	idToken, err := parseVerifiedIDToken(rawIDToken)
+	if err != nil {
+		return err
+	}
+	var claims authenticationContextClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return fmt.Errorf("could not get ID token claims: %v", err)
+	}
+
+	if len(b.cfg.requiredAMR) > 0 {
+		amr := claims.amr()
+		if !slices.ContainsFunc(b.cfg.requiredAMR, func(m string) bool { return slices.Contains(amr, m) }) {
+			return fmt.Errorf("the authentication methods %q of the ID token do not include any of the required ones %q",
+				amr, b.cfg.requiredAMR)
+		}
+	}
+	if len(b.cfg.requiredACR) > 0 && !slices.Contains(b.cfg.requiredACR, claims.ACR) {
+		return fmt.Errorf("the authentication context class %q of the ID token is not one of the required ones %q",
+			claims.ACR, b.cfg.requiredACR)
+	}
+	return nil
+}
+
+// checkEmailVerified returns an error if the email_verified claim of the ID token is not true, if verified email
+// addresses are required. A missing claim is only accepted if configured so.
+func (b *Broker) checkEmailVerified(rawIDToken string) error {
+	if !b.cfg.requireVerifiedEmail {
+		return nil
+	}
+
+	idToken, err := parseVerifiedIDToken(rawIDToken)
+	if err != nil {
+		return err
+	}
+	var claims struct {
+		// EmailVerified is a boolean, but some providers return it as a string.
+		EmailVerified any `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return fmt.Errorf("could not get ID token claims: %v", err)
+	}
+
+	switch v := claims.EmailVerified.(type) {
+	case nil:
+		if b.cfg.allowMissingVerified {
+			return nil
+		}
+		return errors.New("the ID token has no email_verified claim, and verified email addresses are required")
+	case bool:
+		if v {
+			return nil
+		}
+	case string:
+		if verified, err := strconv.ParseBool(v); err == nil && verified {
+			return nil
+		}
+	}
+	return fmt.Errorf("the email_verified claim of the ID token is %v, and verified email addresses are required", claims.EmailVerified)
+}
+
+// maxAgeAuthOptions returns the parameters of the authorization request which ask the provider to authenticate the user
+// again if they were authenticated longer ago than the configured maximum age, if any.
+func (b *Broker) maxAgeAuthOptions() []oauth2.AuthCodeOption {
+	if b.cfg.maxAge <= 0 {
+		return nil
+	}
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("max_age", strconv.FormatInt(int64(b.cfg.maxAge/time.Second), 10)),
+	}
+}
+
+// checkAuthTime returns an error if the ID token shows that the provider authenticated the user longer ago than the
+// configured maximum age at now, or if it does not tell when the user was authenticated.
+func (b *Broker) checkAuthTime(rawIDToken string, now time.Time) error {
+	if b.cfg.maxAge <= 0 {
+		return nil
+	}
+
+	idToken, err := parseVerifiedIDToken(rawIDToken)
+	if err != nil {
+		return err
+	}
+	var claims authenticationContextClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return fmt.Errorf("could not get ID token claims: %v", err)
+	}
+	if claims.AuthTime == 0 {
+		return errNoAuthTime
+	}
+
+	authTime := time.Unix(claims.AuthTime, 0)
+	if age := now.Sub(authTime); age > b.cfg.maxAge+b.cfg.allowedClockSkew {
+		return fmt.Errorf("the user was authenticated by the provider at %s, %s ago, which is longer than the maximum age %s",
+			authTime.Format(time.RFC3339), age.Truncate(time.Second), b.cfg.maxAge)
+	}
+	return nil
+}
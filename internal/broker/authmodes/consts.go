@@ -13,4 +13,12 @@ const (
 
 	// NewPassword is the ID of the new password configuration method.
 	NewPassword = "newpassword"
+
+	// WebAuthn is the ID of the WebAuthn (security key or passkey) authentication method.
+	WebAuthn = "webauthn"
 )
+
+// All returns the IDs of all the authentication modes.
+func All() []string {
+	return []string{Password, Device, DeviceQr, NewPassword, WebAuthn}
+}
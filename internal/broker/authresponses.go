@@ -16,6 +16,10 @@ func (userInfoMessage) isAuthenticatedDataResponse() {}
 // errorMessage represents the error message that is returned to authd.
 type errorMessage struct {
 	Message string `json:"message"`
+
+	// err is the cause of the failure, which is not sent to authd. The metrics count the failures by the authentication
+	// error it wraps.
+	err error
 }
 
 func (errorMessage) isAuthenticatedDataResponse() {}
@@ -10,7 +10,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os/user"
 	"path/filepath"
 	"slices"
 	"strings"
@@ -20,6 +25,7 @@ import (
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/google/uuid"
 	"github.com/ubuntu/authd-oidc-brokers/internal/broker/authmodes"
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker/sessionmode"
 	"github.com/ubuntu/authd-oidc-brokers/internal/consts"
 	"github.com/ubuntu/authd-oidc-brokers/internal/fileutils"
 	"github.com/ubuntu/authd-oidc-brokers/internal/password"
@@ -32,7 +38,8 @@ import (
 )
 
 const (
-	maxAuthAttempts    = 3
+	maxAuthAttempts = 3
+	// maxRequestDuration is how long a request to the providers can take, unless configured otherwise.
 	maxRequestDuration = 5 * time.Second
 )
 
@@ -48,14 +55,50 @@ type Config struct {
 // Broker is the real implementation of the broker to track sessions and process oidc calls.
 type Broker struct {
 	cfg Config
-
-	provider providers.Provider
-	oidcCfg  oidc.Config
+	// cfgMu protects the settings which can be changed by ReloadConfig.
+	cfgMu sync.RWMutex
+
+	// customProvider replaces the provider-specific implementations selected for the configured providers, if set.
+	customProvider providers.Provider
+	// tokenOpts are the options to store and load the cached tokens and the other secret data.
+	tokenOpts []token.Option
+	// tokenStore stores the tokens of the users.
+	tokenStore TokenStore
+	// httpClient is the client for the requests to the providers, if the default one can not be used.
+	httpClient *http.Client
 
 	currentSessions   map[string]session
 	currentSessionsMu sync.RWMutex
+	// persistMu serializes the writes of the persisted sessions.
+	persistMu sync.Mutex
+	// persistedState is the state of the sessions last persisted, to only store them again when it changes. It is
+	// protected by persistMu.
+	persistedState []byte
+	// usernamesMu serializes the accesses to the stored usernames of the users.
+	usernamesMu sync.Mutex
+	// uidsMu serializes the accesses to the stored UIDs of the users.
+	uidsMu sync.Mutex
+	// gidsMu serializes the accesses to the stored GIDs of the groups.
+	gidsMu sync.Mutex
+	// auditMu serializes the writes and the rotations of the audit log.
+	auditMu sync.Mutex
+	// userRemovalMu serializes the removals of the users whose account was removed at the provider.
+	userRemovalMu sync.Mutex
+	// capabilities are the results of the check of the capabilities of the providers when the broker started.
+	capabilities   []ProviderCapabilities
+	capabilitiesMu sync.Mutex
 
 	privateKey *rsa.PrivateKey
+
+	// readOnly is set for the brokers of the CLI commands, see NewReadOnly.
+	readOnly bool
+
+	logger           *slog.Logger
+	metrics          metrics
+	discovery        discoveryStatus
+	userInfoCache    userInfoCache
+	passwordThrottle passwordThrottle
+	drain            drainState
 }
 
 type session struct {
@@ -68,18 +111,32 @@ type session struct {
 	authModes         []string
 	attemptsPerMode   map[string]int
 
+	issuerURL             string
+	acceptedIssuers       []string
+	authParams            map[string]string
 	oidcServer            *oidc.Provider
+	provider              providers.Provider
+	clientAuth            clientAuth
+	jwksFile              string
+	tokenAudience         string
 	oauth2Config          oauth2.Config
+	discoveryDoc          discoveryDocument
 	authInfo              map[string]any
 	isOffline             bool
 	userDataDir           string
 	passwordPath          string
-	tokenPath             string
 	oldEncryptedTokenPath string
 
 	currentAuthStep int
 
 	isAuthenticating *isAuthenticatedCtx
+
+	// created is when the session was created, before the broker restarted if it was resumed.
+	created time.Time
+	// lastActivity is when the session was last updated by a request of authd.
+	lastActivity time.Time
+	// idleTimer ends the session once it is idle for longer than the session idle timeout, if one is configured.
+	idleTimer *time.Timer
 }
 
 type isAuthenticatedCtx struct {
@@ -88,14 +145,44 @@ type isAuthenticatedCtx struct {
 }
 
 type option struct {
-	provider providers.Provider
+	provider   providers.Provider
+	logger     *slog.Logger
+	tokenStore TokenStore
 }
 
 // Option is a func that allows to override some of the broker default settings.
 type Option func(*option)
 
+// WithLogger makes the broker log with the given logger instead of the default one.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *option) {
+		o.logger = logger
+	}
+}
+
+// WithTokenStore makes the broker store the tokens of the users in the given store, instead of in files of the data
+// directory. The store is in charge of protecting the tokens, which are then not encrypted by the broker.
+func WithTokenStore(store TokenStore) Option {
+	return func(o *option) {
+		o.tokenStore = store
+	}
+}
+
 // New returns a new oidc Broker with the providers listed in the configuration file.
 func New(cfg Config, args ...Option) (b *Broker, err error) {
+	return newBroker(cfg, false, args...)
+}
+
+// NewReadOnly returns a broker for the CLI commands, which run next to the daemon. Unlike New, it neither checks the
+// capabilities of the providers nor restores or removes the sessions persisted by the daemon, and the authentications
+// it runs, like DryRun, write nothing to the data directory. Only the methods meant to change the data, like
+// RemoveUser, do.
+func NewReadOnly(cfg Config, args ...Option) (b *Broker, err error) {
+	return newBroker(cfg, true, args...)
+}
+
+// newBroker returns a new broker, which is read-only if readOnly is set.
+func newBroker(cfg Config, readOnly bool, args ...Option) (b *Broker, err error) {
 	defer decorate.OnError(&err, "could not create broker")
 
 	p := providers.CurrentProvider()
@@ -108,21 +195,17 @@ func New(cfg Config, args ...Option) (b *Broker, err error) {
 	}
 
 	opts := option{
-		provider: p,
+		logger: slog.Default(),
 	}
 	for _, arg := range args {
 		arg(&opts)
 	}
+	cfg.selectProviders(cfg.providerSettings(), opts.provider)
 
 	if cfg.DataDir == "" {
 		err = errors.Join(err, errors.New("cache path is required and was not provided"))
 	}
-	if cfg.issuerURL == "" {
-		err = errors.Join(err, errors.New("issuer URL is required and was not provided"))
-	}
-	if cfg.clientID == "" {
-		err = errors.Join(err, errors.New("client ID is required and was not provided"))
-	}
+	err = errors.Join(err, cfg.checkOIDCSettings())
 	if err != nil {
 		return nil, err
 	}
@@ -130,32 +213,113 @@ func New(cfg Config, args ...Option) (b *Broker, err error) {
 	if cfg.homeBaseDir == "" {
 		cfg.homeBaseDir = "/home"
 	}
+	if cfg.onUserRemoval == "" {
+		cfg.onUserRemoval = userRemovalKeep
+	}
 
 	// Generate a new private key for the broker.
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		slog.Error(err.Error())
+		opts.logger.Error(err.Error())
 		return nil, errors.New("failed to generate broker private key")
 	}
 
+	httpClient, err := cfg.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.insecureSkipVerify {
+		opts.logger.Warn("The TLS certificates of the identity providers are NOT verified, the tokens can be " +
+			"intercepted and forged: only enable insecure_skip_verify for debugging")
+	}
+
+	if err := cfg.resolveClientSecrets(opts.logger); err != nil {
+		return nil, fmt.Errorf("could not get the client secret: %v", err)
+	}
+
+	var tokenOpts []token.Option
+	if keySource := cfg.tokenKeySource(); keySource != nil {
+		key, err := keySource.Key()
+		if err != nil {
+			return nil, fmt.Errorf("could not get the token cache encryption key: %v", err)
+		}
+		tokenOpts = append(tokenOpts, token.WithEncryptionKey(key))
+	}
+	switch {
+	case opts.tokenStore != nil:
+	case cfg.tokenStore == tokenStoreMemory:
+		opts.logger.Info("The tokens are only kept in memory, the users can not log in offline after the broker restarts")
+		opts.tokenStore = NewMemoryTokenStore()
+	default:
+		opts.tokenStore = NewFileTokenStore(cfg.DataDir, tokenOpts...)
+	}
+
 	b = &Broker{
-		cfg:        cfg,
-		provider:   opts.provider,
-		oidcCfg:    oidc.Config{ClientID: cfg.clientID},
-		privateKey: privateKey,
+		cfg:            cfg,
+		customProvider: opts.provider,
+		tokenOpts:      tokenOpts,
+		tokenStore:     opts.tokenStore,
+		httpClient:     httpClient,
+		privateKey:     privateKey,
+		readOnly:       readOnly,
+		logger:         opts.logger,
 
 		currentSessions:   make(map[string]session),
 		currentSessionsMu: sync.RWMutex{},
 	}
+	if readOnly {
+		return b, nil
+	}
+	if err := b.probeCapabilities(); err != nil {
+		return nil, err
+	}
+	if cfg.persistSessions {
+		b.restoreSessions()
+	} else {
+		b.removePersistedSessions()
+	}
 	return b, nil
 }
 
-// NewSession creates a new session for the user.
+// NewSession creates a new session for the user, with the identity provider selected by the domain of the username.
+//
+// The mode is one of the session modes: in a sessionmode.Login session, the user authenticates with the provider or
+// with the local password, and creates the local password if needed. In a sessionmode.ChangePassword session, the user
+// authenticates with the current local password and then sets a new one, without authenticating with the provider,
+// which requires the user to have logged in before.
 func (b *Broker) NewSession(username, lang, mode string) (sessionID, encryptionKey string, err error) {
 	defer decorate.OnError(&err, "could not create new session for user %q", username)
 
+	if b.isDraining() {
+		return "", "", errDraining
+	}
+
+	pubASN1, err := x509.MarshalPKIXPublicKey(&b.privateKey.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	s, err := b.newSession(username, lang, mode)
+	if err != nil {
+		return "", "", err
+	}
+
 	sessionID = uuid.New().String()
-	s := session{
+	if err := b.addSession(sessionID, s); err != nil {
+		return "", "", err
+	}
+
+	return sessionID, base64.StdEncoding.EncodeToString(pubASN1), nil
+}
+
+// newSession returns the state of a new session for the user, connected to the identity provider selected by the
+// domain of the username.
+func (b *Broker) newSession(username, lang, mode string) (s session, err error) {
+	if !slices.Contains(sessionmode.All(), mode) {
+		return s, fmt.Errorf("unknown session mode %q, must be %q or %q", mode, sessionmode.Login, sessionmode.ChangePassword)
+	}
+
+	s = session{
 		username: username,
 		lang:     lang,
 		mode:     mode,
@@ -164,49 +328,135 @@ func (b *Broker) NewSession(username, lang, mode string) (sessionID, encryptionK
 		attemptsPerMode: make(map[string]int),
 	}
 
-	pubASN1, err := x509.MarshalPKIXPublicKey(&b.privateKey.PublicKey)
+	// Take a snapshot of the settings that can be reloaded, so that the session keeps using the same ones.
+	b.cfgMu.RLock()
+	p, err := b.cfg.oidcProviderFor(username)
+	b.cfgMu.RUnlock()
 	if err != nil {
-		return "", "", err
-	}
-
-	_, issuer, _ := strings.Cut(b.cfg.issuerURL, "://")
-	issuer = strings.ReplaceAll(issuer, "/", "_")
-	issuer = strings.ReplaceAll(issuer, ":", "_")
-	s.userDataDir = filepath.Join(b.cfg.DataDir, issuer, username)
-	// The token is stored in $DATA_DIR/$ISSUER/$USERNAME/token.json.
-	s.tokenPath = filepath.Join(s.userDataDir, "token.json")
+		return s, err
+	}
+	issuerURL := p.issuerURL
+	s.issuerURL = issuerURL
+	s.provider = p.provider
+	s.acceptedIssuers = p.acceptedIssuers
+	s.authParams = p.authParams
+	s.clientAuth = p.clientAuth
+	s.jwksFile = p.jwksFile
+	s.tokenAudience = p.tokenAudience
+
+	issuer := issuerDirName(issuerURL)
+	s.userDataDir = b.userDataDir(issuerURL, username)
 	// The password is stored in $DATA_DIR/$ISSUER/$USERNAME/password.
 	s.passwordPath = filepath.Join(s.userDataDir, "password")
 	s.oldEncryptedTokenPath = filepath.Join(b.cfg.OldEncryptedTokensDir, issuer, username+".cache")
 
 	// Construct an OIDC provider via OIDC discovery.
-	s.oidcServer, err = b.connectToOIDCServer(context.Background())
+	// The discovery document is cached in $DATA_DIR/$ISSUER.discovery.json.
+	discoveryCachePath := filepath.Join(b.cfg.DataDir, issuer+discoveryCacheSuffix)
+	ctx := b.withHTTPClient(context.Background())
+	s.oidcServer, err = b.connectToOIDCServer(ctx, issuerURL, discoveryCachePath)
 	if err != nil {
-		slog.Debug(fmt.Sprintf("Could not connect to the provider: %v. Starting session in offline mode.", err))
+		b.logger.Debug(fmt.Sprintf("Could not connect to the provider: %v. Starting session in offline mode.", err))
 		s.isOffline = true
+		s.oidcServer = b.cachedOIDCServer(ctx, issuerURL, discoveryCachePath)
 	}
 
 	if s.oidcServer != nil {
-		s.oauth2Config = oauth2.Config{
-			ClientID:     b.oidcCfg.ClientID,
-			ClientSecret: b.cfg.clientSecret,
-			Endpoint:     s.oidcServer.Endpoint(),
-			Scopes:       append(consts.DefaultScopes, b.provider.AdditionalScopes()...),
+		s.oauth2Config = p.clientConfig(s.oidcServer.Endpoint(), b.scopes(p))
+		if s.discoveryDoc, err = discoveryDocumentOf(s.oidcServer, discoveryCachePath, issuerURL); err != nil {
+			b.logger.Warn(fmt.Sprintf("Could not get the discovery document of %q: %v", issuerURL, err))
 		}
 	}
 
-	b.currentSessionsMu.Lock()
-	b.currentSessions[sessionID] = s
-	b.currentSessionsMu.Unlock()
+	return s, nil
+}
 
-	return sessionID, base64.StdEncoding.EncodeToString(pubASN1), nil
+// issuerDirName returns the name of the directory where the data of the issuer is stored.
+func issuerDirName(issuerURL string) string {
+	_, issuer, _ := strings.Cut(issuerURL, "://")
+	issuer = strings.ReplaceAll(issuer, "/", "_")
+	return strings.ReplaceAll(issuer, ":", "_")
 }
 
-func (b *Broker) connectToOIDCServer(ctx context.Context) (*oidc.Provider, error) {
-	ctx, cancel := context.WithTimeout(ctx, maxRequestDuration)
-	defer cancel()
+// userDataDir returns the directory where the data of the user of the issuer is stored, $DATA_DIR/$ISSUER/$USERNAME.
+func (b *Broker) userDataDir(issuerURL, username string) string {
+	return filepath.Join(b.cfg.DataDir, issuerDirName(issuerURL), username)
+}
 
-	return oidc.NewProvider(ctx, b.cfg.issuerURL)
+// ReloadConfig parses the configuration file again and applies the OIDC settings (the providers with their issuer,
+// client ID and secret, provider type, and extra scopes) to the sessions created from now on. The existing sessions keep the settings they were created with.
+// The changes of the other settings are logged as needing a restart of the broker.
+// If the new configuration is invalid, the current one is kept.
+func (b *Broker) ReloadConfig() (err error) {
+	defer decorate.OnError(&err, "could not reload configuration")
+
+	if b.cfg.ConfigFile == "" {
+		return errors.New("the broker was not started with a configuration file")
+	}
+
+	newCfg, err := parseConfigFile(b.cfg.ConfigFile, b.cfg.provider)
+	if err != nil {
+		return fmt.Errorf("could not parse config: %v", err)
+	}
+	if err := newCfg.checkOIDCSettings(); err != nil {
+		return err
+	}
+	if err := newCfg.resolveClientSecrets(b.logger); err != nil {
+		return fmt.Errorf("could not get the client secret: %v", err)
+	}
+	// The provider-specific settings, like the groups claim, are not reloaded, but the provider types are.
+	newCfg.selectProviders(b.cfg.providerSettings(), b.customProvider)
+
+	b.cfgMu.Lock()
+	defer b.cfgMu.Unlock()
+
+	b.cfg.issuerURL = newCfg.issuerURL
+	b.cfg.clientID = newCfg.clientID
+	b.cfg.clientSecret = newCfg.clientSecret
+	b.cfg.clientAuth = newCfg.clientAuth
+	b.cfg.jwksFile = newCfg.jwksFile
+	b.cfg.tokenAudience = newCfg.tokenAudience
+	b.cfg.publicClientID = newCfg.publicClientID
+	b.cfg.clientType = newCfg.clientType
+	b.cfg.extraScopes = newCfg.extraScopes
+	b.cfg.acceptedIssuers = newCfg.acceptedIssuers
+	b.cfg.authParams = newCfg.authParams
+	b.cfg.oidcProviders = newCfg.oidcProviders
+	b.cfg.defaultProvider = newCfg.defaultProvider
+	b.cfg.providerType = newCfg.providerType
+	b.cfg.sectionProvider = newCfg.sectionProvider
+
+	b.logger.Info(fmt.Sprintf("Reloaded configuration from %q", b.cfg.ConfigFile))
+	// The other settings are kept as the broker started with, so their changes are reported until it restarts.
+	if changed := unappliedChanges(b.cfg.settings, newCfg.settings); len(changed) > 0 {
+		b.logger.Warn(fmt.Sprintf("The changes of %s are only applied when the broker restarts", strings.Join(changed, ", ")))
+	}
+	return nil
+}
+
+// scopes returns the scopes to request: the default ones, followed by the ones required by the provider and the extra
+// ones configured by the administrator, without duplicates.
+func (b *Broker) scopes(p oidcProvider) []string {
+	var scopes []string
+	for _, scope := range slices.Concat(consts.DefaultScopes, p.provider.AdditionalScopes(), p.extraScopes) {
+		if scope == "" || slices.Contains(scopes, scope) {
+			continue
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes
+}
+
+// providerFor returns the provider-specific implementation of the identity provider selected by the domain of the
+// username, or the one of the first configured provider if none authenticates the user.
+func (b *Broker) providerFor(username string) providers.Provider {
+	b.cfgMu.RLock()
+	defer b.cfgMu.RUnlock()
+
+	if p, err := b.cfg.oidcProviderFor(username); err == nil {
+		return p.provider
+	}
+	return b.cfg.configuredProviders()[0].provider
 }
 
 // GetAuthenticationModes returns the authentication modes available for the user.
@@ -216,24 +466,52 @@ func (b *Broker) GetAuthenticationModes(sessionID string, supportedUILayouts []m
 		return nil, err
 	}
 
+	if b.cfg.disablePassword && session.mode == sessionmode.ChangePassword {
+		return nil, fmt.Errorf("the local password of user %q can not be changed, as local passwords are disabled", session.username)
+	}
+
 	supportedAuthModes := b.supportedAuthModesFromLayout(supportedUILayouts)
 
-	slog.Debug(fmt.Sprintf("Supported UI Layouts for session %s: %#v", sessionID, supportedUILayouts))
-	slog.Debug(fmt.Sprintf("Supported Authentication modes for session %s: %#v", sessionID, supportedAuthModes))
+	b.logger.Debug(fmt.Sprintf("Supported UI Layouts for session %s: %#v", sessionID, supportedUILayouts))
+	b.logger.Debug(fmt.Sprintf("Supported Authentication modes for session %s: %#v", sessionID, supportedAuthModes))
 
-	// Checks if the token exists in the cache.
-	tokenExists, err := fileutils.FileExists(session.tokenPath)
-	if err != nil {
-		slog.Warn(fmt.Sprintf("Could not check if token exists: %v", err))
+	// Checks if the token exists in the store.
+	_, err = b.tokenStore.Load(session.issuerURL, session.username)
+	tokenExists := err == nil || errors.Is(err, token.ErrInvalidCache)
+	if err != nil && !tokenExists && !errors.Is(err, fs.ErrNotExist) {
+		b.logger.Warn(fmt.Sprintf("Could not check if token exists: %v", err))
+	}
+	// An encrypted token can become undecryptable, e.g. if the machine ID changed. It is then handled as if there was
+	// no token, so that the user authenticates with the provider again instead of being offered the local password.
+	if errors.Is(err, token.ErrInvalidCache) && b.tokenOpts != nil {
+		b.logger.Warn(fmt.Sprintf("Ignoring the cached token of session %s: %v", sessionID, err))
+		tokenExists = false
 	}
 	if !tokenExists {
 		// Check the old encrypted token path.
 		tokenExists, err = fileutils.FileExists(session.oldEncryptedTokenPath)
 		if err != nil {
-			slog.Warn(fmt.Sprintf("Could not check if old encrypted token exists: %v", err))
+			b.logger.Warn(fmt.Sprintf("Could not check if old encrypted token exists: %v", err))
 		}
 	}
 
+	// Without local password, the cached token only serves to refresh the user info, and the new password step never
+	// comes as the user is granted access right after authenticating with the provider.
+	if b.cfg.disablePassword {
+		delete(supportedAuthModes, authmodes.Password)
+		delete(supportedAuthModes, authmodes.NewPassword)
+		tokenExists = false
+	}
+
+	// In an auth session, the local password is only offered along with other modes, so we hide it if the UI can not
+	// render a password entry instead of failing because the provider offers it. A passwd session requires it though.
+	if _, ok := supportedAuthModes[authmodes.Password]; !ok && tokenExists && session.mode != sessionmode.ChangePassword {
+		b.logger.Debug(fmt.Sprintf("Not offering the local password for session %s, as no UI layout supports it", sessionID))
+		tokenExists = false
+	}
+
+	// The endpoints only include the modes supported by the UI layouts, so that device_auth is offered instead of
+	// device_auth_qr if the UI does not render QR codes.
 	endpoints := make(map[string]struct{})
 	if session.oidcServer != nil && session.oidcServer.Endpoint().DeviceAuthURL != "" {
 		authMode := authmodes.DeviceQr
@@ -245,8 +523,13 @@ func (b *Broker) GetAuthenticationModes(sessionID string, supportedUILayouts []m
 			endpoints[authMode] = struct{}{}
 		}
 	}
+	if _, ok := session.provider.(providers.WebAuthnProvider); ok && session.oidcServer != nil {
+		if _, ok := supportedAuthModes[authmodes.WebAuthn]; ok {
+			endpoints[authmodes.WebAuthn] = struct{}{}
+		}
+	}
 
-	availableModes, err := b.provider.CurrentAuthenticationModesOffered(
+	availableModes, err := session.provider.CurrentAuthenticationModesOffered(
 		session.mode,
 		supportedAuthModes,
 		tokenExists,
@@ -256,6 +539,7 @@ func (b *Broker) GetAuthenticationModes(sessionID string, supportedUILayouts []m
 	if err != nil {
 		return nil, err
 	}
+	availableModes = orderAuthModes(availableModes, b.cfg.authModeOrder)
 
 	for _, id := range availableModes {
 		authModes = append(authModes, map[string]string{
@@ -276,6 +560,30 @@ func (b *Broker) GetAuthenticationModes(sessionID string, supportedUILayouts []m
 	return authModes, nil
 }
 
+// orderAuthModes returns the offered modes in the configured order, followed by the offered modes which are not listed
+// in it, in their original order. The modes which are not offered are ignored. device_auth_qr takes the place of
+// device_auth if only the latter is listed, as which of the two is offered depends on the UI.
+func orderAuthModes(offered, order []string) []string {
+	if len(order) == 0 {
+		return offered
+	}
+
+	rank := func(mode string) int {
+		i := slices.Index(order, mode)
+		if i < 0 && mode == authmodes.DeviceQr {
+			i = slices.Index(order, authmodes.Device)
+		}
+		if i < 0 {
+			return len(order)
+		}
+		return i
+	}
+
+	ordered := slices.Clone(offered)
+	slices.SortStableFunc(ordered, func(a, b string) int { return rank(a) - rank(b) })
+	return ordered
+}
+
 func (b *Broker) supportedAuthModesFromLayout(supportedUILayouts []map[string]string) (supportedModes map[string]string) {
 	supportedModes = make(map[string]string)
 	for _, layout := range supportedUILayouts {
@@ -300,6 +608,9 @@ func (b *Broker) supportedAuthModesFromLayout(supportedUILayouts []map[string]st
 			if slices.Contains(supportedEntries, "chars_password") {
 				supportedModes[authmodes.NewPassword] = "Define your local password"
 			}
+
+		case "webauthn":
+			supportedModes[authmodes.WebAuthn] = "Security Key Authentication"
 		}
 	}
 
@@ -333,6 +644,24 @@ func (b *Broker) SelectAuthenticationMode(sessionID, authModeID string) (uiLayou
 	return uiLayoutInfo, nil
 }
 
+// loginHintAuthOptions returns the parameter of the authorization request which tells the provider the username the user
+// already entered, if configured.
+func (b *Broker) loginHintAuthOptions(username string) []oauth2.AuthCodeOption {
+	if !b.cfg.sendLoginHint || username == "" {
+		return nil
+	}
+	return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("login_hint", username)}
+}
+
+// authParamsAuthOptions returns the configured extra parameters of the authorization request.
+func authParamsAuthOptions(params map[string]string) []oauth2.AuthCodeOption {
+	var opts []oauth2.AuthCodeOption
+	for k, v := range params {
+		opts = append(opts, oauth2.SetAuthURLParam(k, v))
+	}
+	return opts
+}
+
 func (b *Broker) generateUILayout(session *session, authModeID string) (map[string]string, error) {
 	if !slices.Contains(session.authModes, authModeID) {
 		return nil, fmt.Errorf("selected authentication mode %q does not exist", authModeID)
@@ -341,7 +670,7 @@ func (b *Broker) generateUILayout(session *session, authModeID string) (map[stri
 	var uiLayout map[string]string
 	switch authModeID {
 	case authmodes.Device, authmodes.DeviceQr:
-		ctx, cancel := context.WithTimeout(context.Background(), maxRequestDuration)
+		ctx, cancel := context.WithTimeout(withClientAssertion(b.withHTTPClient(context.Background()), session), b.cfg.requestTimeout())
 		defer cancel()
 
 		var authOpts []oauth2.AuthCodeOption
@@ -359,11 +688,16 @@ func (b *Broker) generateUILayout(session *session, authModeID string) (map[stri
 		// some implement neither.
 		// This was tested with the following providers:
 		// - Ory Hydra: supports client_secret_post
-		// TODO @shipperizer: client_authentication methods should be configurable
+		// With private_key_jwt, there is no secret: the client assertion is added by the HTTP client of ctx instead.
 		if secret := session.oauth2Config.ClientSecret; secret != "" {
 			authOpts = append(authOpts, oauth2.SetAuthURLParam("client_secret", secret))
 		}
 
+		authOpts = append(authOpts, b.maxAgeAuthOptions()...)
+		authOpts = append(authOpts, b.loginHintAuthOptions(session.username)...)
+		authOpts = append(authOpts, authParamsAuthOptions(session.authParams)...)
+		authOpts = append(authOpts, tokenAudienceAuthOptions(session.tokenAudience, session.oauth2Config.Endpoint)...)
+
 		response, err := session.oauth2Config.DeviceAuth(ctx, authOpts...)
 		if err != nil {
 			return nil, fmt.Errorf("could not generate Device Authentication code layout: %v", err)
@@ -374,11 +708,21 @@ func (b *Broker) generateUILayout(session *session, authModeID string) (map[stri
 			"Access %q and use the provided login code",
 			response.VerificationURI,
 		)
+		content := response.VerificationURI
 		if authModeID == authmodes.DeviceQr {
 			label = fmt.Sprintf(
 				"Scan the QR code or access %q and use the provided login code",
 				response.VerificationURI,
 			)
+			// The complete verification URI embeds the login code, so that scanning the QR code is enough. It is not
+			// used in the text layout, where the short URI is easier to type, and the code is shown in both cases.
+			if response.VerificationURIComplete != "" {
+				label = fmt.Sprintf(
+					"Scan the QR code to log in, or access %q and use the provided login code",
+					response.VerificationURI,
+				)
+				content = response.VerificationURIComplete
+			}
 		}
 
 		uiLayout = map[string]string{
@@ -386,10 +730,31 @@ func (b *Broker) generateUILayout(session *session, authModeID string) (map[stri
 			"label":   label,
 			"wait":    "true",
 			"button":  "Request new login code",
-			"content": response.VerificationURI,
+			"content": content,
 			"code":    response.UserCode,
 		}
 
+	case authmodes.WebAuthn:
+		p, ok := session.provider.(providers.WebAuthnProvider)
+		if !ok {
+			return nil, errors.New("provider does not support WebAuthn")
+		}
+
+		ctx, cancel := context.WithTimeout(withClientAssertion(b.withHTTPClient(context.Background()), session), b.cfg.requestTimeout())
+		defer cancel()
+
+		challenge, err := p.WebAuthnChallenge(ctx, session.oauth2Config, session.username)
+		if err != nil {
+			return nil, fmt.Errorf("could not generate WebAuthn challenge: %v", err)
+		}
+		session.authInfo["webauthn_challenge"] = challenge
+
+		uiLayout = map[string]string{
+			"type":    "webauthn",
+			"label":   "Use your security key to log in",
+			"content": challenge,
+		}
+
 	case authmodes.Password:
 		uiLayout = map[string]string{
 			"type":  "form",
@@ -399,7 +764,7 @@ func (b *Broker) generateUILayout(session *session, authModeID string) (map[stri
 
 	case authmodes.NewPassword:
 		label := "Create a local password"
-		if session.mode == "passwd" {
+		if session.mode == sessionmode.ChangePassword {
 			label = "Update your local password"
 		}
 
@@ -414,23 +779,44 @@ func (b *Broker) generateUILayout(session *session, authModeID string) (map[stri
 }
 
 // IsAuthenticated evaluates the provided authenticationData and returns the authentication status for the user.
+//
+// The evaluation runs under a context stored in the session, so that CancelIsAuthenticated aborts the pending requests
+// to the provider (e.g. polling the token endpoint in the device flow) and IsAuthenticated returns AuthCancelled.
 func (b *Broker) IsAuthenticated(sessionID, authenticationData string) (string, string, error) {
+	access, iadResponse, err := b.isAuthenticated(sessionID, authenticationData)
+
+	encoded, marshalErr := json.Marshal(iadResponse)
+	if marshalErr != nil {
+		return AuthDenied, "{}", fmt.Errorf("could not parse data to JSON: %v", marshalErr)
+	}
+
+	data := string(encoded)
+	if data == "null" {
+		data = "{}"
+	}
+	return access, data, err
+}
+
+// isAuthenticated is IsAuthenticated, returning the data to send to authd before it is serialized. If it holds an
+// errorMessage, its cause can be matched against the authentication errors.
+func (b *Broker) isAuthenticated(sessionID, authenticationData string) (string, isAuthenticatedDataResponse, error) {
 	session, err := b.getSession(sessionID)
 	if err != nil {
-		return AuthDenied, "{}", err
+		return AuthDenied, nil, err
 	}
 
 	var authData map[string]string
 	if authenticationData != "" {
 		if err := json.Unmarshal([]byte(authenticationData), &authData); err != nil {
-			return AuthDenied, "{}", fmt.Errorf("authentication data is not a valid json value: %v", err)
+			return AuthDenied, nil, fmt.Errorf("authentication data is not a valid json value: %v", err)
 		}
 	}
 
 	ctx, err := b.startAuthenticate(sessionID)
 	if err != nil {
-		return AuthDenied, "{}", err
+		return AuthDenied, nil, err
 	}
+	b.drain.begin()
 
 	// Cleans up the IsAuthenticated context when the call is done.
 	defer b.CancelIsAuthenticated(sessionID)
@@ -445,151 +831,228 @@ func (b *Broker) IsAuthenticated(sessionID, authenticationData string) (string,
 
 	select {
 	case <-authDone:
+		defer b.drain.end()
 	case <-ctx.Done():
-		// We can ignore the error here since the message is constant.
-		msg, _ := json.Marshal(errorMessage{Message: "authentication request cancelled"})
-		return AuthCancelled, string(msg), ctx.Err()
-	}
+		// The call returns as soon as it is cancelled, but it is only drained once the authentication stopped, so that
+		// the broker does not stop while it still writes the data of the user.
+		go func() {
+			<-authDone
+			b.drain.end()
+		}()
+		b.metrics.recordAuthentication(session.selectedMode, AuthCancelled, nil)
+		access, msg := authCancelled(ctx)
+		return access, msg, ctx.Err()
+	}
+	b.metrics.recordAuthentication(session.selectedMode, access, iadResponse)
 
 	switch access {
 	case AuthRetry:
 		session.attemptsPerMode[session.selectedMode]++
 		if session.attemptsPerMode[session.selectedMode] == maxAuthAttempts {
 			access = AuthDenied
-			iadResponse = errorMessage{Message: "maximum number of attempts reached"}
+			var cause error
+			if msg, ok := iadResponse.(errorMessage); ok {
+				cause = msg.err
+			}
+			iadResponse = errorMessage{Message: "maximum number of attempts reached", err: cause}
 		}
 
 	case AuthNext:
 		session.currentAuthStep++
-	}
 
-	if err = b.updateSession(sessionID, session); err != nil {
-		return AuthDenied, "{}", err
+	case AuthGranted:
+		b.resetPasswordFailures(session.username)
 	}
+	b.auditDecision(&session, access, iadResponse)
 
-	encoded, err := json.Marshal(iadResponse)
-	if err != nil {
-		return AuthDenied, "{}", fmt.Errorf("could not parse data to JSON: %v", err)
+	if err = b.updateSession(sessionID, session); err != nil {
+		return AuthDenied, nil, err
 	}
 
-	data := string(encoded)
-	if data == "null" {
-		data = "{}"
-	}
-	return access, data, nil
+	return access, iadResponse, nil
 }
 
 func (b *Broker) handleIsAuthenticated(ctx context.Context, session *session, authData map[string]string) (access string, data isAuthenticatedDataResponse) {
 	defer decorateErrorMessage(&data, "authentication failure")
 
 	// Decrypt challenge if present.
-	challenge, err := decodeRawChallenge(b.privateKey, authData["challenge"])
+	challenge, err := b.decodeRawChallenge(authData["challenge"])
 	if err != nil {
-		slog.Error(err.Error())
+		b.logger.Error(err.Error())
 		return AuthRetry, errorMessage{Message: "could not decode challenge"}
 	}
 
+	// The password modes are not offered then, but could still be selected.
+	if b.cfg.disablePassword && (session.selectedMode == authmodes.Password || session.selectedMode == authmodes.NewPassword) {
+		return AuthDenied, errorMessage{Message: "local password authentication is disabled"}
+	}
+
 	var authInfo token.AuthCachedInfo
 	switch session.selectedMode {
 	case authmodes.Device, authmodes.DeviceQr:
 		response, ok := session.authInfo["response"].(*oauth2.DeviceAuthResponse)
 		if !ok {
-			slog.Error("could not get device auth response")
+			b.logger.Error("could not get device auth response")
 			return AuthDenied, errorMessage{Message: "could not get required response"}
 		}
 
 		if response.Expiry.IsZero() {
 			response.Expiry = time.Now().Add(time.Hour)
 		}
-		expiryCtx, cancel := context.WithDeadline(ctx, response.Expiry)
+		deadline := response.Expiry
+		if maxWait := b.cfg.deviceAuthMaxWait; maxWait > 0 && time.Now().Add(maxWait).Before(deadline) {
+			deadline = time.Now().Add(maxWait)
+		}
+		expiryCtx, cancel := context.WithDeadline(ctx, deadline)
 		defer cancel()
-		t, err := session.oauth2Config.DeviceAccessToken(expiryCtx, response, b.provider.AuthOptions()...)
+		tokenOpts := slices.Concat(session.provider.AuthOptions(), tokenAudienceAuthOptions(session.tokenAudience, session.oauth2Config.Endpoint))
+		t, err := session.oauth2Config.DeviceAccessToken(expiryCtx, b.withPollJitter(response), tokenOpts...)
 		if err != nil {
-			slog.Error(err.Error())
-			return AuthRetry, errorMessage{Message: "could not authenticate user remotely"}
+			b.logger.Error(err.Error())
+			return deviceAccessTokenFailure(err, deadline)
 		}
 
-		if err = b.provider.CheckTokenScopes(t); err != nil {
-			slog.Warn(err.Error())
+		authInfo, data = b.authInfoFromToken(ctx, session, t)
+		if data != nil {
+			return AuthDenied, data
 		}
 
-		rawIDToken, ok := t.Extra("id_token").(string)
+		session.authInfo["auth_info"] = authInfo
+		// The user is granted access right away if they can not define a local password.
+		if !b.cfg.disablePassword {
+			return AuthNext, nil
+		}
+
+	case authmodes.WebAuthn:
+		p, ok := session.provider.(providers.WebAuthnProvider)
+		if !ok {
+			b.logger.Error("provider does not support WebAuthn")
+			return AuthDenied, errorMessage{Message: "WebAuthn is not supported"}
+		}
+		webAuthnChallenge, ok := session.authInfo["webauthn_challenge"].(string)
 		if !ok {
-			slog.Error("could not get ID token")
-			return AuthDenied, errorMessage{Message: "could not get ID token"}
+			b.logger.Error("could not get WebAuthn challenge")
+			return AuthDenied, errorMessage{Message: "could not get required challenge"}
 		}
 
-		authInfo = token.NewAuthCachedInfo(t, rawIDToken, b.provider)
-		authInfo.UserInfo, err = b.fetchUserInfo(ctx, session, &authInfo)
+		verifyCtx, cancel := context.WithTimeout(ctx, b.cfg.requestTimeout())
+		defer cancel()
+		t, err := p.VerifyWebAuthnAssertion(verifyCtx, session.oauth2Config, webAuthnChallenge, challenge)
 		if err != nil {
-			slog.Error(err.Error())
-			return AuthDenied, errorMessageForDisplay(err, "could not fetch user info")
+			b.logger.Error(err.Error())
+			return AuthRetry, errorMessage{Message: "could not verify security key", err: authError(err)}
+		}
+
+		authInfo, data = b.authInfoFromToken(ctx, session, t)
+		if data != nil {
+			return AuthDenied, data
 		}
 
 		session.authInfo["auth_info"] = authInfo
-		return AuthNext, nil
+		if !b.cfg.disablePassword {
+			return AuthNext, nil
+		}
 
 	case authmodes.Password:
-		useOldEncryptedToken, err := token.UseOldEncryptedToken(session.tokenPath, session.passwordPath, session.oldEncryptedTokenPath)
+		if lockout := b.passwordLockout(session.username); lockout > 0 {
+			return AuthDenied, tooManyAttemptsMessage(lockout)
+		}
+
+		storedToken, loadErr := b.tokenStore.Load(session.issuerURL, session.username)
+		useOldEncryptedToken, err := token.UseOldEncryptedToken(session.passwordPath, !errors.Is(loadErr, fs.ErrNotExist), session.oldEncryptedTokenPath)
 		if err != nil {
-			slog.Error(err.Error())
+			b.logger.Error(err.Error())
 			return AuthDenied, errorMessage{Message: "could not check password file"}
 		}
 
 		if useOldEncryptedToken {
 			authInfo, err = token.LoadOldEncryptedAuthInfo(session.oldEncryptedTokenPath, challenge)
 			if err != nil {
-				slog.Error(err.Error())
+				b.logger.Error(err.Error())
 				return AuthDenied, errorMessage{Message: "could not load encrypted token"}
 			}
 
 			// We were able to decrypt the old token with the password, so we can now hash and store the password in the
 			// new format.
 			if err = password.HashAndStorePassword(challenge, session.passwordPath); err != nil {
-				slog.Error(err.Error())
+				b.logger.Error(err.Error())
 				return AuthDenied, errorMessage{Message: "could not store password"}
 			}
 		} else {
 			ok, err := password.CheckPassword(challenge, session.passwordPath)
 			if err != nil {
-				slog.Error(err.Error())
+				b.logger.Error(err.Error())
 				return AuthDenied, errorMessage{Message: "could not check password"}
 			}
 			if !ok {
+				if lockout := b.recordPasswordFailure(session.username); lockout > 0 {
+					return AuthDenied, tooManyAttemptsMessage(lockout)
+				}
 				return AuthRetry, errorMessage{Message: "incorrect password"}
 			}
 
-			authInfo, err = token.LoadAuthInfo(session.tokenPath)
+			authInfo, err = storedToken, loadErr
+			if errors.Is(err, token.ErrInvalidCache) {
+				b.logger.Error(err.Error())
+				return AuthDenied, errorMessage{Message: "stored token is not usable, authenticate with the provider instead"}
+			}
 			if err != nil {
-				slog.Error(err.Error())
+				b.logger.Error(err.Error())
 				return AuthDenied, errorMessage{Message: "could not load stored token"}
 			}
 		}
 
+		if session.isOffline {
+			if err := b.checkOfflineCredentials(authInfo, time.Now()); err != nil {
+				b.logger.Error(err.Error())
+				return AuthDenied, errorMessage{Message: "cached credentials expired, connect to the network to log in"}
+			}
+		}
+
+		// The refresh token is cleared from the cached token once revoked at the end of a session, with
+		// revoke_on_logout. The cached user info is then used, as when offline, within the offline credential TTL.
+		canRefresh := !authInfo.RefreshTokenRevoked
+		if !session.isOffline && !canRefresh {
+			if err := b.checkOfflineCredentials(authInfo, time.Now()); err != nil {
+				b.logger.Error(err.Error())
+				return AuthDenied, errorMessage{Message: "cached credentials expired, authenticate with the provider instead"}
+			}
+		}
+
 		// Refresh the token if we're online even if the token has not expired
-		if !session.isOffline {
-			authInfo, err = b.refreshToken(ctx, session.oauth2Config, authInfo)
+		if !session.isOffline && canRefresh {
+			authInfo, err = b.refreshToken(ctx, session, authInfo)
 			if err != nil {
-				slog.Error(err.Error())
-				return AuthDenied, errorMessage{Message: "could not refresh token"}
+				b.logger.Error(err.Error())
+				if err = authError(err); errors.Is(err, ErrUserRemoved) {
+					b.handleUserRemoved(session)
+				}
+				return AuthDenied, errorMessage{Message: "could not refresh token", err: err}
 			}
 		}
 
 		// Try to refresh the user info
-		userInfo, err := b.fetchUserInfo(ctx, session, &authInfo)
-		if err != nil && authInfo.UserInfo.Name == "" {
-			// We don't have a valid user info, so we can't proceed.
-			slog.Error(err.Error())
+		var userInfo info.User
+		if canRefresh {
+			userInfo, err = b.fetchUserInfo(ctx, session, &authInfo)
+		} else {
+			err = errors.New("the cached token can not be refreshed")
+		}
+		var groupsErr *providerErrors.GroupsError
+		if err != nil && (authInfo.UserInfo.Name == "" || errors.As(err, &groupsErr)) {
+			// We don't have a valid user info, so we can't proceed. The cached groups are not used either if the groups
+			// could not be fetched, unless the policy for the group fetch errors allows it.
+			b.logger.Error(err.Error())
 			return AuthDenied, errorMessageForDisplay(err, "could not fetch user info")
 		}
 		if err != nil {
 			// We couldn't fetch the user info, but we have a valid cached one.
-			slog.Warn(fmt.Sprintf("Could not fetch user info: %v. Using cached user info.", err))
+			b.logger.Warn(fmt.Sprintf("Could not fetch user info: %v. Using cached user info.", err))
 		} else {
 			authInfo.UserInfo = userInfo
 		}
 
-		if session.mode == "passwd" {
+		if session.mode == sessionmode.ChangePassword {
 			session.authInfo["auth_info"] = authInfo
 			return AuthNext, nil
 		}
@@ -603,20 +1066,45 @@ func (b *Broker) handleIsAuthenticated(ctx context.Context, session *session, au
 		// This mode must always come after a authentication mode, so it has to have an auth_info.
 		authInfo, ok = session.authInfo["auth_info"].(token.AuthCachedInfo)
 		if !ok {
-			slog.Error("could not get required information")
+			b.logger.Error("could not get required information")
 			return AuthDenied, errorMessage{Message: "could not get required information"}
 		}
 
+		if err := b.cfg.passwordPolicy.Check(challenge, session.passwordPath); err != nil {
+			// Let the user choose another password if it does not follow the policy.
+			var policyErr *password.PolicyError
+			if errors.As(err, &policyErr) {
+				return AuthRetry, errorMessage{Message: policyErr.Error()}
+			}
+			b.logger.Error(err.Error())
+			return AuthDenied, errorMessage{Message: "could not check password"}
+		}
+
+		if ctx.Err() != nil {
+			return authCancelled(ctx)
+		}
 		if err = password.HashAndStorePassword(challenge, session.passwordPath); err != nil {
-			slog.Error(err.Error())
+			b.logger.Error(err.Error())
 			return AuthDenied, errorMessage{Message: "could not store password"}
 		}
 	}
 
+	// Check the groups before registering the owner, so that a user who is not allowed cannot become the owner.
+	if !b.userGroupsAreAllowed(authInfo.UserInfo.Groups) {
+		return AuthDenied, errorMessage{Message: "user not in an allowed group", err: ErrNotInAllowedGroup}
+	}
+	// The groups of the previous logins are only added once the current ones granted access, so that a group the user
+	// was removed from never does.
+	authInfo.UserInfo.Groups = b.syncedGroups(session, authInfo.UserInfo.Groups)
+
+	// Nothing is written from here on if the authentication was cancelled, e.g. because the broker is stopping.
+	if ctx.Err() != nil {
+		return authCancelled(ctx)
+	}
 	if err := b.cfg.registerOwner(b.cfg.ConfigFile, authInfo.UserInfo.Name); err != nil {
 		// The user is not allowed if we fail to create the owner-autoregistration file.
 		// Otherwise the owner might change if the broker is restarted.
-		slog.Error(fmt.Sprintf("Failed to assign the owner role: %v", err))
+		b.logger.Error(fmt.Sprintf("Failed to assign the owner role: %v", err))
 		return AuthDenied, errorMessage{Message: "could not register the owner"}
 	}
 
@@ -624,12 +1112,65 @@ func (b *Broker) handleIsAuthenticated(ctx context.Context, session *session, au
 		return AuthDenied, errorMessage{Message: "permission denied"}
 	}
 
+	// The username is only kept once the user is granted access, so that a user who is denied access cannot take it.
+	if err := b.recordUsername(session.issuerURL, authInfo.UserInfo); err != nil {
+		b.logger.Error(fmt.Sprintf("Failed to record the username: %v", err))
+		return AuthDenied, errorMessage{Message: "could not record the username"}
+	}
+
+	if ctx.Err() != nil {
+		return authCancelled(ctx)
+	}
+	uid, err := b.assignUID(session.issuerURL, authInfo.UserInfo)
+	if err != nil {
+		b.logger.Error(fmt.Sprintf("Failed to assign the UID: %v", err))
+		return AuthDenied, errorMessage{Message: "could not assign a UID"}
+	}
+
+	userInfo, err := b.userInfoForLogin(authInfo.UserInfo, session.issuerURL)
+	if err != nil {
+		b.logger.Error(fmt.Sprintf("Failed to assign the GIDs: %v", err))
+		return AuthDenied, errorMessage{Message: "could not assign the GIDs"}
+	}
+	userInfo.UID = uid
+	if ctx.Err() != nil {
+		return authCancelled(ctx)
+	}
+	firstLogin := b.isFirstLogin(session)
+	if err := b.runLoginHooks(userInfo, firstLogin); err != nil {
+		b.logger.Error(err.Error())
+		return AuthDenied, errorMessage{Message: "could not prepare the session of the user"}
+	}
+	if firstLogin {
+		// The first login hook is run again on the next login if it can not be recorded.
+		if err := b.recordFirstLogin(session); err != nil {
+			b.logger.Warn(err.Error())
+		}
+	}
+	session.authInfo[grantedUserInfoKey] = userInfo
+	// The login is granted even if it can not be recorded, as the record is only used for auditing.
+	if err := b.recordLastLogin(session, userInfo); err != nil {
+		b.logger.Warn(err.Error())
+	}
+	if err := b.unflagUserRemoved(session); err != nil {
+		b.logger.Warn(err.Error())
+	}
+	if ctx.Err() != nil {
+		return authCancelled(ctx)
+	}
+	if err := b.populateHomeDir(userInfo.Home); err != nil {
+		b.logger.Warn(err.Error())
+	}
+
 	if session.isOffline {
-		return AuthGranted, userInfoMessage{UserInfo: authInfo.UserInfo}
+		return AuthGranted, userInfoMessage{UserInfo: userInfo}
 	}
 
-	if err := token.CacheAuthInfo(session.tokenPath, authInfo); err != nil {
-		slog.Error(err.Error())
+	if ctx.Err() != nil {
+		return authCancelled(ctx)
+	}
+	if err := b.tokenStore.Save(session.issuerURL, session.username, authInfo); err != nil {
+		b.logger.Error(err.Error())
 		return AuthDenied, errorMessage{Message: "could not cache user info"}
 	}
 
@@ -637,12 +1178,119 @@ func (b *Broker) handleIsAuthenticated(ctx context.Context, session *session, au
 	// encrypted token.
 	token.CleanupOldEncryptedToken(session.oldEncryptedTokenPath)
 
-	return AuthGranted, userInfoMessage{UserInfo: authInfo.UserInfo}
+	// Keep the cached token in the session, so that it can be revoked when the session ends.
+	session.authInfo["auth_info"] = authInfo
+
+	return AuthGranted, userInfoMessage{UserInfo: userInfo}
+}
+
+// authCancelled returns the access and the message of an authentication whose request was cancelled.
+func authCancelled(ctx context.Context) (string, errorMessage) {
+	return AuthCancelled, errorMessage{Message: "authentication request cancelled", err: ctx.Err()}
+}
+
+// deviceCodeExpired returns true if polling the token endpoint for the device access token failed with err because the
+// provider rejected the expired device code, or because the deadline to wait for the user passed.
+func deviceCodeExpired(err error, deadline time.Time) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "expired_token" {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) && !time.Now().Before(deadline)
+}
+
+// deviceAccessTokenFailure returns the access and the message of a device flow which the polling of the token endpoint
+// ended without a token. While the provider answers authorization_pending or slow_down, the user has not entered the
+// code yet and the polling goes on, so that IsAuthenticated keeps waiting instead of failing. It only ends when the
+// user declines the request, the code expires, or the provider can not be reached or returns another error.
+func deviceAccessTokenFailure(err error, deadline time.Time) (string, errorMessage) {
+	if deviceCodeExpired(err, deadline) {
+		return AuthRetry, errorMessage{Message: "device code expired, request a new login code", err: fmt.Errorf("%w: %w", ErrDeviceCodeExpired, err)}
+	}
+
+	// The user explicitly declined the request, so they are not asked to try again.
+	if err = authError(err); errors.Is(err, ErrAccessDenied) {
+		return AuthDenied, errorMessage{Message: "the login request was declined", err: err}
+	}
+	return AuthRetry, errorMessage{Message: "could not authenticate user remotely", err: err}
+}
+
+// defaultDeviceAuthInterval is the interval, in seconds, at which the token endpoint is polled if the provider does not
+// tell it, as required by RFC 8628.
+const defaultDeviceAuthInterval = 5
+
+// withPollJitter returns a copy of the device authorization response whose polling interval is lengthened by a random
+// number of whole seconds, up to the configured jitter, so that the machines authenticating at the same time do not
+// poll the provider together. The interval required by the provider is never shortened, and it is still increased
+// when the provider asks to slow down.
+func (b *Broker) withPollJitter(response *oauth2.DeviceAuthResponse) *oauth2.DeviceAuthResponse {
+	maxJitter := int64(b.cfg.pollJitter / time.Second)
+	if maxJitter <= 0 {
+		return response
+	}
+
+	r := *response
+	if r.Interval <= 0 {
+		r.Interval = defaultDeviceAuthInterval
+	}
+	r.Interval += mathrand.Int64N(maxJitter + 1)
+	return &r
+}
+
+// authInfoFromToken returns the authentication information, with the user info, for a token freshly obtained from the
+// provider. If it fails, the returned data holds the error message to display.
+func (b *Broker) authInfoFromToken(ctx context.Context, session *session, t *oauth2.Token) (token.AuthCachedInfo, isAuthenticatedDataResponse) {
+	if err := session.provider.CheckTokenScopes(t); err != nil {
+		b.logger.Warn(err.Error())
+	}
+
+	// With introspection, the ID token is made of the introspected claims when fetching the user info.
+	rawIDToken, ok := t.Extra("id_token").(string)
+	if !ok && b.cfg.tokenValidation != tokenValidationIntrospection {
+		b.logger.Error("could not get ID token")
+		return token.AuthCachedInfo{}, errorMessage{Message: "could not get ID token"}
+	}
+
+	authInfo := token.NewAuthCachedInfo(t, rawIDToken, session.provider)
+	var err error
+	authInfo.UserInfo, err = b.fetchUserInfo(ctx, session, &authInfo)
+	if err != nil {
+		b.logger.Error(err.Error())
+		return token.AuthCachedInfo{}, errorMessageForDisplay(err, "could not fetch user info")
+	}
+	rawIDToken = authInfo.RawIDToken
+
+	// The ID token was verified when fetching the user info.
+	if err := b.checkAuthenticationContext(rawIDToken); err != nil {
+		b.logger.Error(err.Error())
+		return token.AuthCachedInfo{}, errorMessage{
+			Message: "the identity provider did not authenticate you with the required method, e.g. multi-factor authentication",
+		}
+	}
+	if err := b.checkEmailVerified(rawIDToken); err != nil {
+		b.logger.Error(err.Error())
+		return token.AuthCachedInfo{}, errorMessage{
+			Message: "your email address is not verified by the identity provider, verify it to log in",
+		}
+	}
+	if err := b.checkAuthTime(rawIDToken, time.Now()); err != nil {
+		b.logger.Error(err.Error())
+		if errors.Is(err, errNoAuthTime) {
+			return token.AuthCachedInfo{}, errorMessage{
+				Message: "the identity provider did not tell when it authenticated you, which is required to log in",
+			}
+		}
+		return token.AuthCachedInfo{}, errorMessage{
+			Message: "your session with the identity provider is too old, authenticate with it again to log in",
+		}
+	}
+
+	return authInfo, nil
 }
 
 // userNameIsAllowed checks whether the user's username is allowed to access the machine.
 func (b *Broker) userNameIsAllowed(userName string) bool {
-	normalizedUsername := b.provider.NormalizeUsername(userName)
+	normalizedUsername := b.providerFor(userName).NormalizeUsername(userName)
 	// The user is allowed to log in if:
 	// - ALL users are allowed
 	// - the user's name is in the list of allowed_users
@@ -657,6 +1305,160 @@ func (b *Broker) userNameIsAllowed(userName string) bool {
 	return b.cfg.isOwnerAllowed(normalizedUsername)
 }
 
+// checkOfflineCredentials returns an error if, at now, the cached credentials expired more than the configured offline
+// credential TTL ago, allowing for the configured clock skew. If no TTL is configured, the cached credentials can be
+// used offline indefinitely.
+func (b *Broker) checkOfflineCredentials(authInfo token.AuthCachedInfo, now time.Time) error {
+	if !b.cfg.hasOfflineCredentialTTL {
+		return nil
+	}
+
+	expiry, err := cachedCredentialsExpiry(authInfo)
+	if err != nil {
+		return err
+	}
+
+	if deadline := expiry.Add(b.cfg.offlineCredentialTTL); now.Add(-b.cfg.allowedClockSkew).After(deadline) {
+		return fmt.Errorf("cached credentials can not be used offline since %s", deadline.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// cachedCredentialsExpiry returns the expiry of the cached ID token, or of the access token if no ID token is cached.
+func cachedCredentialsExpiry(authInfo token.AuthCachedInfo) (time.Time, error) {
+	if authInfo.RawIDToken == "" {
+		if authInfo.Token == nil || authInfo.Token.Expiry.IsZero() {
+			return time.Time{}, errors.New("could not determine the expiry of the cached credentials")
+		}
+		return authInfo.Token.Expiry, nil
+	}
+
+	// We can't reach the provider to get its keys anyway.
+	idToken, err := parseVerifiedIDToken(authInfo.RawIDToken)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return idToken.Expiry, nil
+}
+
+// parseVerifiedIDToken parses an ID token which was already verified when it was obtained from the provider, without
+// checking its signature, issuer, audience or expiry again.
+func parseVerifiedIDToken(rawIDToken string) (*oidc.IDToken, error) {
+	verifier := oidc.NewVerifier("", nil, &oidc.Config{
+		SkipClientIDCheck:          true,
+		SkipExpiryCheck:            true,
+		SkipIssuerCheck:            true,
+		InsecureSkipSignatureCheck: true,
+	})
+	idToken, err := verifier.Verify(context.Background(), rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse ID token: %v", err)
+	}
+	return idToken, nil
+}
+
+// withAdminGroup returns the user info with the local admin group added to the groups if the user is an admin.
+// The group is not stored in the token cache, so that removing the user from the admin users revokes it.
+func (b *Broker) withAdminGroup(userInfo info.User) info.User {
+	if !b.cfg.isAdmin(b.providerFor(userInfo.Name).NormalizeUsername(userInfo.Name)) {
+		return userInfo
+	}
+
+	// Local groups are the ones without a UGID.
+	if slices.Contains(userInfo.Groups, info.Group{Name: b.cfg.adminGroup}) {
+		return userInfo
+	}
+
+	if _, err := user.LookupGroup(b.cfg.adminGroup); err != nil {
+		b.logger.Warn(fmt.Sprintf("Not adding user %q to the admin group %q: %v", userInfo.Name, b.cfg.adminGroup, err))
+		return userInfo
+	}
+
+	userInfo.Groups = append(slices.Clone(userInfo.Groups), info.Group{Name: b.cfg.adminGroup})
+	return userInfo
+}
+
+// userInfoForLogin returns the user info to send to authd on login, with the settings which are applied on login instead
+// of being cached.
+func (b *Broker) userInfoForLogin(userInfo info.User, issuerURL string) (info.User, error) {
+	return b.withGIDs(b.withGroupNames(b.withShell(b.withAdminGroup(b.withAlwaysGroups(userInfo)))), issuerURL)
+}
+
+// withAlwaysGroups returns the user info with the local groups every user is added to. Like the admin group, they are
+// not stored in the token cache, and they are added after the allowed groups are checked, so that they never grant
+// access by themselves.
+func (b *Broker) withAlwaysGroups(userInfo info.User) info.User {
+	groups := slices.Clone(userInfo.Groups)
+	for _, name := range b.cfg.alwaysGroups {
+		if !slices.Contains(groups, info.Group{Name: name}) {
+			groups = append(groups, info.Group{Name: name})
+		}
+	}
+	userInfo.Groups = groups
+	return userInfo
+}
+
+// withShell replaces the built-in default shell of the user, which is the one set when the provider does not return
+// any, by the configured shell. Like the admin group, it is applied on login instead of being cached.
+func (b *Broker) withShell(userInfo info.User) info.User {
+	if userInfo.Shell != info.DefaultShell {
+		return userInfo
+	}
+	if shell := b.cfg.shellFor(userInfo.Groups); shell != "" {
+		userInfo.Shell = shell
+	}
+	return userInfo
+}
+
+// withGroupNames returns the user info with the local names of the groups returned by the provider. The groups are
+// cached with their upstream names, which the allowed groups and the group shells are matched against. The local
+// groups, which have no UGID, are kept as they are.
+func (b *Broker) withGroupNames(userInfo info.User) info.User {
+	if b.cfg.groupNameTemplate == "" {
+		return userInfo
+	}
+
+	groups := make([]info.Group, 0, len(userInfo.Groups))
+	for _, group := range userInfo.Groups {
+		if group.UGID == "" {
+			groups = append(groups, group)
+			continue
+		}
+
+		name := b.cfg.groupName(group.Name)
+		if name == "" {
+			b.logger.Warn(fmt.Sprintf("Ignoring group %q of user %q: its name has no character allowed in group names", group.Name, userInfo.Name))
+			continue
+		}
+		if slices.ContainsFunc(groups, func(g info.Group) bool { return g.Name == name }) {
+			b.logger.Warn(fmt.Sprintf("Ignoring group %q of user %q: another group is also named %q", group.Name, userInfo.Name, name))
+			continue
+		}
+		groups = append(groups, info.Group{Name: name, UGID: group.UGID})
+	}
+	userInfo.Groups = groups
+	return userInfo
+}
+
+// userGroupsAreAllowed checks whether the user is a member of one of the allowed groups. If no allowed groups are
+// configured, all users are allowed.
+func (b *Broker) userGroupsAreAllowed(groups []info.Group) bool {
+	if len(b.cfg.allowedGroups) == 0 {
+		return true
+	}
+
+	for _, group := range groups {
+		name := group.Name
+		if !b.cfg.allowedGroupsCaseSensitive {
+			name = strings.ToLower(name)
+		}
+		if _, ok := b.cfg.allowedGroups[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *Broker) startAuthenticate(sessionID string) (context.Context, error) {
 	session, err := b.getSession(sessionID)
 	if err != nil {
@@ -664,11 +1466,11 @@ func (b *Broker) startAuthenticate(sessionID string) (context.Context, error) {
 	}
 
 	if session.isAuthenticating != nil {
-		slog.Error(fmt.Sprintf("Authentication already running for session %q", sessionID))
+		b.logger.Error(fmt.Sprintf("Authentication already running for session %q", sessionID))
 		return nil, errors.New("authentication already running for this user session")
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(withClientAssertion(b.withHTTPClient(context.Background()), &session))
 	session.isAuthenticating = &isAuthenticatedCtx{ctx: ctx, cancelFunc: cancel}
 
 	if err := b.updateSession(sessionID, session); err != nil {
@@ -681,19 +1483,14 @@ func (b *Broker) startAuthenticate(sessionID string) (context.Context, error) {
 
 // EndSession ends the session for the user.
 func (b *Broker) EndSession(sessionID string) error {
-	session, err := b.getSession(sessionID)
+	session, err := b.removeSession(sessionID)
 	if err != nil {
 		return err
 	}
+	b.persistSessions()
 
-	// Checks if there is a isAuthenticated call running for this session and cancels it before ending the session.
-	if session.isAuthenticating != nil {
-		b.CancelIsAuthenticated(sessionID)
-	}
-
-	b.currentSessionsMu.Lock()
-	defer b.currentSessionsMu.Unlock()
-	delete(b.currentSessions, sessionID)
+	// Cancels the IsAuthenticated call running for this session, if any.
+	b.releaseSession(&session)
 	return nil
 }
 
@@ -712,8 +1509,135 @@ func (b *Broker) CancelIsAuthenticated(sessionID string) {
 	session.isAuthenticating = nil
 
 	if err := b.updateSession(sessionID, session); err != nil {
-		slog.Error(fmt.Sprintf("Error when cancelling IsAuthenticated: %v", err))
+		b.logger.Error(fmt.Sprintf("Error when cancelling IsAuthenticated: %v", err))
+	}
+}
+
+// ForceTokenRefresh uses the cached refresh token of the session user to refresh the token and the user info. The
+// updated token and user info are then stored in the cache.
+//
+// If the provider rejects the refresh token, the session is ended, as the user needs to authenticate again. Other
+// errors (e.g. network errors) are returned without ending the session.
+func (b *Broker) ForceTokenRefresh(sessionID string) (err error) {
+	defer decorate.OnError(&err, "could not refresh token for session %q", sessionID)
+
+	session, err := b.getSession(sessionID)
+	if err != nil {
+		return err
+	}
+
+	if session.isOffline {
+		return errors.New("session is in offline mode")
+	}
+
+	authInfo, err := b.tokenStore.Load(session.issuerURL, session.username)
+	if err != nil {
+		return err
+	}
+	if authInfo.Token == nil || authInfo.Token.RefreshToken == "" {
+		return errors.New("no refresh token is cached for this session")
+	}
+
+	ctx := withClientAssertion(b.withHTTPClient(context.Background()), &session)
+	authInfo, err = b.refreshToken(ctx, &session, authInfo)
+	err = authError(err)
+	if errors.Is(err, ErrInvalidGrant) {
+		b.logger.Warn(fmt.Sprintf("Refresh token of session %q was rejected by the provider, ending the session", sessionID))
+		err = errors.Join(err, b.EndSession(sessionID))
+		if errors.Is(err, ErrUserRemoved) {
+			b.handleUserRemoved(&session)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	authInfo.UserInfo, err = b.fetchUserInfo(ctx, &session, &authInfo)
+	if err != nil {
+		return authError(err)
 	}
+	authInfo.UserInfo.Groups = b.syncedGroups(&session, authInfo.UserInfo.Groups)
+
+	return b.tokenStore.Save(session.issuerURL, session.username, authInfo)
+}
+
+// UserClaims are the claims identifying the user in the ID token of a session.
+type UserClaims struct {
+	PreferredUsername string
+	Email             string
+	Name              string
+	Subject           string
+}
+
+// MissingClaimsError is returned when the ID token does not contain the claims required to identify the user.
+type MissingClaimsError struct {
+	Claims []string
+}
+
+func (e MissingClaimsError) Error() string {
+	return fmt.Sprintf("ID token is missing required claims: %s", strings.Join(e.Claims, ", "))
+}
+
+// GetUserInfo returns the user claims from the ID token of the session: the one obtained during the current
+// authentication if any, or else the cached one. The preferred username falls back to the email if the provider
+// does not set it, and is normalized like the usernames of the broker.
+func (b *Broker) GetUserInfo(sessionID string) (claims UserClaims, err error) {
+	defer decorate.OnError(&err, "could not get user info for session %q", sessionID)
+
+	session, err := b.getSession(sessionID)
+	if err != nil {
+		return UserClaims{}, err
+	}
+
+	authInfo, ok := session.authInfo["auth_info"].(token.AuthCachedInfo)
+	if !ok {
+		authInfo, err = b.tokenStore.Load(session.issuerURL, session.username)
+		if err != nil {
+			return UserClaims{}, err
+		}
+	}
+	if authInfo.RawIDToken == "" {
+		return UserClaims{}, errors.New("no ID token is available for this session")
+	}
+
+	idToken, err := parseVerifiedIDToken(authInfo.RawIDToken)
+	if err != nil {
+		return UserClaims{}, err
+	}
+
+	var c struct {
+		PreferredUsername string `json:"preferred_username"`
+		Email             string `json:"email"`
+		Name              string `json:"name"`
+	}
+	if err := idToken.Claims(&c); err != nil {
+		return UserClaims{}, fmt.Errorf("could not get ID token claims: %v", err)
+	}
+
+	claims = UserClaims{
+		PreferredUsername: c.PreferredUsername,
+		Email:             c.Email,
+		Name:              c.Name,
+		Subject:           idToken.Subject,
+	}
+	if claims.PreferredUsername == "" {
+		claims.PreferredUsername = claims.Email
+	}
+
+	var missing []string
+	if claims.Subject == "" {
+		missing = append(missing, "sub")
+	}
+	if claims.PreferredUsername == "" {
+		missing = append(missing, "preferred_username")
+	}
+	if len(missing) > 0 {
+		return UserClaims{}, MissingClaimsError{Claims: missing}
+	}
+
+	claims.PreferredUsername = session.provider.NormalizeUsername(claims.PreferredUsername)
+	return claims, nil
 }
 
 // UserPreCheck checks if the user is valid and can be allowed to authenticate.
@@ -730,7 +1654,19 @@ func (b *Broker) UserPreCheck(username string) (string, error) {
 		return "", errors.New("username does not match the allowed suffixes")
 	}
 
-	u := info.NewUser(username, filepath.Join(b.cfg.homeBaseDir, username), "", "", "", nil)
+	b.cfgMu.RLock()
+	p, err := b.cfg.oidcProviderFor(username)
+	b.cfgMu.RUnlock()
+	if err != nil {
+		return "", err
+	}
+
+	home, err := b.homeDir(username, username, p.issuerURL)
+	if err != nil {
+		return "", err
+	}
+
+	u := b.withShell(info.NewUser(username, home, "", "", "", nil))
 	encoded, err := json.Marshal(u)
 	if err != nil {
 		return "", fmt.Errorf("could not marshal user info: %v", err)
@@ -755,63 +1691,244 @@ func (b *Broker) updateSession(sessionID string, session session) error {
 	if _, err := b.getSession(sessionID); err != nil {
 		return err
 	}
+	session.lastActivity = time.Now()
 	b.currentSessionsMu.Lock()
-	defer b.currentSessionsMu.Unlock()
 	b.currentSessions[sessionID] = session
+	b.currentSessionsMu.Unlock()
+
+	b.persistSessions()
 	return nil
 }
 
-// refreshToken refreshes the OAuth2 token and returns the updated AuthCachedInfo.
-func (b *Broker) refreshToken(ctx context.Context, oauth2Config oauth2.Config, oldToken token.AuthCachedInfo) (token.AuthCachedInfo, error) {
-	timeoutCtx, cancel := context.WithTimeout(ctx, maxRequestDuration)
+// refreshToken refreshes the token of the session. If the provider rotated the refresh token, the new token is stored
+// right away, as the provider may have invalidated the old refresh token.
+func (b *Broker) refreshToken(ctx context.Context, session *session, oldToken token.AuthCachedInfo) (token.AuthCachedInfo, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, b.cfg.requestTimeout())
 	defer cancel()
+	oldRefreshToken := oldToken.Token.RefreshToken
 	// set cached token expiry time to one hour in the past
 	// this makes sure the token is refreshed even if it has not 'actually' expired
 	oldToken.Token.Expiry = time.Now().Add(-time.Hour)
-	oauthToken, err := oauth2Config.TokenSource(timeoutCtx, oldToken.Token).Token()
+	oauthToken, err := session.oauth2Config.TokenSource(timeoutCtx, oldToken.Token).Token()
+	b.metrics.recordTokenRefresh(err)
 	if err != nil {
 		return token.AuthCachedInfo{}, err
 	}
+	// The groups are fetched again with the new access token.
+	b.userInfoCache.remove(userInfoCacheKey(oldToken.Token))
 
 	// Update the raw ID token
 	rawIDToken, ok := oauthToken.Extra("id_token").(string)
 	if !ok {
-		slog.Debug("refreshed token does not contain an ID token, keeping the old one")
+		b.logger.Debug("refreshed token does not contain an ID token, keeping the old one")
 		rawIDToken = oldToken.RawIDToken
 	}
 
-	t := token.NewAuthCachedInfo(oauthToken, rawIDToken, b.provider)
+	t := token.NewAuthCachedInfo(oauthToken, rawIDToken, session.provider)
 	t.UserInfo = oldToken.UserInfo
+
+	// Store the rotated refresh token before anything else can fail, otherwise the user would be left with an
+	// invalidated refresh token in the cache.
+	if oauthToken.RefreshToken != oldRefreshToken {
+		b.logger.Debug("Refresh token was rotated, storing the new one")
+		if err := b.tokenStore.Save(session.issuerURL, session.username, t); err != nil {
+			return token.AuthCachedInfo{}, fmt.Errorf("could not store rotated refresh token: %v", err)
+		}
+	}
+
 	return t, nil
 }
 
+// verifyIDToken verifies the signature, the audience and the issuer of the ID token with the keys of the provider of the
+// session.
+func (b *Broker) verifyIDToken(ctx context.Context, session *session, rawIDToken string) (*oidc.IDToken, error) {
+	// The times of the token are checked by the caller, allowing for the configured clock skew.
+	// The issuer is checked below if other issuers are accepted, e.g. the tenants of a multi-tenant provider.
+	verifierConfig := &oidc.Config{
+		ClientID:        session.oauth2Config.ClientID,
+		SkipExpiryCheck: true,
+		SkipIssuerCheck: len(session.acceptedIssuers) > 0,
+	}
+	issuer := session.issuerURL
+	if session.discoveryDoc.Issuer != "" {
+		issuer = session.discoveryDoc.Issuer
+	}
+
+	verifier := session.oidcServer.Verifier(verifierConfig)
+	switch doc := session.discoveryDoc; {
+	case session.jwksFile != "":
+		// The keys of the file are used even if the provider has a jwks_uri, which may not be reachable.
+		verifierConfig.SupportedSigningAlgs = doc.Algorithms
+		verifier = oidc.NewVerifier(issuer, fileKeySet{path: session.jwksFile}, verifierConfig)
+	case doc.JWKSURL != "":
+		// The signing keys are cached in $DATA_DIR/$ISSUER.jwks.json.
+		keySet := cachedKeySet{
+			jwksURL:         doc.JWKSURL,
+			cachePath:       filepath.Join(b.cfg.DataDir, issuerDirName(session.issuerURL)+jwksCacheSuffix),
+			refreshInterval: b.cfg.jwksRefreshInterval,
+			timeout:         b.cfg.requestTimeout(),
+		}
+		verifierConfig.SupportedSigningAlgs = doc.Algorithms
+		verifier = oidc.NewVerifier(doc.Issuer, keySet, verifierConfig)
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if verifierConfig.SkipIssuerCheck {
+		if err := checkIssuer(idToken, issuer, session.acceptedIssuers); err != nil {
+			return nil, err
+		}
+	}
+	return idToken, nil
+}
+
 func (b *Broker) fetchUserInfo(ctx context.Context, session *session, t *token.AuthCachedInfo) (userInfo info.User, err error) {
 	if session.isOffline {
 		return info.User{}, errors.New("session is in offline mode")
 	}
 
-	idToken, err := session.oidcServer.Verifier(&b.oidcCfg).Verify(ctx, t.RawIDToken)
+	var idToken *oidc.IDToken
+	if b.cfg.tokenValidation == tokenValidationIntrospection {
+		idToken, err = b.introspect(ctx, session, t)
+	} else {
+		idToken, err = b.verifyIDToken(ctx, session, t.RawIDToken)
+	}
 	if err != nil {
 		return info.User{}, fmt.Errorf("could not verify token: %v", err)
 	}
+	if err := checkIDTokenTimes(idToken, time.Now(), b.cfg.allowedClockSkew); err != nil {
+		return info.User{}, fmt.Errorf("could not verify token: %v", err)
+	}
 
-	userInfo, err = b.provider.GetUserInfo(ctx, t.Token, idToken)
+	userInfo, err = b.providerUserInfo(ctx, session.provider, t.Token, idToken)
+	var groupsErr *providerErrors.GroupsError
+	if errors.As(err, &groupsErr) && (b.cfg.onGroupFetchError == groupFetchErrorCached || b.cfg.onGroupFetchError == groupFetchErrorMinimal) {
+		userInfo, err = b.userInfoWithoutFetchedGroups(session, groupsErr)
+	}
 	if err != nil {
 		return info.User{}, fmt.Errorf("could not get user info: %w", err)
 	}
 
-	if err = b.provider.VerifyUsername(session.username, userInfo.Name); err != nil {
+	// The configured groups claim takes precedence over where the provider gets the groups from, if it is present.
+	if b.cfg.groupsClaim != "" {
+		groups, ok, err := b.groupsFromClaim(ctx, session, t.Token, idToken)
+		if err != nil {
+			return info.User{}, fmt.Errorf("could not get user groups: %w", err)
+		}
+		if ok {
+			userInfo.Groups = groups
+		}
+	}
+
+	if b.cfg.usernameClaim != "" || b.cfg.usernameStripDomain {
+		name, err := b.usernameFromClaims(idToken, userInfo.Name)
+		if err != nil {
+			return info.User{}, fmt.Errorf("could not get username: %w", err)
+		}
+		// The defaults derived from the username follow it.
+		if userInfo.Home == userInfo.Name {
+			userInfo.Home = name
+		}
+		if userInfo.Gecos == userInfo.Name {
+			userInfo.Gecos = name
+		}
+		userInfo.Name = name
+	}
+
+	localName, err := b.localUsername(session.issuerURL, userInfo)
+	if err != nil {
+		return info.User{}, fmt.Errorf("could not get local username: %w", err)
+	}
+	if localName != userInfo.Name {
+		if session.provider.NormalizeUsername(session.username) == session.provider.NormalizeUsername(userInfo.Name) {
+			err := providerErrors.NewForDisplayError("the username %q is already used by another user, log in as %q instead", userInfo.Name, localName)
+			return info.User{}, &err
+		}
+		// The home directory of the other user must not be reused.
+		if userInfo.Home == userInfo.Name {
+			userInfo.Home = localName
+		}
+		userInfo.Name = localName
+	}
+
+	if err = session.provider.VerifyUsername(session.username, userInfo.Name); err != nil {
 		return info.User{}, fmt.Errorf("username verification failed: %w", err)
 	}
 
 	// This means that home was not provided by the claims, so we need to set it to the broker default.
 	if !filepath.IsAbs(userInfo.Home) {
-		userInfo.Home = filepath.Join(b.cfg.homeBaseDir, userInfo.Home)
+		userInfo.Home, err = b.homeDir(userInfo.Name, userInfo.Home, session.issuerURL)
+		if err != nil {
+			return info.User{}, err
+		}
 	}
 
 	return userInfo, err
 }
 
+// userInfoWithoutFetchedGroups returns the user info to log in with when the provider could not return the groups of
+// the user: with the groups stored with the token of the user if the policy is cached, or with no groups at all.
+func (b *Broker) userInfoWithoutFetchedGroups(session *session, groupsErr *providerErrors.GroupsError) (info.User, error) {
+	userInfo := groupsErr.User
+	if b.cfg.onGroupFetchError == groupFetchErrorCached {
+		stored, err := b.tokenStore.Load(session.issuerURL, session.username)
+		if err != nil {
+			return info.User{}, fmt.Errorf("%w, and no groups are stored for the user: %v", groupsErr, err)
+		}
+		userInfo.Groups = stored.UserInfo.Groups
+	}
+
+	b.logger.Warn(fmt.Sprintf("Could not get the groups of user %q, logging in with the %s groups: %v",
+		session.username, b.cfg.onGroupFetchError, groupsErr))
+	return userInfo, nil
+}
+
+// syncedGroups returns the groups to report to authd for the user, given the ones they are a member of at the provider.
+// In the additive group sync mode, the groups stored with the token of the user at their previous logins are kept, even
+// if the user was removed from them at the provider, and they are stored again with the new token.
+func (b *Broker) syncedGroups(session *session, groups []info.Group) []info.Group {
+	if b.cfg.groupSyncMode != groupSyncAdditive {
+		return groups
+	}
+
+	stored, err := b.tokenStore.Load(session.issuerURL, session.username)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			b.logger.Warn(fmt.Sprintf("Could not get the previous groups of user %q: %v", session.username, err))
+		}
+		return groups
+	}
+
+	synced := slices.Clone(groups)
+	for _, g := range stored.UserInfo.Groups {
+		if !slices.ContainsFunc(synced, func(current info.Group) bool { return current.Name == g.Name }) {
+			synced = append(synced, g)
+		}
+	}
+	return synced
+}
+
+// homeDir returns the home directory of the user within the home directory prefix. It is built from the home
+// directory template if one is configured, or else from the relative home directory.
+func (b *Broker) homeDir(username, relativeHome, issuerURL string) (string, error) {
+	if b.cfg.homeDirTemplate == "" {
+		return filepath.Join(b.cfg.homeBaseDir, relativeHome), nil
+	}
+
+	var issuerHost string
+	if u, err := url.Parse(issuerURL); err == nil {
+		issuerHost = u.Hostname()
+	}
+
+	home := filepath.Join(b.cfg.homeBaseDir, expandHomeDirTemplate(b.cfg.homeDirTemplate, username, issuerHost))
+	// The template is validated, but the username could still make the path escape the home directory prefix.
+	if rel, err := filepath.Rel(b.cfg.homeBaseDir, home); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("home directory %q of user %q is not within %q", home, username, b.cfg.homeBaseDir)
+	}
+	return home, nil
+}
+
 // decorateErrorMessage decorates the isAuthenticatedDataResponse with the provided message, if it's an errorMessage.
 func decorateErrorMessage(data *isAuthenticatedDataResponse, msg string) {
 	if *data == nil {
@@ -830,7 +1947,7 @@ func decorateErrorMessage(data *isAuthenticatedDataResponse, msg string) {
 func errorMessageForDisplay(err error, fallback string) errorMessage {
 	var e *providerErrors.ForDisplayError
 	if errors.As(err, &e) {
-		return errorMessage{Message: e.Error()}
+		return errorMessage{Message: e.Error(), err: authError(err)}
 	}
-	return errorMessage{Message: fallback}
+	return errorMessage{Message: fallback, err: authError(err)}
 }
@@ -1,19 +1,37 @@
 package broker_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
 	"github.com/ubuntu/authd-oidc-brokers/internal/broker"
 	"github.com/ubuntu/authd-oidc-brokers/internal/broker/authmodes"
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker/sessionmode"
 	"github.com/ubuntu/authd-oidc-brokers/internal/password"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
 	"github.com/ubuntu/authd-oidc-brokers/internal/testutils"
@@ -78,15 +96,377 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestNewReadOnly(t *testing.T) {
+	t.Parallel()
+
+	for name, readOnly := range map[string]bool{"New_removes_persisted_sessions": false, "NewReadOnly_keeps_persisted_sessions": true} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dataDir := t.TempDir()
+			sessionsPath := filepath.Join(dataDir, "sessions.json")
+			err := os.WriteFile(sessionsPath, []byte("{}"), 0600)
+			require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+
+			newBrokerForTests(t, &brokerForTestConfig{Config: broker.Config{DataDir: dataDir}, readOnly: readOnly})
+
+			_, err = os.Stat(sessionsPath)
+			if readOnly {
+				require.NoError(t, err, "NewReadOnly should not have removed the sessions persisted by the daemon")
+				return
+			}
+			require.ErrorIs(t, err, os.ErrNotExist, "New should have removed the persisted sessions")
+		})
+	}
+}
+
+func TestNewWithCustomCACertificates(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", testutils.DefaultOpenIDHandler(server.URL))
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	certDir := t.TempDir()
+	certFile := filepath.Join(certDir, "ca.pem")
+	err := os.WriteFile(certFile, certPEM, 0600)
+	require.NoError(t, err, "Setup: Failed to write the CA certificate")
+
+	notPEMFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(notPEMFile, []byte("not a certificate"), 0600)
+	require.NoError(t, err, "Setup: Failed to write the invalid CA certificate")
+
+	tests := map[string]struct {
+		caCertFile         string
+		insecureSkipVerify bool
+
+		wantOffline bool
+		wantErr     bool
+	}{
+		"Provider_with_private_CA_is_not_reachable_without_its_certificate": {wantOffline: true},
+		"Provider_is_reachable_with_CA_certificate_file":                    {caCertFile: certFile},
+		"Provider_is_reachable_with_CA_certificate_directory":               {caCertFile: certDir},
+		"Provider_is_reachable_if_certificate_verification_is_skipped":      {insecureSkipVerify: true},
+
+		"Error_if_CA_certificate_file_does_not_exist": {caCertFile: filepath.Join(certDir, "does-not-exist"), wantErr: true},
+		"Error_if_CA_certificate_file_is_not_PEM":     {caCertFile: notPEMFile, wantErr: true},
+		"Error_if_CA_certificate_directory_is_empty":  {caCertFile: t.TempDir(), wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := &broker.Config{DataDir: t.TempDir()}
+			cfg.SetIssuerURL(server.URL)
+			cfg.SetClientID("test-client-id")
+			cfg.SetTLSSettings(tc.caCertFile, tc.insecureSkipVerify)
+			b, err := broker.New(*cfg, broker.WithCustomProvider(&testutils.MockProvider{}))
+			if tc.wantErr {
+				require.Error(t, err, "New should have returned an error")
+				return
+			}
+			require.NoError(t, err, "New should not have returned an error")
+
+			sessionID, _ := newSessionForTests(t, b, "", "")
+			isOffline, err := b.IsOffline(sessionID)
+			require.NoError(t, err, "IsOffline should not have returned an error")
+			require.Equal(t, tc.wantOffline, isOffline, "Session should be offline only if the provider is not reachable")
+		})
+	}
+}
+
+func TestNewWithMinTLSVersion(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		serverMinVersion uint16
+		serverMaxVersion uint16
+		minTLSVersion    uint16
+
+		wantOffline bool
+	}{
+		"Provider_with_TLS_1.2_is_reachable_by_default":        {serverMaxVersion: tls.VersionTLS12},
+		"Provider_with_TLS_1.3_is_reachable_if_required":       {serverMaxVersion: tls.VersionTLS13, minTLSVersion: tls.VersionTLS13},
+		"Provider_with_TLS_1.1_is_not_reachable_by_default":    {serverMinVersion: tls.VersionTLS10, serverMaxVersion: tls.VersionTLS11, wantOffline: true},
+		"Provider_with_TLS_1.2_is_not_reachable_if_1.3_is_set": {serverMaxVersion: tls.VersionTLS12, minTLSVersion: tls.VersionTLS13, wantOffline: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			mux := http.NewServeMux()
+			server := httptest.NewUnstartedServer(mux)
+			//nolint: gosec // The server only offers old TLS versions to check that the broker rejects them.
+			server.TLS = &tls.Config{MinVersion: tc.serverMinVersion, MaxVersion: tc.serverMaxVersion}
+			server.StartTLS()
+			t.Cleanup(server.Close)
+			mux.HandleFunc("/.well-known/openid-configuration", testutils.DefaultOpenIDHandler(server.URL))
+
+			cfg := &broker.Config{DataDir: t.TempDir()}
+			cfg.SetIssuerURL(server.URL)
+			cfg.SetClientID("test-client-id")
+			cfg.SetTLSSettings("", true)
+			cfg.SetMinTLSVersion(tc.minTLSVersion)
+			b, err := broker.New(*cfg, broker.WithCustomProvider(&testutils.MockProvider{}))
+			require.NoError(t, err, "New should not have returned an error")
+
+			sessionID, _ := newSessionForTests(t, b, "", "")
+			isOffline, err := b.IsOffline(sessionID)
+			require.NoError(t, err, "IsOffline should not have returned an error")
+			require.Equal(t, tc.wantOffline, isOffline, "Session should be offline only if the handshake with the provider is rejected")
+		})
+	}
+}
+
+func TestNewWithProxy(t *testing.T) {
+	t.Parallel()
+
+	// The host does not resolve, so the provider is only reachable through the proxy.
+	const issuerURL = "http://idp.example.invalid"
+
+	tests := map[string]struct {
+		noProxy string
+
+		wantProxied bool
+	}{
+		"Requests_go_through_the_configured_proxy":          {wantProxied: true},
+		"Requests_to_hosts_in_no_proxy_are_direct":          {noProxy: "example.invalid"},
+		"Requests_to_other_hosts_than_no_proxy_are_proxied": {noProxy: "other.invalid", wantProxied: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var proxied atomic.Int32
+			openIDHandler := testutils.DefaultOpenIDHandler(issuerURL)
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// A proxy receives the absolute URL of the request.
+				if r.URL.String() != issuerURL+"/.well-known/openid-configuration" {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				proxied.Add(1)
+				openIDHandler(w, r)
+			}))
+			t.Cleanup(proxy.Close)
+
+			cfg := &broker.Config{DataDir: t.TempDir()}
+			cfg.SetIssuerURL(issuerURL)
+			cfg.SetClientID("test-client-id")
+			cfg.SetProxy(proxy.URL, tc.noProxy)
+			b, err := broker.New(*cfg, broker.WithCustomProvider(&testutils.MockProvider{}))
+			require.NoError(t, err, "New should not have returned an error")
+
+			sessionID, _ := newSessionForTests(t, b, "", "")
+			isOffline, err := b.IsOffline(sessionID)
+			require.NoError(t, err, "IsOffline should not have returned an error")
+			require.Equal(t, !tc.wantProxied, isOffline, "Provider should only be reachable through the proxy")
+			require.Equal(t, tc.wantProxied, proxied.Load() > 0, "Discovery should go through the proxy only if the host is not excluded")
+		})
+	}
+}
+
+func TestProviderRequestRetries(t *testing.T) {
+	t.Parallel()
+
+	const retries = 2
+
+	tests := map[string]struct {
+		endpoint string
+		// failures is how many times the endpoint fails before answering normally, -1 for always.
+		failures int
+		status   int
+
+		wantCalls   int32
+		wantOffline bool
+		wantErr     bool
+	}{
+		"Discovery_is_retried_after_a_server_error": {
+			endpoint: "/.well-known/openid-configuration", failures: 1, status: http.StatusServiceUnavailable,
+			wantCalls: 2,
+		},
+		"Discovery_is_retried_a_bounded_number_of_times": {
+			endpoint: "/.well-known/openid-configuration", failures: -1, status: http.StatusBadGateway,
+			wantCalls: 1 + retries, wantOffline: true,
+		},
+		"Discovery_is_not_retried_after_a_client_error": {
+			endpoint: "/.well-known/openid-configuration", failures: -1, status: http.StatusNotFound,
+			wantCalls: 1, wantOffline: true,
+		},
+		"Device_authorization_request_is_not_retried": {
+			endpoint: "/device_auth", failures: -1, status: http.StatusServiceUnavailable,
+			wantCalls: 1, wantErr: true,
+		},
+		// oauth2 sends the token request a second time itself, with the client credentials in the body instead of
+		// the header, because the provider does not say which authentication style it supports.
+		"Token_request_is_not_retried": {
+			endpoint: "/token", failures: -1, status: http.StatusServiceUnavailable,
+			wantCalls: 2, wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls atomic.Int32
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				n := calls.Add(1)
+				if tc.failures < 0 || int(n) <= tc.failures {
+					w.WriteHeader(tc.status)
+					return
+				}
+				serverURL := "http://" + r.Host
+				switch tc.endpoint {
+				case "/.well-known/openid-configuration":
+					testutils.DefaultOpenIDHandler(serverURL)(w, r)
+				case "/device_auth":
+					testutils.DefaultDeviceAuthHandler()(w, r)
+				case "/token":
+					testutils.TokenHandler(serverURL, nil)(w, r)
+				}
+			}
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				httpRetries:    retries,
+				customHandlers: map[string]testutils.EndpointHandler{tc.endpoint: handler},
+			})
+
+			sessionID, _ := newSessionForTests(t, b, "", "")
+			isOffline, err := b.IsOffline(sessionID)
+			require.NoError(t, err, "IsOffline should not have returned an error")
+			require.Equal(t, tc.wantOffline, isOffline, "Session should be offline only if the discovery failed")
+
+			if tc.endpoint != "/.well-known/openid-configuration" {
+				err = b.SetAvailableMode(sessionID, authmodes.Device)
+				require.NoError(t, err, "Setup: SetAvailableMode should not have returned an error")
+				_, err = b.SelectAuthenticationMode(sessionID, authmodes.Device)
+				if tc.endpoint == "/token" {
+					require.NoError(t, err, "SelectAuthenticationMode should not have returned an error")
+					access, _, err := b.IsAuthenticated(sessionID, "{}")
+					require.NoError(t, err, "IsAuthenticated should not have returned an error")
+					require.NotEqual(t, broker.AuthGranted, access, "IsAuthenticated should not have granted access")
+				} else {
+					require.Error(t, err, "SelectAuthenticationMode should have returned an error")
+				}
+			}
+
+			require.Equal(t, tc.wantCalls, calls.Load(), "Endpoint should have been called the expected number of times")
+		})
+	}
+}
+
+func TestNewCapabilityProbe(t *testing.T) {
+	t.Parallel()
+
+	limitedOpenIDHandler := func(serverURL string) testutils.EndpointHandler {
+		return func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Add("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{
+				"issuer": "%[1]s",
+				"authorization_endpoint": "%[1]s/auth",
+				"device_authorization_endpoint": "%[1]s/device_auth",
+				"token_endpoint": "%[1]s/token",
+				"jwks_uri": "%[1]s/keys",
+				"id_token_signing_alg_values_supported": ["RS256"],
+				"grant_types_supported": ["authorization_code", "urn:ietf:params:oauth:grant-type:device_code"],
+				"scopes_supported": ["openid", "email"],
+				"token_endpoint_auth_methods_supported": ["client_secret_basic"]
+			}`, serverURL)
+		}
+	}
+
+	tests := map[string]struct {
+		capabilityProbe string
+		openIDHandler   func(serverURL string) testutils.EndpointHandler
+		revokeOnLogout  bool
+		clientAuth      string
+		unreachable     bool
+
+		wantNotProbed bool
+		wantMissing   int
+		wantProbeErr  bool
+		wantErr       bool
+	}{
+		"Nothing_is_missing_if_all_features_are_advertised":   {capabilityProbe: "warn"},
+		"Missing_features_are_reported":                       {capabilityProbe: "warn", openIDHandler: limitedOpenIDHandler, wantMissing: 3},
+		"Missing_device_endpoint_is_reported":                 {capabilityProbe: "warn", openIDHandler: testutils.OpenIDHandlerWithNoDeviceEndpoint, wantMissing: 1},
+		"Missing_revocation_endpoint_is_reported_if_needed":   {capabilityProbe: "warn", revokeOnLogout: true, wantMissing: 1},
+		"Missing_client_auth_method_is_reported_if_needed":    {capabilityProbe: "warn", openIDHandler: limitedOpenIDHandler, clientAuth: "client_secret_post", wantMissing: 4},
+		"Unreachable_provider_is_reported":                    {capabilityProbe: "warn", unreachable: true, wantProbeErr: true},
+		"Unreachable_provider_does_not_fail_the_broker":       {capabilityProbe: "fail", unreachable: true, wantProbeErr: true},
+		"Broker_starts_if_all_features_are_advertised":        {capabilityProbe: "fail"},
+		"Nothing_is_checked_if_the_probe_is_disabled":         {capabilityProbe: "off", openIDHandler: limitedOpenIDHandler, wantNotProbed: true},
+		"Nothing_is_checked_if_the_probe_is_not_configured":   {openIDHandler: limitedOpenIDHandler, wantNotProbed: true},
+		"Error_if_a_feature_is_missing_and_the_probe_fails":   {capabilityProbe: "fail", openIDHandler: limitedOpenIDHandler, wantErr: true},
+		"Error_if_revocation_is_missing_and_the_probe_fails":  {capabilityProbe: "fail", revokeOnLogout: true, wantErr: true},
+		"Error_if_device_endpoint_is_missing_and_probe_fails": {capabilityProbe: "fail", openIDHandler: testutils.OpenIDHandlerWithNoDeviceEndpoint, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			mux := http.NewServeMux()
+			server := httptest.NewServer(mux)
+			t.Cleanup(server.Close)
+			if tc.openIDHandler == nil {
+				tc.openIDHandler = testutils.DefaultOpenIDHandler
+			}
+			mux.HandleFunc("/.well-known/openid-configuration", tc.openIDHandler(server.URL))
+			issuerURL := server.URL
+			if tc.unreachable {
+				issuerURL = "http://127.0.0.1:1"
+			}
+
+			cfg := &broker.Config{DataDir: t.TempDir()}
+			cfg.SetIssuerURL(issuerURL)
+			cfg.SetClientID("test-client-id")
+			cfg.SetCapabilityProbe(tc.capabilityProbe)
+			cfg.SetRevokeOnLogout(tc.revokeOnLogout)
+			cfg.SetClientAuth("", tc.clientAuth, "", "")
+			b, err := broker.New(*cfg, broker.WithCustomProvider(&testutils.MockProvider{}))
+			if tc.wantErr {
+				require.Error(t, err, "New should have returned an error")
+				return
+			}
+			require.NoError(t, err, "New should not have returned an error")
+
+			capabilities := b.Health().Capabilities
+			if tc.wantNotProbed {
+				require.Empty(t, capabilities, "The capabilities should not have been checked")
+				return
+			}
+			require.Len(t, capabilities, 1, "The capabilities of the provider should have been checked")
+			require.Equal(t, issuerURL, capabilities[0].IssuerURL, "The capabilities should be the ones of the provider")
+			if tc.wantProbeErr {
+				require.Error(t, capabilities[0].Err, "The capabilities should not have been checked")
+				return
+			}
+			require.NoError(t, capabilities[0].Err, "The capabilities should have been checked")
+			require.Len(t, capabilities[0].Missing, tc.wantMissing, "Unexpected missing features: %v", capabilities[0].Missing)
+		})
+	}
+}
+
 func TestNewSession(t *testing.T) {
 	t.Parallel()
 
 	tests := map[string]struct {
 		customHandlers map[string]testutils.EndpointHandler
+		extraScopes    []string
+		sessionMode    string
 
 		wantOffline bool
+		wantScopes  []string
+		wantErr     bool
 	}{
-		"Successfully_create_new_session": {},
+		"Successfully_create_new_session":                 {},
+		"Successfully_create_new_change_password_session": {sessionMode: sessionmode.ChangePassword},
+		"Successfully_create_new_session_with_extra_scopes": {
+			extraScopes: []string{"custom-scope", "email", "offline_access", "another-scope"},
+			wantScopes:  []string{"openid", "profile", "email", "offline_access", "custom-scope", "another-scope"},
+		},
 		"Creates_new_session_in_offline_mode_if_provider_is_not_available": {
 			customHandlers: map[string]testutils.EndpointHandler{
 				"/.well-known/openid-configuration": testutils.UnavailableHandler(),
@@ -99,22 +479,185 @@ func TestNewSession(t *testing.T) {
 			},
 			wantOffline: true,
 		},
+
+		"Error_if_session_mode_is_unknown": {sessionMode: "login", wantErr: true},
+		"Error_if_session_mode_is_empty":   {sessionMode: "-", wantErr: true},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 
+			switch tc.sessionMode {
+			case "":
+				tc.sessionMode = sessionmode.Login
+			case "-":
+				tc.sessionMode = ""
+			}
+
 			b := newBrokerForTests(t, &brokerForTestConfig{
 				customHandlers: tc.customHandlers,
+				extraScopes:    tc.extraScopes,
 			})
 
-			id, _, err := b.NewSession("test-user", "lang", "auth")
+			id, _, err := b.NewSession("test-user", "lang", tc.sessionMode)
+			if tc.wantErr {
+				require.Error(t, err, "NewSession should have returned an error")
+				require.Empty(t, b.Sessions(), "No session should have been created")
+				return
+			}
 			require.NoError(t, err, "NewSession should not have returned an error")
 
 			gotOffline, err := b.IsOffline(id)
 			require.NoError(t, err, "Session should have been created")
 
 			require.Equal(t, tc.wantOffline, gotOffline, "Session should have been created in the expected mode")
+
+			if tc.wantScopes != nil {
+				require.Equal(t, tc.wantScopes, b.ScopesForSession(id), "Session should request the expected scopes")
+			}
+		})
+	}
+}
+
+func TestNewSessionSelectsProviderByDomain(t *testing.T) {
+	t.Parallel()
+
+	corpIssuerURL, cleanup := testutils.StartMockProviderServer("", nil)
+	t.Cleanup(cleanup)
+
+	tests := map[string]struct {
+		username          string
+		noDefaultProvider bool
+
+		wantIssuer   string
+		wantClientID string
+		wantErr      bool
+	}{
+		"Successfully_select_provider_of_the_domain":            {username: "user@corp.example.com", wantIssuer: corpIssuerURL, wantClientID: "corp-client-id"},
+		"Successfully_select_default_provider_for_other_domain": {username: "user@other.com", wantClientID: "test-client-id"},
+
+		"Error_if_no_provider_is_configured_for_the_domain": {username: "user@other.com", noDefaultProvider: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			bCfg := &broker.Config{DataDir: t.TempDir()}
+			if !tc.noDefaultProvider {
+				bCfg.SetIssuerURL(defaultIssuerURL)
+				bCfg.SetClientID("test-client-id")
+			}
+			bCfg.AddOIDCProvider("corp", corpIssuerURL, "corp-client-id", []string{"corp.example.com"})
+			b, err := broker.New(*bCfg)
+			require.NoError(t, err, "Setup: New should not have returned an error")
+
+			id, _, err := b.NewSession(tc.username, "lang", "auth")
+			if tc.wantErr {
+				require.Error(t, err, "NewSession should have returned an error")
+				return
+			}
+			require.NoError(t, err, "NewSession should not have returned an error")
+
+			if tc.wantIssuer == "" {
+				tc.wantIssuer = defaultIssuerURL
+			}
+			require.Equal(t, tc.wantIssuer, b.IssuerURLForSession(id), "Session should use the provider of the domain")
+			require.Equal(t, tc.wantClientID, b.ClientIDForSession(id), "Session should use the client ID of the provider")
+			require.True(t, strings.HasPrefix(b.TokenURLForSession(id), tc.wantIssuer), "Session should use the endpoints of the provider")
+		})
+	}
+}
+
+func TestNewSessionDiscoveryCache(t *testing.T) {
+	t.Parallel()
+
+	const cachedTokenURL = "https://cached.issuer.url.com/token"
+
+	tests := map[string]struct {
+		// cacheAge is the age of the cached discovery document, which is not created if zero.
+		cacheAge          time.Duration
+		discoveryCacheTTL time.Duration
+		unavailable       bool
+
+		wantCachedTokenURL bool
+		wantOffline        bool
+	}{
+		"Cache_discovery_document_after_fetching_it": {
+			discoveryCacheTTL: time.Hour,
+		},
+		"Use_cached_discovery_document_while_it_is_fresh": {
+			cacheAge:           time.Minute,
+			discoveryCacheTTL:  time.Hour,
+			wantCachedTokenURL: true,
+		},
+		"Fetch_discovery_document_if_cached_one_is_stale": {
+			cacheAge:          2 * time.Hour,
+			discoveryCacheTTL: time.Hour,
+		},
+		"Fetch_discovery_document_if_no_TTL_is_configured": {
+			cacheAge: time.Minute,
+		},
+		"Use_stale_cached_discovery_document_in_offline_mode_if_provider_is_not_available": {
+			cacheAge:           2 * time.Hour,
+			discoveryCacheTTL:  time.Hour,
+			unavailable:        true,
+			wantCachedTokenURL: true,
+			wantOffline:        true,
+		},
+		"Creates_new_session_in_offline_mode_without_cached_discovery_document": {
+			unavailable: true,
+			wantOffline: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := &brokerForTestConfig{discoveryCacheTTL: tc.discoveryCacheTTL}
+			if tc.unavailable {
+				cfg.customHandlers = map[string]testutils.EndpointHandler{
+					"/.well-known/openid-configuration": testutils.UnavailableHandler(),
+				}
+			}
+			b := newBrokerForTests(t, cfg)
+
+			cachePath := b.DiscoveryCachePath()
+			if tc.cacheAge != 0 {
+				doc := fmt.Sprintf(`{"issuer": %q, "token_endpoint": %q}`, cfg.IssuerURL(), cachedTokenURL)
+				err := os.WriteFile(cachePath, []byte(doc), 0600)
+				require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+				modTime := time.Now().Add(-tc.cacheAge)
+				err = os.Chtimes(cachePath, modTime, modTime)
+				require.NoError(t, err, "Setup: Chtimes should not have returned an error")
+			}
+
+			id, _, err := b.NewSession("test-user", "lang", "auth")
+			require.NoError(t, err, "NewSession should not have returned an error")
+
+			gotOffline, err := b.IsOffline(id)
+			require.NoError(t, err, "Session should have been created")
+			require.Equal(t, tc.wantOffline, gotOffline, "Session should have been created in the expected mode")
+
+			if tc.unavailable && !tc.wantCachedTokenURL {
+				require.Empty(t, b.TokenURLForSession(id), "Session should not have any endpoint")
+				require.NoFileExists(t, cachePath, "Discovery document should not have been cached")
+				return
+			}
+
+			wantTokenURL := cfg.IssuerURL() + "/token"
+			if tc.wantCachedTokenURL {
+				wantTokenURL = cachedTokenURL
+			}
+			require.Equal(t, wantTokenURL, b.TokenURLForSession(id), "Session should use the expected token endpoint")
+
+			cached, err := os.ReadFile(cachePath)
+			require.NoError(t, err, "Discovery document should have been cached")
+			var gotDoc struct {
+				TokenURL string `json:"token_endpoint"`
+			}
+			err = json.Unmarshal(cached, &gotDoc)
+			require.NoError(t, err, "Cached discovery document should be valid JSON")
+			require.Equal(t, wantTokenURL, gotDoc.TokenURL, "Cached discovery document should have the expected token endpoint")
 		})
 	}
 }
@@ -152,6 +695,10 @@ var supportedUILayouts = map[string]map[string]string{
 	"newpassword-without-entry": {
 		"type": "newpassword",
 	},
+
+	"webauthn": {
+		"type": "webauthn",
+	},
 }
 
 func TestGetAuthenticationModes(t *testing.T) {
@@ -167,6 +714,8 @@ func TestGetAuthenticationModes(t *testing.T) {
 		secondAuthStep        bool
 		unavailableProvider   bool
 		deviceAuthUnsupported bool
+		authModeOrder         []string
+		disablePassword       bool
 
 		wantErr bool
 	}{
@@ -175,12 +724,28 @@ func TestGetAuthenticationModes(t *testing.T) {
 		"Get_newpassword_if_already_authenticated_with_device_auth_qr": {secondAuthStep: true},
 		"Get_password_and_device_auth_qr_if_token_exists":              {tokenExists: true},
 
+		"Get_device_auth_if_qrcode_is_not_rendered":                                     {supportedLayouts: []string{"form", "qrcode-without-qrcode", "newpassword"}},
+		"Get_password_and_device_auth_if_token_exists_and_qrcode_is_not_rendered":       {tokenExists: true, supportedLayouts: []string{"form", "qrcode-without-qrcode", "newpassword"}},
+		"Get_only_device_auth_qr_if_token_exists_and_password_entry_is_not_supported":   {tokenExists: true, supportedLayouts: []string{"form-without-entry", "qrcode", "newpassword"}},
+		"Get_only_device_auth_if_token_exists_and_neither_password_nor_qrcode_rendered": {tokenExists: true, supportedLayouts: []string{"qrcode-without-qrcode", "newpassword"}},
+
+		"Get_device_auth_qr_first_if_it_is_ordered_first":             {tokenExists: true, authModeOrder: []string{authmodes.DeviceQr}},
+		"Get_device_auth_qr_first_if_device_auth_is_ordered_first":    {tokenExists: true, authModeOrder: []string{authmodes.Device, authmodes.Password}},
+		"Get_device_auth_first_if_ordered_and_qrcode_is_not_rendered": {tokenExists: true, authModeOrder: []string{authmodes.Device}, supportedLayouts: []string{"form", "qrcode-without-qrcode", "newpassword"}},
+		"Get_password_first_if_it_is_ordered_first":                   {tokenExists: true, authModeOrder: []string{authmodes.Password, authmodes.DeviceQr}},
+		"Get_offered_modes_in_order_without_the_ones_not_offered":     {tokenExists: true, authModeOrder: []string{authmodes.WebAuthn, authmodes.DeviceQr, authmodes.Password}},
+		"Get_only_offered_mode_if_the_others_are_ordered_before":      {authModeOrder: []string{authmodes.Password, authmodes.WebAuthn}},
+
+		"Get_only_device_auth_qr_if_token_exists_and_password_is_disabled":     {tokenExists: true, disablePassword: true},
+		"Get_only_device_auth_qr_if_password_is_ordered_first_but_is_disabled": {tokenExists: true, disablePassword: true, authModeOrder: []string{authmodes.Password}},
+
 		"Get_only_password_if_token_exists_and_provider_is_not_available":                {tokenExists: true, providerAddress: "127.0.0.1:31310", unavailableProvider: true},
 		"Get_only_password_if_token_exists_and_provider_does_not_support_device_auth_qr": {tokenExists: true, providerAddress: "127.0.0.1:31311", deviceAuthUnsupported: true},
 
 		// Passwd Session
 		"Get_only_password_if_token_exists_and_session_is_passwd":                      {sessionMode: "passwd", tokenExists: true},
 		"Get_newpassword_if_already_authenticated_with_password_and_session_is_passwd": {sessionMode: "passwd", tokenExists: true, secondAuthStep: true},
+		"Get_only_password_if_session_is_passwd_and_provider_is_not_available":         {sessionMode: "passwd", tokenExists: true, providerAddress: "127.0.0.1:31315", unavailableProvider: true},
 
 		"Error_if_there_is_no_session": {sessionID: "-", wantErr: true},
 
@@ -190,9 +755,14 @@ func TestGetAuthenticationModes(t *testing.T) {
 		"Error_if_expecting_device_auth_but_not_supported":    {supportedLayouts: []string{"qrcode-without-wait-and-qrcode"}, wantErr: true},
 		"Error_if_expecting_newpassword_but_not_supported":    {supportedLayouts: []string{"newpassword-without-entry"}, wantErr: true},
 		"Error_if_expecting_password_but_not_supported":       {supportedLayouts: []string{"form-without-entry"}, wantErr: true},
+		"Error_if_token_exists_but_no_mode_is_supported":      {tokenExists: true, supportedLayouts: []string{"form-without-entry", "qrcode-without-wait"}, wantErr: true},
 
 		// Passwd session errors
-		"Error_if_session_is_passwd_but_token_does_not_exist": {sessionMode: "passwd", wantErr: true},
+		"Error_if_session_is_passwd_but_token_does_not_exist":      {sessionMode: "passwd", wantErr: true},
+		"Error_if_session_is_passwd_but_password_is_not_supported": {sessionMode: "passwd", tokenExists: true, supportedLayouts: []string{"qrcode", "newpassword"}, wantErr: true},
+		"Error_if_session_is_passwd_but_password_is_disabled":      {sessionMode: "passwd", tokenExists: true, disablePassword: true, wantErr: true},
+
+		"Error_if_provider_is_not_available_and_password_is_disabled": {tokenExists: true, providerAddress: "127.0.0.1:31314", unavailableProvider: true, disablePassword: true, wantErr: true},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -202,7 +772,7 @@ func TestGetAuthenticationModes(t *testing.T) {
 				tc.sessionMode = "auth"
 			}
 
-			cfg := &brokerForTestConfig{}
+			cfg := &brokerForTestConfig{authModeOrder: tc.authModeOrder, disablePassword: tc.disablePassword}
 			if tc.providerAddress == "" {
 				// Use the default provider URL if no address is provided.
 				cfg.issuerURL = defaultIssuerURL
@@ -252,6 +822,12 @@ func TestGetAuthenticationModes(t *testing.T) {
 			}
 			require.NoError(t, err, "GetAuthenticationModes should not have returned an error")
 
+			if tc.disablePassword {
+				for _, mode := range got {
+					require.NotContains(t, []string{authmodes.Password, authmodes.NewPassword}, mode["id"], "Password modes should not be offered if disabled")
+				}
+			}
+
 			golden.CheckOrUpdateYAML(t, got)
 		})
 	}
@@ -287,6 +863,18 @@ func TestSelectAuthenticationMode(t *testing.T) {
 		"Successfully_select_device_auth_qr": {modeName: authmodes.DeviceQr},
 		"Successfully_select_device_auth":    {supportedLayouts: supportedLayoutsWithoutQrCode, modeName: authmodes.Device},
 		"Successfully_select_newpassword":    {modeName: authmodes.NewPassword, secondAuthStep: true},
+		"Successfully_select_device_auth_qr_with_complete_verification_uri": {modeName: authmodes.DeviceQr,
+			customHandlers: map[string]testutils.EndpointHandler{
+				"/device_auth": deviceAuthHandlerWithCompleteURI(),
+			},
+		},
+		"Successfully_select_device_auth_with_complete_verification_uri": {
+			supportedLayouts: supportedLayoutsWithoutQrCode,
+			modeName:         authmodes.Device,
+			customHandlers: map[string]testutils.EndpointHandler{
+				"/device_auth": deviceAuthHandlerWithCompleteURI(),
+			},
+		},
 
 		"Selected_newpassword_shows_correct_label_in_passwd_session": {modeName: authmodes.NewPassword, passwdSession: true, tokenExists: true, secondAuthStep: true},
 
@@ -366,6 +954,15 @@ func TestSelectAuthenticationMode(t *testing.T) {
 	}
 }
 
+// deviceAuthHandlerWithCompleteURI returns a device authorization handler which returns a complete verification URI,
+// embedding the user code.
+func deviceAuthHandlerWithCompleteURI() testutils.EndpointHandler {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"device_code": "device_code", "user_code": "user_code", "verification_uri": "https://verification_uri.com", "verification_uri_complete": "https://verification_uri.com?user_code=user_code"}`))
+	}
+}
+
 type isAuthenticatedResponse struct {
 	Access string
 	Data   string
@@ -691,6 +1288,29 @@ func TestIsAuthenticated(t *testing.T) {
 				err := os.WriteFile(passwordPath, []byte("Definitely a hashed password"), 0600)
 				require.NoError(t, err, "Teardown: Failed to write generic password file")
 			}
+			lastLoginPath := filepath.Join(b.UserDataDirForSession(sessionID), broker.LastLoginFileName)
+			if _, err := os.Stat(lastLoginPath); err == nil {
+				err := os.WriteFile(lastLoginPath, []byte("Definitely a last login record"), 0600)
+				require.NoError(t, err, "Teardown: Failed to write generic last login file")
+			}
+			firstLoginPath := filepath.Join(b.UserDataDirForSession(sessionID), broker.FirstLoginFileName)
+			if _, err := os.Stat(firstLoginPath); err == nil {
+				err := os.WriteFile(firstLoginPath, []byte("Definitely a first login record"), 0600)
+				require.NoError(t, err, "Teardown: Failed to write generic first login file")
+			}
+
+			// The files caching the discovery document and the signing keys are named after the random address of the provider.
+			err = os.RemoveAll(b.DiscoveryCachePath())
+			require.NoError(t, err, "Teardown: Failed to remove the cached discovery document")
+			err = os.RemoveAll(b.JWKSCachePath())
+			require.NoError(t, err, "Teardown: Failed to remove the cached signing keys")
+			// The usernames are recorded by the random address of the provider too.
+			usernamesPath := filepath.Join(b.DataDir(), broker.UsernamesFileName)
+			if content, err := os.ReadFile(usernamesPath); err == nil {
+				content = []byte(strings.ReplaceAll(string(content), b.IssuerURLForSession(sessionID), "provider_url"))
+				err := os.WriteFile(usernamesPath, content, 0600)
+				require.NoError(t, err, "Teardown: Failed to write generic usernames file")
+			}
 
 			// Ensure that the directory structure is generic to avoid golden file conflicts
 			if _, err := os.Stat(filepath.Dir(b.TokenPathForSession(sessionID))); err == nil {
@@ -828,6 +1448,7 @@ func TestConcurrentIsAuthenticated(t *testing.T) {
 
 			<-firstCallDone
 			<-secondCallDone
+			require.Equal(t, uint64(2), b.Metrics().Attempts[authmodes.Password], "Both concurrent authentications should be counted")
 
 			for _, sessionID := range []string{firstSession, secondSession} {
 				// Ensure that the token content is generic to avoid golden file conflicts
@@ -840,6 +1461,29 @@ func TestConcurrentIsAuthenticated(t *testing.T) {
 					err := os.WriteFile(passwordPath, []byte("Definitely a hashed password"), 0600)
 					require.NoError(t, err, "Teardown: Failed to write generic password file")
 				}
+				lastLoginPath := filepath.Join(b.UserDataDirForSession(sessionID), broker.LastLoginFileName)
+				if _, err := os.Stat(lastLoginPath); err == nil {
+					err := os.WriteFile(lastLoginPath, []byte("Definitely a last login record"), 0600)
+					require.NoError(t, err, "Teardown: Failed to write generic last login file")
+				}
+				firstLoginPath := filepath.Join(b.UserDataDirForSession(sessionID), broker.FirstLoginFileName)
+				if _, err := os.Stat(firstLoginPath); err == nil {
+					err := os.WriteFile(firstLoginPath, []byte("Definitely a first login record"), 0600)
+					require.NoError(t, err, "Teardown: Failed to write generic first login file")
+				}
+			}
+
+			// The files caching the discovery document and the signing keys are named after the random address of the provider.
+			err = os.RemoveAll(b.DiscoveryCachePath())
+			require.NoError(t, err, "Teardown: Failed to remove the cached discovery document")
+			err = os.RemoveAll(b.JWKSCachePath())
+			require.NoError(t, err, "Teardown: Failed to remove the cached signing keys")
+			// The usernames are recorded by the random address of the provider too.
+			usernamesPath := filepath.Join(b.DataDir(), broker.UsernamesFileName)
+			if content, err := os.ReadFile(usernamesPath); err == nil {
+				content = []byte(strings.ReplaceAll(string(content), b.IssuerURLForSession(firstSession), "provider_url"))
+				err := os.WriteFile(usernamesPath, content, 0600)
+				require.NoError(t, err, "Teardown: Failed to write generic usernames file")
 			}
 
 			// Ensure that the directory structure is generic to avoid golden file conflicts
@@ -976,22 +1620,2190 @@ func TestIsAuthenticatedAllowedUsersConfig(t *testing.T) {
 	}
 }
 
-func TestFetchUserInfo(t *testing.T) {
+func TestIsAuthenticatedAllowedGroupsConfig(t *testing.T) {
 	t.Parallel()
 
+	userGroups := []info.Group{
+		{Name: "remote-group", UGID: "12345"},
+		{Name: "Mixed-Case-Group", UGID: "67890"},
+		{Name: "local-group"},
+	}
+
 	tests := map[string]struct {
-		username string
-		token    tokenOptions
+		allowedGroups       map[string]struct{}
+		groupsCaseSensitive bool
 
-		emptyHomeDir bool
-		emptyGroups  bool
-		wantGroupErr bool
-		wantErr      bool
+		wantDenied bool
 	}{
-		"Successfully_fetch_user_info_with_groups":                         {},
-		"Successfully_fetch_user_info_without_groups":                      {emptyGroups: true},
-		"Successfully_fetch_user_info_with_default_home_when_not_provided": {emptyHomeDir: true},
-
+		"All_users_are_allowed_if_no_groups_are_configured": {},
+		"User_in_an_allowed_group_is_allowed": {
+			allowedGroups: map[string]struct{}{"other-group": {}, "remote-group": {}},
+		},
+		"User_in_an_allowed_local_group_is_allowed": {
+			allowedGroups: map[string]struct{}{"local-group": {}},
+		},
+		"Groups_are_matched_case_insensitively_by_default": {
+			allowedGroups: map[string]struct{}{"mixed-case-group": {}},
+		},
+		"Groups_are_matched_with_exact_case_if_requested": {
+			allowedGroups:       map[string]struct{}{"Mixed-Case-Group": {}},
+			groupsCaseSensitive: true,
+		},
+
+		"User_not_in_an_allowed_group_is_denied": {
+			allowedGroups: map[string]struct{}{"other-group": {}},
+			wantDenied:    true,
+		},
+		"User_in_a_group_with_a_different_case_is_denied_if_exact_case_is_requested": {
+			allowedGroups:       map[string]struct{}{"mixed-case-group": {}},
+			groupsCaseSensitive: true,
+			wantDenied:          true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed:     true,
+				allowedGroups:       tc.allowedGroups,
+				groupsCaseSensitive: tc.groupsCaseSensitive,
+				getGroupsFunc: func() ([]info.Group, error) {
+					return userGroups, nil
+				},
+			})
+
+			sessionID, key := newSessionForTests(t, b, "", "")
+			generateAndStoreCachedInfo(t, tokenOptions{}, b.TokenPathForSession(sessionID))
+			err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.True(t, json.Valid([]byte(data)), "IsAuthenticated returned data must be a valid JSON")
+
+			if tc.wantDenied {
+				require.Equal(t, broker.AuthDenied, access, "User should not have been allowed")
+				require.Contains(t, data, "user not in an allowed group", "Denial should explain the reason")
+				return
+			}
+			require.Equal(t, broker.AuthGranted, access, "User should have been allowed")
+		})
+	}
+}
+
+func TestIsAuthenticatedGroupNamesConfig(t *testing.T) {
+	t.Parallel()
+
+	userGroups := []info.Group{
+		{Name: "Domain Users", UGID: "12345"},
+		{Name: "R&D (Paris)", UGID: "67890"},
+		{Name: "sudo"},
+	}
+
+	tests := map[string]struct {
+		groupNameTemplate  string
+		groupNameSeparator string
+		userGroups         []info.Group
+		allowedGroups      map[string]struct{}
+
+		wantGroups []info.Group
+		wantDenied bool
+	}{
+		"Group_names_are_kept_if_no_template_is_configured": {
+			wantGroups: userGroups,
+		},
+		"Group_names_are_normalized_if_a_template_is_configured": {
+			groupNameTemplate:  "%g",
+			groupNameSeparator: "_",
+			wantGroups:         []info.Group{{Name: "domain_users", UGID: "12345"}, {Name: "rd_paris", UGID: "67890"}, {Name: "sudo"}},
+		},
+		"Group_names_are_prefixed_and_use_the_configured_separator": {
+			groupNameTemplate:  "oidc-%g",
+			groupNameSeparator: "-",
+			wantGroups:         []info.Group{{Name: "oidc-domain-users", UGID: "12345"}, {Name: "oidc-rd-paris", UGID: "67890"}, {Name: "sudo"}},
+		},
+		"Groups_without_any_allowed_character_are_ignored": {
+			groupNameTemplate: "oidc-%g",
+			userGroups:        []info.Group{{Name: "Équipe", UGID: "12345"}, {Name: "ÉÈ", UGID: "67890"}},
+			wantGroups:        []info.Group{{Name: "oidc-quipe", UGID: "12345"}},
+		},
+		"Groups_with_the_same_normalized_name_are_only_kept_once": {
+			groupNameTemplate: "%g",
+			userGroups:        []info.Group{{Name: "Admins", UGID: "12345"}, {Name: "admins", UGID: "67890"}},
+			wantGroups:        []info.Group{{Name: "admins", UGID: "12345"}},
+		},
+		"Allowed_groups_are_matched_against_the_upstream_names": {
+			groupNameTemplate: "oidc-%g",
+			allowedGroups:     map[string]struct{}{"domain users": {}},
+			wantGroups:        []info.Group{{Name: "oidc-domain_users", UGID: "12345"}, {Name: "oidc-rd_paris", UGID: "67890"}, {Name: "sudo"}},
+		},
+
+		"User_is_denied_if_only_the_normalized_name_is_allowed": {
+			groupNameTemplate: "oidc-%g",
+			allowedGroups:     map[string]struct{}{"oidc-domain_users": {}},
+			wantDenied:        true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.userGroups == nil {
+				tc.userGroups = userGroups
+			}
+			if tc.groupNameTemplate != "" && tc.groupNameSeparator == "" {
+				tc.groupNameSeparator = "_"
+			}
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed:    true,
+				groupNameTemplate:  tc.groupNameTemplate,
+				groupNameSeparator: tc.groupNameSeparator,
+				allowedGroups:      tc.allowedGroups,
+				getGroupsFunc: func() ([]info.Group, error) {
+					return tc.userGroups, nil
+				},
+			})
+
+			sessionID, key := newSessionForTests(t, b, "", "")
+			generateAndStoreCachedInfo(t, tokenOptions{}, b.TokenPathForSession(sessionID))
+			err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+
+			if tc.wantDenied {
+				require.Equal(t, broker.AuthDenied, access, "User should not have been allowed")
+				return
+			}
+			require.Equal(t, broker.AuthGranted, access, "User should have been allowed")
+
+			var got struct {
+				UserInfo info.User `json:"userinfo"`
+			}
+			err = json.Unmarshal([]byte(data), &got)
+			require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+			require.Equal(t, tc.wantGroups, got.UserInfo.Groups, "User should have the expected groups")
+		})
+	}
+}
+
+func TestIsAuthenticatedAdminUsersConfig(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+	remoteGroup := info.Group{Name: "remote-group", UGID: "12345"}
+	// The root group exists on every system.
+	adminGroup := info.Group{Name: "root"}
+
+	tests := map[string]struct {
+		adminUsers   map[string]struct{}
+		ownerIsAdmin bool
+		owner        string
+		adminGroup   string
+		userGroups   []info.Group
+
+		wantGroups []info.Group
+	}{
+		"Admin_group_is_not_added_if_no_admin_users_are_configured": {
+			wantGroups: []info.Group{remoteGroup},
+		},
+		"Admin_group_is_not_added_if_user_is_not_an_admin": {
+			adminUsers: map[string]struct{}{"other-user@email.com": {}},
+			adminGroup: adminGroup.Name,
+			wantGroups: []info.Group{remoteGroup},
+		},
+		"Admin_group_is_added_to_listed_admin_user": {
+			adminUsers: map[string]struct{}{username: {}},
+			adminGroup: adminGroup.Name,
+			wantGroups: []info.Group{remoteGroup, adminGroup},
+		},
+		"Admin_group_is_added_to_owner_if_owner_is_admin": {
+			ownerIsAdmin: true,
+			owner:        username,
+			adminGroup:   adminGroup.Name,
+			wantGroups:   []info.Group{remoteGroup, adminGroup},
+		},
+		"Admin_group_is_not_added_to_other_users_if_owner_is_admin": {
+			ownerIsAdmin: true,
+			owner:        "other-user@email.com",
+			adminGroup:   adminGroup.Name,
+			wantGroups:   []info.Group{remoteGroup},
+		},
+		"Admin_group_is_not_duplicated_if_user_is_already_a_member": {
+			adminUsers: map[string]struct{}{username: {}},
+			adminGroup: adminGroup.Name,
+			userGroups: []info.Group{adminGroup, remoteGroup},
+			wantGroups: []info.Group{adminGroup, remoteGroup},
+		},
+		"Admin_group_is_not_added_if_it_does_not_exist_on_the_system": {
+			adminUsers: map[string]struct{}{username: {}},
+			adminGroup: "nonexistent-admin-group",
+			wantGroups: []info.Group{remoteGroup},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.userGroups == nil {
+				tc.userGroups = []info.Group{remoteGroup}
+			}
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed: true,
+				owner:           tc.owner,
+				adminUsers:      tc.adminUsers,
+				ownerIsAdmin:    tc.ownerIsAdmin,
+				adminGroup:      tc.adminGroup,
+				getGroupsFunc: func() ([]info.Group, error) {
+					return tc.userGroups, nil
+				},
+			})
+
+			sessionID, key := newSessionForTests(t, b, username, "")
+			generateAndStoreCachedInfo(t, tokenOptions{username: username}, b.TokenPathForSession(sessionID))
+			err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthGranted, access, "User should have been allowed")
+
+			var got struct {
+				UserInfo info.User `json:"userinfo"`
+			}
+			err = json.Unmarshal([]byte(data), &got)
+			require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+			require.Equal(t, tc.wantGroups, got.UserInfo.Groups, "User should have the expected groups")
+
+			cached, err := token.LoadAuthInfo(b.TokenPathForSession(sessionID))
+			require.NoError(t, err, "Cached token should be loadable")
+			require.Equal(t, tc.userGroups, cached.UserInfo.Groups, "Admin group should not be cached")
+		})
+	}
+}
+
+func TestIsAuthenticatedAlwaysGroupsConfig(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+	remoteGroup := info.Group{Name: "remote-group", UGID: "12345"}
+	alwaysGroup := info.Group{Name: "oidc-users"}
+
+	tests := map[string]struct {
+		alwaysGroups  []string
+		allowedGroups map[string]struct{}
+		userGroups    []info.Group
+
+		wantAccess string
+		wantGroups []info.Group
+	}{
+		"Always_groups_are_not_added_if_none_are_configured": {
+			wantGroups: []info.Group{remoteGroup},
+		},
+		"Always_groups_are_added_to_every_user": {
+			alwaysGroups: []string{alwaysGroup.Name, "printers"},
+			wantGroups:   []info.Group{remoteGroup, alwaysGroup, {Name: "printers"}},
+		},
+		"Always_groups_are_not_duplicated_if_user_is_already_a_member": {
+			alwaysGroups: []string{alwaysGroup.Name},
+			userGroups:   []info.Group{alwaysGroup, remoteGroup},
+			wantGroups:   []info.Group{alwaysGroup, remoteGroup},
+		},
+		"Always_groups_do_not_grant_access_if_allowed_groups_are_configured": {
+			alwaysGroups:  []string{alwaysGroup.Name},
+			allowedGroups: map[string]struct{}{alwaysGroup.Name: {}},
+			wantAccess:    broker.AuthDenied,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.userGroups == nil {
+				tc.userGroups = []info.Group{remoteGroup}
+			}
+			if tc.wantAccess == "" {
+				tc.wantAccess = broker.AuthGranted
+			}
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed: true,
+				alwaysGroups:    tc.alwaysGroups,
+				allowedGroups:   tc.allowedGroups,
+				getGroupsFunc: func() ([]info.Group, error) {
+					return tc.userGroups, nil
+				},
+			})
+
+			sessionID, key := newSessionForTests(t, b, username, "")
+			generateAndStoreCachedInfo(t, tokenOptions{username: username}, b.TokenPathForSession(sessionID))
+			err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, tc.wantAccess, access, "IsAuthenticated should return the expected access")
+			if tc.wantAccess != broker.AuthGranted {
+				return
+			}
+
+			var got struct {
+				UserInfo info.User `json:"userinfo"`
+			}
+			err = json.Unmarshal([]byte(data), &got)
+			require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+			require.Equal(t, tc.wantGroups, got.UserInfo.Groups, "User should have the expected groups")
+
+			cached, err := token.LoadAuthInfo(b.TokenPathForSession(sessionID))
+			require.NoError(t, err, "Cached token should be loadable")
+			require.Equal(t, tc.userGroups, cached.UserInfo.Groups, "Always groups should not be cached")
+		})
+	}
+}
+
+func TestIsAuthenticatedOnGroupFetchError(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+	storedGroup := info.Group{Name: "stored-group", UGID: "12345"}
+	alwaysGroup := info.Group{Name: "oidc-users"}
+
+	tests := map[string]struct {
+		policy        string
+		noStoredToken bool
+
+		wantAccess string
+		wantGroups []info.Group
+	}{
+		"Log_in_with_the_stored_groups_if_policy_is_cached": {
+			policy:     "cached",
+			wantAccess: broker.AuthGranted,
+			wantGroups: []info.Group{storedGroup, alwaysGroup},
+		},
+		"Log_in_with_only_the_always_groups_if_policy_is_minimal": {
+			policy:     "minimal",
+			wantAccess: broker.AuthGranted,
+			wantGroups: []info.Group{alwaysGroup},
+		},
+
+		"Error_when_policy_is_unset": {wantAccess: broker.AuthDenied},
+		"Error_when_policy_is_deny":  {policy: "deny", wantAccess: broker.AuthDenied},
+		"Error_when_policy_is_cached_and_no_groups_are_stored": {
+			policy:        "cached",
+			noStoredToken: true,
+			wantAccess:    broker.AuthDenied,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				issuerURL:         defaultIssuerURL,
+				allUsersAllowed:   true,
+				alwaysGroups:      []string{alwaysGroup.Name},
+				onGroupFetchError: tc.policy,
+				getGroupsFunc: func() ([]info.Group, error) {
+					return nil, errors.New("groups API is down")
+				},
+			})
+			sessionID, key := newSessionForTests(t, b, username, "")
+
+			var access, data string
+			var err error
+			if tc.noStoredToken {
+				updateAuthModes(t, b, sessionID, authmodes.Device)
+				access, data, err = b.IsAuthenticated(sessionID, "{}")
+			} else {
+				tok := tokenOptions{username: username, issuer: defaultIssuerURL, groups: []info.Group{storedGroup}}
+				generateAndStoreCachedInfo(t, tok, b.TokenPathForSession(sessionID))
+				err = password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+				require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+				updateAuthModes(t, b, sessionID, authmodes.Password)
+
+				authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+				access, data, err = b.IsAuthenticated(sessionID, authData)
+			}
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, tc.wantAccess, access, "IsAuthenticated returned unexpected access: %s", data)
+			if tc.wantAccess != broker.AuthGranted {
+				return
+			}
+
+			var got struct {
+				UserInfo info.User `json:"userinfo"`
+			}
+			err = json.Unmarshal([]byte(data), &got)
+			require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+			require.Equal(t, tc.wantGroups, got.UserInfo.Groups, "User should have the expected groups")
+		})
+	}
+}
+
+func TestIsAuthenticatedGroupSyncMode(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+	keptGroup := info.Group{Name: "kept-group", UGID: "12345"}
+	removedGroup := info.Group{Name: "removed-group", UGID: "67890"}
+	addedGroup := info.Group{Name: "added-group", UGID: "13579"}
+
+	tests := map[string]struct {
+		mode string
+
+		wantSecondGroups []info.Group
+	}{
+		"Removed_groups_are_dropped_if_mode_is_unset": {
+			wantSecondGroups: []info.Group{keptGroup, addedGroup},
+		},
+		"Removed_groups_are_dropped_if_mode_is_authoritative": {
+			mode:             "authoritative",
+			wantSecondGroups: []info.Group{keptGroup, addedGroup},
+		},
+		"Removed_groups_are_kept_if_mode_is_additive": {
+			mode:             "additive",
+			wantSecondGroups: []info.Group{keptGroup, addedGroup, removedGroup},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			// The user is removed from a group and added to another one at the provider between the two logins.
+			var mu sync.Mutex
+			providerGroups := []info.Group{keptGroup, removedGroup}
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				issuerURL:       defaultIssuerURL,
+				allUsersAllowed: true,
+				groupSyncMode:   tc.mode,
+				getGroupsFunc: func() ([]info.Group, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					return slices.Clone(providerGroups), nil
+				},
+			})
+			login := func() []info.Group {
+				t.Helper()
+
+				sessionID, key := newSessionForTests(t, b, username, "")
+				updateAuthModes(t, b, sessionID, authmodes.Password)
+				access, data, err := b.IsAuthenticated(sessionID, `{"challenge":"`+encryptChallenge(t, "password", key)+`"}`)
+				require.NoError(t, err, "IsAuthenticated should not have returned an error")
+				require.Equal(t, broker.AuthGranted, access, "User should have been allowed: %s", data)
+
+				var got struct {
+					UserInfo info.User `json:"userinfo"`
+				}
+				err = json.Unmarshal([]byte(data), &got)
+				require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+				return got.UserInfo.Groups
+			}
+
+			sessionID, _ := newSessionForTests(t, b, username, "")
+			tok := tokenOptions{username: username, issuer: defaultIssuerURL, groups: []info.Group{keptGroup, removedGroup}}
+			generateAndStoreCachedInfo(t, tok, b.TokenPathForSession(sessionID))
+			err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			require.Equal(t, []info.Group{keptGroup, removedGroup}, login(), "The first login should report the groups of the provider")
+
+			mu.Lock()
+			providerGroups = []info.Group{keptGroup, addedGroup}
+			mu.Unlock()
+			require.Equal(t, tc.wantSecondGroups, login(), "The second login should report the expected groups")
+		})
+	}
+}
+
+func TestIsAuthenticatedPasswordPolicy(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+	policy := password.Policy{MinLength: 8, RequiredClasses: []string{password.ClassDigit}, DisallowReuse: true}
+
+	tests := map[string]struct {
+		policy           *password.Policy
+		previousPassword string
+		newPassword      string
+
+		wantAccess  string
+		wantMessage string
+	}{
+		"Any_password_is_accepted_if_no_policy_is_configured": {newPassword: "a"},
+		"Password_following_the_policy_is_accepted":           {policy: &policy, previousPassword: "previous1", newPassword: "password1"},
+
+		"Retry_when_password_is_too_short":                {policy: &policy, newPassword: "pass1", wantAccess: broker.AuthRetry, wantMessage: "the password must be at least 8 characters long"},
+		"Retry_when_password_misses_a_character_class":    {policy: &policy, newPassword: "password", wantAccess: broker.AuthRetry, wantMessage: "the password must contain at least a digit"},
+		"Retry_when_password_is_the_previous_one":         {policy: &policy, previousPassword: "password1", newPassword: "password1", wantAccess: broker.AuthRetry, wantMessage: "the password must be different from the previous one"},
+		"Previous_password_can_be_reused_if_not_disabled": {policy: &password.Policy{MinLength: 8}, previousPassword: "password1", newPassword: "password1"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.wantAccess == "" {
+				tc.wantAccess = broker.AuthGranted
+			}
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed: true,
+				passwordPolicy:  tc.policy,
+			})
+
+			sessionID, key := newSessionForTests(t, b, username, "")
+			if tc.previousPassword != "" {
+				err := password.HashAndStorePassword(tc.previousPassword, b.PasswordFilepathForSession(sessionID))
+				require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+			}
+
+			// Setting a new password is the second step, after the user authenticated with the provider.
+			authInfo := generateCachedInfo(t, tokenOptions{username: username})
+			require.NoError(t, b.SetAuthInfo(sessionID, "auth_info", *authInfo), "Setup: Failed to set AuthInfo for tests")
+			b.UpdateSessionAuthStep(sessionID, 1)
+			updateAuthModes(t, b, sessionID, authmodes.NewPassword)
+
+			authData := `{"challenge":"` + encryptChallenge(t, tc.newPassword, key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, tc.wantAccess, access, "IsAuthenticated should return the expected access")
+
+			if tc.wantMessage != "" {
+				var got struct {
+					Message string `json:"message"`
+				}
+				err = json.Unmarshal([]byte(data), &got)
+				require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+				require.Contains(t, got.Message, tc.wantMessage, "IsAuthenticated should describe the rule which is not followed")
+			}
+
+			// The rejected password must not replace the previous one.
+			wantPassword := tc.newPassword
+			if tc.wantAccess != broker.AuthGranted {
+				wantPassword = tc.previousPassword
+			}
+			if wantPassword == "" {
+				require.NoFileExists(t, b.PasswordFilepathForSession(sessionID), "No password should have been stored")
+				return
+			}
+			ok, err := password.CheckPassword(wantPassword, b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "CheckPassword should not have returned an error")
+			require.True(t, ok, "The expected password should be stored")
+		})
+	}
+}
+
+func TestIsAuthenticatedPasswordThrottle(t *testing.T) {
+	t.Parallel()
+
+	const correctPassword = "password"
+	const lockout = 500 * time.Millisecond
+
+	type attempt struct {
+		username string
+		password string
+		// wait is how long to wait before the attempt.
+		wait time.Duration
+
+		wantAccess string
+		wantLocked bool
+	}
+
+	tests := map[string]struct {
+		maxFailedAttempts int
+		attempts          []attempt
+	}{
+		"Failed_attempts_are_not_limited_if_not_configured": {
+			attempts: []attempt{
+				{password: "wrong", wantAccess: broker.AuthRetry},
+				{password: "wrong", wantAccess: broker.AuthRetry},
+				{password: "wrong", wantAccess: broker.AuthRetry},
+				{password: correctPassword, wantAccess: broker.AuthGranted},
+			},
+		},
+		"User_is_locked_out_after_too_many_failed_attempts_across_sessions": {
+			maxFailedAttempts: 2,
+			attempts: []attempt{
+				{password: "wrong", wantAccess: broker.AuthRetry},
+				{password: "wrong", wantAccess: broker.AuthDenied, wantLocked: true},
+				{password: correctPassword, wantAccess: broker.AuthDenied, wantLocked: true},
+				{password: correctPassword, wait: lockout, wantAccess: broker.AuthGranted},
+			},
+		},
+		"Successful_login_resets_the_failed_attempts": {
+			maxFailedAttempts: 2,
+			attempts: []attempt{
+				{password: "wrong", wantAccess: broker.AuthRetry},
+				{password: correctPassword, wantAccess: broker.AuthGranted},
+				{password: "wrong", wantAccess: broker.AuthRetry},
+				{password: correctPassword, wantAccess: broker.AuthGranted},
+			},
+		},
+		"Lockout_doubles_with_each_new_lockout": {
+			maxFailedAttempts: 1,
+			attempts: []attempt{
+				{password: "wrong", wantAccess: broker.AuthDenied, wantLocked: true},
+				{password: "wrong", wait: lockout, wantAccess: broker.AuthDenied, wantLocked: true},
+				{password: correctPassword, wait: lockout + 100*time.Millisecond, wantAccess: broker.AuthDenied, wantLocked: true},
+				{password: correctPassword, wait: lockout, wantAccess: broker.AuthGranted},
+			},
+		},
+		"Other_users_are_not_locked_out": {
+			maxFailedAttempts: 1,
+			attempts: []attempt{
+				{password: "wrong", wantAccess: broker.AuthDenied, wantLocked: true},
+				{username: "other-user@email.com", password: correctPassword, wantAccess: broker.AuthGranted},
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed:      true,
+				maxFailedAttempts:    tc.maxFailedAttempts,
+				failedAttemptsWindow: time.Minute,
+				lockoutDuration:      lockout,
+			})
+
+			for i, a := range tc.attempts {
+				if a.username == "" {
+					a.username = "test-user@email.com"
+				}
+				time.Sleep(a.wait)
+
+				// Each attempt is made in a new session, like when the user tries to log in again.
+				sessionID, key := newSessionForTests(t, b, a.username, "")
+				generateAndStoreCachedInfo(t, tokenOptions{username: a.username}, b.TokenPathForSession(sessionID))
+				err := password.HashAndStorePassword(correctPassword, b.PasswordFilepathForSession(sessionID))
+				require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+				updateAuthModes(t, b, sessionID, authmodes.Password)
+
+				authData := `{"challenge":"` + encryptChallenge(t, a.password, key) + `"}`
+				access, data, err := b.IsAuthenticated(sessionID, authData)
+				require.NoError(t, err, "IsAuthenticated should not have returned an error")
+				require.Equal(t, a.wantAccess, access, "IsAuthenticated should return the expected access for attempt %d", i)
+
+				var got struct {
+					Message string `json:"message"`
+				}
+				err = json.Unmarshal([]byte(data), &got)
+				require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+				if a.wantLocked {
+					require.Contains(t, got.Message, "too many failed attempts", "User should be locked out at attempt %d", i)
+				} else {
+					require.NotContains(t, got.Message, "too many failed attempts", "User should not be locked out at attempt %d", i)
+				}
+
+				require.NoError(t, b.EndSession(sessionID), "Teardown: EndSession should not have returned an error")
+			}
+		})
+	}
+}
+
+func TestIsAuthenticatedDisablePassword(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		mode            string
+		disablePassword bool
+
+		wantAccess string
+	}{
+		"Device_auth_grants_access_if_password_is_disabled":           {mode: authmodes.DeviceQr, disablePassword: true, wantAccess: broker.AuthGranted},
+		"Device_auth_asks_for_a_local_password_if_it_is_not_disabled": {mode: authmodes.DeviceQr, wantAccess: broker.AuthNext},
+
+		"Error_when_authenticating_with_password_if_it_is_disabled":  {mode: authmodes.Password, disablePassword: true, wantAccess: broker.AuthDenied},
+		"Error_when_defining_a_new_password_if_password_is_disabled": {mode: authmodes.NewPassword, disablePassword: true, wantAccess: broker.AuthDenied},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed: true,
+				disablePassword: tc.disablePassword,
+			})
+			sessionID, key := newSessionForTests(t, b, "", "")
+
+			var authData string
+			switch tc.mode {
+			case authmodes.DeviceQr:
+				authData = `{}`
+			case authmodes.Password:
+				generateAndStoreCachedInfo(t, tokenOptions{}, b.TokenPathForSession(sessionID))
+				err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+				require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+				authData = `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			case authmodes.NewPassword:
+				authData = `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			}
+			updateAuthModes(t, b, sessionID, tc.mode)
+
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.True(t, json.Valid([]byte(data)), "IsAuthenticated returned data must be a valid JSON")
+			require.Equal(t, tc.wantAccess, access, "IsAuthenticated should return the expected access")
+
+			if tc.mode != authmodes.DeviceQr {
+				return
+			}
+			require.NoFileExists(t, b.PasswordFilepathForSession(sessionID), "No local password should have been stored")
+			if tc.wantAccess == broker.AuthGranted {
+				require.FileExists(t, b.TokenPathForSession(sessionID), "Token should have been cached")
+			}
+		})
+	}
+}
+
+func TestIsAuthenticatedFailureCauses(t *testing.T) {
+	t.Parallel()
+
+	const correctPassword = "password"
+	tokenError := func(code string) testutils.EndpointHandler {
+		return func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "` + code + `"}`))
+		}
+	}
+	closeConnection := func(w http.ResponseWriter, _ *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}
+
+	tests := map[string]struct {
+		mode              string
+		password          string
+		allowedGroups     map[string]struct{}
+		maxFailedAttempts int
+		tokenHandler      testutils.EndpointHandler
+
+		wantAccess string
+		wantErr    error
+	}{
+		"No_cause_when_access_is_granted": {wantAccess: broker.AuthGranted},
+		"No_cause_when_password_is_incorrect": {
+			password:   "wrong",
+			wantAccess: broker.AuthRetry,
+		},
+
+		"Error_is_ErrInvalidGrant_when_refresh_token_is_rejected": {
+			tokenHandler: tokenError("invalid_grant"),
+			wantAccess:   broker.AuthDenied,
+			wantErr:      broker.ErrInvalidGrant,
+		},
+		"Error_is_ErrProviderUnreachable_when_token_can_not_be_refreshed": {
+			tokenHandler: closeConnection,
+			wantAccess:   broker.AuthDenied,
+			wantErr:      broker.ErrProviderUnreachable,
+		},
+		"Error_is_ErrNotInAllowedGroup_when_user_is_not_in_an_allowed_group": {
+			allowedGroups: map[string]struct{}{"other-group": {}},
+			wantAccess:    broker.AuthDenied,
+			wantErr:       broker.ErrNotInAllowedGroup,
+		},
+		"Error_is_ErrTooManyAttempts_when_user_is_locked_out": {
+			password:          "wrong",
+			maxFailedAttempts: 1,
+			wantAccess:        broker.AuthDenied,
+			wantErr:           broker.ErrTooManyAttempts,
+		},
+		"Error_is_ErrDeviceCodeExpired_when_device_code_expired": {
+			mode:         authmodes.Device,
+			tokenHandler: tokenError("expired_token"),
+			wantAccess:   broker.AuthRetry,
+			wantErr:      broker.ErrDeviceCodeExpired,
+		},
+		"Error_is_ErrAccessDenied_when_user_declines_device_code": {
+			mode:         authmodes.Device,
+			tokenHandler: tokenError("access_denied"),
+			wantAccess:   broker.AuthDenied,
+			wantErr:      broker.ErrAccessDenied,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.mode == "" {
+				tc.mode = authmodes.Password
+			}
+			if tc.password == "" {
+				tc.password = correctPassword
+			}
+
+			cfg := &brokerForTestConfig{
+				allUsersAllowed:      true,
+				allowedGroups:        tc.allowedGroups,
+				maxFailedAttempts:    tc.maxFailedAttempts,
+				failedAttemptsWindow: time.Minute,
+				lockoutDuration:      time.Minute,
+			}
+			if tc.tokenHandler != nil {
+				cfg.customHandlers = map[string]testutils.EndpointHandler{"/token": tc.tokenHandler}
+			}
+			b := newBrokerForTests(t, cfg)
+
+			sessionID, key := newSessionForTests(t, b, "", "")
+			authData := "{}"
+			if tc.mode == authmodes.Password {
+				generateAndStoreCachedInfo(t, tokenOptions{username: "test-user@email.com"}, b.TokenPathForSession(sessionID))
+				err := password.HashAndStorePassword(correctPassword, b.PasswordFilepathForSession(sessionID))
+				require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+				authData = `{"challenge":"` + encryptChallenge(t, tc.password, key) + `"}`
+			}
+			updateAuthModes(t, b, sessionID, tc.mode)
+
+			access, err := b.IsAuthenticatedCause(sessionID, authData)
+			require.Equal(t, tc.wantAccess, access, "IsAuthenticated should return the expected access")
+			if tc.wantErr == nil {
+				require.NoError(t, err, "IsAuthenticated should not have failed because of an authentication error")
+				return
+			}
+			require.ErrorIs(t, err, tc.wantErr, "IsAuthenticated should have failed with the expected error")
+			for _, other := range []error{broker.ErrProviderUnreachable, broker.ErrInvalidGrant, broker.ErrNotInAllowedGroup, broker.ErrDeviceCodeExpired, broker.ErrAccessDenied, broker.ErrTooManyAttempts} {
+				if other != tc.wantErr {
+					require.NotErrorIs(t, err, other, "IsAuthenticated should not have failed with another error")
+				}
+			}
+		})
+	}
+}
+
+func TestGroupGID(t *testing.T) {
+	t.Parallel()
+
+	const issuer = "https://issuer.url.com"
+	const minGID, maxGID = 1_000_000_000, 1_999_999_999
+
+	var cfg broker.Config
+	require.Zero(t, cfg.GroupGID(issuer, "group"), "GID should be 0 if no GID range is configured")
+
+	cfg.SetGIDRange(minGID, maxGID)
+	gid := cfg.GroupGID(issuer, "group")
+	require.Equal(t, gid, cfg.GroupGID(issuer, "group"), "GID of the same group should be stable")
+	require.NotEqual(t, gid, cfg.GroupGID("https://other.issuer.url.com", "group"),
+		"Groups with the same name from different providers should have different GIDs")
+
+	// The probability that 1000 groups collide in a range of 1e9 GIDs is about 5e-4. The names are fixed, so this
+	// does not make the test flaky.
+	seen := make(map[uint32]string)
+	for i := range 1000 {
+		ugid := fmt.Sprintf("group-%d", i)
+		gid := cfg.GroupGID(issuer, ugid)
+		require.GreaterOrEqual(t, gid, uint32(minGID), "GID should not be lower than the range")
+		require.LessOrEqual(t, gid, uint32(maxGID), "GID should not be greater than the range")
+		require.NotContains(t, seen, gid, "GID of %q should not collide with the GID of %q", ugid, seen[gid])
+		seen[gid] = ugid
+	}
+
+	cfg.SetGIDRange(5000, 5000)
+	require.Equal(t, uint32(5000), cfg.GroupGID(issuer, "group"), "GID should be the only one of the range")
+}
+
+func TestAssignGIDs(t *testing.T) {
+	t.Parallel()
+
+	const issuer = "https://issuer.url.com"
+	// The range is small for the GIDs to collide, and high for them not to be used by local groups.
+	const minGID, maxGID = 3_000_000_000, 3_000_000_002
+
+	b := newBrokerForTests(t, &brokerForTestConfig{
+		issuerURL: defaultIssuerURL,
+		gidRange:  [2]uint32{minGID, maxGID},
+	})
+	var cfg broker.Config
+	cfg.SetGIDRange(minGID, maxGID)
+
+	localGroup := info.Group{Name: "local-group"}
+	groups, err := b.AssignGIDs(issuer, []info.Group{{Name: "group", UGID: "group"}, localGroup})
+	require.NoError(t, err, "AssignGIDs should not have returned an error")
+	gid := groups[0].GID
+	require.Equal(t, cfg.GroupGID(issuer, "group"), gid, "GID should be the one derived from the UGID")
+	require.Equal(t, localGroup, groups[1], "Local group should keep its own GID")
+
+	// Find another group which is derived the same GID.
+	var collidingUGID string
+	for i := 0; collidingUGID == ""; i++ {
+		if ugid := fmt.Sprintf("group-%d", i); cfg.GroupGID(issuer, ugid) == gid {
+			collidingUGID = ugid
+		}
+	}
+	groups, err = b.AssignGIDs(issuer, []info.Group{{Name: "other-group", UGID: collidingUGID}})
+	require.NoError(t, err, "AssignGIDs should not have returned an error")
+	collidingGID := groups[0].GID
+	wantGID := gid + 1
+	if gid == maxGID {
+		wantGID = minGID
+	}
+	require.Equal(t, wantGID, collidingGID, "GID should be the next one of the range on collision")
+
+	groups, err = b.AssignGIDs(issuer, []info.Group{{Name: "other-group", UGID: collidingUGID}, {Name: "group", UGID: "group"}})
+	require.NoError(t, err, "AssignGIDs should not have returned an error")
+	require.Equal(t, collidingGID, groups[0].GID, "GID assigned on collision should be kept")
+	require.Equal(t, gid, groups[1].GID, "GID of the group should be stable")
+
+	_, err = b.AssignGIDs(issuer, []info.Group{{Name: "third-group", UGID: "third-group"}})
+	require.NoError(t, err, "AssignGIDs should not have returned an error")
+	_, err = b.AssignGIDs(issuer, []info.Group{{Name: "fourth-group", UGID: "fourth-group"}})
+	require.Error(t, err, "AssignGIDs should return an error when all the GIDs of the range are used")
+}
+
+func TestIsAuthenticatedGIDRangeConfig(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+	remoteGroup := info.Group{Name: "remote-group", UGID: "12345"}
+	localGroup := info.Group{Name: "local-group"}
+	userGroups := []info.Group{remoteGroup, localGroup}
+
+	tests := map[string]struct {
+		gidRange [2]uint32
+
+		wantGIDs bool
+	}{
+		"GIDs_are_not_assigned_if_no_range_is_configured": {},
+		"GIDs_are_assigned_to_the_remote_groups":          {gidRange: [2]uint32{1_000_000_000, 1_999_999_999}, wantGIDs: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed: true,
+				gidRange:        tc.gidRange,
+				getGroupsFunc: func() ([]info.Group, error) {
+					return userGroups, nil
+				},
+			})
+
+			sessionID, key := newSessionForTests(t, b, username, "")
+			generateAndStoreCachedInfo(t, tokenOptions{username: username}, b.TokenPathForSession(sessionID))
+			err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthGranted, access, "IsAuthenticated should return the expected access")
+
+			var got struct {
+				UserInfo info.User `json:"userinfo"`
+			}
+			err = json.Unmarshal([]byte(data), &got)
+			require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+
+			wantGroups := slices.Clone(userGroups)
+			if tc.wantGIDs {
+				var cfg broker.Config
+				cfg.SetGIDRange(tc.gidRange[0], tc.gidRange[1])
+				wantGroups[0].GID = cfg.GroupGID(b.IssuerURLForSession(sessionID), remoteGroup.UGID)
+				require.NotZero(t, wantGroups[0].GID, "Remote group should have a GID")
+			}
+			require.Equal(t, wantGroups, got.UserInfo.Groups, "User should have the expected groups")
+
+			cached, err := token.LoadAuthInfo(b.TokenPathForSession(sessionID))
+			require.NoError(t, err, "Cached token should be loadable")
+			require.Equal(t, userGroups, cached.UserInfo.Groups, "GIDs should not be cached")
+		})
+	}
+}
+
+func TestSubjectUID(t *testing.T) {
+	t.Parallel()
+
+	const issuer = "https://issuer.url.com"
+	const minUID, maxUID = 1_000_000_000, 1_999_999_999
+
+	var cfg broker.Config
+	require.Zero(t, cfg.SubjectUID(issuer, "subject"), "UID should be 0 if no UID range is configured")
+
+	cfg.SetUIDRange(minUID, maxUID)
+	uid := cfg.SubjectUID(issuer, "subject")
+	require.Equal(t, uid, cfg.SubjectUID(issuer, "subject"), "UID of the same subject should be stable")
+	require.NotEqual(t, uid, cfg.SubjectUID("https://other.issuer.url.com", "subject"),
+		"Users with the same subject from different providers should have different UIDs")
+
+	for i := range 1000 {
+		subject := fmt.Sprintf("subject-%d", i)
+		uid := cfg.SubjectUID(issuer, subject)
+		require.GreaterOrEqual(t, uid, uint32(minUID), "UID should not be lower than the range")
+		require.LessOrEqual(t, uid, uint32(maxUID), "UID should not be greater than the range")
+	}
+
+	cfg.SetUIDRange(5000, 5000)
+	require.Equal(t, uint32(5000), cfg.SubjectUID(issuer, "subject"), "UID should be the only one of the range")
+}
+
+func TestAssignUID(t *testing.T) {
+	t.Parallel()
+
+	const issuer = "https://issuer.url.com"
+	// The range is small for the UIDs to collide, and high for them not to be used by local users.
+	const minUID, maxUID = 3_000_000_000, 3_000_000_002
+
+	b := newBrokerForTests(t, &brokerForTestConfig{
+		issuerURL: defaultIssuerURL,
+		uidRange:  [2]uint32{minUID, maxUID},
+	})
+	var cfg broker.Config
+	cfg.SetUIDRange(minUID, maxUID)
+
+	uid, err := b.AssignUID(issuer, "subject", "user@example.com")
+	require.NoError(t, err, "AssignUID should not have returned an error")
+	require.Equal(t, cfg.SubjectUID(issuer, "subject"), uid, "UID should be the one derived from the subject")
+
+	// Find another subject which is derived the same UID.
+	var collidingSubject string
+	for i := 0; collidingSubject == ""; i++ {
+		if subject := fmt.Sprintf("subject-%d", i); cfg.SubjectUID(issuer, subject) == uid {
+			collidingSubject = subject
+		}
+	}
+	collidingUID, err := b.AssignUID(issuer, collidingSubject, "other-user@example.com")
+	require.NoError(t, err, "AssignUID should not have returned an error")
+	wantUID := uid + 1
+	if uid == maxUID {
+		wantUID = minUID
+	}
+	require.Equal(t, wantUID, collidingUID, "UID should be the next one of the range on collision")
+
+	got, err := b.AssignUID(issuer, "subject", "user@example.com")
+	require.NoError(t, err, "AssignUID should not have returned an error")
+	require.Equal(t, uid, got, "UID of the user should be stable")
+	got, err = b.AssignUID(issuer, collidingSubject, "other-user@example.com")
+	require.NoError(t, err, "AssignUID should not have returned an error")
+	require.Equal(t, collidingUID, got, "UID assigned on collision should be kept")
+
+	_, err = b.AssignUID(issuer, "third-subject", "third-user@example.com")
+	require.NoError(t, err, "AssignUID should not have returned an error")
+	_, err = b.AssignUID(issuer, "fourth-subject", "fourth-user@example.com")
+	require.Error(t, err, "AssignUID should return an error when all the UIDs of the range are used")
+
+	uid, err = b.AssignUID(issuer, "", "user-without-subject@example.com")
+	require.NoError(t, err, "AssignUID should not have returned an error")
+	require.Zero(t, uid, "UID should be 0 if the subject is unknown")
+}
+
+func TestIsAuthenticatedUIDRangeConfig(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+
+	tests := map[string]struct {
+		uidRange [2]uint32
+
+		wantUID bool
+	}{
+		"UID_is_not_assigned_if_no_range_is_configured": {},
+		"UID_is_assigned_from_the_subject":              {uidRange: [2]uint32{1_000_000_000, 1_999_999_999}, wantUID: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed: true,
+				uidRange:        tc.uidRange,
+			})
+
+			sessionID, key := newSessionForTests(t, b, username, "")
+			generateAndStoreCachedInfo(t, tokenOptions{username: username}, b.TokenPathForSession(sessionID))
+			err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthGranted, access, "IsAuthenticated should return the expected access")
+
+			var got struct {
+				UserInfo info.User `json:"userinfo"`
+			}
+			err = json.Unmarshal([]byte(data), &got)
+			require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+
+			var wantUID uint32
+			if tc.wantUID {
+				var cfg broker.Config
+				cfg.SetUIDRange(tc.uidRange[0], tc.uidRange[1])
+				wantUID = cfg.SubjectUID(b.IssuerURLForSession(sessionID), got.UserInfo.UUID)
+				require.NotZero(t, wantUID, "User should have a UID")
+			}
+			require.Equal(t, wantUID, got.UserInfo.UID, "User should have the expected UID")
+
+			cached, err := token.LoadAuthInfo(b.TokenPathForSession(sessionID))
+			require.NoError(t, err, "Cached token should be loadable")
+			require.Zero(t, cached.UserInfo.UID, "UID should not be cached")
+		})
+	}
+}
+
+func TestIsAuthenticatedUsernameCollision(t *testing.T) {
+	t.Parallel()
+
+	// The subject and the username of the user authenticated by the mock provider.
+	const subject = "test-user-id"
+	const username = "test-user@email.com"
+	usedByOtherUser := map[string]string{"other-user-id": username}
+
+	tests := map[string]struct {
+		strategy        string
+		storedUsernames map[string]string
+		loginAs         string
+
+		wantAccess         string
+		wantMessage        string
+		wantStoredUsername string
+	}{
+		"Username_is_stored_when_user_is_granted_access": {
+			strategy:           "reject",
+			wantStoredUsername: username,
+		},
+		"Username_is_stored_even_if_collisions_are_not_handled": {
+			wantStoredUsername: username,
+		},
+		"Usernames_are_not_checked_if_not_configured": {
+			storedUsernames: usedByOtherUser,
+		},
+		"Suffixed_username_is_given_if_username_is_used_by_another_user": {
+			strategy:           "suffix",
+			storedUsernames:    usedByOtherUser,
+			loginAs:            "test-user-2@email.com",
+			wantStoredUsername: "test-user-2@email.com",
+		},
+		"Stored_username_is_kept_even_if_a_lower_suffix_is_free": {
+			strategy:           "suffix",
+			storedUsernames:    map[string]string{"other-user-id": username, subject: "test-user-3@email.com"},
+			loginAs:            "test-user-3@email.com",
+			wantStoredUsername: "test-user-3@email.com",
+		},
+
+		"Error_when_username_is_used_by_another_user": {
+			strategy:        "reject",
+			storedUsernames: usedByOtherUser,
+			wantAccess:      broker.AuthDenied,
+			wantMessage:     `the username "test-user@email.com" is already used by another user`,
+		},
+		"Error_when_logging_in_with_username_used_by_another_user_instead_of_suffixed_one": {
+			strategy:        "suffix",
+			storedUsernames: usedByOtherUser,
+			wantAccess:      broker.AuthDenied,
+			wantMessage:     `log in as "test-user-2@email.com" instead`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.loginAs == "" {
+				tc.loginAs = username
+			}
+			if tc.wantAccess == "" {
+				tc.wantAccess = broker.AuthGranted
+			}
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed:   true,
+				usernameCollision: tc.strategy,
+			})
+			sessionID, key := newSessionForTests(t, b, tc.loginAs, "")
+			issuerURL := b.IssuerURLForSession(sessionID)
+			for s, name := range tc.storedUsernames {
+				err := b.StoreUsername(issuerURL, s, name)
+				require.NoError(t, err, "Setup: StoreUsername should not have returned an error")
+			}
+
+			updateAuthModes(t, b, sessionID, authmodes.Device)
+			access, data, err := b.IsAuthenticated(sessionID, "{}")
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			if tc.wantAccess == broker.AuthDenied {
+				require.Equal(t, broker.AuthDenied, access, "IsAuthenticated should deny access")
+				var got struct {
+					Message string `json:"message"`
+				}
+				err = json.Unmarshal([]byte(data), &got)
+				require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+				require.Contains(t, got.Message, tc.wantMessage, "IsAuthenticated should tell why the username can not be used")
+				return
+			}
+			require.Equal(t, broker.AuthNext, access, "IsAuthenticated should ask for a new password")
+
+			b.UpdateSessionAuthStep(sessionID, 1)
+			updateAuthModes(t, b, sessionID, authmodes.NewPassword)
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err = b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthGranted, access, "IsAuthenticated should grant access")
+
+			var got struct {
+				UserInfo info.User `json:"userinfo"`
+			}
+			err = json.Unmarshal([]byte(data), &got)
+			require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+			require.Equal(t, tc.loginAs, got.UserInfo.Name, "User should have the expected username")
+			require.Equal(t, tc.loginAs, filepath.Base(got.UserInfo.Home), "User should have their own home directory")
+
+			stored, err := b.StoredUsername(issuerURL, subject)
+			require.NoError(t, err, "StoredUsername should not have returned an error")
+			require.Equal(t, tc.wantStoredUsername, stored, "The expected username should be stored for the user")
+		})
+	}
+}
+
+func TestIsAuthenticatedRequiredAuthenticationContext(t *testing.T) {
+	t.Parallel()
+
+	// The claims of the ID token are checked by TestCheckAuthenticationContext, TestCheckEmailVerified and
+	// TestCheckAuthTime. This only checks that the login is denied when they are not as required.
+	b := newBrokerForTests(t, &brokerForTestConfig{
+		allUsersAllowed: true,
+		requiredAMR:     []string{"mfa"},
+		tokenHandlerOptions: &testutils.TokenHandlerOptions{
+			IDTokenClaims: []map[string]interface{}{{"amr": []string{"pwd"}}},
+		},
+	})
+	sessionID, _ := newSessionForTests(t, b, "", "")
+
+	updateAuthModes(t, b, sessionID, authmodes.Device)
+	access, data, err := b.IsAuthenticated(sessionID, "{}")
+	require.NoError(t, err, "IsAuthenticated should not have returned an error")
+	require.Equal(t, broker.AuthDenied, access, "IsAuthenticated should deny access")
+	var got struct {
+		Message string `json:"message"`
+	}
+	err = json.Unmarshal([]byte(data), &got)
+	require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+	require.Contains(t, got.Message, "required method", "IsAuthenticated should tell why the user is denied")
+}
+
+func TestCheckAuthenticationContext(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		requiredAMR []string
+		requiredACR []string
+		claims      map[string]interface{}
+
+		wantErr bool
+	}{
+		"Nothing_is_required_if_not_configured":              {claims: map[string]interface{}{"amr": []string{"pwd"}}},
+		"Required_method_is_in_the_amr_array":                {requiredAMR: []string{"mfa"}, claims: map[string]interface{}{"amr": []string{"pwd", "mfa"}}},
+		"Required_method_is_the_amr_string":                  {requiredAMR: []string{"mfa"}, claims: map[string]interface{}{"amr": "mfa"}},
+		"One_of_the_required_methods_is_in_the_amr":          {requiredAMR: []string{"hwk", "otp"}, claims: map[string]interface{}{"amr": []string{"pwd", "otp"}}},
+		"Required_context_class_is_the_acr":                  {requiredACR: []string{"urn:mfa"}, claims: map[string]interface{}{"acr": "urn:mfa"}},
+		"Required_method_and_context_class_are_in_the_token": {requiredAMR: []string{"mfa"}, requiredACR: []string{"urn:mfa"}, claims: map[string]interface{}{"amr": []string{"mfa"}, "acr": "urn:mfa"}},
+
+		"Error_when_amr_is_absent":                         {requiredAMR: []string{"mfa"}, wantErr: true},
+		"Error_when_amr_array_does_not_contain_the_method": {requiredAMR: []string{"mfa"}, claims: map[string]interface{}{"amr": []string{"pwd"}}, wantErr: true},
+		"Error_when_amr_string_is_not_the_method":          {requiredAMR: []string{"mfa"}, claims: map[string]interface{}{"amr": "pwd"}, wantErr: true},
+		"Error_when_acr_is_absent":                         {requiredACR: []string{"urn:mfa"}, wantErr: true},
+		"Error_when_acr_is_not_the_context_class":          {requiredACR: []string{"urn:mfa"}, claims: map[string]interface{}{"acr": "urn:pwd"}, wantErr: true},
+		"Error_when_only_the_amr_is_as_required":           {requiredAMR: []string{"mfa"}, requiredACR: []string{"urn:mfa"}, claims: map[string]interface{}{"amr": "mfa"}, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				requiredAMR: tc.requiredAMR,
+				requiredACR: tc.requiredACR,
+			})
+			rawIDToken := generateCachedInfo(t, tokenOptions{idTokenClaims: tc.claims}).RawIDToken
+
+			err := b.CheckAuthenticationContext(rawIDToken)
+			if tc.wantErr {
+				require.Error(t, err, "CheckAuthenticationContext should have returned an error")
+				return
+			}
+			require.NoError(t, err, "CheckAuthenticationContext should not have returned an error")
+		})
+	}
+}
+
+func TestCheckEmailVerified(t *testing.T) {
+	t.Parallel()
+
+	// A null claim is handled like a missing one.
+	missing := map[string]interface{}{"email_verified": nil}
+
+	tests := map[string]struct {
+		requireVerified bool
+		allowMissing    bool
+		claims          map[string]interface{}
+
+		wantErr bool
+	}{
+		"Nothing_is_required_if_not_configured":         {claims: map[string]interface{}{"email_verified": false}},
+		"Email_is_verified":                             {requireVerified: true},
+		"Email_is_verified_as_a_string":                 {requireVerified: true, claims: map[string]interface{}{"email_verified": "true"}},
+		"Claim_is_missing_and_missing_claim_is_allowed": {requireVerified: true, allowMissing: true, claims: missing},
+
+		"Error_when_email_is_not_verified":                   {requireVerified: true, claims: map[string]interface{}{"email_verified": false}, wantErr: true},
+		"Error_when_email_is_not_verified_as_a_string":       {requireVerified: true, claims: map[string]interface{}{"email_verified": "false"}, wantErr: true},
+		"Error_when_email_is_not_verified_and_missing_is_ok": {requireVerified: true, allowMissing: true, claims: map[string]interface{}{"email_verified": false}, wantErr: true},
+		"Error_when_claim_is_missing":                        {requireVerified: true, claims: missing, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				requireVerifiedEmail: tc.requireVerified,
+				allowMissingVerified: tc.allowMissing,
+			})
+			rawIDToken := generateCachedInfo(t, tokenOptions{idTokenClaims: tc.claims}).RawIDToken
+
+			err := b.CheckEmailVerified(rawIDToken)
+			if tc.wantErr {
+				require.Error(t, err, "CheckEmailVerified should have returned an error")
+				return
+			}
+			require.NoError(t, err, "CheckEmailVerified should not have returned an error")
+		})
+	}
+}
+
+func TestLoginHint(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		sendLoginHint bool
+		noUsername    bool
+
+		wantLoginHint string
+	}{
+		"Login_hint_is_the_username_if_enabled": {sendLoginHint: true, wantLoginHint: "test-user@email.com"},
+
+		"No_login_hint_if_not_enabled":         {},
+		"No_login_hint_if_username_is_unknown": {sendLoginHint: true, noUsername: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			loginHint := make(chan string, 1)
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				sendLoginHint: tc.sendLoginHint,
+				customHandlers: map[string]testutils.EndpointHandler{
+					"/device_auth": func(w http.ResponseWriter, r *http.Request) {
+						select {
+						case loginHint <- r.FormValue("login_hint"):
+						default:
+						}
+						testutils.DefaultDeviceAuthHandler()(w, r)
+					},
+				},
+			})
+			var sessionID string
+			if tc.noUsername {
+				var err error
+				sessionID, _, err = b.NewSession("", "some lang", "auth")
+				require.NoError(t, err, "Setup: NewSession should not have returned an error")
+			} else {
+				sessionID, _ = newSessionForTests(t, b, "", "")
+			}
+
+			updateAuthModes(t, b, sessionID, authmodes.Device)
+			require.Equal(t, tc.wantLoginHint, <-loginHint, "The device authorization request should have the expected login hint")
+		})
+	}
+}
+
+func TestAuthParams(t *testing.T) {
+	t.Parallel()
+
+	params := make(chan url.Values, 1)
+	b := newBrokerForTests(t, &brokerForTestConfig{
+		authParams: map[string]string{"prompt": "consent", "hd": "example.com"},
+		customHandlers: map[string]testutils.EndpointHandler{
+			"/device_auth": func(w http.ResponseWriter, r *http.Request) {
+				_ = r.ParseForm()
+				select {
+				case params <- r.PostForm:
+				default:
+				}
+				testutils.DefaultDeviceAuthHandler()(w, r)
+			},
+		},
+	})
+	sessionID, _ := newSessionForTests(t, b, "", "")
+
+	updateAuthModes(t, b, sessionID, authmodes.Device)
+	got := <-params
+	require.Equal(t, "consent", got.Get("prompt"), "The device authorization request should have the configured prompt")
+	require.Equal(t, "example.com", got.Get("hd"), "The device authorization request should have the configured hd")
+	require.NotEmpty(t, got.Get("client_id"), "The device authorization request should still have the client ID")
+}
+
+func TestTokenAudience(t *testing.T) {
+	t.Parallel()
+
+	const audience = "https://graph.microsoft.com"
+	tests := map[string]struct {
+		tokenAudience string
+		endpointsPath string
+
+		wantParam string
+		wantScope string
+	}{
+		"Send_the_audience_parameter": {tokenAudience: audience, wantParam: "audience"},
+		"Send_the_resource_parameter_to_v1_endpoints": {
+			tokenAudience: audience,
+			endpointsPath: "/oauth2",
+			wantParam:     "resource",
+		},
+		"Request_the_audience_as_a_scope_of_v2_endpoints": {
+			tokenAudience: audience,
+			endpointsPath: "/oauth2/v2.0",
+			wantScope:     audience + "/.default",
+		},
+
+		"Do_not_send_the_audience_if_not_configured": {},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			deviceAuthForms := make(chan url.Values, 1)
+			tokenForms := make(chan url.Values, 1)
+			recordForm := func(forms chan url.Values, handler func(serverURL string) testutils.EndpointHandler) testutils.EndpointHandler {
+				return func(w http.ResponseWriter, r *http.Request) {
+					if err := r.ParseForm(); err == nil {
+						select {
+						case forms <- r.PostForm:
+						default:
+						}
+					}
+					handler("http://"+r.Host)(w, r)
+				}
+			}
+			tokenPath := tc.endpointsPath + "/token"
+			deviceAuthPath := tc.endpointsPath + "/device_auth"
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				tokenAudience: tc.tokenAudience,
+				customHandlers: map[string]testutils.EndpointHandler{
+					"/.well-known/openid-configuration": func(w http.ResponseWriter, r *http.Request) {
+						serverURL := "http://" + r.Host
+						w.Header().Add("Content-Type", "application/json")
+						_, _ = fmt.Fprintf(w, `{
+							"issuer": "%[1]s",
+							"device_authorization_endpoint": "%[1]s%[2]s",
+							"token_endpoint": "%[1]s%[3]s",
+							"jwks_uri": "%[1]s/keys",
+							"id_token_signing_alg_values_supported": ["RS256"]
+						}`, serverURL, deviceAuthPath, tokenPath)
+					},
+					deviceAuthPath: recordForm(deviceAuthForms, func(string) testutils.EndpointHandler {
+						return testutils.DefaultDeviceAuthHandler()
+					}),
+					tokenPath: recordForm(tokenForms, func(serverURL string) testutils.EndpointHandler {
+						return testutils.TokenHandler(serverURL, nil)
+					}),
+				},
+			})
+			sessionID, _ := newSessionForTests(t, b, "", "")
+
+			updateAuthModes(t, b, sessionID, authmodes.Device)
+			access, data, err := b.IsAuthenticated(sessionID, "{}")
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthNext, access, "IsAuthenticated should ask for a new password: %s", data)
+
+			deviceAuthForm := <-deviceAuthForms
+			scopes := strings.Fields(deviceAuthForm.Get("scope"))
+			if tc.wantScope != "" {
+				require.Contains(t, scopes, tc.wantScope, "The device authorization request should have the audience as a scope")
+			} else {
+				require.False(t, slices.ContainsFunc(scopes, func(s string) bool { return strings.HasSuffix(s, "/.default") }),
+					"The device authorization request should not have the audience as a scope")
+			}
+			for request, form := range map[string]url.Values{"device authorization": deviceAuthForm, "token": <-tokenForms} {
+				for _, param := range []string{"audience", "resource"} {
+					if param == tc.wantParam {
+						require.Equal(t, tc.tokenAudience, form.Get(param), "The %s request should have the audience as the %q parameter", request, param)
+						continue
+					}
+					require.False(t, form.Has(param), "The %s request should not have the %q parameter", request, param)
+				}
+			}
+		})
+	}
+}
+
+func TestIsAuthenticatedMaxAge(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		maxAge time.Duration
+
+		wantMaxAgeParam string
+	}{
+		"Request_the_maximum_age_if_configured": {maxAge: time.Hour, wantMaxAgeParam: "3600"},
+
+		"Do_not_request_a_maximum_age_if_not_configured": {},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			maxAgeParam := make(chan string, 1)
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				maxAge: tc.maxAge,
+				customHandlers: map[string]testutils.EndpointHandler{
+					"/device_auth": func(w http.ResponseWriter, r *http.Request) {
+						select {
+						case maxAgeParam <- r.FormValue("max_age"):
+						default:
+						}
+						testutils.DefaultDeviceAuthHandler()(w, r)
+					},
+				},
+			})
+			sessionID, _ := newSessionForTests(t, b, "", "")
+
+			updateAuthModes(t, b, sessionID, authmodes.Device)
+			require.Equal(t, tc.wantMaxAgeParam, <-maxAgeParam, "The device authorization request should have the configured max_age")
+		})
+	}
+}
+
+func TestCheckAuthTime(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	tests := map[string]struct {
+		maxAge time.Duration
+		claims map[string]interface{}
+
+		wantErr bool
+	}{
+		"Authentication_time_is_not_checked_if_not_configured": {},
+		"Authentication_time_is_within_the_maximum_age": {
+			maxAge: time.Hour,
+			claims: map[string]interface{}{"auth_time": now.Add(-10 * time.Minute).Unix()},
+		},
+
+		"Error_when_authentication_time_exceeds_the_maximum_age": {
+			maxAge:  time.Hour,
+			claims:  map[string]interface{}{"auth_time": now.Add(-2 * time.Hour).Unix()},
+			wantErr: true,
+		},
+		"Error_when_authentication_time_is_absent": {maxAge: time.Hour, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{maxAge: tc.maxAge})
+			rawIDToken := generateCachedInfo(t, tokenOptions{idTokenClaims: tc.claims}).RawIDToken
+
+			err := b.CheckAuthTime(rawIDToken, now)
+			if tc.wantErr {
+				require.Error(t, err, "CheckAuthTime should have returned an error")
+				return
+			}
+			require.NoError(t, err, "CheckAuthTime should not have returned an error")
+		})
+	}
+}
+
+func TestIsAuthenticatedHooks(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+
+	tests := map[string]struct {
+		loggedInBefore bool
+		onlyLastLogin  bool
+		notRecorded    bool
+		failingHook    string
+		blockLogin     bool
+
+		wantAccess string
+		wantEvents []string
+	}{
+		"Successfully_run_first_login_and_login_hooks": {
+			wantAccess: broker.AuthGranted,
+			wantEvents: []string{"first_login", "login"},
+		},
+		"Successfully_run_only_login_hook_if_user_logged_in_before": {
+			loggedInBefore: true,
+			wantAccess:     broker.AuthGranted,
+			wantEvents:     []string{"login"},
+		},
+		"Successfully_run_only_login_hook_if_only_last_login_was_recorded": {
+			loggedInBefore: true,
+			onlyLastLogin:  true,
+			wantAccess:     broker.AuthGranted,
+			wantEvents:     []string{"login"},
+		},
+		"Successfully_run_first_login_hook_if_token_is_cached_but_login_was_not_recorded": {
+			loggedInBefore: true,
+			notRecorded:    true,
+			wantAccess:     broker.AuthGranted,
+			wantEvents:     []string{"first_login", "login"},
+		},
+		"Login_is_granted_if_a_hook_fails_and_does_not_block": {
+			failingHook: "first_login",
+			wantAccess:  broker.AuthGranted,
+			wantEvents:  []string{"login"},
+		},
+
+		"Error_when_first_login_hook_fails_and_blocks_login": {
+			failingHook: "first_login",
+			blockLogin:  true,
+			wantAccess:  broker.AuthDenied,
+		},
+		"Error_when_login_hook_fails_and_blocks_login": {
+			failingHook: "login",
+			blockLogin:  true,
+			wantAccess:  broker.AuthDenied,
+			wantEvents:  []string{"first_login"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			logPath := filepath.Join(dir, "events")
+			hookPath := filepath.Join(dir, "hook")
+			script := fmt.Sprintf("#!/bin/sh\n[ \"$AUTHD_OIDC_EVENT\" = %q ] && exit 1\n"+
+				"echo \"$AUTHD_OIDC_EVENT $AUTHD_OIDC_USERNAME $AUTHD_OIDC_GROUPS ${HOME:-unset}\" >> %q\n", tc.failingHook, logPath)
+			err := os.WriteFile(hookPath, []byte(script), 0700)
+			require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				issuerURL:        defaultIssuerURL,
+				allUsersAllowed:  true,
+				onFirstLogin:     []string{hookPath},
+				onLogin:          []string{hookPath},
+				blockLoginOnHook: tc.blockLogin,
+			})
+			sessionID, key := newSessionForTests(t, b, username, "")
+
+			var access string
+			if tc.loggedInBefore {
+				loginRecord := broker.FirstLoginFileName
+				if tc.onlyLastLogin {
+					loginRecord = broker.LastLoginFileName
+				}
+				if !tc.notRecorded {
+					err = os.MkdirAll(b.UserDataDirForSession(sessionID), 0700)
+					require.NoError(t, err, "Setup: MkdirAll should not have returned an error")
+					err = os.WriteFile(filepath.Join(b.UserDataDirForSession(sessionID), loginRecord), []byte("{}"), 0600)
+					require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+				}
+				tok := generateCachedInfo(t, tokenOptions{username: username, issuer: defaultIssuerURL})
+				err = token.CacheAuthInfo(b.TokenPathForSession(sessionID), *tok)
+				require.NoError(t, err, "Setup: CacheAuthInfo should not have returned an error")
+				err = password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+				require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+				updateAuthModes(t, b, sessionID, authmodes.Password)
+			} else {
+				updateAuthModes(t, b, sessionID, authmodes.Device)
+				access, _, err = b.IsAuthenticated(sessionID, "{}")
+				require.NoError(t, err, "IsAuthenticated should not have returned an error")
+				require.Equal(t, broker.AuthNext, access, "IsAuthenticated should ask for a new password")
+
+				b.UpdateSessionAuthStep(sessionID, 1)
+				updateAuthModes(t, b, sessionID, authmodes.NewPassword)
+			}
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, tc.wantAccess, access, "IsAuthenticated returned unexpected access: %s", data)
+
+			_, err = os.Stat(filepath.Join(b.UserDataDirForSession(sessionID), broker.FirstLoginFileName))
+			if tc.wantAccess != broker.AuthGranted {
+				require.ErrorIs(t, err, os.ErrNotExist, "The first login should not have been recorded if access was denied")
+			} else if !tc.onlyLastLogin {
+				require.NoError(t, err, "The first login should have been recorded")
+			}
+
+			err = b.EndSession(sessionID)
+			require.NoError(t, err, "EndSession should not have returned an error")
+
+			var gotEvents []string
+			content, err := os.ReadFile(logPath)
+			if !errors.Is(err, os.ErrNotExist) {
+				require.NoError(t, err, "ReadFile should not have returned an error")
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+				if line == "" {
+					continue
+				}
+				fields := strings.Fields(line)
+				require.Len(t, fields, 4, "The hook should have been passed the event, the username and the groups")
+				require.Equal(t, username, fields[1], "The hook should have been passed the username")
+				require.Equal(t, "remote-test-group,local-test-group", fields[2], "The hook should have been passed the groups")
+				require.Equal(t, "unset", fields[3], "The hook should not have inherited the environment of the broker")
+				gotEvents = append(gotEvents, fields[0])
+			}
+			require.Equal(t, tc.wantEvents, gotEvents, "The hooks of the expected events should have been run")
+
+		})
+	}
+}
+
+func TestIsAuthenticatedShellConfig(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+	developers := info.Group{Name: "developers", UGID: "12345"}
+	operators := info.Group{Name: "operators", UGID: "67890"}
+	groupShells := map[string]string{"developers": "/usr/bin/zsh", "operators": "/bin/sh"}
+
+	tests := map[string]struct {
+		defaultShell string
+		groupShells  map[string]string
+		userGroups   []info.Group
+
+		wantShell string
+	}{
+		"Built_in_default_shell_is_used_if_no_shell_is_configured": {
+			wantShell: info.DefaultShell,
+		},
+		"Default_shell_is_used_if_configured": {
+			defaultShell: "/bin/bash",
+			wantShell:    "/bin/bash",
+		},
+		"Group_shell_is_used_for_members_of_the_group": {
+			defaultShell: "/bin/bash",
+			groupShells:  groupShells,
+			userGroups:   []info.Group{developers},
+			wantShell:    "/usr/bin/zsh",
+		},
+		"Group_shell_of_the_first_matching_group_is_used": {
+			groupShells: groupShells,
+			userGroups:  []info.Group{operators, developers},
+			wantShell:   "/bin/sh",
+		},
+		"Default_shell_is_used_for_users_not_in_a_group_with_a_shell": {
+			defaultShell: "/bin/bash",
+			groupShells:  groupShells,
+			userGroups:   []info.Group{{Name: "other-group", UGID: "13579"}},
+			wantShell:    "/bin/bash",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed: true,
+				defaultShell:    tc.defaultShell,
+				groupShells:     tc.groupShells,
+				getGroupsFunc: func() ([]info.Group, error) {
+					return tc.userGroups, nil
+				},
+			})
+
+			sessionID, key := newSessionForTests(t, b, username, "")
+			generateAndStoreCachedInfo(t, tokenOptions{username: username}, b.TokenPathForSession(sessionID))
+			err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthGranted, access, "User should have been allowed")
+
+			var got struct {
+				UserInfo info.User `json:"userinfo"`
+			}
+			err = json.Unmarshal([]byte(data), &got)
+			require.NoError(t, err, "IsAuthenticated returned data must be a valid JSON")
+			require.Equal(t, tc.wantShell, got.UserInfo.Shell, "User should have the expected shell")
+		})
+	}
+}
+func TestIsAuthenticatedOfflineCredentialTTL(t *testing.T) {
+	t.Parallel()
+
+	ttl := 2 * time.Hour
+	noTTL := time.Duration(0)
+
+	tests := map[string]struct {
+		offlineCredentialTTL *time.Duration
+		token                tokenOptions
+
+		wantDenied bool
+	}{
+		"Offline_login_is_allowed_with_expired_token_if_no_TTL_is_configured": {
+			token: tokenOptions{idTokenExpiry: time.Now().Add(-1000 * time.Hour), expired: true},
+		},
+		"Offline_login_is_allowed_if_ID_token_has_not_expired": {
+			offlineCredentialTTL: &ttl,
+			token:                tokenOptions{idTokenExpiry: time.Now().Add(time.Hour), expired: true},
+		},
+		"Offline_login_is_allowed_if_ID_token_expired_within_the_TTL": {
+			offlineCredentialTTL: &ttl,
+			token:                tokenOptions{idTokenExpiry: time.Now().Add(-time.Hour), expired: true},
+		},
+		"Offline_login_uses_access_token_expiry_if_there_is_no_ID_token": {
+			offlineCredentialTTL: &ttl,
+			token:                tokenOptions{noIDToken: true},
+		},
+
+		"Offline_login_is_denied_if_ID_token_expired_before_the_TTL": {
+			offlineCredentialTTL: &ttl,
+			token:                tokenOptions{idTokenExpiry: time.Now().Add(-3 * time.Hour)},
+			wantDenied:           true,
+		},
+		"Offline_login_is_denied_if_ID_token_expired_and_TTL_is_zero": {
+			offlineCredentialTTL: &noTTL,
+			token:                tokenOptions{idTokenExpiry: time.Now().Add(-time.Minute)},
+			wantDenied:           true,
+		},
+		"Offline_login_is_denied_if_access_token_expired_before_the_TTL_and_there_is_no_ID_token": {
+			offlineCredentialTTL: &ttl,
+			token:                tokenOptions{noIDToken: true, expired: true},
+			wantDenied:           true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed:      true,
+				offlineCredentialTTL: tc.offlineCredentialTTL,
+				customHandlers: map[string]testutils.EndpointHandler{
+					"/.well-known/openid-configuration": testutils.UnavailableHandler(),
+				},
+			})
+
+			sessionID, key := newSessionForTests(t, b, "", "")
+			offline, err := b.IsOffline(sessionID)
+			require.NoError(t, err, "Setup: IsOffline should not have returned an error")
+			require.True(t, offline, "Setup: Session should be offline")
+
+			generateAndStoreCachedInfo(t, tc.token, b.TokenPathForSession(sessionID))
+			err = password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.True(t, json.Valid([]byte(data)), "IsAuthenticated returned data must be a valid JSON")
+
+			if tc.wantDenied {
+				require.Equal(t, broker.AuthDenied, access, "Offline login should have been denied")
+				require.Contains(t, data, "cached credentials expired", "Denial should explain the reason")
+				return
+			}
+			require.Equal(t, broker.AuthGranted, access, "Offline login should have been allowed")
+		})
+	}
+}
+
+func TestCheckIDTokenTimes(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	const skew = 2 * time.Minute
+
+	tests := map[string]struct {
+		expiry time.Time
+		claims map[string]any
+		noSkew bool
+
+		wantErr bool
+	}{
+		"Token_expiring_after_now_is_valid":                      {expiry: now.Add(5 * time.Second)},
+		"Token_expired_within_the_skew_is_valid":                 {expiry: now.Add(-5 * time.Second)},
+		"Token_valid_from_within_the_skew_is_valid":              {expiry: now.Add(time.Hour), claims: map[string]any{"nbf": now.Add(5 * time.Second).Unix()}},
+		"Token_valid_from_before_now_is_valid":                   {expiry: now.Add(time.Hour), claims: map[string]any{"nbf": now.Add(-5 * time.Second).Unix()}},
+		"Token_issued_within_the_skew_is_valid":                  {expiry: now.Add(time.Hour), claims: map[string]any{"iat": now.Add(5 * time.Second).Unix()}},
+		"Token_issued_before_now_is_valid":                       {expiry: now.Add(time.Hour), claims: map[string]any{"iat": now.Add(-5 * time.Second).Unix()}},
+		"Token_expiring_exactly_at_the_end_of_the_skew_is_valid": {expiry: now.Add(-skew)},
+		"Token_valid_from_exactly_the_end_of_the_skew_is_valid":  {expiry: now.Add(time.Hour), claims: map[string]any{"nbf": now.Add(skew).Unix()}},
+		"Token_expiring_after_now_is_valid_without_skew":         {expiry: now.Add(5 * time.Second), noSkew: true},
+		"Token_issued_before_now_is_valid_without_skew":          {expiry: now.Add(time.Hour), claims: map[string]any{"iat": now.Add(-5 * time.Second).Unix()}, noSkew: true},
+
+		"Error_when_token_expired_before_the_skew":                 {expiry: now.Add(-skew - 5*time.Second), wantErr: true},
+		"Error_when_token_is_valid_from_after_the_skew":            {expiry: now.Add(time.Hour), claims: map[string]any{"nbf": now.Add(skew + 5*time.Second).Unix()}, wantErr: true},
+		"Error_when_token_is_issued_after_the_skew":                {expiry: now.Add(time.Hour), claims: map[string]any{"iat": now.Add(skew + 5*time.Second).Unix()}, wantErr: true},
+		"Error_when_token_expired_a_few_seconds_ago_without_skew":  {expiry: now.Add(-5 * time.Second), noSkew: true, wantErr: true},
+		"Error_when_token_is_valid_in_a_few_seconds_without_skew":  {expiry: now.Add(time.Hour), claims: map[string]any{"nbf": now.Add(5 * time.Second).Unix()}, noSkew: true, wantErr: true},
+		"Error_when_token_is_issued_in_a_few_seconds_without_skew": {expiry: now.Add(time.Hour), claims: map[string]any{"iat": now.Add(5 * time.Second).Unix()}, noSkew: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			allowedSkew := skew
+			if tc.noSkew {
+				allowedSkew = 0
+			}
+			rawIDToken := generateCachedInfo(t, tokenOptions{idTokenExpiry: tc.expiry, idTokenClaims: tc.claims}).RawIDToken
+
+			err := broker.CheckIDTokenTimes(rawIDToken, now, allowedSkew)
+			if tc.wantErr {
+				require.Error(t, err, "CheckIDTokenTimes should have returned an error")
+				return
+			}
+			require.NoError(t, err, "CheckIDTokenTimes should not have returned an error")
+		})
+	}
+}
+
+func TestCachedKeySet(t *testing.T) {
+	t.Parallel()
+
+	var signingKeys []*rsa.PrivateKey
+	for range 2 {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err, "Setup: GenerateKey should not have returned an error")
+		signingKeys = append(signingKeys, key)
+	}
+	keySet := func(ids ...int) []byte {
+		var set jose.JSONWebKeySet
+		for _, id := range ids {
+			set.Keys = append(set.Keys, jose.JSONWebKey{Key: &signingKeys[id].PublicKey, KeyID: fmt.Sprint("key-", id), Algorithm: "RS256", Use: "sig"})
+		}
+		content, err := json.Marshal(set)
+		require.NoError(t, err, "Setup: Marshal should not have returned an error")
+		return content
+	}
+
+	tests := map[string]struct {
+		cachedKeys        []int
+		cacheAge          time.Duration
+		noRefreshInterval bool
+		servedKeys        []int
+		serverDown        bool
+		signedWith        int
+
+		wantFetches int
+		wantErr     bool
+	}{
+		"Fetch_keys_when_none_are_cached":                                {servedKeys: []int{0}, wantFetches: 1},
+		"Use_cached_keys_within_the_refresh_interval":                    {cachedKeys: []int{0}, servedKeys: []int{0}},
+		"Fetch_keys_when_cached_ones_are_outdated":                       {cachedKeys: []int{0}, cacheAge: 2 * time.Hour, servedKeys: []int{0}, wantFetches: 1},
+		"Fetch_keys_when_token_is_signed_with_a_rotated_key":             {cachedKeys: []int{0}, servedKeys: []int{0, 1}, signedWith: 1, wantFetches: 1},
+		"Use_outdated_keys_when_provider_is_unreachable":                 {cachedKeys: []int{0}, cacheAge: 2 * time.Hour, serverDown: true},
+		"Fetch_keys_every_time_when_refresh_interval_is_zero":            {cachedKeys: []int{0}, noRefreshInterval: true, servedKeys: []int{0}, wantFetches: 1},
+		"Error_when_token_is_signed_with_a_key_unknown_after_refetching": {cachedKeys: []int{0}, servedKeys: []int{0}, signedWith: 1, wantFetches: 1, wantErr: true},
+		"Error_when_no_key_is_cached_and_provider_is_unreachable":        {serverDown: true, wantErr: true},
+		"Error_when_rotated_key_can_not_be_fetched":                      {cachedKeys: []int{0}, serverDown: true, signedWith: 1, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var fetches atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				fetches.Add(1)
+				if tc.serverDown {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Add("Content-Type", "application/json")
+				_, _ = w.Write(keySet(tc.servedKeys...))
+			}))
+			t.Cleanup(server.Close)
+
+			cachePath := filepath.Join(t.TempDir(), "issuer.jwks.json")
+			if tc.cachedKeys != nil {
+				err := os.WriteFile(cachePath, keySet(tc.cachedKeys...), 0600)
+				require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+				cachedAt := time.Now().Add(-tc.cacheAge)
+				require.NoError(t, os.Chtimes(cachePath, cachedAt, cachedAt), "Setup: Chtimes should not have returned an error")
+			}
+			refreshInterval := time.Hour
+			if tc.noRefreshInterval {
+				refreshInterval = 0
+			}
+
+			idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "user"})
+			idToken.Header["kid"] = fmt.Sprint("key-", tc.signedWith)
+			rawIDToken, err := idToken.SignedString(signingKeys[tc.signedWith])
+			require.NoError(t, err, "Setup: SignedString should not have returned an error")
+
+			err = broker.VerifyWithCachedKeySet(server.URL, cachePath, refreshInterval, rawIDToken)
+			// The number of fetches does not matter when the provider is not reachable.
+			if !tc.serverDown {
+				require.Equal(t, tc.wantFetches, int(fetches.Load()), "Signing keys should have been fetched the expected number of times")
+			}
+			if tc.wantErr {
+				require.Error(t, err, "VerifyWithCachedKeySet should have returned an error")
+				return
+			}
+			require.NoError(t, err, "VerifyWithCachedKeySet should not have returned an error")
+
+			// The fetched keys are cached and reused right away, including the rotated one.
+			err = broker.VerifyWithCachedKeySet(server.URL, cachePath, time.Hour, rawIDToken)
+			require.NoError(t, err, "VerifyWithCachedKeySet should not have returned an error with the cached keys")
+			if !tc.serverDown {
+				require.Equal(t, tc.wantFetches, int(fetches.Load()), "Cached signing keys should have been reused")
+			}
+		})
+	}
+}
+
+func TestCheckOfflineCredentialsClockSkew(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	const ttl = time.Hour
+	const skew = 2 * time.Minute
+
+	tests := map[string]struct {
+		// deadline is when the cached credentials stop being usable offline, relative to now.
+		deadline time.Duration
+		noSkew   bool
+
+		wantErr bool
+	}{
+		"Credentials_are_usable_a_few_seconds_before_the_deadline":              {deadline: 5 * time.Second},
+		"Credentials_are_usable_a_few_seconds_after_the_deadline_within_skew":   {deadline: -5 * time.Second},
+		"Credentials_are_usable_a_few_seconds_before_the_deadline_without_skew": {deadline: 5 * time.Second, noSkew: true},
+
+		"Error_when_deadline_passed_before_the_skew":                {deadline: -skew - 5*time.Second, wantErr: true},
+		"Error_when_deadline_passed_a_few_seconds_ago_without_skew": {deadline: -5 * time.Second, noSkew: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ttl := ttl
+			cfg := &brokerForTestConfig{offlineCredentialTTL: &ttl, allowedClockSkew: skew}
+			if tc.noSkew {
+				cfg.allowedClockSkew = 0
+			}
+			b := newBrokerForTests(t, cfg)
+
+			authInfo := generateCachedInfo(t, tokenOptions{idTokenExpiry: now.Add(tc.deadline - ttl)})
+
+			err := b.CheckOfflineCredentials(*authInfo, now)
+			if tc.wantErr {
+				require.Error(t, err, "CheckOfflineCredentials should have returned an error")
+				return
+			}
+			require.NoError(t, err, "CheckOfflineCredentials should not have returned an error")
+		})
+	}
+}
+
+func TestWebAuthnAuthentication(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		noWebAuthnProvider bool
+		noWebAuthnLayout   bool
+		providerOffline    bool
+		assertion          string
+
+		wantOffered bool
+		wantAccess  string
+	}{
+		"Successfully_authenticate_with_WebAuthn": {wantOffered: true, wantAccess: broker.AuthNext},
+
+		"WebAuthn_is_not_offered_if_provider_does_not_support_it": {noWebAuthnProvider: true},
+		"WebAuthn_is_not_offered_if_UI_does_not_support_it":       {noWebAuthnLayout: true},
+		"WebAuthn_is_not_offered_if_provider_is_not_reachable":    {providerOffline: true},
+
+		"Error_when_assertion_is_invalid": {assertion: "invalid-assertion", wantOffered: true, wantAccess: broker.AuthRetry},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := &brokerForTestConfig{allUsersAllowed: true, webAuthn: !tc.noWebAuthnProvider}
+			if tc.providerOffline {
+				cfg.customHandlers = map[string]testutils.EndpointHandler{
+					"/.well-known/openid-configuration": testutils.UnavailableHandler(),
+				}
+			}
+			b := newBrokerForTests(t, cfg)
+			sessionID, key := newSessionForTests(t, b, "", "")
+
+			layouts := []map[string]string{supportedUILayouts["qrcode"], supportedUILayouts["newpassword"]}
+			if !tc.noWebAuthnLayout {
+				layouts = append(layouts, supportedUILayouts["webauthn"])
+			}
+			if tc.providerOffline {
+				// An offline session with no cached token is only offered the password mode.
+				generateAndStoreCachedInfo(t, tokenOptions{}, b.TokenPathForSession(sessionID))
+				layouts = append(layouts, supportedUILayouts["form"])
+			}
+
+			modes, err := b.GetAuthenticationModes(sessionID, layouts)
+			require.NoError(t, err, "GetAuthenticationModes should not have returned an error")
+			var offered bool
+			for _, mode := range modes {
+				if mode["id"] == authmodes.WebAuthn {
+					offered = true
+				}
+			}
+			require.Equal(t, tc.wantOffered, offered, "WebAuthn should be offered as expected")
+			if !tc.wantOffered {
+				return
+			}
+
+			uiLayout, err := b.SelectAuthenticationMode(sessionID, authmodes.WebAuthn)
+			require.NoError(t, err, "SelectAuthenticationMode should not have returned an error")
+			require.Equal(t, "webauthn", uiLayout["type"], "UI layout should be a WebAuthn one")
+			require.Equal(t, testutils.MockWebAuthnChallenge, uiLayout["content"], "UI layout should contain the challenge")
+
+			if tc.assertion == "" {
+				tc.assertion = testutils.MockWebAuthnAssertion
+			}
+			authData := `{"challenge":"` + encryptChallenge(t, tc.assertion, key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.True(t, json.Valid([]byte(data)), "IsAuthenticated returned data must be a valid JSON")
+			require.Equal(t, tc.wantAccess, access, "IsAuthenticated should return the expected access")
+		})
+	}
+}
+
+func TestFetchUserInfo(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		username string
+		token    tokenOptions
+
+		emptyHomeDir bool
+		emptyGroups  bool
+		wantGroupErr bool
+		wantErr      bool
+	}{
+		"Successfully_fetch_user_info_with_groups":                         {},
+		"Successfully_fetch_user_info_without_groups":                      {emptyGroups: true},
+		"Successfully_fetch_user_info_with_default_home_when_not_provided": {emptyHomeDir: true},
+
 		"Error_when_token_can_not_be_validated":                   {token: tokenOptions{invalid: true}, wantErr: true},
 		"Error_when_ID_token_claims_are_invalid":                  {token: tokenOptions{invalidClaims: true}, wantErr: true},
 		"Error_when_username_is_not_configured":                   {token: tokenOptions{username: "-"}, wantErr: true},
@@ -1002,97 +3814,2689 @@ func TestFetchUserInfo(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 
-			homeDirPath := "/home/userInfoTests/"
-			if tc.emptyHomeDir {
-				homeDirPath = ""
+			homeDirPath := "/home/userInfoTests/"
+			if tc.emptyHomeDir {
+				homeDirPath = ""
+			}
+
+			dataDir := t.TempDir()
+
+			cfg := &brokerForTestConfig{
+				Config:      broker.Config{DataDir: dataDir},
+				issuerURL:   defaultIssuerURL,
+				homeBaseDir: homeDirPath,
+			}
+			if tc.emptyGroups {
+				cfg.getGroupsFunc = func() ([]info.Group, error) {
+					return []info.Group{}, nil
+				}
+			}
+			if tc.wantGroupErr {
+				cfg.getGroupsFunc = func() ([]info.Group, error) {
+					return nil, errors.New("error getting groups")
+				}
+			}
+			b := newBrokerForTests(t, cfg)
+
+			if tc.username == "" {
+				tc.username = "test-user@email.com"
+			}
+			tc.token.issuer = defaultIssuerURL
+
+			sessionID, _, err := b.NewSession(tc.username, "lang", "auth")
+			require.NoError(t, err, "Setup: Failed to create session for the tests")
+
+			cachedInfo := generateCachedInfo(t, tc.token)
+			if cachedInfo == nil {
+				cachedInfo = &token.AuthCachedInfo{}
+			}
+
+			got, err := b.FetchUserInfo(sessionID, cachedInfo)
+			if tc.wantErr {
+				require.Error(t, err, "FetchUserInfo should have returned an error")
+				return
+			}
+			require.NoError(t, err, "FetchUserInfo should not have returned an error")
+
+			golden.CheckOrUpdateYAML(t, got)
+		})
+	}
+}
+
+func TestFetchUserInfoIntrospection(t *testing.T) {
+	t.Parallel()
+
+	activeResponse := `{"active": true, "sub": "introspected-user-id", "email": "test-user@email.com", "client_id": "test-client-id", "exp": 9999999999}`
+
+	tests := map[string]struct {
+		introspectionResponse string
+		introspectionStatus   int
+		noIntrospection       bool
+
+		wantErr bool
+	}{
+		"Successfully_fetch_user_info_from_the_introspected_claims": {introspectionResponse: activeResponse},
+		"Successfully_fetch_user_info_if_the_client_is_not_returned": {
+			introspectionResponse: `{"active": true, "sub": "introspected-user-id", "email": "test-user@email.com"}`,
+		},
+
+		"Error_when_the_token_is_not_active":                    {introspectionResponse: `{"active": false}`, wantErr: true},
+		"Error_when_the_token_was_issued_to_another_client":     {introspectionResponse: `{"active": true, "sub": "introspected-user-id", "client_id": "other-client-id"}`, wantErr: true},
+		"Error_when_the_token_is_expired":                       {introspectionResponse: `{"active": true, "sub": "introspected-user-id", "exp": 1}`, wantErr: true},
+		"Error_when_the_issuer_is_another_one":                  {introspectionResponse: `{"active": true, "sub": "introspected-user-id", "iss": "https://other.issuer.com"}`, wantErr: true},
+		"Error_when_the_introspection_endpoint_fails":           {introspectionStatus: http.StatusInternalServerError, wantErr: true},
+		"Error_when_the_response_is_not_valid_JSON":             {introspectionResponse: "not json", wantErr: true},
+		"Error_when_the_provider_has_no_introspection_endpoint": {noIntrospection: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var mu sync.Mutex
+			var introspected url.Values
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				tokenValidation: "introspection",
+				customHandlers: map[string]testutils.EndpointHandler{
+					"/.well-known/openid-configuration": func(w http.ResponseWriter, r *http.Request) {
+						serverURL := "http://" + r.Host
+						introspectionEndpoint := fmt.Sprintf(`, "introspection_endpoint": "%s/introspect"`, serverURL)
+						if tc.noIntrospection {
+							introspectionEndpoint = ""
+						}
+						w.Header().Add("Content-Type", "application/json")
+						_, _ = fmt.Fprintf(w, `{"issuer": "%[1]s", "authorization_endpoint": "%[1]s/auth", "device_authorization_endpoint": "%[1]s/device_auth", "token_endpoint": "%[1]s/token", "jwks_uri": "%[1]s/keys"%[2]s}`,
+							serverURL, introspectionEndpoint)
+					},
+					"/introspect": func(w http.ResponseWriter, r *http.Request) {
+						_ = r.ParseForm()
+						mu.Lock()
+						introspected = r.PostForm
+						mu.Unlock()
+
+						if tc.introspectionStatus != 0 {
+							w.WriteHeader(tc.introspectionStatus)
+							return
+						}
+						w.Header().Add("Content-Type", "application/json")
+						_, _ = w.Write([]byte(tc.introspectionResponse))
+					},
+				},
+			})
+			sessionID, _ := newSessionForTests(t, b, "", "")
+
+			// The token has no ID token, which must not be needed.
+			cachedInfo := generateCachedInfo(t, tokenOptions{noIDToken: true})
+
+			got, err := b.FetchUserInfo(sessionID, cachedInfo)
+			if !tc.noIntrospection {
+				mu.Lock()
+				require.Equal(t, cachedInfo.Token.AccessToken, introspected.Get("token"), "The access token should have been introspected")
+				require.Equal(t, "test-client-id", introspected.Get("client_id"), "The client should have authenticated")
+				mu.Unlock()
+			}
+			if tc.wantErr {
+				require.Error(t, err, "FetchUserInfo should have returned an error")
+				return
+			}
+			require.NoError(t, err, "FetchUserInfo should not have returned an error")
+
+			require.Equal(t, "test-user@email.com", got.Name, "User should be the one of the introspected claims")
+			require.Equal(t, "introspected-user-id", got.UUID, "Subject should be the one of the introspected claims")
+			require.NotEmpty(t, cachedInfo.RawIDToken, "The introspected claims should be kept as the ID token")
+		})
+	}
+}
+
+func TestFetchUserInfoGroupsCache(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		groupsCacheTTL time.Duration
+		otherToken     bool
+		expireCache    bool
+
+		wantCalls int
+	}{
+		"Groups_are_fetched_once_for_the_same_token":  {groupsCacheTTL: time.Minute, wantCalls: 1},
+		"Groups_are_fetched_again_with_another_token": {groupsCacheTTL: time.Minute, otherToken: true, wantCalls: 2},
+		"Groups_are_fetched_again_once_cache_expired": {groupsCacheTTL: 100 * time.Millisecond, expireCache: true, wantCalls: 2},
+		"Groups_are_fetched_every_time_if_disabled":   {wantCalls: 2},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls atomic.Int32
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				groupsCacheTTL: tc.groupsCacheTTL,
+				getGroupsFunc: func() ([]info.Group, error) {
+					calls.Add(1)
+					return []info.Group{{Name: "remote-group", UGID: "12345"}}, nil
+				},
+			})
+			sessionID, _ := newSessionForTests(t, b, "", "")
+			issuerURL := b.IssuerURLForSession(sessionID)
+
+			cachedInfo := generateCachedInfo(t, tokenOptions{issuer: issuerURL})
+			_, err := b.FetchUserInfo(sessionID, cachedInfo)
+			require.NoError(t, err, "FetchUserInfo should not have returned an error")
+
+			if tc.otherToken {
+				cachedInfo = generateCachedInfo(t, tokenOptions{issuer: issuerURL})
+				cachedInfo.Token.AccessToken = "other-access-token"
+			}
+			if tc.expireCache {
+				time.Sleep(2 * tc.groupsCacheTTL)
+			}
+			got, err := b.FetchUserInfo(sessionID, cachedInfo)
+			require.NoError(t, err, "FetchUserInfo should not have returned an error")
+			require.Equal(t, []info.Group{{Name: "remote-group", UGID: "12345"}}, got.Groups, "User should have the groups of the provider")
+			require.Equal(t, tc.wantCalls, int(calls.Load()), "Groups should have been fetched the expected number of times")
+		})
+	}
+}
+
+func TestFetchUserInfoUsernameClaim(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		usernameClaim string
+		stripDomain   bool
+		claims        map[string]any
+		username      string
+
+		want    string
+		wantErr bool
+	}{
+		"Successfully_read_username_from_email_without_domain": {usernameClaim: "email", stripDomain: true, want: "test-user"},
+		"Successfully_read_username_from_preferred_username": {
+			usernameClaim: "preferred_username",
+			want:          "test-user-preferred-username@email.com",
+		},
+		"Successfully_read_username_from_custom_claim":       {usernameClaim: "login", claims: map[string]any{"login": "jdoe"}, want: "jdoe"},
+		"Successfully_strip_domain_of_the_provider_username": {stripDomain: true, want: "test-user"},
+		"Username_without_domain_is_kept_when_stripping":     {usernameClaim: "login", stripDomain: true, claims: map[string]any{"login": "jdoe"}, want: "jdoe"},
+
+		"Error_when_claim_is_absent":                   {usernameClaim: "login", username: "jdoe", wantErr: true},
+		"Error_when_claim_is_not_a_string":             {usernameClaim: "login", claims: map[string]any{"login": 42}, username: "jdoe", wantErr: true},
+		"Error_when_requested_username_has_the_domain": {usernameClaim: "email", stripDomain: true, username: "test-user@email.com", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.username == "" {
+				tc.username = tc.want
+			}
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				usernameClaim:       tc.usernameClaim,
+				usernameStripDomain: tc.stripDomain,
+			})
+			sessionID, _ := newSessionForTests(t, b, tc.username, "")
+			cachedInfo := generateCachedInfo(t, tokenOptions{
+				issuer:        b.IssuerURLForSession(sessionID),
+				idTokenClaims: tc.claims,
+			})
+
+			got, err := b.FetchUserInfo(sessionID, cachedInfo)
+			if tc.wantErr {
+				require.Error(t, err, "FetchUserInfo should have returned an error")
+				return
+			}
+			require.NoError(t, err, "FetchUserInfo should not have returned an error")
+			require.Equal(t, tc.want, got.Name, "FetchUserInfo should return the username of the claim")
+			require.Equal(t, tc.want, filepath.Base(got.Home), "The home directory should be named after the username")
+		})
+	}
+}
+
+func TestFetchUserInfoAcceptedIssuers(t *testing.T) {
+	t.Parallel()
+
+	const tenantTemplate = "https://login.example.com/{tenantid}/v2.0"
+
+	tests := map[string]struct {
+		acceptedIssuers []string
+		issuer          string
+		tenantID        string
+
+		wantErr bool
+	}{
+		"Successfully_accept_the_configured_issuer":                    {},
+		"Successfully_accept_the_configured_issuer_with_other_issuers": {acceptedIssuers: []string{tenantTemplate}},
+		"Successfully_accept_the_tenant_of_the_template": {
+			acceptedIssuers: []string{tenantTemplate},
+			issuer:          "https://login.example.com/tenant-a/v2.0",
+			tenantID:        "tenant-a",
+		},
+		"Successfully_accept_the_template_without_tenant_claim": {
+			acceptedIssuers: []string{tenantTemplate},
+			issuer:          "https://login.example.com/tenant-a/v2.0",
+		},
+		"Successfully_accept_a_listed_issuer": {
+			acceptedIssuers: []string{"https://sts.example.com/tenant-a/"},
+			issuer:          "https://sts.example.com/tenant-a/",
+			tenantID:        "tenant-a",
+		},
+
+		"Error_when_issuer_differs_and_no_other_is_accepted": {
+			issuer:  "https://login.example.com/tenant-a/v2.0",
+			wantErr: true,
+		},
+		"Error_when_tenant_claim_is_a_foreign_tenant": {
+			acceptedIssuers: []string{tenantTemplate},
+			issuer:          "https://login.example.com/tenant-a/v2.0",
+			tenantID:        "tenant-b",
+			wantErr:         true,
+		},
+		"Error_when_tenant_is_not_listed": {
+			acceptedIssuers: []string{"https://login.example.com/tenant-a/v2.0"},
+			issuer:          "https://login.example.com/tenant-b/v2.0",
+			tenantID:        "tenant-b",
+			wantErr:         true,
+		},
+		"Error_when_placeholder_matches_several_segments": {
+			acceptedIssuers: []string{tenantTemplate},
+			issuer:          "https://login.example.com/tenant-a/other/v2.0",
+			wantErr:         true,
+		},
+		"Error_when_issuer_has_another_host": {
+			acceptedIssuers: []string{tenantTemplate},
+			issuer:          "https://login.example.org/tenant-a/v2.0",
+			wantErr:         true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{acceptedIssuers: tc.acceptedIssuers})
+			sessionID, _ := newSessionForTests(t, b, "", "")
+
+			issuer := tc.issuer
+			if issuer == "" {
+				issuer = b.IssuerURLForSession(sessionID)
+			}
+			var claims map[string]any
+			if tc.tenantID != "" {
+				claims = map[string]any{"tid": tc.tenantID}
+			}
+			cachedInfo := generateCachedInfo(t, tokenOptions{issuer: issuer, idTokenClaims: claims})
+
+			_, err := b.FetchUserInfo(sessionID, cachedInfo)
+			if tc.wantErr {
+				require.Error(t, err, "FetchUserInfo should have returned an error")
+				return
+			}
+			require.NoError(t, err, "FetchUserInfo should not have returned an error")
+		})
+	}
+}
+
+func TestFetchUserInfoJWKSFile(t *testing.T) {
+	t.Parallel()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "Setup: GenerateKey should not have returned an error")
+	keys := map[string]*rsa.PrivateKey{"mock": testutils.MockKey, "other": otherKey}
+	keySet := func(name string) []byte {
+		set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &keys[name].PublicKey, KeyID: name, Algorithm: "RS256", Use: "sig"}}}
+		content, err := json.Marshal(set)
+		require.NoError(t, err, "Setup: Marshal should not have returned an error")
+		return content
+	}
+
+	tests := map[string]struct {
+		fileKey string
+		// rotatedKey replaces the key of the file once the session is created.
+		rotatedKey string
+		removeFile bool
+		// reload sets the file when reloading the configuration, instead of when creating the broker.
+		reload bool
+
+		wantErr bool
+	}{
+		"Successfully_verify_the_token_with_the_keys_of_the_file":  {fileKey: "mock"},
+		"Successfully_verify_the_token_after_the_file_is_replaced": {fileKey: "other", rotatedKey: "mock"},
+		"Successfully_verify_the_token_with_a_reloaded_file":       {fileKey: "mock", reload: true},
+
+		"Error_when_no_file_is_set_and_provider_keys_do_not_match": {wantErr: true},
+		"Error_when_token_is_not_signed_with_a_key_of_the_file":    {fileKey: "other", wantErr: true},
+		"Error_when_the_file_is_removed":                           {fileKey: "mock", removeFile: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			// The provider serves the keys of another key pair, so that the tokens are only valid with the file.
+			var fetches atomic.Int32
+			issuerURL, cleanup := testutils.StartMockProviderServer("", nil, testutils.WithHandler("/keys", func(w http.ResponseWriter, _ *http.Request) {
+				fetches.Add(1)
+				w.Header().Add("Content-Type", "application/json")
+				_, _ = w.Write(keySet("other"))
+			}))
+			t.Cleanup(cleanup)
+
+			cfg := &brokerForTestConfig{issuerURL: issuerURL}
+			jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+			if tc.fileKey != "" {
+				err := os.WriteFile(jwksFile, keySet(tc.fileKey), 0600)
+				require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+				if !tc.reload {
+					cfg.jwksFile = jwksFile
+				}
+			}
+			config := fmt.Sprintf("[oidc]\nissuer = %s\nclient_id = test-client-id\n", issuerURL)
+			if tc.reload {
+				cfg.ConfigFile = filepath.Join(t.TempDir(), "broker.conf")
+				err := os.WriteFile(cfg.ConfigFile, []byte(config), 0600)
+				require.NoError(t, err, "Setup: Failed to write config file")
+			}
+			b := newBrokerForTests(t, cfg)
+			sessionID, _ := newSessionForTests(t, b, "", "")
+
+			if tc.reload {
+				err := os.WriteFile(cfg.ConfigFile, []byte(config+"jwks_file = "+jwksFile+"\n"), 0600)
+				require.NoError(t, err, "Setup: Failed to write config file")
+				require.NoError(t, b.ReloadConfig(), "Setup: ReloadConfig should not have returned an error")
+				sessionID, _ = newSessionForTests(t, b, "", "")
+			}
+			if tc.rotatedKey != "" {
+				err := os.WriteFile(jwksFile, keySet(tc.rotatedKey), 0600)
+				require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+			}
+			if tc.removeFile {
+				require.NoError(t, os.Remove(jwksFile), "Setup: Remove should not have returned an error")
+			}
+
+			cachedInfo := generateCachedInfo(t, tokenOptions{issuer: b.IssuerURLForSession(sessionID)})
+			_, err := b.FetchUserInfo(sessionID, cachedInfo)
+			if tc.fileKey != "" {
+				require.Zero(t, fetches.Load(), "The signing keys should not be fetched from the provider")
+			}
+			if tc.wantErr {
+				require.Error(t, err, "FetchUserInfo should have returned an error")
+				return
+			}
+			require.NoError(t, err, "FetchUserInfo should not have returned an error")
+		})
+	}
+}
+
+func TestFetchUserInfoGroupsClaim(t *testing.T) {
+	t.Parallel()
+
+	providerGroups := []info.Group{{Name: "provider-group", UGID: "provider-group"}}
+
+	tests := map[string]struct {
+		groupScope string
+		nameField  string
+		claims     map[string]any
+		userInfo   string
+
+		want    []info.Group
+		wantErr bool
+	}{
+		"Successfully_read_groups_from_ID_token": {
+			claims: map[string]any{"roles": []string{"Developers", "linux-sudo"}},
+			want:   []info.Group{{Name: "developers", UGID: "developers"}, {Name: "sudo"}},
+		},
+		"Successfully_read_groups_from_objects_with_default_name_field": {
+			claims: map[string]any{"roles": []map[string]any{{"name": "developers", "id": 1}}},
+			want:   []info.Group{{Name: "developers", UGID: "developers"}},
+		},
+		"Successfully_read_groups_from_objects_with_configured_name_field": {
+			nameField: "displayName",
+			claims:    map[string]any{"roles": []map[string]any{{"displayName": "Developers", "name": "ignored"}}},
+			want:      []info.Group{{Name: "developers", UGID: "developers"}},
+		},
+		"Successfully_read_groups_from_userinfo": {
+			groupScope: "userinfo",
+			claims:     map[string]any{"roles": []string{"ignored"}},
+			userInfo:   `{"sub": "saved-user-id", "roles": ["developers"]}`,
+			want:       []info.Group{{Name: "developers", UGID: "developers"}},
+		},
+		"Successfully_read_empty_groups_claim":          {claims: map[string]any{"roles": []string{}}, want: []info.Group{}},
+		"Keep_provider_groups_if_claim_is_absent":       {want: providerGroups},
+		"Keep_provider_groups_if_userinfo_has_no_claim": {groupScope: "userinfo", userInfo: `{"sub": "saved-user-id"}`, want: providerGroups},
+
+		"Error_when_claim_is_not_an_array":              {claims: map[string]any{"roles": "developers"}, wantErr: true},
+		"Error_when_group_is_neither_string_nor_object": {claims: map[string]any{"roles": []any{42}}, wantErr: true},
+		"Error_when_group_object_has_no_name":           {claims: map[string]any{"roles": []map[string]any{{"id": 1}}}, wantErr: true},
+		"Error_when_userinfo_can_not_be_fetched":        {groupScope: "userinfo", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			customHandlers := map[string]testutils.EndpointHandler{
+				"/.well-known/openid-configuration": func(w http.ResponseWriter, r *http.Request) {
+					serverURL := "http://" + r.Host
+					w.Header().Add("Content-Type", "application/json")
+					_, _ = fmt.Fprintf(w, `{
+						"issuer": "%[1]s",
+						"device_authorization_endpoint": "%[1]s/device_auth",
+						"token_endpoint": "%[1]s/token",
+						"userinfo_endpoint": "%[1]s/userinfo",
+						"jwks_uri": "%[1]s/keys",
+						"id_token_signing_alg_values_supported": ["RS256"]
+					}`, serverURL)
+				},
+				"/userinfo": func(w http.ResponseWriter, _ *http.Request) {
+					if tc.userInfo == "" {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					w.Header().Add("Content-Type", "application/json")
+					_, _ = w.Write([]byte(tc.userInfo))
+				},
+			}
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				groupsClaim:          "roles",
+				groupScope:           tc.groupScope,
+				groupsClaimNameField: tc.nameField,
+				getGroupsFunc:        func() ([]info.Group, error) { return providerGroups, nil },
+				customHandlers:       customHandlers,
+			})
+
+			sessionID, _ := newSessionForTests(t, b, "", "")
+			cachedInfo := generateCachedInfo(t, tokenOptions{
+				issuer:        b.IssuerURLForSession(sessionID),
+				idTokenClaims: tc.claims,
+			})
+
+			got, err := b.FetchUserInfo(sessionID, cachedInfo)
+			if tc.wantErr {
+				require.Error(t, err, "FetchUserInfo should have returned an error")
+				return
+			}
+			require.NoError(t, err, "FetchUserInfo should not have returned an error")
+			require.Equal(t, tc.want, got.Groups, "FetchUserInfo should return the groups of the claim")
+		})
+	}
+}
+
+func TestDeviceAuthPolling(t *testing.T) {
+	t.Parallel()
+
+	// The token endpoint closes the connection instead of answering with an error.
+	const closeConnection = "close_connection"
+
+	tests := map[string]struct {
+		// tokenErrors are the errors returned by the token endpoint, an empty one returning a token.
+		tokenErrors       []string
+		deviceAuthMaxWait time.Duration
+		pollJitter        time.Duration
+
+		wantSlowDown bool
+		wantAccess   string
+		wantMessage  string
+		wantFailure  string
+	}{
+		"Wait_while_authorization_is_pending": {
+			tokenErrors: []string{"authorization_pending", "authorization_pending", ""},
+			wantAccess:  broker.AuthNext,
+		},
+		"Wait_while_asked_to_slow_down": {
+			tokenErrors:  []string{"slow_down", ""},
+			wantSlowDown: true,
+			wantAccess:   broker.AuthNext,
+		},
+		"Device_code_expires_after_pending_and_slow_down": {
+			tokenErrors:  []string{"authorization_pending", "slow_down", "expired_token"},
+			wantSlowDown: true,
+		},
+		"Polling_interval_with_jitter_is_not_shorter_than_the_one_of_the_provider": {
+			tokenErrors:  []string{"authorization_pending", "slow_down", "expired_token"},
+			pollJitter:   2 * time.Second,
+			wantSlowDown: true,
+		},
+		"Device_code_expires_when_max_wait_is_reached": {
+			tokenErrors:       []string{"authorization_pending"},
+			deviceAuthMaxWait: 2 * time.Second,
+		},
+
+		"Error_when_the_user_declines_the_request": {
+			tokenErrors: []string{"authorization_pending", "access_denied"},
+			wantAccess:  broker.AuthDenied,
+			wantMessage: "the login request was declined",
+		},
+		"Error_when_the_provider_returns_another_error": {
+			tokenErrors: []string{"authorization_pending", "invalid_request"},
+			wantMessage: "could not authenticate user remotely",
+		},
+		"Error_when_the_provider_can_not_be_reached": {
+			tokenErrors: []string{"authorization_pending", closeConnection},
+			wantMessage: "could not authenticate user remotely",
+			wantFailure: broker.FailureNetwork,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var mu sync.Mutex
+			var polls []time.Time
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				deviceAuthMaxWait: tc.deviceAuthMaxWait,
+				pollJitter:        tc.pollJitter,
+				customHandlers: map[string]testutils.EndpointHandler{
+					"/device_auth": func(w http.ResponseWriter, _ *http.Request) {
+						w.Header().Add("Content-Type", "application/json")
+						_, _ = w.Write([]byte(`{"device_code": "device_code", "user_code": "user_code", "verification_uri": "https://verification_uri.com", "interval": 1, "expires_in": 600}`))
+					},
+					// The token endpoint returns the errors in order, and then keeps returning the last one.
+					"/token": func(w http.ResponseWriter, r *http.Request) {
+						// The client tries to authenticate in the header and then in the parameters until it succeeds,
+						// so only accept the latter, for each poll to be a single request.
+						if _, _, ok := r.BasicAuth(); ok {
+							w.Header().Add("Content-Type", "application/json")
+							w.WriteHeader(http.StatusUnauthorized)
+							_, _ = w.Write([]byte(`{"error": "invalid_client"}`))
+							return
+						}
+
+						mu.Lock()
+						polls = append(polls, time.Now())
+						tokenErr := tc.tokenErrors[min(len(polls), len(tc.tokenErrors))-1]
+						mu.Unlock()
+
+						switch tokenErr {
+						case "":
+							testutils.TokenHandler("http://"+r.Host, nil)(w, r)
+							return
+						case closeConnection:
+							conn, _, err := http.NewResponseController(w).Hijack()
+							if err == nil {
+								_ = conn.Close()
+							}
+							return
+						}
+						w.Header().Add("Content-Type", "application/json")
+						w.WriteHeader(http.StatusBadRequest)
+						_, _ = fmt.Fprintf(w, `{"error": %q}`, tokenErr)
+					},
+				},
+			})
+			sessionID, _ := newSessionForTests(t, b, "", "")
+			updateAuthModes(t, b, sessionID, authmodes.DeviceQr)
+
+			start := time.Now()
+			access, data, err := b.IsAuthenticated(sessionID, `{}`)
+			elapsed := time.Since(start)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			if tc.wantAccess == "" {
+				tc.wantAccess = broker.AuthRetry
+			}
+			if tc.wantMessage == "" && tc.wantAccess == broker.AuthRetry {
+				tc.wantMessage = "device code expired"
+			}
+			require.Equal(t, tc.wantAccess, access, "IsAuthenticated should have returned the expected access: %s", data)
+			require.Contains(t, data, tc.wantMessage, "User should be told why the authentication failed")
+			if tc.wantFailure != "" {
+				require.Equal(t, uint64(1), b.Metrics().Failures[tc.wantFailure], "The failure should be counted with the expected reason")
+			}
+
+			if tc.deviceAuthMaxWait != 0 {
+				require.Less(t, elapsed, tc.deviceAuthMaxWait+2*time.Second, "Polling should stop once the max wait is reached")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.GreaterOrEqual(t, len(polls), len(tc.tokenErrors), "Token endpoint should have been polled until it returned the last error")
+			// The polls are timed when the requests are received, so allow for their latency to vary.
+			for i := 1; i < len(polls); i++ {
+				require.GreaterOrEqual(t, polls[i].Sub(polls[i-1]), time.Second-100*time.Millisecond, "Polling interval should not be shorter than the one of the provider")
+			}
+			if tc.wantSlowDown {
+				slowDown := slices.Index(tc.tokenErrors, "slow_down")
+				require.GreaterOrEqual(t, polls[slowDown+1].Sub(polls[slowDown]), 6*time.Second, "Polling interval should be increased by 5 seconds after slow_down")
+			}
+		})
+	}
+}
+
+func TestCancelIsAuthenticated(t *testing.T) {
+	t.Parallel()
+
+	// The token endpoint hangs until the request is aborted, which is how we know the device flow polling stopped.
+	pollStarted := make(chan struct{})
+	pollAborted := make(chan struct{})
+	b := newBrokerForTests(t, &brokerForTestConfig{
+		customHandlers: map[string]testutils.EndpointHandler{
+			"/device_auth": func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"device_code": "device_code", "user_code": "user_code", "verification_uri": "https://verification_uri.com", "interval": 1}`))
+			},
+			"/token": func(w http.ResponseWriter, r *http.Request) {
+				// The server only notices that the client went away once the request body was read.
+				_ = r.ParseForm()
+				close(pollStarted)
+				select {
+				case <-r.Context().Done():
+					close(pollAborted)
+				case <-time.After(30 * time.Second):
+				}
+				w.WriteHeader(http.StatusRequestTimeout)
+			},
+		},
+	})
+	sessionID, _ := newSessionForTests(t, b, "", "")
+
+	updateAuthModes(t, b, sessionID, authmodes.DeviceQr)
+
+	type result struct {
+		access string
+		err    error
+	}
+	stopped := make(chan result)
+	go func() {
+		access, _, err := b.IsAuthenticated(sessionID, `{}`)
+		stopped <- result{access, err}
+	}()
+
+	select {
+	case <-pollStarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Setup: IsAuthenticated should have polled the token endpoint")
+	}
+
+	go b.CancelIsAuthenticated(sessionID)
+
+	select {
+	case got := <-stopped:
+		require.Error(t, got.err, "IsAuthenticated should have returned an error")
+		require.Equal(t, broker.AuthCancelled, got.access, "IsAuthenticated should have been cancelled")
+	case <-time.After(time.Second):
+		t.Fatal("IsAuthenticated should have returned shortly after being cancelled")
+	}
+
+	select {
+	case <-pollAborted:
+	case <-time.After(time.Second):
+		t.Fatal("Polling the token endpoint should have been aborted")
+	}
+}
+
+func TestEndSession(t *testing.T) {
+	t.Parallel()
+
+	b := newBrokerForTests(t, &brokerForTestConfig{
+		issuerURL: defaultIssuerURL,
+	})
+
+	sessionID, _ := newSessionForTests(t, b, "", "")
+
+	// Try to end a session that does not exist
+	err := b.EndSession("nonexistent")
+	require.Error(t, err, "EndSession should have returned an error when ending a nonexistent session")
+
+	// End a session that exists
+	err = b.EndSession(sessionID)
+	require.NoError(t, err, "EndSession should not have returned an error when ending an existent session")
+}
+
+func TestDrainWaitsForCancelledAuthentication(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+
+	// The login hook blocks until it is released, so that the authentication is cancelled once the user authenticated.
+	dir := t.TempDir()
+	startedPath := filepath.Join(dir, "started")
+	releasePath := filepath.Join(dir, "release")
+	hookPath := filepath.Join(dir, "hook")
+	script := fmt.Sprintf("#!/bin/sh\ntouch %q\nwhile [ ! -e %q ]; do sleep 0.1; done\n", startedPath, releasePath)
+	err := os.WriteFile(hookPath, []byte(script), 0700)
+	require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+
+	b := newBrokerForTests(t, &brokerForTestConfig{
+		issuerURL:       defaultIssuerURL,
+		allUsersAllowed: true,
+		onLogin:         []string{hookPath},
+	})
+	sessionID, key := newSessionForTests(t, b, username, "")
+	tokenPath := b.TokenPathForSession(sessionID)
+	generateAndStoreCachedInfo(t, tokenOptions{username: username, issuer: defaultIssuerURL}, tokenPath)
+	cached, err := os.ReadFile(tokenPath)
+	require.NoError(t, err, "Setup: ReadFile should not have returned an error")
+	err = password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+	require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+	updateAuthModes(t, b, sessionID, authmodes.Password)
+
+	authDone := make(chan string)
+	go func() {
+		authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+		access, _, _ := b.IsAuthenticated(sessionID, authData)
+		authDone <- access
+	}()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(startedPath)
+		return err == nil
+	}, 30*time.Second, 10*time.Millisecond, "Setup: The login hook should have been run")
+
+	b.CancelIsAuthenticated(sessionID)
+	require.Equal(t, broker.AuthCancelled, <-authDone, "IsAuthenticated should have returned once cancelled")
+
+	drainDone := make(chan error)
+	go func() { drainDone <- b.Drain(context.Background()) }()
+	select {
+	case err := <-drainDone:
+		require.Fail(t, "Drain should wait for the cancelled authentication to stop", "Drain returned: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	err = os.WriteFile(releasePath, nil, 0600)
+	require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+	require.NoError(t, <-drainDone, "Drain should not have returned an error")
+
+	got, err := os.ReadFile(tokenPath)
+	require.NoError(t, err, "Cached token should still be readable")
+	require.Equal(t, string(cached), string(got), "Cached token should not have been replaced once the authentication was cancelled")
+}
+
+func TestEndSessionRevokesRefreshToken(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		revokeOnLogout       bool
+		noRevocationEndpoint bool
+		revocationFails      bool
+
+		wantRevoked bool
+	}{
+		"Revoke_refresh_token_when_enabled":                       {revokeOnLogout: true, wantRevoked: true},
+		"End_session_even_if_revocation_fails":                    {revokeOnLogout: true, revocationFails: true, wantRevoked: true},
+		"Do_not_revoke_refresh_token_when_disabled":               {},
+		"Do_not_revoke_refresh_token_without_revocation_endpoint": {revokeOnLogout: true, noRevocationEndpoint: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			revoked := make(chan url.Values, 1)
+			customHandlers := map[string]testutils.EndpointHandler{
+				"/revoke": func(w http.ResponseWriter, r *http.Request) {
+					if err := r.ParseForm(); err == nil {
+						revoked <- r.PostForm
+					}
+					if tc.revocationFails {
+						w.WriteHeader(http.StatusServiceUnavailable)
+					}
+				},
+			}
+			if !tc.noRevocationEndpoint {
+				customHandlers["/.well-known/openid-configuration"] = func(w http.ResponseWriter, r *http.Request) {
+					serverURL := "http://" + r.Host
+					w.Header().Add("Content-Type", "application/json")
+					_, _ = fmt.Fprintf(w, `{
+						"issuer": "%[1]s",
+						"device_authorization_endpoint": "%[1]s/device_auth",
+						"token_endpoint": "%[1]s/token",
+						"revocation_endpoint": "%[1]s/revoke",
+						"jwks_uri": "%[1]s/keys",
+						"id_token_signing_alg_values_supported": ["RS256"]
+					}`, serverURL)
+				}
+			}
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed: true,
+				revokeOnLogout:  tc.revokeOnLogout,
+				customHandlers:  customHandlers,
+			})
+
+			const username = "test-user@email.com"
+			sessionID, key := newSessionForTests(t, b, username, "")
+			tokenPath := b.TokenPathForSession(sessionID)
+			generateAndStoreCachedInfo(t, tokenOptions{username: username}, tokenPath)
+			err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, _, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "Setup: IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthGranted, access, "Setup: User should have been allowed")
+
+			cached, err := token.LoadAuthInfo(tokenPath)
+			require.NoError(t, err, "Setup: Cached token should be readable")
+
+			err = b.EndSession(sessionID)
+			require.NoError(t, err, "EndSession should not have returned an error")
+			_, err = b.IsOffline(sessionID)
+			require.Error(t, err, "Session should have been ended")
+
+			// The cached token is kept, so the next login with the local password succeeds.
+			sessionID, key = newSessionForTests(t, b, username, "")
+			modes, err := b.GetAuthenticationModes(sessionID, []map[string]string{supportedUILayouts["form"], supportedUILayouts["qrcode"]})
+			require.NoError(t, err, "GetAuthenticationModes should not have returned an error")
+			var passwordOffered bool
+			for _, mode := range modes {
+				passwordOffered = passwordOffered || mode["id"] == authmodes.Password
+			}
+			require.True(t, passwordOffered, "Password mode should be offered on the next login")
+
+			kept, err := token.LoadAuthInfo(tokenPath)
+			require.NoError(t, err, "Cached token should have been kept")
+			if !tc.wantRevoked {
+				require.Empty(t, revoked, "Refresh token should not have been revoked")
+				require.Equal(t, cached.Token.RefreshToken, kept.Token.RefreshToken, "Refresh token should have been kept in the cache")
+			} else {
+				require.Len(t, revoked, 1, "Refresh token should have been revoked")
+				form := <-revoked
+				require.Equal(t, cached.Token.RefreshToken, form.Get("token"), "Cached refresh token should have been revoked")
+				require.Equal(t, "refresh_token", form.Get("token_type_hint"), "Revoked token should be hinted as a refresh token")
+				require.Equal(t, "test-client-id", form.Get("client_id"), "Revocation request should identify the client")
+				require.Empty(t, kept.Token.RefreshToken, "Revoked refresh token should have been cleared from the cache")
+				require.Equal(t, cached.RawIDToken, kept.RawIDToken, "Cached ID token should have been kept")
+			}
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+			authData = `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, _, err = b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthGranted, access, "Next password login should be allowed")
+		})
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	t.Parallel()
+
+	b := newBrokerForTests(t, &brokerForTestConfig{maxSessions: 2})
+
+	first, _ := newSessionForTests(t, b, "", "")
+	second, _ := newSessionForTests(t, b, "", "")
+	// Updating the first session makes the second one the session idle for the longest time.
+	err := b.SetAvailableMode(first, authmodes.Password)
+	require.NoError(t, err, "Setup: SetAvailableMode should not have returned an error")
+
+	third, _ := newSessionForTests(t, b, "", "")
+
+	_, err = b.IsOffline(second)
+	require.Error(t, err, "The session idle for the longest time should have been ended")
+	for _, sessionID := range []string{first, third} {
+		_, err = b.IsOffline(sessionID)
+		require.NoError(t, err, "The other sessions should not have been ended")
+	}
+}
+
+func TestSessionLimitsWithAuthenticatingSessions(t *testing.T) {
+	t.Parallel()
+
+	pollStarted := make(chan struct{})
+	pollAborted := make(chan struct{})
+	b := newBrokerForTests(t, &brokerForTestConfig{
+		maxSessions:    1,
+		customHandlers: hangingDeviceAuthHandlers(pollStarted, pollAborted),
+	})
+	sessionID, _ := newSessionForTests(t, b, "", "")
+	updateAuthModes(t, b, sessionID, authmodes.DeviceQr)
+
+	stopped := make(chan string)
+	go func() {
+		access, _, _ := b.IsAuthenticated(sessionID, `{}`)
+		stopped <- access
+	}()
+	select {
+	case <-pollStarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Setup: IsAuthenticated should have polled the token endpoint")
+	}
+
+	_, _, err := b.NewSession("other-user@email.com", "some lang", "auth")
+	require.Error(t, err, "NewSession should have returned an error when all the sessions are authenticating")
+
+	err = b.EndSession(sessionID)
+	require.NoError(t, err, "EndSession should not have returned an error")
+
+	select {
+	case access := <-stopped:
+		require.Equal(t, broker.AuthCancelled, access, "IsAuthenticated should have been cancelled by ending the session")
+	case <-time.After(time.Second):
+		t.Fatal("IsAuthenticated should have returned shortly after the session ended")
+	}
+	select {
+	case <-pollAborted:
+	case <-time.After(time.Second):
+		t.Fatal("Ending the session should have freed its authentication context")
+	}
+
+	_, _, err = b.NewSession("other-user@email.com", "some lang", "auth")
+	require.NoError(t, err, "NewSession should not have returned an error once a session was ended")
+}
+
+func TestSessions(t *testing.T) {
+	t.Parallel()
+
+	b := newBrokerForTests(t, &brokerForTestConfig{})
+	require.Empty(t, b.Sessions(), "No session should be listed before any is created")
+
+	before := time.Now()
+	firstID, _ := newSessionForTests(t, b, "first-user@email.com", "")
+	secondID, _ := newSessionForTests(t, b, "second-user@email.com", "passwd")
+	updateAuthModes(t, b, secondID, authmodes.Password)
+	b.UpdateSessionAuthStep(secondID, 1)
+
+	got := b.Sessions()
+	require.Len(t, got, 2, "Both sessions should be listed")
+	require.Equal(t, firstID, got[0].ID, "The oldest session should be listed first")
+	require.Equal(t, "first-user@email.com", got[0].Username, "The session should have the user it was created for")
+	require.Equal(t, "auth", got[0].Mode, "The session should have the mode it was created with")
+	require.Equal(t, b.IssuerURLForSession(firstID), got[0].IssuerURL, "The session should have the issuer of the user")
+	require.Empty(t, got[0].SelectedAuthMode, "No authentication mode should be selected yet")
+	require.Zero(t, got[0].AuthStep, "The session should be at the first step")
+	require.False(t, got[0].Authenticating, "The session should not be authenticating")
+	require.False(t, got[0].Created.Before(before), "The session should have been created during the test")
+	require.False(t, got[0].LastActivity.Before(got[0].Created), "The session should have been active after it was created")
+
+	require.Equal(t, secondID, got[1].ID, "The newest session should be listed last")
+	require.Equal(t, "passwd", got[1].Mode, "The session should have the mode it was created with")
+	require.Equal(t, authmodes.Password, got[1].SelectedAuthMode, "The session should have the selected authentication mode")
+	require.Equal(t, 1, got[1].AuthStep, "The session should be at the current step")
+
+	err := b.EndSession(firstID)
+	require.NoError(t, err, "Setup: EndSession should not have returned an error")
+	got = b.Sessions()
+	require.Len(t, got, 1, "The ended session should not be listed")
+	require.Equal(t, secondID, got[0].ID, "The current session should still be listed")
+}
+
+func TestWhoAmI(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+	group := info.Group{Name: "remote-group", UGID: "12345"}
+	b := newBrokerForTests(t, &brokerForTestConfig{
+		issuerURL:       defaultIssuerURL,
+		allUsersAllowed: true,
+		getGroupsFunc:   func() ([]info.Group, error) { return []info.Group{group}, nil },
+	})
+
+	sessionID, key := newSessionForTests(t, b, username, "")
+	_, err := b.WhoAmI(sessionID)
+	require.Error(t, err, "WhoAmI should return an error before the user is authenticated")
+
+	generateAndStoreCachedInfo(t, tokenOptions{username: username, issuer: defaultIssuerURL}, b.TokenPathForSession(sessionID))
+	err = password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+	require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+	updateAuthModes(t, b, sessionID, authmodes.Password)
+	access, data, err := b.IsAuthenticated(sessionID, `{"challenge":"`+encryptChallenge(t, "password", key)+`"}`)
+	require.NoError(t, err, "Setup: IsAuthenticated should not have returned an error")
+	require.Equal(t, broker.AuthGranted, access, "Setup: User should have been allowed: %s", data)
+
+	got, err := b.WhoAmI(sessionID)
+	require.NoError(t, err, "WhoAmI should not have returned an error once the user is granted access")
+	require.Equal(t, username, got.Username, "WhoAmI should return the name of the user")
+	require.Equal(t, "test-user-id", got.Subject, "WhoAmI should return the subject of the refreshed ID token")
+	require.Equal(t, b.IssuerURLForSession(sessionID), got.IssuerURL, "WhoAmI should return the issuer of the user")
+	require.Equal(t, []string{group.Name}, got.Groups, "WhoAmI should return the groups of the user")
+
+	_, err = b.WhoAmI("unknown-session-id")
+	require.Error(t, err, "WhoAmI should return an error for an unknown session")
+
+	otherID, _ := newSessionForTests(t, b, "other-user@email.com", "")
+	_, err = b.WhoAmI(otherID)
+	require.Error(t, err, "WhoAmI should return an error for a session which did not grant access")
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	const idleTimeout = 100 * time.Millisecond
+
+	t.Run("End_idle_session", func(t *testing.T) {
+		t.Parallel()
+
+		b := newBrokerForTests(t, &brokerForTestConfig{sessionIdleTimeout: idleTimeout})
+		sessionID, _ := newSessionForTests(t, b, "", "")
+
+		require.Eventually(t, func() bool {
+			_, err := b.IsOffline(sessionID)
+			return err != nil
+		}, 5*time.Second, 10*time.Millisecond, "The idle session should have been ended")
+	})
+
+	t.Run("Do_not_end_authenticating_session", func(t *testing.T) {
+		t.Parallel()
+
+		pollStarted := make(chan struct{})
+		pollAborted := make(chan struct{})
+		b := newBrokerForTests(t, &brokerForTestConfig{
+			sessionIdleTimeout: idleTimeout,
+			customHandlers:     hangingDeviceAuthHandlers(pollStarted, pollAborted),
+		})
+		sessionID, _ := newSessionForTests(t, b, "", "")
+		updateAuthModes(t, b, sessionID, authmodes.DeviceQr)
+
+		stopped := make(chan struct{})
+		go func() {
+			_, _, _ = b.IsAuthenticated(sessionID, `{}`)
+			close(stopped)
+		}()
+		select {
+		case <-pollStarted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Setup: IsAuthenticated should have polled the token endpoint")
+		}
+
+		time.Sleep(3 * idleTimeout)
+		_, err := b.IsOffline(sessionID)
+		require.NoError(t, err, "The session should not have been ended while authenticating")
+
+		b.CancelIsAuthenticated(sessionID)
+		<-stopped
+	})
+}
+
+// hangingDeviceAuthHandlers returns the handlers of a provider whose token endpoint hangs until the request is aborted,
+// closing pollStarted when the device flow starts polling and pollAborted when the polling is aborted.
+func hangingDeviceAuthHandlers(pollStarted, pollAborted chan struct{}) map[string]testutils.EndpointHandler {
+	return map[string]testutils.EndpointHandler{
+		"/device_auth": func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Add("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"device_code": "device_code", "user_code": "user_code", "verification_uri": "https://verification_uri.com", "interval": 1}`))
+		},
+		"/token": func(w http.ResponseWriter, r *http.Request) {
+			// The server only notices that the client went away once the request body was read.
+			_ = r.ParseForm()
+			close(pollStarted)
+			select {
+			case <-r.Context().Done():
+				close(pollAborted)
+			case <-time.After(30 * time.Second):
+			}
+			w.WriteHeader(http.StatusRequestTimeout)
+		},
+	}
+}
+
+func TestPersistSessions(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		persistSessions bool
+		cacheEncryption string
+		expiresIn       int
+
+		wantResumed bool
+	}{
+		"Resume_session_waiting_for_the_device_code":          {persistSessions: true, wantResumed: true},
+		"Resume_session_persisted_encrypted":                  {persistSessions: true, cacheEncryption: "key-file", wantResumed: true},
+		"Do_not_resume_session_whose_device_code_expired":     {persistSessions: true, expiresIn: 1},
+		"Do_not_resume_session_if_persistence_is_not_enabled": {},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.expiresIn == 0 {
+				tc.expiresIn = 600
+			}
+			var keyFile string
+			if tc.cacheEncryption == "key-file" {
+				keyFile = filepath.Join(t.TempDir(), "cache-key")
+				err := os.WriteFile(keyFile, bytes.Repeat([]byte{3}, 32), 0600)
+				require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+			}
+
+			const deviceCode = "persisted-device-code"
+			polledCodes := make(chan string, 10)
+			customHandlers := map[string]testutils.EndpointHandler{
+				"/device_auth": func(w http.ResponseWriter, _ *http.Request) {
+					w.Header().Add("Content-Type", "application/json")
+					_, _ = fmt.Fprintf(w, `{"device_code": %q, "user_code": "user_code", "verification_uri": "https://verification_uri.com", "interval": 1, "expires_in": %d}`, deviceCode, tc.expiresIn)
+				},
+				// The token endpoint records the device code it is polled with, to check that the persisted one is used.
+				"/token": func(w http.ResponseWriter, r *http.Request) {
+					if err := r.ParseForm(); err == nil {
+						polledCodes <- r.PostForm.Get("device_code")
+					}
+					testutils.TokenHandler("http://"+r.Host, nil)(w, r)
+				},
+			}
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed: true,
+				persistSessions: tc.persistSessions,
+				cacheEncryption: tc.cacheEncryption,
+				cacheKeyFile:    keyFile,
+				customHandlers:  customHandlers,
+			})
+			const username = "test-user@email.com"
+			sessionID, key := newSessionForTests(t, b, username, "")
+			updateAuthModes(t, b, sessionID, authmodes.DeviceQr)
+			issuerURL := b.IssuerURLForSession(sessionID)
+
+			if tc.cacheEncryption != "" {
+				content, err := os.ReadFile(filepath.Join(b.DataDir(), "sessions.json"))
+				require.NoError(t, err, "Setup: The sessions should have been persisted")
+				require.NotContains(t, string(content), deviceCode, "The persisted sessions should be encrypted")
+				require.NotContains(t, string(content), username, "The persisted sessions should be encrypted")
+			}
+			if tc.expiresIn < 600 {
+				time.Sleep(time.Duration(tc.expiresIn)*time.Second + 500*time.Millisecond)
+			}
+
+			restarted := newBrokerForTests(t, &brokerForTestConfig{
+				Config:          broker.Config{DataDir: b.DataDir()},
+				issuerURL:       issuerURL,
+				allUsersAllowed: true,
+				persistSessions: tc.persistSessions,
+				cacheEncryption: tc.cacheEncryption,
+				cacheKeyFile:    keyFile,
+			})
+
+			_, err := restarted.IsOffline(sessionID)
+			if !tc.wantResumed {
+				require.Error(t, err, "The session should not have been resumed")
+				return
+			}
+			require.NoError(t, err, "The session should have been resumed")
+
+			_, newKey, err := restarted.NewSession("other-user@email.com", "some lang", "auth")
+			require.NoError(t, err, "NewSession should not have returned an error")
+			require.Equal(t, key, newKey, "The restarted broker should keep the key authd got for the resumed session")
+
+			access, data, err := restarted.IsAuthenticated(sessionID, `{}`)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			// The user has no local password yet, so the device flow is followed by the step to choose one.
+			require.Equal(t, broker.AuthNext, access, "The resumed session should be authenticated, got %s", data)
+			require.Equal(t, deviceCode, <-polledCodes, "The persisted device code should have been used")
+		})
+	}
+}
+
+func TestPersistSessionsOnlyWhenChanged(t *testing.T) {
+	t.Parallel()
+
+	b := newBrokerForTests(t, &brokerForTestConfig{allUsersAllowed: true, persistSessions: true})
+	sessionsPath := filepath.Join(b.DataDir(), "sessions.json")
+	requirePersisted := func(want bool, msg string) {
+		t.Helper()
+		_, err := os.Stat(sessionsPath)
+		if !want {
+			require.ErrorIs(t, err, os.ErrNotExist, msg)
+			return
+		}
+		require.NoError(t, err, msg)
+		err = os.Remove(sessionsPath)
+		require.NoError(t, err, "Setup: Remove should not have returned an error")
+	}
+
+	sessionID, _ := newSessionForTests(t, b, "test-user@email.com", "")
+	requirePersisted(true, "The sessions should have been stored when one was added")
+
+	err := b.SetAvailableMode(sessionID, authmodes.DeviceQr)
+	require.NoError(t, err, "Setup: SetAvailableMode should not have returned an error")
+	requirePersisted(true, "The sessions should have been stored when the modes of one changed")
+
+	err = b.SetAvailableMode(sessionID, authmodes.DeviceQr)
+	require.NoError(t, err, "Setup: SetAvailableMode should not have returned an error")
+	requirePersisted(false, "The sessions should not have been stored when only the activity of one changed")
+
+	_, err = b.SelectAuthenticationMode(sessionID, authmodes.DeviceQr)
+	require.NoError(t, err, "Setup: SelectAuthenticationMode should not have returned an error")
+	requirePersisted(true, "The sessions should have been stored when the mode of one was selected")
+
+	err = b.EndSession(sessionID)
+	require.NoError(t, err, "Setup: EndSession should not have returned an error")
+	requirePersisted(true, "The sessions should have been stored when one was removed")
+}
+
+func TestForceTokenRefresh(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		sessionID      string
+		token          *tokenOptions
+		customHandlers map[string]testutils.EndpointHandler
+
+		wantSessionEnded bool
+		wantErr          bool
+	}{
+		"Successfully_refresh_token_and_groups": {token: &tokenOptions{groups: []info.Group{{Name: "old-group"}}}},
+
+		"Error_when_session_does_not_exist":  {sessionID: "-", wantErr: true},
+		"Error_when_token_does_not_exist":    {wantErr: true},
+		"Error_when_token_is_invalid":        {token: &tokenOptions{invalid: true}, wantErr: true},
+		"Error_when_no_refresh_token_cached": {token: &tokenOptions{noRefreshToken: true}, wantErr: true},
+		"Error_when_session_is_offline": {
+			token: &tokenOptions{},
+			customHandlers: map[string]testutils.EndpointHandler{
+				"/.well-known/openid-configuration": testutils.UnavailableHandler(),
+			},
+			wantErr: true,
+		},
+		"Error_and_keep_session_when_provider_is_unavailable": {
+			token: &tokenOptions{},
+			customHandlers: map[string]testutils.EndpointHandler{
+				"/token": testutils.UnavailableHandler(),
+			},
+			wantErr: true,
+		},
+		"Error_and_end_session_when_refresh_token_is_rejected": {
+			token: &tokenOptions{},
+			customHandlers: map[string]testutils.EndpointHandler{
+				"/token": func(w http.ResponseWriter, _ *http.Request) {
+					w.Header().Add("Content-Type", "application/json")
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+				},
+			},
+			wantSessionEnded: true,
+			wantErr:          true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			wantGroups := []info.Group{{Name: "refreshed-group"}}
+			cfg := &brokerForTestConfig{
+				getGroupsFunc: func() ([]info.Group, error) {
+					return wantGroups, nil
+				},
+			}
+			if tc.customHandlers == nil {
+				cfg.issuerURL = defaultIssuerURL
+			} else {
+				cfg.customHandlers = tc.customHandlers
+			}
+			b := newBrokerForTests(t, cfg)
+
+			sessionID, _ := newSessionForTests(t, b, "", "")
+			if tc.token != nil {
+				generateAndStoreCachedInfo(t, *tc.token, b.TokenPathForSession(sessionID))
+			}
+			tokenPath := b.TokenPathForSession(sessionID)
+			if tc.sessionID == "-" {
+				sessionID = "nonexistent"
+			}
+
+			err := b.ForceTokenRefresh(sessionID)
+
+			_, sessionErr := b.IsOffline(sessionID)
+			if tc.sessionID != "-" {
+				require.Equal(t, tc.wantSessionEnded, sessionErr != nil, "Session should only be ended if the refresh token was rejected")
+			}
+
+			if tc.wantErr {
+				require.Error(t, err, "ForceTokenRefresh should have returned an error")
+				return
+			}
+			require.NoError(t, err, "ForceTokenRefresh should not have returned an error")
+
+			got, err := token.LoadAuthInfo(tokenPath)
+			require.NoError(t, err, "Cached token should be readable after the refresh")
+			require.Equal(t, wantGroups, got.UserInfo.Groups, "Cached groups should have been refreshed")
+		})
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		authenticate     bool
+		getUserInfoFails bool
+
+		wantErr bool
+	}{
+		"Rotated_refresh_token_is_stored_when_forcing_a_refresh":            {},
+		"Rotated_refresh_token_is_stored_when_authenticating_with_password": {authenticate: true},
+		"Rotated_refresh_token_is_stored_even_if_fetching_user_info_fails":  {getUserInfoFails: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed:     true,
+				getUserInfoFails:    tc.getUserInfoFails,
+				tokenHandlerOptions: &testutils.TokenHandlerOptions{RotateRefreshToken: true},
+			})
+
+			const username = "test-user@email.com"
+			sessionID, key := newSessionForTests(t, b, username, "")
+			tokenPath := b.TokenPathForSession(sessionID)
+			generateAndStoreCachedInfo(t, tokenOptions{username: username}, tokenPath)
+
+			if tc.authenticate {
+				err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+				require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+				updateAuthModes(t, b, sessionID, authmodes.Password)
+
+				authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+				access, _, err := b.IsAuthenticated(sessionID, authData)
+				require.NoError(t, err, "IsAuthenticated should not have returned an error")
+				require.Equal(t, broker.AuthGranted, access, "User should have been allowed")
+			} else {
+				err := b.ForceTokenRefresh(sessionID)
+				if tc.wantErr {
+					require.Error(t, err, "ForceTokenRefresh should have returned an error")
+				} else {
+					require.NoError(t, err, "ForceTokenRefresh should not have returned an error")
+				}
+			}
+
+			got, err := token.LoadAuthInfo(tokenPath)
+			require.NoError(t, err, "Cached token should be readable after the refresh")
+			require.Equal(t, "refreshtoken-1", got.Token.RefreshToken, "Rotated refresh token should have been stored")
+
+			// The provider only accepts the rotated refresh token, so refreshing again proves that it was stored.
+			sessionID, _ = newSessionForTests(t, b, username, "")
+			err = b.ForceTokenRefresh(sessionID)
+			if tc.wantErr {
+				require.Error(t, err, "ForceTokenRefresh should have returned an error")
+			} else {
+				require.NoError(t, err, "ForceTokenRefresh should not have returned an error with the rotated refresh token")
+			}
+
+			got, err = token.LoadAuthInfo(tokenPath)
+			require.NoError(t, err, "Cached token should be readable after the second refresh")
+			require.Equal(t, "refreshtoken-2", got.Token.RefreshToken, "Rotated refresh token should have been stored again")
+		})
+	}
+}
+
+func TestClientAuthentication(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "Setup: GenerateKey should not have returned an error")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "Setup: GenerateKey should not have returned an error")
+
+	keysDir := t.TempDir()
+	rsaKeyFile := filepath.Join(keysDir, "rsa.pem")
+	err = os.WriteFile(rsaKeyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), 0600)
+	require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+	ecKeyDER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err, "Setup: MarshalPKCS8PrivateKey should not have returned an error")
+	ecKeyFile := filepath.Join(keysDir, "ec.pem")
+	err = os.WriteFile(ecKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecKeyDER}), 0600)
+	require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+
+	tests := map[string]struct {
+		clientSecret  string
+		clientAuth    string
+		clientKeyFile string
+		clientKeyID   string
+
+		wantSecretInForm   bool
+		wantSecretInHeader bool
+		wantAssertionKey   any
+		wantAssertionAlg   string
+		wantErr            bool
+	}{
+		"Send_the_secret_in_the_body_with_client_secret_post": {
+			clientSecret:     "test-client-secret",
+			clientAuth:       "client_secret_post",
+			wantSecretInForm: true,
+		},
+		"Send_the_secret_in_the_header_with_client_secret_basic": {
+			clientSecret:       "test-client-secret",
+			clientAuth:         "client_secret_basic",
+			wantSecretInHeader: true,
+		},
+		"Send_an_assertion_signed_with_an_RSA_key": {
+			clientAuth:       "private_key_jwt",
+			clientKeyFile:    rsaKeyFile,
+			clientKeyID:      "test-key-id",
+			wantAssertionKey: &rsaKey.PublicKey,
+			wantAssertionAlg: "RS256",
+		},
+		"Send_an_assertion_signed_with_an_ECDSA_key": {
+			clientAuth:       "private_key_jwt",
+			clientKeyFile:    ecKeyFile,
+			wantAssertionKey: &ecKey.PublicKey,
+			wantAssertionAlg: "ES256",
+		},
+		"Send_an_assertion_instead_of_the_configured_secret": {
+			clientSecret:     "test-client-secret",
+			clientAuth:       "private_key_jwt",
+			clientKeyFile:    rsaKeyFile,
+			wantAssertionKey: &rsaKey.PublicKey,
+			wantAssertionAlg: "RS256",
+		},
+
+		"Error_when_the_private_key_can_not_be_read": {
+			clientAuth:    "private_key_jwt",
+			clientKeyFile: filepath.Join(keysDir, "missing.pem"),
+			wantErr:       true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			requests := make(chan *http.Request, 1)
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				clientSecret:  tc.clientSecret,
+				clientAuth:    tc.clientAuth,
+				clientKeyFile: tc.clientKeyFile,
+				clientKeyID:   tc.clientKeyID,
+				customHandlers: map[string]testutils.EndpointHandler{
+					"/token": func(w http.ResponseWriter, r *http.Request) {
+						if err := r.ParseForm(); err == nil {
+							requests <- r
+						}
+						testutils.TokenHandler("http://"+r.Host, nil)(w, r)
+					},
+				},
+			})
+
+			sessionID, _ := newSessionForTests(t, b, "", "")
+			generateAndStoreCachedInfo(t, tokenOptions{}, b.TokenPathForSession(sessionID))
+
+			err := b.ForceTokenRefresh(sessionID)
+			if tc.wantErr {
+				require.Error(t, err, "ForceTokenRefresh should have returned an error")
+				require.Empty(t, requests, "The token request should not have been sent")
+				return
+			}
+			require.NoError(t, err, "ForceTokenRefresh should not have returned an error")
+
+			require.Len(t, requests, 1, "The token endpoint should have been requested once")
+			r := <-requests
+			require.Equal(t, "refresh_token", r.PostForm.Get("grant_type"), "The token should have been refreshed")
+
+			clientID, secret, hasHeader := r.BasicAuth()
+			require.Equal(t, tc.wantSecretInHeader, hasHeader, "The secret should only be sent in the header with client_secret_basic")
+			if tc.wantSecretInHeader {
+				require.Equal(t, "test-client-id", clientID, "The header should identify the client")
+				require.Equal(t, tc.clientSecret, secret, "The header should hold the client secret")
+			} else {
+				require.Equal(t, "test-client-id", r.PostForm.Get("client_id"), "The body should identify the client")
+			}
+			if tc.wantSecretInForm {
+				require.Equal(t, tc.clientSecret, r.PostForm.Get("client_secret"), "The body should hold the client secret")
+			} else {
+				require.False(t, r.PostForm.Has("client_secret"), "The body should not hold the client secret")
+			}
+
+			if tc.wantAssertionKey == nil {
+				require.False(t, r.PostForm.Has("client_assertion"), "No client assertion should have been sent")
+				return
+			}
+			require.Equal(t, "urn:ietf:params:oauth:client-assertion-type:jwt-bearer", r.PostForm.Get("client_assertion_type"),
+				"The client assertion should be a JWT bearer assertion")
+
+			var claims jwt.RegisteredClaims
+			assertion, err := jwt.ParseWithClaims(r.PostForm.Get("client_assertion"), &claims, func(*jwt.Token) (any, error) {
+				return tc.wantAssertionKey, nil
+			}, jwt.WithValidMethods([]string{tc.wantAssertionAlg}), jwt.WithExpirationRequired(), jwt.WithIssuedAt())
+			require.NoError(t, err, "The client assertion should be signed with the private key of the client")
+
+			tokenURL := "http://" + r.Host + "/token"
+			require.Equal(t, "test-client-id", claims.Issuer, "The client assertion should be issued by the client")
+			require.Equal(t, "test-client-id", claims.Subject, "The subject of the client assertion should be the client")
+			require.Equal(t, jwt.ClaimStrings{tokenURL}, claims.Audience, "The audience of the client assertion should be the token endpoint")
+			require.NotEmpty(t, claims.ID, "The client assertion should have an ID")
+			kid, _ := assertion.Header["kid"].(string)
+			require.Equal(t, tc.clientKeyID, kid, "The client assertion should name the configured key")
+		})
+	}
+}
+
+func TestClientType(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		clientType string
+
+		wantClientID string
+		wantSecret   bool
+	}{
+		"Authenticate_as_the_confidential_client_by_default": {wantClientID: "test-client-id", wantSecret: true},
+		"Authenticate_as_the_confidential_client_if_configured": {
+			clientType:   "confidential",
+			wantClientID: "test-client-id",
+			wantSecret:   true,
+		},
+		"Authenticate_as_the_public_client_if_configured": {
+			clientType:   "public",
+			wantClientID: "test-public-client-id",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			deviceAuthRequests := make(chan *http.Request, 1)
+			tokenRequests := make(chan *http.Request, 1)
+			record := func(requests chan *http.Request, handler func(serverURL string) testutils.EndpointHandler) testutils.EndpointHandler {
+				return func(w http.ResponseWriter, r *http.Request) {
+					if err := r.ParseForm(); err == nil {
+						select {
+						case requests <- r:
+						default:
+						}
+					}
+					handler("http://"+r.Host)(w, r)
+				}
+			}
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				clientSecret:   "test-client-secret",
+				clientAuth:     "client_secret_post",
+				clientType:     tc.clientType,
+				publicClientID: "test-public-client-id",
+				customHandlers: map[string]testutils.EndpointHandler{
+					"/device_auth": record(deviceAuthRequests, func(string) testutils.EndpointHandler {
+						return testutils.DefaultDeviceAuthHandler()
+					}),
+					// The ID token is issued to the client the broker authenticates as.
+					"/token": record(tokenRequests, func(serverURL string) testutils.EndpointHandler {
+						return testutils.TokenHandler(serverURL, &testutils.TokenHandlerOptions{
+							IDTokenClaims: []map[string]any{{"aud": tc.wantClientID}},
+						})
+					}),
+				},
+			})
+			sessionID, _ := newSessionForTests(t, b, "", "")
+
+			updateAuthModes(t, b, sessionID, authmodes.Device)
+			access, data, err := b.IsAuthenticated(sessionID, "{}")
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthNext, access, "IsAuthenticated should ask for a new password: %s", data)
+
+			for request, r := range map[string]*http.Request{"device authorization": <-deviceAuthRequests, "token": <-tokenRequests} {
+				_, _, hasHeader := r.BasicAuth()
+				require.False(t, hasHeader, "The %s request should not authenticate in the header", request)
+				require.Equal(t, tc.wantClientID, r.PostForm.Get("client_id"), "The %s request should identify the client", request)
+				if tc.wantSecret {
+					require.Equal(t, "test-client-secret", r.PostForm.Get("client_secret"), "The %s request should hold the client secret", request)
+				} else {
+					require.False(t, r.PostForm.Has("client_secret"), "The %s request should not hold a client secret", request)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenCacheEncryption(t *testing.T) {
+	t.Parallel()
+
+	machineIDKey, err := token.MachineIDKeySource{Path: "testdata/machine-id"}.Key()
+	require.NoError(t, err, "Setup: Key should not have returned an error")
+	keyFile := filepath.Join(t.TempDir(), "cache-key")
+	err = os.WriteFile(keyFile, bytes.Repeat([]byte{3}, 32), 0600)
+	require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+	fileKey, err := token.FileKeySource{Path: keyFile}.Key()
+	require.NoError(t, err, "Setup: Key should not have returned an error")
+
+	tests := map[string]struct {
+		// tokenKey is the key the cached token is encrypted with, it is stored in plaintext if nil.
+		tokenKey []byte
+		// keyFile is the key file the broker encrypts the tokens with, instead of the machine ID.
+		keyFile string
+
+		wantPasswordOffered bool
+	}{
+		"Successfully_authenticate_with_encrypted_token":               {tokenKey: machineIDKey, wantPasswordOffered: true},
+		"Successfully_authenticate_and_encrypt_plaintext_token":        {wantPasswordOffered: true},
+		"Successfully_authenticate_with_token_encrypted_with_key_file": {tokenKey: fileKey, keyFile: keyFile, wantPasswordOffered: true},
+		"Successfully_authenticate_and_encrypt_token_with_key_file":    {keyFile: keyFile, wantPasswordOffered: true},
+
+		"Password_is_not_offered_if_token_is_encrypted_with_another_key": {tokenKey: bytes.Repeat([]byte{1}, 32)},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cacheEncryption, brokerKey := "machine-id", machineIDKey
+			if tc.keyFile != "" {
+				cacheEncryption, brokerKey = "key-file", fileKey
+			}
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				issuerURL:       defaultIssuerURL,
+				allUsersAllowed: true,
+				cacheEncryption: cacheEncryption,
+				cacheKeyFile:    tc.keyFile,
+			})
+
+			const username = "test-user@email.com"
+			sessionID, key := newSessionForTests(t, b, username, "")
+			tokenPath := b.TokenPathForSession(sessionID)
+			tok := generateCachedInfo(t, tokenOptions{username: username})
+			var opts []token.Option
+			if tc.tokenKey != nil {
+				opts = append(opts, token.WithEncryptionKey(tc.tokenKey))
+			}
+			err := token.CacheAuthInfo(tokenPath, *tok, opts...)
+			require.NoError(t, err, "Setup: CacheAuthInfo should not have returned an error")
+			err = password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			modes, err := b.GetAuthenticationModes(sessionID, supportedLayouts)
+			require.NoError(t, err, "GetAuthenticationModes should not have returned an error")
+			gotPasswordOffered := slices.ContainsFunc(modes, func(m map[string]string) bool { return m["id"] == authmodes.Password })
+			require.Equal(t, tc.wantPasswordOffered, gotPasswordOffered, "Password should only be offered if the token can be decrypted")
+			if !tc.wantPasswordOffered {
+				return
+			}
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthGranted, access, "User should have been allowed: %s", data)
+
+			_, err = token.LoadAuthInfo(tokenPath)
+			require.ErrorIs(t, err, token.ErrInvalidCache, "Cached token should not be readable without the key")
+			got, err := token.LoadAuthInfo(tokenPath, token.WithEncryptionKey(brokerKey))
+			require.NoError(t, err, "Cached token should be readable with the key")
+			require.Equal(t, username, got.UserInfo.Name, "Cached token should contain the user info")
+		})
+	}
+}
+
+func TestTokenStore(t *testing.T) {
+	t.Parallel()
+
+	machineIDKey, err := token.MachineIDKeySource{Path: "testdata/machine-id"}.Key()
+	require.NoError(t, err, "Setup: Key should not have returned an error")
+
+	tests := map[string]struct {
+		newStore func(t *testing.T) broker.TokenStore
+	}{
+		"File_store": {newStore: func(t *testing.T) broker.TokenStore {
+			return broker.NewFileTokenStore(t.TempDir())
+		}},
+		"Encrypted_file_store": {newStore: func(t *testing.T) broker.TokenStore {
+			return broker.NewFileTokenStore(t.TempDir(), token.WithEncryptionKey(machineIDKey))
+		}},
+		"Memory_store": {newStore: func(*testing.T) broker.TokenStore { return broker.NewMemoryTokenStore() }},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			const issuer = "https://issuer.example.com"
+			const username = "test-user@email.com"
+			store := tc.newStore(t)
+
+			_, err := store.Load(issuer, username)
+			require.ErrorIs(t, err, fs.ErrNotExist, "Load should return fs.ErrNotExist if no token is stored")
+
+			tok := generateCachedInfo(t, tokenOptions{username: username})
+			err = store.Save(issuer, username, *tok)
+			require.NoError(t, err, "Save should not have returned an error")
+
+			got, err := store.Load(issuer, username)
+			require.NoError(t, err, "Load should not have returned an error")
+			require.Equal(t, tok.Token.RefreshToken, got.Token.RefreshToken, "Loaded token should be the stored one")
+			require.Equal(t, username, got.UserInfo.Name, "Loaded token should contain the user info")
+			require.Equal(t, tok.RawIDToken, got.RawIDToken, "Loaded token should have the stored ID token")
+
+			_, err = store.Load(issuer, "other-user@email.com")
+			require.ErrorIs(t, err, fs.ErrNotExist, "Load should not return the token of another user")
+			_, err = store.Load("https://other-issuer.example.com", username)
+			require.ErrorIs(t, err, fs.ErrNotExist, "Load should not return the token of another issuer")
+
+			got.UserInfo.Name = "modified"
+			got, err = store.Load(issuer, username)
+			require.NoError(t, err, "Load should not have returned an error")
+			require.Equal(t, username, got.UserInfo.Name, "Modifying a loaded token should not modify the stored one")
+
+			err = store.Delete(issuer, username)
+			require.NoError(t, err, "Delete should not have returned an error")
+			_, err = store.Load(issuer, username)
+			require.ErrorIs(t, err, fs.ErrNotExist, "Load should return fs.ErrNotExist once the token is deleted")
+
+			err = store.Delete(issuer, username)
+			require.NoError(t, err, "Delete should not return an error if no token is stored")
+		})
+	}
+}
+
+func TestIsAuthenticatedWithTokenStore(t *testing.T) {
+	t.Parallel()
+
+	dataDir := t.TempDir()
+	store := broker.NewMemoryTokenStore()
+	b := newBrokerForTests(t, &brokerForTestConfig{
+		Config:          broker.Config{DataDir: dataDir},
+		issuerURL:       defaultIssuerURL,
+		allUsersAllowed: true,
+		tokenStore:      store,
+	})
+
+	const username = "test-user@email.com"
+	sessionID, key := newSessionForTests(t, b, username, "")
+	require.Empty(t, b.TokenPathForSession(sessionID), "Token should not have a path if it is not stored in a file")
+	err := store.Save(defaultIssuerURL, username, *generateCachedInfo(t, tokenOptions{username: username}))
+	require.NoError(t, err, "Setup: Save should not have returned an error")
+	err = password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+	require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+	modes, err := b.GetAuthenticationModes(sessionID, supportedLayouts)
+	require.NoError(t, err, "GetAuthenticationModes should not have returned an error")
+	gotPasswordOffered := slices.ContainsFunc(modes, func(m map[string]string) bool { return m["id"] == authmodes.Password })
+	require.True(t, gotPasswordOffered, "Password should be offered as the store has a token")
+
+	updateAuthModes(t, b, sessionID, authmodes.Password)
+	authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+	access, data, err := b.IsAuthenticated(sessionID, authData)
+	require.NoError(t, err, "IsAuthenticated should not have returned an error")
+	require.Equal(t, broker.AuthGranted, access, "User should have been allowed: %s", data)
+
+	got, err := store.Load(defaultIssuerURL, username)
+	require.NoError(t, err, "Token should still be in the store")
+	require.Equal(t, username, got.UserInfo.Name, "Stored token should contain the user info")
+	_, err = broker.NewFileTokenStore(dataDir).Load(defaultIssuerURL, username)
+	require.ErrorIs(t, err, fs.ErrNotExist, "Token should not have been stored in the data directory")
+}
+
+func TestTokenStoreConfig(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+	dataDir := t.TempDir()
+	cfg := broker.Config{DataDir: dataDir}
+	cfg.SetTokenStore("memory")
+	newBroker := func() *broker.Broker {
+		return newBrokerForTests(t, &brokerForTestConfig{
+			Config:          cfg,
+			issuerURL:       defaultIssuerURL,
+			allUsersAllowed: true,
+		})
+	}
+	passwordOffered := func(b *broker.Broker, sessionID string) bool {
+		modes, err := b.GetAuthenticationModes(sessionID, supportedLayouts)
+		require.NoError(t, err, "GetAuthenticationModes should not have returned an error")
+		return slices.ContainsFunc(modes, func(m map[string]string) bool { return m["id"] == authmodes.Password })
+	}
+
+	b := newBroker()
+	sessionID, key := newSessionForTests(t, b, username, "")
+	updateAuthModes(t, b, sessionID, authmodes.Device)
+	access, data, err := b.IsAuthenticated(sessionID, "{}")
+	require.NoError(t, err, "IsAuthenticated should not have returned an error")
+	require.Equal(t, broker.AuthNext, access, "IsAuthenticated should ask for a new password: %s", data)
+	b.UpdateSessionAuthStep(sessionID, 1)
+	updateAuthModes(t, b, sessionID, authmodes.NewPassword)
+	access, data, err = b.IsAuthenticated(sessionID, `{"challenge":"`+encryptChallenge(t, "password", key)+`"}`)
+	require.NoError(t, err, "IsAuthenticated should not have returned an error")
+	require.Equal(t, broker.AuthGranted, access, "User should have been allowed: %s", data)
+
+	_, err = broker.NewFileTokenStore(dataDir).Load(defaultIssuerURL, username)
+	require.ErrorIs(t, err, fs.ErrNotExist, "Token should not have been stored in the data directory")
+
+	// The token is kept for the lifetime of the broker.
+	sessionID, key = newSessionForTests(t, b, username, "")
+	require.True(t, passwordOffered(b, sessionID), "Password should be offered while the broker runs")
+	updateAuthModes(t, b, sessionID, authmodes.Password)
+	access, data, err = b.IsAuthenticated(sessionID, `{"challenge":"`+encryptChallenge(t, "password", key)+`"}`)
+	require.NoError(t, err, "IsAuthenticated should not have returned an error")
+	require.Equal(t, broker.AuthGranted, access, "User should have been allowed with the local password: %s", data)
+
+	// A new broker starts with an empty store, even though the password file is still in the data directory.
+	b = newBroker()
+	sessionID, _ = newSessionForTests(t, b, username, "")
+	require.False(t, passwordOffered(b, sessionID), "Password should not be offered once the broker restarted")
+}
+
+func TestInspectToken(t *testing.T) {
+	t.Parallel()
+
+	machineIDKey, err := token.MachineIDKeySource{Path: "testdata/machine-id"}.Key()
+	require.NoError(t, err, "Setup: Key should not have returned an error")
+
+	tests := map[string]struct {
+		// tokenKey is the key the cached token is encrypted with, it is stored in plaintext if nil.
+		tokenKey       []byte
+		noRefreshToken bool
+		noToken        bool
+
+		wantErr   bool
+		wantErrIs error
+	}{
+		"Successfully_inspect_plaintext_token":             {},
+		"Successfully_inspect_encrypted_token":             {tokenKey: machineIDKey},
+		"Successfully_inspect_token_without_refresh_token": {noRefreshToken: true},
+
+		"Error_when_token_is_encrypted_with_another_key": {tokenKey: bytes.Repeat([]byte{1}, 32), wantErr: true, wantErrIs: token.ErrInvalidCache},
+		"Error_when_there_is_no_cached_token":            {noToken: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				issuerURL:       defaultIssuerURL,
+				cacheEncryption: "machine-id",
+			})
+
+			const username = "test-user@email.com"
+			sessionID, _ := newSessionForTests(t, b, username, "")
+			tokenPath := b.TokenPathForSession(sessionID)
+			if !tc.noToken {
+				tok := generateCachedInfo(t, tokenOptions{username: username, issuer: defaultIssuerURL, noRefreshToken: tc.noRefreshToken})
+				var opts []token.Option
+				if tc.tokenKey != nil {
+					opts = append(opts, token.WithEncryptionKey(tc.tokenKey))
+				}
+				err := token.CacheAuthInfo(tokenPath, *tok, opts...)
+				require.NoError(t, err, "Setup: CacheAuthInfo should not have returned an error")
+			}
+
+			got, err := b.InspectToken(username)
+			if tc.wantErr {
+				require.Error(t, err, "InspectToken should have returned an error")
+				if tc.wantErrIs != nil {
+					require.ErrorIs(t, err, tc.wantErrIs, "InspectToken should return the cause of the error")
+				}
+				return
+			}
+			require.NoError(t, err, "InspectToken should not have returned an error")
+
+			require.Equal(t, tokenPath, got.Path, "InspectToken should return the path of the token cache")
+			require.Equal(t, "saved-user-id", got.Subject, "InspectToken should return the subject of the ID token")
+			require.Equal(t, defaultIssuerURL, got.Issuer, "InspectToken should return the issuer of the ID token")
+			require.Equal(t, username, got.Username, "InspectToken should return the cached username")
+			require.Equal(t, []string{"saved-remote-group", "saved-local-group"}, got.Groups, "InspectToken should return the cached groups")
+			require.False(t, got.Expiry.IsZero(), "InspectToken should return the expiry of the access token")
+			require.False(t, got.IDTokenExpiry.IsZero(), "InspectToken should return the expiry of the ID token")
+			require.Equal(t, !tc.noRefreshToken, got.HasRefreshToken, "InspectToken should tell if there is a refresh token")
+
+			j, err := json.Marshal(got)
+			require.NoError(t, err, "Setup: Marshal should not have returned an error")
+			require.NotContains(t, string(j), "accesstoken", "InspectToken should not return the access token")
+			require.NotContains(t, string(j), "refreshtoken", "InspectToken should not return the refresh token")
+
+			if tc.tokenKey == nil {
+				_, err = token.LoadAuthInfo(tokenPath)
+				require.NoError(t, err, "The plaintext token should not have been encrypted by InspectToken")
+			}
+		})
+	}
+}
+
+func TestLastLogin(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+
+	tests := map[string]struct {
+		notAllowed bool
+
+		wantRecorded bool
+	}{
+		"Successfully_record_the_last_login": {wantRecorded: true},
+
+		"Login_is_not_recorded_if_the_user_is_denied": {notAllowed: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				issuerURL:       defaultIssuerURL,
+				allUsersAllowed: !tc.notAllowed,
+			})
+			sessionID, key := newSessionForTests(t, b, username, "")
+			tok := generateCachedInfo(t, tokenOptions{username: username, issuer: defaultIssuerURL})
+			err := token.CacheAuthInfo(b.TokenPathForSession(sessionID), *tok)
+			require.NoError(t, err, "Setup: CacheAuthInfo should not have returned an error")
+			err = password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			before := time.Now()
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			_, _, err = b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+
+			got, err := b.LastLogin(username)
+			if !tc.wantRecorded {
+				require.ErrorIs(t, err, os.ErrNotExist, "LastLogin should return that no login was recorded")
+				return
+			}
+			require.NoError(t, err, "LastLogin should not have returned an error")
+			require.False(t, got.Time.Before(before), "LastLogin should return the time of the login")
+			require.Equal(t, defaultIssuerURL, got.Issuer, "LastLogin should return the issuer which authenticated the user")
+			require.Equal(t, authmodes.Password, got.Mode, "LastLogin should return the authentication mode")
+			require.False(t, got.Offline, "LastLogin should return that the user logged in online")
+			require.Equal(t, []string{"remote-test-group", "local-test-group"}, got.Groups, "LastLogin should return the granted groups")
+
+			err = b.ForceTokenRefresh(sessionID)
+			require.NoError(t, err, "ForceTokenRefresh should not have returned an error")
+			afterRefresh, err := b.LastLogin(username)
+			require.NoError(t, err, "LastLogin should not have returned an error")
+			require.Equal(t, got, afterRefresh, "The last login should be kept when the token is refreshed")
+		})
+	}
+}
+
+func TestManagedUsers(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+
+	tests := map[string]struct {
+		strategy string
+	}{
+		"Successfully_list_the_users":                           {},
+		"Successfully_list_the_users_with_a_collision_strategy": {strategy: "reject"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				issuerURL:         defaultIssuerURL,
+				allUsersAllowed:   true,
+				usernameCollision: tc.strategy,
+			})
+			got, err := b.ManagedUsers()
+			require.NoError(t, err, "ManagedUsers should not have returned an error")
+			require.Empty(t, got, "No users should be listed before any logs in")
+
+			sessionID, key := newSessionForTests(t, b, username, "")
+			issuerURL := b.IssuerURLForSession(sessionID)
+			// The user was provisioned before the last logins were recorded.
+			err = b.StoreUsername(issuerURL, "other-user-id", "other-user@email.com")
+			require.NoError(t, err, "Setup: StoreUsername should not have returned an error")
+			tok := generateCachedInfo(t, tokenOptions{username: username, issuer: defaultIssuerURL})
+			err = token.CacheAuthInfo(b.TokenPathForSession(sessionID), *tok)
+			require.NoError(t, err, "Setup: CacheAuthInfo should not have returned an error")
+			err = password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+			access, data, err := b.IsAuthenticated(sessionID, `{"challenge":"`+encryptChallenge(t, "password", key)+`"}`)
+			require.NoError(t, err, "Setup: IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthGranted, access, "Setup: User should have been allowed: %s", data)
+			lastLogin, err := b.LastLogin(username)
+			require.NoError(t, err, "Setup: LastLogin should not have returned an error")
+
+			got, err = b.ManagedUsers()
+			require.NoError(t, err, "ManagedUsers should not have returned an error")
+			require.Equal(t, []broker.ManagedUser{
+				{Username: "other-user@email.com", Subject: "other-user-id", Issuer: issuerURL},
+				{Username: username, Subject: "test-user-id", Issuer: issuerURL, LastLogin: lastLogin.Time},
+			}, got, "ManagedUsers should list the users sorted by username, with their last login if recorded")
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+
+	tests := map[string]struct {
+		noAuditLog       bool
+		allowedGroups    map[string]struct{}
+		password         string
+		existingLogSize  int
+		existingRotated  bool
+		auditLogMaxFiles int
+
+		wantOutcome string
+		wantReason  string
+		wantRotated []string
+	}{
+		"Record_a_granted_decision": {wantOutcome: broker.AuthGranted},
+		"Record_a_denied_decision_with_its_reason": {
+			allowedGroups: map[string]struct{}{"other-group": {}},
+			wantOutcome:   broker.AuthDenied,
+			wantReason:    broker.FailureNotInGroup,
+		},
+		"Record_a_retry_after_an_incorrect_password": {
+			password:    "wrong-password",
+			wantOutcome: broker.AuthRetry,
+			wantReason:  broker.FailureOther,
+		},
+		"Append_to_the_existing_audit_log": {existingLogSize: 16, wantOutcome: broker.AuthGranted},
+		"Rotate_the_audit_log_above_the_maximum_size": {
+			existingLogSize:  1 << 20,
+			existingRotated:  true,
+			auditLogMaxFiles: 2,
+			wantOutcome:      broker.AuthGranted,
+			wantRotated:      []string{"current", "previous"},
+		},
+		"Remove_the_oldest_rotated_audit_log": {
+			existingLogSize:  1 << 20,
+			existingRotated:  true,
+			auditLogMaxFiles: 1,
+			wantOutcome:      broker.AuthGranted,
+			wantRotated:      []string{"current"},
+		},
+
+		"Nothing_is_recorded_if_no_audit_log_is_configured": {noAuditLog: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			auditLog := filepath.Join(t.TempDir(), "audit", "audit.log")
+			existing := strings.Repeat("x", tc.existingLogSize)
+			if tc.existingLogSize > 0 {
+				existing = existing[:len(existing)-1] + "\n"
+				err := os.MkdirAll(filepath.Dir(auditLog), 0700)
+				require.NoError(t, err, "Setup: MkdirAll should not have returned an error")
+				err = os.WriteFile(auditLog, []byte(existing), 0600)
+				require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+			}
+			if tc.existingRotated {
+				err := os.WriteFile(auditLog+".1", []byte("previous\n"), 0600)
+				require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+			}
+
+			cfg := &brokerForTestConfig{
+				issuerURL:        defaultIssuerURL,
+				allUsersAllowed:  true,
+				allowedGroups:    tc.allowedGroups,
+				auditLog:         auditLog,
+				auditLogMaxSize:  1,
+				auditLogMaxFiles: tc.auditLogMaxFiles,
+			}
+			if tc.noAuditLog {
+				cfg.auditLog = ""
+			}
+			b := newBrokerForTests(t, cfg)
+
+			sessionID, key := newSessionForTests(t, b, username, "")
+			tok := generateCachedInfo(t, tokenOptions{username: username, issuer: defaultIssuerURL})
+			err := token.CacheAuthInfo(b.TokenPathForSession(sessionID), *tok)
+			require.NoError(t, err, "Setup: CacheAuthInfo should not have returned an error")
+			err = password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			if tc.password == "" {
+				tc.password = "password"
+			}
+			before := time.Now()
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+			authData := `{"challenge":"` + encryptChallenge(t, tc.password, key) + `"}`
+			_, _, err = b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+
+			// The decision must be written when IsAuthenticated returns.
+			data, err := os.ReadFile(auditLog)
+			if tc.noAuditLog {
+				require.ErrorIs(t, err, os.ErrNotExist, "No audit log should have been written")
+				return
+			}
+			require.NoError(t, err, "The audit log should have been written")
+			if tc.wantRotated == nil {
+				require.True(t, strings.HasPrefix(string(data), existing), "The audit log should have been appended to")
+				data = data[len(existing):]
+			}
+			for i, want := range tc.wantRotated {
+				rotated, err := os.ReadFile(fmt.Sprintf("%s.%d", auditLog, i+1))
+				require.NoError(t, err, "The rotated audit log should exist")
+				if want == "current" {
+					require.Equal(t, existing, string(rotated), "The audit log should have been rotated")
+				} else {
+					require.Equal(t, want+"\n", string(rotated), "The previous rotated audit log should have been renamed")
+				}
+			}
+			require.NoFileExists(t, fmt.Sprintf("%s.%d", auditLog, len(tc.wantRotated)+1), "No other rotated audit log should be kept")
+
+			lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			require.Len(t, lines, 1, "The audit log should hold one line per decision")
+			var record map[string]any
+			err = json.Unmarshal([]byte(lines[0]), &record)
+			require.NoError(t, err, "The audit log line should be JSON")
+
+			recordTime, err := time.Parse(time.RFC3339Nano, record["time"].(string))
+			require.NoError(t, err, "The audit record should have a time")
+			require.False(t, recordTime.Before(before), "The audit record should have the time of the decision")
+			require.Equal(t, username, record["username"], "The audit record should have the username")
+			require.Equal(t, defaultIssuerURL, record["provider"], "The audit record should have the provider")
+			require.Equal(t, authmodes.Password, record["mode"], "The audit record should have the authentication mode")
+			require.Equal(t, tc.wantOutcome, record["outcome"], "The audit record should have the outcome")
+			if tc.wantReason == "" {
+				require.NotContains(t, record, "reason", "The audit record should not have a reason if access was granted")
+			} else {
+				require.Equal(t, tc.wantReason, record["reason"], "The audit record should have the reason of the failure")
+				require.NotEmpty(t, record["message"], "The audit record should have the message shown to the user")
+			}
+			for k := range record {
+				require.Contains(t, []string{"time", "username", "provider", "mode", "outcome", "reason", "message"}, k,
+					"The audit record should not have other fields, which could leak secrets")
+			}
+			require.NotContains(t, lines[0], tok.Token.AccessToken, "The audit record should not contain the access token")
+			require.NotContains(t, lines[0], tok.Token.RefreshToken, "The audit record should not contain the refresh token")
+		})
+	}
+}
+
+func TestSkelDir(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+
+	tests := map[string]struct {
+		noSkelDir     bool
+		noHomeDir     bool
+		existingFiles map[string]string
+		symlinkConfig bool
+
+		wantFiles map[string]string
+	}{
+		"Successfully_copy_the_skeleton_to_the_home_directory": {
+			wantFiles: map[string]string{".profile": "skel profile", ".config/app.conf": "skel app config"},
+		},
+		"Existing_files_of_the_home_directory_are_kept": {
+			existingFiles: map[string]string{".profile": "user profile", ".config/other.conf": "user other config"},
+			wantFiles:     map[string]string{".profile": "user profile", ".config/app.conf": "skel app config", ".config/other.conf": "user other config"},
+		},
+
+		"Skeleton_is_copied_once_the_home_directory_is_created": {
+			noHomeDir: true,
+			wantFiles: map[string]string{".profile": "skel profile", ".config/app.conf": "skel app config"},
+		},
+		"Nothing_is_copied_through_a_symlink_of_the_home_directory": {
+			symlinkConfig: true,
+			wantFiles:     map[string]string{".profile": "skel profile"},
+		},
+		"Nothing_is_copied_if_not_configured": {noSkelDir: true, wantFiles: map[string]string{}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			skelDir := filepath.Join(t.TempDir(), "skel")
+			err := os.MkdirAll(filepath.Join(skelDir, ".config"), 0700)
+			require.NoError(t, err, "Setup: MkdirAll should not have returned an error")
+			err = os.WriteFile(filepath.Join(skelDir, ".profile"), []byte("skel profile"), 0640)
+			require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+			err = os.WriteFile(filepath.Join(skelDir, ".config", "app.conf"), []byte("skel app config"), 0600)
+			require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+			if tc.noSkelDir {
+				skelDir = ""
 			}
 
-			dataDir := t.TempDir()
+			homeBaseDir := t.TempDir()
+			home := filepath.Join(homeBaseDir, username)
+			if !tc.noHomeDir {
+				err := os.Mkdir(home, 0700)
+				require.NoError(t, err, "Setup: Mkdir should not have returned an error")
+			}
+			outsideDir := t.TempDir()
+			if tc.symlinkConfig {
+				err := os.Symlink(outsideDir, filepath.Join(home, ".config"))
+				require.NoError(t, err, "Setup: Symlink should not have returned an error")
+			}
+			for path, content := range tc.existingFiles {
+				err := os.MkdirAll(filepath.Dir(filepath.Join(home, path)), 0700)
+				require.NoError(t, err, "Setup: MkdirAll should not have returned an error")
+				err = os.WriteFile(filepath.Join(home, path), []byte(content), 0600)
+				require.NoError(t, err, "Setup: WriteFile should not have returned an error")
+			}
 
-			cfg := &brokerForTestConfig{
-				Config:      broker.Config{DataDir: dataDir},
-				issuerURL:   defaultIssuerURL,
-				homeBaseDir: homeDirPath,
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				issuerURL:       defaultIssuerURL,
+				allUsersAllowed: true,
+				homeBaseDir:     homeBaseDir,
+				skelDir:         skelDir,
+			})
+			sessionID, key := newSessionForTests(t, b, username, "")
+			tok := generateCachedInfo(t, tokenOptions{username: username, issuer: defaultIssuerURL})
+			err = token.CacheAuthInfo(b.TokenPathForSession(sessionID), *tok)
+			require.NoError(t, err, "Setup: CacheAuthInfo should not have returned an error")
+			err = password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, data, err := b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+			require.Equal(t, broker.AuthGranted, access, "IsAuthenticated should have granted access, data: %s", data)
+
+			if tc.noHomeDir {
+				require.NoDirExists(t, home, "The home directory should not have been created")
+				err := os.Mkdir(home, 0700)
+				require.NoError(t, err, "Mkdir should not have returned an error")
+				require.Eventually(t, func() bool {
+					_, err := os.Stat(filepath.Join(home, ".config", "app.conf"))
+					return err == nil
+				}, 10*time.Second, 100*time.Millisecond, "The skeleton should have been copied once the home directory was created")
 			}
-			if tc.emptyGroups {
-				cfg.getGroupsFunc = func() ([]info.Group, error) {
-					return []info.Group{}, nil
+			entries, err := os.ReadDir(outsideDir)
+			require.NoError(t, err, "ReadDir should not have returned an error")
+			require.Empty(t, entries, "Nothing should have been copied outside of the home directory")
+
+			got := make(map[string]string)
+			err = filepath.WalkDir(home, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() || d.Type()&fs.ModeSymlink != 0 {
+					return err
 				}
-			}
-			if tc.wantGroupErr {
-				cfg.getGroupsFunc = func() ([]info.Group, error) {
-					return nil, errors.New("error getting groups")
+				content, err := os.ReadFile(path)
+				if err != nil {
+					return err
 				}
-			}
-			b := newBrokerForTests(t, cfg)
+				rel, err := filepath.Rel(home, path)
+				got[rel] = string(content)
+				return err
+			})
+			require.NoError(t, err, "WalkDir should not have returned an error")
+			require.Equal(t, tc.wantFiles, got, "The home directory should have the expected files")
 
-			if tc.username == "" {
-				tc.username = "test-user@email.com"
+			if !tc.noSkelDir && tc.existingFiles == nil {
+				info, err := os.Stat(filepath.Join(home, ".profile"))
+				require.NoError(t, err, "Stat should not have returned an error")
+				require.Equal(t, os.FileMode(0640), info.Mode().Perm(), "The mode of the copied files should be preserved")
 			}
-			tc.token.issuer = defaultIssuerURL
+		})
+	}
+}
 
-			sessionID, _, err := b.NewSession(tc.username, "lang", "auth")
-			require.NoError(t, err, "Setup: Failed to create session for the tests")
+func TestRemoveUser(t *testing.T) {
+	t.Parallel()
 
-			cachedInfo := generateCachedInfo(t, tc.token)
-			if cachedInfo == nil {
-				cachedInfo = &token.AuthCachedInfo{}
+	const username = "test-user@email.com"
+
+	tests := map[string]struct {
+		onUserRemoval    string
+		noToken          bool
+		noHomeDir        bool
+		homeOutside      bool
+		archiveDirIsFile bool
+
+		wantHomeKept bool
+		wantArchive  bool
+		wantErr      bool
+	}{
+		"Successfully_keep_the_home_directory":                                      {onUserRemoval: "keep", wantHomeKept: true},
+		"Successfully_archive_the_home_directory":                                   {onUserRemoval: "archive", wantArchive: true},
+		"Successfully_delete_the_home_directory":                                    {onUserRemoval: "delete"},
+		"Successfully_delete_the_home_directory_of_the_prefix_without_cached_token": {onUserRemoval: "delete", noToken: true},
+		"Successfully_remove_user_whose_home_directory_does_not_exist":              {onUserRemoval: "delete", noHomeDir: true},
+
+		"Error_if_the_home_directory_is_outside_of_the_prefix": {onUserRemoval: "delete", homeOutside: true, wantHomeKept: true, wantErr: true},
+		"Error_if_the_archive_can_not_be_written":              {onUserRemoval: "archive", archiveDirIsFile: true, wantHomeKept: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			homeBaseDir := t.TempDir()
+			home := filepath.Join(homeBaseDir, username)
+			if tc.homeOutside {
+				home = filepath.Join(t.TempDir(), username)
+			}
+			if !tc.noHomeDir {
+				writeHomeDirForTests(t, home)
+			}
+			archiveDir := filepath.Join(t.TempDir(), "archives")
+			if tc.archiveDirIsFile {
+				err := os.WriteFile(archiveDir, nil, 0600)
+				require.NoError(t, err, "Setup: WriteFile should not have returned an error")
 			}
 
-			got, err := b.FetchUserInfo(sessionID, cachedInfo)
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				issuerURL:             defaultIssuerURL,
+				allUsersAllowed:       true,
+				homeBaseDir:           homeBaseDir,
+				onUserRemoval:         tc.onUserRemoval,
+				userRemovalArchiveDir: archiveDir,
+			})
+			sessionID, _ := newSessionForTests(t, b, username, "")
+			tokenPath := b.TokenPathForSession(sessionID)
+			passwordPath := b.PasswordFilepathForSession(sessionID)
+			if !tc.noToken {
+				tok := generateCachedInfo(t, tokenOptions{username: username, issuer: defaultIssuerURL})
+				tok.UserInfo.Home = home
+				err := token.CacheAuthInfo(tokenPath, *tok)
+				require.NoError(t, err, "Setup: CacheAuthInfo should not have returned an error")
+			}
+			err := password.HashAndStorePassword("password", passwordPath)
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+
+			err = b.RemoveUser(username)
 			if tc.wantErr {
-				require.Error(t, err, "FetchUserInfo should have returned an error")
+				require.Error(t, err, "RemoveUser should have returned an error")
+			} else {
+				require.NoError(t, err, "RemoveUser should not have returned an error")
+			}
+
+			// The user can not log in with their cached credentials, whatever happens to their home directory.
+			require.NoFileExists(t, tokenPath, "The token of the user should have been deleted")
+			require.NoFileExists(t, passwordPath, "The password of the user should have been deleted")
+
+			if tc.wantHomeKept {
+				require.FileExists(t, filepath.Join(home, ".profile"), "The home directory should have been kept")
+			} else {
+				require.NoDirExists(t, home, "The home directory should have been deleted")
+			}
+
+			archives, _ := filepath.Glob(filepath.Join(archiveDir, "*"))
+			if !tc.wantArchive {
+				require.Empty(t, archives, "The home directory should not have been archived")
 				return
 			}
-			require.NoError(t, err, "FetchUserInfo should not have returned an error")
+			require.Len(t, archives, 1, "The home directory should have been archived")
+			require.Regexp(t, `/test-user@email\.com-\d{8}T\d{6}Z\.tar\.gz$`, archives[0], "The archive should be named after the user and the time of the removal")
+			fi, err := os.Stat(archives[0])
+			require.NoError(t, err, "Stat should not have returned an error")
+			require.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "The archive should only be readable by its owner")
+			require.Equal(t, map[string]string{
+				username + "/":                  "",
+				username + "/.profile":          "user profile",
+				username + "/.config/":          "",
+				username + "/.config/app.conf":  "user app config",
+				username + "/.config/link.conf": "-> app.conf",
+			}, readArchiveForTests(t, archives[0]), "The archive should have the files of the home directory")
+		})
+	}
+}
 
-			golden.CheckOrUpdateYAML(t, got)
+func TestIsAuthenticatedOnUserRemoval(t *testing.T) {
+	t.Parallel()
+
+	const username = "test-user@email.com"
+
+	tests := map[string]struct {
+		errorDescription string
+
+		wantUserRemoved bool
+	}{
+		"Flag_user_whose_account_does_not_exist":       {errorDescription: "User not found", wantUserRemoved: true},
+		"Flag_user_whose_Entra_account_does_not_exist": {errorDescription: "AADSTS50034: The user account {EUII Hidden} does not exist in the directory.", wantUserRemoved: true},
+
+		"Do_not_flag_user_whose_refresh_token_is_only_rejected": {errorDescription: "Token is not active"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			homeBaseDir := t.TempDir()
+			home := filepath.Join(homeBaseDir, username)
+			writeHomeDirForTests(t, home)
+
+			b := newBrokerForTests(t, &brokerForTestConfig{
+				allUsersAllowed: true,
+				homeBaseDir:     homeBaseDir,
+				// The home directory is only deleted by RemoveUser.
+				onUserRemoval: "delete",
+				customHandlers: map[string]testutils.EndpointHandler{
+					"/token": func(w http.ResponseWriter, _ *http.Request) {
+						w.Header().Add("Content-Type", "application/json")
+						w.WriteHeader(http.StatusBadRequest)
+						_, _ = w.Write([]byte(`{"error": "invalid_grant", "error_description": "` + tc.errorDescription + `"}`))
+					},
+				},
+			})
+			sessionID, key := newSessionForTests(t, b, username, "")
+			tokenPath := b.TokenPathForSession(sessionID)
+			tok := generateCachedInfo(t, tokenOptions{username: username})
+			tok.UserInfo.Home = home
+			err := token.CacheAuthInfo(tokenPath, *tok)
+			require.NoError(t, err, "Setup: CacheAuthInfo should not have returned an error")
+			passwordPath := b.PasswordFilepathForSession(sessionID)
+			err = password.HashAndStorePassword("password", passwordPath)
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+			err = b.StoreUsername(b.IssuerURLForSession(sessionID), "test-user-id", username)
+			require.NoError(t, err, "Setup: StoreUsername should not have returned an error")
+
+			updateAuthModes(t, b, sessionID, authmodes.Password)
+			authData := `{"challenge":"` + encryptChallenge(t, "password", key) + `"}`
+			access, err := b.IsAuthenticatedCause(sessionID, authData)
+			require.Equal(t, broker.AuthDenied, access, "IsAuthenticated should have denied access")
+			require.ErrorIs(t, err, broker.ErrInvalidGrant, "IsAuthenticated should have failed because the grant was rejected")
+			require.FileExists(t, passwordPath, "The local password of the user should have been kept")
+			require.DirExists(t, home, "The home directory should have been kept")
+
+			users, usersErr := b.ManagedUsers()
+			require.NoError(t, usersErr, "ManagedUsers should not have returned an error")
+			require.Len(t, users, 1, "ManagedUsers should list the user")
+			require.Equal(t, tc.wantUserRemoved, users[0].RemovedAtProvider, "The user should be flagged as removed at the provider only if told so")
+			if !tc.wantUserRemoved {
+				require.NotErrorIs(t, err, broker.ErrUserRemoved, "IsAuthenticated should not have failed because the user was removed")
+				require.FileExists(t, tokenPath, "The token of the user should have been kept")
+				return
+			}
+			require.ErrorIs(t, err, broker.ErrUserRemoved, "IsAuthenticated should have failed because the user was removed")
+			require.NoFileExists(t, tokenPath, "The token of the user should have been deleted")
 		})
 	}
 }
 
-func TestCancelIsAuthenticated(t *testing.T) {
+func TestMetrics(t *testing.T) {
 	t.Parallel()
 
-	b := newBrokerForTests(t, &brokerForTestConfig{
-		customHandlers: map[string]testutils.EndpointHandler{
-			"/token": testutils.HangingHandler(3 * time.Second),
+	tests := map[string]struct {
+		password      string
+		allowedGroups map[string]struct{}
+		tokenHandler  testutils.EndpointHandler
+
+		wantMetrics broker.Metrics
+	}{
+		"Successful_authentication_is_counted": {
+			wantMetrics: broker.Metrics{Attempts: map[string]uint64{authmodes.Password: 1}, Successes: 1, TokenRefreshes: 1},
 		},
-	})
-	sessionID, _ := newSessionForTests(t, b, "", "")
 
-	updateAuthModes(t, b, sessionID, authmodes.DeviceQr)
+		"Incorrect_password_is_counted_as_other_failure": {
+			password:    "wrong-password",
+			wantMetrics: broker.Metrics{Attempts: map[string]uint64{authmodes.Password: 1}, Failures: map[string]uint64{broker.FailureOther: 1}},
+		},
+		"User_not_in_allowed_group_is_counted_as_not_in_group_failure": {
+			allowedGroups: map[string]struct{}{"not-a-group": {}},
+			wantMetrics: broker.Metrics{
+				Attempts:       map[string]uint64{authmodes.Password: 1},
+				Failures:       map[string]uint64{broker.FailureNotInGroup: 1},
+				TokenRefreshes: 1,
+			},
+		},
+		"Rejected_refresh_token_is_counted_as_invalid_grant_failure": {
+			tokenHandler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+			},
+			wantMetrics: broker.Metrics{
+				Attempts:             map[string]uint64{authmodes.Password: 1},
+				Failures:             map[string]uint64{broker.FailureInvalidGrant: 1},
+				TokenRefreshFailures: 1,
+			},
+		},
+		"Unreachable_token_endpoint_is_counted_as_network_failure": {
+			tokenHandler: func(w http.ResponseWriter, _ *http.Request) {
+				// Close the connection without any response.
+				conn, _, err := http.NewResponseController(w).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+			},
+			wantMetrics: broker.Metrics{
+				Attempts:             map[string]uint64{authmodes.Password: 1},
+				Failures:             map[string]uint64{broker.FailureNetwork: 1},
+				TokenRefreshFailures: 1,
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
 
-	stopped := make(chan struct{})
-	go func() {
-		defer close(stopped)
-		_, _, err := b.IsAuthenticated(sessionID, `{}`)
-		require.Error(t, err, "IsAuthenticated should have returned an error")
-	}()
+			cfg := &brokerForTestConfig{allUsersAllowed: true, allowedGroups: tc.allowedGroups}
+			if tc.tokenHandler != nil {
+				cfg.customHandlers = map[string]testutils.EndpointHandler{"/token": tc.tokenHandler}
+			} else {
+				cfg.issuerURL = defaultIssuerURL
+			}
+			b := newBrokerForTests(t, cfg)
+			require.Equal(t, broker.Metrics{}, b.Metrics(), "Metrics should be empty before any authentication")
 
-	// Wait for the call to hang
-	time.Sleep(50 * time.Millisecond)
+			const username = "test-user@email.com"
+			sessionID, key := newSessionForTests(t, b, username, "")
+			generateAndStoreCachedInfo(t, tokenOptions{username: username}, b.TokenPathForSession(sessionID))
+			err := password.HashAndStorePassword("password", b.PasswordFilepathForSession(sessionID))
+			require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+			updateAuthModes(t, b, sessionID, authmodes.Password)
 
-	b.CancelIsAuthenticated(sessionID)
-	<-stopped
+			if tc.password == "" {
+				tc.password = "password"
+			}
+			authData := `{"challenge":"` + encryptChallenge(t, tc.password, key) + `"}`
+			_, _, err = b.IsAuthenticated(sessionID, authData)
+			require.NoError(t, err, "IsAuthenticated should not have returned an error")
+
+			require.Equal(t, tc.wantMetrics, b.Metrics(), "Metrics should count the authentication outcome")
+		})
+	}
 }
 
-func TestEndSession(t *testing.T) {
+func TestReloadConfig(t *testing.T) {
 	t.Parallel()
 
-	b := newBrokerForTests(t, &brokerForTestConfig{
-		issuerURL: defaultIssuerURL,
-	})
+	tests := map[string]struct {
+		newConfig    string
+		noConfigFile bool
 
-	sessionID, _ := newSessionForTests(t, b, "", "")
+		wantClientID string
+		wantScope    string
+		wantErr      bool
+	}{
+		"Successfully_reload_config": {
+			newConfig:    "[oidc]\nissuer = ISSUER\nclient_id = new-client-id\nextra_scopes = new-scope\n",
+			wantClientID: "new-client-id",
+			wantScope:    "new-scope",
+		},
 
-	// Try to end a session that does not exist
-	err := b.EndSession("nonexistent")
-	require.Error(t, err, "EndSession should have returned an error when ending a nonexistent session")
+		"Error_if_broker_has_no_config_file":       {noConfigFile: true, wantErr: true},
+		"Error_if_config_file_is_removed":          {wantErr: true},
+		"Error_if_new_config_is_not_updated":       {newConfig: "[oidc]\nissuer = https://<ISSUER_URL>\nclient_id = <CLIENT_ID>\n", wantErr: true},
+		"Error_if_new_config_has_no_client_id":     {newConfig: "[oidc]\nissuer = ISSUER\nextra_scopes = new-scope\n", wantErr: true},
+		"Error_if_new_config_has_invalid_env_vars": {newConfig: "[oidc]\nissuer = ISSUER\nclient_id = ${AUTHD_OIDC_TEST_UNSET:?}\n", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
 
-	// End a session that exists
-	err = b.EndSession(sessionID)
-	require.NoError(t, err, "EndSession should not have returned an error when ending an existent session")
+			cfg := &brokerForTestConfig{}
+			if !tc.noConfigFile {
+				cfg.ConfigFile = filepath.Join(t.TempDir(), "broker.conf")
+				oldConfig := fmt.Sprintf("[oidc]\nissuer = %s\nclient_id = old-client-id\n", defaultIssuerURL)
+				err := os.WriteFile(cfg.ConfigFile, []byte(oldConfig), 0600)
+				require.NoError(t, err, "Setup: Failed to write config file")
+			}
+			b := newBrokerForTests(t, cfg)
+
+			oldSessionID, _ := newSessionForTests(t, b, "", "")
+			oldClientID := b.ClientIDForSession(oldSessionID)
+			oldScopes := b.ScopesForSession(oldSessionID)
+
+			if !tc.noConfigFile {
+				var err error
+				if tc.newConfig == "" {
+					err = os.Remove(cfg.ConfigFile)
+				} else {
+					newConfig := strings.ReplaceAll(tc.newConfig, "ISSUER", defaultIssuerURL)
+					err = os.WriteFile(cfg.ConfigFile, []byte(newConfig), 0600)
+				}
+				require.NoError(t, err, "Setup: Failed to update config file")
+			}
+
+			err := b.ReloadConfig()
+			if tc.wantErr {
+				require.Error(t, err, "ReloadConfig should have returned an error")
+			} else {
+				require.NoError(t, err, "ReloadConfig should not have returned an error")
+			}
+
+			require.Equal(t, oldClientID, b.ClientIDForSession(oldSessionID), "Existing session should keep its client ID")
+			require.Equal(t, oldScopes, b.ScopesForSession(oldSessionID), "Existing session should keep its scopes")
+
+			newSessionID, _ := newSessionForTests(t, b, "", "")
+			if tc.wantErr {
+				require.Equal(t, oldClientID, b.ClientIDForSession(newSessionID), "New session should use the old client ID")
+				require.Equal(t, oldScopes, b.ScopesForSession(newSessionID), "New session should use the old scopes")
+				return
+			}
+			require.Equal(t, tc.wantClientID, b.ClientIDForSession(newSessionID), "New session should use the new client ID")
+			require.Contains(t, b.ScopesForSession(newSessionID), tc.wantScope, "New session should request the new scopes")
+		})
+	}
+}
+
+func TestGetUserInfo(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		sessionID string
+		token     *tokenOptions
+
+		wantClaims        broker.UserClaims
+		wantMissingClaims []string
+		wantErr           bool
+	}{
+		"Successfully_get_user_info_from_cached_token": {
+			token: &tokenOptions{},
+			wantClaims: broker.UserClaims{
+				PreferredUsername: "test-user-preferred-username@email.com",
+				Email:             "test-user@email.com",
+				Name:              "test-user",
+				Subject:           "saved-user-id",
+			},
+		},
+		"Preferred_username_is_normalized": {
+			token: &tokenOptions{idTokenClaims: map[string]any{"preferred_username": "Test-User@Email.com"}},
+			wantClaims: broker.UserClaims{
+				PreferredUsername: "test-user@email.com",
+				Email:             "test-user@email.com",
+				Name:              "test-user",
+				Subject:           "saved-user-id",
+			},
+		},
+		"Preferred_username_falls_back_to_email": {
+			token: &tokenOptions{idTokenClaims: map[string]any{"preferred_username": ""}},
+			wantClaims: broker.UserClaims{
+				PreferredUsername: "test-user@email.com",
+				Email:             "test-user@email.com",
+				Name:              "test-user",
+				Subject:           "saved-user-id",
+			},
+		},
+
+		"Error_when_session_does_not_exist": {sessionID: "-", wantErr: true},
+		"Error_when_token_does_not_exist":   {wantErr: true},
+		"Error_when_token_is_invalid":       {token: &tokenOptions{invalid: true}, wantErr: true},
+		"Error_when_token_has_no_ID_token":  {token: &tokenOptions{noIDToken: true}, wantErr: true},
+		"Error_when_subject_is_missing": {
+			token:             &tokenOptions{idTokenClaims: map[string]any{"sub": ""}},
+			wantMissingClaims: []string{"sub"},
+			wantErr:           true,
+		},
+		"Error_when_preferred_username_and_email_are_missing": {
+			token:             &tokenOptions{username: "-", idTokenClaims: map[string]any{"preferred_username": ""}},
+			wantMissingClaims: []string{"preferred_username"},
+			wantErr:           true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := newBrokerForTests(t, &brokerForTestConfig{})
+			sessionID, _ := newSessionForTests(t, b, "", "")
+			if tc.token != nil {
+				generateAndStoreCachedInfo(t, *tc.token, b.TokenPathForSession(sessionID))
+			}
+			if tc.sessionID == "-" {
+				sessionID = "nonexistent"
+			}
+
+			got, err := b.GetUserInfo(sessionID)
+			if tc.wantErr {
+				require.Error(t, err, "GetUserInfo should have returned an error")
+				if tc.wantMissingClaims != nil {
+					var missingClaimsErr broker.MissingClaimsError
+					require.ErrorAs(t, err, &missingClaimsErr, "GetUserInfo should have returned a MissingClaimsError")
+					require.Equal(t, tc.wantMissingClaims, missingClaimsErr.Claims, "Error should list the missing claims")
+				}
+				return
+			}
+			require.NoError(t, err, "GetUserInfo should not have returned an error")
+			require.Equal(t, tc.wantClaims, got, "GetUserInfo should have returned the expected claims")
+		})
+	}
 }
 
 func TestUserPreCheck(t *testing.T) {
@@ -1102,6 +6506,7 @@ func TestUserPreCheck(t *testing.T) {
 		username        string
 		allowedSuffixes []string
 		homePrefix      string
+		homeDirTemplate string
 
 		wantErr bool
 	}{
@@ -1117,6 +6522,12 @@ func TestUserPreCheck(t *testing.T) {
 			allowedSuffixes: []string{"@allowed"},
 			homePrefix:      "/home/allowed/",
 		},
+		"Return_userinfo_with_homedir_from_template_after_precheck": {
+			username:        "user@allowed",
+			allowedSuffixes: []string{"@allowed"},
+			homePrefix:      "/home/",
+			homeDirTemplate: "%i/%d/%u",
+		},
 
 		"Error_when_username_does_not_match_allowed_suffix": {
 			username:        "user@notallowed",
@@ -1132,6 +6543,13 @@ func TestUserPreCheck(t *testing.T) {
 			username: "user@allowed",
 			wantErr:  true,
 		},
+		"Error_when_homedir_from_template_escapes_the_home_prefix": {
+			username:        "..",
+			allowedSuffixes: []string{""},
+			homePrefix:      "/home/",
+			homeDirTemplate: "%u",
+			wantErr:         true,
+		},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -1140,6 +6558,7 @@ func TestUserPreCheck(t *testing.T) {
 			b := newBrokerForTests(t, &brokerForTestConfig{
 				issuerURL:          defaultIssuerURL,
 				homeBaseDir:        tc.homePrefix,
+				homeDirTemplate:    tc.homeDirTemplate,
 				allowedSSHSuffixes: tc.allowedSuffixes,
 			})
 
@@ -1155,6 +6574,89 @@ func TestUserPreCheck(t *testing.T) {
 	}
 }
 
+func TestDryRun(t *testing.T) {
+	t.Parallel()
+
+	userGroups := []info.Group{{Name: "Remote Group", UGID: "12345"}, {Name: "local-group"}}
+
+	tests := map[string]struct {
+		username            string
+		allowedGroups       map[string]struct{}
+		requiredACR         []string
+		unavailableProvider bool
+
+		wantGroups     []info.Group
+		wantNotAllowed bool
+		wantErr        bool
+	}{
+		"Successfully_resolve_claims_and_groups": {
+			wantGroups: []info.Group{{Name: "oidc-remote_group", UGID: "12345"}, {Name: "local-group"}},
+		},
+		"Successfully_report_that_user_is_not_in_an_allowed_group": {
+			allowedGroups:  map[string]struct{}{"other-group": {}},
+			wantGroups:     []info.Group{{Name: "oidc-remote_group", UGID: "12345"}, {Name: "local-group"}},
+			wantNotAllowed: true,
+		},
+
+		"Error_when_provider_is_not_reachable":         {unavailableProvider: true, wantErr: true},
+		"Error_when_username_does_not_match":           {username: "other-user@email.com", wantErr: true},
+		"Error_when_authentication_context_is_not_met": {requiredACR: []string{"urn:example:unmet"}, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.username == "" {
+				tc.username = "test-user@email.com"
+			}
+
+			cfg := &brokerForTestConfig{
+				readOnly:           true,
+				groupNameTemplate:  "oidc-%g",
+				groupNameSeparator: "_",
+				allowedGroups:      tc.allowedGroups,
+				requiredACR:        tc.requiredACR,
+				gidRange:           [2]uint32{1_000_000_000, 1_999_999_999},
+				getGroupsFunc: func() ([]info.Group, error) {
+					return userGroups, nil
+				},
+			}
+			if tc.unavailableProvider {
+				cfg.customHandlers = map[string]testutils.EndpointHandler{
+					"/.well-known/openid-configuration": testutils.UnavailableHandler(),
+				}
+			}
+			b := newBrokerForTests(t, cfg)
+
+			var prompted bool
+			got, err := b.DryRun(context.Background(), tc.username, func(verificationURI, userCode string) {
+				prompted = true
+				require.NotEmpty(t, verificationURI, "DryRun should prompt with the verification URI")
+				require.NotEmpty(t, userCode, "DryRun should prompt with the user code")
+			})
+
+			entries, readErr := os.ReadDir(cfg.DataDir)
+			require.NoError(t, readErr, "Setup: ReadDir should not have returned an error")
+			require.Empty(t, entries, "DryRun should not write anything to the data directory")
+
+			if tc.wantErr {
+				require.Error(t, err, "DryRun should have returned an error")
+				return
+			}
+			require.NoError(t, err, "DryRun should not have returned an error")
+			require.True(t, prompted, "DryRun should have prompted the user")
+			require.Equal(t, "test-user@email.com", got.Claims["email"], "DryRun should return the claims of the ID token")
+			require.Equal(t, tc.username, got.UserInfo.Name, "DryRun should return the user info")
+			var gidCfg broker.Config
+			gidCfg.SetGIDRange(1_000_000_000, 1_999_999_999)
+			wantGroups := slices.Clone(tc.wantGroups)
+			wantGroups[0].GID = gidCfg.GroupGID(cfg.IssuerURL(), wantGroups[0].UGID)
+			require.Equal(t, wantGroups, got.UserInfo.Groups, "DryRun should return the groups which would be returned to authd")
+			require.Equal(t, !tc.wantNotAllowed, got.GroupsAllowed, "DryRun should report whether the groups are allowed")
+		})
+	}
+}
+
 func TestMain(m *testing.M) {
 	var cleanup func()
 	defaultIssuerURL, cleanup = testutils.StartMockProviderServer("", nil)
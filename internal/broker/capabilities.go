@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// capabilityProbeOff does not check the capabilities of the providers when the broker starts.
+	capabilityProbeOff = "off"
+	// capabilityProbeWarn logs the configured features which the providers do not advertise when the broker starts.
+	capabilityProbeWarn = "warn"
+	// capabilityProbeFail makes the broker fail to start if the providers do not advertise a configured feature.
+	capabilityProbeFail = "fail"
+
+	// deviceCodeGrantType is the grant type of the device authorization flow.
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// refreshTokenGrantType is the grant type used to refresh the tokens.
+	refreshTokenGrantType = "refresh_token"
+)
+
+// ProviderCapabilities is the result of the check of the features advertised by an identity provider in its discovery
+// document, against the ones the broker is configured to use.
+type ProviderCapabilities struct {
+	// IssuerURL is the issuer of the provider.
+	IssuerURL string
+	// Probed is when the discovery document of the provider was checked.
+	Probed time.Time
+	// Err is the error if the discovery document could not be fetched, in which case nothing was checked.
+	Err error
+	// Missing are the configured features which the provider does not advertise.
+	Missing []string
+}
+
+// probeCapabilities checks the features advertised by the configured providers, and logs the missing ones. It returns an
+// error if a provider does not advertise a configured feature and the probe is configured to fail. The providers
+// which can not be reached are only logged, as the broker can start without them.
+func (b *Broker) probeCapabilities() error {
+	if b.cfg.capabilityProbe == "" || b.cfg.capabilityProbe == capabilityProbeOff {
+		return nil
+	}
+
+	var results []ProviderCapabilities
+	var missing []string
+	for _, p := range b.cfg.configuredProviders() {
+		c := b.providerCapabilities(p)
+		results = append(results, c)
+		if c.Err != nil {
+			b.logger.Warn(fmt.Sprintf("Could not check the capabilities of %q: %v", p.issuerURL, c.Err))
+			continue
+		}
+		for _, m := range c.Missing {
+			b.logger.Warn(fmt.Sprintf("The provider %q does not advertise %s", p.issuerURL, m))
+			missing = append(missing, fmt.Sprintf("%s (%s)", m, p.issuerURL))
+		}
+	}
+
+	b.capabilitiesMu.Lock()
+	b.capabilities = results
+	b.capabilitiesMu.Unlock()
+
+	if len(missing) > 0 && b.cfg.capabilityProbe == capabilityProbeFail {
+		return fmt.Errorf("the providers do not advertise the configured features: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// providerCapabilities returns the configured features which the provider does not advertise in its discovery
+// document. The lists of supported grant types, scopes and client authentication methods are optional, so they are only
+// checked if present.
+func (b *Broker) providerCapabilities(p oidcProvider) ProviderCapabilities {
+	c := ProviderCapabilities{IssuerURL: p.issuerURL, Probed: time.Now()}
+
+	// The discovery document is fetched again, regardless of the cached one, which may be outdated.
+	doc, err := fetchDiscoveryDocument(context.Background(), b.httpClient, p.issuerURL, b.cfg.requestTimeout())
+	if err != nil {
+		c.Err = err
+		return c
+	}
+
+	if doc.DeviceAuthURL == "" {
+		c.Missing = append(c.Missing, "the device authorization endpoint, needed to authenticate with a login code")
+	} else if doc.GrantTypes != nil && !slices.Contains(doc.GrantTypes, deviceCodeGrantType) {
+		c.Missing = append(c.Missing, fmt.Sprintf("the %q grant type, needed to authenticate with a login code", deviceCodeGrantType))
+	}
+	if doc.GrantTypes != nil && !slices.Contains(doc.GrantTypes, refreshTokenGrantType) {
+		c.Missing = append(c.Missing, fmt.Sprintf("the %q grant type, needed to refresh the tokens", refreshTokenGrantType))
+	}
+	if b.cfg.revokeOnLogout && doc.RevocationURL == "" {
+		c.Missing = append(c.Missing, fmt.Sprintf("the revocation endpoint, needed by %q", revokeOnLogoutKey))
+	}
+	if b.cfg.tokenValidation == tokenValidationIntrospection && doc.IntrospectionURL == "" {
+		c.Missing = append(c.Missing, fmt.Sprintf("the introspection endpoint, needed by %q", tokenValidationKey))
+	}
+	if b.cfg.groupScope == groupScopeUserInfo && doc.UserInfoURL == "" {
+		c.Missing = append(c.Missing, fmt.Sprintf("the userinfo endpoint, needed by %q", groupScopeKey))
+	}
+	if m := p.clientAuth.method; m != "" && doc.TokenAuthMethods != nil && !slices.Contains(doc.TokenAuthMethods, m) {
+		c.Missing = append(c.Missing, fmt.Sprintf("the %q client authentication method, needed by %q", m, clientAuthKey))
+	}
+	if doc.Scopes != nil {
+		for _, scope := range b.scopes(p) {
+			if !slices.Contains(doc.Scopes, scope) {
+				c.Missing = append(c.Missing, fmt.Sprintf("the %q scope", scope))
+			}
+		}
+	}
+	return c
+}
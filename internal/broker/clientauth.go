@@ -0,0 +1,295 @@
+package broker
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+	"gopkg.in/ini.v1"
+)
+
+// Values of the client authentication setting, named after the token endpoint authentication methods of OpenID Connect.
+const (
+	// clientAuthSecretPost sends the client secret in the body of the requests.
+	clientAuthSecretPost = "client_secret_post"
+	// clientAuthSecretBasic sends the client secret in the Authorization header of the requests.
+	clientAuthSecretBasic = "client_secret_basic"
+	// clientAuthPrivateKeyJWT sends a JWT signed with the private key of the client instead of a secret.
+	clientAuthPrivateKeyJWT = "private_key_jwt"
+	// clientAuthNone only sends the client ID, for the public clients. It is not a value of the setting, but the
+	// method of the public client.
+	clientAuthNone = "none"
+)
+
+// Values of the client type setting.
+const (
+	// clientTypeConfidential authenticates as the client of client_id, with its secret or private key.
+	clientTypeConfidential = "confidential"
+	// clientTypePublic authenticates as the client of public_client_id, which has no secret, e.g. on the machines the
+	// secret of the confidential client is not deployed to.
+	clientTypePublic = "public"
+)
+
+const (
+	// clientAssertionType is the type of the client assertions, as defined by RFC 7523.
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// clientAssertionLifetime is how long a client assertion is valid. Each request gets its own assertion, so it only
+	// has to cover the time it takes to reach the provider.
+	clientAssertionLifetime = 5 * time.Minute
+)
+
+// clientAuth is how the broker authenticates as the client to the endpoints of a provider.
+type clientAuth struct {
+	// method is one of the client authentication values, or empty to detect how the token endpoint accepts the secret.
+	method string
+	// keyFile is the PEM file of the private key signing the client assertions, with private_key_jwt.
+	keyFile string
+	// keyID is the ID of the key, set as the kid header of the client assertions if not empty.
+	keyID string
+}
+
+// parseClientAuth parses the client authentication settings of the section. The private key is loaded to check it, but
+// it is loaded again for each assertion, so that it can be replaced without restarting the broker.
+func parseClientAuth(section *ini.Section) (clientAuth, error) {
+	a := clientAuth{
+		method:  section.Key(clientAuthKey).String(),
+		keyFile: section.Key(clientKeyFileKey).String(),
+		keyID:   section.Key(clientKeyIDKey).String(),
+	}
+	switch a.method {
+	case "", clientAuthSecretPost, clientAuthSecretBasic:
+		return a, nil
+	case clientAuthPrivateKeyJWT:
+	default:
+		return a, fmt.Errorf("invalid value for %q: must be %q, %q or %q", clientAuthKey,
+			clientAuthSecretPost, clientAuthSecretBasic, clientAuthPrivateKeyJWT)
+	}
+
+	if a.keyFile == "" {
+		return a, fmt.Errorf("%q must be set when %q is %q", clientKeyFileKey, clientAuthKey, clientAuthPrivateKeyJWT)
+	}
+	if _, _, err := loadClientKey(a.keyFile); err != nil {
+		return a, fmt.Errorf("invalid value for %q: %v", clientKeyFileKey, err)
+	}
+	return a, nil
+}
+
+// parseClientType parses the client type setting of the section.
+func parseClientType(section *ini.Section) (string, error) {
+	t := section.Key(clientTypeKey).MustString(clientTypeConfidential)
+	if t != clientTypeConfidential && t != clientTypePublic {
+		return t, fmt.Errorf("invalid value for %q: must be %q or %q", clientTypeKey, clientTypeConfidential, clientTypePublic)
+	}
+	return t, nil
+}
+
+// selectedClient returns the provider with the client of its client type. The client is selected by the config rather
+// than by the session, as the refresh tokens can only be used by the client they were issued to.
+func (p oidcProvider) selectedClient() oidcProvider {
+	if p.clientType != clientTypePublic {
+		return p
+	}
+	p.clientID = p.publicClientID
+	p.clientSecret = ""
+	p.secretSource = clientSecretSource{}
+	p.clientAuth = clientAuth{method: clientAuthNone}
+	return p
+}
+
+// loadClientKey returns the private key of the PEM file, and the method signing the client assertions with it.
+func loadClientKey(path string) (crypto.Signer, jwt.SigningMethod, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read the private key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no PEM encoded private key found in %q", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse the private key: %v", err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			return k, jwt.SigningMethodES256, nil
+		case 384:
+			return k, jwt.SigningMethodES384, nil
+		case 521:
+			return k, jwt.SigningMethodES512, nil
+		}
+		return nil, nil, fmt.Errorf("unsupported elliptic curve %q", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return k, jwt.SigningMethodEdDSA, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+// assertion returns a client assertion of the client, for the audience, signed with the private key. Its ID is unique,
+// as the providers may reject the assertions which are used twice.
+func (a clientAuth) assertion(clientID, audience string) (string, error) {
+	key, method, err := loadClientKey(a.keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	t := jwt.NewWithClaims(method, jwt.RegisteredClaims{
+		Issuer:    clientID,
+		Subject:   clientID,
+		Audience:  jwt.ClaimStrings{audience},
+		ID:        uuid.NewString(),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(clientAssertionLifetime)),
+	})
+	if a.keyID != "" {
+		t.Header["kid"] = a.keyID
+	}
+	return t.SignedString(key)
+}
+
+// clientConfig returns the OAuth 2.0 configuration of the client of the provider, authenticating to the endpoint the
+// way it is configured to. The audience of the access tokens is added to the scopes if the endpoint takes it as one.
+func (p oidcProvider) clientConfig(endpoint oauth2.Endpoint, scopes []string) oauth2.Config {
+	if scope := audienceScope(p.tokenAudience); p.tokenAudience != "" && audienceInScopes(endpoint) && !slices.Contains(scopes, scope) {
+		scopes = append(slices.Clip(scopes), scope)
+	}
+	c := oauth2.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		Endpoint:     endpoint,
+		Scopes:       scopes,
+	}
+	switch p.clientAuth.method {
+	case clientAuthSecretPost:
+		c.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	case clientAuthSecretBasic:
+		c.Endpoint.AuthStyle = oauth2.AuthStyleInHeader
+	case clientAuthPrivateKeyJWT:
+		// Only the client ID is sent, the client assertion is added by clientAssertionTransport.
+		c.ClientSecret = ""
+		c.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	case clientAuthNone:
+		c.ClientSecret = ""
+		c.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
+	return c
+}
+
+// newClientRequest returns a form POST request to the endpoint, authenticating as the client like the requests to the
+// token endpoint do.
+func newClientRequest(ctx context.Context, oauth2Config oauth2.Config, endpointURL string, form url.Values) (*http.Request, error) {
+	inParams := oauth2Config.ClientSecret == "" || oauth2Config.Endpoint.AuthStyle == oauth2.AuthStyleInParams
+	if inParams {
+		form.Set("client_id", oauth2Config.ClientID)
+		if oauth2Config.ClientSecret != "" {
+			form.Set("client_secret", oauth2Config.ClientSecret)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpointURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if !inParams {
+		req.SetBasicAuth(url.QueryEscape(oauth2Config.ClientID), url.QueryEscape(oauth2Config.ClientSecret))
+	}
+	return req, nil
+}
+
+// withClientAssertion returns a copy of ctx whose HTTP client adds a client assertion to the requests authenticating as
+// the client of the session, if it authenticates with private_key_jwt. The requests of the oauth2 package, e.g. to
+// refresh a token, can not be given extra parameters otherwise.
+func withClientAssertion(ctx context.Context, s *session) context.Context {
+	if s.clientAuth.method != clientAuthPrivateKeyJWT {
+		return ctx
+	}
+
+	client := *httpClientFrom(ctx)
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = clientAssertionTransport{
+		base:     base,
+		auth:     s.clientAuth,
+		clientID: s.oauth2Config.ClientID,
+		// OpenID Connect recommends the token endpoint as the audience, which the providers also accept for their
+		// other endpoints.
+		audience: s.oauth2Config.Endpoint.TokenURL,
+	}
+	return oidc.ClientContext(ctx, &client)
+}
+
+// clientAssertionTransport adds a new client assertion to each form POST request sending the client ID, which are the
+// requests authenticating as the client.
+type clientAssertionTransport struct {
+	base     http.RoundTripper
+	auth     clientAuth
+	clientID string
+	audience string
+}
+
+// RoundTrip sends the request, with a client assertion if it authenticates as the client.
+func (t clientAssertionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || req.Body == nil || req.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		return t.base.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil || form.Get("client_id") != t.clientID {
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(strings.NewReader(string(body)))
+		return t.base.RoundTrip(req)
+	}
+
+	assertion, err := t.auth.assertion(t.clientID, t.audience)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign the client assertion: %v", err)
+	}
+	form.Set("client_assertion_type", clientAssertionType)
+	form.Set("client_assertion", assertion)
+
+	encoded := form.Encode()
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(strings.NewReader(encoded))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(encoded)), nil }
+	req.ContentLength = int64(len(encoded))
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// clientSecretCommandTimeout is how long the command printing the client secret can run before it is killed.
+const clientSecretCommandTimeout = 30 * time.Second
+
+// clientSecretSource is where the client secret of a provider is read from instead of the config file, so that it does
+// not have to be written in it.
+type clientSecretSource struct {
+	// file is the path of the file holding the secret.
+	file string
+	// command is the command printing the secret, e.g. the client of a secret manager. It is not run by a shell.
+	command []string
+}
+
+// parseClientSecretSource parses the sources of the client secret of the section.
+func parseClientSecretSource(section *ini.Section) (clientSecretSource, error) {
+	s := clientSecretSource{
+		file: section.Key(clientSecretFileKey).String(),
+		// The command is not run by a shell, so its arguments are only separated by spaces.
+		command: strings.Fields(section.Key(clientSecretCommandKey).String()),
+	}
+	if s.file != "" && !filepath.IsAbs(s.file) {
+		return s, fmt.Errorf("invalid value for %q: %q is not an absolute path", clientSecretFileKey, s.file)
+	}
+	if len(s.command) > 0 && !filepath.IsAbs(s.command[0]) {
+		return s, fmt.Errorf("invalid value for %q: %q is not an absolute path", clientSecretCommandKey, s.command[0])
+	}
+	return s, nil
+}
+
+// secret returns the client secret printed by the command if one is configured, or else the one read from the file if
+// one is configured, or else the one of the config file, resolved if it is a secret reference.
+func (s clientSecretSource) secret(logger *slog.Logger, configured string) (string, error) {
+	if len(s.command) > 0 {
+		return commandSecret(clientSecretCommandKey, s.command)
+	}
+	if s.file != "" {
+		return fileSecret(logger, clientSecretFileKey, s.file)
+	}
+	return resolveSecretRef(logger, configured)
+}
+
+// commandSecret returns the secret printed by the command, without the surrounding spaces and newlines. source names
+// where the command is configured in the error messages.
+func commandSecret(source string, command []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clientSecretCommandTimeout)
+	defer cancel()
+
+	//nolint: gosec // The command is configured by the administrator.
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("the %q command %q failed: %v: %s", source, command[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	secret := strings.TrimSpace(string(out))
+	if secret == "" {
+		return "", fmt.Errorf("the %q command %q printed no secret", source, command[0])
+	}
+	return secret, nil
+}
+
+// fileSecret returns the secret read from the file, without the surrounding spaces and newlines. A warning is logged if
+// the file can be read by all the users. source names where the file is configured in the error messages.
+func fileSecret(logger *slog.Logger, source, path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read the %q file: %v", source, err)
+	}
+	if fi.Mode().Perm()&0o004 != 0 {
+		logger.Warn(fmt.Sprintf("The client secret file %q can be read by all the users, its permissions should be 0600", path))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read the %q file: %v", source, err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("the %q file %q is empty", source, path)
+	}
+	return secret, nil
+}
+
+// resolveClientSecrets replaces the client secrets of the providers by the ones read from their configured sources.
+func (uc *userConfig) resolveClientSecrets(logger *slog.Logger) (err error) {
+	// The secret of the confidential client is not read if the public one is used, as it may not be deployed then.
+	if uc.clientType != clientTypePublic {
+		if uc.clientSecret, err = uc.secretSource.secret(logger, uc.clientSecret); err != nil {
+			return err
+		}
+	}
+	for i, p := range uc.oidcProviders {
+		if p.clientType == clientTypePublic {
+			continue
+		}
+		if uc.oidcProviders[i].clientSecret, err = p.secretSource.secret(logger, p.clientSecret); err != nil {
+			return fmt.Errorf("provider %q: %w", p.name, err)
+		}
+	}
+	return nil
+}
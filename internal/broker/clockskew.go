@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// defaultAllowedClockSkew is how much the local clock can differ from the one of the provider if it is not configured.
+const defaultAllowedClockSkew = 2 * time.Minute
+
+// checkIDTokenTimes returns an error if, according to the local clock at now, the ID token expired, is not valid yet
+// or was issued in the future. The local clock can be either late or early, so the skew is allowed in both directions.
+func checkIDTokenTimes(idToken *oidc.IDToken, now time.Time, skew time.Duration) error {
+	if !idToken.Expiry.IsZero() && now.Add(-skew).After(idToken.Expiry) {
+		return fmt.Errorf("ID token expired at %s", idToken.Expiry.Format(time.RFC3339))
+	}
+
+	// The ID token does not expose when it becomes valid.
+	var c struct {
+		NotBefore *float64 `json:"nbf"`
+	}
+	if err := idToken.Claims(&c); err != nil {
+		return fmt.Errorf("could not get ID token claims: %v", err)
+	}
+	if c.NotBefore != nil {
+		if notBefore := time.Unix(int64(*c.NotBefore), 0); now.Add(skew).Before(notBefore) {
+			return fmt.Errorf("ID token is not valid before %s", notBefore.Format(time.RFC3339))
+		}
+	}
+
+	if !idToken.IssuedAt.IsZero() && now.Add(skew).Before(idToken.IssuedAt) {
+		return fmt.Errorf("ID token was issued in the future, at %s", idToken.IssuedAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -1,16 +1,30 @@
 package broker
 
 import (
+	"context"
 	"embed"
 	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
 
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker/authmodes"
+	"github.com/ubuntu/authd-oidc-brokers/internal/log"
+	"github.com/ubuntu/authd-oidc-brokers/internal/password"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"github.com/ubuntu/authd-oidc-brokers/internal/token"
+	"github.com/ubuntu/decorate"
 	"gopkg.in/ini.v1"
 )
 
@@ -24,6 +38,235 @@ const (
 	clientIDKey = "client_id"
 	// clientSecret is the optional client secret for this client.
 	clientSecret = "client_secret"
+	// clientSecretFileKey is the key in the config file for the file which the client secret is read from.
+	clientSecretFileKey = "client_secret_file"
+	// clientSecretCommandKey is the key in the config file for the command which prints the client secret.
+	clientSecretCommandKey = "client_secret_command"
+	// clientAuthKey is the key in the config file for how the broker authenticates as the client to the provider.
+	clientAuthKey = "client_auth"
+	// clientKeyFileKey is the key in the config file for the PEM file of the private key signing the client assertions.
+	clientKeyFileKey = "client_key_file"
+	// clientKeyIDKey is the key in the config file for the ID of the private key signing the client assertions.
+	clientKeyIDKey = "client_key_id"
+	// publicClientIDKey is the key in the config file for the ID of the public client of the provider, which has no
+	// secret.
+	publicClientIDKey = "public_client_id"
+	// clientTypeKey is the key in the config file for whether the broker authenticates as the confidential or as the
+	// public client of the provider.
+	clientTypeKey = "client_type"
+	// extraScopesKey is the key in the config file for the additional scopes to request, separated by commas.
+	extraScopesKey = "extra_scopes"
+	// acceptedIssuersKey is the key in the config file for the issuers of the ID tokens which are accepted besides the
+	// configured issuer, separated by commas.
+	acceptedIssuersKey = "accepted_issuers"
+	// authParamsKey is the key in the config file for the extra parameters of the authorization requests, as key=value
+	// pairs.
+	authParamsKey = "auth_params"
+	// allowedGroupsKey is the key in the config file for the groups whose members are allowed to log in.
+	allowedGroupsKey = "allowed_groups"
+	// allowedGroupsCaseSensitiveKey is the key in the config file to match the allowed groups with the exact case.
+	allowedGroupsCaseSensitiveKey = "allowed_groups_case_sensitive"
+	// adminUsersKey is the key in the config file for the users who are granted local admin rights.
+	adminUsersKey = "admin_users"
+	// adminGroupKey is the key in the config file for the local group which grants admin rights.
+	adminGroupKey = "admin_group"
+	// alwaysGroupsKey is the key in the config file for the local groups every user is added to.
+	alwaysGroupsKey = "always_groups"
+	// requiredAMRKey is the key in the config file for the authentication methods, of which the amr claim of the ID
+	// token must contain at least one.
+	requiredAMRKey = "required_amr"
+	// requiredACRKey is the key in the config file for the authentication context classes, one of which the acr claim
+	// of the ID token must be equal to.
+	requiredACRKey = "required_acr"
+	// requireVerifiedEmailKey is the key in the config file to only let the users log in if the email_verified claim of
+	// the ID token is true.
+	requireVerifiedEmailKey = "require_verified_email"
+	// allowMissingVerifiedKey is the key in the config file to let the users log in when the ID token has no
+	// email_verified claim, as some providers only issue verified addresses and omit it.
+	allowMissingVerifiedKey = "allow_missing_email_verified"
+	// authModeOrderKey is the key in the config file for the authentication modes, in the order they are offered to
+	// the users.
+	authModeOrderKey = "auth_mode_order"
+	// maxAgeKey is the key in the config file for how long ago the provider can have last authenticated the user, for
+	// the login to be allowed.
+	maxAgeKey = "max_age"
+	// offlineCredentialTTLKey is the key in the config file for how long the cached credentials can be used offline
+	// after the token expired.
+	offlineCredentialTTLKey = "offline_credential_ttl"
+	// discoveryCacheTTLKey is the key in the config file for how long the cached discovery document of the issuer is
+	// used without fetching it again.
+	discoveryCacheTTLKey = "discovery_cache_ttl"
+	// allowedClockSkewKey is the key in the config file for how much the local clock can differ from the one of the
+	// provider when checking the times of the tokens.
+	allowedClockSkewKey = "allowed_clock_skew"
+	// tokenValidationKey is the key in the config file for how the tokens obtained from the provider are validated: by
+	// verifying the signature of the ID token, or by asking the introspection endpoint of the provider.
+	tokenValidationKey = "token_validation"
+	// jwksRefreshIntervalKey is the key in the config file for how long the cached signing keys of the issuer are used
+	// without fetching them again.
+	jwksRefreshIntervalKey = "jwks_refresh_interval"
+	// jwksFileKey is the key in the config file for the local JWKS file whose keys verify the ID tokens, instead of
+	// the ones fetched from the provider.
+	jwksFileKey = "jwks_file"
+	// tokenAudienceKey is the key in the config file for the API which the access tokens are requested for, e.g.
+	// Microsoft Graph, if the provider does not issue them for it by default.
+	tokenAudienceKey = "token_audience"
+	// groupsCacheTTLKey is the key in the config file for how long the user info and groups fetched from the provider
+	// are reused for the same access token.
+	groupsCacheTTLKey = "groups_cache_ttl"
+	// onGroupFetchErrorKey is the key in the config file for what to do when the groups of the user can not be fetched
+	// from the provider.
+	onGroupFetchErrorKey = "on_group_fetch_error"
+	// groupSyncModeKey is the key in the config file for whether the groups reported to authd on login are only the
+	// current ones of the user, or also the ones of their previous logins.
+	groupSyncModeKey = "group_sync_mode"
+	// deviceAuthMaxWaitKey is the key in the config file for how long to wait at most for the user to enter the device
+	// code, if the provider lets the code be valid for longer.
+	deviceAuthMaxWaitKey = "device_auth_max_wait"
+	// pollJitterKey is the key in the config file for the random delay added to the interval at which the token
+	// endpoint is polled in the device code flow.
+	pollJitterKey = "poll_jitter"
+	// sendLoginHintKey is the key in the config file to send the username to the provider as the login hint, so that
+	// the user does not have to type it again.
+	sendLoginHintKey = "send_login_hint"
+	// disablePasswordKey is the key in the config file to never let the users authenticate with a local password, so
+	// that every login is authenticated by the provider.
+	disablePasswordKey = "disable_password"
+	// revokeOnLogoutKey is the key in the config file to revoke the refresh token when the session ends.
+	revokeOnLogoutKey = "revoke_on_logout"
+	// capabilityProbeKey is the key in the config file for whether the broker checks, when it starts, that the
+	// providers advertise the features it is configured to use.
+	capabilityProbeKey = "capability_probe"
+	// maxSessionsKey is the key in the config file for the maximum number of concurrent sessions.
+	maxSessionsKey = "max_sessions"
+	// sessionIdleTimeoutKey is the key in the config file for how long a session can be idle before it is ended.
+	sessionIdleTimeoutKey = "session_idle_timeout"
+	// stopGracePeriodKey is the key in the config file for how long to wait for the running authentications when the
+	// broker stops.
+	stopGracePeriodKey = "stop_grace_period"
+	// cacheEncryptionKey is the key in the config file for the source of the key used to encrypt the cached tokens.
+	cacheEncryptionKey = "cache_encryption"
+	// cacheEncryptionKeyFileKey is the key in the config file for the key file the cached tokens are encrypted with.
+	cacheEncryptionKeyFileKey = "cache_encryption_key_file"
+	// tokenStoreKey is the key in the config file for where the tokens of the users are stored.
+	tokenStoreKey = "token_store"
+	// defaultShellKey is the key in the config file for the shell of the users if the provider does not set one.
+	defaultShellKey = "default_shell"
+	// skelDirKey is the key in the config file for the directory whose files are copied to the home directories of the
+	// users.
+	skelDirKey = "skel_dir"
+	// onUserRemovalKey is the key in the config file for what to do with the home directory of a user whose account
+	// was removed at the provider.
+	onUserRemovalKey = "on_user_removal"
+	// userRemovalArchiveDirKey is the key in the config file for the directory where the home directories of the
+	// removed users are archived.
+	userRemovalArchiveDirKey = "user_removal_archive_dir"
+	// caCertFileKey is the key in the config file for the PEM file, or directory of PEM files, of the additional CA
+	// certificates to trust when connecting to the providers.
+	caCertFileKey = "ca_cert_file"
+	// insecureSkipVerifyKey is the key in the config file to disable the verification of the TLS certificates of the
+	// providers, for debugging.
+	insecureSkipVerifyKey = "insecure_skip_verify"
+	// minTLSVersionKey is the key in the config file for the minimum TLS version of the connections to the providers.
+	minTLSVersionKey = "min_tls_version"
+	// httpProxyKey is the key in the config file for the proxy of the requests to the providers, instead of the ones
+	// set in the environment.
+	httpProxyKey = "http_proxy"
+	// noProxyKey is the key in the config file for the hosts which are connected to without proxy, instead of the ones
+	// set in the environment.
+	noProxyKey = "no_proxy"
+	// httpTimeoutKey is the key in the config file for how long a request to the providers, including its retries, can
+	// take.
+	httpTimeoutKey = "http_timeout"
+	// httpRetriesKey is the key in the config file for how many times the idempotent requests to the providers are
+	// retried after a transient error.
+	httpRetriesKey = "http_retries"
+	// providerTypeKey is the key in the config file for the provider implementation to use, instead of selecting it from
+	// the issuer.
+	providerTypeKey = "provider_type"
+	// gitlabFullGroupPathsKey is the key in the config file to name the GitLab groups after their full path.
+	gitlabFullGroupPathsKey = "gitlab_full_group_paths"
+	// pingGroupsClaimKey is the key in the config file for the claim listing the groups of the Ping Identity users.
+	pingGroupsClaimKey = "ping_groups_claim"
+	// googleDirectoryGroupsKey is the key in the config file to fetch the groups of the Google users from the Directory
+	// API.
+	googleDirectoryGroupsKey = "google_directory_groups"
+	// nestedGroupsMaxDepthKey is the key in the config file for how many levels of parent groups are followed to get the
+	// groups the users are members of through other groups.
+	nestedGroupsMaxDepthKey = "nested_groups_max_depth"
+	// usernameClaimKey is the key in the config file for the claim of the ID token which the local username is read
+	// from.
+	usernameClaimKey = "username_claim"
+	// usernameStripDomainKey is the key in the config file to remove the domain part of the username read from the
+	// username claim.
+	usernameStripDomainKey = "username_strip_domain"
+	// groupsClaimKey is the key in the config file for the claim listing the groups of the users.
+	groupsClaimKey = "groups_claim"
+	// groupScopeKey is the key in the config file for where the groups claim is read from: the ID token or the
+	// userinfo endpoint.
+	groupScopeKey = "group_scope"
+	// groupsClaimNameFieldKey is the key in the config file for the field holding the group name, when the groups
+	// claim lists objects.
+	groupsClaimNameFieldKey = "groups_claim_name_field"
+	// groupNameTemplateKey is the key in the config file for the template of the local names of the groups returned by
+	// the provider. Setting it enables the normalization of the group names.
+	groupNameTemplateKey = "group_name_template"
+	// groupNameSeparatorKey is the key in the config file for the string replacing the spaces of the group names.
+	groupNameSeparatorKey = "group_name_separator"
+	// defaultProviderKey is the key in the config file for the named provider which authenticates the users whose
+	// domain is not configured for any provider.
+	defaultProviderKey = "default_provider"
+	// domainsKey is the key in the named provider sections for the domains of the users it authenticates, separated by
+	// commas.
+	domainsKey = "domains"
+	// shellForGroupKeyPrefix is the prefix of the keys in the config file which override the default shell for the
+	// members of a group, e.g. "shell_for_group.developers".
+	shellForGroupKeyPrefix = "shell_for_group."
+
+	// defaultAdminGroup is the local group added to the admin users if none is configured.
+	defaultAdminGroup = "sudo"
+	// defaultGroupNameSeparator replaces the spaces of the group names if no separator is configured.
+	defaultGroupNameSeparator = "_"
+
+	// cacheEncryptionNone stores the cached tokens in plaintext, only protected by the file permissions.
+	cacheEncryptionNone = "none"
+	// cacheEncryptionMachineID encrypts the cached tokens with a key derived from the machine ID. As the machine ID is
+	// world-readable, it only prevents the tokens from being used on another machine, not from being read locally.
+	cacheEncryptionMachineID = "machine-id"
+	// cacheEncryptionKeyFile encrypts the cached tokens with a key derived from a key file which only the broker can read,
+	// e.g. a systemd credential encrypted with the TPM.
+	cacheEncryptionKeyFile = "key-file"
+	// cacheEncryptionTPM is not supported: the broker does not seal the key with the TPM itself, systemd does it for the
+	// key file.
+	cacheEncryptionTPM = "tpm"
+
+	// tokenStoreFile stores the tokens in the data directory, so that the users can log in offline.
+	tokenStoreFile = "file"
+	// tokenStoreMemory keeps the tokens in memory only, so that none is written to the disk. They are lost when the
+	// broker stops.
+	tokenStoreMemory = "memory"
+
+	// userRemovalKeep keeps the home directory of the removed users as it is.
+	userRemovalKeep = "keep"
+	// userRemovalArchive archives the home directory of the removed users to a tarball, then deletes it.
+	userRemovalArchive = "archive"
+	// userRemovalDelete deletes the home directory of the removed users.
+	userRemovalDelete = "delete"
+
+	// groupFetchErrorDeny denies the login if the groups of the user can not be fetched.
+	groupFetchErrorDeny = "deny"
+	// groupFetchErrorCached logs the user in with the groups stored with their token at their previous login.
+	groupFetchErrorCached = "cached"
+	// groupFetchErrorMinimal logs the user in without any of their groups from the provider, only with the groups every
+	// user is added to.
+	groupFetchErrorMinimal = "minimal"
+
+	// groupSyncAuthoritative reports the groups the user is currently a member of, so that authd removes the user from
+	// the groups they were removed from at the provider.
+	groupSyncAuthoritative = "authoritative"
+	// groupSyncAdditive also reports the groups of the previous logins of the user, so that the user is only ever added
+	// to groups.
+	groupSyncAdditive = "additive"
 
 	// usersSection is the section name in the config file for the users and broker specific configuration.
 	usersSection = "users"
@@ -33,8 +276,62 @@ const (
 	ownerKey = "owner"
 	// homeDirKey is the key in the config file for the home directory prefix.
 	homeDirKey = "home_base_dir"
+	// homeDirTemplateKey is the key in the config file for the template of the home directories, relative to the home
+	// directory prefix.
+	homeDirTemplateKey = "home_dir_template"
 	// SSHSuffixKey is the key in the config file for the SSH allowed suffixes.
 	sshSuffixesKey = "ssh_allowed_suffixes"
+	// uidRangeKey is the key in the config file for the range of the UIDs assigned to the users.
+	uidRangeKey = "uid_range"
+	// gidRangeKey is the key in the config file for the range of the GIDs assigned to the groups of the provider.
+	gidRangeKey = "gid_range"
+	// usernameCollisionKey is the key in the config file for what to do when a user has the username of another user.
+	usernameCollisionKey = "username_collision"
+
+	// authdSection is the section name in the config file for the settings of the broker daemon.
+	authdSection = "authd"
+	// logLevelKey is the key in the config file for the minimum level of the logged messages.
+	logLevelKey = "log_level"
+	// logFormatKey is the key in the config file for the output format of the logs.
+	logFormatKey = "log_format"
+	// persistSessionsKey is the key in the config file to restore the sessions when the broker restarts.
+	persistSessionsKey = "persist_sessions"
+	// auditLogKey is the key in the config file for the file where the authorization decisions are recorded.
+	auditLogKey = "audit_log"
+	// auditLogMaxSizeKey is the key in the config file for the size, in megabytes, above which the audit log is
+	// rotated.
+	auditLogMaxSizeKey = "audit_log_max_size"
+	// auditLogMaxFilesKey is the key in the config file for how many rotated audit logs are kept.
+	auditLogMaxFilesKey = "audit_log_max_files"
+
+	// passwordSection is the section name in the config file for the policy of the local passwords.
+	passwordSection = "password"
+	// minLengthKey is the key in the config file for the minimum length of the local passwords.
+	minLengthKey = "min_length"
+	// requiredCharacterClassesKey is the key in the config file for the character classes the local passwords must
+	// contain.
+	requiredCharacterClassesKey = "required_character_classes"
+	// disallowReuseKey is the key in the config file to reject setting the previous local password again.
+	disallowReuseKey = "disallow_reuse"
+	// maxFailedAttemptsKey is the key in the config file for the number of failed attempts to enter the local password
+	// after which the user is locked out.
+	maxFailedAttemptsKey = "max_failed_attempts"
+	// failedAttemptsWindowKey is the key in the config file for the period within which the failed attempts are counted.
+	failedAttemptsWindowKey = "failed_attempts_window"
+	// lockoutDurationKey is the key in the config file for how long a user is locked out the first time.
+	lockoutDurationKey = "lockout_duration"
+
+	// hooksSection is the section name in the config file for the commands run at the steps of the lifecycle of the
+	// users.
+	hooksSection = "hooks"
+	// onFirstLoginKey is the key in the config file for the command run when a user logs in for the first time.
+	onFirstLoginKey = "on_first_login"
+	// onLoginKey is the key in the config file for the command run every time a user logs in.
+	onLoginKey = "on_login"
+	// hookTimeoutKey is the key in the config file for how long the hook commands can run before they are killed.
+	hookTimeoutKey = "timeout"
+	// blockLoginOnHookFailureKey is the key in the config file to deny the login if a login hook command fails.
+	blockLoginOnHookFailureKey = "block_login_on_failure"
 
 	// allUsersKeyword is the keyword for the `allowed_users` key that allows access to all users.
 	allUsersKeyword = "ALL"
@@ -47,6 +344,11 @@ const (
 )
 
 var (
+	// shellsFile is the file listing the valid login shells.
+	shellsFile = "/etc/shells"
+	// machineIDFile is the file containing the machine ID, from which the cache encryption key can be derived.
+	machineIDFile = "/etc/machine-id"
+
 	//go:embed templates/20-owner-autoregistration.conf.tmpl
 	ownerAutoRegistrationConfig embed.FS
 )
@@ -59,10 +361,142 @@ type templateEnv struct {
 	Owner string
 }
 
-type userConfig struct {
+// oidcProvider is the configuration of an identity provider.
+type oidcProvider struct {
+	// name is the name of the [oidc "name"] section, or empty for the [oidc] section.
+	name         string
+	issuerURL    string
 	clientID     string
 	clientSecret string
-	issuerURL    string
+	clientAuth   clientAuth
+	extraScopes  []string
+	// acceptedIssuers are the issuers of the ID tokens which are accepted besides issuerURL.
+	acceptedIssuers []string
+	// authParams are the extra parameters of the authorization requests.
+	authParams map[string]string
+	// domains are the lowercase domains of the usernames which are authenticated by this provider.
+	domains []string
+	// secretSource is where clientSecret is read from when the broker starts, if not from the config file.
+	secretSource clientSecretSource
+	// jwksFile is the JWKS file verifying the signatures of the ID tokens, if they are not verified with the keys
+	// fetched from the provider.
+	jwksFile string
+	// tokenAudience is the API which the access tokens are requested for, if not the default one of the provider.
+	tokenAudience string
+	// publicClientID is the ID of the public client, which the broker authenticates as instead of clientID if
+	// clientType is public.
+	publicClientID string
+	// clientType is one of the client type values, selecting the client the broker authenticates as.
+	clientType string
+	// providerType is one of the provider types, or empty to select the provider-specific implementation from the
+	// issuer.
+	providerType string
+	// provider is the provider-specific implementation of the identity provider.
+	provider providers.Provider
+}
+
+type userConfig struct {
+	clientID        string
+	clientSecret    string
+	secretSource    clientSecretSource
+	clientAuth      clientAuth
+	issuerURL       string
+	extraScopes     []string
+	acceptedIssuers []string
+	authParams      map[string]string
+	jwksFile        string
+	tokenAudience   string
+	publicClientID  string
+	clientType      string
+
+	oidcProviders   []oidcProvider
+	defaultProvider string
+	providerType    string
+	// sectionProvider is the provider-specific implementation of the provider of the [oidc] section.
+	sectionProvider providers.Provider
+
+	usernameClaim        string
+	usernameStripDomain  bool
+	groupsClaim          string
+	groupScope           string
+	tokenValidation      string
+	groupsClaimNameField string
+
+	gitlabFullGroupPaths  bool
+	pingGroupsClaim       string
+	googleDirectoryGroups bool
+	nestedGroupsMaxDepth  int
+
+	groupNameTemplate  string
+	groupNameSeparator string
+
+	allowedGroups              map[string]struct{}
+	allowedGroupsCaseSensitive bool
+
+	adminUsers   map[string]struct{}
+	ownerIsAdmin bool
+	adminGroup   string
+
+	alwaysGroups []string
+
+	requiredAMR []string
+	requiredACR []string
+	maxAge      time.Duration
+
+	requireVerifiedEmail bool
+	allowMissingVerified bool
+
+	authModeOrder []string
+
+	offlineCredentialTTL    time.Duration
+	hasOfflineCredentialTTL bool
+	discoveryCacheTTL       time.Duration
+	jwksRefreshInterval     time.Duration
+	groupsCacheTTL          time.Duration
+	onGroupFetchError       string
+	groupSyncMode           string
+	allowedClockSkew        time.Duration
+	deviceAuthMaxWait       time.Duration
+	pollJitter              time.Duration
+	revokeOnLogout          bool
+	sendLoginHint           bool
+	disablePassword         bool
+	capabilityProbe         string
+	cacheEncryption         string
+	cacheEncryptionKeyFile  string
+	tokenStore              string
+	skelDir                 string
+	onUserRemoval           string
+	userRemovalArchiveDir   string
+	caCertFile              string
+	insecureSkipVerify      bool
+	minTLSVersion           uint16
+	httpProxy               string
+	noProxy                 string
+	httpTimeout             time.Duration
+	httpRetries             int
+
+	maxSessions        int
+	sessionIdleTimeout time.Duration
+	stopGracePeriod    time.Duration
+	persistSessions    bool
+
+	auditLog         string
+	auditLogMaxSize  int
+	auditLogMaxFiles int
+
+	defaultShell string
+	groupShells  map[string]string
+
+	passwordPolicy       password.Policy
+	maxFailedAttempts    int
+	failedAttemptsWindow time.Duration
+	lockoutDuration      time.Duration
+
+	onFirstLogin            []string
+	onLogin                 []string
+	hookTimeout             time.Duration
+	blockLoginOnHookFailure bool
 
 	allowedUsers          map[string]struct{}
 	allUsersAllowed       bool
@@ -71,16 +505,58 @@ type userConfig struct {
 	owner                 string
 	ownerMutex            *sync.RWMutex
 	homeBaseDir           string
+	homeDirTemplate       string
 	allowedSSHSuffixes    []string
+	uidMin                uint32
+	uidMax                uint32
+	gidMin                uint32
+	gidMax                uint32
+	usernameCollision     string
+
+	// settings are the values of the keys of the config file, by "[section] key", to tell which ones changed when the
+	// config is reloaded.
+	settings map[string]string
 
 	provider provider
 }
 
 // GetDropInDir takes the broker configuration path and returns the drop in dir path.
+// If the configuration path is a directory, it is its own drop in dir.
 func GetDropInDir(cfgPath string) string {
+	if isConfigDir(cfgPath) {
+		return cfgPath
+	}
 	return cfgPath + ".d"
 }
 
+// isConfigDir returns true if the broker configuration path is a directory of configuration files.
+func isConfigDir(cfgPath string) bool {
+	fi, err := os.Stat(cfgPath)
+	return err == nil && fi.IsDir()
+}
+
+// getConfigDirFiles returns the paths to the *.conf files in the configuration directory, in lexical order.
+func getConfigDirFiles(cfgDir string) ([]any, error) {
+	files, err := os.ReadDir(cfgDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfgFiles []any
+	// os.ReadDir returns the entries sorted by filename.
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".conf" {
+			continue
+		}
+		cfgFiles = append(cfgFiles, filepath.Join(cfgDir, file.Name()))
+	}
+	if len(cfgFiles) == 0 {
+		return nil, fmt.Errorf("no configuration files found in %q", cfgDir)
+	}
+
+	return cfgFiles, nil
+}
+
 func getDropInFiles(cfgPath string) ([]any, error) {
 	// Check if a .d directory exists and return the paths to the files in it.
 	dropInDir := GetDropInDir(cfgPath)
@@ -104,7 +580,280 @@ func getDropInFiles(cfgPath string) ([]any, error) {
 	return dropInFiles, nil
 }
 
-func (uc *userConfig) populateUsersConfig(users *ini.Section) {
+// tokenKeySource returns the source of the key used to encrypt the cached tokens, or nil if they are not encrypted.
+func (uc userConfig) tokenKeySource() token.KeySource {
+	switch uc.cacheEncryption {
+	case cacheEncryptionMachineID:
+		return token.MachineIDKeySource{Path: machineIDFile}
+	case cacheEncryptionKeyFile:
+		return token.FileKeySource{Path: uc.cacheEncryptionKeyFile}
+	default:
+		return nil
+	}
+}
+
+// populateShellsConfig parses the default shell and the per group shell overrides, and checks that they are valid
+// login shells.
+func (uc *userConfig) populateShellsConfig(oidc *ini.Section) error {
+	if !oidc.HasKey(defaultShellKey) && !slices.ContainsFunc(oidc.KeyStrings(), isShellForGroupKey) {
+		return nil
+	}
+
+	validShells, err := readValidShells()
+	if err != nil {
+		return err
+	}
+
+	if oidc.HasKey(defaultShellKey) {
+		uc.defaultShell = oidc.Key(defaultShellKey).String()
+		if _, ok := validShells[uc.defaultShell]; !ok {
+			return fmt.Errorf("invalid value for %q: %q is not listed in %s", defaultShellKey, uc.defaultShell, shellsFile)
+		}
+	}
+
+	for _, key := range oidc.Keys() {
+		group, ok := strings.CutPrefix(key.Name(), shellForGroupKeyPrefix)
+		if !ok {
+			continue
+		}
+		if group == "" {
+			return fmt.Errorf("invalid key %q: missing group name", key.Name())
+		}
+		shell := key.String()
+		if _, ok := validShells[shell]; !ok {
+			return fmt.Errorf("invalid value for %q: %q is not listed in %s", key.Name(), shell, shellsFile)
+		}
+		if uc.groupShells == nil {
+			uc.groupShells = make(map[string]string)
+		}
+		uc.groupShells[strings.ToLower(group)] = shell
+	}
+
+	return nil
+}
+
+// isShellForGroupKey returns true if the key overrides the shell of the members of a group.
+func isShellForGroupKey(key string) bool {
+	return strings.HasPrefix(key, shellForGroupKeyPrefix)
+}
+
+// readValidShells returns the login shells listed in the shells file.
+func readValidShells() (map[string]struct{}, error) {
+	content, err := os.ReadFile(shellsFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the valid login shells: %v", err)
+	}
+
+	shells := make(map[string]struct{})
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		shells[line] = struct{}{}
+	}
+	return shells, nil
+}
+
+// shellFor returns the configured shell for a user who is a member of the given groups. The override of the first
+// group of the user which has one takes precedence over the default shell. It returns an empty string if no shell is
+// configured.
+func (uc userConfig) shellFor(groups []info.Group) string {
+	for _, group := range groups {
+		if shell, ok := uc.groupShells[strings.ToLower(group.Name)]; ok {
+			return shell
+		}
+	}
+	return uc.defaultShell
+}
+
+// populateGroupNamesConfig parses the template and the separator of the local group names.
+func (uc *userConfig) populateGroupNamesConfig(oidc *ini.Section) error {
+	if oidc.HasKey(groupNameTemplateKey) {
+		uc.groupNameTemplate = oidc.Key(groupNameTemplateKey).String()
+		if err := validateGroupNameTemplate(uc.groupNameTemplate); err != nil {
+			return fmt.Errorf("invalid value for %q: %v", groupNameTemplateKey, err)
+		}
+	}
+
+	uc.groupNameSeparator = defaultGroupNameSeparator
+	if oidc.HasKey(groupNameSeparatorKey) {
+		uc.groupNameSeparator = oidc.Key(groupNameSeparatorKey).String()
+		for _, r := range uc.groupNameSeparator {
+			if isNotGroupNameChar(r) {
+				return fmt.Errorf("invalid value for %q: character %q is not allowed in group names", groupNameSeparatorKey, r)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isNotGroupNameChar returns true if r is not allowed in the local group names, which only contain lowercase ASCII
+// letters, digits, underscores, hyphens and dots.
+func isNotGroupNameChar(r rune) bool {
+	return (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' && r != '-' && r != '.'
+}
+
+// validateGroupNameTemplate returns an error if the group name template does not contain the group name, or if it
+// would add characters which are not allowed in the local group names.
+func validateGroupNameTemplate(template string) error {
+	var hasGroupName bool
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			if isNotGroupNameChar(rune(template[i])) {
+				return fmt.Errorf("character %q is not allowed in group names", template[i])
+			}
+			continue
+		}
+		i++
+		if i == len(template) {
+			return errors.New("ends with an incomplete placeholder")
+		}
+		switch template[i] {
+		case 'g':
+			hasGroupName = true
+		default:
+			return fmt.Errorf("unknown placeholder %%%c", template[i])
+		}
+	}
+	if !hasGroupName {
+		return errors.New("must contain the %g placeholder")
+	}
+
+	return nil
+}
+
+// groupName returns the local name of the group named name by the provider. If a group name template is configured,
+// the name is lowercased, its spaces are replaced by the separator, the characters which are not allowed in the local
+// group names are removed and the result replaces %g in the template. It returns an empty string if no character of
+// the name is allowed.
+func (uc userConfig) groupName(name string) string {
+	if uc.groupNameTemplate == "" {
+		return name
+	}
+
+	var normalized strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case unicode.IsSpace(r):
+			normalized.WriteString(uc.groupNameSeparator)
+		case !isNotGroupNameChar(r):
+			normalized.WriteRune(r)
+		}
+	}
+	if normalized.Len() == 0 {
+		return ""
+	}
+
+	return strings.ReplaceAll(uc.groupNameTemplate, "%g", normalized.String())
+}
+
+// validateHomeDirTemplate returns an error if the home directory template is not a relative path which is unique per
+// user and stays within the home directory prefix.
+func validateHomeDirTemplate(template string) error {
+	if filepath.IsAbs(template) {
+		return errors.New("must be relative to the home directory prefix")
+	}
+	for _, elem := range strings.Split(template, "/") {
+		if elem == ".." {
+			return errors.New("must not contain \"..\"")
+		}
+	}
+
+	var hasUsername bool
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			continue
+		}
+		i++
+		if i == len(template) {
+			return errors.New("ends with an incomplete placeholder")
+		}
+		switch template[i] {
+		case 'u':
+			hasUsername = true
+		case 'd', 'i', '%':
+		default:
+			return fmt.Errorf("unknown placeholder %%%c", template[i])
+		}
+	}
+	if !hasUsername {
+		return errors.New("must contain the %u placeholder")
+	}
+
+	return nil
+}
+
+// parseAcceptedIssuers returns the accepted issuers of the section, which may contain the tenant ID placeholder.
+func parseAcceptedIssuers(section *ini.Section) ([]string, error) {
+	var issuers []string
+	for _, issuer := range section.Key(acceptedIssuersKey).Strings(",") {
+		if issuer == "" {
+			continue
+		}
+		if err := validateAcceptedIssuer(issuer); err != nil {
+			return nil, fmt.Errorf("invalid value for %q: %v", acceptedIssuersKey, err)
+		}
+		issuers = append(issuers, issuer)
+	}
+	return issuers, nil
+}
+
+// reservedAuthParams are the parameters of the authorization requests which are set by the broker, and which can not be
+// overridden by the extra ones.
+var reservedAuthParams = []string{"client_id", "client_secret", "scope"}
+
+// parseAuthParams returns the extra parameters of the authorization requests of the section, from its key=value pairs.
+func parseAuthParams(section *ini.Section) (map[string]string, error) {
+	var params map[string]string
+	for _, pair := range section.Key(authParamsKey).Strings(",") {
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("invalid value for %q: %q is not a key=value pair", authParamsKey, pair)
+		}
+		if slices.Contains(reservedAuthParams, k) {
+			return nil, fmt.Errorf("invalid value for %q: %q is set by the broker", authParamsKey, k)
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[k] = v
+	}
+	return params, nil
+}
+
+// expandHomeDirTemplate replaces the placeholders of the home directory template: %u by the username, %d by the
+// domain of the username, %i by the host of the issuer and %% by %.
+func expandHomeDirTemplate(template, username, issuerHost string) string {
+	_, domain, _ := strings.Cut(username, "@")
+
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' || i+1 == len(template) {
+			b.WriteByte(template[i])
+			continue
+		}
+		i++
+		switch template[i] {
+		case 'u':
+			b.WriteString(username)
+		case 'd':
+			b.WriteString(domain)
+		case 'i':
+			b.WriteString(issuerHost)
+		default:
+			b.WriteByte(template[i])
+		}
+	}
+	return b.String()
+}
+
+func (uc *userConfig) populateUsersConfig(users *ini.Section) error {
 	uc.ownerMutex.Lock()
 	defer uc.ownerMutex.Unlock()
 
@@ -112,11 +861,37 @@ func (uc *userConfig) populateUsersConfig(users *ini.Section) {
 		// The default behavior is to allow only the owner
 		uc.ownerAllowed = true
 		uc.firstUserBecomesOwner = true
-		return
+		return nil
 	}
 
 	uc.homeBaseDir = users.Key(homeDirKey).String()
+	uc.homeDirTemplate = users.Key(homeDirTemplateKey).String()
+	if uc.homeDirTemplate != "" {
+		if err := validateHomeDirTemplate(uc.homeDirTemplate); err != nil {
+			return fmt.Errorf("invalid value for %q: %v", homeDirTemplateKey, err)
+		}
+	}
 	uc.allowedSSHSuffixes = strings.Split(users.Key(sshSuffixesKey).String(), ",")
+	if users.HasKey(uidRangeKey) {
+		minUID, maxUID, err := parseIDRange(users.Key(uidRangeKey).String(), "UID")
+		if err != nil {
+			return fmt.Errorf("invalid value for %q: %v", uidRangeKey, err)
+		}
+		uc.uidMin, uc.uidMax = minUID, maxUID
+	}
+	if users.HasKey(gidRangeKey) {
+		minGID, maxGID, err := parseIDRange(users.Key(gidRangeKey).String(), "GID")
+		if err != nil {
+			return fmt.Errorf("invalid value for %q: %v", gidRangeKey, err)
+		}
+		uc.gidMin, uc.gidMax = minGID, maxGID
+	}
+	if users.HasKey(usernameCollisionKey) {
+		uc.usernameCollision = users.Key(usernameCollisionKey).String()
+		if uc.usernameCollision != usernameCollisionReject && uc.usernameCollision != usernameCollisionSuffix {
+			return fmt.Errorf("invalid value for %q: must be %q or %q", usernameCollisionKey, usernameCollisionReject, usernameCollisionSuffix)
+		}
+	}
 
 	if uc.allowedUsers == nil {
 		uc.allowedUsers = make(map[string]struct{})
@@ -147,20 +922,47 @@ func (uc *userConfig) populateUsersConfig(users *ini.Section) {
 	// We need to read the owner key after we call HasKey, because the key is created
 	// when we call the "Key" function and we can't distinguish between empty and unset.
 	uc.owner = uc.provider.NormalizeUsername(users.Key(ownerKey).String())
+
+	return nil
 }
 
-// parseConfigFile parses the config file and returns a map with the configuration keys and values.
-func parseConfigFile(cfgPath string, p provider) (userConfig, error) {
-	cfg := userConfig{provider: p, ownerMutex: &sync.RWMutex{}}
+// loadConfigFile loads the config file with its drop-in files and expands the environment variables in the values.
+// If cfgPath is a directory, all the *.conf files in it are merged in lexical order instead.
+func loadConfigFile(cfgPath string) (*ini.File, error) {
+	var cfgFiles []any
+	var err error
+	if isConfigDir(cfgPath) {
+		cfgFiles, err = getConfigDirFiles(cfgPath)
+	} else {
+		cfgFiles, err = getDropInFiles(cfgPath)
+		cfgFiles = append([]any{cfgPath}, cfgFiles...)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	dropInFiles, err := getDropInFiles(cfgPath)
+	// Later files override the keys of the earlier ones, section by section.
+	iniCfg, err := ini.LoadSources(ini.LoadOptions{}, cfgFiles[0], cfgFiles[1:]...)
 	if err != nil {
-		return cfg, err
+		return nil, err
+	}
+	if err := restoreSecretRefs(iniCfg, cfgFiles); err != nil {
+		return nil, err
 	}
 
-	iniCfg, err := ini.Load(cfgPath, dropInFiles...)
+	// Expand the environment variables referenced in the values.
+	for _, section := range iniCfg.Sections() {
+		for _, key := range section.Keys() {
+			v, expandErr := expandEnv(key.Value())
+			if expandErr != nil {
+				err = errors.Join(err, fmt.Errorf("section %q, key %q: %w", section.Name(), key.Name(), expandErr))
+				continue
+			}
+			key.SetValue(v)
+		}
+	}
 	if err != nil {
-		return cfg, err
+		return nil, fmt.Errorf("could not expand environment variables in config file %q:\n%w", cfgPath, err)
 	}
 
 	// Check if any of the keys still contain the placeholders.
@@ -172,21 +974,978 @@ func parseConfigFile(cfgPath string, p provider) (userConfig, error) {
 		}
 	}
 	if err != nil {
-		return cfg, fmt.Errorf("config file has invalid values, did you edit the file %q?\n%w", cfgPath, err)
+		return nil, fmt.Errorf("config file has invalid values, did you edit the file %q?\n%w", cfgPath, err)
+	}
+
+	return iniCfg, nil
+}
+
+// parseConfigFile parses the config file and returns a map with the configuration keys and values.
+// If cfgPath is a directory, all the *.conf files in it are merged in lexical order instead.
+func parseConfigFile(cfgPath string, p provider) (userConfig, error) {
+	cfg := userConfig{
+		provider:            p,
+		ownerMutex:          &sync.RWMutex{},
+		allowedClockSkew:    defaultAllowedClockSkew,
+		hookTimeout:         defaultHookTimeout,
+		jwksRefreshInterval: defaultJWKSRefreshInterval,
+		httpRetries:         defaultHTTPRetries,
+		groupsCacheTTL:      defaultGroupsCacheTTL,
+		stopGracePeriod:     defaultStopGracePeriod,
+		auditLogMaxSize:     defaultAuditLogMaxSize,
+		auditLogMaxFiles:    defaultAuditLogMaxFiles,
+	}
+
+	iniCfg, err := loadConfigFile(cfgPath)
+	if err != nil {
+		return cfg, err
 	}
+	cfg.settings = configSettings(iniCfg)
 
 	oidc := iniCfg.Section(oidcSection)
 	if oidc != nil {
 		cfg.issuerURL = oidc.Key(issuerKey).String()
 		cfg.clientID = oidc.Key(clientIDKey).String()
 		cfg.clientSecret = oidc.Key(clientSecret).String()
+		if cfg.secretSource, err = parseClientSecretSource(oidc); err != nil {
+			return cfg, err
+		}
+		cfg.publicClientID = oidc.Key(publicClientIDKey).String()
+		if cfg.clientType, err = parseClientType(oidc); err != nil {
+			return cfg, err
+		}
+		// The private key of the confidential client may not be deployed if the public one is used.
+		if cfg.clientType != clientTypePublic {
+			if cfg.clientAuth, err = parseClientAuth(oidc); err != nil {
+				return cfg, err
+			}
+		}
+		if cfg.jwksFile, err = parseJWKSFile(oidc); err != nil {
+			return cfg, err
+		}
+		cfg.tokenAudience = oidc.Key(tokenAudienceKey).String()
+		cfg.extraScopes = oidc.Key(extraScopesKey).Strings(",")
+		if cfg.acceptedIssuers, err = parseAcceptedIssuers(oidc); err != nil {
+			return cfg, err
+		}
+		if cfg.authParams, err = parseAuthParams(oidc); err != nil {
+			return cfg, err
+		}
+		cfg.defaultProvider = oidc.Key(defaultProviderKey).String()
+		if cfg.providerType, err = parseProviderType(oidc); err != nil {
+			return cfg, err
+		}
+		if oidc.HasKey(gitlabFullGroupPathsKey) {
+			cfg.gitlabFullGroupPaths, err = oidc.Key(gitlabFullGroupPathsKey).Bool()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", gitlabFullGroupPathsKey, err)
+			}
+		}
+		if oidc.HasKey(pingGroupsClaimKey) {
+			cfg.pingGroupsClaim = oidc.Key(pingGroupsClaimKey).String()
+			if cfg.pingGroupsClaim == "" {
+				return cfg, fmt.Errorf("invalid value for %q: must not be empty", pingGroupsClaimKey)
+			}
+		}
+		if oidc.HasKey(googleDirectoryGroupsKey) {
+			cfg.googleDirectoryGroups, err = oidc.Key(googleDirectoryGroupsKey).Bool()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", googleDirectoryGroupsKey, err)
+			}
+		}
+		if oidc.HasKey(nestedGroupsMaxDepthKey) {
+			cfg.nestedGroupsMaxDepth, err = oidc.Key(nestedGroupsMaxDepthKey).Int()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", nestedGroupsMaxDepthKey, err)
+			}
+			if cfg.nestedGroupsMaxDepth < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", nestedGroupsMaxDepthKey)
+			}
+		}
+		if oidc.HasKey(usernameClaimKey) {
+			cfg.usernameClaim = oidc.Key(usernameClaimKey).String()
+			if cfg.usernameClaim == "" {
+				return cfg, fmt.Errorf("invalid value for %q: must not be empty", usernameClaimKey)
+			}
+		}
+		if oidc.HasKey(usernameStripDomainKey) {
+			cfg.usernameStripDomain, err = oidc.Key(usernameStripDomainKey).Bool()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", usernameStripDomainKey, err)
+			}
+		}
+		if oidc.HasKey(groupsClaimKey) {
+			cfg.groupsClaim = oidc.Key(groupsClaimKey).String()
+			if cfg.groupsClaim == "" {
+				return cfg, fmt.Errorf("invalid value for %q: must not be empty", groupsClaimKey)
+			}
+		}
+		cfg.groupScope = oidc.Key(groupScopeKey).MustString(groupScopeIDToken)
+		if cfg.groupScope != groupScopeIDToken && cfg.groupScope != groupScopeUserInfo {
+			return cfg, fmt.Errorf("invalid value for %q: must be %q or %q", groupScopeKey, groupScopeIDToken, groupScopeUserInfo)
+		}
+		cfg.groupsClaimNameField = oidc.Key(groupsClaimNameFieldKey).MustString(defaultGroupsClaimNameField)
+		cfg.tokenValidation = oidc.Key(tokenValidationKey).MustString(tokenValidationJWT)
+		if cfg.tokenValidation != tokenValidationJWT && cfg.tokenValidation != tokenValidationIntrospection {
+			return cfg, fmt.Errorf("invalid value for %q: must be %q or %q", tokenValidationKey, tokenValidationJWT, tokenValidationIntrospection)
+		}
+
+		if err := cfg.populateGroupNamesConfig(oidc); err != nil {
+			return cfg, err
+		}
+
+		if oidc.HasKey(allowedGroupsCaseSensitiveKey) {
+			cfg.allowedGroupsCaseSensitive, err = oidc.Key(allowedGroupsCaseSensitiveKey).Bool()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", allowedGroupsCaseSensitiveKey, err)
+			}
+		}
+		for _, group := range oidc.Key(allowedGroupsKey).Strings(",") {
+			if cfg.allowedGroups == nil {
+				cfg.allowedGroups = make(map[string]struct{})
+			}
+			if !cfg.allowedGroupsCaseSensitive {
+				group = strings.ToLower(group)
+			}
+			cfg.allowedGroups[group] = struct{}{}
+		}
+
+		for _, user := range oidc.Key(adminUsersKey).Strings(",") {
+			if user == ownerUserKeyword {
+				cfg.ownerIsAdmin = true
+				continue
+			}
+			if cfg.adminUsers == nil {
+				cfg.adminUsers = make(map[string]struct{})
+			}
+			cfg.adminUsers[cfg.provider.NormalizeUsername(user)] = struct{}{}
+		}
+		cfg.adminGroup = oidc.Key(adminGroupKey).MustString(defaultAdminGroup)
+
+		for _, group := range oidc.Key(alwaysGroupsKey).Strings(",") {
+			for _, r := range group {
+				if isNotGroupNameChar(r) {
+					return cfg, fmt.Errorf("invalid value for %q: character %q of group %q is not allowed in group names", alwaysGroupsKey, r, group)
+				}
+			}
+			if group != "" && !slices.Contains(cfg.alwaysGroups, group) {
+				cfg.alwaysGroups = append(cfg.alwaysGroups, group)
+			}
+		}
+
+		cfg.requiredAMR = slices.DeleteFunc(oidc.Key(requiredAMRKey).Strings(","), func(s string) bool { return s == "" })
+		cfg.requiredACR = slices.DeleteFunc(oidc.Key(requiredACRKey).Strings(","), func(s string) bool { return s == "" })
+		if oidc.HasKey(maxAgeKey) {
+			cfg.maxAge, err = oidc.Key(maxAgeKey).Duration()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", maxAgeKey, err)
+			}
+			if cfg.maxAge < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", maxAgeKey)
+			}
+		}
+		if oidc.HasKey(requireVerifiedEmailKey) {
+			cfg.requireVerifiedEmail, err = oidc.Key(requireVerifiedEmailKey).Bool()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", requireVerifiedEmailKey, err)
+			}
+		}
+		if oidc.HasKey(allowMissingVerifiedKey) {
+			cfg.allowMissingVerified, err = oidc.Key(allowMissingVerifiedKey).Bool()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", allowMissingVerifiedKey, err)
+			}
+		}
+
+		if oidc.HasKey(offlineCredentialTTLKey) {
+			cfg.offlineCredentialTTL, err = oidc.Key(offlineCredentialTTLKey).Duration()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", offlineCredentialTTLKey, err)
+			}
+			if cfg.offlineCredentialTTL < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", offlineCredentialTTLKey)
+			}
+			cfg.hasOfflineCredentialTTL = true
+		}
+		if oidc.HasKey(discoveryCacheTTLKey) {
+			cfg.discoveryCacheTTL, err = oidc.Key(discoveryCacheTTLKey).Duration()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", discoveryCacheTTLKey, err)
+			}
+			if cfg.discoveryCacheTTL < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", discoveryCacheTTLKey)
+			}
+		}
+
+		if oidc.HasKey(allowedClockSkewKey) {
+			cfg.allowedClockSkew, err = oidc.Key(allowedClockSkewKey).Duration()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", allowedClockSkewKey, err)
+			}
+			if cfg.allowedClockSkew < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", allowedClockSkewKey)
+			}
+		}
+		if oidc.HasKey(jwksRefreshIntervalKey) {
+			cfg.jwksRefreshInterval, err = oidc.Key(jwksRefreshIntervalKey).Duration()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", jwksRefreshIntervalKey, err)
+			}
+			if cfg.jwksRefreshInterval < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", jwksRefreshIntervalKey)
+			}
+		}
+		if oidc.HasKey(groupsCacheTTLKey) {
+			cfg.groupsCacheTTL, err = oidc.Key(groupsCacheTTLKey).Duration()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", groupsCacheTTLKey, err)
+			}
+			if cfg.groupsCacheTTL < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", groupsCacheTTLKey)
+			}
+		}
+		cfg.onGroupFetchError = oidc.Key(onGroupFetchErrorKey).MustString(groupFetchErrorDeny)
+		switch cfg.onGroupFetchError {
+		case groupFetchErrorDeny, groupFetchErrorCached, groupFetchErrorMinimal:
+		default:
+			return cfg, fmt.Errorf("invalid value for %q: must be %q, %q or %q", onGroupFetchErrorKey,
+				groupFetchErrorDeny, groupFetchErrorCached, groupFetchErrorMinimal)
+		}
+		cfg.groupSyncMode = oidc.Key(groupSyncModeKey).MustString(groupSyncAuthoritative)
+		if cfg.groupSyncMode != groupSyncAuthoritative && cfg.groupSyncMode != groupSyncAdditive {
+			return cfg, fmt.Errorf("invalid value for %q: must be %q or %q", groupSyncModeKey, groupSyncAuthoritative, groupSyncAdditive)
+		}
+		if oidc.HasKey(deviceAuthMaxWaitKey) {
+			cfg.deviceAuthMaxWait, err = oidc.Key(deviceAuthMaxWaitKey).Duration()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", deviceAuthMaxWaitKey, err)
+			}
+			if cfg.deviceAuthMaxWait < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", deviceAuthMaxWaitKey)
+			}
+		}
+		if oidc.HasKey(pollJitterKey) {
+			cfg.pollJitter, err = oidc.Key(pollJitterKey).Duration()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", pollJitterKey, err)
+			}
+			if cfg.pollJitter < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", pollJitterKey)
+			}
+		}
+		if oidc.HasKey(revokeOnLogoutKey) {
+			cfg.revokeOnLogout, err = oidc.Key(revokeOnLogoutKey).Bool()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", revokeOnLogoutKey, err)
+			}
+		}
+		if oidc.HasKey(sendLoginHintKey) {
+			cfg.sendLoginHint, err = oidc.Key(sendLoginHintKey).Bool()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", sendLoginHintKey, err)
+			}
+		}
+		if oidc.HasKey(disablePasswordKey) {
+			cfg.disablePassword, err = oidc.Key(disablePasswordKey).Bool()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", disablePasswordKey, err)
+			}
+		}
+		for _, mode := range oidc.Key(authModeOrderKey).Strings(",") {
+			if mode == "" {
+				continue
+			}
+			if !slices.Contains(authmodes.All(), mode) {
+				return cfg, fmt.Errorf("invalid value for %q: unknown authentication mode %q, valid modes are: %s",
+					authModeOrderKey, mode, strings.Join(authmodes.All(), ", "))
+			}
+			cfg.authModeOrder = append(cfg.authModeOrder, mode)
+		}
+		cfg.capabilityProbe = oidc.Key(capabilityProbeKey).MustString(capabilityProbeOff)
+		if !slices.Contains([]string{capabilityProbeOff, capabilityProbeWarn, capabilityProbeFail}, cfg.capabilityProbe) {
+			return cfg, fmt.Errorf("invalid value for %q: must be %q, %q or %q", capabilityProbeKey,
+				capabilityProbeOff, capabilityProbeWarn, capabilityProbeFail)
+		}
+		if oidc.HasKey(maxSessionsKey) {
+			cfg.maxSessions, err = oidc.Key(maxSessionsKey).Int()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", maxSessionsKey, err)
+			}
+			if cfg.maxSessions < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", maxSessionsKey)
+			}
+		}
+		if oidc.HasKey(sessionIdleTimeoutKey) {
+			cfg.sessionIdleTimeout, err = oidc.Key(sessionIdleTimeoutKey).Duration()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", sessionIdleTimeoutKey, err)
+			}
+			if cfg.sessionIdleTimeout < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", sessionIdleTimeoutKey)
+			}
+		}
+		if oidc.HasKey(stopGracePeriodKey) {
+			cfg.stopGracePeriod, err = oidc.Key(stopGracePeriodKey).Duration()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", stopGracePeriodKey, err)
+			}
+			if cfg.stopGracePeriod < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", stopGracePeriodKey)
+			}
+		}
+
+		cfg.cacheEncryption = oidc.Key(cacheEncryptionKey).MustString(cacheEncryptionNone)
+		switch cfg.cacheEncryption {
+		case cacheEncryptionNone, cacheEncryptionMachineID:
+		case cacheEncryptionKeyFile:
+			cfg.cacheEncryptionKeyFile = oidc.Key(cacheEncryptionKeyFileKey).String()
+			if cfg.cacheEncryptionKeyFile == "" {
+				return cfg, fmt.Errorf("%q is required when %q is %q", cacheEncryptionKeyFileKey, cacheEncryptionKey, cacheEncryptionKeyFile)
+			}
+		case cacheEncryptionTPM:
+			return cfg, fmt.Errorf("invalid value for %q: %q is not supported, use %q with a systemd credential encrypted with the TPM",
+				cacheEncryptionKey, cacheEncryptionTPM, cacheEncryptionKeyFile)
+		default:
+			return cfg, fmt.Errorf("invalid value for %q: %q is not one of %q, %q or %q", cacheEncryptionKey,
+				cfg.cacheEncryption, cacheEncryptionNone, cacheEncryptionMachineID, cacheEncryptionKeyFile)
+		}
+		cfg.tokenStore = oidc.Key(tokenStoreKey).MustString(tokenStoreFile)
+		if cfg.tokenStore != tokenStoreFile && cfg.tokenStore != tokenStoreMemory {
+			return cfg, fmt.Errorf("invalid value for %q: must be %q or %q", tokenStoreKey, tokenStoreFile, tokenStoreMemory)
+		}
+
+		cfg.skelDir = oidc.Key(skelDirKey).String()
+		if cfg.skelDir != "" && !filepath.IsAbs(cfg.skelDir) {
+			return cfg, fmt.Errorf("invalid value for %q: %q is not an absolute path", skelDirKey, cfg.skelDir)
+		}
+		cfg.onUserRemoval = oidc.Key(onUserRemovalKey).MustString(userRemovalKeep)
+		switch cfg.onUserRemoval {
+		case userRemovalKeep, userRemovalArchive, userRemovalDelete:
+		default:
+			return cfg, fmt.Errorf("invalid value for %q: must be %q, %q or %q", onUserRemovalKey,
+				userRemovalKeep, userRemovalArchive, userRemovalDelete)
+		}
+		cfg.userRemovalArchiveDir = oidc.Key(userRemovalArchiveDirKey).String()
+		if cfg.userRemovalArchiveDir != "" && !filepath.IsAbs(cfg.userRemovalArchiveDir) {
+			return cfg, fmt.Errorf("invalid value for %q: %q is not an absolute path", userRemovalArchiveDirKey,
+				cfg.userRemovalArchiveDir)
+		}
+		if cfg.onUserRemoval == userRemovalArchive && cfg.userRemovalArchiveDir == "" {
+			return cfg, fmt.Errorf("%q is required when %q is %q", userRemovalArchiveDirKey, onUserRemovalKey, userRemovalArchive)
+		}
+		cfg.caCertFile = oidc.Key(caCertFileKey).String()
+		if oidc.HasKey(insecureSkipVerifyKey) {
+			cfg.insecureSkipVerify, err = oidc.Key(insecureSkipVerifyKey).Bool()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", insecureSkipVerifyKey, err)
+			}
+		}
+		if oidc.HasKey(minTLSVersionKey) {
+			v, ok := tlsVersions[oidc.Key(minTLSVersionKey).String()]
+			if !ok {
+				return cfg, fmt.Errorf("invalid value for %q: must be %q or %q", minTLSVersionKey, "1.2", "1.3")
+			}
+			cfg.minTLSVersion = v
+		}
+		cfg.httpProxy = oidc.Key(httpProxyKey).String()
+		if cfg.httpProxy != "" {
+			if err := validateProxyURL(cfg.httpProxy); err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", httpProxyKey, err)
+			}
+		}
+		cfg.noProxy = oidc.Key(noProxyKey).String()
+		if oidc.HasKey(httpTimeoutKey) {
+			cfg.httpTimeout, err = oidc.Key(httpTimeoutKey).Duration()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", httpTimeoutKey, err)
+			}
+			if cfg.httpTimeout <= 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must be positive", httpTimeoutKey)
+			}
+		}
+		if oidc.HasKey(httpRetriesKey) {
+			cfg.httpRetries, err = oidc.Key(httpRetriesKey).Int()
+			if err != nil {
+				return cfg, fmt.Errorf("invalid value for %q: %v", httpRetriesKey, err)
+			}
+			if cfg.httpRetries < 0 {
+				return cfg, fmt.Errorf("invalid value for %q: must not be negative", httpRetriesKey)
+			}
+		}
+
+		if err := cfg.populateShellsConfig(oidc); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, section := range iniCfg.Sections() {
+		name, ok := namedOIDCSection(section.Name())
+		if !ok {
+			continue
+		}
+		var domains []string
+		for _, domain := range section.Key(domainsKey).Strings(",") {
+			domains = append(domains, strings.ToLower(domain))
+		}
+		acceptedIssuers, err := parseAcceptedIssuers(section)
+		if err != nil {
+			return cfg, fmt.Errorf("provider %q: %w", name, err)
+		}
+		authParams, err := parseAuthParams(section)
+		if err != nil {
+			return cfg, fmt.Errorf("provider %q: %w", name, err)
+		}
+		clientType, err := parseClientType(section)
+		if err != nil {
+			return cfg, fmt.Errorf("provider %q: %w", name, err)
+		}
+		var clientAuth clientAuth
+		if clientType != clientTypePublic {
+			if clientAuth, err = parseClientAuth(section); err != nil {
+				return cfg, fmt.Errorf("provider %q: %w", name, err)
+			}
+		}
+		secretSource, err := parseClientSecretSource(section)
+		if err != nil {
+			return cfg, fmt.Errorf("provider %q: %w", name, err)
+		}
+		jwksFile, err := parseJWKSFile(section)
+		if err != nil {
+			return cfg, fmt.Errorf("provider %q: %w", name, err)
+		}
+		providerType, err := parseProviderType(section)
+		if err != nil {
+			return cfg, fmt.Errorf("provider %q: %w", name, err)
+		}
+		cfg.oidcProviders = append(cfg.oidcProviders, oidcProvider{
+			name:            name,
+			issuerURL:       section.Key(issuerKey).String(),
+			clientID:        section.Key(clientIDKey).String(),
+			clientSecret:    section.Key(clientSecret).String(),
+			clientAuth:      clientAuth,
+			extraScopes:     section.Key(extraScopesKey).Strings(","),
+			acceptedIssuers: acceptedIssuers,
+			authParams:      authParams,
+			domains:         domains,
+			secretSource:    secretSource,
+			jwksFile:        jwksFile,
+			tokenAudience:   section.Key(tokenAudienceKey).String(),
+			publicClientID:  section.Key(publicClientIDKey).String(),
+			clientType:      clientType,
+			providerType:    providerType,
+		})
+	}
+
+	if err := cfg.populateUsersConfig(iniCfg.Section(usersSection)); err != nil {
+		return cfg, err
+	}
+
+	authd := iniCfg.Section(authdSection)
+	if authd.HasKey(persistSessionsKey) {
+		cfg.persistSessions, err = authd.Key(persistSessionsKey).Bool()
+		if err != nil {
+			return cfg, fmt.Errorf("invalid value for %q: %v", persistSessionsKey, err)
+		}
+	}
+	// The persisted sessions hold the private key of the broker, which must be encrypted with a key local users can not
+	// derive, unlike the machine ID which is readable by everyone.
+	if cfg.persistSessions && cfg.cacheEncryption != cacheEncryptionKeyFile {
+		return cfg, fmt.Errorf("%q must be %q when %q is true", cacheEncryptionKey, cacheEncryptionKeyFile, persistSessionsKey)
+	}
+	cfg.auditLog = authd.Key(auditLogKey).String()
+	if cfg.auditLog != "" && !filepath.IsAbs(cfg.auditLog) {
+		return cfg, fmt.Errorf("invalid value for %q: %q is not an absolute path", auditLogKey, cfg.auditLog)
+	}
+	for _, limit := range []struct {
+		key   string
+		value *int
+	}{
+		{auditLogMaxSizeKey, &cfg.auditLogMaxSize},
+		{auditLogMaxFilesKey, &cfg.auditLogMaxFiles},
+	} {
+		if !authd.HasKey(limit.key) {
+			continue
+		}
+		*limit.value, err = authd.Key(limit.key).Int()
+		if err != nil {
+			return cfg, fmt.Errorf("invalid value for %q: %v", limit.key, err)
+		}
+		if *limit.value < 0 {
+			return cfg, fmt.Errorf("invalid value for %q: must not be negative", limit.key)
+		}
+	}
+
+	if err := cfg.populatePasswordConfig(iniCfg.Section(passwordSection)); err != nil {
+		return cfg, err
 	}
 
-	cfg.populateUsersConfig(iniCfg.Section(usersSection))
+	if err := cfg.populateHooksConfig(iniCfg.Section(hooksSection)); err != nil {
+		return cfg, err
+	}
 
 	return cfg, nil
 }
 
+// populateHooksConfig reads the commands run at the steps of the lifecycle of the users from the hooks section.
+func (uc *userConfig) populateHooksConfig(section *ini.Section) (err error) {
+	for _, hook := range []struct {
+		key     string
+		command *[]string
+	}{
+		{onFirstLoginKey, &uc.onFirstLogin},
+		{onLoginKey, &uc.onLogin},
+	} {
+		// The commands are not run by a shell, so their arguments are only separated by spaces.
+		*hook.command = strings.Fields(section.Key(hook.key).String())
+		if len(*hook.command) > 0 && !filepath.IsAbs((*hook.command)[0]) {
+			return fmt.Errorf("invalid value for %q: %q is not an absolute path", hook.key, (*hook.command)[0])
+		}
+	}
+
+	if section.HasKey(hookTimeoutKey) {
+		uc.hookTimeout, err = section.Key(hookTimeoutKey).Duration()
+		if err != nil {
+			return fmt.Errorf("invalid value for %q: %v", hookTimeoutKey, err)
+		}
+		if uc.hookTimeout <= 0 {
+			return fmt.Errorf("invalid value for %q: must be positive", hookTimeoutKey)
+		}
+	}
+	if section.HasKey(blockLoginOnHookFailureKey) {
+		uc.blockLoginOnHookFailure, err = section.Key(blockLoginOnHookFailureKey).Bool()
+		if err != nil {
+			return fmt.Errorf("invalid value for %q: %v", blockLoginOnHookFailureKey, err)
+		}
+	}
+	return nil
+}
+
+// populatePasswordConfig reads the policy of the local passwords and the limit of the failed attempts to enter them
+// from the password section.
+func (uc *userConfig) populatePasswordConfig(section *ini.Section) (err error) {
+	if section.HasKey(minLengthKey) {
+		uc.passwordPolicy.MinLength, err = section.Key(minLengthKey).Int()
+		if err != nil {
+			return fmt.Errorf("invalid value for %q: %v", minLengthKey, err)
+		}
+		if uc.passwordPolicy.MinLength < 0 {
+			return fmt.Errorf("invalid value for %q: must not be negative", minLengthKey)
+		}
+	}
+
+	for _, class := range section.Key(requiredCharacterClassesKey).Strings(",") {
+		class = strings.ToLower(class)
+		if !slices.Contains(password.CharacterClasses(), class) {
+			return fmt.Errorf("invalid value for %q: unknown character class %q, valid classes are: %s",
+				requiredCharacterClassesKey, class, strings.Join(password.CharacterClasses(), ", "))
+		}
+		if !slices.Contains(uc.passwordPolicy.RequiredClasses, class) {
+			uc.passwordPolicy.RequiredClasses = append(uc.passwordPolicy.RequiredClasses, class)
+		}
+	}
+
+	if section.HasKey(disallowReuseKey) {
+		uc.passwordPolicy.DisallowReuse, err = section.Key(disallowReuseKey).Bool()
+		if err != nil {
+			return fmt.Errorf("invalid value for %q: %v", disallowReuseKey, err)
+		}
+	}
+
+	if section.HasKey(maxFailedAttemptsKey) {
+		uc.maxFailedAttempts, err = section.Key(maxFailedAttemptsKey).Int()
+		if err != nil {
+			return fmt.Errorf("invalid value for %q: %v", maxFailedAttemptsKey, err)
+		}
+		if uc.maxFailedAttempts < 0 {
+			return fmt.Errorf("invalid value for %q: must not be negative", maxFailedAttemptsKey)
+		}
+	}
+
+	uc.failedAttemptsWindow = defaultFailedAttemptsWindow
+	if section.HasKey(failedAttemptsWindowKey) {
+		uc.failedAttemptsWindow, err = section.Key(failedAttemptsWindowKey).Duration()
+		if err != nil {
+			return fmt.Errorf("invalid value for %q: %v", failedAttemptsWindowKey, err)
+		}
+		if uc.failedAttemptsWindow <= 0 {
+			return fmt.Errorf("invalid value for %q: must be positive", failedAttemptsWindowKey)
+		}
+	}
+
+	uc.lockoutDuration = defaultLockoutDuration
+	if section.HasKey(lockoutDurationKey) {
+		uc.lockoutDuration, err = section.Key(lockoutDurationKey).Duration()
+		if err != nil {
+			return fmt.Errorf("invalid value for %q: %v", lockoutDurationKey, err)
+		}
+		if uc.lockoutDuration <= 0 {
+			return fmt.Errorf("invalid value for %q: must be positive", lockoutDurationKey)
+		}
+	}
+
+	return nil
+}
+
+// parseProviderType returns the provider type of the section, which is empty if it is selected from the issuer.
+func parseProviderType(section *ini.Section) (string, error) {
+	t := section.Key(providerTypeKey).String()
+	if t != "" && !slices.Contains(providers.Types(), t) {
+		return t, fmt.Errorf("invalid value for %q: unknown provider type %q, valid types are: %s",
+			providerTypeKey, t, strings.Join(providers.Types(), ", "))
+	}
+	if tag, ok := providers.BuildTag(t); ok {
+		return t, fmt.Errorf("invalid value for %q: the %q provider is only available in the broker built with the %q build tag",
+			providerTypeKey, t, tag)
+	}
+	return t, nil
+}
+
+// reloadableKeys are the keys of the [oidc] sections which ReloadConfig applies. The changes of the other keys only take
+// effect when the broker restarts.
+var reloadableKeys = []string{
+	issuerKey, clientIDKey, clientSecret, clientSecretFileKey, clientSecretCommandKey, clientAuthKey, clientKeyFileKey,
+	clientKeyIDKey, publicClientIDKey, clientTypeKey, extraScopesKey, acceptedIssuersKey, authParamsKey, jwksFileKey,
+	tokenAudienceKey, defaultProviderKey, domainsKey, providerTypeKey,
+}
+
+// configSettings returns the values of the keys of the config, by "[section] key".
+func configSettings(iniCfg *ini.File) map[string]string {
+	settings := make(map[string]string)
+	for _, section := range iniCfg.Sections() {
+		for _, key := range section.Keys() {
+			settings[fmt.Sprintf("[%s] %s", section.Name(), key.Name())] = key.Value()
+		}
+	}
+	return settings
+}
+
+// unappliedChanges returns the sorted "[section] key" of the keys which are added, removed or changed from oldSettings
+// to newSettings, and which ReloadConfig does not apply.
+func unappliedChanges(oldSettings, newSettings map[string]string) []string {
+	var changed []string
+	for _, settings := range []map[string]string{oldSettings, newSettings} {
+		for setting := range settings {
+			oldValue, inOld := oldSettings[setting]
+			newValue, inNew := newSettings[setting]
+			if inOld == inNew && oldValue == newValue || slices.Contains(changed, setting) {
+				continue
+			}
+			section, key, _ := strings.Cut(strings.TrimPrefix(setting, "["), "] ")
+			if _, named := namedOIDCSection(section); (section == oidcSection || named) && slices.Contains(reloadableKeys, key) {
+				continue
+			}
+			changed = append(changed, setting)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// namedOIDCSection returns the provider name of a section named `oidc "name"`, and whether it is such a section.
+func namedOIDCSection(sectionName string) (string, bool) {
+	prefix, quoted, ok := strings.Cut(sectionName, " ")
+	if !ok || prefix != oidcSection {
+		return "", false
+	}
+	name, err := strconv.Unquote(strings.TrimSpace(quoted))
+	if err != nil || name == "" {
+		return "", false
+	}
+	return name, true
+}
+
+// LogConfig is the logging configuration of the broker daemon.
+type LogConfig struct {
+	// Level is the configured log level, or nil if it is not set.
+	Level *slog.Level
+	// Format is the output format of the logs.
+	Format log.Format
+}
+
+// ParseLogConfig parses the logging configuration of the config file, so that the logger can be set up before the
+// broker is created.
+func ParseLogConfig(cfgPath string) (cfg LogConfig, err error) {
+	defer decorate.OnError(&err, "could not parse config")
+
+	iniCfg, err := loadConfigFile(cfgPath)
+	if err != nil {
+		return cfg, err
+	}
+	authd := iniCfg.Section(authdSection)
+
+	cfg.Format = log.FormatText
+	if authd.HasKey(logFormatKey) {
+		cfg.Format, err = log.ParseFormat(authd.Key(logFormatKey).String())
+		if err != nil {
+			return cfg, fmt.Errorf("invalid value for %q: %v", logFormatKey, err)
+		}
+	}
+	if authd.HasKey(logLevelKey) {
+		level, err := log.ParseLevel(authd.Key(logLevelKey).String())
+		if err != nil {
+			return cfg, fmt.Errorf("invalid value for %q: %v", logLevelKey, err)
+		}
+		cfg.Level = &level
+	}
+
+	return cfg, nil
+}
+
+// ValidateConfig runs the validations of the config file which are done when the broker starts, without starting it,
+// and returns all the errors found. If checkIssuers is true, it also checks that the discovery documents of the
+// configured issuers can be fetched.
+func ValidateConfig(ctx context.Context, cfgPath string, checkIssuers bool) error {
+	_, logErr := ParseLogConfig(cfgPath)
+
+	cfg, err := parseConfigFile(cfgPath, providers.CurrentProvider())
+	if err != nil {
+		return errors.Join(logErr, fmt.Errorf("could not parse config: %v", err))
+	}
+
+	errs := []error{logErr, cfg.checkOIDCSettings(), cfg.resolveClientSecrets(slog.Default())}
+	if keySource := cfg.tokenKeySource(); keySource != nil {
+		if _, err := keySource.Key(); err != nil {
+			errs = append(errs, fmt.Errorf("could not get the token cache encryption key: %v", err))
+		}
+	}
+
+	if !checkIssuers {
+		return errors.Join(errs...)
+	}
+
+	issuerURLs := []string{cfg.issuerURL}
+	for _, p := range cfg.oidcProviders {
+		issuerURLs = append(issuerURLs, p.issuerURL)
+	}
+	httpClient, err := cfg.httpClient()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	for _, issuerURL := range issuerURLs {
+		if issuerURL == "" {
+			continue
+		}
+		if _, err := fetchDiscoveryDocument(ctx, httpClient, issuerURL, cfg.requestTimeout()); err != nil {
+			errs = append(errs, fmt.Errorf("could not reach issuer %q: %v", issuerURL, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// spacedInlineComment matches the inline comment ending a secret reference, which must follow a space.
+var spacedInlineComment = regexp.MustCompile(`\s+[#;].*$`)
+
+// restoreSecretRefs replaces the secret references of iniCfg, whose inline comment was stripped from the first # or ;,
+// by their value in the config files without their inline comment, which must follow a space in them: a # or ; can be
+// part of the reference, like the field of the secrets of Vault. The other values are kept as they are.
+func restoreSecretRefs(iniCfg *ini.File, cfgFiles []any) error {
+	rawCfg, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, cfgFiles[0], cfgFiles[1:]...)
+	if err != nil {
+		return err
+	}
+
+	for _, section := range iniCfg.Sections() {
+		rawSection, err := rawCfg.GetSection(section.Name())
+		if err != nil {
+			continue
+		}
+		for _, key := range section.Keys() {
+			if !strings.HasPrefix(key.Value(), secretRefPrefix) || !rawSection.HasKey(key.Name()) {
+				continue
+			}
+			key.SetValue(spacedInlineComment.ReplaceAllString(rawSection.Key(key.Name()).Value(), ""))
+		}
+	}
+	return nil
+}
+
+// envReference matches the references to the environment variables, ${VAR}, ${VAR:?} or $VAR, and the escaped $, $$.
+var envReference = regexp.MustCompile(`\$(?:\$|\{([A-Za-z_][A-Za-z0-9_]*)(:\?)?\}|([A-Za-z_][A-Za-z0-9_]*))`)
+
+// expandEnv replaces the ${VAR} and $VAR references in value with the value of the environment variable. An unset
+// variable is replaced by an empty string with a warning, unless it is referenced as ${VAR:?}, in which case an error is
+// returned. $$ is replaced by a literal $, which the secrets holding a $ followed by a letter must use, and the other $
+// are kept as they are.
+func expandEnv(value string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+		m := envReference.FindStringSubmatch(ref)
+		name, required := m[1]+m[3], m[2] != ""
+
+		v, ok := os.LookupEnv(name)
+		if !ok && required {
+			err = errors.Join(err, fmt.Errorf("environment variable %q is not set", name))
+		} else if !ok {
+			slog.Warn(fmt.Sprintf("Environment variable %q is not set, it is replaced by an empty string", name))
+		}
+		return v
+	})
+
+	return expanded, err
+}
+
+// checkOIDCSettings returns an error if the settings required to connect to the providers are missing. The [oidc]
+// section only needs an issuer if no named provider is configured.
+func (uc *userConfig) checkOIDCSettings() (err error) {
+	if uc.issuerURL != "" || len(uc.oidcProviders) == 0 {
+		if uc.issuerURL == "" {
+			err = errors.Join(err, errors.New("issuer URL is required and was not provided"))
+		}
+		if uc.clientType == clientTypePublic && uc.publicClientID == "" {
+			err = errors.Join(err, fmt.Errorf("public client ID is required when %q is %q and was not provided", clientTypeKey, clientTypePublic))
+		} else if uc.clientType != clientTypePublic && uc.clientID == "" {
+			err = errors.Join(err, errors.New("client ID is required and was not provided"))
+		}
+	}
+
+	domainProviders := make(map[string]string)
+	for _, p := range uc.oidcProviders {
+		if p.issuerURL == "" {
+			err = errors.Join(err, fmt.Errorf("issuer URL of provider %q is required and was not provided", p.name))
+		}
+		if p.clientType == clientTypePublic && p.publicClientID == "" {
+			err = errors.Join(err, fmt.Errorf("public client ID of provider %q is required when %q is %q and was not provided",
+				p.name, clientTypeKey, clientTypePublic))
+		} else if p.clientType != clientTypePublic && p.clientID == "" {
+			err = errors.Join(err, fmt.Errorf("client ID of provider %q is required and was not provided", p.name))
+		}
+		if len(p.domains) == 0 {
+			err = errors.Join(err, fmt.Errorf("domains of provider %q are required and were not provided", p.name))
+		}
+		for _, domain := range p.domains {
+			if other, ok := domainProviders[domain]; ok {
+				err = errors.Join(err, fmt.Errorf("domain %q is configured for both providers %q and %q", domain, other, p.name))
+				continue
+			}
+			domainProviders[domain] = p.name
+		}
+	}
+
+	if uc.defaultProvider != "" {
+		if uc.issuerURL != "" {
+			err = errors.Join(err, fmt.Errorf("%q can not be set together with %q in the [%s] section", defaultProviderKey, issuerKey, oidcSection))
+		} else if !slices.ContainsFunc(uc.oidcProviders, func(p oidcProvider) bool { return p.name == uc.defaultProvider }) {
+			err = errors.Join(err, fmt.Errorf("default provider %q is not configured", uc.defaultProvider))
+		}
+	}
+
+	return err
+}
+
+// defaultIssuerURL returns the issuer of the users whose domain is not configured for any named provider.
+func (uc *userConfig) defaultIssuerURL() string {
+	for _, p := range uc.oidcProviders {
+		if p.name == uc.defaultProvider {
+			return p.issuerURL
+		}
+	}
+	return uc.issuerURL
+}
+
+// oidcProviderFor returns the identity provider which authenticates the user, selected by the domain of the username.
+// The users of the domains which are not configured for any named provider are authenticated by the default provider,
+// which is either the one of the [oidc] section or the one set by default_provider.
+func (uc *userConfig) oidcProviderFor(username string) (oidcProvider, error) {
+	var domain string
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		domain = strings.ToLower(username[i+1:])
+	}
+
+	for _, p := range uc.oidcProviders {
+		if domain != "" && slices.Contains(p.domains, domain) {
+			return p.selectedClient(), nil
+		}
+	}
+	for _, p := range uc.oidcProviders {
+		if p.name == uc.defaultProvider {
+			return p.selectedClient(), nil
+		}
+	}
+	if uc.issuerURL != "" {
+		return oidcProvider{
+			issuerURL:       uc.issuerURL,
+			clientID:        uc.clientID,
+			clientSecret:    uc.clientSecret,
+			clientAuth:      uc.clientAuth,
+			extraScopes:     uc.extraScopes,
+			acceptedIssuers: uc.acceptedIssuers,
+			authParams:      uc.authParams,
+			jwksFile:        uc.jwksFile,
+			tokenAudience:   uc.tokenAudience,
+			publicClientID:  uc.publicClientID,
+			clientType:      uc.clientType,
+			providerType:    uc.providerType,
+			provider:        uc.sectionProvider,
+		}.selectedClient(), nil
+	}
+
+	if domain == "" {
+		return oidcProvider{}, fmt.Errorf("no identity provider is configured for user %q, which has no domain", username)
+	}
+	return oidcProvider{}, fmt.Errorf("no identity provider is configured for the domain %q", domain)
+}
+
+// providerSettings returns the provider-specific settings of the config, without the provider type, which is set by
+// provider.
+func (uc *userConfig) providerSettings() providers.Settings {
+	return providers.Settings{
+		GroupsClaim:           uc.groupsClaim,
+		GitLabFullGroupPaths:  uc.gitlabFullGroupPaths,
+		PingGroupsClaim:       uc.pingGroupsClaim,
+		GoogleDirectoryGroups: uc.googleDirectoryGroups,
+		NestedGroupsMaxDepth:  uc.nestedGroupsMaxDepth,
+	}
+}
+
+// selectProviders selects the provider-specific implementation of each configured identity provider, from its provider
+// type or its issuer, with the given settings. If custom is set, it is used for all the providers instead.
+func (uc *userConfig) selectProviders(s providers.Settings, custom providers.Provider) {
+	selectProvider := func(issuerURL, providerType string) providers.Provider {
+		if custom != nil {
+			return custom
+		}
+		s.Type = providerType
+		return providers.ForIssuer(issuerURL, s)
+	}
+
+	uc.sectionProvider = selectProvider(uc.issuerURL, uc.providerType)
+	for i, p := range uc.oidcProviders {
+		uc.oidcProviders[i].provider = selectProvider(p.issuerURL, p.providerType)
+	}
+}
+
+// configuredProviders returns all the configured identity providers: the one of the [oidc] section, if it has an
+// issuer, and the named ones.
+func (uc *userConfig) configuredProviders() []oidcProvider {
+	var ps []oidcProvider
+	if uc.issuerURL != "" {
+		ps = append(ps, oidcProvider{
+			issuerURL:       uc.issuerURL,
+			clientID:        uc.clientID,
+			clientSecret:    uc.clientSecret,
+			clientAuth:      uc.clientAuth,
+			extraScopes:     uc.extraScopes,
+			acceptedIssuers: uc.acceptedIssuers,
+			authParams:      uc.authParams,
+			jwksFile:        uc.jwksFile,
+			tokenAudience:   uc.tokenAudience,
+			publicClientID:  uc.publicClientID,
+			clientType:      uc.clientType,
+			providerType:    uc.providerType,
+			provider:        uc.sectionProvider,
+		})
+	}
+	ps = append(ps, uc.oidcProviders...)
+	for i, p := range ps {
+		ps[i] = p.selectedClient()
+	}
+	return ps
+}
+
 func (uc *userConfig) isOwnerAllowed(userName string) bool {
 	uc.ownerMutex.RLock()
 	defer uc.ownerMutex.RUnlock()
@@ -194,6 +1953,18 @@ func (uc *userConfig) isOwnerAllowed(userName string) bool {
 	return uc.ownerAllowed && uc.owner == userName
 }
 
+// isAdmin returns true if the user is listed in the admin users, or is the owner and the owner is an admin.
+func (uc *userConfig) isAdmin(userName string) bool {
+	if _, ok := uc.adminUsers[userName]; ok {
+		return true
+	}
+
+	uc.ownerMutex.RLock()
+	defer uc.ownerMutex.RUnlock()
+
+	return uc.ownerIsAdmin && uc.owner != "" && uc.owner == userName
+}
+
 func (uc *userConfig) registerOwner(cfgPath, userName string) error {
 	// We need to lock here to avoid a race condition where two users log in at the same time, causing both to be
 	// considered the owner.
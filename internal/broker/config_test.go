@@ -1,7 +1,11 @@
 package broker
 
 import (
+	"encoding/json"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -11,6 +15,8 @@ import (
 	"unsafe"
 
 	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/log"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers"
 	"github.com/ubuntu/authd-oidc-brokers/internal/testutils"
 	"github.com/ubuntu/authd-oidc-brokers/internal/testutils/golden"
 )
@@ -27,21 +33,631 @@ client_id = client_id
 issuer = https://issuer.url.com
 client_id = client_id
 
+client_auth = client_secret_post
+extra_scopes = custom-scope, another-scope
+provider_type = gitlab
+gitlab_full_group_paths = true
+ping_groups_claim = groups
+google_directory_groups = true
+nested_groups_max_depth = 3
+username_claim = email
+username_strip_domain = true
+groups_claim = roles
+group_scope = userinfo
+groups_claim_name_field = displayName
+token_validation = introspection
+group_name_template = oidc-%g
+group_name_separator = -
+allowed_clock_skew = 30s
+device_auth_max_wait = 5m
+poll_jitter = 3s
+revoke_on_logout = true
+send_login_hint = true
+disable_password = true
+capability_probe = fail
+max_sessions = 16
+session_idle_timeout = 10m
+stop_grace_period = 30s
+allowed_groups = Group1, group2
+admin_users = OWNER, Admin@issuer.url.com
+admin_group = wheel
+always_groups = oidc-users, printers
+required_amr = mfa, hwk
+required_acr = urn:example:mfa
+require_verified_email = true
+allow_missing_email_verified = true
+max_age = 12h
+auth_mode_order = device_auth, password
+accepted_issuers = https://login.issuer.url.com/{tenantid}/v2.0, https://sts.issuer.url.com/tenant/
+auth_params = prompt=consent, hd = example.com
+skel_dir = /usr/local/etc/skel
+on_user_removal = archive
+user_removal_archive_dir = /var/backups/authd-oidc
+ca_cert_file = /etc/ssl/certs/internal-ca.pem
+insecure_skip_verify = true
+min_tls_version = 1.3
+http_proxy = http://proxy.example.com:3128
+no_proxy = localhost, .internal.example.com
+http_timeout = 30s
+http_retries = 3
+offline_credential_ttl = 72h
+discovery_cache_ttl = 24h
+jwks_refresh_interval = 12h
+groups_cache_ttl = 30s
+cache_encryption = key-file
+cache_encryption_key_file = /run/credentials/authd-oidc/cache-key
+token_store = memory
+on_group_fetch_error = cached
+group_sync_mode = additive
+public_client_id = public_client_id
+token_audience = https://graph.microsoft.com
+default_shell = /bin/bash
+shell_for_group.Developers = /usr/bin/zsh
+
 [users]
 home_base_dir = /home
+home_dir_template = %d/%u
 allowed_ssh_suffixes = @issuer.url.com
+uid_range = 1000000000-1999999999
+gid_range = 1000000000-1999999999
+username_collision = suffix
+
+[authd]
+persist_sessions = true
+audit_log = /var/log/authd-oidc-broker/audit.log
+audit_log_max_size = 20
+audit_log_max_files = 3
+
+[password]
+min_length = 12
+required_character_classes = lowercase, Digit, digit
+disallow_reuse = true
+max_failed_attempts = 5
+failed_attempts_window = 10m
+lockout_duration = 30s
+
+[hooks]
+on_first_login = /usr/local/sbin/provision-quota --soft 10G
+on_login = /usr/local/sbin/log-login
+timeout = 10s
+block_login_on_failure = true
+`,
+
+	"named_providers": `
+[oidc]
+default_provider = partner
+
+[oidc "corp"]
+issuer = https://corp.issuer.url.com
+client_id = corp_client_id
+domains = Corp.example.com, example.com
+provider_type = okta
+
+[oidc "desktop"]
+issuer = https://desktop.issuer.url.com
+client_id = desktop_client_id
+client_secret_file = /etc/authd/brokers.d/not-deployed-secret
+public_client_id = desktop_public_client_id
+client_type = public
+domains = desktop.example.com
+
+[oidc "partner"]
+issuer = https://partner.issuer.url.com
+client_id = partner_client_id
+client_secret = partner_client_secret
+client_auth = client_secret_basic
+extra_scopes = partner-scope
+accepted_issuers = https://partner.issuer.url.com/{tenantid}
+auth_params = domain_hint=partner.com
+domains = partner.com
+`,
+
+	"singles": `
+[oidc]
+issuer = https://ISSUER_URL>
+client_id = <CLIENT_ID
+`,
+
+	"template": `
+[oidc]
+issuer = https://<ISSUER_URL>
+client_id = <CLIENT_ID>
+`,
+
+	"invalid_boolean": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+allowed_groups_case_sensitive = maybe
+`,
+
+	"invalid_integer": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+max_sessions = many
+`,
+
+	"invalid_group_scope": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+groups_claim = roles
+group_scope = access_token
+`,
+
+	"invalid_always_groups": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+always_groups = OIDC Users
+`,
+
+	"invalid_duration": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+offline_credential_ttl = three days
+`,
+
+	"invalid_default_shell": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+default_shell = /not/a/login/shell
+`,
+
+	"empty_username_claim": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+username_claim =
+`,
+
+	"empty_ping_groups_claim": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+provider_type = ping
+ping_groups_claim =
+`,
+
+	"empty_groups_claim": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+groups_claim =
+`,
+
+	"invalid_provider_type": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+provider_type = github
+`,
+
+	"invalid_provider_type_not_built": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+provider_type = msentraid
+`,
+
+	"invalid_group_name_template": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+group_name_template = oidc_groups
+`,
+
+	"invalid_group_name_separator": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+group_name_template = %g
+group_name_separator = " "
+`,
+
+	"invalid_group_shell": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+shell_for_group.developers = /not/a/login/shell
+`,
+
+	"invalid_cache_encryption": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+cache_encryption = rot13
+`,
+
+	"invalid_cache_encryption_tpm": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+cache_encryption = tpm
+`,
+
+	"invalid_cache_encryption_key_file_without_path": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+cache_encryption = key-file
+`,
+
+	"invalid_group_fetch_error": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+on_group_fetch_error = ignore
+`,
+
+	"invalid_client_type": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+client_type = native
+`,
+
+	"invalid_group_sync_mode": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+group_sync_mode = merge
+`,
+
+	"invalid_token_store": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+token_store = keyring
+`,
+
+	"invalid_home_dir_template": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[users]
+home_dir_template = %u/../other
+`,
+
+	"invalid_character_class": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[password]
+required_character_classes = lowercase, emoji
+`,
+
+	"invalid_hook_command": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[hooks]
+on_login = provision-quota
+`,
+
+	"invalid_hook_timeout": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[hooks]
+timeout = 0s
+`,
+
+	"invalid_lockout_duration": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[password]
+max_failed_attempts = 5
+lockout_duration = 0s
+`,
+
+	"invalid_http_proxy": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+http_proxy = ftp://proxy.example.com
+`,
+
+	"invalid_http_retries": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+http_retries = -1
+`,
+
+	"invalid_min_tls_version": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+min_tls_version = 1.1
+`,
+
+	"invalid_groups_cache_ttl": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+groups_cache_ttl = -1m
+`,
+
+	"invalid_accepted_issuers": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+accepted_issuers = {tenantid}/v2.0
+`,
+
+	"invalid_client_auth": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+client_auth = tls_client_auth
+`,
+
+	"invalid_client_key_file_unset": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+client_auth = private_key_jwt
+`,
+
+	"invalid_client_key_file": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+client_auth = private_key_jwt
+client_key_file = /nonexistent/client-key.pem
+`,
+
+	"invalid_named_client_auth": `
+[oidc]
+default_provider = partner
+
+[oidc "partner"]
+issuer = https://partner.issuer.url.com
+client_id = partner_client_id
+client_auth = tls_client_auth
+`,
+
+	"invalid_named_provider_type": `
+[oidc]
+default_provider = partner
+
+[oidc "partner"]
+issuer = https://partner.issuer.url.com
+client_id = partner_client_id
+provider_type = github
+`,
+
+	"invalid_client_secret_file": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+client_secret_file = client-secret
+`,
+
+	"invalid_client_secret_command": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+client_secret_command = vault kv get -field=secret authd/oidc
+`,
+
+	"invalid_jwks_file": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+jwks_file = jwks.json
+`,
+
+	"invalid_jwks_file_missing": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+jwks_file = /nonexistent/jwks.json
+`,
+
+	"invalid_named_jwks_file": `
+[oidc]
+default_provider = partner
+
+[oidc "partner"]
+issuer = https://partner.issuer.url.com
+client_id = partner_client_id
+jwks_file = jwks.json
+`,
+
+	"invalid_require_verified_email": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+require_verified_email = sometimes
+`,
+
+	"invalid_audit_log": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[authd]
+audit_log = audit.log
+`,
+
+	"invalid_audit_log_max_size": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[authd]
+audit_log = /var/log/authd-oidc-broker/audit.log
+audit_log_max_size = -1
+`,
+
+	"invalid_auth_params": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+auth_params = prompt
+`,
+
+	"invalid_auth_params_reserved": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+auth_params = scope=openid
+`,
+
+	"invalid_skel_dir": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+skel_dir = skel
+`,
+
+	"invalid_on_user_removal": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+on_user_removal = unknown
+`,
+
+	"invalid_user_removal_archive_dir_unset": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+on_user_removal = archive
+`,
+
+	"invalid_user_removal_archive_dir": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+on_user_removal = archive
+user_removal_archive_dir = archives
+`,
+
+	"invalid_persist_sessions_without_encryption": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[authd]
+persist_sessions = true
+`,
+
+	"invalid_persist_sessions_with_machine_id_encryption": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+cache_encryption = machine-id
+
+[authd]
+persist_sessions = true
+`,
+
+	"invalid_uid_range": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[users]
+uid_range = 2000000000-1999999999
+`,
+
+	"invalid_auth_mode_order": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+auth_mode_order = device_auth, sms
+`,
+
+	"invalid_poll_jitter": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+poll_jitter = -1s
+`,
+
+	"invalid_stop_grace_period": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+stop_grace_period = -1s
+`,
+
+	"invalid_send_login_hint": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+send_login_hint = maybe
+`,
+
+	"invalid_disable_password": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+disable_password = maybe
+`,
+
+	"invalid_token_validation": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+token_validation = opaque
+`,
+
+	"invalid_max_age": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+max_age = -1h
+`,
+
+	"invalid_capability_probe": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+capability_probe = sometimes
 `,
 
-	"singles": `
+	"invalid_google_directory_groups": `
 [oidc]
-issuer = https://ISSUER_URL>
-client_id = <CLIENT_ID
+issuer = https://issuer.url.com
+client_id = client_id
+google_directory_groups = maybe
 `,
 
-	"template": `
+	"invalid_nested_groups_max_depth": `
 [oidc]
-issuer = https://<ISSUER_URL>
-client_id = <CLIENT_ID>
+issuer = https://issuer.url.com
+client_id = client_id
+nested_groups_max_depth = -1
+`,
+
+	"invalid_username_collision": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[users]
+username_collision = rename
+`,
+
+	"invalid_gid_range": `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[users]
+gid_range = 2000-1000
 `,
 
 	"overwrite_lower_precedence": `
@@ -59,7 +675,7 @@ issuer = https://higher-precedence-issuer.url.com
 func TestParseConfig(t *testing.T) {
 	t.Parallel()
 	p := &testutils.MockProvider{}
-	ignoredFields := map[string]struct{}{"provider": {}, "ownerMutex": {}}
+	ignoredFields := map[string]struct{}{"provider": {}, "ownerMutex": {}, "settings": {}, "sectionProvider": {}}
 
 	tests := map[string]struct {
 		configType string
@@ -70,14 +686,82 @@ func TestParseConfig(t *testing.T) {
 		"Successfully_parse_config_file":                      {},
 		"Successfully_parse_config_file_with_optional_values": {configType: "valid+optional"},
 		"Successfully_parse_config_with_drop_in_files":        {dropInType: "valid"},
+		"Successfully_parse_config_directory":                 {configType: "directory"},
+		"Successfully_parse_config_with_named_providers":      {configType: "named_providers"},
 
 		"Do_not_fail_if_values_contain_a_single_template_delimiter": {configType: "singles"},
 
-		"Error_if_file_does_not_exist":             {configType: "inexistent", wantErr: true},
-		"Error_if_file_is_unreadable":              {configType: "unreadable", wantErr: true},
-		"Error_if_file_is_not_updated":             {configType: "template", wantErr: true},
-		"Error_if_drop_in_directory_is_unreadable": {dropInType: "unreadable-dir", wantErr: true},
-		"Error_if_drop_in_file_is_unreadable":      {dropInType: "unreadable-file", wantErr: true},
+		"Error_if_file_does_not_exist":                 {configType: "inexistent", wantErr: true},
+		"Error_if_file_is_unreadable":                  {configType: "unreadable", wantErr: true},
+		"Error_if_file_is_not_updated":                 {configType: "template", wantErr: true},
+		"Error_if_directory_has_no_config_files":       {configType: "empty-directory", wantErr: true},
+		"Error_if_boolean_value_is_invalid":            {configType: "invalid_boolean", wantErr: true},
+		"Error_if_integer_value_is_invalid":            {configType: "invalid_integer", wantErr: true},
+		"Error_if_duration_value_is_invalid":           {configType: "invalid_duration", wantErr: true},
+		"Error_if_home_dir_template_is_invalid":        {configType: "invalid_home_dir_template", wantErr: true},
+		"Error_if_cache_encryption_is_invalid":         {configType: "invalid_cache_encryption", wantErr: true},
+		"Error_if_cache_encryption_is_tpm":             {configType: "invalid_cache_encryption_tpm", wantErr: true},
+		"Error_if_cache_encryption_key_file_is_unset":  {configType: "invalid_cache_encryption_key_file_without_path", wantErr: true},
+		"Error_if_token_store_is_invalid":              {configType: "invalid_token_store", wantErr: true},
+		"Error_if_group_fetch_error_is_invalid":        {configType: "invalid_group_fetch_error", wantErr: true},
+		"Error_if_group_sync_mode_is_invalid":          {configType: "invalid_group_sync_mode", wantErr: true},
+		"Error_if_client_type_is_invalid":              {configType: "invalid_client_type", wantErr: true},
+		"Error_if_default_shell_is_not_valid":          {configType: "invalid_default_shell", wantErr: true},
+		"Error_if_group_shell_is_not_valid":            {configType: "invalid_group_shell", wantErr: true},
+		"Error_if_username_claim_is_empty":             {configType: "empty_username_claim", wantErr: true},
+		"Error_if_groups_claim_is_empty":               {configType: "empty_groups_claim", wantErr: true},
+		"Error_if_ping_groups_claim_is_empty":          {configType: "empty_ping_groups_claim", wantErr: true},
+		"Error_if_provider_type_is_unknown":            {configType: "invalid_provider_type", wantErr: true},
+		"Error_if_provider_type_is_not_built":          {configType: "invalid_provider_type_not_built", wantErr: true},
+		"Error_if_group_scope_is_unknown":              {configType: "invalid_group_scope", wantErr: true},
+		"Error_if_always_groups_are_invalid":           {configType: "invalid_always_groups", wantErr: true},
+		"Error_if_gid_range_is_invalid":                {configType: "invalid_gid_range", wantErr: true},
+		"Error_if_username_collision_is_unknown":       {configType: "invalid_username_collision", wantErr: true},
+		"Error_if_google_directory_groups_not_bool":    {configType: "invalid_google_directory_groups", wantErr: true},
+		"Error_if_nested_groups_depth_is_negative":     {configType: "invalid_nested_groups_max_depth", wantErr: true},
+		"Error_if_character_class_is_unknown":          {configType: "invalid_character_class", wantErr: true},
+		"Error_if_lockout_duration_is_not_positive":    {configType: "invalid_lockout_duration", wantErr: true},
+		"Error_if_hook_command_is_not_absolute":        {configType: "invalid_hook_command", wantErr: true},
+		"Error_if_hook_timeout_is_not_positive":        {configType: "invalid_hook_timeout", wantErr: true},
+		"Error_if_http_proxy_is_invalid":               {configType: "invalid_http_proxy", wantErr: true},
+		"Error_if_http_retries_is_negative":            {configType: "invalid_http_retries", wantErr: true},
+		"Error_if_min_tls_version_is_unknown":          {configType: "invalid_min_tls_version", wantErr: true},
+		"Error_if_capability_probe_is_unknown":         {configType: "invalid_capability_probe", wantErr: true},
+		"Error_if_groups_cache_ttl_is_negative":        {configType: "invalid_groups_cache_ttl", wantErr: true},
+		"Error_if_max_age_is_negative":                 {configType: "invalid_max_age", wantErr: true},
+		"Error_if_poll_jitter_is_negative":             {configType: "invalid_poll_jitter", wantErr: true},
+		"Error_if_stop_grace_period_is_negative":       {configType: "invalid_stop_grace_period", wantErr: true},
+		"Error_if_send_login_hint_is_not_a_boolean":    {configType: "invalid_send_login_hint", wantErr: true},
+		"Error_if_disable_password_is_invalid":         {configType: "invalid_disable_password", wantErr: true},
+		"Error_if_token_validation_is_invalid":         {configType: "invalid_token_validation", wantErr: true},
+		"Error_if_auth_mode_order_has_unknown_mode":    {configType: "invalid_auth_mode_order", wantErr: true},
+		"Error_if_accepted_issuer_is_not_a_URL":        {configType: "invalid_accepted_issuers", wantErr: true},
+		"Error_if_auth_param_is_not_a_pair":            {configType: "invalid_auth_params", wantErr: true},
+		"Error_if_auth_param_is_set_by_the_broker":     {configType: "invalid_auth_params_reserved", wantErr: true},
+		"Error_if_client_auth_is_unknown":              {configType: "invalid_client_auth", wantErr: true},
+		"Error_if_client_key_file_is_not_set":          {configType: "invalid_client_key_file_unset", wantErr: true},
+		"Error_if_client_key_file_does_not_exist":      {configType: "invalid_client_key_file", wantErr: true},
+		"Error_if_named_client_auth_is_unknown":        {configType: "invalid_named_client_auth", wantErr: true},
+		"Error_if_secret_file_is_not_absolute":         {configType: "invalid_client_secret_file", wantErr: true},
+		"Error_if_secret_command_is_not_absolute":      {configType: "invalid_client_secret_command", wantErr: true},
+		"Error_if_jwks_file_is_not_absolute":           {configType: "invalid_jwks_file", wantErr: true},
+		"Error_if_jwks_file_does_not_exist":            {configType: "invalid_jwks_file_missing", wantErr: true},
+		"Error_if_named_jwks_file_is_not_absolute":     {configType: "invalid_named_jwks_file", wantErr: true},
+		"Error_if_named_provider_type_is_unknown":      {configType: "invalid_named_provider_type", wantErr: true},
+		"Error_if_verified_email_is_not_a_bool":        {configType: "invalid_require_verified_email", wantErr: true},
+		"Error_if_audit_log_is_not_absolute":           {configType: "invalid_audit_log", wantErr: true},
+		"Error_if_audit_log_max_size_is_negative":      {configType: "invalid_audit_log_max_size", wantErr: true},
+		"Error_if_skel_dir_is_not_absolute":            {configType: "invalid_skel_dir", wantErr: true},
+		"Error_if_on_user_removal_is_unknown":          {configType: "invalid_on_user_removal", wantErr: true},
+		"Error_if_archive_dir_is_not_set":              {configType: "invalid_user_removal_archive_dir_unset", wantErr: true},
+		"Error_if_archive_dir_is_not_absolute":         {configType: "invalid_user_removal_archive_dir", wantErr: true},
+		"Error_if_uid_range_is_invalid":                {configType: "invalid_uid_range", wantErr: true},
+		"Error_if_sessions_are_persisted_in_plaintext": {configType: "invalid_persist_sessions_without_encryption", wantErr: true},
+		"Error_if_persisted_sessions_use_machine_id":   {configType: "invalid_persist_sessions_with_machine_id_encryption", wantErr: true},
+		"Error_if_group_name_template_is_invalid":      {configType: "invalid_group_name_template", wantErr: true},
+		"Error_if_group_name_separator_is_invalid":     {configType: "invalid_group_name_separator", wantErr: true},
+		"Error_if_drop_in_directory_is_unreadable":     {dropInType: "unreadable-dir", wantErr: true},
+		"Error_if_drop_in_file_is_unreadable":          {dropInType: "unreadable-file", wantErr: true},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -98,6 +782,23 @@ func TestParseConfig(t *testing.T) {
 			case "unreadable":
 				err = os.Chmod(confPath, 0000)
 				require.NoError(t, err, "Setup: Failed to make config file unreadable")
+			case "directory", "empty-directory":
+				err = os.Remove(confPath)
+				require.NoError(t, err, "Setup: Failed to remove config file")
+				err = os.Mkdir(confPath, 0700)
+				require.NoError(t, err, "Setup: Failed to create config directory")
+				// Files without the .conf extension are not loaded.
+				err = os.WriteFile(filepath.Join(confPath, "99-ignored.txt"), []byte(configTypes["template"]), 0600)
+				require.NoError(t, err, "Setup: Failed to write ignored file")
+			}
+			if tc.configType == "directory" {
+				// Create multiple files to test that they are merged in lexical order.
+				err = os.WriteFile(filepath.Join(confPath, "00-broker.conf"), []byte(configTypes["valid+optional"]), 0600)
+				require.NoError(t, err, "Setup: Failed to write config file")
+				err = os.WriteFile(filepath.Join(confPath, "10-override.conf"), []byte(configTypes["overwrite_lower_precedence"]), 0600)
+				require.NoError(t, err, "Setup: Failed to write config file")
+				err = os.WriteFile(filepath.Join(confPath, "20-override.conf"), []byte(configTypes["overwrite_higher_precedence"]), 0600)
+				require.NoError(t, err, "Setup: Failed to write config file")
 			}
 
 			dropInDir := GetDropInDir(confPath)
@@ -159,6 +860,620 @@ func TestParseConfig(t *testing.T) {
 	}
 }
 
+func TestParseConfigExpandsEnvironmentVariables(t *testing.T) {
+	t.Setenv("AUTHD_OIDC_TEST_ISSUER", "https://issuer.url.com")
+	t.Setenv("AUTHD_OIDC_TEST_CLIENT_ID", "client_id")
+	t.Setenv("AUTHD_OIDC_TEST_EMPTY", "")
+
+	tests := map[string]struct {
+		issuer   string
+		clientID string
+
+		wantIssuer   string
+		wantClientID string
+		wantErr      bool
+	}{
+		"Values_without_references_are_unchanged": {
+			issuer:       "https://issuer.url.com",
+			clientID:     "client_id",
+			wantIssuer:   "https://issuer.url.com",
+			wantClientID: "client_id",
+		},
+		"Braced_references_are_expanded": {
+			issuer:       "${AUTHD_OIDC_TEST_ISSUER}/tenant",
+			clientID:     "${AUTHD_OIDC_TEST_CLIENT_ID}",
+			wantIssuer:   "https://issuer.url.com/tenant",
+			wantClientID: "client_id",
+		},
+		"Unbraced_references_are_expanded": {
+			issuer:       "$AUTHD_OIDC_TEST_ISSUER/tenant",
+			clientID:     "$AUTHD_OIDC_TEST_CLIENT_ID-suffix",
+			wantIssuer:   "https://issuer.url.com/tenant",
+			wantClientID: "client_id-suffix",
+		},
+		"Escaped_references_are_kept_literally": {
+			issuer:       "https://issuer.url.com",
+			clientID:     "client$${AUTHD_OIDC_TEST_CLIENT_ID}$$AUTHD_OIDC_TEST_CLIENT_ID",
+			wantIssuer:   "https://issuer.url.com",
+			wantClientID: "client${AUTHD_OIDC_TEST_CLIENT_ID}$AUTHD_OIDC_TEST_CLIENT_ID",
+		},
+		"Escaped_dollars_are_kept_literally": {
+			issuer:       "https://issuer.url.com",
+			clientID:     "se$$cret$$$$",
+			wantIssuer:   "https://issuer.url.com",
+			wantClientID: "se$cret$$",
+		},
+		"Dollars_not_starting_a_reference_are_kept": {
+			issuer:       "https://issuer.url.com",
+			clientID:     "secret$1$-$",
+			wantIssuer:   "https://issuer.url.com",
+			wantClientID: "secret$1$-$",
+		},
+		"Unset_variables_are_expanded_to_empty_strings": {
+			issuer:     "https://issuer.url.com",
+			clientID:   "${AUTHD_OIDC_TEST_UNSET}$AUTHD_OIDC_TEST_UNSET",
+			wantIssuer: "https://issuer.url.com",
+		},
+		"Required_variables_set_to_empty_are_accepted": {
+			issuer:     "https://issuer.url.com",
+			clientID:   "${AUTHD_OIDC_TEST_EMPTY:?}",
+			wantIssuer: "https://issuer.url.com",
+		},
+
+		"Error_if_required_variable_is_unset": {
+			issuer:   "https://issuer.url.com",
+			clientID: "${AUTHD_OIDC_TEST_UNSET:?}",
+			wantErr:  true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			confPath := filepath.Join(t.TempDir(), "broker.conf")
+			config := fmt.Sprintf("[oidc]\nissuer = %s\nclient_id = %s\n", tc.issuer, tc.clientID)
+			err := os.WriteFile(confPath, []byte(config), 0600)
+			require.NoError(t, err, "Setup: Failed to write config file")
+
+			cfg, err := parseConfigFile(confPath, &testutils.MockProvider{})
+			if tc.wantErr {
+				require.Error(t, err, "parseConfigFile should return an error")
+				return
+			}
+			require.NoError(t, err, "parseConfigFile should not return an error")
+			require.Equal(t, tc.wantIssuer, cfg.issuerURL, "Issuer should be expanded as expected")
+			require.Equal(t, tc.wantClientID, cfg.clientID, "Client ID should be expanded as expected")
+		})
+	}
+}
+
+func TestParseConfigInlineComments(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		clientID     string
+		clientSecret string
+
+		wantClientID     string
+		wantClientSecret string
+	}{
+		"Values_without_comments_are_unchanged": {
+			clientID:         "client_id",
+			clientSecret:     "secret",
+			wantClientID:     "client_id",
+			wantClientSecret: "secret",
+		},
+		"Comments_after_a_space_are_stripped": {
+			clientID:         "client_id # the client",
+			clientSecret:     "secret ; the secret",
+			wantClientID:     "client_id",
+			wantClientSecret: "secret",
+		},
+		"Comments_without_a_space_are_stripped_from_values": {
+			clientID:         "client_id#the client",
+			clientSecret:     "se;cret",
+			wantClientID:     "client_id",
+			wantClientSecret: "se",
+		},
+		"Secret_references_keep_their_hash_and_semicolon": {
+			clientID:         "client_id",
+			clientSecret:     "!vault:secret/data/oidc;v2#client_secret",
+			wantClientID:     "client_id",
+			wantClientSecret: "!vault:secret/data/oidc;v2#client_secret",
+		},
+		"Comments_after_a_space_are_stripped_from_secret_references": {
+			clientID:         "client_id",
+			clientSecret:     "!vault:secret/data/oidc#client_secret # from Vault",
+			wantClientID:     "client_id",
+			wantClientSecret: "!vault:secret/data/oidc#client_secret",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			confPath := filepath.Join(t.TempDir(), "broker.conf")
+			config := fmt.Sprintf("[oidc]\nissuer = https://issuer.url.com\nclient_id = %s\nclient_secret = %s\n", tc.clientID, tc.clientSecret)
+			err := os.WriteFile(confPath, []byte(config), 0600)
+			require.NoError(t, err, "Setup: Failed to write config file")
+
+			cfg, err := parseConfigFile(confPath, &testutils.MockProvider{})
+			require.NoError(t, err, "parseConfigFile should not return an error")
+			require.Equal(t, tc.wantClientID, cfg.clientID, "Client ID should be parsed as expected")
+			require.Equal(t, tc.wantClientSecret, cfg.clientSecret, "Client secret should be parsed as expected")
+		})
+	}
+}
+
+func TestOIDCProviderFor(t *testing.T) {
+	t.Parallel()
+
+	const defaultProvider = `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+`
+	const namedProvider = `
+[oidc "corp"]
+issuer = https://corp.issuer.url.com
+client_id = corp_client_id
+domains = example.com, Corp.Example.com
+`
+
+	tests := map[string]struct {
+		config   string
+		username string
+
+		wantIssuer   string
+		wantClientID string
+		wantCheckErr bool
+		wantErr      bool
+	}{
+		"Successfully_select_provider_of_the_domain":                    {config: defaultProvider + namedProvider, username: "user@example.com", wantIssuer: "https://corp.issuer.url.com"},
+		"Successfully_select_provider_of_the_domain_case_insensitively": {config: defaultProvider + namedProvider, username: "user@corp.EXAMPLE.com", wantIssuer: "https://corp.issuer.url.com"},
+		"Successfully_select_oidc_section_for_other_domains":            {config: defaultProvider + namedProvider, username: "user@other.com", wantIssuer: "https://issuer.url.com"},
+		"Successfully_select_oidc_section_for_usernames_without_domain": {config: defaultProvider + namedProvider, username: "user", wantIssuer: "https://issuer.url.com"},
+		"Successfully_select_oidc_section_without_named_providers":      {config: defaultProvider, username: "user@example.com", wantIssuer: "https://issuer.url.com"},
+		"Successfully_select_default_provider_for_other_domains": {
+			config:     "[oidc]\ndefault_provider = corp\n" + namedProvider,
+			username:   "user@other.com",
+			wantIssuer: "https://corp.issuer.url.com",
+		},
+		"Successfully_select_public_client_of_the_provider": {
+			config:       defaultProvider + "public_client_id = public_client_id\nclient_type = public\n",
+			username:     "user",
+			wantIssuer:   "https://issuer.url.com",
+			wantClientID: "public_client_id",
+		},
+		"Successfully_select_public_client_of_the_named_provider": {
+			config:       defaultProvider + namedProvider + "public_client_id = corp_public_client_id\nclient_type = public\n",
+			username:     "user@example.com",
+			wantIssuer:   "https://corp.issuer.url.com",
+			wantClientID: "corp_public_client_id",
+		},
+
+		"Error_if_domain_has_no_provider":              {config: namedProvider, username: "user@other.com", wantErr: true},
+		"Error_if_username_has_no_domain_nor_provider": {config: namedProvider, username: "user", wantErr: true},
+
+		"Error_if_no_provider_is_configured":       {config: "[oidc]\n", wantCheckErr: true},
+		"Error_if_oidc_section_has_no_client_ID":   {config: "[oidc]\nissuer = https://issuer.url.com\n" + namedProvider, wantCheckErr: true},
+		"Error_if_named_provider_has_no_issuer":    {config: "[oidc \"corp\"]\nclient_id = corp_client_id\ndomains = example.com\n", wantCheckErr: true},
+		"Error_if_named_provider_has_no_client_ID": {config: "[oidc \"corp\"]\nissuer = https://corp.issuer.url.com\ndomains = example.com\n", wantCheckErr: true},
+		"Error_if_named_provider_has_no_domains":   {config: "[oidc \"corp\"]\nissuer = https://corp.issuer.url.com\nclient_id = corp_client_id\n", wantCheckErr: true},
+		"Error_if_domain_has_several_providers":    {config: namedProvider + strings.ReplaceAll(namedProvider, `"corp"`, `"other"`), wantCheckErr: true},
+		"Error_if_default_provider_is_not_named":   {config: "[oidc]\ndefault_provider = other\n" + namedProvider, wantCheckErr: true},
+		"Error_if_default_provider_is_set_twice":   {config: defaultProvider + "default_provider = corp\n" + namedProvider, wantCheckErr: true},
+		"Error_if_public_client_has_no_ID":         {config: defaultProvider + "client_type = public\n", wantCheckErr: true},
+		"Error_if_named_public_client_has_no_ID":   {config: namedProvider + "client_type = public\n", wantCheckErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			confPath := filepath.Join(t.TempDir(), "broker.conf")
+			err := os.WriteFile(confPath, []byte(tc.config), 0600)
+			require.NoError(t, err, "Setup: Failed to write config file")
+			cfg, err := parseConfigFile(confPath, &testutils.MockProvider{})
+			require.NoError(t, err, "Setup: parseConfigFile should not return an error")
+
+			err = cfg.checkOIDCSettings()
+			if tc.wantCheckErr {
+				require.Error(t, err, "checkOIDCSettings should return an error")
+				return
+			}
+			require.NoError(t, err, "checkOIDCSettings should not return an error")
+
+			got, err := cfg.oidcProviderFor(tc.username)
+			if tc.wantErr {
+				require.Error(t, err, "oidcProviderFor should return an error")
+				return
+			}
+			require.NoError(t, err, "oidcProviderFor should not return an error")
+			require.Equal(t, tc.wantIssuer, got.issuerURL, "oidcProviderFor should return the provider of the user")
+			if tc.wantClientID != "" {
+				require.Equal(t, tc.wantClientID, got.clientID, "oidcProviderFor should return the client of the client type")
+				require.Empty(t, got.clientSecret, "The public client should have no secret")
+			}
+		})
+	}
+}
+
+func TestSelectProviders(t *testing.T) {
+	t.Parallel()
+
+	const config = `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+
+[oidc "corp"]
+issuer = https://corp.issuer.url.com
+client_id = corp_client_id
+domains = example.com
+provider_type = okta
+`
+
+	tests := map[string]struct {
+		custom providers.Provider
+	}{
+		"Successfully_select_provider_of_each_section": {},
+		"Successfully_use_custom_provider":             {custom: &testutils.MockProvider{}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			confPath := filepath.Join(t.TempDir(), "broker.conf")
+			err := os.WriteFile(confPath, []byte(config), 0600)
+			require.NoError(t, err, "Setup: Failed to write config file")
+			cfg, err := parseConfigFile(confPath, &testutils.MockProvider{})
+			require.NoError(t, err, "Setup: parseConfigFile should not return an error")
+
+			cfg.selectProviders(cfg.providerSettings(), tc.custom)
+
+			wantDefault := providers.ForIssuer("https://issuer.url.com", providers.Settings{})
+			wantCorp := providers.ForIssuer("https://corp.issuer.url.com", providers.Settings{Type: providers.TypeOkta})
+			if tc.custom != nil {
+				wantDefault, wantCorp = tc.custom, tc.custom
+			}
+			for username, want := range map[string]providers.Provider{"user@other.com": wantDefault, "user@example.com": wantCorp} {
+				p, err := cfg.oidcProviderFor(username)
+				require.NoError(t, err, "oidcProviderFor should not return an error")
+				require.IsType(t, want, p.provider, "The provider of user %q should be of the type of its section", username)
+			}
+		})
+	}
+}
+
+func TestUnappliedChanges(t *testing.T) {
+	t.Parallel()
+
+	const oldConfig = `
+[oidc]
+issuer = https://issuer.url.com
+client_id = client_id
+username_claim = email
+
+[oidc "corp"]
+issuer = https://corp.issuer.url.com
+client_id = corp_client_id
+domains = example.com
+
+[users]
+allowed_users = OWNER
+`
+
+	tests := map[string]struct {
+		newConfig string
+
+		want []string
+	}{
+		"Nothing_if_config_is_unchanged":         {newConfig: oldConfig},
+		"Nothing_if_only_oidc_settings_changed":  {newConfig: strings.ReplaceAll(strings.ReplaceAll(oldConfig, "client_id = client_id", "client_id = new_client_id\nextra_scopes = scope"), "example.com", "other.com")},
+		"Changed_key_which_is_not_reloaded":      {newConfig: strings.ReplaceAll(oldConfig, "allowed_users = OWNER", "allowed_users = ALL"), want: []string{"[users] allowed_users"}},
+		"Added_and_removed_keys":                 {newConfig: strings.ReplaceAll(oldConfig, "username_claim = email", "") + "home_base_dir = /srv/home\n", want: []string{"[oidc] username_claim", "[users] home_base_dir"}},
+		"Keys_of_removed_section_not_reloaded":   {newConfig: strings.ReplaceAll(oldConfig, "[users]\nallowed_users = OWNER\n", ""), want: []string{"[users] allowed_users"}},
+		"Changed_oidc_key_which_is_not_reloaded": {newConfig: strings.ReplaceAll(oldConfig, "username_claim = email", "username_claim = sub"), want: []string{"[oidc] username_claim"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			settings := make([]map[string]string, 2)
+			for i, config := range []string{oldConfig, tc.newConfig} {
+				confPath := filepath.Join(dir, fmt.Sprintf("broker-%d.conf", i))
+				err := os.WriteFile(confPath, []byte(config), 0600)
+				require.NoError(t, err, "Setup: Failed to write config file")
+				cfg, err := parseConfigFile(confPath, &testutils.MockProvider{})
+				require.NoError(t, err, "Setup: parseConfigFile should not return an error")
+				settings[i] = cfg.settings
+			}
+
+			got := unappliedChanges(settings[0], settings[1])
+			require.Equal(t, tc.want, got, "unappliedChanges should return the changed keys which are not reloaded")
+		})
+	}
+}
+
+func TestResolveClientSecrets(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	err := os.WriteFile(secretFile, []byte("file-secret\n"), 0600)
+	require.NoError(t, err, "Setup: Failed to write secret file")
+	worldReadableFile := filepath.Join(dir, "world-readable-secret")
+	err = os.WriteFile(worldReadableFile, []byte("file-secret\n"), 0600)
+	require.NoError(t, err, "Setup: Failed to write secret file")
+	err = os.Chmod(worldReadableFile, 0644)
+	require.NoError(t, err, "Setup: Failed to make secret file world-readable")
+	emptyFile := filepath.Join(dir, "empty-secret")
+	err = os.WriteFile(emptyFile, []byte("\n"), 0600)
+	require.NoError(t, err, "Setup: Failed to write secret file")
+
+	secretCommand := filepath.Join(dir, "print-secret")
+	err = os.WriteFile(secretCommand, []byte("#!/bin/sh\necho \"command-secret$1\"\n"), 0700)
+	require.NoError(t, err, "Setup: Failed to write secret command")
+	failingCommand := filepath.Join(dir, "fail")
+	err = os.WriteFile(failingCommand, []byte("#!/bin/sh\necho 'vault is sealed' >&2\nexit 1\n"), 0700)
+	require.NoError(t, err, "Setup: Failed to write failing command")
+
+	const oidcSection = "[oidc]\nissuer = https://issuer.url.com\nclient_id = client_id\n"
+
+	tests := map[string]struct {
+		config string
+
+		wantSecret         string
+		wantProviderSecret string
+		wantWarning        bool
+		wantErr            bool
+	}{
+		"Use_the_secret_of_the_config_file": {
+			config:     oidcSection + "client_secret = config-secret\n",
+			wantSecret: "config-secret",
+		},
+		"Read_the_secret_from_the_file": {
+			config:     oidcSection + "client_secret_file = " + secretFile + "\n",
+			wantSecret: "file-secret",
+		},
+		"Read_the_secret_from_the_command_output": {
+			config:     oidcSection + "client_secret_command = " + secretCommand + " -suffix\n",
+			wantSecret: "command-secret-suffix",
+		},
+		"Prefer_the_file_to_the_config_file": {
+			config:     oidcSection + "client_secret = config-secret\nclient_secret_file = " + secretFile + "\n",
+			wantSecret: "file-secret",
+		},
+		"Prefer_the_command_to_the_file_and_the_config_file": {
+			config: oidcSection + "client_secret = config-secret\nclient_secret_file = " + secretFile +
+				"\nclient_secret_command = " + secretCommand + "\n",
+			wantSecret: "command-secret",
+		},
+		"Read_the_secret_of_a_named_provider": {
+			config: oidcSection + "client_secret = config-secret\n" +
+				"[oidc \"corp\"]\nissuer = https://corp.issuer.url.com\nclient_id = corp_client_id\ndomains = example.com\n" +
+				"client_secret = corp-config-secret\nclient_secret_command = " + secretCommand + "\n",
+			wantSecret:         "config-secret",
+			wantProviderSecret: "command-secret",
+		},
+		"Do_not_read_the_secret_if_the_public_client_is_used": {
+			config: oidcSection + "client_secret_file = " + filepath.Join(dir, "missing") +
+				"\npublic_client_id = public_client_id\nclient_type = public\n",
+		},
+		"Warn_if_the_file_is_world_readable": {
+			config:      oidcSection + "client_secret_file = " + worldReadableFile + "\n",
+			wantSecret:  "file-secret",
+			wantWarning: true,
+		},
+
+		"Error_if_the_file_does_not_exist": {config: oidcSection + "client_secret_file = " + filepath.Join(dir, "missing") + "\n", wantErr: true},
+		"Error_if_the_file_is_empty":       {config: oidcSection + "client_secret_file = " + emptyFile + "\n", wantErr: true},
+		"Error_if_the_command_fails":       {config: oidcSection + "client_secret_command = " + failingCommand + "\n", wantErr: true},
+		"Error_if_the_command_prints_nothing": {
+			config:  oidcSection + "client_secret_command = /bin/true\n",
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			confPath := filepath.Join(t.TempDir(), "broker.conf")
+			err := os.WriteFile(confPath, []byte(tc.config), 0600)
+			require.NoError(t, err, "Setup: Failed to write config file")
+			cfg, err := parseConfigFile(confPath, &testutils.MockProvider{})
+			require.NoError(t, err, "Setup: parseConfigFile should not return an error")
+
+			var logs strings.Builder
+			err = cfg.resolveClientSecrets(slog.New(slog.NewTextHandler(&logs, nil)))
+			if tc.wantErr {
+				require.Error(t, err, "resolveClientSecrets should return an error")
+				return
+			}
+			require.NoError(t, err, "resolveClientSecrets should not return an error")
+
+			require.Equal(t, tc.wantSecret, cfg.clientSecret, "The client secret should be read from the source with the highest precedence")
+			if tc.wantProviderSecret != "" {
+				require.Len(t, cfg.oidcProviders, 1, "Setup: the named provider should have been parsed")
+				require.Equal(t, tc.wantProviderSecret, cfg.oidcProviders[0].clientSecret, "The client secret of the named provider should be read from its source")
+			}
+			if tc.wantWarning {
+				require.Contains(t, logs.String(), "can be read by all the users", "A warning should be logged for a world-readable secret file")
+			} else {
+				require.Empty(t, logs.String(), "Nothing should be logged")
+			}
+			require.NotContains(t, logs.String(), "file-secret", "The client secret should never be logged")
+		})
+	}
+}
+
+// TestResolveSecretRefs does not run in parallel, as it sets the environment variables read by the resolvers.
+func TestResolveSecretRefs(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	err := os.WriteFile(secretFile, []byte("file-secret\n"), 0600)
+	require.NoError(t, err, "Setup: Failed to write secret file")
+	secretCommand := filepath.Join(dir, "print-secret")
+	err = os.WriteFile(secretCommand, []byte("#!/bin/sh\necho \"command-secret$1\"\n"), 0700)
+	require.NoError(t, err, "Setup: Failed to write secret command")
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		var data map[string]any
+		switch r.URL.Path {
+		case "/v1/secret/data/oidc":
+			data = map[string]any{"data": map[string]any{"client_secret": "vault-v2-secret"}, "metadata": map[string]any{"version": 1}}
+		case "/v1/kv/oidc":
+			data = map[string]any{"client_secret": "vault-v1-secret"}
+		default:
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}))
+	t.Cleanup(vault.Close)
+
+	t.Setenv("OIDC_CLIENT_SECRET", "env-secret")
+	t.Setenv("EMPTY_SECRET", "")
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "vault-token")
+
+	tests := map[string]struct {
+		secret        string
+		vaultToken    string
+		providerValue string
+
+		wantSecret         string
+		wantProviderSecret string
+		wantErr            bool
+		wantErrContains    string
+	}{
+		"Keep_a_plain_secret":               {secret: "plain-secret", wantSecret: "plain-secret"},
+		"Keep_a_plain_secret_with_a_prefix": {secret: "!plain-secret", wantSecret: "!plain-secret"},
+		"Unescape_a_plain_secret":           {secret: "!!env:plain-secret", wantSecret: "!env:plain-secret"},
+		"Resolve_an_environment_variable":   {secret: "!env:OIDC_CLIENT_SECRET", wantSecret: "env-secret"},
+		"Resolve_a_file":                    {secret: "!file:" + secretFile, wantSecret: "file-secret"},
+		"Resolve_a_command":                 {secret: "!cmd:" + secretCommand + " -suffix", wantSecret: "command-secret-suffix"},
+		"Resolve_a_versioned_Vault_secret":  {secret: "!vault:secret/data/oidc#client_secret", wantSecret: "vault-v2-secret"},
+		"Resolve_a_Vault_secret":            {secret: "!vault:kv/oidc#client_secret", wantSecret: "vault-v1-secret"},
+		"Resolve_the_secret_of_a_provider": {
+			secret:             "plain-secret",
+			providerValue:      "!env:OIDC_CLIENT_SECRET",
+			wantSecret:         "plain-secret",
+			wantProviderSecret: "env-secret",
+		},
+
+		"Error_if_the_prefix_is_unknown": {
+			secret:          "!unknown:secret",
+			wantErr:         true,
+			wantErrContains: `unknown secret reference "!unknown": the prefix must be one of !cmd:, !env:, !file:, !vault:`,
+		},
+		"Error_if_the_variable_is_not_set":         {secret: "!env:UNSET_SECRET", wantErr: true},
+		"Error_if_the_variable_is_empty":           {secret: "!env:EMPTY_SECRET", wantErr: true},
+		"Error_if_the_file_path_is_relative":       {secret: "!file:secret", wantErr: true},
+		"Error_if_the_file_does_not_exist":         {secret: "!file:" + filepath.Join(dir, "missing"), wantErr: true},
+		"Error_if_the_command_path_is_relative":    {secret: "!cmd:print-secret", wantErr: true},
+		"Error_if_the_command_fails":               {secret: "!cmd:/bin/false", wantErr: true},
+		"Error_if_the_Vault_field_is_missing":      {secret: "!vault:secret/data/oidc", wantErr: true},
+		"Error_if_the_Vault_field_does_not_exist":  {secret: "!vault:secret/data/oidc#other", wantErr: true},
+		"Error_if_the_Vault_secret_does_not_exist": {secret: "!vault:secret/data/missing#client_secret", wantErr: true},
+		"Error_if_the_Vault_token_is_denied":       {secret: "!vault:kv/oidc#client_secret", vaultToken: "other-token", wantErr: true},
+		"Error_if_the_secret_of_a_provider_fails": {
+			secret:        "plain-secret",
+			providerValue: "!unknown:secret",
+			wantErr:       true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if tc.vaultToken != "" {
+				t.Setenv("VAULT_TOKEN", tc.vaultToken)
+			}
+
+			config := "[oidc]\nissuer = https://issuer.url.com\nclient_id = client_id\nclient_secret = " + tc.secret + "\n"
+			if tc.providerValue != "" {
+				config += "[oidc \"corp\"]\nissuer = https://corp.issuer.url.com\nclient_id = corp_client_id\n" +
+					"domains = example.com\nclient_secret = " + tc.providerValue + "\n"
+			}
+			confPath := filepath.Join(t.TempDir(), "broker.conf")
+			err := os.WriteFile(confPath, []byte(config), 0600)
+			require.NoError(t, err, "Setup: Failed to write config file")
+			cfg, err := parseConfigFile(confPath, &testutils.MockProvider{})
+			require.NoError(t, err, "Setup: parseConfigFile should not return an error")
+
+			err = cfg.resolveClientSecrets(slog.Default())
+			if tc.wantErr {
+				require.Error(t, err, "resolveClientSecrets should return an error")
+				require.NotContains(t, err.Error(), "secret-", "The error should not hold the resolved secrets")
+				if tc.wantErrContains != "" {
+					require.ErrorContains(t, err, tc.wantErrContains, "The error should explain what is wrong")
+				}
+				return
+			}
+			require.NoError(t, err, "resolveClientSecrets should not return an error")
+
+			require.Equal(t, tc.wantSecret, cfg.clientSecret, "The client secret should be the resolved one")
+			if tc.wantProviderSecret != "" {
+				require.Len(t, cfg.oidcProviders, 1, "Setup: the named provider should have been parsed")
+				require.Equal(t, tc.wantProviderSecret, cfg.oidcProviders[0].clientSecret, "The client secret of the named provider should be the resolved one")
+			}
+		})
+	}
+}
+
+func TestParseLogConfig(t *testing.T) {
+	t.Parallel()
+
+	debug := slog.LevelDebug
+
+	tests := map[string]struct {
+		authd        string
+		dropIn       string
+		noConfigFile bool
+
+		wantLevel  *slog.Level
+		wantFormat log.Format
+		wantErr    bool
+	}{
+		"Successfully_parse_config_without_authd_section": {wantFormat: log.FormatText},
+		"Successfully_parse_level_and_format":             {authd: "log_level = debug\nlog_format = json", wantLevel: &debug, wantFormat: log.FormatJSON},
+		"Successfully_parse_level_from_drop_in_file":      {authd: "log_level = error", dropIn: "log_level = debug", wantLevel: &debug, wantFormat: log.FormatText},
+
+		"Error_if_level_is_invalid":       {authd: "log_level = trace", wantErr: true},
+		"Error_if_format_is_invalid":      {authd: "log_format = logfmt", wantErr: true},
+		"Error_if_config_file_is_missing": {noConfigFile: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			confPath := filepath.Join(t.TempDir(), "broker.conf")
+			if !tc.noConfigFile {
+				err := os.WriteFile(confPath, []byte(configTypes["valid"]+"\n[authd]\n"+tc.authd+"\n"), 0600)
+				require.NoError(t, err, "Setup: Failed to write config file")
+			}
+			if tc.dropIn != "" {
+				dropInDir := GetDropInDir(confPath)
+				err := os.Mkdir(dropInDir, 0700)
+				require.NoError(t, err, "Setup: Failed to create drop-in directory")
+				err = os.WriteFile(filepath.Join(dropInDir, "00-drop-in.conf"), []byte("[authd]\n"+tc.dropIn+"\n"), 0600)
+				require.NoError(t, err, "Setup: Failed to write drop-in file")
+			}
+
+			got, err := ParseLogConfig(confPath)
+			if tc.wantErr {
+				require.Error(t, err, "ParseLogConfig should return an error")
+				return
+			}
+			require.NoError(t, err, "ParseLogConfig should not return an error")
+			require.Equal(t, tc.wantLevel, got.Level, "Level should be parsed as expected")
+			require.Equal(t, tc.wantFormat, got.Format, "Format should be parsed as expected")
+		})
+	}
+}
+
 var testParseUserConfigTypes = map[string]string{
 	"All_are_allowed": `
 [oidc]
@@ -0,0 +1,148 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// discoveryCacheSuffix is appended to the issuer directory name to get the file where its discovery document is cached.
+const discoveryCacheSuffix = ".discovery.json"
+
+// discoveryDocument contains the fields of the OIDC discovery document which are needed to create the provider.
+type discoveryDocument struct {
+	Issuer           string   `json:"issuer"`
+	AuthURL          string   `json:"authorization_endpoint"`
+	TokenURL         string   `json:"token_endpoint"`
+	DeviceAuthURL    string   `json:"device_authorization_endpoint"`
+	UserInfoURL      string   `json:"userinfo_endpoint"`
+	JWKSURL          string   `json:"jwks_uri"`
+	RevocationURL    string   `json:"revocation_endpoint"`
+	IntrospectionURL string   `json:"introspection_endpoint"`
+	Algorithms       []string `json:"id_token_signing_alg_values_supported"`
+	GrantTypes       []string `json:"grant_types_supported"`
+	Scopes           []string `json:"scopes_supported"`
+	TokenAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// newProvider creates the provider from the endpoints of the discovery document, without contacting the issuer.
+func (d discoveryDocument) newProvider(ctx context.Context) *oidc.Provider {
+	cfg := oidc.ProviderConfig{
+		IssuerURL:     d.Issuer,
+		AuthURL:       d.AuthURL,
+		TokenURL:      d.TokenURL,
+		DeviceAuthURL: d.DeviceAuthURL,
+		UserInfoURL:   d.UserInfoURL,
+		JWKSURL:       d.JWKSURL,
+		Algorithms:    d.Algorithms,
+	}
+	return cfg.NewProvider(ctx)
+}
+
+// connectToOIDCServer returns the provider of the issuer. It reuses the cached discovery document if it is more recent
+// than the configured TTL, or else fetches it and updates the cache.
+func (b *Broker) connectToOIDCServer(ctx context.Context, issuerURL, cachePath string) (*oidc.Provider, error) {
+	if b.cfg.discoveryCacheTTL > 0 {
+		if doc, modTime, err := loadDiscoveryDocument(cachePath, issuerURL); err == nil && time.Since(modTime) < b.cfg.discoveryCacheTTL {
+			b.logger.Debug(fmt.Sprintf("Using the discovery document of %q cached at %s", issuerURL, modTime))
+			return doc.newProvider(ctx), nil
+		}
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, b.cfg.requestTimeout())
+	defer cancel()
+
+	p, err := oidc.NewProvider(reqCtx, issuerURL)
+	b.discovery.record(err)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cacheDiscoveryDocument(cachePath, p); err != nil {
+		b.logger.Warn(fmt.Sprintf("Could not cache the discovery document of %q: %v", issuerURL, err))
+	}
+	return p, nil
+}
+
+// discoveryDocumentOf returns the discovery document the provider was created from, reading it from the cache if the
+// provider was created from the cached copy.
+func discoveryDocumentOf(p *oidc.Provider, cachePath, issuerURL string) (discoveryDocument, error) {
+	var doc discoveryDocument
+	if err := p.Claims(&doc); err == nil {
+		return doc, nil
+	}
+	doc, _, err := loadDiscoveryDocument(cachePath, issuerURL)
+	return doc, err
+}
+
+// fetchDiscoveryDocument fetches the discovery document of the issuer with the client, without caching it.
+func fetchDiscoveryDocument(ctx context.Context, client *http.Client, issuerURL string, timeout time.Duration) (discoveryDocument, error) {
+	reqCtx, cancel := context.WithTimeout(oidc.ClientContext(ctx, client), timeout)
+	defer cancel()
+
+	var doc discoveryDocument
+	p, err := oidc.NewProvider(reqCtx, issuerURL)
+	if err != nil {
+		return doc, err
+	}
+	err = p.Claims(&doc)
+	return doc, err
+}
+
+// cachedOIDCServer returns the provider from the cached discovery document of the issuer, regardless of its age, or nil
+// if there is none.
+func (b *Broker) cachedOIDCServer(ctx context.Context, issuerURL, cachePath string) *oidc.Provider {
+	doc, _, err := loadDiscoveryDocument(cachePath, issuerURL)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Could not use the cached discovery document of %q: %v", issuerURL, err))
+		return nil
+	}
+
+	b.logger.Warn(fmt.Sprintf("Using the cached discovery document of %q, as the provider is not reachable", issuerURL))
+	return doc.newProvider(ctx)
+}
+
+// cacheDiscoveryDocument stores the discovery document of the provider.
+func cacheDiscoveryDocument(path string, p *oidc.Provider) error {
+	var doc json.RawMessage
+	if err := p.Claims(&doc); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("could not create data directory: %v", err)
+	}
+	return os.WriteFile(path, doc, 0600)
+}
+
+// loadDiscoveryDocument reads the cached discovery document of the issuer and returns it with the time it was cached.
+func loadDiscoveryDocument(path, issuerURL string) (discoveryDocument, time.Time, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return discoveryDocument{}, time.Time{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return discoveryDocument{}, time.Time{}, err
+	}
+
+	var doc discoveryDocument
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return discoveryDocument{}, time.Time{}, fmt.Errorf("could not parse %q: %v", path, err)
+	}
+	if doc.Issuer != issuerURL {
+		return discoveryDocument{}, time.Time{}, fmt.Errorf("%q is the discovery document of %q", path, doc.Issuer)
+	}
+
+	return doc, fi.ModTime(), nil
+}
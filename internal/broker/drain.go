@@ -0,0 +1,98 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultStopGracePeriod is how long to wait for the running authentications when the broker stops, unless configured
+// otherwise.
+const defaultStopGracePeriod = 10 * time.Second
+
+// errDraining is the error of the new sessions requested while the broker stops.
+var errDraining = errors.New("the broker is stopping")
+
+// drainState tracks the running IsAuthenticated calls, so that the broker can wait for them to finish before stopping.
+type drainState struct {
+	mu       sync.Mutex
+	draining bool
+	running  int
+	// done is closed once no IsAuthenticated call is running while draining.
+	done chan struct{}
+}
+
+// begin records that an IsAuthenticated call started.
+func (d *drainState) begin() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.running++
+}
+
+// end records that an IsAuthenticated call finished.
+func (d *drainState) end() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.running--
+	if d.draining && d.running == 0 {
+		d.closeDone()
+	}
+}
+
+// closeDone closes the done channel, if it is not closed yet. mu must be held by the caller.
+func (d *drainState) closeDone() {
+	select {
+	case <-d.done:
+	default:
+		close(d.done)
+	}
+}
+
+// StopGracePeriod returns how long to wait for the running authentications when the broker stops.
+func (b *Broker) StopGracePeriod() time.Duration {
+	return b.cfg.stopGracePeriod
+}
+
+// Drain stops accepting new sessions and waits for the running IsAuthenticated calls to finish, so that the users who
+// are authenticating are not interrupted by a restart of the broker. The calls still running when ctx is done are
+// cancelled, and the error of ctx is returned. The existing sessions can still be authenticated meanwhile, e.g. to
+// define the local password after authenticating with the provider.
+func (b *Broker) Drain(ctx context.Context) error {
+	b.drain.mu.Lock()
+	if !b.drain.draining {
+		b.drain.draining = true
+		b.drain.done = make(chan struct{})
+		if b.drain.running == 0 {
+			b.drain.closeDone()
+		}
+	}
+	done := b.drain.done
+	b.drain.mu.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	for _, s := range b.Sessions() {
+		if !s.Authenticating {
+			continue
+		}
+		b.logger.Info(fmt.Sprintf("Cancelling the authentication of session %q, as the broker is stopping", s.ID))
+		b.CancelIsAuthenticated(s.ID)
+	}
+	return ctx.Err()
+}
+
+// isDraining returns true if the broker stopped accepting new sessions.
+func (b *Broker) isDraining() bool {
+	b.drain.mu.Lock()
+	defer b.drain.mu.Unlock()
+
+	return b.drain.draining
+}
@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/oauth2"
+)
+
+// DryRunResult is what the broker resolved from the token of a dry-run authentication.
+type DryRunResult struct {
+	// Claims are all the claims of the ID token.
+	Claims map[string]any
+	// UserInfo is the user info which would be returned to authd, with its groups.
+	UserInfo info.User
+	// GroupsAllowed is false if allowed_groups is configured and the user is not a member of any allowed group.
+	GroupsAllowed bool
+}
+
+// DryRun authenticates the user with the device code flow of the identity provider selected for the username, and
+// returns what the broker resolved from the token. prompt is called with the URI where the user must enter the code.
+// Neither the token nor the discovery document is cached, and the user is not registered as the owner. If the broker
+// was created with NewReadOnly, nothing else is written to the data directory either, like the GIDs of the groups.
+func (b *Broker) DryRun(ctx context.Context, username string, prompt func(verificationURI, userCode string)) (res DryRunResult, err error) {
+	defer decorate.OnError(&err, "dry-run authentication of user %q failed", username)
+
+	ctx = b.withHTTPClient(ctx)
+
+	b.cfgMu.RLock()
+	p, err := b.cfg.oidcProviderFor(username)
+	b.cfgMu.RUnlock()
+	if err != nil {
+		return res, err
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, b.cfg.requestTimeout())
+	defer cancel()
+	oidcServer, err := oidc.NewProvider(reqCtx, p.issuerURL)
+	if err != nil {
+		return res, fmt.Errorf("could not connect to the provider: %w", authError(err))
+	}
+	if oidcServer.Endpoint().DeviceAuthURL == "" {
+		return res, errors.New("the provider does not support the device code flow")
+	}
+
+	s := session{
+		username:        username,
+		issuerURL:       p.issuerURL,
+		provider:        p.provider,
+		acceptedIssuers: p.acceptedIssuers,
+		authParams:      p.authParams,
+		clientAuth:      p.clientAuth,
+		jwksFile:        p.jwksFile,
+		tokenAudience:   p.tokenAudience,
+		oidcServer:      oidcServer,
+		oauth2Config:    p.clientConfig(oidcServer.Endpoint(), b.scopes(p)),
+	}
+	reqCtx = withClientAssertion(reqCtx, &s)
+	ctx = withClientAssertion(ctx, &s)
+
+	// Same client_secret_post workaround as when generating the device code layout.
+	var authOpts []oauth2.AuthCodeOption
+	if secret := s.oauth2Config.ClientSecret; secret != "" {
+		authOpts = append(authOpts, oauth2.SetAuthURLParam("client_secret", secret))
+	}
+	authOpts = append(authOpts, b.maxAgeAuthOptions()...)
+	authOpts = append(authOpts, b.loginHintAuthOptions(username)...)
+	authOpts = append(authOpts, authParamsAuthOptions(p.authParams)...)
+	authOpts = append(authOpts, tokenAudienceAuthOptions(p.tokenAudience, s.oauth2Config.Endpoint)...)
+	response, err := s.oauth2Config.DeviceAuth(reqCtx, authOpts...)
+	if err != nil {
+		return res, fmt.Errorf("could not get a device code: %w", authError(err))
+	}
+	prompt(response.VerificationURI, response.UserCode)
+
+	if response.Expiry.IsZero() {
+		response.Expiry = time.Now().Add(time.Hour)
+	}
+	expiryCtx, cancel := context.WithDeadline(ctx, response.Expiry)
+	defer cancel()
+	tokenOpts := slices.Concat(p.provider.AuthOptions(), tokenAudienceAuthOptions(p.tokenAudience, s.oauth2Config.Endpoint))
+	t, err := s.oauth2Config.DeviceAccessToken(expiryCtx, b.withPollJitter(response), tokenOpts...)
+	if err != nil {
+		if deviceCodeExpired(err, response.Expiry) {
+			err = fmt.Errorf("%w: %w", ErrDeviceCodeExpired, err)
+		}
+		return res, fmt.Errorf("could not authenticate user remotely: %w", authError(err))
+	}
+
+	// The token is checked like on login, including the required authentication context, verified email and maximum
+	// age of the authentication.
+	authInfo, data := b.authInfoFromToken(ctx, &s, t)
+	if msg, ok := data.(errorMessage); ok {
+		return res, errors.New(msg.Message)
+	}
+	userInfo := authInfo.UserInfo
+
+	idToken, err := parseVerifiedIDToken(authInfo.RawIDToken)
+	if err != nil {
+		return res, err
+	}
+	if err := idToken.Claims(&res.Claims); err != nil {
+		return res, fmt.Errorf("could not get ID token claims: %v", err)
+	}
+
+	res.GroupsAllowed = b.userGroupsAreAllowed(userInfo.Groups)
+	if res.UserInfo, err = b.userInfoForLogin(userInfo, s.issuerURL); err != nil {
+		return res, err
+	}
+	return res, nil
+}
@@ -6,16 +6,15 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"log/slog"
 )
 
-// decodeRawChallenge extract the base64 challenge and try to decrypt it with the private key.
-func decodeRawChallenge(priv *rsa.PrivateKey, rawChallenge string) (decoded string, err error) {
+// decodeRawChallenge extract the base64 challenge and try to decrypt it with the broker private key.
+func (b *Broker) decodeRawChallenge(rawChallenge string) (decoded string, err error) {
 	defer func() {
 		// Override the error so that we don't leak information. Also, abstract it for the user.
 		// We still log as error for the admin to get access.
 		if err != nil {
-			slog.Error(fmt.Sprintf("Error when decoding challenge: %v", err))
+			b.logger.Error(fmt.Sprintf("Error when decoding challenge: %v", err))
 			err = errors.New("could not decode challenge")
 		}
 	}()
@@ -29,7 +28,7 @@ func decodeRawChallenge(priv *rsa.PrivateKey, rawChallenge string) (decoded stri
 		return "", err
 	}
 
-	plaintext, err := rsa.DecryptOAEP(sha512.New(), nil, priv, ciphertext, nil)
+	plaintext, err := rsa.DecryptOAEP(sha512.New(), nil, b.privateKey, ciphertext, nil)
 	if err != nil {
 		return "", fmt.Errorf("could not decrypt challenge: %v", err)
 	}
@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Errors of the failed authentications. They wrap the error which caused the failure, so that both can be matched
+// with errors.Is.
+var (
+	// ErrProviderUnreachable is the error of the failures caused by the provider not being reachable.
+	ErrProviderUnreachable = errors.New("the provider is not reachable")
+	// ErrInvalidGrant is the error of the failures caused by the provider rejecting the grant, e.g. an expired or
+	// revoked refresh token.
+	ErrInvalidGrant = errors.New("the provider rejected the grant")
+	// ErrUserRemoved is the error of the failures caused by the account of the user not existing at the provider
+	// anymore. The failures are also caused by ErrInvalidGrant, as it is how the providers report it.
+	ErrUserRemoved = errors.New("the account of the user does not exist at the provider anymore")
+	// ErrNotInAllowedGroup is the error of the failures caused by the user not being a member of any allowed group.
+	ErrNotInAllowedGroup = errors.New("the user is not a member of any allowed group")
+	// ErrDeviceCodeExpired is the error of the failures caused by the user not entering the device code in time.
+	ErrDeviceCodeExpired = errors.New("the device code expired")
+	// ErrAccessDenied is the error of the failures caused by the user declining the authorization request of the device
+	// code at the provider.
+	ErrAccessDenied = errors.New("the user declined the authorization request")
+	// ErrTooManyAttempts is the error of the failures caused by the user being locked out of the local password mode.
+	ErrTooManyAttempts = errors.New("too many failed attempts")
+)
+
+// authErrors are all the errors of the failed authentications.
+var authErrors = []error{ErrProviderUnreachable, ErrInvalidGrant, ErrUserRemoved, ErrNotInAllowedGroup, ErrDeviceCodeExpired, ErrAccessDenied, ErrTooManyAttempts}
+
+// authError returns err wrapped in the error of the authentication failures it causes, if it is a known cause and it
+// is not wrapped in one already.
+func authError(err error) error {
+	if err == nil || slices.ContainsFunc(authErrors, func(target error) bool { return errors.Is(err, target) }) {
+		return err
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		switch retrieveErr.ErrorCode {
+		case "invalid_grant":
+			if userRemoved(retrieveErr) {
+				return fmt.Errorf("%w: %w: %w", ErrInvalidGrant, ErrUserRemoved, err)
+			}
+			return fmt.Errorf("%w: %w", ErrInvalidGrant, err)
+		case "access_denied":
+			return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrProviderUnreachable, err)
+	}
+
+	return err
+}
+
+// userRemovedMarkers are the parts of the descriptions of the invalid_grant errors with which the providers tell that
+// the user of the grant does not exist anymore, rather than that the grant expired or was revoked. There is no error
+// code for it in OAuth 2.0, so they are matched case-insensitively.
+var userRemovedMarkers = []string{
+	"user not found",
+	"unknown user",
+	"user does not exist",
+	// Microsoft Entra ID: the user account does not exist in the directory.
+	"aadsts50034",
+}
+
+// userRemoved returns true if the provider rejected the grant because its user does not exist anymore.
+func userRemoved(err *oauth2.RetrieveError) bool {
+	description := strings.ToLower(err.ErrorDescription)
+	return slices.ContainsFunc(userRemovedMarkers, func(marker string) bool { return strings.Contains(description, marker) })
+}
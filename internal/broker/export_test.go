@@ -2,12 +2,22 @@ package broker
 
 import (
 	"context"
+	"encoding/json"
+	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/ubuntu/authd-oidc-brokers/internal/password"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
 	tokenPkg "github.com/ubuntu/authd-oidc-brokers/internal/token"
 )
 
+func init() {
+	// Do not depend on the login shells and the machine ID of the machine running the tests.
+	shellsFile = "testdata/shells/shells"
+	machineIDFile = "testdata/machine-id"
+}
+
 func (cfg *Config) Init() {
 	cfg.ownerMutex = &sync.RWMutex{}
 }
@@ -16,14 +26,65 @@ func (cfg *Config) SetClientID(clientID string) {
 	cfg.clientID = clientID
 }
 
+// SetClientAuth sets how the broker authenticates as the client to the provider of the [oidc] section.
+func (cfg *Config) SetClientAuth(clientSecret, method, keyFile, keyID string) {
+	cfg.clientSecret = clientSecret
+	cfg.clientAuth = clientAuth{method: method, keyFile: keyFile, keyID: keyID}
+}
+
+// SetClientType sets which client of the provider of the [oidc] section the broker authenticates as.
+func (cfg *Config) SetClientType(clientType, publicClientID string) {
+	cfg.clientType = clientType
+	cfg.publicClientID = publicClientID
+}
+
 func (cfg *Config) SetIssuerURL(issuerURL string) {
 	cfg.issuerURL = issuerURL
 }
 
+// AddOIDCProvider adds a named identity provider authenticating the users of the given domains.
+func (cfg *Config) AddOIDCProvider(name, issuerURL, clientID string, domains []string) {
+	cfg.oidcProviders = append(cfg.oidcProviders, oidcProvider{name: name, issuerURL: issuerURL, clientID: clientID, domains: domains})
+}
+
 func (cfg *Config) SetHomeBaseDir(homeBaseDir string) {
 	cfg.homeBaseDir = homeBaseDir
 }
 
+func (cfg *Config) SetUIDRange(minUID, maxUID uint32) {
+	cfg.uidMin = minUID
+	cfg.uidMax = maxUID
+}
+
+func (cfg *Config) SetSkelDir(skelDir string) {
+	cfg.skelDir = skelDir
+}
+
+func (cfg *Config) SetOnUserRemoval(onUserRemoval, archiveDir string) {
+	cfg.onUserRemoval = onUserRemoval
+	cfg.userRemovalArchiveDir = archiveDir
+}
+
+func (cfg *Config) SetHomeDirTemplate(homeDirTemplate string) {
+	cfg.homeDirTemplate = homeDirTemplate
+}
+
+func (cfg *Config) SetShells(defaultShell string, groupShells map[string]string) {
+	cfg.defaultShell = defaultShell
+	cfg.groupShells = groupShells
+}
+
+func (cfg *Config) SetGroupsClaim(claim, scope, nameField string) {
+	cfg.groupsClaim = claim
+	cfg.groupScope = scope
+	cfg.groupsClaimNameField = nameField
+}
+
+func (cfg *Config) SetGroupNames(template, separator string) {
+	cfg.groupNameTemplate = template
+	cfg.groupNameSeparator = separator
+}
+
 func (cfg *Config) SetAllowedUsers(allowedUsers map[string]struct{}) {
 	cfg.allowedUsers = allowedUsers
 }
@@ -57,6 +118,189 @@ func (cfg *Config) SetAllowedSSHSuffixes(allowedSSHSuffixes []string) {
 	cfg.allowedSSHSuffixes = allowedSSHSuffixes
 }
 
+func (cfg *Config) SetExtraScopes(extraScopes []string) {
+	cfg.extraScopes = extraScopes
+}
+
+func (cfg *Config) SetAllowedGroups(allowedGroups map[string]struct{}, caseSensitive bool) {
+	cfg.allowedGroups = allowedGroups
+	cfg.allowedGroupsCaseSensitive = caseSensitive
+}
+
+func (cfg *Config) SetAdminUsers(adminUsers map[string]struct{}, ownerIsAdmin bool, adminGroup string) {
+	cfg.adminUsers = adminUsers
+	cfg.ownerIsAdmin = ownerIsAdmin
+	cfg.adminGroup = adminGroup
+}
+
+func (cfg *Config) SetAlwaysGroups(alwaysGroups []string) {
+	cfg.alwaysGroups = alwaysGroups
+}
+
+func (cfg *Config) SetOnGroupFetchError(policy string) {
+	cfg.onGroupFetchError = policy
+}
+
+func (cfg *Config) SetGroupSyncMode(mode string) {
+	cfg.groupSyncMode = mode
+}
+
+func (cfg *Config) SetGIDRange(minGID, maxGID uint32) {
+	cfg.gidMin = minGID
+	cfg.gidMax = maxGID
+}
+
+func (cfg *Config) SetUsernameCollision(strategy string) {
+	cfg.usernameCollision = strategy
+}
+
+func (cfg *Config) SetPasswordPolicy(policy password.Policy) {
+	cfg.passwordPolicy = policy
+}
+
+func (cfg *Config) SetPasswordThrottle(maxFailedAttempts int, window, lockout time.Duration) {
+	cfg.maxFailedAttempts = maxFailedAttempts
+	cfg.failedAttemptsWindow = window
+	cfg.lockoutDuration = lockout
+}
+
+func (cfg *Config) SetOfflineCredentialTTL(ttl time.Duration) {
+	cfg.offlineCredentialTTL = ttl
+	cfg.hasOfflineCredentialTTL = true
+}
+
+func (cfg *Config) SetDiscoveryCacheTTL(ttl time.Duration) {
+	cfg.discoveryCacheTTL = ttl
+}
+
+func (cfg *Config) SetAllowedClockSkew(skew time.Duration) {
+	cfg.allowedClockSkew = skew
+}
+
+func (cfg *Config) SetDeviceAuthMaxWait(maxWait time.Duration) {
+	cfg.deviceAuthMaxWait = maxWait
+}
+
+func (cfg *Config) SetPollJitter(jitter time.Duration) {
+	cfg.pollJitter = jitter
+}
+
+func (cfg *Config) SetSendLoginHint(sendLoginHint bool) {
+	cfg.sendLoginHint = sendLoginHint
+}
+
+func (cfg *Config) SetDisablePassword(disablePassword bool) {
+	cfg.disablePassword = disablePassword
+}
+
+func (cfg *Config) SetRevokeOnLogout(revokeOnLogout bool) {
+	cfg.revokeOnLogout = revokeOnLogout
+}
+
+func (cfg *Config) SetTokenValidation(tokenValidation string) {
+	cfg.tokenValidation = tokenValidation
+}
+
+// SetRequireVerifiedEmail sets whether the email_verified claim of the ID token must be true, and whether it can be
+// missing.
+func (cfg *Config) SetRequireVerifiedEmail(require, allowMissing bool) {
+	cfg.requireVerifiedEmail = require
+	cfg.allowMissingVerified = allowMissing
+}
+
+func (cfg *Config) SetRequiredAuthenticationContext(requiredAMR, requiredACR []string) {
+	cfg.requiredAMR = requiredAMR
+	cfg.requiredACR = requiredACR
+}
+
+func (cfg *Config) SetAcceptedIssuers(issuers []string) {
+	cfg.acceptedIssuers = issuers
+}
+
+func (cfg *Config) SetAuthParams(params map[string]string) {
+	cfg.authParams = params
+}
+
+func (cfg *Config) SetJWKSFile(path string) {
+	cfg.jwksFile = path
+}
+
+func (cfg *Config) SetTokenAudience(audience string) {
+	cfg.tokenAudience = audience
+}
+
+func (cfg *Config) SetHooks(onFirstLogin, onLogin []string, blockLoginOnFailure bool) {
+	cfg.onFirstLogin = onFirstLogin
+	cfg.onLogin = onLogin
+	cfg.blockLoginOnHookFailure = blockLoginOnFailure
+}
+
+func (cfg *Config) SetAuthModeOrder(order []string) {
+	cfg.authModeOrder = order
+}
+
+func (cfg *Config) SetMaxAge(maxAge time.Duration) {
+	cfg.maxAge = maxAge
+}
+
+func (cfg *Config) SetUsernameClaim(claim string, stripDomain bool) {
+	cfg.usernameClaim = claim
+	cfg.usernameStripDomain = stripDomain
+}
+
+func (cfg *Config) SetGroupsCacheTTL(ttl time.Duration) {
+	cfg.groupsCacheTTL = ttl
+}
+
+func (cfg *Config) SetCapabilityProbe(capabilityProbe string) {
+	cfg.capabilityProbe = capabilityProbe
+}
+
+func (cfg *Config) SetPersistSessions(persistSessions bool) {
+	cfg.persistSessions = persistSessions
+}
+
+func (cfg *Config) SetAuditLog(path string, maxSize, maxFiles int) {
+	cfg.auditLog = path
+	cfg.auditLogMaxSize = maxSize
+	cfg.auditLogMaxFiles = maxFiles
+}
+
+func (cfg *Config) SetSessionLimits(maxSessions int, idleTimeout time.Duration) {
+	cfg.maxSessions = maxSessions
+	cfg.sessionIdleTimeout = idleTimeout
+}
+
+func (cfg *Config) SetTLSSettings(caCertFile string, insecureSkipVerify bool) {
+	cfg.caCertFile = caCertFile
+	cfg.insecureSkipVerify = insecureSkipVerify
+}
+
+func (cfg *Config) SetMinTLSVersion(version uint16) {
+	cfg.minTLSVersion = version
+}
+
+func (cfg *Config) SetProxy(httpProxy, noProxy string) {
+	cfg.httpProxy = httpProxy
+	cfg.noProxy = noProxy
+}
+
+func (cfg *Config) SetHTTPRetries(retries int) {
+	cfg.httpRetries = retries
+}
+
+func (cfg *Config) SetCacheEncryption(cacheEncryption string) {
+	cfg.cacheEncryption = cacheEncryption
+}
+
+func (cfg *Config) SetCacheEncryptionKeyFile(keyFile string) {
+	cfg.cacheEncryptionKeyFile = keyFile
+}
+
+func (cfg *Config) SetTokenStore(tokenStore string) {
+	cfg.tokenStore = tokenStore
+}
+
 func (cfg *Config) SetProvider(provider provider) {
 	cfg.provider = provider
 }
@@ -69,6 +313,15 @@ func (cfg *Config) IssuerURL() string {
 	return cfg.issuerURL
 }
 
+// LastLoginFileName is the name of the file where the last login of a user is recorded.
+const LastLoginFileName = lastLoginFileName
+
+// FirstLoginFileName is the name of the file where the first login of a user is recorded.
+const FirstLoginFileName = firstLoginFileName
+
+// UsernamesFileName is the name of the file, in the data directory, where the usernames of the users are stored.
+const UsernamesFileName = usernamesFileName
+
 // TokenPathForSession returns the path to the token file for the given session.
 func (b *Broker) TokenPathForSession(sessionID string) string {
 	b.currentSessionsMu.Lock()
@@ -79,7 +332,11 @@ func (b *Broker) TokenPathForSession(sessionID string) string {
 		return ""
 	}
 
-	return session.tokenPath
+	store, ok := b.tokenStore.(*FileTokenStore)
+	if !ok {
+		return ""
+	}
+	return store.Path(session.issuerURL, session.username)
 }
 
 // PasswordFilepathForSession returns the path to the password file for the given session.
@@ -108,6 +365,56 @@ func (b *Broker) UserDataDirForSession(sessionID string) string {
 	return session.userDataDir
 }
 
+// ScopesForSession returns the scopes requested for the given session.
+func (b *Broker) ScopesForSession(sessionID string) []string {
+	session, err := b.getSession(sessionID)
+	if err != nil {
+		return nil
+	}
+
+	return session.oauth2Config.Scopes
+}
+
+// ClientIDForSession returns the client ID used by the given session.
+func (b *Broker) ClientIDForSession(sessionID string) string {
+	session, err := b.getSession(sessionID)
+	if err != nil {
+		return ""
+	}
+
+	return session.oauth2Config.ClientID
+}
+
+// IssuerURLForSession returns the issuer of the provider selected for the given session.
+func (b *Broker) IssuerURLForSession(sessionID string) string {
+	session, err := b.getSession(sessionID)
+	if err != nil {
+		return ""
+	}
+
+	return session.issuerURL
+}
+
+// TokenURLForSession returns the token endpoint used by the given session.
+func (b *Broker) TokenURLForSession(sessionID string) string {
+	session, err := b.getSession(sessionID)
+	if err != nil {
+		return ""
+	}
+
+	return session.oauth2Config.Endpoint.TokenURL
+}
+
+// DiscoveryCachePath returns the path to the cached discovery document of the issuer.
+func (b *Broker) DiscoveryCachePath() string {
+	return filepath.Join(b.cfg.DataDir, issuerDirName(b.cfg.issuerURL)+discoveryCacheSuffix)
+}
+
+// JWKSCachePath returns the path to the cached signing keys of the issuer.
+func (b *Broker) JWKSCachePath() string {
+	return filepath.Join(b.cfg.DataDir, issuerDirName(b.cfg.issuerURL)+jwksCacheSuffix)
+}
+
 // DataDir returns the path to the data directory for tests.
 func (b *Broker) DataDir() string {
 	return b.cfg.DataDir
@@ -152,6 +459,76 @@ func (b *Broker) SetAvailableMode(sessionID, mode string) error {
 	return b.updateSession(sessionID, s)
 }
 
+// GroupGID returns the GID derived for the group with the given UGID, from the provider with the given issuer.
+func (cfg *Config) GroupGID(issuerURL, ugid string) uint32 {
+	return cfg.groupGID(issuerURL, ugid)
+}
+
+// SubjectUID returns the UID derived from the subject of the user of the provider with the given issuer.
+func (cfg *Config) SubjectUID(issuerURL, subject string) uint32 {
+	return cfg.subjectUID(issuerURL, subject)
+}
+
+// AssignUID exposes assignUID for tests, for the user with the given subject and username.
+func (b *Broker) AssignUID(issuerURL, subject, username string) (uint32, error) {
+	return b.assignUID(issuerURL, info.User{Name: username, UUID: subject})
+}
+
+// AssignGIDs exposes withGIDs for tests, for the groups with the given UGIDs and names.
+func (b *Broker) AssignGIDs(issuerURL string, groups []info.Group) ([]info.Group, error) {
+	u, err := b.withGIDs(info.User{Groups: groups}, issuerURL)
+	return u.Groups, err
+}
+
+// StoreUsername stores the username of the user with the given subject, as if they were granted access.
+func (b *Broker) StoreUsername(issuerURL, subject, username string) error {
+	m, err := b.loadUsernameMappings()
+	if err != nil {
+		return err
+	}
+	if m[issuerURL] == nil {
+		m[issuerURL] = make(map[string]string)
+	}
+	m[issuerURL][subject] = username
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return tokenPkg.StoreData(b.usernamesPath(), data)
+}
+
+// StoredUsername returns the stored username of the user with the given subject, if any.
+func (b *Broker) StoredUsername(issuerURL, subject string) (string, error) {
+	m, err := b.loadUsernameMappings()
+	if err != nil {
+		return "", err
+	}
+	return m[issuerURL][subject], nil
+}
+
+// CheckIDTokenTimes exposes checkIDTokenTimes for tests.
+func CheckIDTokenTimes(rawIDToken string, now time.Time, skew time.Duration) error {
+	idToken, err := parseVerifiedIDToken(rawIDToken)
+	if err != nil {
+		return err
+	}
+	return checkIDTokenTimes(idToken, now, skew)
+}
+
+// VerifyWithCachedKeySet verifies the signature of the JWT with the signing keys cached in cachePath and fetched from
+// jwksURL.
+func VerifyWithCachedKeySet(jwksURL, cachePath string, refreshInterval time.Duration, jwt string) error {
+	keySet := cachedKeySet{jwksURL: jwksURL, cachePath: cachePath, refreshInterval: refreshInterval, timeout: maxRequestDuration}
+	_, err := keySet.VerifySignature(context.Background(), jwt)
+	return err
+}
+
+// CheckOfflineCredentials exposes the broker's checkOfflineCredentials method for tests.
+func (b *Broker) CheckOfflineCredentials(authInfo tokenPkg.AuthCachedInfo, now time.Time) error {
+	return b.checkOfflineCredentials(authInfo, now)
+}
+
 // FetchUserInfo exposes the broker's fetchUserInfo method for tests.
 func (b *Broker) FetchUserInfo(sessionID string, token *tokenPkg.AuthCachedInfo) (info.User, error) {
 	s, err := b.getSession(sessionID)
@@ -167,6 +544,19 @@ func (b *Broker) FetchUserInfo(sessionID string, token *tokenPkg.AuthCachedInfo)
 	return uInfo, err
 }
 
+// IsAuthenticatedCause calls IsAuthenticated and returns the cause of the failure, if it failed, instead of the data
+// sent to authd.
+func (b *Broker) IsAuthenticatedCause(sessionID, authenticationData string) (string, error) {
+	access, data, err := b.isAuthenticated(sessionID, authenticationData)
+	if err != nil {
+		return access, err
+	}
+	if msg, ok := data.(errorMessage); ok {
+		return access, msg.err
+	}
+	return access, nil
+}
+
 // IsOffline returns whether the given session is offline or an error if the session does not exist.
 func (b *Broker) IsOffline(sessionID string) (bool, error) {
 	session, err := b.getSession(sessionID)
@@ -178,3 +568,18 @@ func (b *Broker) IsOffline(sessionID string) (bool, error) {
 
 // MaxRequestDuration exposes the broker's maxRequestDuration for tests.
 const MaxRequestDuration = maxRequestDuration
+
+// CheckAuthenticationContext exposes checkAuthenticationContext for tests.
+func (b *Broker) CheckAuthenticationContext(rawIDToken string) error {
+	return b.checkAuthenticationContext(rawIDToken)
+}
+
+// CheckEmailVerified exposes checkEmailVerified for tests.
+func (b *Broker) CheckEmailVerified(rawIDToken string) error {
+	return b.checkEmailVerified(rawIDToken)
+}
+
+// CheckAuthTime exposes checkAuthTime for tests.
+func (b *Broker) CheckAuthTime(rawIDToken string, now time.Time) error {
+	return b.checkAuthTime(rawIDToken, now)
+}
@@ -0,0 +1,127 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+)
+
+// gidsFileName is the name of the file, in the data directory, where the GIDs assigned to the groups are stored.
+const gidsFileName = "gids.json"
+
+// parseIDRange parses a range of UIDs or GIDs, as told by kind, written as "<min>-<max>", both included.
+func parseIDRange(value, kind string) (uint32, uint32, error) {
+	minStr, maxStr, ok := strings.Cut(value, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not of the form <min>-<max>", value)
+	}
+	minID, err := strconv.ParseUint(strings.TrimSpace(minStr), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid minimum %s: %v", kind, err)
+	}
+	maxID, err := strconv.ParseUint(strings.TrimSpace(maxStr), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid maximum %s: %v", kind, err)
+	}
+
+	// ID 0 is root's, and the highest ID is the -1 which means "no user" or "no group" in the system calls.
+	if minID == 0 {
+		return 0, 0, fmt.Errorf("the minimum %s must be greater than 0", kind)
+	}
+	if maxID == math.MaxUint32 {
+		return 0, 0, fmt.Errorf("the maximum %s must be lower than %d", kind, uint64(math.MaxUint32))
+	}
+	if minID > maxID {
+		return 0, 0, fmt.Errorf("the minimum %s %d is greater than the maximum %s %d", kind, minID, kind, maxID)
+	}
+	return uint32(minID), uint32(maxID), nil
+}
+
+// groupGID returns the GID derived for the group with the given UGID, from the provider with the given issuer. It is
+// derived from the issuer and the UGID, so that it is the same on every login and every machine, and groups with the
+// same name from different providers get different GIDs. It returns 0 if no GID range is configured.
+func (uc userConfig) groupGID(issuerURL, ugid string) uint32 {
+	if uc.gidMax == 0 {
+		return 0
+	}
+
+	sum := sha256.Sum256([]byte(issuerURL + "#" + ugid))
+	size := uint64(uc.gidMax-uc.gidMin) + 1
+	return uc.gidMin + uint32(binary.BigEndian.Uint64(sum[:8])%size)
+}
+
+// gidsPath returns the path of the file where the GIDs assigned to the groups are stored.
+func (b *Broker) gidsPath() string {
+	return filepath.Join(b.cfg.DataDir, gidsFileName)
+}
+
+// withGIDs returns the user info with the GIDs of the groups returned by the provider with the given issuer, if a GID
+// range is configured. The local groups, which have no UGID, already exist on the machine and keep their own GIDs.
+//
+// The GID of a group is the one derived from its UGID, unless it is already assigned to another group or used by
+// another local group, in which case the next free GID of the range is assigned, going back to its start after its
+// end. The GIDs are stored, so that the groups keep them, unless the broker is read-only.
+func (b *Broker) withGIDs(userInfo info.User, issuerURL string) (info.User, error) {
+	if b.cfg.gidMax == 0 {
+		return userInfo, nil
+	}
+
+	b.gidsMu.Lock()
+	defer b.gidsMu.Unlock()
+
+	m, err := loadIDMappings(b.gidsPath())
+	if err != nil {
+		return userInfo, err
+	}
+
+	var assigned bool
+	groups := make([]info.Group, 0, len(userInfo.Groups))
+	for _, group := range userInfo.Groups {
+		if group.UGID == "" {
+			groups = append(groups, group)
+			continue
+		}
+
+		gid, ok := m[issuerURL][group.UGID]
+		if !ok {
+			gid, ok = nextFreeID(b.cfg.groupGID(issuerURL, group.UGID), b.cfg.gidMin, b.cfg.gidMax, func(gid uint32) bool {
+				return gidIsUsed(m, gid, group.Name)
+			})
+			if !ok {
+				return userInfo, fmt.Errorf("all the GIDs from %d to %d are already used", b.cfg.gidMin, b.cfg.gidMax)
+			}
+			m.assign(issuerURL, group.UGID, gid)
+			assigned = true
+		}
+		group.GID = gid
+		groups = append(groups, group)
+	}
+
+	if assigned && !b.readOnly {
+		if err := storeIDMappings(b.gidsPath(), m); err != nil {
+			return userInfo, err
+		}
+	}
+	userInfo.Groups = groups
+	return userInfo, nil
+}
+
+// gidIsUsed returns true if the GID is assigned to another group, or if it is the GID of a local group other than the
+// group with the given name, e.g. one created before the GIDs were stored.
+func gidIsUsed(m idMappings, gid uint32, name string) bool {
+	if m.isAssigned(gid) {
+		return true
+	}
+	g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10))
+	if err != nil {
+		return false
+	}
+	return g.Name != name
+}
@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// groupScopeIDToken reads the groups claim from the ID token.
+	groupScopeIDToken = "id_token"
+	// groupScopeUserInfo reads the groups claim from the response of the userinfo endpoint.
+	groupScopeUserInfo = "userinfo"
+
+	// defaultGroupsClaimNameField is the field holding the group name, when the groups claim lists objects.
+	defaultGroupsClaimNameField = "name"
+
+	// localGroupPrefix is the prefix of the names of the groups which are local to the machine.
+	localGroupPrefix = "linux-"
+)
+
+// groupsFromClaim returns the groups listed in the configured groups claim, read from the ID token or the userinfo
+// endpoint, and false if the claim is absent.
+func (b *Broker) groupsFromClaim(ctx context.Context, session *session, accessToken *oauth2.Token, idToken *oidc.IDToken) ([]info.Group, bool, error) {
+	var claims map[string]json.RawMessage
+	if b.cfg.groupScope == groupScopeUserInfo {
+		userInfo, err := session.oidcServer.UserInfo(ctx, oauth2.StaticTokenSource(accessToken))
+		if err != nil {
+			return nil, false, fmt.Errorf("could not get user info from the provider: %v", err)
+		}
+		if err := userInfo.Claims(&claims); err != nil {
+			return nil, false, fmt.Errorf("could not get user info claims: %v", err)
+		}
+	} else if err := idToken.Claims(&claims); err != nil {
+		return nil, false, fmt.Errorf("could not get ID token claims: %v", err)
+	}
+
+	rawGroups, ok := claims[b.cfg.groupsClaim]
+	if !ok {
+		return nil, false, nil
+	}
+
+	nameField := b.cfg.groupsClaimNameField
+	if nameField == "" {
+		nameField = defaultGroupsClaimNameField
+	}
+	groups, err := parseGroupsClaim(rawGroups, nameField)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid %q claim: %v", b.cfg.groupsClaim, err)
+	}
+	return groups, true, nil
+}
+
+// parseGroupsClaim returns the groups of a claim listing either their names, or objects with their name in nameField.
+// The names are also used as the UGIDs, except for the local groups, which have none.
+func parseGroupsClaim(rawGroups json.RawMessage, nameField string) ([]info.Group, error) {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(rawGroups, &elems); err != nil {
+		return nil, fmt.Errorf("not an array: %v", err)
+	}
+
+	groups := []info.Group{}
+	for _, elem := range elems {
+		var name string
+		if err := json.Unmarshal(elem, &name); err != nil {
+			var obj map[string]any
+			if err := json.Unmarshal(elem, &obj); err != nil {
+				return nil, fmt.Errorf("group %s is neither a string nor an object", elem)
+			}
+			name, _ = obj[nameField].(string)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("group %s has no name", elem)
+		}
+
+		groupName := strings.ToLower(name)
+		if strings.HasPrefix(groupName, localGroupPrefix) {
+			groups = append(groups, info.Group{Name: strings.TrimPrefix(groupName, localGroupPrefix)})
+			continue
+		}
+		groups = append(groups, info.Group{Name: groupName, UGID: groupName})
+	}
+	return groups, nil
+}
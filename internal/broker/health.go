@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Health is the status of the connection of the broker to the identity provider.
+type Health struct {
+	// LastDiscovery is when the broker last fetched a discovery document, or the zero time if it never did.
+	LastDiscovery time.Time
+	// LastDiscoveryErr is the error of the last fetch of a discovery document, or nil if it succeeded.
+	LastDiscoveryErr error
+	// DiscoveryCacheAge is the age of the cached discovery document of the default issuer, or a negative duration if
+	// none is cached.
+	DiscoveryCacheAge time.Duration
+	// Capabilities are the results of the check of the capabilities of the providers when the broker started, or nil
+	// if they were not checked.
+	Capabilities []ProviderCapabilities
+}
+
+// discoveryStatus is the outcome of the last fetch of a discovery document by any session.
+type discoveryStatus struct {
+	mu      sync.Mutex
+	fetched time.Time
+	err     error
+}
+
+// record stores the outcome of a fetch of a discovery document which returned err.
+func (s *discoveryStatus) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fetched = time.Now()
+	s.err = err
+}
+
+// Health returns whether the broker could reach the identity provider the last time it tried, and how old the cached
+// discovery document of the default issuer is.
+func (b *Broker) Health() Health {
+	b.discovery.mu.Lock()
+	h := Health{LastDiscovery: b.discovery.fetched, LastDiscoveryErr: b.discovery.err, DiscoveryCacheAge: -1}
+	b.discovery.mu.Unlock()
+
+	b.cfgMu.RLock()
+	cachePath := filepath.Join(b.cfg.DataDir, issuerDirName(b.cfg.defaultIssuerURL())+discoveryCacheSuffix)
+	b.cfgMu.RUnlock()
+
+	if fi, err := os.Stat(cachePath); err == nil {
+		h.DiscoveryCacheAge = time.Since(fi.ModTime())
+	}
+
+	b.capabilitiesMu.Lock()
+	h.Capabilities = slices.Clone(b.capabilities)
+	b.capabilitiesMu.Unlock()
+	return h
+}
@@ -1,11 +1,15 @@
 package broker_test
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -14,6 +18,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
 	"github.com/ubuntu/authd-oidc-brokers/internal/broker"
+	"github.com/ubuntu/authd-oidc-brokers/internal/password"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
 	"github.com/ubuntu/authd-oidc-brokers/internal/testutils"
@@ -24,19 +29,91 @@ import (
 type brokerForTestConfig struct {
 	broker.Config
 	issuerURL             string
+	clientSecret          string
+	clientAuth            string
+	clientType            string
+	publicClientID        string
+	clientKeyFile         string
+	clientKeyID           string
 	allowedUsers          map[string]struct{}
 	allUsersAllowed       bool
 	ownerAllowed          bool
 	firstUserBecomesOwner bool
 	owner                 string
 	homeBaseDir           string
+	homeDirTemplate       string
+	skelDir               string
+	onUserRemoval         string
+	userRemovalArchiveDir string
 	allowedSSHSuffixes    []string
+	extraScopes           []string
+	allowedGroups         map[string]struct{}
+	groupsCaseSensitive   bool
+	adminUsers            map[string]struct{}
+	ownerIsAdmin          bool
+	adminGroup            string
+	alwaysGroups          []string
+	onGroupFetchError     string
+	groupSyncMode         string
+	requiredAMR           []string
+	requireVerifiedEmail  bool
+	allowMissingVerified  bool
+	requiredACR           []string
+	maxAge                time.Duration
+	authModeOrder         []string
+	acceptedIssuers       []string
+	authParams            map[string]string
+	jwksFile              string
+	tokenAudience         string
+	onFirstLogin          []string
+	onLogin               []string
+	blockLoginOnHook      bool
+	gidRange              [2]uint32
+	uidRange              [2]uint32
+	usernameCollision     string
+	passwordPolicy        *password.Policy
+	maxFailedAttempts     int
+	failedAttemptsWindow  time.Duration
+	lockoutDuration       time.Duration
+	httpRetries           int
+	offlineCredentialTTL  *time.Duration
+	discoveryCacheTTL     time.Duration
+	groupsCacheTTL        time.Duration
+	allowedClockSkew      time.Duration
+	deviceAuthMaxWait     time.Duration
+	pollJitter            time.Duration
+	sendLoginHint         bool
+	disablePassword       bool
+	revokeOnLogout        bool
+	tokenValidation       string
+	maxSessions           int
+	sessionIdleTimeout    time.Duration
+	persistSessions       bool
+	auditLog              string
+	auditLogMaxSize       int
+	auditLogMaxFiles      int
+	cacheEncryption       string
+	cacheKeyFile          string
+	defaultShell          string
+	groupShells           map[string]string
+	usernameClaim         string
+	usernameStripDomain   bool
+	groupsClaim           string
+	groupScope            string
+	groupsClaimNameField  string
+	groupNameTemplate     string
+	groupNameSeparator    string
 	provider              providers.Provider
+	tokenStore            broker.TokenStore
+
+	// readOnly creates the broker with NewReadOnly instead of New.
+	readOnly bool
 
 	getUserInfoFails bool
 	firstCallDelay   int
 	secondCallDelay  int
 	getGroupsFunc    func() ([]info.Group, error)
+	webAuthn         bool
 
 	listenAddress       string
 	tokenHandlerOptions *testutils.TokenHandlerOptions
@@ -51,12 +128,147 @@ func newBrokerForTests(t *testing.T, cfg *brokerForTestConfig) (b *broker.Broker
 	if cfg.issuerURL != "" {
 		cfg.SetIssuerURL(cfg.issuerURL)
 	}
+	if cfg.clientSecret != "" || cfg.clientAuth != "" {
+		cfg.SetClientAuth(cfg.clientSecret, cfg.clientAuth, cfg.clientKeyFile, cfg.clientKeyID)
+	}
+	if cfg.clientType != "" || cfg.publicClientID != "" {
+		cfg.SetClientType(cfg.clientType, cfg.publicClientID)
+	}
 	if cfg.homeBaseDir != "" {
 		cfg.SetHomeBaseDir(cfg.homeBaseDir)
 	}
+	if cfg.homeDirTemplate != "" {
+		cfg.SetHomeDirTemplate(cfg.homeDirTemplate)
+	}
+	if cfg.skelDir != "" {
+		cfg.SetSkelDir(cfg.skelDir)
+	}
+	if cfg.onUserRemoval != "" {
+		cfg.SetOnUserRemoval(cfg.onUserRemoval, cfg.userRemovalArchiveDir)
+	}
 	if cfg.allowedSSHSuffixes != nil {
 		cfg.SetAllowedSSHSuffixes(cfg.allowedSSHSuffixes)
 	}
+	if cfg.defaultShell != "" || cfg.groupShells != nil {
+		cfg.SetShells(cfg.defaultShell, cfg.groupShells)
+	}
+	if cfg.usernameClaim != "" || cfg.usernameStripDomain {
+		cfg.SetUsernameClaim(cfg.usernameClaim, cfg.usernameStripDomain)
+	}
+	if cfg.groupsClaim != "" {
+		cfg.SetGroupsClaim(cfg.groupsClaim, cfg.groupScope, cfg.groupsClaimNameField)
+	}
+	if cfg.groupNameTemplate != "" {
+		cfg.SetGroupNames(cfg.groupNameTemplate, cfg.groupNameSeparator)
+	}
+	if cfg.allowedGroups != nil {
+		cfg.SetAllowedGroups(cfg.allowedGroups, cfg.groupsCaseSensitive)
+	}
+	if cfg.adminUsers != nil || cfg.ownerIsAdmin {
+		cfg.SetAdminUsers(cfg.adminUsers, cfg.ownerIsAdmin, cfg.adminGroup)
+	}
+	if cfg.alwaysGroups != nil {
+		cfg.SetAlwaysGroups(cfg.alwaysGroups)
+	}
+	if cfg.onGroupFetchError != "" {
+		cfg.SetOnGroupFetchError(cfg.onGroupFetchError)
+	}
+	if cfg.groupSyncMode != "" {
+		cfg.SetGroupSyncMode(cfg.groupSyncMode)
+	}
+	if cfg.gidRange != [2]uint32{} {
+		cfg.SetGIDRange(cfg.gidRange[0], cfg.gidRange[1])
+	}
+	if cfg.uidRange != [2]uint32{} {
+		cfg.SetUIDRange(cfg.uidRange[0], cfg.uidRange[1])
+	}
+	if cfg.usernameCollision != "" {
+		cfg.SetUsernameCollision(cfg.usernameCollision)
+	}
+	if cfg.passwordPolicy != nil {
+		cfg.SetPasswordPolicy(*cfg.passwordPolicy)
+	}
+	if cfg.httpRetries != 0 {
+		cfg.SetHTTPRetries(cfg.httpRetries)
+	}
+	if cfg.maxFailedAttempts != 0 {
+		cfg.SetPasswordThrottle(cfg.maxFailedAttempts, cfg.failedAttemptsWindow, cfg.lockoutDuration)
+	}
+	if cfg.offlineCredentialTTL != nil {
+		cfg.SetOfflineCredentialTTL(*cfg.offlineCredentialTTL)
+	}
+	if cfg.allowedClockSkew != 0 {
+		cfg.SetAllowedClockSkew(cfg.allowedClockSkew)
+	}
+	if cfg.deviceAuthMaxWait != 0 {
+		cfg.SetDeviceAuthMaxWait(cfg.deviceAuthMaxWait)
+	}
+	if cfg.pollJitter != 0 {
+		cfg.SetPollJitter(cfg.pollJitter)
+	}
+	if cfg.sendLoginHint {
+		cfg.SetSendLoginHint(cfg.sendLoginHint)
+	}
+	if cfg.disablePassword {
+		cfg.SetDisablePassword(cfg.disablePassword)
+	}
+	if cfg.revokeOnLogout {
+		cfg.SetRevokeOnLogout(cfg.revokeOnLogout)
+	}
+	if cfg.tokenValidation != "" {
+		cfg.SetTokenValidation(cfg.tokenValidation)
+	}
+	if cfg.requiredAMR != nil || cfg.requiredACR != nil {
+		cfg.SetRequiredAuthenticationContext(cfg.requiredAMR, cfg.requiredACR)
+	}
+	if cfg.requireVerifiedEmail {
+		cfg.SetRequireVerifiedEmail(cfg.requireVerifiedEmail, cfg.allowMissingVerified)
+	}
+	if cfg.maxAge != 0 {
+		cfg.SetMaxAge(cfg.maxAge)
+	}
+	if cfg.authModeOrder != nil {
+		cfg.SetAuthModeOrder(cfg.authModeOrder)
+	}
+	if cfg.acceptedIssuers != nil {
+		cfg.SetAcceptedIssuers(cfg.acceptedIssuers)
+	}
+	if cfg.jwksFile != "" {
+		cfg.SetJWKSFile(cfg.jwksFile)
+	}
+	if cfg.tokenAudience != "" {
+		cfg.SetTokenAudience(cfg.tokenAudience)
+	}
+	if cfg.authParams != nil {
+		cfg.SetAuthParams(cfg.authParams)
+	}
+	if cfg.onFirstLogin != nil || cfg.onLogin != nil {
+		cfg.SetHooks(cfg.onFirstLogin, cfg.onLogin, cfg.blockLoginOnHook)
+	}
+	if cfg.maxSessions != 0 || cfg.sessionIdleTimeout != 0 {
+		cfg.SetSessionLimits(cfg.maxSessions, cfg.sessionIdleTimeout)
+	}
+	if cfg.persistSessions {
+		cfg.SetPersistSessions(cfg.persistSessions)
+	}
+	if cfg.auditLog != "" {
+		cfg.SetAuditLog(cfg.auditLog, cfg.auditLogMaxSize, cfg.auditLogMaxFiles)
+	}
+	if cfg.groupsCacheTTL != 0 {
+		cfg.SetGroupsCacheTTL(cfg.groupsCacheTTL)
+	}
+	if cfg.discoveryCacheTTL != 0 {
+		cfg.SetDiscoveryCacheTTL(cfg.discoveryCacheTTL)
+	}
+	if cfg.cacheEncryption != "" {
+		cfg.SetCacheEncryption(cfg.cacheEncryption)
+	}
+	if cfg.cacheKeyFile != "" {
+		cfg.SetCacheEncryptionKeyFile(cfg.cacheKeyFile)
+	}
+	if cfg.extraScopes != nil {
+		cfg.SetExtraScopes(cfg.extraScopes)
+	}
 	if cfg.allowedUsers != nil {
 		cfg.SetAllowedUsers(cfg.allowedUsers)
 	}
@@ -104,7 +316,21 @@ func newBrokerForTests(t *testing.T, cfg *brokerForTestConfig) (b *broker.Broker
 		cfg.SetIssuerURL(issuerURL)
 	}
 
-	b, err := broker.New(cfg.Config, broker.WithCustomProvider(provider))
+	var brokerProvider providers.Provider = provider
+	if cfg.webAuthn {
+		brokerProvider = &testutils.MockWebAuthnProvider{MockProvider: provider}
+	}
+
+	opts := []broker.Option{broker.WithCustomProvider(brokerProvider)}
+	if cfg.tokenStore != nil {
+		opts = append(opts, broker.WithTokenStore(cfg.tokenStore))
+	}
+
+	newBroker := broker.New
+	if cfg.readOnly {
+		newBroker = broker.NewReadOnly
+	}
+	b, err := newBroker(cfg.Config, opts...)
 	require.NoError(t, err, "Setup: New should not have returned an error")
 	return b
 }
@@ -175,6 +401,10 @@ type tokenOptions struct {
 	username string
 	issuer   string
 	groups   []info.Group
+	// idTokenExpiry is the expiry of the ID token. If unset, the ID token does not expire in practice.
+	idTokenExpiry time.Time
+	// idTokenClaims overrides the default claims of the ID token.
+	idTokenClaims map[string]any
 
 	expired        bool
 	noRefreshToken bool
@@ -198,16 +428,26 @@ func generateCachedInfo(t *testing.T, options tokenOptions) *token.AuthCachedInf
 		options.username = ""
 	}
 
-	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+	var idTokenExpiry int64 = 9999999999
+	if !options.idTokenExpiry.IsZero() {
+		idTokenExpiry = options.idTokenExpiry.Unix()
+	}
+
+	claims := jwt.MapClaims{
 		"iss":                options.issuer,
 		"sub":                "saved-user-id",
 		"aud":                "test-client-id",
-		"exp":                9999999999,
+		"exp":                idTokenExpiry,
 		"name":               "test-user",
 		"preferred_username": "test-user-preferred-username@email.com",
 		"email":              options.username,
 		"email_verified":     true,
-	})
+	}
+	for k, v := range options.idTokenClaims {
+		claims[k] = v
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 	encodedToken, err := idToken.SignedString(testutils.MockKey)
 	require.NoError(t, err, "Setup: signing token should not have failed")
 
@@ -268,3 +508,48 @@ func writeTrashToken(t *testing.T, path string) {
 	err = os.WriteFile(path, content, 0600)
 	require.NoError(t, err, "Setup: writing trash token should not have failed")
 }
+
+// writeHomeDirForTests creates the home directory at path, with a file in a subdirectory and a symlink to it.
+func writeHomeDirForTests(t *testing.T, path string) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Join(path, ".config"), 0700)
+	require.NoError(t, err, "Setup: creating home directory should not have failed")
+	err = os.WriteFile(filepath.Join(path, ".profile"), []byte("user profile"), 0600)
+	require.NoError(t, err, "Setup: writing home directory file should not have failed")
+	err = os.WriteFile(filepath.Join(path, ".config", "app.conf"), []byte("user app config"), 0600)
+	require.NoError(t, err, "Setup: writing home directory file should not have failed")
+	err = os.Symlink("app.conf", filepath.Join(path, ".config", "link.conf"))
+	require.NoError(t, err, "Setup: creating home directory symlink should not have failed")
+}
+
+// readArchiveForTests returns the content of the files of the gzipped tarball by name, empty for the directories and
+// "-> <target>" for the symlinks.
+func readArchiveForTests(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err, "Opening the archive should not have failed")
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err, "The archive should be gzipped")
+
+	content := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err, "Reading the archive should not have failed")
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			content[hdr.Name] = "-> " + hdr.Linkname
+		default:
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err, "Reading the archive should not have failed")
+			content[hdr.Name] = string(data)
+		}
+	}
+	return content
+}
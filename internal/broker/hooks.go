@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/fileutils"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+)
+
+// defaultHookTimeout is how long the hook commands can run before they are killed, unless configured otherwise.
+const defaultHookTimeout = 30 * time.Second
+
+// hookPath is the PATH of the hook commands. They do not inherit the environment of the broker, which can hold
+// secrets, e.g. the ones referenced by the client secret.
+const hookPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Events of the lifecycle of the users, passed to the hook commands.
+const (
+	hookEventFirstLogin = "first_login"
+	hookEventLogin      = "login"
+)
+
+// firstLoginFileName is the name of the file, in the data directory of the user, where their first login is recorded, so
+// that the first login hook is only run once.
+const firstLoginFileName = "first_login"
+
+// grantedUserInfoKey is the key in the authentication info of the session of the user info returned to authd when the
+// user was granted access.
+const grantedUserInfoKey = "granted_user_info"
+
+// runHook runs the hook command of the event for the user, with only the PATH, the username, the groups and the event
+// in its environment. The output of the command is returned in the error if it fails.
+func (b *Broker) runHook(event string, command []string, userInfo info.User) error {
+	if len(command) == 0 {
+		return nil
+	}
+
+	timeout := b.cfg.hookTimeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var groups []string
+	for _, g := range userInfo.Groups {
+		groups = append(groups, g.Name)
+	}
+
+	//nolint: gosec // The hook commands are configured by the administrator.
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = []string{
+		"PATH=" + hookPath,
+		"AUTHD_OIDC_EVENT=" + event,
+		"AUTHD_OIDC_USERNAME=" + userInfo.Name,
+		"AUTHD_OIDC_GROUPS=" + strings.Join(groups, ","),
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("the %s hook %q of user %q failed: %v: %s", event, command[0], userInfo.Name, err, strings.TrimSpace(string(out)))
+	}
+	b.logger.Debug(fmt.Sprintf("Ran the %s hook %q of user %q", event, command[0], userInfo.Name))
+	return nil
+}
+
+// runLoginHooks runs the first login hook if the user never logged in before, and then the login hook. It returns an
+// error only if a hook fails and the hooks are configured to block the login, in which case the next one is not run.
+func (b *Broker) runLoginHooks(userInfo info.User, firstLogin bool) error {
+	if firstLogin {
+		if err := b.runLoginHook(hookEventFirstLogin, b.cfg.onFirstLogin, userInfo); err != nil {
+			return err
+		}
+	}
+	return b.runLoginHook(hookEventLogin, b.cfg.onLogin, userInfo)
+}
+
+// isFirstLogin returns true if the user of the session never logged in before. The users who logged in before the first
+// logins were recorded have their last login recorded.
+func (b *Broker) isFirstLogin(session *session) bool {
+	for _, name := range []string{firstLoginFileName, lastLoginFileName} {
+		_, err := os.Stat(filepath.Join(session.userDataDir, name))
+		if err == nil {
+			return false
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			b.logger.Warn(fmt.Sprintf("Could not check if user %q logged in before: %v", session.username, err))
+			return false
+		}
+	}
+	return true
+}
+
+// recordFirstLogin records the first login of the user of the session, whose login hooks ran.
+func (b *Broker) recordFirstLogin(session *session) error {
+	err := os.MkdirAll(session.userDataDir, 0700)
+	if err == nil {
+		err = fileutils.WriteFileAtomically(filepath.Join(session.userDataDir, firstLoginFileName),
+			[]byte(time.Now().UTC().Format(time.RFC3339)+"\n"))
+	}
+	if err != nil {
+		return fmt.Errorf("could not record the first login of user %q: %v", session.username, err)
+	}
+	return nil
+}
+
+// runLoginHook runs the login hook command of the event, and only logs its failure unless it must block the login.
+func (b *Broker) runLoginHook(event string, command []string, userInfo info.User) error {
+	err := b.runHook(event, command, userInfo)
+	if err == nil || b.cfg.blockLoginOnHookFailure {
+		return err
+	}
+	b.logger.Warn(err.Error())
+	return nil
+}
@@ -0,0 +1,151 @@
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/oauth2"
+)
+
+// tlsVersions are the TLS versions which can be required as the minimum one, by value of the setting.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// httpClient returns the client for the requests to the providers, which trusts the configured CA certificates in
+// addition to the system ones, goes through the configured proxy, and retries the idempotent requests which failed
+// because of a transient error.
+func (uc userConfig) httpClient() (*http.Client, error) {
+	minVersion := uc.minTLSVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: minVersion,
+		//nolint: gosec // This is only allowed for debugging, and loudly warned about when the broker is created.
+		InsecureSkipVerify: uc.insecureSkipVerify,
+	}
+	if uc.caCertFile != "" {
+		pool, err := certPoolWith(uc.caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q: %v", caCertFileKey, err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = uc.proxyFunc()
+	return &http.Client{Transport: retryTransport{
+		base:       transport,
+		timeout:    uc.requestTimeout(),
+		maxRetries: uc.httpRetries,
+	}}, nil
+}
+
+// requestTimeout returns how long a request to the providers, including its retries, can take.
+func (uc userConfig) requestTimeout() time.Duration {
+	if uc.httpTimeout > 0 {
+		return uc.httpTimeout
+	}
+	return maxRequestDuration
+}
+
+// proxyFunc returns the function selecting the proxy of a request. The configured proxy replaces the ones set in the
+// environment, which may not be the same for the broker as in the sessions of the users, and the configured hosts are
+// then the only ones not to go through it.
+func (uc userConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	proxyCfg := httpproxy.FromEnvironment()
+	if uc.httpProxy != "" {
+		proxyCfg.HTTPProxy = uc.httpProxy
+		proxyCfg.HTTPSProxy = uc.httpProxy
+		proxyCfg.NoProxy = ""
+	}
+	if uc.noProxy != "" {
+		proxyCfg.NoProxy = uc.noProxy
+	}
+
+	proxy := proxyCfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// validateProxyURL checks that the proxy URL has a scheme supported by the HTTP transport and a host.
+func validateProxyURL(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q, it must be http, https, socks5 or socks5h", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("proxy URL %q has no host", proxyURL)
+	}
+	return nil
+}
+
+// certPoolWith returns the system certificate pool with the CA certificates of path, a PEM file or a directory of PEM
+// files, added to it.
+func certPoolWith(path string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	files := []string{path}
+	if fi, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("could not read CA certificates: %v", err)
+	} else if fi.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*")); err != nil {
+			return nil, fmt.Errorf("could not list CA certificates: %v", err)
+		}
+	}
+
+	var added bool
+	for _, file := range files {
+		if fi, err := os.Stat(file); err != nil || fi.IsDir() {
+			continue
+		}
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA certificates: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM encoded certificate found in %q", file)
+		}
+		added = true
+	}
+	if !added {
+		return nil, fmt.Errorf("no CA certificate found in %q", path)
+	}
+	return pool, nil
+}
+
+// withHTTPClient returns a copy of ctx carrying the HTTP client of the broker. go-oidc and oauth2 read their client from
+// the context, so it is used for all the requests made with ctx, including the ones of the *oidc.Provider created with
+// it.
+func (b *Broker) withHTTPClient(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, b.httpClient)
+}
+
+// httpClientFrom returns the HTTP client carried by ctx, or the default one.
+func httpClientFrom(ctx context.Context) *http.Client {
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return c
+	}
+	return http.DefaultClient
+}
@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/token"
+	"github.com/ubuntu/decorate"
+)
+
+// TokenInspection is what the cached token of a user tells, without any of the tokens themselves, so that it can be
+// shown for support.
+type TokenInspection struct {
+	// Path is the path of the token cache, if the tokens are stored in files.
+	Path string
+	// Subject is the sub claim of the ID token, which identifies the user at the provider.
+	Subject string
+	// Issuer is the iss claim of the ID token.
+	Issuer string
+	// Username is the name of the user resolved when the token was cached.
+	Username string
+	// Groups are the names of the groups resolved when the token was cached.
+	Groups []string
+	// Expiry is when the access token expires, or zero if it does not.
+	Expiry time.Time
+	// IDTokenExpiry is when the ID token expires.
+	IDTokenExpiry time.Time
+	// HasRefreshToken is true if the token can be refreshed.
+	HasRefreshToken bool
+}
+
+// InspectToken reads the cached token of the user, decrypting it if needed, and returns what it tells. The cache is
+// only read: a plaintext token is not encrypted, and the token is not refreshed.
+func (b *Broker) InspectToken(username string) (res TokenInspection, err error) {
+	defer decorate.OnError(&err, "could not inspect the token of user %q", username)
+
+	b.cfgMu.RLock()
+	p, err := b.cfg.oidcProviderFor(username)
+	b.cfgMu.RUnlock()
+	if err != nil {
+		return res, err
+	}
+
+	var authInfo token.AuthCachedInfo
+	if store, ok := b.tokenStore.(*FileTokenStore); ok {
+		res.Path = store.Path(p.issuerURL, username)
+		authInfo, err = store.read(p.issuerURL, username)
+	} else {
+		authInfo, err = b.tokenStore.Load(p.issuerURL, username)
+	}
+	if err != nil {
+		return res, err
+	}
+	if authInfo.Token == nil {
+		return res, errors.New("the cache has no token")
+	}
+
+	res.Username = authInfo.UserInfo.Name
+	for _, g := range authInfo.UserInfo.Groups {
+		res.Groups = append(res.Groups, g.Name)
+	}
+	res.Expiry = authInfo.Token.Expiry
+	res.HasRefreshToken = authInfo.Token.RefreshToken != ""
+
+	if authInfo.RawIDToken == "" {
+		return res, nil
+	}
+	idToken, err := parseVerifiedIDToken(authInfo.RawIDToken)
+	if err != nil {
+		return res, err
+	}
+	res.Subject = idToken.Subject
+	res.Issuer = idToken.Issuer
+	res.IDTokenExpiry = idToken.Expiry
+	return res, nil
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ubuntu/authd-oidc-brokers/internal/token"
+	"golang.org/x/oauth2"
+)
+
+// Values of the token validation setting.
+const (
+	// tokenValidationJWT verifies the signature of the ID token with the keys of the provider.
+	tokenValidationJWT = "jwt"
+	// tokenValidationIntrospection asks the introspection endpoint of the provider whether the access token is active,
+	// for the providers which do not issue verifiable ID tokens.
+	tokenValidationIntrospection = "introspection"
+)
+
+// maxIntrospectionResponseSize is the maximum size of the responses of the introspection endpoint which are read.
+const maxIntrospectionResponseSize = 1 << 20
+
+// errInactiveToken is the error of the tokens which the introspection endpoint does not report as active.
+var errInactiveToken = errors.New("the provider reported the token as not active")
+
+// introspect asks the introspection endpoint of the provider of the session whether the access token is active, and
+// returns an ID token holding the returned claims, which are used like the ones of a verified ID token. The raw ID
+// token of t is replaced by an unsigned JWT of these claims, so that they are also used once the token is cached.
+func (b *Broker) introspect(ctx context.Context, session *session, t *token.AuthCachedInfo) (*oidc.IDToken, error) {
+	if session.discoveryDoc.IntrospectionURL == "" {
+		return nil, errors.New("the provider has no introspection endpoint")
+	}
+	if t.Token == nil || t.Token.AccessToken == "" {
+		return nil, errors.New("no access token to introspect")
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, b.cfg.requestTimeout())
+	defer cancel()
+	claims, err := introspectToken(reqCtx, session.oauth2Config, session.discoveryDoc.IntrospectionURL, t.Token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// The token may have been issued to another client of the provider.
+	if clientID, ok := claims["client_id"].(string); ok && clientID != session.oauth2Config.ClientID {
+		return nil, fmt.Errorf("the token was issued to the client %q", clientID)
+	}
+	issuer := session.issuerURL
+	if session.discoveryDoc.Issuer != "" {
+		issuer = session.discoveryDoc.Issuer
+	}
+	if _, ok := claims["iss"]; !ok {
+		claims["iss"] = issuer
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal the introspected claims: %v", err)
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	rawIDToken := header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+
+	idToken, err := parseVerifiedIDToken(rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIssuer(idToken, issuer, session.acceptedIssuers); err != nil {
+		return nil, err
+	}
+
+	t.RawIDToken = rawIDToken
+	return idToken, nil
+}
+
+// introspectToken sends an RFC 7662 introspection request for the access token to the endpoint, authenticating as the
+// client, and returns the claims of the token, without the active flag. It returns errInactiveToken if the token is not
+// active.
+func introspectToken(ctx context.Context, oauth2Config oauth2.Config, introspectionURL, accessToken string) (map[string]any, error) {
+	form := url.Values{
+		"token":           {accessToken},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := newClientRequest(ctx, oauth2Config, introspectionURL, form)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClientFrom(ctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIntrospectionResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q: %s", resp.Status, body[:min(len(body), 1024)])
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("could not parse the introspection response: %v", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, errInactiveToken
+	}
+	delete(claims, "active")
+	return claims, nil
+}
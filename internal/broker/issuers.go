@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// tenantIDPlaceholder is the placeholder of the accepted issuers which matches the tenant ID of multi-tenant providers,
+// e.g. https://login.microsoftonline.com/{tenantid}/v2.0.
+const tenantIDPlaceholder = "{tenantid}"
+
+// validateAcceptedIssuer returns an error if the accepted issuer is not a URL, once its tenant ID placeholder is
+// replaced.
+func validateAcceptedIssuer(issuer string) error {
+	u, err := url.Parse(strings.ReplaceAll(issuer, tenantIDPlaceholder, "tenant"))
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL", issuer)
+	}
+	return nil
+}
+
+// issuerMatches returns true if the issuer matches the accepted one, in which the tenant ID placeholder matches a single
+// path segment or host label, and that tenant ID equals tid if it is not empty.
+func issuerMatches(iss, accepted, tid string) bool {
+	prefix, suffix, ok := strings.Cut(accepted, tenantIDPlaceholder)
+	if !ok {
+		return iss == accepted
+	}
+	if len(iss) <= len(prefix)+len(suffix) || !strings.HasPrefix(iss, prefix) || !strings.HasSuffix(iss, suffix) {
+		return false
+	}
+	tenant := iss[len(prefix) : len(iss)-len(suffix)]
+	if strings.ContainsAny(tenant, "/.:?#") {
+		return false
+	}
+	return tid == "" || tenant == tid
+}
+
+// checkIssuer returns an error if the ID token was not issued by the issuer, nor by one of the accepted issuers. The
+// tenant ID matched by the placeholder of an accepted issuer must be the one of the tid claim, if the token has it, so
+// that a token of a tenant can not be passed off as one of another tenant.
+func checkIssuer(idToken *oidc.IDToken, issuer string, accepted []string) error {
+	if idToken.Issuer == issuer {
+		return nil
+	}
+
+	var claims struct {
+		TenantID string `json:"tid"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return fmt.Errorf("could not get ID token claims: %v", err)
+	}
+	for _, a := range accepted {
+		if issuerMatches(idToken.Issuer, a, claims.TenantID) {
+			return nil
+		}
+	}
+	return fmt.Errorf("id token issued by a different provider, expected %q or one of %q, got %q", issuer, accepted, idToken.Issuer)
+}
@@ -0,0 +1,206 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	// jwksCacheSuffix is appended to the issuer directory name to get the file where its signing keys are cached.
+	jwksCacheSuffix = ".jwks.json"
+	// defaultJWKSRefreshInterval is how long the cached signing keys are used before fetching them again, unless
+	// configured otherwise.
+	defaultJWKSRefreshInterval = 24 * time.Hour
+)
+
+// signatureAlgorithms are the algorithms which the ID tokens can be signed with. The verifier already rejects the
+// tokens signed with an algorithm the provider does not support.
+var signatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.EdDSA,
+}
+
+// cachedKeySet is the oidc.KeySet verifying the signatures with the signing keys of the issuer cached in the data
+// directory. The keys are fetched again once they are older than the refresh interval, and as soon as a token is
+// signed with a key which is not cached, as the provider rotated its keys.
+type cachedKeySet struct {
+	jwksURL         string
+	cachePath       string
+	refreshInterval time.Duration
+	// timeout bounds the requests fetching the keys.
+	timeout time.Duration
+}
+
+// VerifySignature verifies the signature of the JWT with the cached keys, or with the keys fetched from the provider if
+// they are outdated or do not include the key the JWT was signed with, and returns its payload.
+func (k cachedKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt, signatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+	// We don't support JWTs signed with multiple signatures.
+	keyID := jws.Signatures[0].Header.KeyID
+
+	keys, cachedAt, cacheErr := loadKeySet(k.cachePath)
+	if cacheErr == nil && time.Since(cachedAt) < k.refreshInterval {
+		if payload, ok := verifyWithKeys(jws, keys, keyID); ok {
+			return payload, nil
+		}
+	}
+
+	fetched, err := k.fetch(ctx)
+	if err != nil {
+		// Keep verifying with the outdated keys while the provider is not reachable.
+		if cacheErr == nil {
+			if payload, ok := verifyWithKeys(jws, keys, keyID); ok {
+				return payload, nil
+			}
+		}
+		return nil, fmt.Errorf("could not fetch signing keys: %v", err)
+	}
+	if payload, ok := verifyWithKeys(jws, fetched.Keys, keyID); ok {
+		return payload, nil
+	}
+	return nil, errors.New("failed to verify id token signature")
+}
+
+// fetch fetches the signing keys of the issuer and caches them.
+func (k cachedKeySet) fetch(ctx context.Context) (jose.JSONWebKeySet, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, k.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, k.jwksURL, nil)
+	if err != nil {
+		return jose.JSONWebKeySet{}, err
+	}
+	resp, err := httpClientFrom(ctx).Do(req)
+	if err != nil {
+		return jose.JSONWebKeySet{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return jose.JSONWebKeySet{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return jose.JSONWebKeySet{}, fmt.Errorf("unexpected status %q: %s", resp.Status, body)
+	}
+
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return jose.JSONWebKeySet{}, fmt.Errorf("could not parse signing keys: %v", err)
+	}
+
+	if err := cacheKeySet(k.cachePath, body); err != nil {
+		return jose.JSONWebKeySet{}, fmt.Errorf("could not cache signing keys: %v", err)
+	}
+	return keySet, nil
+}
+
+// fileKeySet is the oidc.KeySet verifying the signatures with the signing keys of a local JWKS file, for the
+// environments where the keys of the provider can not be fetched. The file is read for each verification, so that the
+// keys can be rotated by replacing it, without restarting the broker.
+type fileKeySet struct {
+	path string
+}
+
+// VerifySignature verifies the signature of the JWT with the keys of the file, and returns its payload.
+func (k fileKeySet) VerifySignature(_ context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt, signatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+	keys, _, err := loadKeySet(k.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing keys: %v", err)
+	}
+	if payload, ok := verifyWithKeys(jws, keys, jws.Signatures[0].Header.KeyID); ok {
+		return payload, nil
+	}
+	return nil, fmt.Errorf("failed to verify id token signature with the keys of %q", k.path)
+}
+
+// parseJWKSFile returns the JWKS file of the section, after checking that it holds signing keys.
+func parseJWKSFile(section *ini.Section) (string, error) {
+	path := section.Key(jwksFileKey).String()
+	if path == "" {
+		return "", nil
+	}
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("invalid value for %q: %q is not an absolute path", jwksFileKey, path)
+	}
+	keys, _, err := loadKeySet(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid value for %q: %v", jwksFileKey, err)
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("invalid value for %q: %q holds no key", jwksFileKey, path)
+	}
+	return path, nil
+}
+
+// verifyWithKeys verifies the signature of the JWS with the key whose ID is keyID, or with any key if keyID is empty.
+func verifyWithKeys(jws *jose.JSONWebSignature, keys []jose.JSONWebKey, keyID string) ([]byte, bool) {
+	for _, key := range keys {
+		if keyID != "" && key.KeyID != keyID {
+			continue
+		}
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, true
+		}
+	}
+	return nil, false
+}
+
+// loadKeySet reads the cached signing keys and returns them with the time they were cached.
+func loadKeySet(path string) ([]jose.JSONWebKey, time.Time, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(content, &keySet); err != nil {
+		return nil, time.Time{}, fmt.Errorf("could not parse %q: %v", path, err)
+	}
+	return keySet.Keys, fi.ModTime(), nil
+}
+
+// cacheKeySet stores the signing keys, replacing the cached ones at once, as other sessions may be reading them.
+func cacheKeySet(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("could not create data directory: %v", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/fileutils"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"github.com/ubuntu/decorate"
+)
+
+// lastLoginFileName is the name of the file, in the data directory of the user, where their last login is recorded.
+const lastLoginFileName = "last_login.json"
+
+// LastLogin is the record of the last time a user was granted access. It is stored as JSON, apart from the token
+// cache, so that it is kept when the token is refreshed and can be read by other tools.
+type LastLogin struct {
+	// Time is when the user was granted access.
+	Time time.Time `json:"time"`
+	// Issuer is the issuer of the provider which authenticated the user.
+	Issuer string `json:"issuer"`
+	// Mode is the authentication mode the user logged in with.
+	Mode string `json:"mode"`
+	// Offline is true if the user logged in while the provider was not reachable.
+	Offline bool `json:"offline"`
+	// Groups are the names of the groups the user was granted.
+	Groups []string `json:"groups"`
+}
+
+// recordLastLogin stores the last login of the user of the session, granted with the user info.
+func (b *Broker) recordLastLogin(session *session, userInfo info.User) (err error) {
+	defer decorate.OnError(&err, "could not record the last login of user %q", session.username)
+
+	l := LastLogin{
+		Time:    time.Now(),
+		Issuer:  session.issuerURL,
+		Mode:    session.selectedMode,
+		Offline: session.isOffline,
+		Groups:  []string{},
+	}
+	for _, g := range userInfo.Groups {
+		l.Groups = append(l.Groups, g.Name)
+	}
+
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(session.userDataDir, 0700); err != nil {
+		return err
+	}
+	return fileutils.WriteFileAtomically(filepath.Join(session.userDataDir, lastLoginFileName), data)
+}
+
+// LastLogin returns the record of the last time the user was granted access. The returned error wraps os.ErrNotExist if
+// no login of the user was recorded.
+func (b *Broker) LastLogin(username string) (l LastLogin, err error) {
+	defer decorate.OnError(&err, "could not read the last login of user %q", username)
+
+	b.cfgMu.RLock()
+	p, err := b.cfg.oidcProviderFor(username)
+	b.cfgMu.RUnlock()
+	if err != nil {
+		return l, err
+	}
+	return b.readLastLogin(p.issuerURL, username)
+}
+
+// readLastLogin returns the record of the last time the user of the issuer was granted access.
+func (b *Broker) readLastLogin(issuerURL, username string) (l LastLogin, err error) {
+	data, err := os.ReadFile(filepath.Join(b.userDataDir(issuerURL, username), lastLoginFileName))
+	if err != nil {
+		return l, err
+	}
+	if err := json.Unmarshal(data, &l); err != nil {
+		return l, fmt.Errorf("could not parse the last login: %v", err)
+	}
+	return l, nil
+}
@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"cmp"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ubuntu/decorate"
+)
+
+// ManagedUser is a local user provisioned by the broker.
+type ManagedUser struct {
+	// Username is the local name of the user.
+	Username string
+	// Subject is the subject of the user at the provider.
+	Subject string
+	// Issuer is the issuer of the provider of the user.
+	Issuer string
+	// LastLogin is when the user was last granted access, or zero if no login of the user was recorded.
+	LastLogin time.Time
+	// RemovedAtProvider is true if the provider told, since the user was last granted access, that their account does
+	// not exist anymore. The user can then be removed with RemoveUser.
+	RemovedAtProvider bool
+}
+
+// ManagedUsers returns the local users provisioned by the broker, sorted by username, so that the tools of the machine
+// can tell them from the ones created locally. They are the users whose username was recorded when they were granted
+// access. No file is written, so it can be called while the users log in.
+func (b *Broker) ManagedUsers() (users []ManagedUser, err error) {
+	defer decorate.OnError(&err, "could not list the managed users")
+
+	b.usernamesMu.Lock()
+	m, err := b.loadUsernameMappings()
+	b.usernamesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	users = []ManagedUser{}
+	for issuer, subjects := range m {
+		for subject, username := range subjects {
+			u := ManagedUser{Username: username, Subject: subject, Issuer: issuer}
+			// The usernames may have been recorded before the last logins were.
+			l, err := b.readLastLogin(issuer, username)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			u.LastLogin = l.Time
+			if u.RemovedAtProvider, err = b.userRemovedAtProvider(issuer, username); err != nil {
+				return nil, err
+			}
+			users = append(users, u)
+		}
+	}
+
+	slices.SortFunc(users, func(a, b ManagedUser) int {
+		return cmp.Or(strings.Compare(a.Username, b.Username), strings.Compare(a.Issuer, b.Issuer))
+	})
+	return users, nil
+}
@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"errors"
+	"maps"
+	"sync"
+)
+
+// Reasons of the failed authentication attempts.
+const (
+	// FailureNetwork is the reason of the failures caused by the provider not being reachable.
+	FailureNetwork = "network"
+	// FailureInvalidGrant is the reason of the failures caused by the provider rejecting the grant, e.g. an expired or
+	// revoked refresh token.
+	FailureInvalidGrant = "invalid_grant"
+	// FailureNotInGroup is the reason of the failures caused by the user not being a member of any allowed group.
+	FailureNotInGroup = "not_in_group"
+	// FailureTooManyAttempts is the reason of the failures caused by the user being locked out of the local password
+	// mode after too many failed attempts.
+	FailureTooManyAttempts = "too_many_attempts"
+	// FailureOther is the reason of all the other failures, e.g. an incorrect password.
+	FailureOther = "other"
+)
+
+// Metrics is a snapshot of the authentication counters of the broker, since it was created.
+type Metrics struct {
+	// Attempts is the number of authentication attempts, by authentication mode.
+	Attempts map[string]uint64
+	// Successes is the number of attempts which granted access to the user.
+	Successes uint64
+	// Failures is the number of attempts which were retried or denied, by reason.
+	Failures map[string]uint64
+	// TokenRefreshes is the number of successful token refreshes.
+	TokenRefreshes uint64
+	// TokenRefreshFailures is the number of failed token refreshes.
+	TokenRefreshFailures uint64
+}
+
+// metrics holds the counters which are updated by the concurrent sessions.
+type metrics struct {
+	mu sync.Mutex
+	m  Metrics
+}
+
+// recordAuthentication counts an authentication attempt with the given mode and its outcome.
+func (m *metrics) recordAuthentication(mode, access string, data isAuthenticatedDataResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.m.Attempts == nil {
+		m.m.Attempts = make(map[string]uint64)
+	}
+	m.m.Attempts[mode]++
+
+	switch access {
+	case AuthGranted:
+		m.m.Successes++
+	case AuthRetry, AuthDenied:
+		reason := FailureOther
+		if msg, ok := data.(errorMessage); ok {
+			reason = failureReason(msg.err)
+		}
+		if m.m.Failures == nil {
+			m.m.Failures = make(map[string]uint64)
+		}
+		m.m.Failures[reason]++
+	}
+}
+
+// recordTokenRefresh counts a token refresh which returned err.
+func (m *metrics) recordTokenRefresh(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.m.TokenRefreshFailures++
+		return
+	}
+	m.m.TokenRefreshes++
+}
+
+// snapshot returns a copy of the counters, which is not affected by the later updates.
+func (m *metrics) snapshot() Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.m
+	s.Attempts = maps.Clone(m.m.Attempts)
+	s.Failures = maps.Clone(m.m.Failures)
+	return s
+}
+
+// Metrics returns a snapshot of the authentication counters, so that the caller can publish them.
+func (b *Broker) Metrics() Metrics {
+	return b.metrics.snapshot()
+}
+
+// failureReason returns the reason of an authentication failure caused by err.
+func failureReason(err error) string {
+	err = authError(err)
+	switch {
+	case errors.Is(err, ErrInvalidGrant):
+		return FailureInvalidGrant
+	case errors.Is(err, ErrProviderUnreachable):
+		return FailureNetwork
+	case errors.Is(err, ErrNotInAllowedGroup):
+		return FailureNotInGroup
+	case errors.Is(err, ErrTooManyAttempts):
+		return FailureTooManyAttempts
+	}
+	return FailureOther
+}
@@ -0,0 +1,246 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/token"
+	"golang.org/x/oauth2"
+)
+
+// sessionsFileName is the name of the file, in the data directory, where the sessions are persisted.
+const sessionsFileName = "sessions.json"
+
+// persistedSessions is what is stored in the data directory to resume the sessions after the broker restarts.
+type persistedSessions struct {
+	// PrivateKey is the PKCS #1 encoded private key of the broker, whose public key authd uses to encrypt the secrets
+	// sent in the sessions.
+	PrivateKey []byte                      `json:"private_key"`
+	Sessions   map[string]persistedSession `json:"sessions"`
+}
+
+// persistedSession is the minimal state of a session needed to resume it.
+type persistedSession struct {
+	Username          string               `json:"username"`
+	Lang              string               `json:"lang"`
+	Mode              string               `json:"mode"`
+	IssuerURL         string               `json:"issuer_url"`
+	SelectedMode      string               `json:"selected_mode,omitempty"`
+	FirstSelectedMode string               `json:"first_selected_mode,omitempty"`
+	AuthModes         []string             `json:"auth_modes,omitempty"`
+	AttemptsPerMode   map[string]int       `json:"attempts_per_mode,omitempty"`
+	DeviceAuth        *persistedDeviceAuth `json:"device_auth,omitempty"`
+	WebAuthnChallenge string               `json:"webauthn_challenge,omitempty"`
+	Created           time.Time            `json:"created,omitempty"`
+	LastActivity      time.Time            `json:"last_activity"`
+}
+
+// persistedDeviceAuth is the device authorization response of a session. Unlike oauth2.DeviceAuthResponse, which is
+// marshalled with a relative expiry, the expiry is stored as an absolute time.
+type persistedDeviceAuth struct {
+	DeviceCode              string    `json:"device_code"`
+	UserCode                string    `json:"user_code"`
+	VerificationURI         string    `json:"verification_uri"`
+	VerificationURIComplete string    `json:"verification_uri_complete,omitempty"`
+	Expiry                  time.Time `json:"expiry,omitempty"`
+	Interval                int64     `json:"interval,omitempty"`
+}
+
+// sessionsPath returns the path of the file where the sessions are persisted.
+func (b *Broker) sessionsPath() string {
+	return filepath.Join(b.cfg.DataDir, sessionsFileName)
+}
+
+// persistSessions stores the current sessions which can be resumed, if enabled. Failing to store them only prevents
+// them from being resumed after a restart, so the error is only logged.
+//
+// The sessions are only stored again when one is added or removed, or when the state needed to resume it changes, e.g.
+// when an authentication mode is selected. The activity of the sessions alone does not change it, so the persisted
+// last activity of a session is the one of its last change.
+func (b *Broker) persistSessions() {
+	if !b.cfg.persistSessions {
+		return
+	}
+
+	// The snapshot is taken under the lock too, so that an older snapshot never overwrites a newer one.
+	b.persistMu.Lock()
+	defer b.persistMu.Unlock()
+
+	stored := persistedSessions{
+		PrivateKey: x509.MarshalPKCS1PrivateKey(b.privateKey),
+		Sessions:   make(map[string]persistedSession),
+	}
+	b.currentSessionsMu.RLock()
+	for id, s := range b.currentSessions {
+		if p, ok := persistedSessionOf(s); ok {
+			stored.Sessions[id] = p
+		}
+	}
+	b.currentSessionsMu.RUnlock()
+
+	state, err := persistedStateOf(stored.Sessions)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Could not marshal the sessions: %v", err))
+		return
+	}
+	if b.persistedState != nil && bytes.Equal(state, b.persistedState) {
+		return
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Could not marshal the sessions: %v", err))
+		return
+	}
+	if err := token.StoreData(b.sessionsPath(), data, b.tokenOpts...); err != nil {
+		b.logger.Warn(fmt.Sprintf("Could not store the sessions: %v", err))
+		return
+	}
+	b.persistedState = state
+}
+
+// persistedStateOf returns the state of the persisted sessions to compare to decide whether to store them again, which
+// is all of it but their last activity.
+func persistedStateOf(sessions map[string]persistedSession) ([]byte, error) {
+	sessions = maps.Clone(sessions)
+	for id, p := range sessions {
+		p.LastActivity = time.Time{}
+		sessions[id] = p
+	}
+	return json.Marshal(sessions)
+}
+
+// persistedSessionOf returns the state to persist for the session, and false if it can not be resumed.
+func persistedSessionOf(s session) (persistedSession, bool) {
+	// The later steps depend on the token obtained in the first one, which is only kept in memory.
+	if s.currentAuthStep > 0 {
+		return persistedSession{}, false
+	}
+
+	p := persistedSession{
+		Username:          s.username,
+		Lang:              s.lang,
+		Mode:              s.mode,
+		IssuerURL:         s.issuerURL,
+		SelectedMode:      s.selectedMode,
+		FirstSelectedMode: s.firstSelectedMode,
+		AuthModes:         slices.Clone(s.authModes),
+		AttemptsPerMode:   maps.Clone(s.attemptsPerMode),
+		Created:           s.created,
+		LastActivity:      s.lastActivity,
+	}
+	if r, ok := s.authInfo["response"].(*oauth2.DeviceAuthResponse); ok {
+		p.DeviceAuth = &persistedDeviceAuth{
+			DeviceCode:              r.DeviceCode,
+			UserCode:                r.UserCode,
+			VerificationURI:         r.VerificationURI,
+			VerificationURIComplete: r.VerificationURIComplete,
+			Expiry:                  r.Expiry,
+			Interval:                r.Interval,
+		}
+	}
+	if challenge, ok := s.authInfo["webauthn_challenge"].(string); ok {
+		p.WebAuthnChallenge = challenge
+	}
+	return p, true
+}
+
+// restoreSessions resumes the sessions persisted before the broker was restarted, and the private key they were
+// created with. The sessions which expired or can not be resumed are dropped.
+func (b *Broker) restoreSessions() {
+	path := b.sessionsPath()
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	data, err := token.LoadData(path, b.tokenOpts...)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Could not load the persisted sessions: %v", err))
+		return
+	}
+	var stored persistedSessions
+	if err := json.Unmarshal(data, &stored); err != nil {
+		b.logger.Warn(fmt.Sprintf("Could not parse the persisted sessions: %v", err))
+		return
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(stored.PrivateKey)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Could not parse the private key of the persisted sessions: %v", err))
+		return
+	}
+	// authd encrypts the secrets of the resumed sessions with the public key it got when creating them.
+	b.privateKey = privateKey
+	if state, err := persistedStateOf(stored.Sessions); err == nil {
+		b.persistMu.Lock()
+		b.persistedState = state
+		b.persistMu.Unlock()
+	}
+
+	for id, p := range stored.Sessions {
+		if err := b.resumeSession(id, p); err != nil {
+			b.logger.Info(fmt.Sprintf("Dropping persisted session %q of user %q: %v", id, p.Username, err))
+			continue
+		}
+		b.logger.Info(fmt.Sprintf("Resumed session %q of user %q", id, p.Username))
+	}
+
+	// Do not keep the dropped sessions.
+	b.persistSessions()
+}
+
+// resumeSession makes the persisted session current again, or returns an error if it expired or can not be resumed.
+func (b *Broker) resumeSession(sessionID string, p persistedSession) error {
+	if p.DeviceAuth != nil && !p.DeviceAuth.Expiry.IsZero() && time.Now().After(p.DeviceAuth.Expiry) {
+		return errors.New("the device code expired")
+	}
+	if b.cfg.sessionIdleTimeout > 0 && time.Since(p.LastActivity) > b.cfg.sessionIdleTimeout {
+		return errors.New("the session was idle for too long")
+	}
+
+	s, err := b.newSession(p.Username, p.Lang, p.Mode)
+	if err != nil {
+		return err
+	}
+	if s.issuerURL != p.IssuerURL {
+		return fmt.Errorf("the issuer of the user changed from %q to %q", p.IssuerURL, s.issuerURL)
+	}
+
+	s.created = p.Created
+	s.selectedMode = p.SelectedMode
+	s.firstSelectedMode = p.FirstSelectedMode
+	s.authModes = p.AuthModes
+	if p.AttemptsPerMode != nil {
+		s.attemptsPerMode = p.AttemptsPerMode
+	}
+	if d := p.DeviceAuth; d != nil {
+		s.authInfo["response"] = &oauth2.DeviceAuthResponse{
+			DeviceCode:              d.DeviceCode,
+			UserCode:                d.UserCode,
+			VerificationURI:         d.VerificationURI,
+			VerificationURIComplete: d.VerificationURIComplete,
+			Expiry:                  d.Expiry,
+			Interval:                d.Interval,
+		}
+	}
+	if p.WebAuthnChallenge != "" {
+		s.authInfo["webauthn_challenge"] = p.WebAuthnChallenge
+	}
+
+	return b.addSession(sessionID, s)
+}
+
+// removePersistedSessions removes the sessions persisted while persisting them was enabled, so that the private key
+// they contain is not kept.
+func (b *Broker) removePersistedSessions() {
+	if err := os.Remove(b.sessionsPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		b.logger.Warn(fmt.Sprintf("Could not remove the persisted sessions: %v", err))
+	}
+}
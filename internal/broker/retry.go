@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultHTTPRetries is how many times an idempotent request to the providers is retried, unless configured
+	// otherwise.
+	defaultHTTPRetries = 2
+	// retryBackoff is how long to wait before the first retry. It doubles with each retry.
+	retryBackoff = 100 * time.Millisecond
+)
+
+// retryTransport retries the idempotent requests which failed with a connection error or a server error, as these are
+// usually transient. The other requests, e.g. the token requests, are sent only once: the authorization codes and
+// device codes can only be exchanged once, and the refresh tokens may be rotated by the first request.
+type retryTransport struct {
+	base http.RoundTripper
+	// timeout bounds each attempt, so that the requests made without a deadline, e.g. by the providers, do not hang.
+	timeout    time.Duration
+	maxRetries int
+}
+
+// RoundTrip sends the request, and retries it with an exponential backoff if it is idempotent and failed because of a
+// transient error, until the context of the request is done.
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := isIdempotent(req)
+
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.roundTrip(req)
+		if !retryable || attempt >= t.maxRetries || !isTransientFailure(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			// Read the body, so that the connection can be reused.
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// roundTrip sends the request once, bounding it with the timeout of the attempts.
+func (t retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.timeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The body is read after RoundTrip returns, so the context is only cancelled once it is closed.
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// isIdempotent returns true if the request can be sent again without side effects.
+func isIdempotent(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// isTransientFailure returns true if the request failed with a connection error or a server error.
+func isTransientFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// cancelOnClose cancels the context of a response when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,75 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/token"
+	"golang.org/x/oauth2"
+)
+
+// revokeRefreshToken asks the provider to revoke the refresh token obtained or used during the session, and clears it
+// from the cached token. The rest of the cached token is kept, so that the user can still log in with the local
+// password, online or offline, with the cached user info.
+func (b *Broker) revokeRefreshToken(s *session) {
+	authInfo, ok := s.authInfo["auth_info"].(token.AuthCachedInfo)
+	if !ok || authInfo.Token == nil || authInfo.Token.RefreshToken == "" {
+		return
+	}
+	if s.discoveryDoc.RevocationURL == "" {
+		b.logger.Debug(fmt.Sprintf("Not revoking the refresh token of user %q: the provider has no revocation endpoint", s.username))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withClientAssertion(b.withHTTPClient(context.Background()), s), b.cfg.requestTimeout())
+	defer cancel()
+	if err := revokeToken(ctx, s.oauth2Config, s.discoveryDoc.RevocationURL, authInfo.Token.RefreshToken); err != nil {
+		b.logger.Warn(fmt.Sprintf("Could not revoke the refresh token of user %q: %v", s.username, err))
+	} else {
+		b.logger.Debug(fmt.Sprintf("Revoked the refresh token of user %q", s.username))
+	}
+
+	// The refresh token is cleared from the cache even if the revocation failed, so that it can not be stolen from the
+	// cache anymore.
+	cached, err := b.tokenStore.Load(s.issuerURL, s.username)
+	if err != nil {
+		b.logger.Warn(fmt.Sprintf("Could not load the cached token of user %q to clear its refresh token: %v", s.username, err))
+		return
+	}
+	if cached.Token == nil || cached.Token.RefreshToken != authInfo.Token.RefreshToken {
+		// The cached token was replaced since, e.g. by another authentication of the user.
+		return
+	}
+	cached.Token.RefreshToken = ""
+	cached.RefreshTokenRevoked = true
+	if err := b.tokenStore.Save(s.issuerURL, s.username, cached); err != nil {
+		b.logger.Warn(fmt.Sprintf("Could not clear the refresh token from the cached token of user %q: %v", s.username, err))
+	}
+}
+
+// revokeToken sends a revocation request for the refresh token to the endpoint, authenticating as the client.
+func revokeToken(ctx context.Context, oauth2Config oauth2.Config, revocationURL, refreshToken string) error {
+	form := url.Values{
+		"token":           {refreshToken},
+		"token_type_hint": {"refresh_token"},
+	}
+	req, err := newClientRequest(ctx, oauth2Config, revocationURL, form)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClientFrom(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %q: %s", resp.Status, body)
+	}
+	return nil
+}
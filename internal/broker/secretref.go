@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// secretRefPrefix starts the values of the config file which are references to a secret, like !env:OIDC_SECRET, rather
+// than the secret itself. A value starting with two of them is the plain value without the first one.
+const secretRefPrefix = "!"
+
+// vaultRequestTimeout is how long the request reading a secret from Vault can take.
+const vaultRequestTimeout = 30 * time.Second
+
+// maxVaultResponseSize is the maximum size of the responses of Vault which are read.
+const maxVaultResponseSize = 1 << 20
+
+// secretResolver returns the secret referenced by ref, the part of a secret reference after the name of the resolver.
+type secretResolver func(logger *slog.Logger, ref string) (string, error)
+
+// secretResolvers are the resolvers of the secret references, by the name following secretRefPrefix in the reference.
+var secretResolvers = map[string]secretResolver{
+	"env":   envSecret,
+	"file":  fileSecretRef,
+	"cmd":   commandSecretRef,
+	"vault": vaultSecret,
+}
+
+// resolveSecretRef returns the secret referenced by the value if it is a secret reference, !<resolver>:<reference>, or
+// else the value itself.
+func resolveSecretRef(logger *slog.Logger, value string) (string, error) {
+	if strings.HasPrefix(value, secretRefPrefix+secretRefPrefix) {
+		return strings.TrimPrefix(value, secretRefPrefix), nil
+	}
+	name, ref, ok := strings.Cut(strings.TrimPrefix(value, secretRefPrefix), ":")
+	if !strings.HasPrefix(value, secretRefPrefix) || !ok {
+		return value, nil
+	}
+
+	// The reference itself is not part of the errors, in case the value is a plain secret which was not escaped.
+	resolve, ok := secretResolvers[name]
+	if !ok {
+		names := slices.Sorted(maps.Keys(secretResolvers))
+		return "", fmt.Errorf("unknown secret reference %q: the prefix must be one of %s%s:", secretRefPrefix+name, secretRefPrefix,
+			strings.Join(names, ":, "+secretRefPrefix))
+	}
+	secret, err := resolve(logger, ref)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve the %q secret reference: %w", secretRefPrefix+name, err)
+	}
+	return secret, nil
+}
+
+// envSecret returns the secret held by the environment variable named ref.
+func envSecret(_ *slog.Logger, ref string) (string, error) {
+	secret, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("the environment variable %q is not set", ref)
+	}
+	if secret == "" {
+		return "", fmt.Errorf("the environment variable %q is empty", ref)
+	}
+	return secret, nil
+}
+
+// fileSecretRef returns the secret read from the file at the absolute path ref.
+func fileSecretRef(logger *slog.Logger, ref string) (string, error) {
+	if !filepath.IsAbs(ref) {
+		return "", fmt.Errorf("%q is not an absolute path", ref)
+	}
+	return fileSecret(logger, secretRefPrefix+"file", ref)
+}
+
+// commandSecretRef returns the secret printed by the command ref, whose arguments are separated by spaces as it is not
+// run by a shell.
+func commandSecretRef(_ *slog.Logger, ref string) (string, error) {
+	command := strings.Fields(ref)
+	if len(command) == 0 {
+		return "", errors.New("no command is given")
+	}
+	if !filepath.IsAbs(command[0]) {
+		return "", fmt.Errorf("%q is not an absolute path", command[0])
+	}
+	return commandSecret(secretRefPrefix+"cmd", command)
+}
+
+// vaultSecret returns the field of the Vault secret referenced by ref, <path>#<field>, e.g. secret/data/oidc#secret. The
+// address of Vault and the token to read the secret with are the ones of the VAULT_ADDR and VAULT_TOKEN environment
+// variables, like for the Vault client, as well as the VAULT_NAMESPACE and VAULT_CACERT ones if set. Both the
+// versioned and unversioned key/value secrets are supported.
+func vaultSecret(_ *slog.Logger, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", errors.New("the reference must be <path>#<field>")
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("the VAULT_ADDR environment variable is not set")
+	}
+	vaultToken := os.Getenv("VAULT_TOKEN")
+	if vaultToken == "" {
+		return "", errors.New("the VAULT_TOKEN environment variable is not set")
+	}
+
+	client := &http.Client{}
+	if caFile := os.Getenv("VAULT_CACERT"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read the VAULT_CACERT file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("no certificate found in the VAULT_CACERT file %q", caFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		client.Transport = transport
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", vaultToken)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxVaultResponseSize))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The body only holds the errors of Vault if the secret was not returned.
+		return "", fmt.Errorf("unexpected status %q from Vault: %s", resp.Status, body[:min(len(body), 1024)])
+	}
+
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("could not parse the response of Vault: %v", err)
+	}
+	data := secret.Data
+	// The versioned key/value secrets hold their fields in a nested object, next to their metadata.
+	if nested, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = nested
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("the Vault secret %q has no %q field", path, field)
+	}
+	if value == "" {
+		return "", fmt.Errorf("the %q field of the Vault secret %q is empty", field, path)
+	}
+	return value, nil
+}
@@ -0,0 +1,18 @@
+// Package sessionmode lists the modes of the sessions that authd can request.
+package sessionmode
+
+const (
+	// Login is the mode of the sessions authenticating the user to log in. The user authenticates with the provider,
+	// or with the local password if a token is cached, and then creates the local password if needed.
+	Login = "auth"
+
+	// ChangePassword is the mode of the sessions changing the local password of a user who already logged in. The
+	// user authenticates with the current local password and then sets the new one, without authenticating with
+	// the provider.
+	ChangePassword = "passwd"
+)
+
+// All returns all the session modes.
+func All() []string {
+	return []string{Login, ChangePassword}
+}
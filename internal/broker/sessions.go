@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// SessionInfo is the state of a current session, for debugging. It holds neither the tokens nor the secrets of the
+// session.
+type SessionInfo struct {
+	// ID is the ID of the session.
+	ID string
+	// Username is the name of the user the session was created for.
+	Username string
+	// Mode is the mode of the session: login or password change.
+	Mode string
+	// IssuerURL is the issuer of the provider which authenticates the user.
+	IssuerURL string
+	// SelectedAuthMode is the authentication mode selected last, or empty if none was selected yet.
+	SelectedAuthMode string
+	// AuthStep is the current step of the authentication, starting at 0.
+	AuthStep int
+	// Authenticating is true while the broker waits for the authentication to complete, e.g. for the user to enter the
+	// device code.
+	Authenticating bool
+	// Offline is true if the provider could not be reached when the session was created.
+	Offline bool
+	// Created is when the session was created.
+	Created time.Time
+	// LastActivity is when the session was last updated by a request of authd.
+	LastActivity time.Time
+}
+
+// Sessions returns the state of the current sessions, from the oldest to the newest, so that the stuck logins can be
+// diagnosed.
+func (b *Broker) Sessions() []SessionInfo {
+	b.currentSessionsMu.RLock()
+	infos := make([]SessionInfo, 0, len(b.currentSessions))
+	for id, s := range b.currentSessions {
+		infos = append(infos, SessionInfo{
+			ID:               id,
+			Username:         s.username,
+			Mode:             s.mode,
+			IssuerURL:        s.issuerURL,
+			SelectedAuthMode: s.selectedMode,
+			AuthStep:         s.currentAuthStep,
+			Authenticating:   s.isAuthenticating != nil,
+			Offline:          s.isOffline,
+			Created:          s.created,
+			LastActivity:     s.lastActivity,
+		})
+	}
+	b.currentSessionsMu.RUnlock()
+
+	slices.SortFunc(infos, func(a, b SessionInfo) int {
+		return cmp.Or(a.Created.Compare(b.Created), cmp.Compare(a.ID, b.ID))
+	})
+	return infos
+}
+
+// addSession makes the session current. If the maximum number of concurrent sessions is reached, the session which was
+// idle for the longest time is ended to make room for it, unless all the sessions are authenticating.
+func (b *Broker) addSession(sessionID string, s session) error {
+	s.lastActivity = time.Now()
+	if s.created.IsZero() {
+		s.created = s.lastActivity
+	}
+
+	b.currentSessionsMu.Lock()
+	var evicted *session
+	if b.cfg.maxSessions > 0 && len(b.currentSessions) >= b.cfg.maxSessions {
+		evictedID, ok := b.oldestIdleSession()
+		if !ok {
+			b.currentSessionsMu.Unlock()
+			return fmt.Errorf("maximum number of concurrent sessions (%d) reached", b.cfg.maxSessions)
+		}
+		b.logger.Info(fmt.Sprintf("Ending idle session %q to make room for a new session", evictedID))
+		old := b.currentSessions[evictedID]
+		evicted = &old
+		delete(b.currentSessions, evictedID)
+	}
+	if b.cfg.sessionIdleTimeout > 0 {
+		s.idleTimer = time.AfterFunc(b.cfg.sessionIdleTimeout, func() { b.endIdleSession(sessionID) })
+	}
+	b.currentSessions[sessionID] = s
+	b.currentSessionsMu.Unlock()
+	b.persistSessions()
+
+	if evicted != nil {
+		b.releaseSession(evicted)
+	}
+	return nil
+}
+
+// oldestIdleSession returns the ID of the session which was idle for the longest time, ignoring the ones which are
+// authenticating. currentSessionsMu must be held by the caller.
+func (b *Broker) oldestIdleSession() (sessionID string, ok bool) {
+	var oldest time.Time
+	for id, s := range b.currentSessions {
+		if s.isAuthenticating != nil {
+			continue
+		}
+		if !ok || s.lastActivity.Before(oldest) {
+			sessionID, oldest, ok = id, s.lastActivity, true
+		}
+	}
+	return sessionID, ok
+}
+
+// endIdleSession ends the session if it was idle for longer than the session idle timeout. Otherwise, it checks again
+// when the session would reach the timeout.
+func (b *Broker) endIdleSession(sessionID string) {
+	s, err := b.getSession(sessionID)
+	if err != nil {
+		// The session was already ended.
+		return
+	}
+
+	// A session waiting for the user to authenticate is not idle, even if authd does not send any request meanwhile.
+	if s.isAuthenticating != nil {
+		s.idleTimer.Reset(b.cfg.sessionIdleTimeout)
+		return
+	}
+	idle := time.Since(s.lastActivity)
+	if idle < b.cfg.sessionIdleTimeout {
+		s.idleTimer.Reset(b.cfg.sessionIdleTimeout - idle)
+		return
+	}
+
+	b.logger.Info(fmt.Sprintf("Ending session %q after being idle for %s", sessionID, idle.Round(time.Second)))
+	if err := b.EndSession(sessionID); err != nil {
+		b.logger.Debug(fmt.Sprintf("Could not end idle session %q: %v", sessionID, err))
+	}
+}
+
+// removeSession removes the session from the current ones and returns it.
+func (b *Broker) removeSession(sessionID string) (session, error) {
+	b.currentSessionsMu.Lock()
+	defer b.currentSessionsMu.Unlock()
+
+	s, active := b.currentSessions[sessionID]
+	if !active {
+		return session{}, fmt.Errorf("%s is not a current transaction", sessionID)
+	}
+	delete(b.currentSessions, sessionID)
+	return s, nil
+}
+
+// releaseSession frees the resources of a session which was removed from the current ones: its idle timer, and the
+// context of its running authentication, if any. The refresh token is also revoked, and cleared from the cached token,
+// if configured.
+func (b *Broker) releaseSession(s *session) {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	if s.isAuthenticating != nil {
+		s.isAuthenticating.cancelFunc()
+	}
+
+	// Failing to revoke the token must not prevent the session from ending, so the error is only logged.
+	if b.cfg.revokeOnLogout && !s.isOffline {
+		b.revokeRefreshToken(s)
+	}
+}
@@ -0,0 +1,221 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/ubuntu/decorate"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// homeDirPollInterval is how often the broker checks whether the home directory of a user it granted access to was
+	// created, to copy the skeleton directory to it.
+	homeDirPollInterval = time.Second
+	// homeDirWaitTimeout is how long the broker waits for the home directory of a user it granted access to be created.
+	homeDirWaitTimeout = time.Minute
+)
+
+// populateHomeDir copies the files of the configured skeleton directory which are missing from the home directory, owned
+// by the owner of the home directory. The existing files are never replaced, so that the changes of the user are kept
+// and that a home directory created for another provider can be populated too.
+//
+// The broker does not know the UID of the user, which is assigned by authd once the login is granted, so it does not
+// create the home directory. If it does not exist yet, as on the first login of the user, the files are copied in the
+// background once it is created.
+func (b *Broker) populateHomeDir(home string) error {
+	if b.cfg.skelDir == "" || home == "" {
+		return nil
+	}
+
+	if _, err := os.Lstat(home); errors.Is(err, fs.ErrNotExist) {
+		b.logger.Debug(fmt.Sprintf("Copying the skeleton directory to %q once it is created", home))
+		go b.populateHomeDirOnceCreated(home)
+		return nil
+	}
+	return b.copySkelDir(home)
+}
+
+// populateHomeDirOnceCreated waits for the home directory to be created, and then copies the skeleton directory to it.
+// The errors are only logged, as the user was already granted access.
+func (b *Broker) populateHomeDirOnceCreated(home string) {
+	ticker := time.NewTicker(homeDirPollInterval)
+	defer ticker.Stop()
+	timeout := time.After(homeDirWaitTimeout)
+	for {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			b.logger.Warn(fmt.Sprintf("Not copying the skeleton directory to %q, which was not created within %s", home, homeDirWaitTimeout))
+			return
+		}
+
+		if _, err := os.Lstat(home); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := b.copySkelDir(home); err != nil {
+			b.logger.Warn(err.Error())
+		}
+		return
+	}
+}
+
+// copySkelDir copies the skeleton directory to the existing home directory.
+//
+// The user can replace the directories of their home directory by symlinks while the files are copied as root. The
+// files are therefore only created and chowned relative to the file descriptor of their parent directory, which is
+// opened without following symlinks, so that nothing outside of the home directory is ever written.
+func (b *Broker) copySkelDir(home string) (err error) {
+	defer decorate.OnError(&err, "could not copy the skeleton directory %q to %q", b.cfg.skelDir, home)
+
+	homeFd, err := unix.Open(home, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.ENOTDIR) || errors.Is(err, unix.ELOOP) {
+		return fmt.Errorf("%q is not a directory", home)
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(homeFd)
+
+	var owner unix.Stat_t
+	if err := unix.Fstat(homeFd, &owner); err != nil {
+		return err
+	}
+	return copyDirAt(b.cfg.skelDir, homeFd, int(owner.Uid), int(owner.Gid))
+}
+
+// copyDirAt copies the entries of the directory src which are missing from the directory dirFd, owned by uid and gid,
+// with the permissions and the times of the source. The existing directories are merged, and the existing files are
+// kept. The entries which are neither directories, regular files nor symlinks are not copied.
+func copyDirAt(src string, dirFd, uid, gid int) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(src, e.Name())
+		switch {
+		case fi.IsDir():
+			err = copySubdirAt(path, fi, dirFd, uid, gid)
+		case fi.Mode().IsRegular():
+			err = copyFileAt(path, fi, dirFd, uid, gid)
+		case fi.Mode()&fs.ModeSymlink != 0:
+			err = copySymlinkAt(path, fi, dirFd, uid, gid)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copySubdirAt copies the directory src to the directory with the same name in dirFd, creating it if it is missing. An
+// existing entry which is not a directory, e.g. a symlink, is kept as it is.
+func copySubdirAt(src string, fi fs.FileInfo, dirFd, uid, gid int) error {
+	name := fi.Name()
+	created := true
+	if err := unix.Mkdirat(dirFd, name, 0700); errors.Is(err, unix.EEXIST) {
+		created = false
+	} else if err != nil {
+		return err
+	}
+
+	fd, err := unix.Openat(dirFd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if !created && (errors.Is(err, unix.ENOTDIR) || errors.Is(err, unix.ELOOP)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if err := copyDirAt(src, fd, uid, gid); err != nil {
+		return err
+	}
+	if !created {
+		return nil
+	}
+	if err := unix.Fchown(fd, uid, gid); err != nil {
+		return err
+	}
+	if err := unix.Fchmod(fd, uint32(fi.Mode().Perm())); err != nil {
+		return err
+	}
+	// The times are set once the content is copied, which changes them.
+	return preserveTimesAt(dirFd, fi)
+}
+
+// copyFileAt copies the regular file src to the file with the same name in dirFd, unless it exists.
+func copyFileAt(src string, fi fs.FileInfo, dirFd, uid, gid int) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fd, err := unix.Openat(dirFd, fi.Name(), unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	out := os.NewFile(uintptr(fd), fi.Name())
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	// The file is chowned before its permissions are set, as chown clears the setuid and setgid bits.
+	if err := out.Chown(uid, gid); err != nil {
+		return err
+	}
+	if err := out.Chmod(fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return preserveTimesAt(dirFd, fi)
+}
+
+// copySymlinkAt copies the symlink src to the symlink with the same name in dirFd, unless it exists. The target of the
+// symlink is not copied.
+func copySymlinkAt(src string, fi fs.FileInfo, dirFd, uid, gid int) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if err := unix.Symlinkat(target, dirFd, fi.Name()); errors.Is(err, unix.EEXIST) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := unix.Fchownat(dirFd, fi.Name(), uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	return preserveTimesAt(dirFd, fi)
+}
+
+// preserveTimesAt sets the access and the modification times of the entry with the name of fi in dirFd to the ones of
+// fi, without following symlinks.
+func preserveTimesAt(dirFd int, fi fs.FileInfo) error {
+	atime := fi.ModTime()
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		atime = time.Unix(st.Atim.Unix())
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(fi.ModTime().UnixNano())}
+	return unix.UtimesNanoAt(dirFd, fi.Name(), ts, unix.AT_SYMLINK_NOFOLLOW)
+}
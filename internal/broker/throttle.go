@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultFailedAttemptsWindow is the period within which the failed attempts are counted, unless configured
+	// otherwise.
+	defaultFailedAttemptsWindow = 15 * time.Minute
+	// defaultLockoutDuration is how long a user is locked out the first time, unless configured otherwise.
+	defaultLockoutDuration = time.Minute
+	// maxLockoutDuration caps the lockout of the users who keep failing to enter their local password.
+	maxLockoutDuration = 24 * time.Hour
+)
+
+// failedAttempts are the failed local password attempts of a user.
+type failedAttempts struct {
+	// count is the number of failures since windowStart.
+	count       int
+	windowStart time.Time
+	// lockouts is the number of times the user was locked out since their last successful login. Each lockout lasts
+	// twice as long as the previous one.
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// passwordThrottle tracks the failed local password attempts of the users. They are tracked by user instead of by
+// session, so that starting a new session does not allow more attempts.
+type passwordThrottle struct {
+	mu    sync.Mutex
+	users map[string]*failedAttempts
+}
+
+// lockedOut returns how long the user is still locked out for, or 0 if they are not.
+func (t *passwordThrottle) lockedOut(username string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a, ok := t.users[username]
+	if !ok || !now.Before(a.lockedUntil) {
+		return 0
+	}
+	return a.lockedUntil.Sub(now)
+}
+
+// recordFailure counts a failed attempt of the user, and locks them out if it is their maxAttempts-th failure within
+// window. It returns how long the user is locked out for, or 0 if they are not.
+func (t *passwordThrottle) recordFailure(username string, now time.Time, maxAttempts int, window, lockout time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.users == nil {
+		t.users = make(map[string]*failedAttempts)
+	}
+	a, ok := t.users[username]
+	if !ok {
+		a = &failedAttempts{}
+		t.users[username] = a
+	}
+
+	if a.count == 0 || now.Sub(a.windowStart) > window {
+		a.count = 0
+		a.windowStart = now
+	}
+	a.count++
+	if a.count < maxAttempts {
+		return 0
+	}
+
+	duration := lockout
+	for range a.lockouts {
+		if duration >= maxLockoutDuration/2 {
+			duration = maxLockoutDuration
+			break
+		}
+		duration *= 2
+	}
+	a.count = 0
+	a.lockouts++
+	a.lockedUntil = now.Add(duration)
+	return duration
+}
+
+// reset forgets the failed attempts of the user, e.g. after they logged in successfully.
+func (t *passwordThrottle) reset(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.users, username)
+}
+
+// passwordLockout returns how long the user is still locked out of the local password mode for, or 0 if they are not.
+func (b *Broker) passwordLockout(username string) time.Duration {
+	return b.passwordThrottle.lockedOut(b.providerFor(username).NormalizeUsername(username), time.Now())
+}
+
+// recordPasswordFailure counts a failed local password attempt of the user, if the failed attempts are limited, and
+// returns how long the user is locked out for, or 0 if they are not.
+func (b *Broker) recordPasswordFailure(username string) time.Duration {
+	if b.cfg.maxFailedAttempts == 0 {
+		return 0
+	}
+	return b.passwordThrottle.recordFailure(b.providerFor(username).NormalizeUsername(username), time.Now(),
+		b.cfg.maxFailedAttempts, b.cfg.failedAttemptsWindow, b.cfg.lockoutDuration)
+}
+
+// resetPasswordFailures forgets the failed local password attempts of the user.
+func (b *Broker) resetPasswordFailures(username string) {
+	b.passwordThrottle.reset(b.providerFor(username).NormalizeUsername(username))
+}
+
+// tooManyAttemptsMessage is the message returned to a user who is locked out for the given duration.
+func tooManyAttemptsMessage(lockout time.Duration) errorMessage {
+	seconds := time.Duration(math.Ceil(lockout.Seconds())) * time.Second
+	return errorMessage{
+		Message: fmt.Sprintf("too many failed attempts, try again in %s", seconds),
+		err:     fmt.Errorf("%w: locked out for %s", ErrTooManyAttempts, seconds),
+	}
+}
@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/token"
+)
+
+// TokenStore stores the tokens of the users, which let them log in with the local password and refresh their user
+// info. The tokens are identified by the issuer of the provider and the username.
+type TokenStore interface {
+	// Load returns the token of the user. The error wraps fs.ErrNotExist if no token is stored for the user, and
+	// token.ErrInvalidCache if the stored one can not be decrypted or parsed.
+	Load(issuer, username string) (token.AuthCachedInfo, error)
+	// Save stores the token of the user, replacing the previous one at once.
+	Save(issuer, username string, t token.AuthCachedInfo) error
+	// Delete removes the token of the user. It is not an error if no token is stored.
+	Delete(issuer, username string) error
+}
+
+// FileTokenStore is the TokenStore storing the tokens as files of the data directory, in
+// $DATA_DIR/$ISSUER/$USERNAME/token.json, encrypted if an encryption key is given.
+type FileTokenStore struct {
+	dataDir string
+	opts    []token.Option
+}
+
+// NewFileTokenStore returns a FileTokenStore storing the tokens in the data directory.
+func NewFileTokenStore(dataDir string, opts ...token.Option) *FileTokenStore {
+	return &FileTokenStore{dataDir: dataDir, opts: opts}
+}
+
+// Path returns the path of the file storing the token of the user.
+func (s *FileTokenStore) Path(issuer, username string) string {
+	return filepath.Join(s.dataDir, issuerDirName(issuer), username, "token.json")
+}
+
+// Load returns the token of the user. A plaintext token is migrated by storing it encrypted, if an encryption key is
+// given.
+func (s *FileTokenStore) Load(issuer, username string) (token.AuthCachedInfo, error) {
+	return token.LoadAuthInfo(s.Path(issuer, username), s.opts...)
+}
+
+// read returns the token of the user like Load, but never writes it, e.g. when the token is only inspected.
+func (s *FileTokenStore) read(issuer, username string) (token.AuthCachedInfo, error) {
+	return token.ReadAuthInfo(s.Path(issuer, username), s.opts...)
+}
+
+// Save stores the token of the user.
+func (s *FileTokenStore) Save(issuer, username string, t token.AuthCachedInfo) error {
+	return token.CacheAuthInfo(s.Path(issuer, username), t, s.opts...)
+}
+
+// Delete removes the token of the user.
+func (s *FileTokenStore) Delete(issuer, username string) error {
+	if err := os.Remove(s.Path(issuer, username)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not remove token: %v", err)
+	}
+	return nil
+}
+
+// memoryTokenKey identifies a token of a MemoryTokenStore.
+type memoryTokenKey struct {
+	issuer   string
+	username string
+}
+
+// MemoryTokenStore is the TokenStore keeping the tokens in memory, so that they are lost when the broker stops, e.g.
+// for tests. The tokens are stored serialized, so that the loaded ones can be modified without changing the stored ones.
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[memoryTokenKey][]byte
+}
+
+// NewMemoryTokenStore returns an empty MemoryTokenStore.
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[memoryTokenKey][]byte)}
+}
+
+// Load returns the token of the user.
+func (s *MemoryTokenStore) Load(issuer, username string) (token.AuthCachedInfo, error) {
+	s.mu.Lock()
+	data, ok := s.tokens[memoryTokenKey{issuer, username}]
+	s.mu.Unlock()
+	if !ok {
+		return token.AuthCachedInfo{}, fmt.Errorf("no token is stored for user %q of %q: %w", username, issuer, fs.ErrNotExist)
+	}
+
+	var t token.AuthCachedInfo
+	if err := json.Unmarshal(data, &t); err != nil {
+		return token.AuthCachedInfo{}, fmt.Errorf("%w: could not unmarshal token: %v", token.ErrInvalidCache, err)
+	}
+	// Set the extra fields of the token, like when it is read from a file.
+	if t.Token != nil && t.ExtraFields != nil {
+		t.Token = t.Token.WithExtra(t.ExtraFields)
+	}
+	return t, nil
+}
+
+// Save stores the token of the user.
+func (s *MemoryTokenStore) Save(issuer, username string, t token.AuthCachedInfo) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("could not marshal token: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[memoryTokenKey{issuer, username}] = data
+	return nil
+}
+
+// Delete removes the token of the user.
+func (s *MemoryTokenStore) Delete(issuer, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, memoryTokenKey{issuer, username})
+	return nil
+}
@@ -0,0 +1,153 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"github.com/ubuntu/authd-oidc-brokers/internal/token"
+)
+
+// uidsFileName is the name of the file, in the data directory, where the UIDs assigned to the users are stored.
+const uidsFileName = "uids.json"
+
+// idMappings are the IDs assigned to the users by subject, or to the groups by UGID, by issuer.
+type idMappings map[string]map[string]uint32
+
+// isAssigned returns true if the ID is assigned to a user or a group.
+func (m idMappings) isAssigned(id uint32) bool {
+	for _, assignments := range m {
+		for _, assigned := range assignments {
+			if assigned == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// assign assigns the ID to the user or the group with the given key, of the provider with the given issuer.
+func (m idMappings) assign(issuerURL, key string, id uint32) {
+	if m[issuerURL] == nil {
+		m[issuerURL] = make(map[string]uint32)
+	}
+	m[issuerURL][key] = id
+}
+
+// loadIDMappings returns the IDs stored in the file, which are empty if none was stored yet.
+func loadIDMappings(path string) (idMappings, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return idMappings{}, nil
+	}
+
+	data, err := token.LoadData(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := idMappings{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("could not parse %q: %v", path, err)
+	}
+	return m, nil
+}
+
+// storeIDMappings stores the IDs in the file.
+func storeIDMappings(path string, m idMappings) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("could not marshal the IDs: %v", err)
+	}
+	return token.StoreData(path, data)
+}
+
+// nextFreeID returns the first ID of the range, from id, which is not used, going back to the start of the range after
+// its end. It returns false if all the IDs of the range are used.
+func nextFreeID(id, minID, maxID uint32, isUsed func(uint32) bool) (uint32, bool) {
+	size := uint64(maxID-minID) + 1
+	for i := uint64(0); i < size; i++ {
+		if !isUsed(id) {
+			return id, true
+		}
+		if id == maxID {
+			id = minID
+		} else {
+			id++
+		}
+	}
+	return 0, false
+}
+
+// subjectUID returns the UID derived from the subject of the user of the provider with the given issuer: the first 8
+// bytes of the SHA-256 of "<issuer>#<subject>", as a big-endian integer, modulo the size of the UID range, plus the
+// minimum UID. It is the same on every machine using the same range, and users with the same subject from different
+// providers get different UIDs. It returns 0 if no UID range is configured.
+func (uc userConfig) subjectUID(issuerURL, subject string) uint32 {
+	if uc.uidMax == 0 {
+		return 0
+	}
+
+	sum := sha256.Sum256([]byte(issuerURL + "#" + subject))
+	size := uint64(uc.uidMax-uc.uidMin) + 1
+	return uc.uidMin + uint32(binary.BigEndian.Uint64(sum[:8])%size)
+}
+
+// uidsPath returns the path of the file where the UIDs assigned to the users are stored.
+func (b *Broker) uidsPath() string {
+	return filepath.Join(b.cfg.DataDir, uidsFileName)
+}
+
+// assignUID returns the UID of the user of the provider with the given issuer, if a UID range is configured, and stores
+// it so that the user keeps it. It is the UID derived from the subject, unless it is already assigned to another user
+// or used by another local user, in which case the next free UID of the range is assigned, going back to its start
+// after its end. It returns 0 if no UID range is configured or if the provider did not tell the subject.
+func (b *Broker) assignUID(issuerURL string, userInfo info.User) (uint32, error) {
+	if b.cfg.uidMax == 0 || userInfo.UUID == "" {
+		return 0, nil
+	}
+
+	b.uidsMu.Lock()
+	defer b.uidsMu.Unlock()
+
+	m, err := loadIDMappings(b.uidsPath())
+	if err != nil {
+		return 0, err
+	}
+	if uid, ok := m[issuerURL][userInfo.UUID]; ok {
+		return uid, nil
+	}
+
+	uid, ok := nextFreeID(b.cfg.subjectUID(issuerURL, userInfo.UUID), b.cfg.uidMin, b.cfg.uidMax, func(uid uint32) bool {
+		return b.uidIsUsed(m, uid, userInfo.Name)
+	})
+	if !ok {
+		return 0, fmt.Errorf("all the UIDs from %d to %d are already used", b.cfg.uidMin, b.cfg.uidMax)
+	}
+
+	m.assign(issuerURL, userInfo.UUID, uid)
+	if err := storeIDMappings(b.uidsPath(), m); err != nil {
+		return 0, err
+	}
+	return uid, nil
+}
+
+// uidIsUsed returns true if the UID is assigned to another user, or if it is the UID of a local user other than the
+// user with the given name, e.g. one created before the UIDs were stored.
+func (b *Broker) uidIsUsed(m idMappings, uid uint32, username string) bool {
+	if m.isAssigned(uid) {
+		return true
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return false
+	}
+	p := b.providerFor(username)
+	return p.NormalizeUsername(u.Username) != p.NormalizeUsername(username)
+}
@@ -0,0 +1,98 @@
+package broker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"golang.org/x/oauth2"
+)
+
+// defaultGroupsCacheTTL is how long the user info and groups fetched from the provider are reused for the same access
+// token, unless configured otherwise.
+const defaultGroupsCacheTTL = time.Minute
+
+// userInfoCache holds the user info, with the groups, fetched from the provider for each access token, so that the
+// provider API is not called again when the same token is used in several steps of the authentication.
+type userInfoCache struct {
+	mu      sync.Mutex
+	entries map[string]userInfoCacheEntry
+}
+
+type userInfoCacheEntry struct {
+	userInfo info.User
+	expiry   time.Time
+}
+
+// userInfoCacheKey returns the key of the access token in the cache. The token is hashed, so that the cache does not
+// hold usable tokens.
+func userInfoCacheKey(t *oauth2.Token) string {
+	sum := sha256.Sum256([]byte(t.AccessToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the user info cached for the key, if it has not expired at now.
+func (c *userInfoCache) get(key string, now time.Time) (info.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.expiry) {
+		return info.User{}, false
+	}
+	u := e.userInfo
+	u.Groups = slices.Clone(u.Groups)
+	return u, true
+}
+
+// put caches the user info for the key until expiry, and removes the expired entries.
+func (c *userInfoCache) put(key string, u info.User, expiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if !now.Before(e.expiry) {
+			delete(c.entries, k)
+		}
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]userInfoCacheEntry)
+	}
+	u.Groups = slices.Clone(u.Groups)
+	c.entries[key] = userInfoCacheEntry{userInfo: u, expiry: expiry}
+}
+
+// remove removes the user info cached for the key, if any.
+func (c *userInfoCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+// providerUserInfo returns the user info, with the groups, of the provider p for the access token. It is reused for the
+// configured TTL, so that the groups are not fetched again while the same token is used.
+func (b *Broker) providerUserInfo(ctx context.Context, p providers.Provider, accessToken *oauth2.Token, idToken *oidc.IDToken) (info.User, error) {
+	if b.cfg.groupsCacheTTL <= 0 || accessToken == nil || accessToken.AccessToken == "" {
+		return p.GetUserInfo(ctx, accessToken, idToken)
+	}
+
+	key := userInfoCacheKey(accessToken)
+	if u, ok := b.userInfoCache.get(key, time.Now()); ok {
+		return u, nil
+	}
+
+	u, err := p.GetUserInfo(ctx, accessToken, idToken)
+	if err != nil {
+		return info.User{}, err
+	}
+	b.userInfoCache.put(key, u, time.Now().Add(b.cfg.groupsCacheTTL))
+	return u, nil
+}
@@ -0,0 +1,187 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	providerErrors "github.com/ubuntu/authd-oidc-brokers/internal/providers/errors"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"github.com/ubuntu/authd-oidc-brokers/internal/token"
+)
+
+const (
+	// usernameCollisionReject denies the login of a user whose username is already used by another user.
+	usernameCollisionReject = "reject"
+	// usernameCollisionSuffix gives a user whose username is already used by another user the same username with the
+	// first free numeric suffix, e.g. user-2@example.com.
+	usernameCollisionSuffix = "suffix"
+
+	// usernamesFileName is the name of the file, in the data directory, where the usernames of the users are stored.
+	usernamesFileName = "usernames.json"
+)
+
+// usernameMappings are the local usernames of the users, by subject, by issuer.
+type usernameMappings map[string]map[string]string
+
+// subjectOf returns the subject which the username is mapped to, if any.
+func (m usernameMappings) subjectOf(issuerURL, username string) (string, bool) {
+	for subject, name := range m[issuerURL] {
+		if name == username {
+			return subject, true
+		}
+	}
+	// The usernames are shared by all the providers.
+	for issuer, subjects := range m {
+		if issuer == issuerURL {
+			continue
+		}
+		for _, name := range subjects {
+			if name == username {
+				return "", true
+			}
+		}
+	}
+	return "", false
+}
+
+// usernamesPath returns the path of the file where the usernames of the users are stored.
+func (b *Broker) usernamesPath() string {
+	return filepath.Join(b.cfg.DataDir, usernamesFileName)
+}
+
+// loadUsernameMappings returns the stored usernames of the users, which are empty if none was stored yet.
+func (b *Broker) loadUsernameMappings() (usernameMappings, error) {
+	path := b.usernamesPath()
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return usernameMappings{}, nil
+	}
+
+	data, err := token.LoadData(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := usernameMappings{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("could not parse the usernames: %v", err)
+	}
+	return m, nil
+}
+
+// localUsername returns the username of the user on this machine. It is the username of the user on the provider,
+// unless another subject has it. If so, the login is denied or the username gets a suffix, depending on the
+// configured strategy. The username of a user is kept once recorded, so that it does not depend on who logs in first.
+func (b *Broker) localUsername(issuerURL string, userInfo info.User) (string, error) {
+	if b.cfg.usernameCollision == "" || userInfo.UUID == "" {
+		return userInfo.Name, nil
+	}
+
+	b.usernamesMu.Lock()
+	defer b.usernamesMu.Unlock()
+
+	m, err := b.loadUsernameMappings()
+	if err != nil {
+		return "", err
+	}
+
+	username := b.providerFor(userInfo.Name).NormalizeUsername(userInfo.Name)
+	if name, ok := m[issuerURL][userInfo.UUID]; ok {
+		if name == username {
+			return userInfo.Name, nil
+		}
+		return name, nil
+	}
+
+	subject, taken := m.subjectOf(issuerURL, username)
+	if !taken || subject == userInfo.UUID {
+		return userInfo.Name, nil
+	}
+	if b.cfg.usernameCollision == usernameCollisionReject {
+		err := providerErrors.NewForDisplayError("the username %q is already used by another user", userInfo.Name)
+		return "", &err
+	}
+
+	for i := 2; ; i++ {
+		name := usernameWithSuffix(username, i)
+		if _, taken := m.subjectOf(issuerURL, name); !taken {
+			return name, nil
+		}
+	}
+}
+
+// recordUsername stores the username of the user on this machine, so that the user keeps it and is listed in the
+// managed users. If no username collision strategy is configured, a username which another user has stays recorded
+// for them only, as both users share it.
+func (b *Broker) recordUsername(issuerURL string, userInfo info.User) error {
+	if userInfo.UUID == "" {
+		return nil
+	}
+
+	b.usernamesMu.Lock()
+	defer b.usernamesMu.Unlock()
+
+	m, err := b.loadUsernameMappings()
+	if err != nil {
+		return err
+	}
+
+	username := b.providerFor(userInfo.Name).NormalizeUsername(userInfo.Name)
+	if m[issuerURL][userInfo.UUID] == username {
+		return nil
+	}
+	// Another user with the same username may have logged in since the username was resolved.
+	if subject, taken := m.subjectOf(issuerURL, username); taken && subject != userInfo.UUID {
+		if b.cfg.usernameCollision == "" {
+			return nil
+		}
+		return fmt.Errorf("the username %q is already used by another user", username)
+	}
+
+	if m[issuerURL] == nil {
+		m[issuerURL] = make(map[string]string)
+	}
+	m[issuerURL][userInfo.UUID] = username
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("could not marshal the usernames: %v", err)
+	}
+	return token.StoreData(b.usernamesPath(), data)
+}
+
+// usernameFromClaims returns the username of the user read from the configured username claim of the ID token, or
+// else the one returned by the provider, without its domain part if configured so.
+func (b *Broker) usernameFromClaims(idToken *oidc.IDToken, providerUsername string) (string, error) {
+	username := providerUsername
+	if b.cfg.usernameClaim != "" {
+		var claims map[string]any
+		if err := idToken.Claims(&claims); err != nil {
+			return "", fmt.Errorf("could not get ID token claims: %v", err)
+		}
+		var ok bool
+		if username, ok = claims[b.cfg.usernameClaim].(string); !ok || username == "" {
+			return "", fmt.Errorf("the ID token has no %q claim with the username", b.cfg.usernameClaim)
+		}
+	}
+
+	if b.cfg.usernameStripDomain {
+		if i := strings.LastIndex(username, "@"); i >= 0 {
+			username = username[:i]
+		}
+	}
+	return username, nil
+}
+
+// usernameWithSuffix returns the username with the numeric suffix appended to its local part.
+func usernameWithSuffix(username string, n int) string {
+	local, domain, found := strings.Cut(username, "@")
+	if !found {
+		return fmt.Sprintf("%s-%d", username, n)
+	}
+	return fmt.Sprintf("%s-%d@%s", local, n, domain)
+}
@@ -0,0 +1,219 @@
+package broker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/fileutils"
+	"github.com/ubuntu/decorate"
+)
+
+// userRemovedFileName is the name of the file, in the data directory of the user, which flags that the provider told
+// that their account does not exist anymore.
+const userRemovedFileName = "removed_at_provider"
+
+// RemoveUser forgets the user, whose account was removed at the provider, and applies the configured policy to their
+// home directory. It is never done while the users log in, even when the provider tells that the account of the user
+// does not exist anymore, as their home directory may be deleted.
+func (b *Broker) RemoveUser(username string) (err error) {
+	b.cfgMu.RLock()
+	p, err := b.cfg.oidcProviderFor(username)
+	b.cfgMu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("could not remove user %q: %w", username, err)
+	}
+	return b.removeUser(p.issuerURL, username)
+}
+
+// removeUser deletes the token, the password and the other data of the user of the issuer, so that they can not log
+// in offline anymore, then keeps, archives or deletes their home directory. The username stays recorded for their
+// subject, so that another account of the provider can not take over the local user, which authd still knows.
+func (b *Broker) removeUser(issuerURL, username string) (err error) {
+	defer decorate.OnError(&err, "could not remove user %q", username)
+
+	b.userRemovalMu.Lock()
+	defer b.userRemovalMu.Unlock()
+
+	// The home directory is the one returned at the last login of the user, which is stored with their token.
+	var home string
+	if t, err := b.tokenStore.Load(issuerURL, username); err == nil {
+		home = t.UserInfo.Home
+	}
+	if home == "" {
+		if home, err = b.homeDir(username, username, issuerURL); err != nil {
+			return err
+		}
+	}
+
+	if err := b.tokenStore.Delete(issuerURL, username); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(b.userDataDir(issuerURL, username)); err != nil {
+		return err
+	}
+
+	if b.cfg.onUserRemoval == userRemovalKeep {
+		b.logger.Info(fmt.Sprintf("Removed user %q, keeping their home directory %q", username, home))
+		return nil
+	}
+
+	// The home directory can come from the claims of the provider, so it is only deleted if it is within the home
+	// directory prefix, and not a link to anything else.
+	if rel, err := filepath.Rel(b.cfg.homeBaseDir, home); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("home directory %q is not within %q", home, b.cfg.homeBaseDir)
+	}
+	fi, err := os.Lstat(home)
+	if errors.Is(err, fs.ErrNotExist) {
+		b.logger.Info(fmt.Sprintf("Removed user %q, whose home directory %q does not exist", username, home))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory", home)
+	}
+
+	if b.cfg.onUserRemoval == userRemovalArchive {
+		archive := filepath.Join(b.cfg.userRemovalArchiveDir,
+			fmt.Sprintf("%s-%s.tar.gz", username, time.Now().UTC().Format("20060102T150405Z")))
+		if err := archiveDir(home, archive); err != nil {
+			return fmt.Errorf("could not archive the home directory %q: %v", home, err)
+		}
+		b.logger.Info(fmt.Sprintf("Archived the home directory %q of removed user %q to %q", home, username, archive))
+	}
+	if err := os.RemoveAll(home); err != nil {
+		return err
+	}
+	b.logger.Info(fmt.Sprintf("Removed user %q and deleted their home directory %q", username, home))
+	return nil
+}
+
+// archiveDir writes the gzipped tarball of the directory to path, with the owners and the permissions of its files.
+// The names of the files start with the name of the directory, so that it is extracted as it was. The sockets are not
+// archived, as they can not be.
+func archiveDir(dir, path string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// The archive is only renamed to path once complete. The temporary file is created with 0600 permissions.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSocket != 0 {
+			return nil
+		}
+
+		var link string
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Dir(dir), p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// handleUserRemoved forgets the token of the user of the session, whose account the provider told does not exist
+// anymore, and flags the user so that the managed users show it. The provider tells it in the free-text description
+// of its error, which can be misread, so the other data and the home directory of the user are only removed by
+// RemoveUser. The errors are only logged, as the authentication fails anyway.
+func (b *Broker) handleUserRemoved(session *session) {
+	b.logger.Warn(fmt.Sprintf("The account of user %q does not exist at the provider anymore, forgetting their token. "+
+		"Remove the user with the remove-user command if it was removed.", session.username))
+	if err := b.tokenStore.Delete(session.issuerURL, session.username); err != nil {
+		b.logger.Error(fmt.Sprintf("Could not forget the token of user %q: %v", session.username, err))
+	}
+
+	err := os.MkdirAll(session.userDataDir, 0700)
+	if err == nil {
+		err = fileutils.WriteFileAtomically(filepath.Join(session.userDataDir, userRemovedFileName),
+			[]byte(time.Now().UTC().Format(time.RFC3339)+"\n"))
+	}
+	if err != nil {
+		b.logger.Error(fmt.Sprintf("Could not flag user %q as removed at the provider: %v", session.username, err))
+	}
+}
+
+// unflagUserRemoved clears the flag of the user of the session, who was granted access, as their account exists at the
+// provider.
+func (b *Broker) unflagUserRemoved(session *session) error {
+	err := os.Remove(filepath.Join(session.userDataDir, userRemovedFileName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not clear the removal flag of user %q: %v", session.username, err)
+	}
+	return nil
+}
+
+// userRemovedAtProvider returns true if the user of the issuer is flagged as removed at the provider.
+func (b *Broker) userRemovedAtProvider(issuerURL, username string) (bool, error) {
+	_, err := os.Stat(filepath.Join(b.userDataDir(issuerURL, username), userRemovedFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
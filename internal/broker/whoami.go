@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"errors"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"github.com/ubuntu/authd-oidc-brokers/internal/token"
+	"github.com/ubuntu/decorate"
+)
+
+// Identity is the identity of the user who was granted access by a session. It holds no token.
+type Identity struct {
+	// Username is the local name of the user, as returned to authd.
+	Username string
+	// Subject is the subject of the user at the provider, the sub claim of their ID token.
+	Subject string
+	// IssuerURL is the issuer of the provider which authenticated the user.
+	IssuerURL string
+	// Groups are the names of the groups of the user, as returned to authd.
+	Groups []string
+}
+
+// WhoAmI returns the identity of the user of the session, without authenticating them again. It is only returned once
+// the session granted access to the user, so that a session created for another user does not reveal their cached
+// data.
+func (b *Broker) WhoAmI(sessionID string) (id Identity, err error) {
+	defer decorate.OnError(&err, "could not get the identity of session %q", sessionID)
+
+	session, err := b.getSession(sessionID)
+	if err != nil {
+		return Identity{}, err
+	}
+	userInfo, ok := session.authInfo[grantedUserInfoKey].(info.User)
+	if !ok {
+		return Identity{}, errors.New("the session did not grant access to its user")
+	}
+
+	// The token is only kept in the session if it was obtained from the provider or refreshed.
+	authInfo, ok := session.authInfo["auth_info"].(token.AuthCachedInfo)
+	if !ok {
+		if authInfo, err = b.tokenStore.Load(session.issuerURL, session.username); err != nil {
+			return Identity{}, err
+		}
+	}
+	idToken, err := parseVerifiedIDToken(authInfo.RawIDToken)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	id = Identity{
+		Username:  userInfo.Name,
+		Subject:   idToken.Subject,
+		IssuerURL: session.issuerURL,
+		Groups:    []string{},
+	}
+	for _, g := range userInfo.Groups {
+		id.Groups = append(id.Groups, g.Name)
+	}
+	return id, nil
+}
@@ -0,0 +1,74 @@
+package dbusservice
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// errPermissionDenied is the error returned to the callers which are not allowed to call a method.
+var errPermissionDenied = errors.New("permission denied")
+
+// lookupCallerUID returns the UID of the process which sent the method call, as the bus tells it.
+func (s *Service) lookupCallerUID(sender dbus.Sender) (uint32, error) {
+	s.connMu.Lock()
+	conn := s.conn
+	s.connMu.Unlock()
+	if conn == nil {
+		return 0, errors.New("not connected to the bus")
+	}
+
+	var uid uint32
+	if err := conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixUser", 0, string(sender)).Store(&uid); err != nil {
+		return 0, fmt.Errorf("could not get the UID of %q: %v", sender, err)
+	}
+	return uid, nil
+}
+
+// senderUID returns the UID of the process which sent the method call.
+func (s *Service) senderUID(sender dbus.Sender) (uint32, error) {
+	s.connMu.Lock()
+	callerUID := s.callerUID
+	s.connMu.Unlock()
+	return callerUID(sender)
+}
+
+// isPrivileged returns true if the UID is root's or the one the broker runs as, i.e. the one of authd or of the
+// administrator debugging the broker.
+func isPrivileged(uid uint32) bool {
+	return uid == 0 || uid == uint32(os.Geteuid())
+}
+
+// checkPrivilegedCaller returns an error unless the method call was sent by a privileged process.
+func (s *Service) checkPrivilegedCaller(sender dbus.Sender) error {
+	uid, err := s.senderUID(sender)
+	if err != nil {
+		return err
+	}
+	if !isPrivileged(uid) {
+		s.logger.Warn(fmt.Sprintf("Denied the call of %q, run by UID %d", sender, uid))
+		return errPermissionDenied
+	}
+	return nil
+}
+
+// checkSessionCaller returns an error unless the method call was sent by a privileged process or by a process of the
+// local user of the session.
+func (s *Service) checkSessionCaller(sender dbus.Sender, username string) error {
+	uid, err := s.senderUID(sender)
+	if err != nil {
+		return err
+	}
+	if isPrivileged(uid) {
+		return nil
+	}
+	if u, err := user.Lookup(username); err == nil && u.Uid == strconv.FormatUint(uint64(uid), 10) {
+		return nil
+	}
+	s.logger.Warn(fmt.Sprintf("Denied the call of %q, run by UID %d, for a session of user %q", sender, uid, username))
+	return errPermissionDenied
+}
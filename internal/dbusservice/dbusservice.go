@@ -4,6 +4,9 @@ package dbusservice
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/introspect"
@@ -46,51 +49,112 @@ const intro = `
 		<method name="UserPreCheck">
 			<arg type="s" direction="in" name="username"/>
 		</method>
+		<method name="HealthCheck">
+			<arg type="s" direction="out" name="status"/>
+		</method>
+		<method name="ListSessions">
+			<arg type="s" direction="out" name="sessions"/>
+		</method>
+		<method name="WhoAmI">
+			<arg type="s" direction="in" name="sessionID"/>
+			<arg type="s" direction="out" name="identity"/>
+		</method>
 	</interface>` + introspect.IntrospectDataString + `</node> `
 
 // Service is the handler exposing our broker methods on the system bus.
 type Service struct {
-	name   string
-	broker *broker.Broker
+	name          string
+	broker        *broker.Broker
+	useSessionBus bool
+	logger        *slog.Logger
 
 	serve      chan struct{}
 	disconnect func()
+	exported   atomic.Bool
+	stopOnce   sync.Once
+
+	// connMu protects conn, which is replaced when reconnecting to the bus.
+	connMu sync.Mutex
+	conn   *dbus.Conn
+
+	// callerUID returns the UID of the process which sent a method call. It is protected by connMu too.
+	callerUID func(sender dbus.Sender) (uint32, error)
+}
+
+type options struct {
+	useSessionBus bool
+	logger        *slog.Logger
+}
+
+// Option is the function signature used to tweak the service creation.
+type Option func(*options)
+
+// WithSessionBus makes the service connect to the session bus instead of the system bus.
+// This is meant to run the broker as an unprivileged user during development.
+func WithSessionBus() Option {
+	return func(o *options) {
+		o.useSessionBus = true
+	}
+}
+
+// WithLogger makes the service log with the given logger instead of the default one.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
 }
 
 // New returns a new dbus service after exporting to the system bus our name.
-func New(_ context.Context, broker *broker.Broker) (s *Service, err error) {
-	name := consts.DbusName
-	object := dbus.ObjectPath(consts.DbusObject)
-	iface := "com.ubuntu.authd.Broker"
+func New(_ context.Context, broker *broker.Broker, args ...Option) (s *Service, err error) {
+	opts := options{logger: slog.Default()}
+	for _, arg := range args {
+		arg(&opts)
+	}
+
 	s = &Service{
-		name:   name,
-		broker: broker,
-		serve:  make(chan struct{}),
+		name:          consts.DbusName,
+		broker:        broker,
+		useSessionBus: opts.useSessionBus,
+		logger:        opts.logger,
+		serve:         make(chan struct{}),
 	}
+	s.callerUID = s.lookupCallerUID
 
 	conn, err := s.getBus()
 	if err != nil {
 		return nil, err
 	}
+	if err := s.export(conn); err != nil {
+		s.disconnect()
+		return nil, err
+	}
+	s.exported.Store(true)
+
+	go s.watchConnection(conn)
+
+	return s, nil
+}
+
+// export exports our object on the connection and requests our name on the bus.
+func (s *Service) export(conn *dbus.Conn) error {
+	object := dbus.ObjectPath(consts.DbusObject)
+	iface := "com.ubuntu.authd.Broker"
 
 	if err := conn.Export(s, object, iface); err != nil {
-		return nil, err
+		return err
 	}
 	if err := conn.Export(introspect.Introspectable(fmt.Sprintf(intro, iface)), object, "org.freedesktop.DBus.Introspectable"); err != nil {
-		return nil, err
+		return err
 	}
 
-	reply, err := conn.RequestName(consts.DbusName, dbus.NameFlagDoNotQueue)
+	reply, err := conn.RequestName(s.name, dbus.NameFlagDoNotQueue)
 	if err != nil {
-		s.disconnect()
-		return nil, err
+		return err
 	}
 	if reply != dbus.RequestNameReplyPrimaryOwner {
-		s.disconnect()
-		return nil, fmt.Errorf("%q is already taken in the bus", name)
+		return fmt.Errorf("%q is already taken in the bus", s.name)
 	}
-
-	return s, nil
+	return nil
 }
 
 // Addr returns the address of the service.
@@ -98,20 +162,31 @@ func (s *Service) Addr() string {
 	return s.name
 }
 
-// Serve wait for the service.
+// Serve wait for the service, including while reconnecting to the bus.
 func (s *Service) Serve() error {
 	<-s.serve
 	return nil
 }
 
-// Stop stop the service and do all the necessary cleanup operation.
+// Reload reloads the broker configuration, keeping our name on the bus and the existing sessions.
+func (s *Service) Reload() error {
+	return s.broker.ReloadConfig()
+}
+
+// Stop stop the service and do all the necessary cleanup operation. It first waits, for the grace period configured in
+// the broker, for the running authentications to finish, and cancels the remaining ones, so that a restart does not
+// abort the users who are authenticating. The calls to Stop while it waits block until the service is stopped.
 func (s *Service) Stop() error {
-	// Check if already stopped.
-	select {
-	case <-s.serve:
-	default:
+	s.stopOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.broker.StopGracePeriod())
+		defer cancel()
+		if err := s.broker.Drain(ctx); err != nil {
+			s.logger.Warn(fmt.Sprintf("Cancelled the running authentications after the grace period: %v", err))
+		}
+
+		s.exported.Store(false)
 		close(s.serve)
 		s.disconnect()
-	}
+	})
 	return nil
 }
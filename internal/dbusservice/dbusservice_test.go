@@ -0,0 +1,434 @@
+//go:build !withlocalbus
+
+package dbusservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker"
+	"github.com/ubuntu/authd-oidc-brokers/internal/consts"
+	"github.com/ubuntu/authd-oidc-brokers/internal/dbusservice"
+	"github.com/ubuntu/authd-oidc-brokers/internal/testutils"
+)
+
+func TestNewWithSessionBus(t *testing.T) {
+	cleanup, err := testutils.StartSystemBusMock()
+	require.NoError(t, err, "Setup: Failed to start the private bus")
+	t.Cleanup(cleanup)
+
+	// Expose the private bus only as the session bus, so that the service would fail to connect to the system bus.
+	busAddress := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", busAddress)
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", "unix:path="+filepath.Join(t.TempDir(), "inexistent.sock"))
+
+	cfgPath := filepath.Join(t.TempDir(), "broker.conf")
+	err = os.WriteFile(cfgPath, []byte("[oidc]\nissuer = https://issuer.url.com\nclient_id = client_id\n"), 0600)
+	require.NoError(t, err, "Setup: Failed to write broker config file")
+	b, err := broker.New(broker.Config{ConfigFile: cfgPath, DataDir: t.TempDir()})
+	require.NoError(t, err, "Setup: Failed to create broker")
+
+	_, err = dbusservice.New(context.Background(), b)
+	require.Error(t, err, "New should fail to connect to the system bus")
+
+	s, err := dbusservice.New(context.Background(), b, dbusservice.WithSessionBus())
+	require.NoError(t, err, "New should connect to the session bus")
+	t.Cleanup(func() { _ = s.Stop() })
+
+	conn, err := dbus.Connect(busAddress)
+	require.NoError(t, err, "Setup: Failed to connect to the private bus")
+	t.Cleanup(func() { _ = conn.Close() })
+
+	var hasOwner bool
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, consts.DbusName).Store(&hasOwner)
+	require.NoError(t, err, "NameHasOwner should not return an error")
+	require.True(t, hasOwner, "Service should own its name on the session bus")
+
+	node, err := introspect.Call(conn.Object(consts.DbusName, dbus.ObjectPath(consts.DbusObject)))
+	require.NoError(t, err, "Introspection should not return an error")
+	var ifaces []string
+	for _, iface := range node.Interfaces {
+		ifaces = append(ifaces, iface.Name)
+	}
+	require.Contains(t, ifaces, "com.ubuntu.authd.Broker", "Service should export the broker interface")
+}
+
+func TestHealthCheck(t *testing.T) {
+	cleanup, err := testutils.StartSystemBusMock()
+	require.NoError(t, err, "Setup: Failed to start the private bus")
+	t.Cleanup(cleanup)
+
+	providerURL, stopServer := testutils.StartMockProviderServer("", nil)
+	t.Cleanup(stopServer)
+
+	cfgPath := filepath.Join(t.TempDir(), "broker.conf")
+	err = os.WriteFile(cfgPath, []byte("[oidc]\nissuer = "+providerURL+"\nclient_id = client_id\ncapability_probe = warn\n"), 0600)
+	require.NoError(t, err, "Setup: Failed to write broker config file")
+	b, err := broker.New(broker.Config{ConfigFile: cfgPath, DataDir: t.TempDir()})
+	require.NoError(t, err, "Setup: Failed to create broker")
+
+	s, err := dbusservice.New(context.Background(), b)
+	require.NoError(t, err, "Setup: Failed to create the service")
+	t.Cleanup(func() { _ = s.Stop() })
+
+	conn, err := testutils.GetSystemBusConnection(t)
+	require.NoError(t, err, "Setup: Failed to connect to the private bus")
+	t.Cleanup(func() { _ = conn.Close() })
+	obj := conn.Object(consts.DbusName, dbus.ObjectPath(consts.DbusObject))
+
+	healthCheck := func() map[string]any {
+		t.Helper()
+
+		var status string
+		err := obj.Call("com.ubuntu.authd.Broker.HealthCheck", 0).Store(&status)
+		require.NoError(t, err, "HealthCheck should not return an error")
+		var got map[string]any
+		require.NoError(t, json.Unmarshal([]byte(status), &got), "HealthCheck should return a JSON object")
+		return got
+	}
+
+	got := healthCheck()
+	require.Equal(t, true, got["exported"], "Service should be reported as exported")
+	require.Equal(t, false, got["discovery_ok"], "Discovery should not be reported as successful before any session")
+	require.NotContains(t, got, "last_discovery", "No discovery should be reported before any session")
+	require.Equal(t, float64(-1), got["discovery_cache_age_seconds"], "No discovery document should be reported as cached")
+	require.Len(t, got["capabilities"], 1, "The capabilities of the provider should be reported")
+	capabilities, ok := got["capabilities"].([]any)[0].(map[string]any)
+	require.True(t, ok, "The capabilities of the provider should be a JSON object")
+	require.Equal(t, providerURL, capabilities["issuer"], "The capabilities should be the ones of the provider")
+	require.NotContains(t, capabilities, "error", "No error should be reported when checking the capabilities")
+	require.NotContains(t, capabilities, "missing", "No feature should be reported as missing")
+
+	var sessionID, encryptionKey string
+	err = obj.Call("com.ubuntu.authd.Broker.NewSession", 0, "user@example.com", "lang", "auth").Store(&sessionID, &encryptionKey)
+	require.NoError(t, err, "Setup: NewSession should not return an error")
+
+	got = healthCheck()
+	require.Equal(t, true, got["discovery_ok"], "Discovery should be reported as successful")
+	require.Contains(t, got, "last_discovery", "Last discovery should be reported")
+	require.NotContains(t, got, "last_discovery_error", "No discovery error should be reported")
+	require.GreaterOrEqual(t, got["discovery_cache_age_seconds"], float64(0), "Discovery document should be reported as cached")
+}
+
+func TestListSessions(t *testing.T) {
+	cleanup, err := testutils.StartSystemBusMock()
+	require.NoError(t, err, "Setup: Failed to start the private bus")
+	t.Cleanup(cleanup)
+
+	providerURL, stopServer := testutils.StartMockProviderServer("", nil)
+	t.Cleanup(stopServer)
+
+	cfgPath := filepath.Join(t.TempDir(), "broker.conf")
+	err = os.WriteFile(cfgPath, []byte("[oidc]\nissuer = "+providerURL+"\nclient_id = client_id\n"), 0600)
+	require.NoError(t, err, "Setup: Failed to write broker config file")
+	b, err := broker.New(broker.Config{ConfigFile: cfgPath, DataDir: t.TempDir()})
+	require.NoError(t, err, "Setup: Failed to create broker")
+
+	s, err := dbusservice.New(context.Background(), b)
+	require.NoError(t, err, "Setup: Failed to create the service")
+	t.Cleanup(func() { _ = s.Stop() })
+
+	conn, err := testutils.GetSystemBusConnection(t)
+	require.NoError(t, err, "Setup: Failed to connect to the private bus")
+	t.Cleanup(func() { _ = conn.Close() })
+	obj := conn.Object(consts.DbusName, dbus.ObjectPath(consts.DbusObject))
+
+	listSessions := func() []map[string]any {
+		t.Helper()
+
+		var sessions string
+		err := obj.Call("com.ubuntu.authd.Broker.ListSessions", 0).Store(&sessions)
+		require.NoError(t, err, "ListSessions should not return an error")
+		var got []map[string]any
+		require.NoError(t, json.Unmarshal([]byte(sessions), &got), "ListSessions should return a JSON array")
+		return got
+	}
+
+	require.Empty(t, listSessions(), "No session should be listed before any is created")
+
+	var sessionID, encryptionKey string
+	err = obj.Call("com.ubuntu.authd.Broker.NewSession", 0, "user@example.com", "lang", "auth").Store(&sessionID, &encryptionKey)
+	require.NoError(t, err, "Setup: NewSession should not return an error")
+
+	got := listSessions()
+	require.Len(t, got, 1, "The session should be listed")
+	require.Equal(t, sessionID, got[0]["id"], "The session should be listed with its ID")
+	require.Equal(t, "user@example.com", got[0]["username"], "The session should be listed with its user")
+	require.Equal(t, providerURL, got[0]["issuer"], "The session should be listed with the issuer of the user")
+	require.Equal(t, float64(0), got[0]["auth_step"], "The session should be at the first step")
+
+	// The IDs of the sessions give access to them, so they must not be listed to the other users.
+	s.SetCallerUID(12345)
+	err = obj.Call("com.ubuntu.authd.Broker.ListSessions", 0).Store(new(string))
+	require.Error(t, err, "ListSessions should return an error to an unprivileged caller")
+}
+
+func TestWhoAmI(t *testing.T) {
+	cleanup, err := testutils.StartSystemBusMock()
+	require.NoError(t, err, "Setup: Failed to start the private bus")
+	t.Cleanup(cleanup)
+
+	providerURL, stopServer := testutils.StartMockProviderServer("", nil)
+	t.Cleanup(stopServer)
+
+	// The password is disabled, so that the user is granted access once authenticated with the device code.
+	cfgPath := filepath.Join(t.TempDir(), "broker.conf")
+	cfg := "[oidc]\nissuer = " + providerURL + "\nclient_id = test-client-id\ndisable_password = true\n" +
+		"always_groups = local-group\n"
+	err = os.WriteFile(cfgPath, []byte(cfg), 0600)
+	require.NoError(t, err, "Setup: Failed to write broker config file")
+	// The first user to log in becomes the owner, which is registered in the drop-in directory.
+	err = os.Mkdir(cfgPath+".d", 0700)
+	require.NoError(t, err, "Setup: Failed to create the drop-in directory of the config")
+	b, err := broker.New(broker.Config{ConfigFile: cfgPath, DataDir: t.TempDir()})
+	require.NoError(t, err, "Setup: Failed to create broker")
+
+	s, err := dbusservice.New(context.Background(), b)
+	require.NoError(t, err, "Setup: Failed to create the service")
+	t.Cleanup(func() { _ = s.Stop() })
+
+	conn, err := testutils.GetSystemBusConnection(t)
+	require.NoError(t, err, "Setup: Failed to connect to the private bus")
+	t.Cleanup(func() { _ = conn.Close() })
+	obj := conn.Object(consts.DbusName, dbus.ObjectPath(consts.DbusObject))
+
+	newSession := func(username string) string {
+		t.Helper()
+
+		var sessionID, encryptionKey string
+		err := obj.Call("com.ubuntu.authd.Broker.NewSession", 0, username, "lang", "auth").Store(&sessionID, &encryptionKey)
+		require.NoError(t, err, "Setup: NewSession should not return an error")
+		return sessionID
+	}
+	whoAmI := func(sessionID string) (map[string]any, error) {
+		t.Helper()
+
+		var identity string
+		if err := obj.Call("com.ubuntu.authd.Broker.WhoAmI", 0, sessionID).Store(&identity); err != nil {
+			return nil, err
+		}
+		var got map[string]any
+		require.NoError(t, json.Unmarshal([]byte(identity), &got), "WhoAmI should return a JSON object")
+		return got, nil
+	}
+
+	sessionID := newSession("test-user@email.com")
+	_, err = whoAmI(sessionID)
+	require.Error(t, err, "WhoAmI should return an error before the user is authenticated")
+
+	layouts := []map[string]string{
+		{"type": "form", "entry": "chars_password"},
+		{"type": "qrcode", "wait": "true"},
+		{"type": "newpassword", "entry": "chars_password"},
+	}
+	var modes []map[string]string
+	err = obj.Call("com.ubuntu.authd.Broker.GetAuthenticationModes", 0, sessionID, layouts).Store(&modes)
+	require.NoError(t, err, "Setup: GetAuthenticationModes should not return an error")
+	var layout map[string]string
+	err = obj.Call("com.ubuntu.authd.Broker.SelectAuthenticationMode", 0, sessionID, "device_auth_qr").Store(&layout)
+	require.NoError(t, err, "Setup: SelectAuthenticationMode should not return an error")
+	var access, data string
+	err = obj.Call("com.ubuntu.authd.Broker.IsAuthenticated", 0, sessionID, "{}").Store(&access, &data)
+	require.NoError(t, err, "Setup: IsAuthenticated should not return an error")
+	require.Equal(t, broker.AuthGranted, access, "Setup: The user should be granted access, got %s", data)
+
+	got, err := whoAmI(sessionID)
+	require.NoError(t, err, "WhoAmI should not return an error once the user is granted access")
+	require.Equal(t, "test-user@email.com", got["username"], "WhoAmI should return the name of the user")
+	require.Equal(t, "test-user-id", got["subject"], "WhoAmI should return the subject of the ID token")
+	require.Equal(t, providerURL, got["provider"], "WhoAmI should return the issuer of the user")
+	require.Contains(t, got["groups"], "local-group", "WhoAmI should return the groups of the user")
+
+	// Another user must not get the identity of the user of the session.
+	s.SetCallerUID(12345)
+	_, err = whoAmI(sessionID)
+	require.Error(t, err, "WhoAmI should return an error to a caller which is not the user of the session")
+	s.SetCallerUID(0)
+
+	_, err = whoAmI("unknown-session-id")
+	require.Error(t, err, "WhoAmI should return an error for an unknown session")
+
+	// A session of another user must not reveal the identity of the authenticated one.
+	_, err = whoAmI(newSession("other-user@email.com"))
+	require.Error(t, err, "WhoAmI should return an error for a session which did not grant access")
+}
+
+func TestReconnect(t *testing.T) {
+	cleanup, err := testutils.StartSystemBusMock()
+	require.NoError(t, err, "Setup: Failed to start the private bus")
+	t.Cleanup(cleanup)
+
+	cfgPath := filepath.Join(t.TempDir(), "broker.conf")
+	err = os.WriteFile(cfgPath, []byte("[oidc]\nissuer = https://issuer.url.com\nclient_id = client_id\n"), 0600)
+	require.NoError(t, err, "Setup: Failed to write broker config file")
+	b, err := broker.New(broker.Config{ConfigFile: cfgPath, DataDir: t.TempDir()})
+	require.NoError(t, err, "Setup: Failed to create broker")
+
+	s, err := dbusservice.New(context.Background(), b)
+	require.NoError(t, err, "Setup: Failed to create the service")
+	t.Cleanup(func() { _ = s.Stop() })
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+
+	conn, err := testutils.GetSystemBusConnection(t)
+	require.NoError(t, err, "Setup: Failed to connect to the private bus")
+	t.Cleanup(func() { _ = conn.Close() })
+
+	var uniqueName string
+	err = conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, consts.DbusName).Store(&uniqueName)
+	require.NoError(t, err, "Setup: GetNameOwner should not return an error")
+
+	s.CloseConnection()
+
+	require.Eventually(t, func() bool {
+		var owner string
+		err := conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, consts.DbusName).Store(&owner)
+		return err == nil && owner != uniqueName
+	}, 5*time.Second, 100*time.Millisecond, "Service should own its name again with a new connection")
+
+	var status string
+	err = conn.Object(consts.DbusName, dbus.ObjectPath(consts.DbusObject)).Call("com.ubuntu.authd.Broker.HealthCheck", 0).Store(&status)
+	require.NoError(t, err, "Service should serve the broker methods after reconnecting")
+
+	select {
+	case err := <-served:
+		require.Fail(t, "Serve should keep blocking across reconnects", "Serve returned: %v", err)
+	default:
+	}
+
+	require.NoError(t, s.Stop(), "Stop should not return an error")
+	require.NoError(t, <-served, "Serve should return once the service is stopped")
+}
+
+func TestStop(t *testing.T) {
+	tests := map[string]struct {
+		gracePeriod          time.Duration
+		finishAuthentication bool
+
+		wantCancelled bool
+	}{
+		"Stop_waits_for_the_running_authentication_to_finish":            {gracePeriod: time.Minute, finishAuthentication: true},
+		"Stop_cancels_the_running_authentication_after_the_grace_period": {gracePeriod: 500 * time.Millisecond, wantCancelled: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cleanup, err := testutils.StartSystemBusMock()
+			require.NoError(t, err, "Setup: Failed to start the private bus")
+			t.Cleanup(cleanup)
+
+			// The token endpoint holds the polls until the authentication is allowed to finish, or until it is cancelled.
+			polled := make(chan struct{})
+			var pollOnce, closeOnce sync.Once
+			finish := make(chan struct{})
+			providerURL, stopServer := testutils.StartMockProviderServer("", nil,
+				testutils.WithHandler("/device_auth", func(w http.ResponseWriter, _ *http.Request) {
+					w.Header().Add("Content-Type", "application/json")
+					_, _ = w.Write([]byte(`{"device_code": "device_code", "user_code": "user_code", "verification_uri": "https://verification_uri.com", "interval": 1}`))
+				}),
+				testutils.WithHandler("/token", func(w http.ResponseWriter, r *http.Request) {
+					// The server only notices that the client cancelled the request once the body is read.
+					_ = r.ParseForm()
+					pollOnce.Do(func() { close(polled) })
+					select {
+					case <-finish:
+					case <-r.Context().Done():
+						return
+					}
+					w.Header().Add("Content-Type", "application/json")
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte(`{"error": "expired_token"}`))
+				}),
+			)
+			t.Cleanup(stopServer)
+			// The held polls must return for the server to be stopped.
+			t.Cleanup(func() { closeOnce.Do(func() { close(finish) }) })
+
+			cfgPath := filepath.Join(t.TempDir(), "broker.conf")
+			cfg := "[oidc]\nissuer = " + providerURL + "\nclient_id = client_id\nstop_grace_period = " + tc.gracePeriod.String() + "\n"
+			err = os.WriteFile(cfgPath, []byte(cfg), 0600)
+			require.NoError(t, err, "Setup: Failed to write broker config file")
+			b, err := broker.New(broker.Config{ConfigFile: cfgPath, DataDir: t.TempDir()})
+			require.NoError(t, err, "Setup: Failed to create broker")
+
+			s, err := dbusservice.New(context.Background(), b)
+			require.NoError(t, err, "Setup: Failed to create the service")
+			t.Cleanup(func() { _ = s.Stop() })
+
+			conn, err := testutils.GetSystemBusConnection(t)
+			require.NoError(t, err, "Setup: Failed to connect to the private bus")
+			t.Cleanup(func() { _ = conn.Close() })
+			obj := conn.Object(consts.DbusName, dbus.ObjectPath(consts.DbusObject))
+
+			var sessionID, encryptionKey string
+			err = obj.Call("com.ubuntu.authd.Broker.NewSession", 0, "user@example.com", "lang", "auth").Store(&sessionID, &encryptionKey)
+			require.NoError(t, err, "Setup: NewSession should not return an error")
+			layouts := []map[string]string{{"type": "qrcode", "content": "required", "wait": "required:true,false", "renders_qrcode": "true"}}
+			var modes []map[string]string
+			err = obj.Call("com.ubuntu.authd.Broker.GetAuthenticationModes", 0, sessionID, layouts).Store(&modes)
+			require.NoError(t, err, "Setup: GetAuthenticationModes should not return an error")
+			var uiLayout map[string]string
+			err = obj.Call("com.ubuntu.authd.Broker.SelectAuthenticationMode", 0, sessionID, "device_auth_qr").Store(&uiLayout)
+			require.NoError(t, err, "Setup: SelectAuthenticationMode should not return an error")
+
+			authenticated := make(chan string, 1)
+			go func() {
+				var access, data string
+				_ = obj.Call("com.ubuntu.authd.Broker.IsAuthenticated", 0, sessionID, "{}").Store(&access, &data)
+				authenticated <- access
+			}()
+			select {
+			case <-polled:
+			case <-time.After(10 * time.Second):
+				require.Fail(t, "Setup: The token endpoint should have been polled")
+			}
+
+			start := time.Now()
+			stopped := make(chan struct{})
+			go func() {
+				_ = s.Stop()
+				close(stopped)
+			}()
+
+			require.Eventually(t, func() bool {
+				err := obj.Call("com.ubuntu.authd.Broker.NewSession", 0, "other-user@example.com", "lang", "auth").Store(&sessionID, &encryptionKey)
+				return err != nil
+			}, 5*time.Second, 50*time.Millisecond, "NewSession should fail once the service is stopping")
+
+			select {
+			case <-stopped:
+				require.Fail(t, "Stop should wait for the running authentication")
+			case <-authenticated:
+				require.Fail(t, "The authentication should still be running")
+			default:
+			}
+
+			if tc.finishAuthentication {
+				closeOnce.Do(func() { close(finish) })
+				require.Equal(t, "retry", <-authenticated, "The authentication should finish while the service is stopping")
+			}
+			select {
+			case <-stopped:
+			case <-time.After(tc.gracePeriod + 5*time.Second):
+				require.Fail(t, "Stop should return once the grace period is over")
+			}
+			if tc.wantCancelled {
+				require.GreaterOrEqual(t, time.Since(start), tc.gracePeriod, "Stop should wait for the grace period")
+				select {
+				case <-authenticated:
+				case <-time.After(5 * time.Second):
+					require.Fail(t, "The authentication should be cancelled after the grace period")
+				}
+			}
+		})
+	}
+}
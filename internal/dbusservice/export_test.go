@@ -0,0 +1,15 @@
+package dbusservice
+
+import "github.com/godbus/dbus/v5"
+
+// CloseConnection closes the current connection to the bus, as if the bus had been restarted.
+func (s *Service) CloseConnection() {
+	s.closeConn()
+}
+
+// SetCallerUID makes the service handle the method calls as if they were sent by a process of the UID.
+func (s *Service) SetCallerUID(uid uint32) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	s.callerUID = func(dbus.Sender) (uint32, error) { return uid, nil }
+}
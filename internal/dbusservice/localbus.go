@@ -4,7 +4,6 @@ package dbusservice
 
 import (
 	"fmt"
-	"log/slog"
 	"os"
 
 	"github.com/godbus/dbus/v5"
@@ -18,15 +17,21 @@ func (s *Service) getBus() (*dbus.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	slog.Info(fmt.Sprintf("Using local bus address: %s", os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")))
-	conn, err := dbus.ConnectSystemBus()
+	s.logger.Info(fmt.Sprintf("Using local bus address: %s", os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")))
+	conn, err := s.dial()
 	if err != nil {
 		return nil, err
 	}
+	s.conn = conn
 
 	s.disconnect = func() {
-		conn.Close()
+		s.closeConn()
 		cleanup()
 	}
 	return conn, err
 }
+
+// dial returns a new connection to the local bus.
+func (s *Service) dial() (*dbus.Conn, error) {
+	return dbus.ConnectSystemBus()
+}
@@ -1,6 +1,9 @@
 package dbusservice
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/godbus/dbus/v5"
 )
 
@@ -63,3 +66,135 @@ func (s *Service) UserPreCheck(username string) (userinfo string, dbusErr *dbus.
 	}
 	return userinfo, nil
 }
+
+// healthStatus is the status returned by HealthCheck, serialized as JSON.
+type healthStatus struct {
+	Exported           bool   `json:"exported"`
+	DiscoveryOK        bool   `json:"discovery_ok"`
+	LastDiscovery      string `json:"last_discovery,omitempty"`
+	LastDiscoveryError string `json:"last_discovery_error,omitempty"`
+	// DiscoveryCacheAge is the age in seconds of the cached discovery document, or -1 if none is cached.
+	DiscoveryCacheAge int64 `json:"discovery_cache_age_seconds"`
+	// Capabilities are the results of the check of the capabilities of the providers when the broker started.
+	Capabilities []capabilitiesStatus `json:"capabilities,omitempty"`
+}
+
+// capabilitiesStatus is the result of the check of the capabilities of a provider, serialized as JSON.
+type capabilitiesStatus struct {
+	Issuer  string   `json:"issuer"`
+	Probed  string   `json:"probed"`
+	Error   string   `json:"error,omitempty"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+// HealthCheck is the method through which monitoring tools get whether the service is exported on the bus and whether
+// the broker could reach the identity provider the last time it tried.
+func (s *Service) HealthCheck() (status string, dbusErr *dbus.Error) {
+	h := s.broker.Health()
+
+	hs := healthStatus{
+		Exported:          s.exported.Load(),
+		DiscoveryOK:       !h.LastDiscovery.IsZero() && h.LastDiscoveryErr == nil,
+		DiscoveryCacheAge: -1,
+	}
+	if !h.LastDiscovery.IsZero() {
+		hs.LastDiscovery = h.LastDiscovery.Format(time.RFC3339)
+	}
+	if h.LastDiscoveryErr != nil {
+		hs.LastDiscoveryError = h.LastDiscoveryErr.Error()
+	}
+	if h.DiscoveryCacheAge >= 0 {
+		hs.DiscoveryCacheAge = int64(h.DiscoveryCacheAge / time.Second)
+	}
+	for _, c := range h.Capabilities {
+		cs := capabilitiesStatus{Issuer: c.IssuerURL, Probed: c.Probed.Format(time.RFC3339), Missing: c.Missing}
+		if c.Err != nil {
+			cs.Error = c.Err.Error()
+		}
+		hs.Capabilities = append(hs.Capabilities, cs)
+	}
+
+	data, err := json.Marshal(hs)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return string(data), nil
+}
+
+// sessionStatus is the state of a session returned by ListSessions, serialized as JSON.
+type sessionStatus struct {
+	ID               string `json:"id"`
+	Username         string `json:"username"`
+	Mode             string `json:"mode"`
+	Issuer           string `json:"issuer"`
+	SelectedAuthMode string `json:"selected_auth_mode,omitempty"`
+	AuthStep         int    `json:"auth_step"`
+	Authenticating   bool   `json:"authenticating"`
+	Offline          bool   `json:"offline"`
+	// AgeSeconds is how long ago the session was created, in seconds.
+	AgeSeconds int64 `json:"age_seconds"`
+	// IdleSeconds is how long ago the session was last updated by a request of authd, in seconds.
+	IdleSeconds int64 `json:"idle_seconds"`
+}
+
+// ListSessions is the method through which debugging tools get the state of the current sessions, as a JSON array.
+// The IDs of the sessions give access to them, so only root and the user the broker runs as can list them.
+func (s *Service) ListSessions(sender dbus.Sender) (sessions string, dbusErr *dbus.Error) {
+	if err := s.checkPrivilegedCaller(sender); err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+
+	ss := []sessionStatus{}
+	for _, i := range s.broker.Sessions() {
+		ss = append(ss, sessionStatus{
+			ID:               i.ID,
+			Username:         i.Username,
+			Mode:             i.Mode,
+			Issuer:           i.IssuerURL,
+			SelectedAuthMode: i.SelectedAuthMode,
+			AuthStep:         i.AuthStep,
+			Authenticating:   i.Authenticating,
+			Offline:          i.Offline,
+			AgeSeconds:       int64(time.Since(i.Created) / time.Second),
+			IdleSeconds:      int64(time.Since(i.LastActivity) / time.Second),
+		})
+	}
+
+	data, err := json.Marshal(ss)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return string(data), nil
+}
+
+// identityStatus is the identity of the user of a session returned by WhoAmI, serialized as JSON.
+type identityStatus struct {
+	Username string   `json:"username"`
+	Subject  string   `json:"subject"`
+	Provider string   `json:"provider"`
+	Groups   []string `json:"groups"`
+}
+
+// WhoAmI is the method through which the tools of the machine get the identity of the user granted access by the
+// session, as a JSON object, without authenticating them again. Only root, the user the broker runs as and the user of
+// the session can get it.
+func (s *Service) WhoAmI(sender dbus.Sender, sessionID string) (identity string, dbusErr *dbus.Error) {
+	id, err := s.broker.WhoAmI(sessionID)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	if err := s.checkSessionCaller(sender, id.Username); err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+
+	data, err := json.Marshal(identityStatus{
+		Username: id.Username,
+		Subject:  id.Subject,
+		Provider: id.IssuerURL,
+		Groups:   id.Groups,
+	})
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,80 @@
+package dbusservice
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	// minReconnectDelay is the delay before the first attempt to reconnect to the bus.
+	minReconnectDelay = 500 * time.Millisecond
+	// maxReconnectDelay is the maximum delay between two attempts to reconnect to the bus.
+	maxReconnectDelay = 30 * time.Second
+)
+
+// watchConnection reconnects to the bus each time the connection is closed, e.g. because the bus restarted, until the
+// service is stopped.
+func (s *Service) watchConnection(conn *dbus.Conn) {
+	for {
+		select {
+		case <-s.serve:
+			return
+		case <-conn.Context().Done():
+		}
+
+		s.exported.Store(false)
+		s.logger.Warn("Lost the connection to the bus, reconnecting")
+		if conn = s.reconnect(); conn == nil {
+			return
+		}
+		s.exported.Store(true)
+		s.logger.Info("Reconnected to the bus")
+	}
+}
+
+// reconnect connects to the bus again and exports the service, retrying with an exponential backoff. It returns nil if
+// the service was stopped in the meantime.
+func (s *Service) reconnect() *dbus.Conn {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-s.serve:
+			return nil
+		case <-time.After(delay):
+		}
+
+		conn, err := s.dial()
+		if err == nil {
+			if err = s.export(conn); err != nil {
+				_ = conn.Close()
+			}
+		}
+		if err != nil {
+			s.logger.Warn(fmt.Sprintf("Could not reconnect to the bus, retrying in %s: %v", delay, err))
+			delay = min(2*delay, maxReconnectDelay)
+			continue
+		}
+
+		s.connMu.Lock()
+		defer s.connMu.Unlock()
+		select {
+		case <-s.serve:
+			// Stop already closed the previous connection, so it would not close this one.
+			_ = conn.Close()
+			return nil
+		default:
+		}
+		s.conn = conn
+		return conn
+	}
+}
+
+// closeConn closes the current connection to the bus.
+func (s *Service) closeConn() {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	_ = s.conn.Close()
+}
@@ -6,13 +6,22 @@ import (
 	"github.com/godbus/dbus/v5"
 )
 
-// getBus returns the system bus and attach a disconnect handler.
+// getBus returns the system bus, or the session bus if requested, and attach a disconnect handler.
 func (s *Service) getBus() (*dbus.Conn, error) {
-	conn, err := dbus.ConnectSystemBus()
+	conn, err := s.dial()
 	if err != nil {
 		return nil, err
 	}
-	s.disconnect = func() { _ = conn.Close() }
+	s.conn = conn
+	s.disconnect = s.closeConn
 
 	return conn, nil
 }
+
+// dial returns a new connection to the system bus, or the session bus if requested.
+func (s *Service) dial() (*dbus.Conn, error) {
+	if s.useSessionBus {
+		return dbus.ConnectSessionBus()
+	}
+	return dbus.ConnectSystemBus()
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"os"
+	"path/filepath"
 )
 
 // FileExists checks if a file exists at the given path.
@@ -43,3 +44,31 @@ func Touch(path string) error {
 	}
 	return nil
 }
+
+// WriteFileAtomically writes the data to a temporary file in the same directory, which is then renamed to path, so that
+// readers never see a partially written file.
+func WriteFileAtomically(path string, data []byte) (err error) {
+	// The temporary file is created with 0600 permissions.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -154,3 +154,53 @@ func TestTouch(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteFileAtomically(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		fileExists         bool
+		parentDoesNotExist bool
+
+		wantError bool
+	}{
+		"Creates_file_when_it_does_not_exist": {},
+		"Replaces_file_when_it_exists":        {fileExists: true},
+
+		"Returns_error_when_parent_directory_does_not_exist": {parentDoesNotExist: true, wantError: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tempDir := t.TempDir()
+			path := filepath.Join(tempDir, "file")
+			if tc.fileExists {
+				err := os.WriteFile(path, []byte("old content which is longer"), 0o600)
+				require.NoError(t, err, "Setup: WriteFile should not return an error")
+			}
+			if tc.parentDoesNotExist {
+				path = filepath.Join(tempDir, "does-not-exist", "file")
+			}
+
+			err := fileutils.WriteFileAtomically(path, []byte("content"))
+			if tc.wantError {
+				require.Error(t, err, "WriteFileAtomically should return an error")
+				return
+			}
+			require.NoError(t, err, "WriteFileAtomically should not return an error")
+
+			got, err := os.ReadFile(path)
+			require.NoError(t, err, "ReadFile should not return an error")
+			require.Equal(t, "content", string(got), "WriteFileAtomically should write the data")
+			fi, err := os.Stat(path)
+			require.NoError(t, err, "Stat should not return an error")
+			require.Equal(t, os.FileMode(0o600), fi.Mode().Perm(), "WriteFileAtomically should create the file with 0600 permissions")
+
+			entries, err := os.ReadDir(tempDir)
+			require.NoError(t, err, "ReadDir should not return an error")
+			require.Len(t, entries, 1, "WriteFileAtomically should not leave temporary files")
+		})
+	}
+}
@@ -2,19 +2,64 @@
 package log
 
 import (
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 )
 
 var globalLevel = &slog.LevelVar{}
 
+// Format is the output format of the logs.
+type Format string
+
+const (
+	// FormatText writes the logs as key=value pairs.
+	FormatText Format = "text"
+	// FormatJSON writes the logs as one JSON object per line.
+	FormatJSON Format = "json"
+)
+
 func init() {
-	h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: globalLevel})
-	slog.SetDefault(slog.New(h))
+	slog.SetDefault(New(os.Stderr, FormatText))
 	globalLevel.Set(slog.LevelWarn)
 }
 
+// New returns a logger writing to w in the given format. Its level is the global one and the secret material is
+// redacted from the records.
+func New(w io.Writer, format Format) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: globalLevel, ReplaceAttr: redact}
+	if format == FormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
 // SetLevel change global handler log level.
 func SetLevel(l slog.Level) {
 	globalLevel.Set(l)
 }
+
+// ParseLevel returns the level named by s, which is one of error, warn, info or debug.
+func ParseLevel(s string) (slog.Level, error) {
+	switch s {
+	case "error":
+		return slog.LevelError, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	}
+	return 0, fmt.Errorf("%q is not one of %q, %q, %q or %q", s, "error", "warn", "info", "debug")
+}
+
+// ParseFormat returns the format named by s, which is one of text or json.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatText, FormatJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("%q is not one of %q or %q", s, FormatText, FormatJSON)
+}
@@ -0,0 +1,65 @@
+package log
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces the secret material in the logs.
+const redacted = "[REDACTED]"
+
+// secretKeys are the attribute keys whose values are never logged.
+var secretKeys = map[string]struct{}{
+	"access_token":  {},
+	"authorization": {},
+	"challenge":     {},
+	"client_secret": {},
+	"code":          {},
+	"device_code":   {},
+	"id_token":      {},
+	"password":      {},
+	"refresh_token": {},
+	"secret":        {},
+	"token":         {},
+}
+
+// secretParams are the OAuth 2.0 parameters and fields holding secrets.
+const secretParams = "access_token|refresh_token|id_token|device_code|code|client_secret|password"
+
+var (
+	// jwtRegexp matches the JSON Web Tokens, like the ID tokens and most access tokens.
+	jwtRegexp = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	// formValueRegexp matches the secret parameters of the url encoded OAuth 2.0 requests.
+	formValueRegexp = regexp.MustCompile(`(?i)\b(` + secretParams + `)=[^\s&"]+`)
+	// jsonValueRegexp matches the secret fields of the JSON encoded OAuth 2.0 responses.
+	jsonValueRegexp = regexp.MustCompile(`(?i)("(?:` + secretParams + `)"\s*:\s*)"[^"]*"`)
+	// bearerRegexp matches the tokens of the authorization headers.
+	bearerRegexp = regexp.MustCompile(`(?i)\b(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+)
+
+// redact is the slog.HandlerOptions.ReplaceAttr function removing the secret material from the log records, including
+// the one formatted in the messages.
+func redact(_ []string, a slog.Attr) slog.Attr {
+	if _, ok := secretKeys[strings.ToLower(a.Key)]; ok {
+		return slog.String(a.Key, redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(redactString(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(redactString(err.Error()))
+		}
+	}
+	return a
+}
+
+// redactString replaces the secrets found in s.
+func redactString(s string) string {
+	s = jwtRegexp.ReplaceAllString(s, redacted)
+	s = formValueRegexp.ReplaceAllString(s, "${1}="+redacted)
+	s = jsonValueRegexp.ReplaceAllString(s, `${1}"`+redacted+`"`)
+	return bearerRegexp.ReplaceAllString(s, "${1}"+redacted)
+}
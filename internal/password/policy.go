@@ -0,0 +1,97 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Character classes which a policy can require the passwords to contain.
+const (
+	// ClassLowercase is the class of the lowercase letters.
+	ClassLowercase = "lowercase"
+	// ClassUppercase is the class of the uppercase letters.
+	ClassUppercase = "uppercase"
+	// ClassDigit is the class of the digits.
+	ClassDigit = "digit"
+	// ClassSymbol is the class of the characters which are neither letters nor digits.
+	ClassSymbol = "symbol"
+)
+
+// characterClasses are the character classes with the function matching their characters and their description in the
+// policy errors.
+var characterClasses = []struct {
+	name        string
+	matches     func(rune) bool
+	description string
+}{
+	{ClassLowercase, unicode.IsLower, "a lowercase letter"},
+	{ClassUppercase, unicode.IsUpper, "an uppercase letter"},
+	{ClassDigit, unicode.IsDigit, "a digit"},
+	{ClassSymbol, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }, "a symbol"},
+}
+
+// CharacterClasses returns the names of the character classes which a policy can require.
+func CharacterClasses() []string {
+	names := make([]string, 0, len(characterClasses))
+	for _, class := range characterClasses {
+		names = append(names, class.name)
+	}
+	return names
+}
+
+// Policy is the set of rules which the local passwords must follow. The zero value accepts any password.
+type Policy struct {
+	// MinLength is the minimum number of characters of the passwords.
+	MinLength int
+	// RequiredClasses are the character classes which the passwords must contain at least one character of.
+	RequiredClasses []string
+	// DisallowReuse rejects the password which is already stored in the password file.
+	DisallowReuse bool
+}
+
+// PolicyError is returned when a password does not follow a rule of the policy. Its message describes the rule, so
+// that it can be shown to the user.
+type PolicyError struct {
+	msg string
+}
+
+func (e *PolicyError) Error() string {
+	return e.msg
+}
+
+// Check returns a *PolicyError describing the first rule of the policy which the password does not follow. The
+// previous password, which must not be reused if DisallowReuse is set, is the one stored in the file at path, if any.
+func (p Policy) Check(password, path string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return &PolicyError{fmt.Sprintf("the password must be at least %d characters long", p.MinLength)}
+	}
+
+	for _, class := range characterClasses {
+		if !slices.Contains(p.RequiredClasses, class.name) {
+			continue
+		}
+		if !strings.ContainsFunc(password, class.matches) {
+			return &PolicyError{fmt.Sprintf("the password must contain at least %s", class.description)}
+		}
+	}
+
+	if p.DisallowReuse {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		reused, err := CheckPassword(password, path)
+		if err != nil {
+			return fmt.Errorf("could not compare with the previous password: %w", err)
+		}
+		if reused {
+			return &PolicyError{"the password must be different from the previous one"}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package password_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/password"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	t.Parallel()
+
+	const previousPassword = "previous"
+
+	tests := map[string]struct {
+		policy     password.Policy
+		password   string
+		noPrevious bool
+
+		wantErr string
+	}{
+		"Success_when_password_follows_all_the_rules": {policy: password.Policy{MinLength: 8, RequiredClasses: password.CharacterClasses(), DisallowReuse: true}, password: "Pa55word!"},
+
+		// Minimum length
+		"Success_when_password_has_minimum_length":        {policy: password.Policy{MinLength: 4}, password: "abcd"},
+		"Success_when_length_counts_characters_not_bytes": {policy: password.Policy{MinLength: 4}, password: "éééé"},
+		"Error_when_password_is_too_short":                {policy: password.Policy{MinLength: 5}, password: "abcd", wantErr: "the password must be at least 5 characters long"},
+
+		// Character classes
+		"Error_when_lowercase_letter_is_missing": {policy: password.Policy{RequiredClasses: []string{password.ClassLowercase}}, password: "ABC123", wantErr: "the password must contain at least a lowercase letter"},
+		"Error_when_uppercase_letter_is_missing": {policy: password.Policy{RequiredClasses: []string{password.ClassUppercase}}, password: "abc123", wantErr: "the password must contain at least an uppercase letter"},
+		"Error_when_digit_is_missing":            {policy: password.Policy{RequiredClasses: []string{password.ClassDigit}}, password: "abcABC", wantErr: "the password must contain at least a digit"},
+		"Error_when_symbol_is_missing":           {policy: password.Policy{RequiredClasses: []string{password.ClassSymbol}}, password: "abc123", wantErr: "the password must contain at least a symbol"},
+		"Success_when_space_is_a_symbol":         {policy: password.Policy{RequiredClasses: []string{password.ClassSymbol}}, password: "abc 123"},
+
+		// Reuse
+		"Success_when_reuse_is_allowed":               {password: previousPassword},
+		"Success_when_password_differs_from_previous": {policy: password.Policy{DisallowReuse: true}, password: "other"},
+		"Success_when_there_is_no_previous_password":  {policy: password.Policy{DisallowReuse: true}, password: previousPassword, noPrevious: true},
+		"Error_when_password_is_the_previous_one":     {policy: password.Policy{DisallowReuse: true}, password: previousPassword, wantErr: "the password must be different from the previous one"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "password")
+			if !tc.noPrevious {
+				err := password.HashAndStorePassword(previousPassword, path)
+				require.NoError(t, err, "Setup: HashAndStorePassword should not have returned an error")
+			}
+
+			err := tc.policy.Check(tc.password, path)
+			if tc.wantErr == "" {
+				require.NoError(t, err, "Check should not have returned an error")
+				return
+			}
+			var policyErr *password.PolicyError
+			require.ErrorAs(t, err, &policyErr, "Check should have returned a policy error")
+			require.Equal(t, tc.wantErr, policyErr.Error(), "Check should describe the rule which is not followed")
+		})
+	}
+}
+
+func TestPolicyCheckFailsIfPreviousPasswordIsInvalid(t *testing.T) {
+	t.Parallel()
+
+	// A directory can not be read as a password file.
+	path := t.TempDir()
+
+	err := password.Policy{DisallowReuse: true}.Check("password", path)
+	require.Error(t, err, "Check should have returned an error")
+	var policyErr *password.PolicyError
+	require.NotErrorAs(t, err, &policyErr, "Check should not have returned a policy error")
+}
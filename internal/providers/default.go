@@ -3,10 +3,40 @@
 package providers
 
 import (
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/gitlab"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/google"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/noprovider"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/okta"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/ping"
 )
 
 // CurrentProvider returns a generic oidc provider implementation.
 func CurrentProvider() Provider {
 	return noprovider.New()
 }
+
+// BuildTag returns the build tag the broker must be built with to use the provider type, and true if the provider is not
+// built in this broker.
+func BuildTag(providerType string) (string, bool) {
+	if providerType == TypeMsEntraID {
+		return "withmsentraid", true
+	}
+	return "", false
+}
+
+// ForIssuer returns the provider implementation of the configured type, or if none is configured, the Okta one if the
+// issuer is an Okta org, the GitLab one if the issuer is GitLab SaaS, the Google one if the issuer is Google, or else the
+// generic one. The Ping Identity issuers have no common host, so the Ping one is only returned if it is configured.
+func ForIssuer(issuerURL string, s Settings) Provider {
+	switch {
+	case s.Type == TypeOkta, s.Type == "" && okta.IsOktaIssuer(issuerURL):
+		return okta.New(s.GroupsClaim)
+	case s.Type == TypeGitLab, s.Type == "" && gitlab.IsGitLabIssuer(issuerURL):
+		return gitlab.New(s.GitLabFullGroupPaths)
+	case s.Type == TypePing:
+		return ping.New(s.PingGroupsClaim)
+	case s.Type == TypeGoogle, s.Type == "" && google.IsGoogleIssuer(issuerURL):
+		return google.New().WithDirectoryGroups(s.GoogleDirectoryGroups).WithNestedGroups(s.NestedGroupsMaxDepth)
+	}
+	return CurrentProvider()
+}
@@ -0,0 +1,93 @@
+//go:build !withgoogle && !withmsentraid
+
+package providers_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/gitlab"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/google"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/noprovider"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/okta"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/ping"
+)
+
+func TestForIssuer(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		issuerURL    string
+		providerType string
+
+		want providers.Provider
+	}{
+		"Select_Okta_from_issuer":                          {issuerURL: "https://example.okta.com", want: okta.New("")},
+		"Select_GitLab_from_issuer":                        {issuerURL: "https://gitlab.com", want: gitlab.New(false)},
+		"Select_Google_from_issuer":                        {issuerURL: "https://accounts.google.com", want: google.New()},
+		"Select_generic_provider_from_issuer":              {issuerURL: "https://login.example.com", want: noprovider.New()},
+		"Select_configured_GitLab_for_self_managed_issuer": {issuerURL: "https://gitlab.example.com", providerType: providers.TypeGitLab, want: gitlab.New(false)},
+		"Select_configured_Okta_for_custom_domain":         {issuerURL: "https://login.example.com", providerType: providers.TypeOkta, want: okta.New("")},
+		"Select_configured_Ping":                           {issuerURL: "https://sso.example.com", providerType: providers.TypePing, want: ping.New("")},
+		"Select_configured_Google":                         {issuerURL: "https://login.example.com", providerType: providers.TypeGoogle, want: google.New()},
+		"Select_configured_generic_provider_over_issuer":   {issuerURL: "https://gitlab.com", providerType: providers.TypeGeneric, want: noprovider.New()},
+		"Select_configured_generic_provider_over_Google":   {issuerURL: "https://accounts.google.com", providerType: providers.TypeGeneric, want: noprovider.New()},
+		"Select_Okta_from_issuer_with_port":                {issuerURL: "https://example.okta.com:8443/oauth2/default", want: okta.New("")},
+		"Select_GitLab_from_issuer_with_port":              {issuerURL: "https://gitlab.com:443", want: gitlab.New(false)},
+		"Select_generic_provider_from_issuer_with_port":    {issuerURL: "https://keycloak.internal:8443/realms/x", want: noprovider.New()},
+		"Select_generic_provider_from_IPv6_issuer":         {issuerURL: "https://[::1]:8443/realms/x", want: noprovider.New()},
+		"Select_configured_Okta_for_IPv6_issuer":           {issuerURL: "https://[::1]:8443/realms/x", providerType: providers.TypeOkta, want: okta.New("")},
+		"Select_configured_GitLab_for_issuer_with_port":    {issuerURL: "https://keycloak.internal:8443/realms/x", providerType: providers.TypeGitLab, want: gitlab.New(false)},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got := providers.ForIssuer(tc.issuerURL, providers.Settings{Type: tc.providerType})
+			require.Equal(t, tc.want, got, "ForIssuer should return the expected provider")
+		})
+	}
+}
+
+func TestForIssuerHandlesAllTypes(t *testing.T) {
+	t.Parallel()
+
+	for _, providerType := range providers.Types() {
+		got := providers.ForIssuer("https://login.example.com", providers.Settings{Type: providerType})
+		if tag, ok := providers.BuildTag(providerType); ok {
+			require.NotEmpty(t, tag, "BuildTag should name the build tag of type %q", providerType)
+			continue
+		}
+		if providerType == providers.TypeGeneric {
+			require.Equal(t, noprovider.New(), got, "ForIssuer should return the generic provider")
+			continue
+		}
+		require.NotEqual(t, noprovider.New(), got, "ForIssuer should return a specific provider for type %q", providerType)
+	}
+}
+
+func TestBuildTag(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		providerType string
+
+		wantTag     string
+		wantMissing bool
+	}{
+		"Microsoft_Entra_ID_is_not_built":   {providerType: providers.TypeMsEntraID, wantTag: "withmsentraid", wantMissing: true},
+		"Google_is_built":                   {providerType: providers.TypeGoogle},
+		"Generic_provider_is_built":         {providerType: providers.TypeGeneric},
+		"Provider_selected_from_the_issuer": {},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tag, missing := providers.BuildTag(tc.providerType)
+			require.Equal(t, tc.wantMissing, missing, "BuildTag should tell whether the provider is built")
+			require.Equal(t, tc.wantTag, tag, "BuildTag should return the expected build tag")
+		})
+	}
+}
@@ -3,6 +3,8 @@ package errors
 
 import (
 	"fmt"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
 )
 
 // ForDisplayError is an error type for errors that are meant to be displayed to the user.
@@ -18,3 +20,26 @@ func (e ForDisplayError) Error() string {
 func NewForDisplayError(format string, v ...interface{}) ForDisplayError {
 	return ForDisplayError{message: fmt.Sprintf(format, v...)}
 }
+
+// GroupsError is the error returned by the providers when the groups of the user could not be fetched. It holds the
+// rest of the user info, so that the broker can still let the user log in if it is configured to.
+type GroupsError struct {
+	// User is the user info, without the groups.
+	User info.User
+	err  error
+}
+
+// NewGroupsError creates a new GroupsError for the user info whose groups could not be fetched because of err.
+func NewGroupsError(user info.User, err error) *GroupsError {
+	user.Groups = nil
+	return &GroupsError{User: user, err: err}
+}
+
+func (e *GroupsError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error which prevented fetching the groups.
+func (e *GroupsError) Unwrap() error {
+	return e.err
+}
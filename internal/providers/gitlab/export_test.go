@@ -0,0 +1,14 @@
+package gitlab
+
+import (
+	"context"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"golang.org/x/oauth2"
+)
+
+// GetGroups exposes the provider's getGroups method for tests.
+func (p Provider) GetGroups(ctx context.Context, token *oauth2.Token, idToken *oidc.IDToken) ([]info.Group, error) {
+	return p.getGroups(ctx, token, idToken)
+}
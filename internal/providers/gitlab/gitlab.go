@@ -0,0 +1,182 @@
+// Package gitlab is the GitLab specific extension.
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	providerErrors "github.com/ubuntu/authd-oidc-brokers/internal/providers/errors"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/hosts"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/noprovider"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// groupsDirectClaim is the claim of the ID token listing the full paths of the groups the user is a direct member
+	// of.
+	groupsDirectClaim = "groups_direct"
+	// userInfoPath is the path of the userinfo endpoint of GitLab, relative to the issuer.
+	userInfoPath = "/oauth/userinfo"
+	// gitlabHost is the host of the GitLab SaaS instance.
+	gitlabHost = "gitlab.com"
+
+	localGroupPrefix = "linux-"
+)
+
+// Provider is the GitLab provider implementation.
+type Provider struct {
+	noprovider.NoProvider
+
+	fullGroupPaths bool
+}
+
+// New returns a new GitLab provider. The groups are named after their full path (e.g. parent/child) if fullGroupPaths
+// is true, or else after the last component of their path.
+func New(fullGroupPaths bool) Provider {
+	return Provider{
+		NoProvider:     noprovider.New(),
+		fullGroupPaths: fullGroupPaths,
+	}
+}
+
+// IsGitLabIssuer returns true if the issuer is the GitLab SaaS instance. The self-managed instances can not be detected,
+// so the provider must be selected explicitly for them.
+func IsGitLabIssuer(issuerURL string) bool {
+	return hosts.IssuerMatches(issuerURL, gitlabHost)
+}
+
+// AdditionalScopes returns the scopes required by the provider. GitLab rejects the unknown scopes, so unlike the
+// generic provider, it does not request offline_access: GitLab always returns a refresh token.
+func (p Provider) AdditionalScopes() []string {
+	return []string{oidc.ScopeOpenID, "profile", "email"}
+}
+
+// GetUserInfo returns the user info parsed from the ID token, with the groups of the groups_direct claim, or fetched
+// from the userinfo endpoint if the ID token has no such claim.
+func (p Provider) GetUserInfo(ctx context.Context, accessToken *oauth2.Token, idToken *oidc.IDToken) (info.User, error) {
+	userClaims, err := p.userClaims(idToken)
+	if err != nil {
+		return info.User{}, err
+	}
+
+	userGroups, err := p.getGroups(ctx, accessToken, idToken)
+	user := info.NewUser(
+		userClaims.Email,
+		userClaims.Home,
+		userClaims.Sub,
+		userClaims.Shell,
+		userClaims.Gecos,
+		userGroups,
+	)
+	if err != nil {
+		return info.User{}, providerErrors.NewGroupsError(user, err)
+	}
+	return user, nil
+}
+
+type claims struct {
+	Email string `json:"email"`
+	Sub   string `json:"sub"`
+	Home  string `json:"home"`
+	Shell string `json:"shell"`
+	Gecos string `json:"gecos"`
+}
+
+// userClaims returns the user claims parsed from the ID token.
+func (p Provider) userClaims(idToken *oidc.IDToken) (claims, error) {
+	var userClaims claims
+	if err := idToken.Claims(&userClaims); err != nil {
+		return claims{}, fmt.Errorf("failed to get ID token claims: %v", err)
+	}
+	return userClaims, nil
+}
+
+// getGroups returns the groups of the groups_direct claim of the ID token, or the ones returned by the userinfo
+// endpoint if the claim is absent.
+func (p Provider) getGroups(ctx context.Context, token *oauth2.Token, idToken *oidc.IDToken) ([]info.Group, error) {
+	var allClaims map[string]json.RawMessage
+	if err := idToken.Claims(&allClaims); err != nil {
+		return nil, fmt.Errorf("failed to get ID token claims: %v", err)
+	}
+
+	rawGroups, ok := allClaims[groupsDirectClaim]
+	if !ok {
+		return p.getGroupsFromUserInfo(ctx, token, idToken.Issuer)
+	}
+
+	var paths []string
+	if err := json.Unmarshal(rawGroups, &paths); err != nil {
+		return nil, fmt.Errorf("invalid %q claim: %v", groupsDirectClaim, err)
+	}
+	return p.groupsFromPaths(paths)
+}
+
+// getGroupsFromUserInfo fetches the groups of the user from the userinfo endpoint of the issuer. It lists them in its
+// groups claim, including the groups the user is a member of through a parent group.
+func (p Provider) getGroupsFromUserInfo(ctx context.Context, token *oauth2.Token, issuerURL string) ([]info.Group, error) {
+	slog.Debug("Getting user groups from the GitLab userinfo endpoint")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuerURL, "/")+userInfoPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user groups: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oauth2.NewClient(ctx, oauth2.StaticTokenSource(token)).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user groups: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user groups: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get user groups: unexpected status %q: %s", resp.Status, body)
+	}
+
+	var userInfo struct {
+		Groups []string `json:"groups"`
+	}
+	if err := json.Unmarshal(body, &userInfo); err != nil {
+		return nil, fmt.Errorf("failed to get user groups: could not parse response: %v", err)
+	}
+	return p.groupsFromPaths(userInfo.Groups)
+}
+
+// groupsFromPaths returns the groups with the given full paths. The full path is the UGID of the group, as the last
+// component of the path is only unique among the subgroups of the same parent.
+func (p Provider) groupsFromPaths(paths []string) ([]info.Group, error) {
+	var groups []info.Group
+	for _, path := range paths {
+		path = strings.Trim(path, "/")
+		if path == "" {
+			return nil, errors.New("group path is empty")
+		}
+		groupPath := strings.ToLower(path)
+		leaf := groupPath[strings.LastIndex(groupPath, "/")+1:]
+
+		// Check if the group is a local group, in which case we don't set the UGID (because that's how the user manager
+		// differentiates between local and remote groups).
+		if strings.HasPrefix(leaf, localGroupPrefix) {
+			groups = append(groups, info.Group{Name: strings.TrimPrefix(leaf, localGroupPrefix)})
+			continue
+		}
+
+		name := leaf
+		if p.fullGroupPaths {
+			name = groupPath
+		}
+		groups = append(groups, info.Group{Name: name, UGID: groupPath})
+	}
+	return groups, nil
+}
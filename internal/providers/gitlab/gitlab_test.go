@@ -0,0 +1,149 @@
+package gitlab_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/gitlab"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"golang.org/x/oauth2"
+)
+
+var signingKey = func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("could not generate signing key: %v", err))
+	}
+	return key
+}()
+
+func TestIsGitLabIssuer(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		issuerURL string
+
+		want bool
+	}{
+		"GitLab_SaaS":                       {issuerURL: "https://gitlab.com", want: true},
+		"GitLab_SaaS_with_uppercase_host":   {issuerURL: "https://GitLab.com", want: true},
+		"Self_managed_instance":             {issuerURL: "https://gitlab.example.com"},
+		"Issuer_with_GitLab_as_host_prefix": {issuerURL: "https://gitlab.com.example.com"},
+		"Issuer_with_GitLab_in_path":        {issuerURL: "https://login.example.com/gitlab.com"},
+		"Invalid_issuer_URL":                {issuerURL: "://gitlab.com"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.want, gitlab.IsGitLabIssuer(tc.issuerURL), "IsGitLabIssuer should only detect GitLab SaaS")
+		})
+	}
+}
+
+func TestAdditionalScopes(t *testing.T) {
+	t.Parallel()
+
+	p := gitlab.New(false)
+
+	require.Equal(t, []string{oidc.ScopeOpenID, "profile", "email"}, p.AdditionalScopes(),
+		"GitLab provider should require the OpenID, profile and email scopes")
+}
+
+func TestGetGroups(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		fullGroupPaths bool
+		claims         map[string]any
+		userInfo       string
+		statusCode     int
+
+		wantGroups []info.Group
+		wantErr    bool
+	}{
+		"Successfully_get_leaf_names_from_claim": {
+			claims:     map[string]any{"groups_direct": []string{"Parent/Child", "Other"}},
+			wantGroups: []info.Group{{Name: "child", UGID: "parent/child"}, {Name: "other", UGID: "other"}},
+		},
+		"Successfully_get_full_paths_from_claim": {
+			fullGroupPaths: true,
+			claims:         map[string]any{"groups_direct": []string{"Parent/Child", "Other"}},
+			wantGroups:     []info.Group{{Name: "parent/child", UGID: "parent/child"}, {Name: "other", UGID: "other"}},
+		},
+		"Successfully_get_local_groups_from_claim_without_UGID": {
+			claims:     map[string]any{"groups_direct": []string{"linux-sudo", "parent/linux-docker"}},
+			wantGroups: []info.Group{{Name: "sudo"}, {Name: "docker"}},
+		},
+		"Successfully_get_no_groups_from_empty_claim": {
+			claims: map[string]any{"groups_direct": []string{}},
+		},
+		"Successfully_get_groups_from_userinfo_when_claim_is_absent": {
+			userInfo:   `{"sub": "user-id", "groups": ["parent", "parent/child"]}`,
+			wantGroups: []info.Group{{Name: "parent", UGID: "parent"}, {Name: "child", UGID: "parent/child"}},
+		},
+		"Successfully_get_no_groups_from_userinfo": {
+			userInfo: `{"sub": "user-id"}`,
+		},
+
+		"Error_when_claim_is_not_a_list_of_strings":   {claims: map[string]any{"groups_direct": "parent"}, wantErr: true},
+		"Error_when_claim_has_an_empty_group_path":    {claims: map[string]any{"groups_direct": []string{"/"}}, wantErr: true},
+		"Error_when_userinfo_response_is_invalid":     {userInfo: `not json`, wantErr: true},
+		"Error_when_userinfo_returns_an_error_status": {userInfo: `{}`, statusCode: http.StatusUnauthorized, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "/oauth/userinfo", r.URL.Path, "Request should be for the userinfo endpoint")
+				require.Equal(t, "Bearer accesstoken", r.Header.Get("Authorization"), "Request should be authenticated")
+
+				if tc.statusCode != 0 {
+					w.WriteHeader(tc.statusCode)
+				}
+				_, err := w.Write([]byte(tc.userInfo))
+				require.NoError(t, err, "Writing the response should not fail")
+			}))
+			t.Cleanup(server.Close)
+
+			idToken := newIDToken(t, server.URL, tc.claims)
+
+			got, err := gitlab.New(tc.fullGroupPaths).GetGroups(context.Background(), &oauth2.Token{AccessToken: "accesstoken"}, idToken)
+			if tc.wantErr {
+				require.Error(t, err, "GetGroups should return an error")
+				return
+			}
+			require.NoError(t, err, "GetGroups should not return an error")
+			require.Equal(t, tc.wantGroups, got, "GetGroups should return the expected groups")
+		})
+	}
+}
+
+// newIDToken returns a verified ID token of the issuer with the given extra claims.
+func newIDToken(t *testing.T, issuer string, extraClaims map[string]any) *oidc.IDToken {
+	t.Helper()
+
+	claims := jwt.MapClaims{"iss": issuer, "sub": "user-id", "aud": "client-id", "email": "user@example.com"}
+	for k, v := range extraClaims {
+		claims[k] = v
+	}
+	rawIDToken, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(signingKey)
+	require.NoError(t, err, "Setup: Signing the ID token should not fail")
+
+	keySet := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&signingKey.PublicKey}}
+	verifier := oidc.NewVerifier(issuer, keySet, &oidc.Config{SkipClientIDCheck: true, SkipExpiryCheck: true})
+	idToken, err := verifier.Verify(context.Background(), rawIDToken)
+	require.NoError(t, err, "Setup: Verifying the ID token should not fail")
+
+	return idToken
+}
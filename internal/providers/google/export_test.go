@@ -0,0 +1,19 @@
+package google
+
+import (
+	"context"
+
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"golang.org/x/oauth2"
+)
+
+// WithDirectoryGroupsURL returns a copy of the provider using the given Directory API endpoint.
+func (p Provider) WithDirectoryGroupsURL(url string) Provider {
+	p.directoryGroupsURL = url
+	return p
+}
+
+// GetGroups exposes the provider's getGroups method for tests.
+func (p Provider) GetGroups(ctx context.Context, token *oauth2.Token, email string) ([]info.Group, error) {
+	return p.getGroups(ctx, token, email)
+}
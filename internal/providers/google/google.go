@@ -2,27 +2,267 @@
 package google
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	providerErrors "github.com/ubuntu/authd-oidc-brokers/internal/providers/errors"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/hosts"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/noprovider"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// issuerHost is the host of the Google issuer.
+	issuerHost = "accounts.google.com"
+	// directoryGroupsScope is the scope required to list the groups of a user with the Admin SDK Directory API. Google
+	// does not allow it for the "TVs and Limited Input devices" clients, which the device authentication uses.
+	directoryGroupsScope = "https://www.googleapis.com/auth/admin.directory.group.readonly"
+	// directoryGroupsURL is the Admin SDK Directory API endpoint used to list the groups of a user.
+	directoryGroupsURL = "https://admin.googleapis.com/admin/directory/v1/groups"
+
+	localGroupPrefix = "linux-"
 )
 
 // Provider is the google provider implementation.
 type Provider struct {
 	noprovider.NoProvider
+
+	// directoryGroups is true if the groups of the user are fetched from the Directory API.
+	directoryGroups    bool
+	directoryGroupsURL string
+	// nestedGroupsMaxDepth is how many levels of parent groups are followed to get the groups the user is a member of
+	// through another group, or 0 to only get the groups the user is a direct member of.
+	nestedGroupsMaxDepth int
 }
 
-// New returns a new GoogleProvider.
+// New returns a new GoogleProvider, which does not fetch the groups of the users.
 func New() Provider {
 	return Provider{
-		NoProvider: noprovider.New(),
+		NoProvider:         noprovider.New(),
+		directoryGroupsURL: directoryGroupsURL,
 	}
 }
 
-// AdditionalScopes returns the generic scopes required by the provider.
+// IsGoogleIssuer returns true if the issuer is Google.
+func IsGoogleIssuer(issuerURL string) bool {
+	return hosts.IssuerMatches(issuerURL, issuerHost)
+}
+
+// WithDirectoryGroups returns a copy of the provider which fetches the groups of the users from the Admin SDK Directory
+// API. It requests the admin.directory.group.readonly scope, which must be allowed for the OAuth client, and the users
+// need the admin privilege to read the groups of the Google Workspace: the others are denied the login as their groups
+// can not be fetched.
+func (p Provider) WithDirectoryGroups(enabled bool) Provider {
+	p.directoryGroups = enabled
+	return p
+}
+
+// WithNestedGroups returns a copy of the provider which also gets the groups the user is a member of through other
+// groups, following up to maxDepth levels of parent groups. Each level costs one more request per group.
+func (p Provider) WithNestedGroups(maxDepth int) Provider {
+	p.nestedGroupsMaxDepth = maxDepth
+	return p
+}
+
+// AdditionalScopes returns the scopes required by the provider, the one to list the groups of the user if they are
+// fetched from the Directory API.
 // Note that we do not return oidc.ScopeOfflineAccess, as for TV/limited input devices, the API call will fail as not
 // supported by this application type. However, the refresh token will be acquired and is functional to refresh without
 // user interaction.
 // If we start to support other kinds of applications, we should revisit this.
 // More info on https://developers.google.com/identity/protocols/oauth2/limited-input-device#allowedscopes.
-func (Provider) AdditionalScopes() []string {
-	return []string{}
+func (p Provider) AdditionalScopes() []string {
+	if !p.directoryGroups {
+		return []string{}
+	}
+	return []string{directoryGroupsScope}
+}
+
+// GetUserInfo returns the user info parsed from the ID token, with the groups fetched from the Directory API if
+// enabled.
+func (p Provider) GetUserInfo(ctx context.Context, accessToken *oauth2.Token, idToken *oidc.IDToken) (info.User, error) {
+	if !p.directoryGroups {
+		return p.NoProvider.GetUserInfo(ctx, accessToken, idToken)
+	}
+
+	userClaims, err := p.userClaims(idToken)
+	if err != nil {
+		return info.User{}, err
+	}
+
+	userGroups, err := p.getGroups(ctx, accessToken, userClaims.Email)
+	user := info.NewUser(
+		userClaims.Email,
+		userClaims.Home,
+		userClaims.Sub,
+		userClaims.Shell,
+		userClaims.Gecos,
+		userGroups,
+	)
+	if err != nil {
+		return info.User{}, providerErrors.NewGroupsError(user, err)
+	}
+	return user, nil
+}
+
+type claims struct {
+	Email string `json:"email"`
+	Sub   string `json:"sub"`
+	Home  string `json:"home"`
+	Shell string `json:"shell"`
+	Gecos string `json:"gecos"`
+}
+
+// userClaims returns the user claims parsed from the ID token.
+func (p Provider) userClaims(idToken *oidc.IDToken) (claims, error) {
+	var userClaims claims
+	if err := idToken.Claims(&userClaims); err != nil {
+		return claims{}, fmt.Errorf("failed to get ID token claims: %v", err)
+	}
+	return userClaims, nil
+}
+
+type directoryGroup struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+type directoryGroupsResponse struct {
+	Groups        []directoryGroup `json:"groups"`
+	NextPageToken string           `json:"nextPageToken"`
+}
+
+// getGroups access the Admin SDK Directory API to get the groups the user is a member of.
+func (p Provider) getGroups(ctx context.Context, token *oauth2.Token, email string) ([]info.Group, error) {
+	slog.Debug("Getting user groups from the Google Directory API")
+
+	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(token))
+
+	directoryGroups, err := p.listGroups(ctx, client, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user groups: %v", err)
+	}
+	if p.nestedGroupsMaxDepth > 0 {
+		directoryGroups, err = p.withParentGroups(ctx, client, directoryGroups)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get parent groups: %v", err)
+		}
+	}
+
+	var groups []info.Group
+	for _, g := range directoryGroups {
+		if g.Name == "" {
+			slog.Warn(fmt.Sprintf("Could not get name for group %q", g.Email))
+			return nil, fmt.Errorf("could not get name of group %q", g.Email)
+		}
+		groupName := strings.ToLower(g.Name)
+
+		// Check if the group is a local group, in which case we don't set the UGID (because that's how the user manager
+		// differentiates between local and remote groups).
+		if strings.HasPrefix(groupName, localGroupPrefix) {
+			groups = append(groups, info.Group{Name: strings.TrimPrefix(groupName, localGroupPrefix)})
+			continue
+		}
+
+		groups = append(groups, info.Group{Name: groupName, UGID: g.ID})
+	}
+
+	return groups, nil
+}
+
+// withParentGroups returns the groups with the groups they are members of, recursively, up to the maximum depth. Each
+// group is only listed and followed once, so that the groups which are members of each other do not loop.
+func (p Provider) withParentGroups(ctx context.Context, client *http.Client, groups []directoryGroup) ([]directoryGroup, error) {
+	seen := make(map[string]struct{}, len(groups))
+	for _, g := range groups {
+		seen[g.ID] = struct{}{}
+	}
+
+	level := groups
+	for depth := 1; len(level) > 0; depth++ {
+		if depth > p.nestedGroupsMaxDepth {
+			slog.Debug(fmt.Sprintf("Not following the parent groups deeper than %d levels", p.nestedGroupsMaxDepth))
+			break
+		}
+
+		var parents []directoryGroup
+		for _, g := range level {
+			groupParents, err := p.listGroups(ctx, client, g.Email)
+			if err != nil {
+				return nil, fmt.Errorf("could not get parent groups of %q: %v", g.Email, err)
+			}
+			for _, parent := range groupParents {
+				if _, ok := seen[parent.ID]; ok {
+					continue
+				}
+				seen[parent.ID] = struct{}{}
+				parents = append(parents, parent)
+			}
+		}
+		groups = append(groups, parents...)
+		level = parents
+	}
+
+	return groups, nil
+}
+
+// listGroups fetches all the pages of the groups which the user or the group with the given email is a member of.
+func (p Provider) listGroups(ctx context.Context, client *http.Client, email string) ([]directoryGroup, error) {
+	var groups []directoryGroup
+	var pageToken string
+	for {
+		resp, err := p.getGroupsPage(ctx, client, email, pageToken)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, resp.Groups...)
+
+		if resp.NextPageToken == "" {
+			return groups, nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+// getGroupsPage fetches a single page of the groups the user or the group is a member of.
+func (p Provider) getGroupsPage(ctx context.Context, client *http.Client, email, pageToken string) (directoryGroupsResponse, error) {
+	params := url.Values{}
+	params.Set("userKey", email)
+	if pageToken != "" {
+		params.Set("pageToken", pageToken)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.directoryGroupsURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return directoryGroupsResponse{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return directoryGroupsResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return directoryGroupsResponse{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return directoryGroupsResponse{}, fmt.Errorf("unexpected status %q: %s", resp.Status, body)
+	}
+
+	var groupsResp directoryGroupsResponse
+	if err := json.Unmarshal(body, &groupsResp); err != nil {
+		return directoryGroupsResponse{}, fmt.Errorf("could not parse response: %v", err)
+	}
+	return groupsResp, nil
 }
@@ -1,10 +1,18 @@
 package google_test
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/google"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"golang.org/x/oauth2"
 )
 
 func TestNew(t *testing.T) {
@@ -12,13 +20,214 @@ func TestNew(t *testing.T) {
 
 	p := google.New()
 
-	require.Empty(t, p, "New should return the default provider implementation with no parameters")
+	require.NotEmpty(t, p, "New should return a non-empty provider")
+}
+
+func TestIsGoogleIssuer(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		issuerURL string
+
+		want bool
+	}{
+		"Google_issuer":                     {issuerURL: "https://accounts.google.com", want: true},
+		"Google_issuer_with_uppercase_host": {issuerURL: "https://Accounts.Google.com", want: true},
+		"Google_issuer_with_port":           {issuerURL: "https://accounts.google.com:443", want: true},
+		"Other_Google_host":                 {issuerURL: "https://google.com"},
+		"Issuer_with_Google_as_host_prefix": {issuerURL: "https://accounts.google.com.example.com"},
+		"Issuer_with_Google_in_path":        {issuerURL: "https://login.example.com/accounts.google.com"},
+		"Invalid_issuer_URL":                {issuerURL: "://accounts.google.com"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.want, google.IsGoogleIssuer(tc.issuerURL), "IsGoogleIssuer should only detect the Google issuer")
+		})
+	}
 }
 
 func TestAdditionalScopes(t *testing.T) {
 	t.Parallel()
 
-	p := google.New()
+	require.Empty(t, google.New().AdditionalScopes(),
+		"Google provider should not require additional scopes, which the device authentication does not allow")
+	require.Equal(t, []string{"https://www.googleapis.com/auth/admin.directory.group.readonly"},
+		google.New().WithDirectoryGroups(true).AdditionalScopes(),
+		"Google provider should require the directory group scope if the groups are fetched from the Directory API")
+}
+
+func TestAuthOptions(t *testing.T) {
+	t.Parallel()
+
+	require.Empty(t, google.New().AuthOptions(), "Google provider should not require auth options")
+}
+
+func TestGetGroups(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		pages      []string
+		statusCode int
+
+		wantGroups []info.Group
+		wantErr    bool
+	}{
+		"Successfully_get_groups": {
+			pages:      []string{`{"groups": [{"id": "id1", "email": "g1@example.com", "name": "Group1"}]}`},
+			wantGroups: []info.Group{{Name: "group1", UGID: "id1"}},
+		},
+		"Successfully_get_groups_with_pagination": {
+			pages: []string{
+				`{"groups": [{"id": "id1", "email": "g1@example.com", "name": "Group1"}], "nextPageToken": "1"}`,
+				`{"groups": [{"id": "id2", "email": "g2@example.com", "name": "Group2"}]}`,
+			},
+			wantGroups: []info.Group{{Name: "group1", UGID: "id1"}, {Name: "group2", UGID: "id2"}},
+		},
+		"Successfully_get_local_groups_without_UGID": {
+			pages:      []string{`{"groups": [{"id": "id1", "email": "g1@example.com", "name": "linux-sudo"}]}`},
+			wantGroups: []info.Group{{Name: "sudo"}},
+		},
+		"Successfully_get_no_groups": {
+			pages: []string{`{}`},
+		},
+
+		"Error_when_group_has_no_name":           {pages: []string{`{"groups": [{"id": "id1", "email": "g1@example.com"}]}`}, wantErr: true},
+		"Error_when_response_is_invalid":         {pages: []string{`not json`}, wantErr: true},
+		"Error_when_API_returns_an_error_status": {pages: []string{`{}`}, statusCode: http.StatusForbidden, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "Bearer accesstoken", r.Header.Get("Authorization"), "Request should be authenticated")
+				require.Equal(t, "user@example.com", r.URL.Query().Get("userKey"), "Request should be for the user")
+
+				if tc.statusCode != 0 {
+					w.WriteHeader(tc.statusCode)
+				}
+
+				page := 0
+				if pageToken := r.URL.Query().Get("pageToken"); pageToken != "" {
+					_, err := fmt.Sscanf(pageToken, "%d", &page)
+					require.NoError(t, err, "Page token should be a number")
+				}
+				_, err := w.Write([]byte(tc.pages[page]))
+				require.NoError(t, err, "Writing the response should not fail")
+			}))
+			t.Cleanup(server.Close)
+
+			p := google.New().WithDirectoryGroupsURL(server.URL)
+
+			got, err := p.GetGroups(context.Background(), &oauth2.Token{AccessToken: "accesstoken"}, "user@example.com")
+			if tc.wantErr {
+				require.Error(t, err, "GetGroups should return an error")
+				return
+			}
+			require.NoError(t, err, "GetGroups should not return an error")
+			require.Equal(t, tc.wantGroups, got, "GetGroups should return the expected groups")
+		})
+	}
+}
+
+func TestGetNestedGroups(t *testing.T) {
+	t.Parallel()
+
+	group := func(name string) string {
+		return fmt.Sprintf(`{"id": "id-%s", "email": "%s@example.com", "name": "%s"}`, name, name, name)
+	}
+	want := func(names ...string) []info.Group {
+		var groups []info.Group
+		for _, name := range names {
+			groups = append(groups, info.Group{Name: name, UGID: "id-" + name})
+		}
+		return groups
+	}
+
+	tests := map[string]struct {
+		// memberships are the groups which the user, or each group, is a direct member of.
+		memberships map[string][]string
+		maxDepth    int
+		failingKey  string
+
+		wantGroups    []info.Group
+		wantRequested []string
+		wantErr       bool
+	}{
+		"Only_direct_groups_are_returned_if_disabled": {
+			memberships:   map[string][]string{"user": {"a"}, "a": {"b"}},
+			wantGroups:    want("a"),
+			wantRequested: []string{"user"},
+		},
+		"Parent_groups_are_returned": {
+			memberships:   map[string][]string{"user": {"a"}, "a": {"b"}, "b": {"c"}},
+			maxDepth:      5,
+			wantGroups:    want("a", "b", "c"),
+			wantRequested: []string{"user", "a", "b", "c"},
+		},
+		"Parent_groups_are_returned_once_in_a_diamond": {
+			memberships:   map[string][]string{"user": {"a"}, "a": {"b", "c"}, "b": {"d"}, "c": {"d"}},
+			maxDepth:      5,
+			wantGroups:    want("a", "b", "c", "d"),
+			wantRequested: []string{"user", "a", "b", "c", "d"},
+		},
+		"Parent_groups_are_returned_once_in_a_cycle": {
+			memberships:   map[string][]string{"user": {"a"}, "a": {"b"}, "b": {"a"}},
+			maxDepth:      5,
+			wantGroups:    want("a", "b"),
+			wantRequested: []string{"user", "a", "b"},
+		},
+		"Parent_groups_are_not_followed_deeper_than_the_maximum_depth": {
+			memberships:   map[string][]string{"user": {"a"}, "a": {"b"}, "b": {"c"}},
+			maxDepth:      1,
+			wantGroups:    want("a", "b"),
+			wantRequested: []string{"user", "a"},
+		},
+
+		"Error_when_parent_groups_can_not_be_listed": {
+			memberships: map[string][]string{"user": {"a"}, "a": {"b"}},
+			maxDepth:    5,
+			failingKey:  "a",
+			wantErr:     true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var mu sync.Mutex
+			var requested []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				key := strings.TrimSuffix(r.URL.Query().Get("userKey"), "@example.com")
+				mu.Lock()
+				requested = append(requested, key)
+				mu.Unlock()
+
+				if key == tc.failingKey {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				var groups []string
+				for _, g := range tc.memberships[key] {
+					groups = append(groups, group(g))
+				}
+				_, err := w.Write([]byte(`{"groups": [` + strings.Join(groups, ", ") + `]}`))
+				require.NoError(t, err, "Writing the response should not fail")
+			}))
+			t.Cleanup(server.Close)
+
+			p := google.New().WithDirectoryGroupsURL(server.URL).WithNestedGroups(tc.maxDepth)
 
-	require.Empty(t, p.AdditionalScopes(), "Google provider should not require additional scopes")
+			got, err := p.GetGroups(context.Background(), &oauth2.Token{AccessToken: "accesstoken"}, "user@example.com")
+			if tc.wantErr {
+				require.Error(t, err, "GetGroups should return an error")
+				return
+			}
+			require.NoError(t, err, "GetGroups should not return an error")
+			require.Equal(t, tc.wantGroups, got, "GetGroups should return the expected groups")
+			require.Equal(t, tc.wantRequested, requested, "The groups of the user and of each group should be listed once")
+		})
+	}
 }
@@ -0,0 +1,46 @@
+// Package hosts matches the issuers against the hosts of the identity providers, to detect which provider they are.
+package hosts
+
+import (
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// IssuerMatches returns true if the host of the issuer URL matches one of the patterns. A pattern is either a host,
+// matched as a whole, or a host prefixed with "*.", matched by all its subdomains but not by the host itself. The port,
+// the brackets of the IPv6 literals and the trailing dot of the host are ignored, and the hosts are compared case
+// insensitively.
+func IssuerMatches(issuerURL string, patterns ...string) bool {
+	u, err := url.Parse(issuerURL)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return false
+	}
+	// IP literals can be written in several ways, e.g. with or without the leading zeros of IPv6.
+	addr, err := netip.ParseAddr(host)
+	isIP := err == nil
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+		if isIP {
+			if p, err := netip.ParseAddr(pattern); err == nil && p == addr {
+				return true
+			}
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasPrefix(suffix, ".") && len(host) > len(suffix) && strings.HasSuffix(host, suffix) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package hosts_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/hosts"
+)
+
+func TestIssuerMatches(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		issuerURL string
+		patterns  []string
+
+		want bool
+	}{
+		"Host":                                 {issuerURL: "https://gitlab.com", patterns: []string{"gitlab.com"}, want: true},
+		"Host_with_port":                       {issuerURL: "https://keycloak.internal:8443/realms/x", patterns: []string{"keycloak.internal"}, want: true},
+		"Host_with_trailing_dot":               {issuerURL: "https://gitlab.com./", patterns: []string{"gitlab.com"}, want: true},
+		"Host_with_uppercase":                  {issuerURL: "https://GitLab.COM", patterns: []string{"gitlab.com"}, want: true},
+		"Subdomain_of_wildcard":                {issuerURL: "https://example.okta.com/oauth2/default", patterns: []string{"*.okta.com"}, want: true},
+		"Subdomain_of_wildcard_with_port":      {issuerURL: "https://example.okta.com:8443", patterns: []string{"*.okta.com"}, want: true},
+		"Second_pattern":                       {issuerURL: "https://example.oktapreview.com", patterns: []string{"*.okta.com", "*.oktapreview.com"}, want: true},
+		"IPv6_literal_with_port":               {issuerURL: "https://[::1]:8443/realms/x", patterns: []string{"::1"}, want: true},
+		"IPv6_literal_written_another_way":     {issuerURL: "https://[0:0::0001]/realms/x", patterns: []string{"::1"}, want: true},
+		"IPv4_literal_with_port":               {issuerURL: "https://127.0.0.1:8443", patterns: []string{"127.0.0.1"}, want: true},
+		"Other_host":                           {issuerURL: "https://login.example.com", patterns: []string{"gitlab.com", "*.okta.com"}},
+		"Wildcard_does_not_match_its_own_host": {issuerURL: "https://okta.com", patterns: []string{"*.okta.com"}},
+		"Host_as_prefix_of_other_host":         {issuerURL: "https://gitlab.com.example.com", patterns: []string{"gitlab.com"}},
+		"Host_as_suffix_of_other_host":         {issuerURL: "https://evilgitlab.com", patterns: []string{"gitlab.com"}},
+		"Host_in_path":                         {issuerURL: "https://login.example.com/gitlab.com", patterns: []string{"gitlab.com"}},
+		"Host_in_user_info":                    {issuerURL: "https://gitlab.com@login.example.com", patterns: []string{"gitlab.com"}},
+		"Port_is_not_part_of_host":             {issuerURL: "https://keycloak.internal:8443", patterns: []string{"keycloak.internal:8443"}},
+		"IPv6_literal_is_not_a_subdomain":      {issuerURL: "https://[::1]:8443", patterns: []string{"*.1"}},
+		"Other_IPv6_literal":                   {issuerURL: "https://[::2]:8443", patterns: []string{"::1"}},
+		"No_host":                              {issuerURL: "/realms/x", patterns: []string{""}},
+		"Invalid_issuer_URL":                   {issuerURL: "://gitlab.com", patterns: []string{"gitlab.com"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.want, hosts.IssuerMatches(tc.issuerURL, tc.patterns...), "IssuerMatches should match the host of the issuer")
+		})
+	}
+}
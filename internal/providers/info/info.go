@@ -5,8 +5,14 @@ package info
 type Group struct {
 	Name string `json:"name"`
 	UGID string `json:"ugid"`
+	// GID is the GID derived from the UGID, if the broker is configured to assign them. It is 0 otherwise, and for the
+	// local groups, which already have one.
+	GID uint32 `json:"gid,omitempty" yaml:"gid,omitempty"`
 }
 
+// DefaultShell is the shell of the users if the provider does not set one.
+const DefaultShell = "/usr/bin/bash"
+
 // User represents the user information obtained from the provider.
 type User struct {
 	Name   string  `json:"name"`
@@ -15,6 +21,8 @@ type User struct {
 	Shell  string  `json:"shell"`
 	Gecos  string  `json:"gecos"`
 	Groups []Group `json:"groups"`
+	// UID is the UID derived from the subject, if the broker is configured to assign them. It is 0 otherwise.
+	UID uint32 `json:"uid,omitempty" yaml:"uid,omitempty"`
 }
 
 // NewUser creates a new user with the specified values.
@@ -34,7 +42,7 @@ func NewUser(name, home, uuid, shell, gecos string, groups []Group) User {
 		u.Home = u.Name
 	}
 	if u.Shell == "" {
-		u.Shell = "/usr/bin/bash"
+		u.Shell = DefaultShell
 	}
 	if u.Gecos == "" {
 		u.Gecos = u.Name
@@ -18,6 +18,7 @@ import (
 	msgraphauth "github.com/microsoftgraph/msgraph-sdk-go-core/authentication"
 	msgraphmodels "github.com/microsoftgraph/msgraph-sdk-go/models"
 	"github.com/ubuntu/authd-oidc-brokers/internal/broker/authmodes"
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker/sessionmode"
 	"github.com/ubuntu/authd-oidc-brokers/internal/consts"
 	providerErrors "github.com/ubuntu/authd-oidc-brokers/internal/providers/errors"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
@@ -94,18 +95,18 @@ func (p Provider) GetUserInfo(ctx context.Context, accessToken *oauth2.Token, id
 	}
 
 	userGroups, err := p.getGroups(accessToken)
-	if err != nil {
-		return info.User{}, err
-	}
-
-	return info.NewUser(
+	user := info.NewUser(
 		userClaims.PreferredUserName,
 		userClaims.Home,
 		userClaims.Sub,
 		userClaims.Shell,
 		userClaims.Gecos,
 		userGroups,
-	), nil
+	)
+	if err != nil {
+		return info.User{}, providerErrors.NewGroupsError(user, err)
+	}
+	return user, nil
 }
 
 type claims struct {
@@ -240,7 +241,7 @@ func (p Provider) CurrentAuthenticationModesOffered(
 	slog.Debug(fmt.Sprintf("In CurrentAuthenticationModesOffered: sessionMode=%q, supportedAuthModes=%q, tokenExists=%t, providerReachable=%t, endpoints=%q, currentAuthStep=%d\n", sessionMode, supportedAuthModes, tokenExists, providerReachable, endpoints, currentAuthStep))
 	var offeredModes []string
 	switch sessionMode {
-	case "passwd":
+	case sessionmode.ChangePassword:
 		if !tokenExists {
 			return nil, errors.New("user has no cached token")
 		}
@@ -249,18 +250,24 @@ func (p Provider) CurrentAuthenticationModesOffered(
 			offeredModes = []string{authmodes.NewPassword}
 		}
 
-	default: // auth mode
+	case sessionmode.Login:
 		if _, ok := endpoints[authmodes.DeviceQr]; ok && providerReachable {
 			offeredModes = []string{authmodes.DeviceQr}
 		} else if _, ok := endpoints[authmodes.Device]; ok && providerReachable {
 			offeredModes = []string{authmodes.Device}
 		}
+		if _, ok := endpoints[authmodes.WebAuthn]; ok && providerReachable {
+			offeredModes = append(offeredModes, authmodes.WebAuthn)
+		}
 		if tokenExists {
 			offeredModes = append([]string{authmodes.Password}, offeredModes...)
 		}
 		if currentAuthStep > 0 {
 			offeredModes = []string{authmodes.NewPassword}
 		}
+
+	default:
+		return nil, fmt.Errorf("unknown session mode %q", sessionMode)
 	}
 	slog.Debug(fmt.Sprintf("Offered modes: %q", offeredModes))
 
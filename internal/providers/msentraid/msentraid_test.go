@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker/authmodes"
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker/sessionmode"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/msentraid"
 	"golang.org/x/oauth2"
 )
@@ -115,3 +117,125 @@ func TestVerifyUsername(t *testing.T) {
 		})
 	}
 }
+
+func TestCurrentAuthenticationModesOffered(t *testing.T) {
+	t.Parallel()
+
+	allModes := map[string]string{
+		authmodes.Password:    "Password",
+		authmodes.Device:      "Device",
+		authmodes.DeviceQr:    "DeviceQr",
+		authmodes.NewPassword: "NewPassword",
+		authmodes.WebAuthn:    "WebAuthn",
+	}
+
+	tests := map[string]struct {
+		sessionMode        string
+		supportedAuthModes map[string]string
+		tokenExists        bool
+		providerReachable  bool
+		endpoints          []string
+		currentAuthStep    int
+
+		wantModes []string
+		wantErr   bool
+	}{
+		"Offer_device_auth_qr_when_supported": {
+			providerReachable: true,
+			endpoints:         []string{authmodes.DeviceQr, authmodes.Device},
+			wantModes:         []string{authmodes.DeviceQr},
+		},
+		"Offer_device_auth_when_qrcode_can_not_be_rendered": {
+			providerReachable: true,
+			endpoints:         []string{authmodes.Device},
+			wantModes:         []string{authmodes.Device},
+		},
+		"Offer_password_first_when_token_exists": {
+			tokenExists:       true,
+			providerReachable: true,
+			endpoints:         []string{authmodes.Device},
+			wantModes:         []string{authmodes.Password, authmodes.Device},
+		},
+		"Offer_only_password_when_provider_is_not_reachable": {
+			tokenExists: true,
+			endpoints:   []string{authmodes.DeviceQr, authmodes.Device},
+			wantModes:   []string{authmodes.Password},
+		},
+		"Offer_webauthn_after_device_auth_when_supported": {
+			providerReachable: true,
+			endpoints:         []string{authmodes.Device, authmodes.WebAuthn},
+			wantModes:         []string{authmodes.Device, authmodes.WebAuthn},
+		},
+		"Do_not_offer_webauthn_when_provider_is_not_reachable": {
+			tokenExists: true,
+			endpoints:   []string{authmodes.WebAuthn},
+			wantModes:   []string{authmodes.Password},
+		},
+		"Offer_newpassword_after_first_step": {
+			providerReachable: true,
+			endpoints:         []string{authmodes.DeviceQr},
+			currentAuthStep:   1,
+			wantModes:         []string{authmodes.NewPassword},
+		},
+		"Offer_password_in_passwd_session": {
+			sessionMode: sessionmode.ChangePassword,
+			tokenExists: true,
+			wantModes:   []string{authmodes.Password},
+		},
+		"Offer_only_password_in_passwd_session_when_provider_is_reachable": {
+			sessionMode:       sessionmode.ChangePassword,
+			tokenExists:       true,
+			providerReachable: true,
+			endpoints:         []string{authmodes.DeviceQr, authmodes.Device, authmodes.WebAuthn},
+			wantModes:         []string{authmodes.Password},
+		},
+		"Offer_newpassword_after_password_in_passwd_session": {
+			sessionMode:     sessionmode.ChangePassword,
+			tokenExists:     true,
+			currentAuthStep: 1,
+			wantModes:       []string{authmodes.NewPassword},
+		},
+
+		"Error_in_passwd_session_without_token": {sessionMode: sessionmode.ChangePassword, wantErr: true},
+		"Error_with_unknown_session_mode":       {sessionMode: "login", tokenExists: true, wantErr: true},
+		"Error_when_offered_mode_is_not_supported_locally": {
+			supportedAuthModes: map[string]string{authmodes.Password: "Password"},
+			providerReachable:  true,
+			endpoints:          []string{authmodes.Device},
+			wantErr:            true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.sessionMode == "" {
+				tc.sessionMode = sessionmode.Login
+			}
+			if tc.supportedAuthModes == nil {
+				tc.supportedAuthModes = allModes
+			}
+			endpoints := make(map[string]struct{})
+			for _, e := range tc.endpoints {
+				endpoints[e] = struct{}{}
+			}
+
+			p := msentraid.New()
+
+			got, err := p.CurrentAuthenticationModesOffered(
+				tc.sessionMode,
+				tc.supportedAuthModes,
+				tc.tokenExists,
+				tc.providerReachable,
+				endpoints,
+				tc.currentAuthStep,
+			)
+			if tc.wantErr {
+				require.Error(t, err, "CurrentAuthenticationModesOffered should return an error")
+				return
+			}
+			require.NoError(t, err, "CurrentAuthenticationModesOffered should not return an error")
+			require.Equal(t, tc.wantModes, got, "CurrentAuthenticationModesOffered should return the expected modes")
+		})
+	}
+}
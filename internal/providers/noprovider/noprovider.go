@@ -8,6 +8,8 @@ import (
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/ubuntu/authd-oidc-brokers/internal/broker/authmodes"
+	"github.com/ubuntu/authd-oidc-brokers/internal/broker/sessionmode"
+	providerErrors "github.com/ubuntu/authd-oidc-brokers/internal/providers/errors"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
 	"golang.org/x/oauth2"
 )
@@ -47,7 +49,7 @@ func (p NoProvider) CurrentAuthenticationModesOffered(
 ) ([]string, error) {
 	var offeredModes []string
 	switch sessionMode {
-	case "passwd":
+	case sessionmode.ChangePassword:
 		if !tokenExists {
 			return nil, errors.New("user has no cached token")
 		}
@@ -56,18 +58,24 @@ func (p NoProvider) CurrentAuthenticationModesOffered(
 			offeredModes = []string{authmodes.NewPassword}
 		}
 
-	default: // auth mode
+	case sessionmode.Login:
 		if _, ok := endpoints[authmodes.DeviceQr]; ok && providerReachable {
 			offeredModes = []string{authmodes.DeviceQr}
 		} else if _, ok := endpoints[authmodes.Device]; ok && providerReachable {
 			offeredModes = []string{authmodes.Device}
 		}
+		if _, ok := endpoints[authmodes.WebAuthn]; ok && providerReachable {
+			offeredModes = append(offeredModes, authmodes.WebAuthn)
+		}
 		if tokenExists {
 			offeredModes = append([]string{authmodes.Password}, offeredModes...)
 		}
 		if currentAuthStep > 0 {
 			offeredModes = []string{authmodes.NewPassword}
 		}
+
+	default:
+		return nil, fmt.Errorf("unknown session mode %q", sessionMode)
 	}
 
 	for _, mode := range offeredModes {
@@ -92,18 +100,18 @@ func (p NoProvider) GetUserInfo(ctx context.Context, accessToken *oauth2.Token,
 	}
 
 	userGroups, err := p.getGroups(accessToken)
-	if err != nil {
-		return info.User{}, err
-	}
-
-	return info.NewUser(
+	user := info.NewUser(
 		userClaims.Email,
 		userClaims.Home,
 		userClaims.Sub,
 		userClaims.Shell,
 		userClaims.Gecos,
 		userGroups,
-	), nil
+	)
+	if err != nil {
+		return info.User{}, providerErrors.NewGroupsError(user, err)
+	}
+	return user, nil
 }
 
 // NormalizeUsername parses a username into a normalized version.
@@ -0,0 +1,228 @@
+// Package okta is the Okta specific extension.
+package okta
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	providerErrors "github.com/ubuntu/authd-oidc-brokers/internal/providers/errors"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/hosts"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/noprovider"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// DefaultGroupsClaim is the claim of the ID token listing the groups of the user, unless another one is configured.
+	DefaultGroupsClaim = "groups"
+	// groupsScope is the scope which makes the authorization server add the groups claim to the ID token.
+	groupsScope = "groups"
+	// groupsAPIPath is the Okta API endpoint listing the groups of the authenticated user, relative to the Okta org.
+	groupsAPIPath = "/api/v1/users/me/groups"
+
+	localGroupPrefix = "linux-"
+)
+
+// oktaHostPatterns are the hosts of the Okta orgs.
+var oktaHostPatterns = []string{"*.okta.com", "*.oktapreview.com"}
+
+// nextLinkRegexp matches the URL of the next page in the Link header of the Okta API responses.
+var nextLinkRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// Provider is the Okta provider implementation.
+type Provider struct {
+	noprovider.NoProvider
+
+	groupsClaim string
+}
+
+// New returns a new Okta provider, reading the groups of the user from the given claim of the ID token, or from
+// DefaultGroupsClaim if it is empty.
+func New(groupsClaim string) Provider {
+	if groupsClaim == "" {
+		groupsClaim = DefaultGroupsClaim
+	}
+	return Provider{
+		NoProvider:  noprovider.New(),
+		groupsClaim: groupsClaim,
+	}
+}
+
+// IsOktaIssuer returns true if the issuer is hosted by Okta.
+func IsOktaIssuer(issuerURL string) bool {
+	return hosts.IssuerMatches(issuerURL, oktaHostPatterns...)
+}
+
+// AdditionalScopes returns the scopes required by the provider, including the one to get the groups claim.
+func (p Provider) AdditionalScopes() []string {
+	return append(p.NoProvider.AdditionalScopes(), groupsScope)
+}
+
+// GetUserInfo returns the user info parsed from the ID token, with the groups of the groups claim, or fetched from the
+// Okta API if the ID token has no such claim.
+func (p Provider) GetUserInfo(ctx context.Context, accessToken *oauth2.Token, idToken *oidc.IDToken) (info.User, error) {
+	userClaims, err := p.userClaims(idToken)
+	if err != nil {
+		return info.User{}, err
+	}
+
+	userGroups, err := p.getGroups(ctx, accessToken, idToken)
+	user := info.NewUser(
+		userClaims.Email,
+		userClaims.Home,
+		userClaims.Sub,
+		userClaims.Shell,
+		userClaims.Gecos,
+		userGroups,
+	)
+	if err != nil {
+		return info.User{}, providerErrors.NewGroupsError(user, err)
+	}
+	return user, nil
+}
+
+type claims struct {
+	Email string `json:"email"`
+	Sub   string `json:"sub"`
+	Home  string `json:"home"`
+	Shell string `json:"shell"`
+	Gecos string `json:"gecos"`
+}
+
+// userClaims returns the user claims parsed from the ID token.
+func (p Provider) userClaims(idToken *oidc.IDToken) (claims, error) {
+	var userClaims claims
+	if err := idToken.Claims(&userClaims); err != nil {
+		return claims{}, fmt.Errorf("failed to get ID token claims: %v", err)
+	}
+	return userClaims, nil
+}
+
+// getGroups returns the groups of the groups claim of the ID token, or fetches them from the Okta API if the claim is
+// absent, e.g. because the authorization server is not configured to add it.
+func (p Provider) getGroups(ctx context.Context, token *oauth2.Token, idToken *oidc.IDToken) ([]info.Group, error) {
+	var allClaims map[string]json.RawMessage
+	if err := idToken.Claims(&allClaims); err != nil {
+		return nil, fmt.Errorf("failed to get ID token claims: %v", err)
+	}
+
+	rawGroups, ok := allClaims[p.groupsClaim]
+	if !ok {
+		return p.getGroupsFromAPI(ctx, token, idToken.Issuer)
+	}
+
+	var names []string
+	if err := json.Unmarshal(rawGroups, &names); err != nil {
+		return nil, fmt.Errorf("invalid %q claim: %v", p.groupsClaim, err)
+	}
+	return groupsFromNames(names)
+}
+
+type apiGroup struct {
+	ID      string `json:"id"`
+	Profile struct {
+		Name string `json:"name"`
+	} `json:"profile"`
+}
+
+// getGroupsFromAPI fetches the groups the user is a member of from the Okta API of the issuer's org.
+func (p Provider) getGroupsFromAPI(ctx context.Context, token *oauth2.Token, issuerURL string) ([]info.Group, error) {
+	slog.Debug("Getting user groups from the Okta API")
+
+	orgURL, err := url.Parse(issuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid issuer URL %q: %v", issuerURL, err)
+	}
+	nextURL := (&url.URL{Scheme: orgURL.Scheme, Host: orgURL.Host, Path: groupsAPIPath}).String()
+
+	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(token))
+
+	var names []string
+	for nextURL != "" {
+		page, next, err := getGroupsPage(ctx, client, nextURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user groups: %v", err)
+		}
+		// Do not send the access token to another host than the one of the org.
+		if u, err := url.Parse(next); next != "" && (err != nil || u.Host != orgURL.Host) {
+			return nil, fmt.Errorf("next page of the user groups %q is not on %q", next, orgURL.Host)
+		}
+		for _, g := range page {
+			if g.Profile.Name == "" {
+				return nil, fmt.Errorf("could not get name of group %q", g.ID)
+			}
+			names = append(names, g.Profile.Name)
+		}
+		nextURL = next
+	}
+
+	return groupsFromNames(names)
+}
+
+// getGroupsPage fetches a single page of the groups the user is a member of, and returns it with the URL of the next
+// page, if any.
+func getGroupsPage(ctx context.Context, client *http.Client, pageURL string) ([]apiGroup, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %q: %s", resp.Status, body)
+	}
+
+	var groups []apiGroup
+	if err := json.Unmarshal(body, &groups); err != nil {
+		return nil, "", fmt.Errorf("could not parse response: %v", err)
+	}
+
+	var next string
+	for _, link := range resp.Header.Values("Link") {
+		if m := nextLinkRegexp.FindStringSubmatch(link); m != nil {
+			next = m[1]
+		}
+	}
+	return groups, next, nil
+}
+
+// groupsFromNames returns the groups with the given names. The groups claim only contains the names, so the names are
+// also used as the UGIDs of the groups fetched from the API, so that they do not depend on where the groups come from.
+func groupsFromNames(names []string) ([]info.Group, error) {
+	var groups []info.Group
+	for _, name := range names {
+		if name == "" {
+			return nil, errors.New("group name is empty")
+		}
+		groupName := strings.ToLower(name)
+
+		// Check if the group is a local group, in which case we don't set the UGID (because that's how the user manager
+		// differentiates between local and remote groups).
+		if strings.HasPrefix(groupName, localGroupPrefix) {
+			groups = append(groups, info.Group{Name: strings.TrimPrefix(groupName, localGroupPrefix)})
+			continue
+		}
+
+		groups = append(groups, info.Group{Name: groupName, UGID: groupName})
+	}
+	return groups, nil
+}
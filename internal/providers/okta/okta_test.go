@@ -0,0 +1,189 @@
+package okta_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/okta"
+	"github.com/ubuntu/authd-oidc-brokers/internal/testutils"
+	"github.com/ubuntu/authd-oidc-brokers/internal/testutils/golden"
+	"golang.org/x/oauth2"
+)
+
+var signingKey = func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("could not generate signing key: %v", err))
+	}
+	return key
+}()
+
+func TestIsOktaIssuer(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		issuerURL string
+
+		want bool
+	}{
+		"Okta_org":                         {issuerURL: "https://example.okta.com", want: true},
+		"Okta_custom_authorization_server": {issuerURL: "https://example.okta.com/oauth2/default", want: true},
+		"Okta_preview_org":                 {issuerURL: "https://example.oktapreview.com", want: true},
+		"Okta_org_with_uppercase_host":     {issuerURL: "https://Example.OKTA.com", want: true},
+		"Other_issuer":                     {issuerURL: "https://login.example.com"},
+		"Issuer_with_Okta_in_path":         {issuerURL: "https://login.example.com/example.okta.com"},
+		"Issuer_with_Okta_as_host_prefix":  {issuerURL: "https://example.okta.com.example.com"},
+		"Invalid_issuer_URL":               {issuerURL: "://example.okta.com"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.want, okta.IsOktaIssuer(tc.issuerURL), "IsOktaIssuer should detect the Okta issuers")
+		})
+	}
+}
+
+func TestAdditionalScopes(t *testing.T) {
+	t.Parallel()
+
+	p := okta.New("")
+
+	require.Equal(t, []string{oidc.ScopeOfflineAccess, "groups"}, p.AdditionalScopes(),
+		"Okta provider should require the offline access and groups scopes")
+}
+
+func TestGetGroups(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		groupsClaim string
+		claims      map[string]any
+		pages       []string
+		statusCode  int
+		nextLink    string
+
+		wantGroups []info.Group
+		wantErr    bool
+	}{
+		"Successfully_get_groups_from_claim": {
+			claims:     map[string]any{"groups": []string{"Group1", "Group2"}},
+			wantGroups: []info.Group{{Name: "group1", UGID: "group1"}, {Name: "group2", UGID: "group2"}},
+		},
+		"Successfully_get_groups_from_custom_claim": {
+			groupsClaim: "roles",
+			claims:      map[string]any{"roles": []string{"Group1"}, "groups": []string{"Ignored"}},
+			wantGroups:  []info.Group{{Name: "group1", UGID: "group1"}},
+		},
+		"Successfully_get_local_groups_from_claim_without_UGID": {
+			claims:     map[string]any{"groups": []string{"linux-sudo"}},
+			wantGroups: []info.Group{{Name: "sudo"}},
+		},
+		"Successfully_get_no_groups_from_empty_claim": {
+			claims: map[string]any{"groups": []string{}},
+		},
+		"Successfully_get_groups_from_API_when_claim_is_absent": {
+			pages:      []string{`[{"id": "id1", "profile": {"name": "Group1"}}]`},
+			wantGroups: []info.Group{{Name: "group1", UGID: "group1"}},
+		},
+		"Successfully_get_groups_from_API_with_pagination": {
+			pages: []string{
+				`[{"id": "id1", "profile": {"name": "Group1"}}]`,
+				`[{"id": "id2", "profile": {"name": "linux-sudo"}}]`,
+			},
+			wantGroups: []info.Group{{Name: "group1", UGID: "group1"}, {Name: "sudo"}},
+		},
+		"Successfully_get_no_groups_from_API": {
+			pages: []string{`[]`},
+		},
+
+		"Error_when_claim_is_not_a_list_of_strings":   {claims: map[string]any{"groups": "Group1"}, wantErr: true},
+		"Error_when_claim_has_an_empty_group_name":    {claims: map[string]any{"groups": []string{""}}, wantErr: true},
+		"Error_when_API_group_has_no_name":            {pages: []string{`[{"id": "id1", "profile": {}}]`}, wantErr: true},
+		"Error_when_API_response_is_invalid":          {pages: []string{`not json`}, wantErr: true},
+		"Error_when_API_returns_an_error_status":      {pages: []string{`[]`}, statusCode: http.StatusForbidden, wantErr: true},
+		"Error_when_API_next_page_is_on_another_host": {pages: []string{`[]`}, nextLink: "https://example.com/api/v1/users/me/groups", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "/api/v1/users/me/groups", r.URL.Path, "Request should be for the groups of the user")
+				require.Equal(t, "Bearer accesstoken", r.Header.Get("Authorization"), "Request should be authenticated")
+
+				page := 0
+				if after := r.URL.Query().Get("after"); after != "" {
+					_, err := fmt.Sscanf(after, "%d", &page)
+					require.NoError(t, err, "Page cursor should be a number")
+				}
+				if tc.nextLink != "" {
+					w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, tc.nextLink))
+				} else if page+1 < len(tc.pages) {
+					w.Header().Add("Link", fmt.Sprintf(`<http://%s%s>; rel="self"`, r.Host, r.URL.Path))
+					w.Header().Add("Link", fmt.Sprintf(`<http://%s%s?after=%d>; rel="next"`, r.Host, r.URL.Path, page+1))
+				}
+				if tc.statusCode != 0 {
+					w.WriteHeader(tc.statusCode)
+				}
+				_, err := w.Write([]byte(tc.pages[page]))
+				require.NoError(t, err, "Writing the response should not fail")
+			}))
+			t.Cleanup(server.Close)
+
+			// The authorization server is a custom one of the org, whose API is at the root of the issuer host.
+			issuer := server.URL + "/oauth2/default"
+			idToken := newIDToken(t, issuer, tc.claims)
+
+			got, err := okta.New(tc.groupsClaim).GetGroups(context.Background(), &oauth2.Token{AccessToken: "accesstoken"}, idToken)
+			if tc.wantErr {
+				require.Error(t, err, "GetGroups should return an error")
+				return
+			}
+			require.NoError(t, err, "GetGroups should not return an error")
+			require.Equal(t, tc.wantGroups, got, "GetGroups should return the expected groups")
+		})
+	}
+}
+
+func TestGetGroupsFromRecordedAPI(t *testing.T) {
+	t.Parallel()
+
+	// The responses can be recorded again from a live org, see testutils.RecordHTTPEnv.
+	transport := testutils.NewRecordedTransport(t)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, transport.Client())
+	idToken := newIDToken(t, "https://example.okta.com/oauth2/default", nil)
+
+	got, err := okta.New("").GetGroups(ctx, &oauth2.Token{AccessToken: "accesstoken"}, idToken)
+	require.NoError(t, err, "GetGroups should not return an error")
+	golden.CheckOrUpdateYAML(t, got)
+}
+
+// newIDToken returns a verified ID token of the issuer with the given extra claims.
+func newIDToken(t *testing.T, issuer string, extraClaims map[string]any) *oidc.IDToken {
+	t.Helper()
+
+	claims := jwt.MapClaims{"iss": issuer, "sub": "user-id", "aud": "client-id", "email": "user@example.com"}
+	for k, v := range extraClaims {
+		claims[k] = v
+	}
+	rawIDToken, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(signingKey)
+	require.NoError(t, err, "Setup: Signing the ID token should not fail")
+
+	keySet := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&signingKey.PublicKey}}
+	verifier := oidc.NewVerifier(issuer, keySet, &oidc.Config{SkipClientIDCheck: true, SkipExpiryCheck: true})
+	idToken, err := verifier.Verify(context.Background(), rawIDToken)
+	require.NoError(t, err, "Setup: Verifying the ID token should not fail")
+
+	return idToken
+}
@@ -0,0 +1,11 @@
+package ping
+
+import (
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+)
+
+// GetGroups exposes the provider's getGroups method for tests.
+func (p Provider) GetGroups(idToken *oidc.IDToken) ([]info.Group, error) {
+	return p.getGroups(idToken)
+}
@@ -0,0 +1,162 @@
+// Package ping is the Ping Identity specific extension, for PingFederate and PingOne.
+package ping
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/noprovider"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// DefaultGroupsClaim is the claim of the ID token listing the groups of the user, unless another one is configured.
+	// PingFederate usually fulfills it from the memberOf attribute of the LDAP directory, so it lists the DNs of the
+	// groups.
+	DefaultGroupsClaim = "memberOf"
+
+	localGroupPrefix = "linux-"
+)
+
+// Provider is the Ping Identity provider implementation.
+type Provider struct {
+	noprovider.NoProvider
+
+	groupsClaim string
+}
+
+// New returns a new Ping Identity provider, reading the groups of the user from the given claim of the ID token, or
+// from DefaultGroupsClaim if it is empty.
+func New(groupsClaim string) Provider {
+	if groupsClaim == "" {
+		groupsClaim = DefaultGroupsClaim
+	}
+	return Provider{
+		NoProvider:  noprovider.New(),
+		groupsClaim: groupsClaim,
+	}
+}
+
+// AdditionalScopes returns the scopes required by the provider. PingFederate rejects the scopes which are not defined
+// by the administrator, so unlike the generic provider, it does not request offline_access: the refresh tokens are
+// issued to the clients allowed to use the refresh token grant.
+func (p Provider) AdditionalScopes() []string {
+	return []string{oidc.ScopeOpenID, "profile", "email"}
+}
+
+// GetUserInfo returns the user info parsed from the ID token, with the groups of the groups claim.
+func (p Provider) GetUserInfo(_ context.Context, _ *oauth2.Token, idToken *oidc.IDToken) (info.User, error) {
+	userClaims, err := p.userClaims(idToken)
+	if err != nil {
+		return info.User{}, err
+	}
+
+	userGroups, err := p.getGroups(idToken)
+	if err != nil {
+		return info.User{}, err
+	}
+
+	return info.NewUser(
+		userClaims.Email,
+		userClaims.Home,
+		userClaims.Sub,
+		userClaims.Shell,
+		userClaims.Gecos,
+		userGroups,
+	), nil
+}
+
+type claims struct {
+	Email string `json:"email"`
+	Sub   string `json:"sub"`
+	Home  string `json:"home"`
+	Shell string `json:"shell"`
+	Gecos string `json:"gecos"`
+}
+
+// userClaims returns the user claims parsed from the ID token.
+func (p Provider) userClaims(idToken *oidc.IDToken) (claims, error) {
+	var userClaims claims
+	if err := idToken.Claims(&userClaims); err != nil {
+		return claims{}, fmt.Errorf("failed to get ID token claims: %v", err)
+	}
+	return userClaims, nil
+}
+
+// getGroups returns the groups of the groups claim of the ID token. PingFederate omits the attributes without value
+// and sets the ones with a single value as a string rather than a list, so the user has no groups if the claim is
+// absent, and the claim can be either a list of groups or a single group.
+func (p Provider) getGroups(idToken *oidc.IDToken) ([]info.Group, error) {
+	var allClaims map[string]json.RawMessage
+	if err := idToken.Claims(&allClaims); err != nil {
+		return nil, fmt.Errorf("failed to get ID token claims: %v", err)
+	}
+
+	rawGroups, ok := allClaims[p.groupsClaim]
+	if !ok {
+		return nil, nil
+	}
+
+	var names []string
+	if err := json.Unmarshal(rawGroups, &names); err != nil {
+		var name string
+		if err := json.Unmarshal(rawGroups, &name); err != nil {
+			return nil, fmt.Errorf("invalid %q claim: must be a string or a list of strings", p.groupsClaim)
+		}
+		names = []string{name}
+	}
+	return groupsFromNames(names)
+}
+
+// groupsFromNames returns the groups with the given names, or DNs of which the common name is the group name. The
+// claim only contains the names, so they are also used as the UGIDs of the groups.
+func groupsFromNames(names []string) ([]info.Group, error) {
+	var groups []info.Group
+	for _, name := range names {
+		groupName := strings.ToLower(commonName(name))
+		if groupName == "" {
+			return nil, errors.New("group name is empty")
+		}
+
+		// Check if the group is a local group, in which case we don't set the UGID (because that's how the user manager
+		// differentiates between local and remote groups).
+		if strings.HasPrefix(groupName, localGroupPrefix) {
+			groups = append(groups, info.Group{Name: strings.TrimPrefix(groupName, localGroupPrefix)})
+			continue
+		}
+
+		groups = append(groups, info.Group{Name: groupName, UGID: groupName})
+	}
+	return groups, nil
+}
+
+// commonName returns the value of the first attribute of the DN if it is its common name, e.g. Admins for
+// CN=Admins,OU=Groups,DC=example,DC=com, or else the name itself.
+func commonName(name string) string {
+	attr, rest, ok := strings.Cut(name, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(attr), "cn") {
+		return name
+	}
+
+	var cn strings.Builder
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case '\\':
+			// The special characters of the values, like the commas, are escaped by a backslash.
+			if i+1 < len(rest) {
+				i++
+				cn.WriteByte(rest[i])
+			}
+			continue
+		case ',', '+':
+			return strings.TrimSpace(cn.String())
+		}
+		cn.WriteByte(rest[i])
+	}
+	return strings.TrimSpace(cn.String())
+}
@@ -0,0 +1,143 @@
+package ping_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
+	"github.com/ubuntu/authd-oidc-brokers/internal/providers/ping"
+	"golang.org/x/oauth2"
+)
+
+var signingKey = func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("could not generate signing key: %v", err))
+	}
+	return key
+}()
+
+func TestAdditionalScopes(t *testing.T) {
+	t.Parallel()
+
+	p := ping.New("")
+
+	require.Equal(t, []string{oidc.ScopeOpenID, "profile", "email"}, p.AdditionalScopes(),
+		"Ping provider should not request offline access, which PingFederate may reject")
+}
+
+func TestGetUserInfo(t *testing.T) {
+	t.Parallel()
+
+	// The claims are the ones of an ID token issued by PingFederate, with the groups of the memberOf LDAP attribute.
+	data, err := os.ReadFile(filepath.Join("testdata", "pingfederate_id_token.json"))
+	require.NoError(t, err, "Setup: Failed to read the ID token claims")
+	var claims jwt.MapClaims
+	require.NoError(t, json.Unmarshal(data, &claims), "Setup: Failed to parse the ID token claims")
+	idToken := newIDToken(t, claims)
+
+	got, err := ping.New("").GetUserInfo(context.Background(), &oauth2.Token{AccessToken: "accesstoken"}, idToken)
+	require.NoError(t, err, "GetUserInfo should not return an error")
+
+	want := info.NewUser("jane.doe@example.com", "", "3d2b6f0e-8b51-4f6c-9a4a-6b1f1c7e2d90", "", "", []info.Group{
+		{Name: "engineering", UGID: "engineering"},
+		{Name: "doe, jane - reports", UGID: "doe, jane - reports"},
+		{Name: "sudo"},
+	})
+	require.Equal(t, want, got, "GetUserInfo should return the user of the ID token, with the groups of the memberOf claim")
+}
+
+func TestGetGroups(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		groupsClaim string
+		claims      map[string]any
+
+		wantGroups []info.Group
+		wantErr    bool
+	}{
+		"Successfully_get_groups_from_names": {
+			claims:     map[string]any{"memberOf": []string{"Group1", "Group2"}},
+			wantGroups: []info.Group{{Name: "group1", UGID: "group1"}, {Name: "group2", UGID: "group2"}},
+		},
+		"Successfully_get_groups_from_DNs": {
+			claims:     map[string]any{"memberOf": []string{"CN=Group1,OU=Groups,DC=example,DC=com", "cn = Group2 ,DC=example"}},
+			wantGroups: []info.Group{{Name: "group1", UGID: "group1"}, {Name: "group2", UGID: "group2"}},
+		},
+		"Successfully_get_groups_from_DNs_with_escaped_characters": {
+			claims:     map[string]any{"memberOf": []string{`CN=Group\,1\+2,OU=Groups,DC=example,DC=com`}},
+			wantGroups: []info.Group{{Name: "group,1+2", UGID: "group,1+2"}},
+		},
+		"Successfully_get_group_named_after_DN_without_CN": {
+			claims:     map[string]any{"memberOf": []string{"OU=Group1,DC=example,DC=com"}},
+			wantGroups: []info.Group{{Name: "ou=group1,dc=example,dc=com", UGID: "ou=group1,dc=example,dc=com"}},
+		},
+		"Successfully_get_group_from_single_value_claim": {
+			claims:     map[string]any{"memberOf": "CN=Group1,OU=Groups,DC=example,DC=com"},
+			wantGroups: []info.Group{{Name: "group1", UGID: "group1"}},
+		},
+		"Successfully_get_groups_from_custom_claim": {
+			groupsClaim: "groups",
+			claims:      map[string]any{"groups": []string{"Group1"}, "memberOf": []string{"Ignored"}},
+			wantGroups:  []info.Group{{Name: "group1", UGID: "group1"}},
+		},
+		"Successfully_get_local_groups_without_UGID": {
+			claims:     map[string]any{"memberOf": []string{"CN=linux-sudo,OU=Groups,DC=example,DC=com"}},
+			wantGroups: []info.Group{{Name: "sudo"}},
+		},
+		"Successfully_get_no_groups_if_claim_is_absent": {},
+		"Successfully_get_no_groups_from_empty_claim": {
+			claims: map[string]any{"memberOf": []string{}},
+		},
+
+		"Error_when_claim_is_not_a_list_of_strings": {claims: map[string]any{"memberOf": []int{1}}, wantErr: true},
+		"Error_when_claim_has_an_empty_group_name":  {claims: map[string]any{"memberOf": []string{""}}, wantErr: true},
+		"Error_when_DN_has_an_empty_common_name":    {claims: map[string]any{"memberOf": []string{"CN=,DC=example"}}, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			claims := jwt.MapClaims{"iss": "https://sso.example.com", "sub": "user-id", "aud": "client-id", "email": "user@example.com"}
+			for k, v := range tc.claims {
+				claims[k] = v
+			}
+
+			got, err := ping.New(tc.groupsClaim).GetGroups(newIDToken(t, claims))
+			if tc.wantErr {
+				require.Error(t, err, "GetGroups should return an error")
+				return
+			}
+			require.NoError(t, err, "GetGroups should not return an error")
+			require.Equal(t, tc.wantGroups, got, "GetGroups should return the expected groups")
+		})
+	}
+}
+
+// newIDToken returns a verified ID token with the given claims, which must include the issuer.
+func newIDToken(t *testing.T, claims jwt.MapClaims) *oidc.IDToken {
+	t.Helper()
+
+	rawIDToken, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(signingKey)
+	require.NoError(t, err, "Setup: Signing the ID token should not fail")
+
+	issuer, err := claims.GetIssuer()
+	require.NoError(t, err, "Setup: The ID token should have an issuer")
+	keySet := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&signingKey.PublicKey}}
+	verifier := oidc.NewVerifier(issuer, keySet, &oidc.Config{SkipClientIDCheck: true, SkipExpiryCheck: true})
+	idToken, err := verifier.Verify(context.Background(), rawIDToken)
+	require.NoError(t, err, "Setup: Verifying the ID token should not fail")
+
+	return idToken
+}
@@ -9,6 +9,46 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// Types of the providers which can be selected in the configuration, when the broker is not built for a single
+// provider.
+const (
+	// TypeGeneric is the generic OIDC provider.
+	TypeGeneric = "generic"
+	// TypeOkta is the Okta provider.
+	TypeOkta = "okta"
+	// TypeGitLab is the GitLab provider.
+	TypeGitLab = "gitlab"
+	// TypePing is the Ping Identity provider, for PingFederate and PingOne.
+	TypePing = "ping"
+	// TypeGoogle is the Google provider.
+	TypeGoogle = "google"
+	// TypeMsEntraID is the Microsoft Entra ID provider, which is only built in the broker built for it.
+	TypeMsEntraID = "msentraid"
+)
+
+// Types returns the types of the providers which can be selected in the configuration. The ones which are not built in
+// the broker are listed too, and BuildTag tells how to build them.
+func Types() []string {
+	return []string{TypeGeneric, TypeOkta, TypeGitLab, TypePing, TypeGoogle, TypeMsEntraID}
+}
+
+// Settings are the provider-specific settings of the broker configuration.
+type Settings struct {
+	// Type is the provider to use, or empty to select it from the issuer.
+	Type string
+	// GroupsClaim is the claim of the ID token listing the groups of the Okta users.
+	GroupsClaim string
+	// GitLabFullGroupPaths names the GitLab groups after their full path instead of the last component of the path.
+	GitLabFullGroupPaths bool
+	// PingGroupsClaim is the claim of the ID token listing the groups of the Ping Identity users.
+	PingGroupsClaim string
+	// GoogleDirectoryGroups fetches the groups of the Google users from the Admin SDK Directory API.
+	GoogleDirectoryGroups bool
+	// NestedGroupsMaxDepth is how many levels of parent groups are followed to get the groups the user is a member of
+	// through other groups, for the providers which support it, or 0 to only get the direct memberships.
+	NestedGroupsMaxDepth int
+}
+
 // Provider defines provider-specific methods to be used by the broker.
 type Provider interface {
 	AdditionalScopes() []string
@@ -27,3 +67,14 @@ type Provider interface {
 	NormalizeUsername(username string) string
 	VerifyUsername(requestedUsername, authenticatedUsername string) error
 }
+
+// WebAuthnProvider is implemented by the providers which support passwordless authentication with a WebAuthn
+// credential, like a FIDO2 security key or a passkey.
+type WebAuthnProvider interface {
+	// WebAuthnChallenge returns the assertion request (the JSON encoded PublicKeyCredentialRequestOptions) to sign with
+	// the credential of the user.
+	WebAuthnChallenge(ctx context.Context, oauth2Config oauth2.Config, username string) (string, error)
+	// VerifyWebAuthnAssertion verifies the assertion signed for the challenge and returns the token of the user, which
+	// must contain an ID token.
+	VerifyWebAuthnAssertion(ctx context.Context, oauth2Config oauth2.Config, challenge, assertion string) (*oauth2.Token, error)
+}
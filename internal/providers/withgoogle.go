@@ -8,3 +8,14 @@ import "github.com/ubuntu/authd-oidc-brokers/internal/providers/google"
 func CurrentProvider() Provider {
 	return google.New()
 }
+
+// BuildTag returns the build tag the broker must be built with to use the provider type, and true if the provider is not
+// built in this broker. The broker built for a single provider ignores the configured type, so none is missing.
+func BuildTag(_ string) (string, bool) {
+	return "", false
+}
+
+// ForIssuer returns the Google provider implementation, whatever the issuer is.
+func ForIssuer(_ string, s Settings) Provider {
+	return google.New().WithDirectoryGroups(s.GoogleDirectoryGroups).WithNestedGroups(s.NestedGroupsMaxDepth)
+}
@@ -10,3 +10,14 @@ import (
 func CurrentProvider() Provider {
 	return msentraid.New()
 }
+
+// BuildTag returns the build tag the broker must be built with to use the provider type, and true if the provider is not
+// built in this broker. The broker built for a single provider ignores the configured type, so none is missing.
+func BuildTag(_ string) (string, bool) {
+	return "", false
+}
+
+// ForIssuer returns the Microsoft Entra ID provider implementation, whatever the issuer is.
+func ForIssuer(_ string, _ Settings) Provider {
+	return CurrentProvider()
+}
@@ -0,0 +1,15 @@
+package golden
+
+import "testing"
+
+// ColorizeDiff exposes colorizeDiff for tests.
+func ColorizeDiff(t *testing.T, diff string) string {
+	t.Helper()
+
+	return colorizeDiff(t, diff)
+}
+
+// BytesMismatch exposes bytesMismatch for tests.
+func BytesMismatch(expected, actual []byte) string {
+	return bytesMismatch(expected, actual)
+}
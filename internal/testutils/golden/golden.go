@@ -3,12 +3,15 @@ package golden
 
 import (
 	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
@@ -25,8 +28,14 @@ const (
 	// UpdateGoldenFilesEnv is the environment variable used to indicate go test that
 	// the golden files should be overwritten with the current test results.
 	UpdateGoldenFilesEnv = `TESTS_UPDATE_GOLDEN`
+	// DiffCommandEnv is the environment variable overriding the command, with its arguments separated by spaces, which
+	// colorizes the unified diff of the golden files mismatches.
+	DiffCommandEnv = `TESTS_DIFF_CMD`
 )
 
+// defaultDiffCommand is the command colorizing the diffs if DiffCommandEnv is not set.
+var defaultDiffCommand = []string{"delta", "--diff-so-fancy", "--hunk-header-style", "omit"}
+
 func init() {
 	if os.Getenv(UpdateGoldenFilesEnv) != "" {
 		update = true
@@ -34,7 +43,8 @@ func init() {
 }
 
 type config struct {
-	path string
+	path          string
+	ignoreRegexps []*regexp.Regexp
 }
 
 // Option is a supported option reference to change the golden files comparison.
@@ -49,6 +59,26 @@ func WithPath(path string) Option {
 	}
 }
 
+// ignoredPlaceholder replaces the substrings matching the regexps of WithIgnoreRegexps before comparing the content.
+const ignoredPlaceholder = "<ignored>"
+
+// WithIgnoreRegexps masks the substrings matching any of the regexps, in both the actual and the golden content, before
+// comparing them, e.g. for timestamps or generated IDs which change every run. The golden files are still updated
+// with the actual content.
+func WithIgnoreRegexps(regexps ...*regexp.Regexp) Option {
+	return func(cfg *config) {
+		cfg.ignoreRegexps = append(cfg.ignoreRegexps, regexps...)
+	}
+}
+
+// mask returns the content with the substrings matching the ignored regexps replaced by a placeholder.
+func (cfg config) mask(content string) string {
+	for _, re := range cfg.ignoreRegexps {
+		content = re.ReplaceAllLiteralString(content, ignoredPlaceholder)
+	}
+	return content
+}
+
 func updateGoldenFile(t *testing.T, path string, data []byte) {
 	t.Helper()
 
@@ -76,18 +106,145 @@ func CheckOrUpdate(t *testing.T, got string, options ...Option) {
 		updateGoldenFile(t, cfg.path, []byte(got))
 	}
 
-	checkGoldenFileEqualsString(t, got, cfg.path)
+	checkGoldenFileEqualsString(t, cfg, got)
+}
+
+// CheckOrUpdateBytes compares the provided bytes with the content of the golden file, byte for byte, e.g. for binary
+// content like images. If the update environment variable is set, the golden file is updated with the provided bytes.
+func CheckOrUpdateBytes(t *testing.T, got []byte, options ...Option) {
+	t.Helper()
+
+	cfg := config{}
+	for _, f := range options {
+		f(&cfg)
+	}
+	if !filepath.IsAbs(cfg.path) {
+		cfg.path = filepath.Join(Path(t), cfg.path)
+	}
+
+	if update {
+		updateGoldenFile(t, cfg.path, got)
+	}
+
+	goldenContent, err := os.ReadFile(cfg.path)
+	require.NoError(t, err, "Cannot read golden file %s", cfg.path)
+
+	if bytes.Equal(got, goldenContent) {
+		return
+	}
+	require.Failf(t, "Golden file content mismatch", "Golden file: %s\n%s", cfg.path, bytesMismatch(goldenContent, got))
 }
 
-// CheckOrUpdateYAML compares the provided object with the content of the golden file. If the update environment
-// variable is set, the golden file is updated with the provided object serialized as YAML.
+// bytesMismatchContext is how many bytes are dumped before and after the first differing byte.
+const bytesMismatchContext = 32
+
+// bytesMismatch describes where the actual bytes first differ from the expected ones, with a hex dump of both around
+// that offset, as a text diff of binary content is not readable.
+func bytesMismatch(expected, actual []byte) string {
+	offset := 0
+	for offset < len(expected) && offset < len(actual) && expected[offset] == actual[offset] {
+		offset++
+	}
+
+	// Dump whole lines of 16 bytes, so that the offsets of the dumps are aligned.
+	start := max(offset-bytesMismatchContext, 0) &^ 0xf
+	dump := func(data []byte) string {
+		end := min(offset+bytesMismatchContext, len(data))
+		if start >= end {
+			return "(no bytes)\n"
+		}
+		var b strings.Builder
+		for _, line := range strings.SplitAfter(hex.Dump(data[start:end]), "\n") {
+			if line == "" {
+				continue
+			}
+			// hex.Dump numbers the lines from 0, so shift them to the offsets in the data.
+			lineOffset, err := strconv.ParseInt(line[:8], 16, 64)
+			if err != nil {
+				b.WriteString(line)
+				continue
+			}
+			fmt.Fprintf(&b, "%08x%s", int64(start)+lineOffset, line[8:])
+		}
+		return b.String()
+	}
+
+	return fmt.Sprintf("First difference at offset %d (0x%x): expected %d bytes, got %d bytes\n"+
+		"\nExpected (golden):\n%s\nActual:\n%s",
+		offset, offset, len(expected), len(actual), dump(expected), dump(actual))
+}
+
+// CheckNoGolden checks that there is no golden file, or that it is empty, for the cases which are expected to produce
+// no output. If the update environment variable is set, the golden file is removed instead.
+func CheckNoGolden(t *testing.T, options ...Option) {
+	t.Helper()
+
+	cfg := config{}
+	for _, f := range options {
+		f(&cfg)
+	}
+	if !filepath.IsAbs(cfg.path) {
+		cfg.path = filepath.Join(Path(t), cfg.path)
+	}
+
+	if update {
+		t.Logf("removing golden file %s", cfg.path)
+		err := os.Remove(cfg.path)
+		if !errors.Is(err, fs.ErrNotExist) {
+			require.NoError(t, err, "Cannot remove golden file")
+		}
+		return
+	}
+
+	fi, err := os.Stat(cfg.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	require.NoError(t, err, "Cannot get golden file %s", cfg.path)
+	require.False(t, fi.IsDir(), "Golden path %s should not be a directory", cfg.path)
+	require.Zero(t, fi.Size(), "Golden file %s should not exist, as no output is expected", cfg.path)
+}
+
+// CheckOrUpdateYAML compares the provided object with the content of the golden file as YAML, once the anchors, aliases
+// and merge keys of the golden file are resolved. If the update environment variable is set, the golden file is
+// updated with the provided object serialized as YAML.
 func CheckOrUpdateYAML[E any](t *testing.T, got E, options ...Option) {
 	t.Helper()
 
 	data, err := yaml.Marshal(got)
 	require.NoError(t, err, "Cannot serialize provided object")
 
-	CheckOrUpdate(t, string(data), options...)
+	cfg := config{}
+	for _, f := range options {
+		f(&cfg)
+	}
+	if !filepath.IsAbs(cfg.path) {
+		cfg.path = filepath.Join(Path(t), cfg.path)
+	}
+
+	if update {
+		updateGoldenFile(t, cfg.path, data)
+	}
+
+	goldenContent, err := os.ReadFile(cfg.path)
+	require.NoError(t, err, "Cannot read golden file %s", cfg.path)
+
+	checkFileContent(t, cfg.mask(normalizeYAML(t, data)), cfg.mask(normalizeYAML(t, goldenContent)), "Actual", cfg.path)
+}
+
+// normalizeYAML returns the YAML document with its anchors, aliases and merge keys resolved, and the keys of all its
+// mappings sorted, so that semantically equal documents are identical.
+func normalizeYAML(t *testing.T, data []byte) string {
+	t.Helper()
+
+	var v any
+	err := yaml.Unmarshal(data, &v)
+	require.NoError(t, err, "Cannot parse YAML document")
+
+	normalized, err := yaml.Marshal(v)
+	require.NoError(t, err, "Cannot serialize YAML document")
+
+	return string(normalized)
 }
 
 // LoadWithUpdate loads the element from a plaintext golden file.
@@ -130,6 +287,69 @@ func LoadWithUpdateYAML[E any](t *testing.T, got E, options ...Option) E {
 	return wantDeserialized
 }
 
+// CheckOrUpdateJSON compares the provided object with the content of the golden file as JSON, regardless of the order
+// of the keys. If the update environment variable is set, the golden file is updated with the provided object
+// serialized as indented JSON with sorted keys.
+func CheckOrUpdateJSON[E any](t *testing.T, got E, options ...Option) {
+	t.Helper()
+
+	data, err := json.Marshal(got)
+	require.NoError(t, err, "Cannot serialize provided object")
+
+	cfg := config{}
+	for _, f := range options {
+		f(&cfg)
+	}
+	if !filepath.IsAbs(cfg.path) {
+		cfg.path = filepath.Join(Path(t), cfg.path)
+	}
+
+	gotNormalized := normalizeJSON(t, data)
+	if update {
+		updateGoldenFile(t, cfg.path, []byte(gotNormalized))
+	}
+
+	goldenContent, err := os.ReadFile(cfg.path)
+	require.NoError(t, err, "Cannot read golden file %s", cfg.path)
+
+	checkFileContent(t, cfg.mask(gotNormalized), cfg.mask(normalizeJSON(t, goldenContent)), "Actual", cfg.path)
+}
+
+// LoadWithUpdateJSON load the generic element from a JSON serialized golden file.
+// It will update the file if the update flag is used prior to deserializing it.
+func LoadWithUpdateJSON[E any](t *testing.T, got E, options ...Option) E {
+	t.Helper()
+
+	t.Logf("Serializing object for golden file")
+	data, err := json.Marshal(got)
+	require.NoError(t, err, "Cannot serialize provided object")
+	want := LoadWithUpdate(t, normalizeJSON(t, data), options...)
+
+	var wantDeserialized E
+	err = json.Unmarshal([]byte(want), &wantDeserialized)
+	require.NoError(t, err, "Cannot deserialize object from golden file")
+
+	return wantDeserialized
+}
+
+// normalizeJSON returns the JSON document indented and with the keys of all its objects sorted, so that semantically
+// equal documents are identical.
+func normalizeJSON(t *testing.T, data []byte) string {
+	t.Helper()
+
+	// Keep the numbers as they are written instead of converting them to float64.
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v any
+	err := d.Decode(&v)
+	require.NoError(t, err, "Cannot parse JSON document")
+
+	normalized, err := json.MarshalIndent(v, "", "  ")
+	require.NoError(t, err, "Cannot serialize JSON document")
+
+	return string(normalized) + "\n"
+}
+
 // CheckValidGoldenFileName checks if the provided name is a valid golden file name.
 func CheckValidGoldenFileName(t *testing.T, name string) {
 	t.Helper()
@@ -139,29 +359,33 @@ func CheckValidGoldenFileName(t *testing.T, name string) {
 		"Invalid golden file name %q. Only alphanumeric characters, underscores, dashes, and dots are allowed", name)
 }
 
-// Path returns the golden path for the provided test.
+// Path returns the golden path for the provided test. The nested subtests get a directory per level, e.g.
+// testdata/golden/TestX/a/b/c for TestX/a/b/c.
 func Path(t *testing.T) string {
 	t.Helper()
 
 	cwd, err := os.Getwd()
 	require.NoError(t, err, "Cannot get current working directory")
 
-	topLevelTest, subtest, subtestFound := strings.Cut(t.Name(), "/")
-	CheckValidGoldenFileName(t, topLevelTest)
-
-	path := filepath.Join(cwd, "testdata", "golden", topLevelTest)
-
-	if !subtestFound {
-		return path
+	path := filepath.Join(cwd, "testdata", "golden")
+	for _, name := range strings.Split(t.Name(), "/") {
+		CheckValidGoldenFileName(t, name)
+		path = filepath.Join(path, name)
 	}
+	return path
+}
 
-	CheckValidGoldenFileName(t, subtest)
-	return filepath.Join(path, subtest)
+// diffCommand returns the command colorizing the diffs, with its arguments.
+func diffCommand() []string {
+	if args := strings.Fields(os.Getenv(DiffCommandEnv)); len(args) > 0 {
+		return args
+	}
+	return defaultDiffCommand
 }
 
-// runDelta pipes the unified diff through the `delta` command for word-level diff and coloring.
-func runDelta(diff string) (string, error) {
-	cmd := exec.Command("delta", "--diff-so-fancy", "--hunk-header-style", "omit")
+// runDiffCommand pipes the unified diff through the diff command, e.g. `delta` for word-level diff and coloring.
+func runDiffCommand(args []string, diff string) (string, error) {
+	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdin = strings.NewReader(diff)
 
 	var out bytes.Buffer
@@ -170,11 +394,28 @@ func runDelta(diff string) (string, error) {
 
 	err := cmd.Run()
 	if err != nil {
-		return "", fmt.Errorf("failed to run delta: %w", err)
+		return "", fmt.Errorf("failed to run %s: %w", args[0], err)
 	}
 	return out.String(), nil
 }
 
+// colorizeDiff returns the diff colorized by the diff command, or the plain diff if the command is missing or fails.
+func colorizeDiff(t *testing.T, diff string) string {
+	t.Helper()
+
+	args := diffCommand()
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return "\nDiff:\n" + diff
+	}
+
+	colorized, err := runDiffCommand(args, diff)
+	if err != nil {
+		t.Logf("Showing the plain diff: %v", err)
+		return "\nDiff:\n" + diff
+	}
+	return colorized
+}
+
 // checkFileContent compares the content of the actual and golden files and reports any differences.
 func checkFileContent(t *testing.T, actual, expected, actualPath, expectedPath string) {
 	t.Helper()
@@ -193,14 +434,7 @@ func checkFileContent(t *testing.T, actual, expected, actualPath, expectedPath s
 	diffStr, err := difflib.GetUnifiedDiffString(diff)
 	require.NoError(t, err, "Cannot get unified diff")
 
-	// Check if the `delta` command is available and use it to colorize the diff.
-	_, err = exec.LookPath("delta")
-	if err == nil {
-		diffStr, err = runDelta(diffStr)
-		require.NoError(t, err, "Cannot run delta")
-	} else {
-		diffStr = "\nDiff:\n" + diffStr
-	}
+	diffStr = colorizeDiff(t, diffStr)
 
 	msg := fmt.Sprintf("Golden file: %s", expectedPath)
 	if actualPath != "Actual" {
@@ -221,7 +455,7 @@ func checkFileContent(t *testing.T, actual, expected, actualPath, expectedPath s
 	}, "\n"), msg)
 }
 
-func checkGoldenFileEqualsFile(t *testing.T, path, goldenPath string) {
+func checkGoldenFileEqualsFile(t *testing.T, cfg config, path, goldenPath string) {
 	t.Helper()
 
 	fileContent, err := os.ReadFile(path)
@@ -229,16 +463,16 @@ func checkGoldenFileEqualsFile(t *testing.T, path, goldenPath string) {
 	goldenContent, err := os.ReadFile(goldenPath)
 	require.NoError(t, err, "Cannot read golden file %s", goldenPath)
 
-	checkFileContent(t, string(fileContent), string(goldenContent), path, goldenPath)
+	checkFileContent(t, cfg.mask(string(fileContent)), cfg.mask(string(goldenContent)), path, goldenPath)
 }
 
-func checkGoldenFileEqualsString(t *testing.T, got, goldenPath string) {
+func checkGoldenFileEqualsString(t *testing.T, cfg config, got string) {
 	t.Helper()
 
-	goldenContent, err := os.ReadFile(goldenPath)
-	require.NoError(t, err, "Cannot read golden file %s", goldenPath)
+	goldenContent, err := os.ReadFile(cfg.path)
+	require.NoError(t, err, "Cannot read golden file %s", cfg.path)
 
-	checkFileContent(t, got, string(goldenContent), "Actual", goldenPath)
+	checkFileContent(t, cfg.mask(got), cfg.mask(string(goldenContent)), "Actual", cfg.path)
 }
 
 // CheckOrUpdateFileTree allows comparing a goldPath directory to p. Those can be updated via the dedicated flag.
@@ -309,7 +543,7 @@ func CheckOrUpdateFileTree(t *testing.T, path string, options ...Option) {
 		require.Equal(t, a, b, "Executable bit does not match.\nFile: %s\nGolden file: %s", p, goldenFilePath)
 
 		// Compare content
-		checkGoldenFileEqualsFile(t, p, goldenFilePath)
+		checkGoldenFileEqualsFile(t, cfg, p, goldenFilePath)
 
 		return nil
 	})
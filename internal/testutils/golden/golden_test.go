@@ -0,0 +1,349 @@
+package golden_test
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/testutils/golden"
+)
+
+type group struct {
+	UGID string `json:"ugid"`
+	Name string `json:"name"`
+}
+
+func TestCheckOrUpdateJSON(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		golden string
+		got    any
+	}{
+		"Matches_golden_file_with_the_same_key_order": {
+			golden: `{"name": "group1", "ugid": "12345"}`,
+			got:    group{Name: "group1", UGID: "12345"},
+		},
+		"Matches_golden_file_with_another_key_order": {
+			golden: `{"ugid": "12345", "name": "group1"}`,
+			got:    map[string]any{"name": "group1", "ugid": "12345"},
+		},
+		"Matches_golden_file_with_another_indentation": {
+			golden: "[\n\t{\"ugid\": \"12345\",\n\t\"name\": \"group1\"}\n]",
+			got:    []group{{Name: "group1", UGID: "12345"}},
+		},
+		"Matches_golden_file_with_large_numbers": {
+			golden: `{"exp": 9999999999999999}`,
+			got:    map[string]any{"exp": 9999999999999999},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			goldenPath := filepath.Join(t.TempDir(), "golden.json")
+			err := os.WriteFile(goldenPath, []byte(tc.golden), 0600)
+			require.NoError(t, err, "Setup: could not write golden file")
+
+			golden.CheckOrUpdateJSON(t, tc.got, golden.WithPath(goldenPath))
+		})
+	}
+}
+
+type user struct {
+	Name  string `yaml:"name,omitempty"`
+	Shell string `yaml:"shell"`
+	Home  string `yaml:"home"`
+}
+
+type users struct {
+	Defaults user   `yaml:"defaults"`
+	Users    []user `yaml:"users"`
+}
+
+// yamlWithAnchors describes two users sharing their defaults through an anchor and merge keys.
+const yamlWithAnchors = `defaults: &defaults
+  shell: /bin/bash
+  home: /home/shared
+users:
+  - <<: *defaults
+    name: user1
+  - <<: *defaults
+    name: user2
+    home: /home/user2
+`
+
+var usersWithDefaults = users{
+	Defaults: user{Shell: "/bin/bash", Home: "/home/shared"},
+	Users: []user{
+		{Name: "user1", Shell: "/bin/bash", Home: "/home/shared"},
+		{Name: "user2", Shell: "/bin/bash", Home: "/home/user2"},
+	},
+}
+
+func TestCheckOrUpdateYAML(t *testing.T) {
+	t.Parallel()
+
+	if golden.UpdateEnabled() {
+		t.Skip("The golden file would be replaced by the object")
+	}
+
+	tests := map[string]struct {
+		golden string
+	}{
+		"Matches_golden_file_with_the_same_serialization": {
+			golden: `defaults:
+  shell: /bin/bash
+  home: /home/shared
+users:
+  - name: user1
+    shell: /bin/bash
+    home: /home/shared
+  - name: user2
+    shell: /bin/bash
+    home: /home/user2
+`,
+		},
+		"Matches_golden_file_with_another_key_order": {
+			golden: `users:
+  - home: /home/shared
+    name: user1
+    shell: /bin/bash
+  - home: /home/user2
+    name: user2
+    shell: /bin/bash
+defaults:
+  home: /home/shared
+  shell: /bin/bash
+`,
+		},
+		"Matches_golden_file_with_anchors_and_merge_keys": {golden: yamlWithAnchors},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			goldenPath := filepath.Join(t.TempDir(), "golden.yaml")
+			err := os.WriteFile(goldenPath, []byte(tc.golden), 0600)
+			require.NoError(t, err, "Setup: could not write golden file")
+
+			golden.CheckOrUpdateYAML(t, usersWithDefaults, golden.WithPath(goldenPath))
+		})
+	}
+}
+
+func TestLoadWithUpdateYAML(t *testing.T) {
+	t.Parallel()
+
+	if golden.UpdateEnabled() {
+		t.Skip("The golden file would be replaced by the object")
+	}
+
+	goldenPath := filepath.Join(t.TempDir(), "golden.yaml")
+	err := os.WriteFile(goldenPath, []byte(yamlWithAnchors), 0600)
+	require.NoError(t, err, "Setup: could not write golden file")
+
+	got := golden.LoadWithUpdateYAML(t, users{}, golden.WithPath(goldenPath))
+
+	require.Equal(t, usersWithDefaults, got, "LoadWithUpdateYAML should resolve the anchors and merge keys of the golden file")
+}
+
+func TestCheckOrUpdateWithIgnoreRegexps(t *testing.T) {
+	t.Parallel()
+
+	if golden.UpdateEnabled() {
+		t.Skip("The golden file would be replaced by the content")
+	}
+
+	sessionID := regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+	expiresIn := regexp.MustCompile(`"expires_in": ?\d+`)
+
+	tests := map[string]struct {
+		golden  string
+		got     string
+		regexps []*regexp.Regexp
+	}{
+		"Matches_golden_file_with_another_generated_ID": {
+			golden:  "session: 2f1b5e4c-8d3a-4c6e-9f0b-1a2b3c4d5e6f\n",
+			got:     "session: 7c9d0e1f-2a3b-4c5d-8e6f-0a1b2c3d4e5f\n",
+			regexps: []*regexp.Regexp{sessionID},
+		},
+		"Matches_golden_file_with_several_volatile_fields": {
+			golden:  `{"session": "2f1b5e4c-8d3a-4c6e-9f0b-1a2b3c4d5e6f", "expires_in": 3600}`,
+			got:     `{"session": "7c9d0e1f-2a3b-4c5d-8e6f-0a1b2c3d4e5f", "expires_in": 3599}`,
+			regexps: []*regexp.Regexp{sessionID, expiresIn},
+		},
+		"Matches_golden_file_with_the_placeholder": {
+			golden:  "session: <ignored>\n",
+			got:     "session: 7c9d0e1f-2a3b-4c5d-8e6f-0a1b2c3d4e5f\n",
+			regexps: []*regexp.Regexp{sessionID},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			goldenPath := filepath.Join(t.TempDir(), "golden")
+			err := os.WriteFile(goldenPath, []byte(tc.golden), 0600)
+			require.NoError(t, err, "Setup: could not write golden file")
+
+			golden.CheckOrUpdate(t, tc.got, golden.WithPath(goldenPath), golden.WithIgnoreRegexps(tc.regexps...))
+		})
+	}
+}
+
+func TestCheckOrUpdateBytes(t *testing.T) {
+	t.Parallel()
+
+	if golden.UpdateEnabled() {
+		t.Skip("The golden file would be replaced by the bytes")
+	}
+
+	// Not valid UTF-8, like most binary content.
+	content := []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0xff, 0xfe}
+	goldenPath := filepath.Join(t.TempDir(), "golden.bin")
+	err := os.WriteFile(goldenPath, content, 0600)
+	require.NoError(t, err, "Setup: could not write golden file")
+
+	golden.CheckOrUpdateBytes(t, content, golden.WithPath(goldenPath))
+}
+
+func TestCheckNoGolden(t *testing.T) {
+	t.Parallel()
+
+	if golden.UpdateEnabled() {
+		t.Skip("The golden file would be removed")
+	}
+
+	tests := map[string]struct {
+		emptyGolden bool
+	}{
+		"Passes_if_golden_file_does_not_exist": {},
+		"Passes_if_golden_file_is_empty":       {emptyGolden: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			goldenPath := filepath.Join(t.TempDir(), "golden")
+			if tc.emptyGolden {
+				err := os.WriteFile(goldenPath, nil, 0600)
+				require.NoError(t, err, "Setup: could not write golden file")
+			}
+
+			golden.CheckNoGolden(t, golden.WithPath(goldenPath))
+		})
+	}
+}
+
+func TestBytesMismatch(t *testing.T) {
+	t.Parallel()
+
+	expected := make([]byte, 100)
+	for i := range expected {
+		expected[i] = byte(i)
+	}
+
+	tests := map[string]struct {
+		actual []byte
+
+		wantOffset string
+		wantDump   []string
+	}{
+		"Reports_the_first_differing_byte": {
+			actual:     append(append([]byte{}, expected[:70]...), 0xff),
+			wantOffset: "First difference at offset 70 (0x46): expected 100 bytes, got 71 bytes",
+			wantDump:   []string{"00000020  20 21", "00000040  40 41 42 43 44 45 ff"},
+		},
+		"Reports_the_end_of_the_shorter_content": {
+			actual:     expected[:10],
+			wantOffset: "First difference at offset 10 (0xa): expected 100 bytes, got 10 bytes",
+			wantDump:   []string{"00000000  00 01 02 03 04 05 06 07  08 09  "},
+		},
+		"Reports_empty_content": {
+			actual:     []byte{},
+			wantOffset: "First difference at offset 0 (0x0): expected 100 bytes, got 0 bytes",
+			wantDump:   []string{"(no bytes)"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got := golden.BytesMismatch(expected, tc.actual)
+
+			require.Contains(t, got, tc.wantOffset, "BytesMismatch should report where the content differs")
+			for _, d := range tc.wantDump {
+				require.Contains(t, got, d, "BytesMismatch should dump the content around the difference")
+			}
+		})
+	}
+}
+
+func TestPath(t *testing.T) {
+	t.Parallel()
+
+	cwd, err := os.Getwd()
+	require.NoError(t, err, "Setup: could not get current working directory")
+	goldenDir := filepath.Join(cwd, "testdata", "golden", "TestPath")
+
+	require.Equal(t, goldenDir, golden.Path(t), "Path should be named after the test")
+
+	t.Run("Subtest", func(t *testing.T) {
+		t.Parallel()
+
+		require.Equal(t, filepath.Join(goldenDir, "Subtest"), golden.Path(t), "Path should be named after the subtest")
+
+		t.Run("Nested_subtest", func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, filepath.Join(goldenDir, "Subtest", "Nested_subtest"), golden.Path(t),
+				"Path should have a directory per level of subtest")
+		})
+	})
+}
+
+func TestLoadWithUpdateJSON(t *testing.T) {
+	t.Parallel()
+
+	if golden.UpdateEnabled() {
+		t.Skip("The golden file would be replaced by the object")
+	}
+
+	goldenPath := filepath.Join(t.TempDir(), "golden.json")
+	err := os.WriteFile(goldenPath, []byte(`[{"ugid": "12345", "name": "group1"}]`), 0600)
+	require.NoError(t, err, "Setup: could not write golden file")
+
+	got := golden.LoadWithUpdateJSON(t, []group{{Name: "other"}}, golden.WithPath(goldenPath))
+
+	require.Equal(t, []group{{Name: "group1", UGID: "12345"}}, got, "LoadWithUpdateJSON should return the object of the golden file")
+}
+
+func TestColorizeDiff(t *testing.T) {
+	const diff = "-old\n+new\n"
+
+	tests := map[string]struct {
+		diffCommand string
+
+		want string
+	}{
+		"Diff_is_piped_through_the_configured_command": {diffCommand: "cat", want: diff},
+		"Diff_is_piped_through_the_configured_command_with_its_arguments": {
+			diffCommand: "sed -e s/new/colorized/", want: "-old\n+colorized\n",
+		},
+
+		"Plain_diff_is_returned_if_the_command_is_missing": {diffCommand: "does-not-exist --color", want: "\nDiff:\n" + diff},
+		"Plain_diff_is_returned_if_the_command_fails":      {diffCommand: "false", want: "\nDiff:\n" + diff},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(golden.DiffCommandEnv, tc.diffCommand)
+
+			got := golden.ColorizeDiff(t, diff)
+
+			require.Equal(t, tc.want, got, "ColorizeDiff should return the expected diff")
+		})
+	}
+}
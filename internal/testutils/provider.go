@@ -21,6 +21,7 @@ import (
 	"github.com/go-jose/go-jose/v4"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/ubuntu/authd-oidc-brokers/internal/consts"
+	providerErrors "github.com/ubuntu/authd-oidc-brokers/internal/providers/errors"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/noprovider"
 	"golang.org/x/oauth2"
@@ -183,6 +184,9 @@ type TokenHandlerOptions struct {
 	// will be added to the token, and then that element will be removed from
 	// the list.
 	IDTokenClaims []map[string]interface{}
+	// RotateRefreshToken makes the handler return a new refresh token each time, and reject the refresh tokens it
+	// returned before, like the providers which rotate refresh tokens.
+	RotateRefreshToken bool
 }
 
 var idTokenClaimsMutex sync.Mutex
@@ -196,10 +200,29 @@ func TokenHandler(serverURL string, opts *TokenHandlerOptions) EndpointHandler {
 		opts.Scopes = consts.DefaultScopes
 	}
 
+	var refreshTokenMu sync.Mutex
+	var refreshTokenCount int
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Mimics user going through auth process
 		time.Sleep(2 * time.Second)
 
+		refreshToken := "refreshtoken"
+		if opts.RotateRefreshToken {
+			refreshTokenMu.Lock()
+			// Only the last issued refresh token is valid.
+			if r.FormValue("grant_type") == "refresh_token" && refreshTokenCount > 0 &&
+				r.FormValue("refresh_token") != fmt.Sprintf("refreshtoken-%d", refreshTokenCount) {
+				refreshTokenMu.Unlock()
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+				return
+			}
+			refreshTokenCount++
+			refreshToken = fmt.Sprintf("refreshtoken-%d", refreshTokenCount)
+			refreshTokenMu.Unlock()
+		}
+
 		claims := jwt.MapClaims{
 			"iss":                serverURL,
 			"sub":                "test-user-id",
@@ -230,12 +253,12 @@ func TokenHandler(serverURL string, opts *TokenHandlerOptions) EndpointHandler {
 
 		response := fmt.Sprintf(`{
 			"access_token": "accesstoken",
-			"refresh_token": "refreshtoken",
+			"refresh_token": "%s",
 			"token_type": "Bearer",
 			"scope": "%s",
 			"expires_in": 3600,
 			"id_token": "%s"
-		}`, strings.Join(opts.Scopes, " "), rawToken)
+		}`, refreshToken, strings.Join(opts.Scopes, " "), rawToken)
 
 		w.Header().Add("Content-Type", "application/json")
 		if _, err := w.Write([]byte(response)); err != nil {
@@ -396,7 +419,8 @@ func (p *MockProvider) GetUserInfo(ctx context.Context, accessToken *oauth2.Toke
 	if p.GetGroupsFunc != nil {
 		userGroups, err = p.GetGroupsFunc()
 		if err != nil {
-			return info.User{}, err
+			user := info.NewUser(userClaims.Email, userClaims.Home, userClaims.Sub, userClaims.Shell, userClaims.Gecos, nil)
+			return info.User{}, providerErrors.NewGroupsError(user, err)
 		}
 	}
 
@@ -422,6 +446,32 @@ func (p *MockProvider) GetUserInfo(ctx context.Context, accessToken *oauth2.Toke
 	), nil
 }
 
+// MockWebAuthnProvider is a mock provider which also supports the WebAuthn authentication mode.
+type MockWebAuthnProvider struct {
+	*MockProvider
+}
+
+// MockWebAuthnChallenge is the challenge returned by MockWebAuthnProvider and MockWebAuthnAssertion is the only
+// assertion it accepts.
+const (
+	MockWebAuthnChallenge = `{"challenge":"mock-challenge"}`
+	MockWebAuthnAssertion = "mock-assertion"
+)
+
+// WebAuthnChallenge returns MockWebAuthnChallenge.
+func (p *MockWebAuthnProvider) WebAuthnChallenge(ctx context.Context, oauth2Config oauth2.Config, username string) (string, error) {
+	return MockWebAuthnChallenge, nil
+}
+
+// VerifyWebAuthnAssertion accepts MockWebAuthnAssertion for MockWebAuthnChallenge and returns a token from the
+// mock server token endpoint.
+func (p *MockWebAuthnProvider) VerifyWebAuthnAssertion(ctx context.Context, oauth2Config oauth2.Config, challenge, assertion string) (*oauth2.Token, error) {
+	if challenge != MockWebAuthnChallenge || assertion != MockWebAuthnAssertion {
+		return nil, errors.New("invalid assertion")
+	}
+	return oauth2Config.PasswordCredentialsToken(ctx, "webauthn", assertion)
+}
+
 type claims struct {
 	Email string `json:"email"`
 	Sub   string `json:"sub"`
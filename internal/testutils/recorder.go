@@ -0,0 +1,205 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/testutils/golden"
+)
+
+const (
+	// RecordHTTPEnv is the environment variable set to the URL of a live provider, e.g. https://dev-123.okta.com, to
+	// record its responses while the golden files are updated, instead of replaying the recorded ones.
+	RecordHTTPEnv = `TESTS_RECORD_HTTP`
+	// RecordHTTPTokenEnv is the environment variable holding the access token sent to the live provider while the
+	// responses are recorded, instead of the one of the test.
+	RecordHTTPTokenEnv = `TESTS_RECORD_HTTP_TOKEN`
+)
+
+// recordedResponse is a response of the provider, as stored in the interactions file.
+type recordedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	// JSON is the body of the response if it is a JSON document, so that it is readable in the file.
+	JSON json.RawMessage `json:"json,omitempty"`
+	// Body is the body of the response otherwise.
+	Body string `json:"body,omitempty"`
+}
+
+// recordedURLPlaceholder replaces the URL of the live provider in the recorded responses.
+const recordedURLPlaceholder = "{{provider}}"
+
+// ignoredRecordedHeaders are the headers of the responses which are not recorded, as they change every time, may hold
+// secrets, or no longer match the body once the URL of the provider is replaced.
+var ignoredRecordedHeaders = []string{"Content-Length", "Date", "Set-Cookie"}
+
+// RecordedTransport is an http.RoundTripper which replays the responses of a provider recorded in a JSON golden file,
+// keyed by the method and the path, with the query, of the requests, so that the provider tests run without network.
+// The host of the requests does not matter: the URLs of the provider in the responses point to it, so the tests can use
+// the URL of any org of the provider.
+//
+// If RecordHTTPEnv is set while the golden files are updated, the requests are sent to the live provider instead, and
+// its responses replace the recorded ones. The recorded file must be reviewed before committing it, as the responses
+// may hold personal data.
+type RecordedTransport struct {
+	t         *testing.T
+	path      string
+	liveURL   *url.URL
+	liveToken string
+
+	mu        sync.Mutex
+	responses map[string]recordedResponse
+}
+
+type recordedTransportOption struct {
+	path string
+}
+
+// RecordedTransportOption is a function that allows to override default options of the recorded transport.
+type RecordedTransportOption func(*recordedTransportOption)
+
+// WithInteractionsPath returns a RecordedTransportOption that overrides the path of the file of the recorded
+// responses, e.g. to share it between several tests.
+func WithInteractionsPath(path string) RecordedTransportOption {
+	return func(o *recordedTransportOption) {
+		o.path = path
+	}
+}
+
+// NewRecordedTransport returns a RecordedTransport replaying the responses recorded for the test, which are by default
+// in the golden path of the test with the .interactions.json extension.
+func NewRecordedTransport(t *testing.T, args ...RecordedTransportOption) *RecordedTransport {
+	t.Helper()
+
+	opts := recordedTransportOption{path: golden.Path(t) + ".interactions.json"}
+	for _, opt := range args {
+		opt(&opts)
+	}
+
+	rt := &RecordedTransport{t: t, path: opts.path, responses: make(map[string]recordedResponse)}
+	if live := os.Getenv(RecordHTTPEnv); live != "" && golden.UpdateEnabled() {
+		u, err := url.Parse(live)
+		require.NoError(t, err, "Setup: %s should be the URL of the live provider", RecordHTTPEnv)
+		rt.liveURL = u
+		rt.liveToken = os.Getenv(RecordHTTPTokenEnv)
+		t.Cleanup(func() { golden.CheckOrUpdateJSON(t, rt.responses, golden.WithPath(rt.path)) })
+		return rt
+	}
+
+	data, err := os.ReadFile(rt.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		require.FailNow(t, "Setup: no recorded responses", "Record them in %s by setting %s and %s",
+			rt.path, RecordHTTPEnv, golden.UpdateGoldenFilesEnv)
+	}
+	require.NoError(t, err, "Setup: could not read the recorded responses")
+	err = json.Unmarshal(data, &rt.responses)
+	require.NoError(t, err, "Setup: could not parse the recorded responses")
+	return rt
+}
+
+// Client returns an HTTP client sending its requests through the transport.
+func (rt *RecordedTransport) Client() *http.Client {
+	return &http.Client{Transport: rt}
+}
+
+// RoundTrip returns the recorded response of the request, or records the one of the live provider first.
+func (rt *RecordedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.Method + " " + req.URL.RequestURI()
+	if rt.liveURL != nil {
+		if err := rt.record(key, req); err != nil {
+			return nil, err
+		}
+	}
+	return rt.replay(key, req)
+}
+
+// replay returns the response recorded for the key, with the URLs of the provider pointing to the host of the request.
+func (rt *RecordedTransport) replay(key string, req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	r, ok := rt.responses[key]
+	rt.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no response recorded in %s for %q", rt.path, key)
+	}
+
+	base := req.URL.Scheme + "://" + req.URL.Host
+	body := []byte(r.Body)
+	if r.JSON != nil {
+		body = r.JSON
+	}
+	body = bytes.ReplaceAll(body, []byte(recordedURLPlaceholder), []byte(base))
+	header := http.Header{}
+	for k, values := range r.Header {
+		for _, v := range values {
+			header.Add(k, strings.ReplaceAll(v, recordedURLPlaceholder, base))
+		}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// record sends the request to the live provider, and records its response for the key, with its URL replaced by a
+// placeholder.
+func (rt *RecordedTransport) record(key string, req *http.Request) error {
+	live := req.Clone(req.Context())
+	live.URL.Scheme = rt.liveURL.Scheme
+	live.URL.Host = rt.liveURL.Host
+	live.Host = ""
+	if rt.liveToken != "" {
+		live.Header.Set("Authorization", "Bearer "+rt.liveToken)
+	}
+
+	resp, err := http.DefaultTransport.RoundTrip(live)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	base := rt.liveURL.Scheme + "://" + rt.liveURL.Host
+	r := recordedResponse{Status: resp.StatusCode, Header: http.Header{}}
+	for k, values := range resp.Header {
+		if slices.Contains(ignoredRecordedHeaders, k) {
+			continue
+		}
+		for _, v := range values {
+			r.Header.Add(k, strings.ReplaceAll(v, base, recordedURLPlaceholder))
+		}
+	}
+	body = bytes.ReplaceAll(body, []byte(base), []byte(recordedURLPlaceholder))
+	if json.Valid(body) {
+		r.JSON = body
+	} else {
+		r.Body = string(body)
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.responses[key] = r
+	return nil
+}
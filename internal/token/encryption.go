@@ -0,0 +1,154 @@
+package token
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// encryptedHeader is the prefix of the encrypted token files, which distinguishes them from the plaintext ones.
+var encryptedHeader = []byte("authd-oidc-encrypted-v1\n")
+
+// keyLen is the length of the AES-256 key used to encrypt the tokens.
+const keyLen = 32
+
+// ErrInvalidCache is returned when the cached token can not be decrypted or parsed.
+var ErrInvalidCache = errors.New("invalid token cache")
+
+// KeySource provides the key used to encrypt the cached tokens.
+type KeySource interface {
+	Key() ([]byte, error)
+}
+
+// MachineIDKeySource derives the key from the machine ID, so that the cached tokens can not be decrypted on another
+// machine. The machine ID is world-readable, so the key gives no protection against the local users.
+type MachineIDKeySource struct {
+	// Path is the path of the machine ID file, usually /etc/machine-id.
+	Path string
+}
+
+// Key returns the key derived from the machine ID.
+func (s MachineIDKeySource) Key() ([]byte, error) {
+	content, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read machine ID: %v", err)
+	}
+	machineID := strings.TrimSpace(string(content))
+	if machineID == "" {
+		return nil, fmt.Errorf("machine ID file %q is empty", s.Path)
+	}
+
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(machineID), nil, []byte("authd-oidc-brokers token cache")), key); err != nil {
+		return nil, fmt.Errorf("could not derive key from machine ID: %v", err)
+	}
+	return key, nil
+}
+
+// minKeyFileSize is the minimum size of the key files, so that the key can not be guessed.
+const minKeyFileSize = keyLen
+
+// FileKeySource derives the key from the content of a key file which only the broker can read, e.g. a systemd
+// credential, which systemd can keep encrypted with the TPM of the machine.
+type FileKeySource struct {
+	// Path is the path of the key file.
+	Path string
+}
+
+// Key returns the key derived from the key file. An error is returned if another user than the one the broker runs as
+// can read the file, as they could then decrypt the cached tokens, or if it is too short.
+func (s FileKeySource) Key() ([]byte, error) {
+	fi, err := os.Stat(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key file: %v", err)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return nil, fmt.Errorf("key file %q must be owned by the user the broker runs as", s.Path)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("key file %q must not be accessible by the group nor the other users, its permissions are %s", s.Path, fi.Mode().Perm())
+	}
+
+	content, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key file: %v", err)
+	}
+	if len(content) < minKeyFileSize {
+		return nil, fmt.Errorf("key file %q must hold at least %d bytes", s.Path, minKeyFileSize)
+	}
+
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, content, nil, []byte("authd-oidc-brokers token cache")), key); err != nil {
+		return nil, fmt.Errorf("could not derive key from key file: %v", err)
+	}
+	return key, nil
+}
+
+type options struct {
+	key []byte
+}
+
+// Option is a func that allows to override some of the default settings to cache the tokens.
+type Option func(*options)
+
+// WithEncryptionKey encrypts the cached tokens with the given key. Plaintext tokens can still be loaded, and are
+// encrypted when they are loaded.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// isEncrypted returns true if the data is an encrypted token.
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedHeader)
+}
+
+// encryptToken encrypts the data with AES-GCM and prefixes it with the header and the nonce.
+func encryptToken(data, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	encrypted := append(bytes.Clone(encryptedHeader), nonce...)
+	return gcm.Seal(encrypted, nonce, data, nil), nil
+}
+
+// decryptToken decrypts the data encrypted by encryptToken.
+func decryptToken(data, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimPrefix(data, encryptedHeader)
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("data is too short to contain a valid nonce")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,283 @@
+package token_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/authd-oidc-brokers/internal/token"
+)
+
+func TestMachineIDKeySource(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		machineID   string
+		noMachineID bool
+
+		wantErr bool
+	}{
+		"Successfully_derive_key_from_machine_ID":                          {machineID: "0123456789abcdef0123456789abcdef\n"},
+		"Successfully_derive_key_from_machine_ID_without_trailing_newline": {machineID: "0123456789abcdef0123456789abcdef"},
+
+		"Error_when_machine_ID_file_does_not_exist": {noMachineID: true, wantErr: true},
+		"Error_when_machine_ID_file_is_empty":       {machineID: "\n", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "machine-id")
+			if !tc.noMachineID {
+				err := os.WriteFile(path, []byte(tc.machineID), 0600)
+				require.NoError(t, err, "Setup: WriteFile should not return an error")
+			}
+
+			got, err := token.MachineIDKeySource{Path: path}.Key()
+			if tc.wantErr {
+				require.Error(t, err, "Key should return an error")
+				return
+			}
+			require.NoError(t, err, "Key should not return an error")
+			require.Len(t, got, 32, "Key should be an AES-256 key")
+
+			again, err := token.MachineIDKeySource{Path: path}.Key()
+			require.NoError(t, err, "Key should not return an error")
+			require.Equal(t, got, again, "Key should be the same for the same machine ID")
+
+			other := filepath.Join(t.TempDir(), "machine-id")
+			err = os.WriteFile(other, []byte("another-machine-id"), 0600)
+			require.NoError(t, err, "Setup: WriteFile should not return an error")
+			otherKey, err := token.MachineIDKeySource{Path: other}.Key()
+			require.NoError(t, err, "Key should not return an error")
+			require.NotEqual(t, got, otherKey, "Key should be different for another machine ID")
+		})
+	}
+}
+
+func TestFileKeySource(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		content   []byte
+		perm      os.FileMode
+		noKeyFile bool
+
+		wantErr bool
+	}{
+		"Successfully_derive_key_from_key_file":               {content: bytes.Repeat([]byte{1}, 32)},
+		"Successfully_derive_key_from_key_file_only_readable": {content: bytes.Repeat([]byte{1}, 64), perm: 0400},
+
+		"Error_when_key_file_does_not_exist":           {noKeyFile: true, wantErr: true},
+		"Error_when_key_file_is_too_short":             {content: bytes.Repeat([]byte{1}, 31), wantErr: true},
+		"Error_when_key_file_is_readable_by_the_group": {content: bytes.Repeat([]byte{1}, 32), perm: 0640, wantErr: true},
+		"Error_when_key_file_is_readable_by_all":       {content: bytes.Repeat([]byte{1}, 32), perm: 0604, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.perm == 0 {
+				tc.perm = 0600
+			}
+			path := filepath.Join(t.TempDir(), "key")
+			if !tc.noKeyFile {
+				err := os.WriteFile(path, tc.content, 0600)
+				require.NoError(t, err, "Setup: WriteFile should not return an error")
+				err = os.Chmod(path, tc.perm)
+				require.NoError(t, err, "Setup: Chmod should not return an error")
+			}
+
+			got, err := token.FileKeySource{Path: path}.Key()
+			if tc.wantErr {
+				require.Error(t, err, "Key should return an error")
+				return
+			}
+			require.NoError(t, err, "Key should not return an error")
+			require.Len(t, got, 32, "Key should be an AES-256 key")
+			require.NotEqual(t, tc.content[:32], got, "Key should be derived from the key file, not be its content")
+
+			again, err := token.FileKeySource{Path: path}.Key()
+			require.NoError(t, err, "Key should not return an error")
+			require.Equal(t, got, again, "Key should be the same for the same key file")
+
+			other := filepath.Join(t.TempDir(), "key")
+			err = os.WriteFile(other, bytes.Repeat([]byte{2}, 32), 0600)
+			require.NoError(t, err, "Setup: WriteFile should not return an error")
+			otherKey, err := token.FileKeySource{Path: other}.Key()
+			require.NoError(t, err, "Key should not return an error")
+			require.NotEqual(t, got, otherKey, "Key should be different for another key file")
+		})
+	}
+}
+
+func TestEncryptedAuthInfo(t *testing.T) {
+	t.Parallel()
+
+	key := bytes.Repeat([]byte{1}, 32)
+	otherKey := bytes.Repeat([]byte{2}, 32)
+
+	tests := map[string]struct {
+		storeKey  []byte
+		loadKey   []byte
+		truncated bool
+
+		wantEncrypted bool
+		wantErr       bool
+	}{
+		"Successfully_store_and_load_encrypted_token":     {storeKey: key, loadKey: key, wantEncrypted: true},
+		"Successfully_load_plaintext_token_without_a_key": {},
+		"Successfully_encrypt_plaintext_token_on_load":    {loadKey: key, wantEncrypted: true},
+
+		"Error_when_token_is_encrypted_with_another_key":  {storeKey: key, loadKey: otherKey, wantEncrypted: true, wantErr: true},
+		"Error_when_token_is_encrypted_but_no_key_is_set": {storeKey: key, wantEncrypted: true, wantErr: true},
+		"Error_when_encrypted_token_is_truncated":         {storeKey: key, loadKey: key, truncated: true, wantEncrypted: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tokenPath := filepath.Join(t.TempDir(), "token.json")
+
+			var storeOpts []token.Option
+			if tc.storeKey != nil {
+				storeOpts = append(storeOpts, token.WithEncryptionKey(tc.storeKey))
+			}
+			err := token.CacheAuthInfo(tokenPath, testToken, storeOpts...)
+			require.NoError(t, err, "Setup: CacheAuthInfo should not return an error")
+
+			if tc.truncated {
+				content, err := os.ReadFile(tokenPath)
+				require.NoError(t, err, "Setup: ReadFile should not return an error")
+				err = os.WriteFile(tokenPath, content[:len(content)/2], 0600)
+				require.NoError(t, err, "Setup: WriteFile should not return an error")
+			}
+
+			var loadOpts []token.Option
+			if tc.loadKey != nil {
+				loadOpts = append(loadOpts, token.WithEncryptionKey(tc.loadKey))
+			}
+			got, err := token.LoadAuthInfo(tokenPath, loadOpts...)
+
+			content, readErr := os.ReadFile(tokenPath)
+			require.NoError(t, readErr, "ReadFile should not return an error")
+			require.NotEqual(t, tc.wantEncrypted, bytes.HasPrefix(content, []byte("{")), "Stored token should be encrypted only if expected")
+
+			if tc.wantErr {
+				require.ErrorIs(t, err, token.ErrInvalidCache, "LoadAuthInfo should return an invalid cache error")
+				return
+			}
+			require.NoError(t, err, "LoadAuthInfo should not return an error")
+			require.Equal(t, testToken, got, "LoadAuthInfo should return the stored token")
+		})
+	}
+}
+
+func TestReadAuthInfo(t *testing.T) {
+	t.Parallel()
+
+	key := bytes.Repeat([]byte{1}, 32)
+	otherKey := bytes.Repeat([]byte{2}, 32)
+
+	tests := map[string]struct {
+		storeKey []byte
+		readKey  []byte
+
+		wantErr bool
+	}{
+		"Successfully_read_encrypted_token":                     {storeKey: key, readKey: key},
+		"Successfully_read_plaintext_token_without_a_key":       {},
+		"Plaintext_token_is_not_encrypted_when_read_with_a_key": {readKey: key},
+
+		"Error_when_token_is_encrypted_with_another_key":  {storeKey: key, readKey: otherKey, wantErr: true},
+		"Error_when_token_is_encrypted_but_no_key_is_set": {storeKey: key, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tokenPath := filepath.Join(t.TempDir(), "token.json")
+
+			var storeOpts []token.Option
+			if tc.storeKey != nil {
+				storeOpts = append(storeOpts, token.WithEncryptionKey(tc.storeKey))
+			}
+			err := token.CacheAuthInfo(tokenPath, testToken, storeOpts...)
+			require.NoError(t, err, "Setup: CacheAuthInfo should not return an error")
+			before, err := os.ReadFile(tokenPath)
+			require.NoError(t, err, "Setup: ReadFile should not return an error")
+
+			var readOpts []token.Option
+			if tc.readKey != nil {
+				readOpts = append(readOpts, token.WithEncryptionKey(tc.readKey))
+			}
+			got, err := token.ReadAuthInfo(tokenPath, readOpts...)
+
+			after, readErr := os.ReadFile(tokenPath)
+			require.NoError(t, readErr, "ReadFile should not return an error")
+			require.Equal(t, before, after, "ReadAuthInfo should not modify the stored token")
+
+			if tc.wantErr {
+				require.ErrorIs(t, err, token.ErrInvalidCache, "ReadAuthInfo should return an invalid cache error")
+				return
+			}
+			require.NoError(t, err, "ReadAuthInfo should not return an error")
+			require.Equal(t, testToken, got, "ReadAuthInfo should return the stored token")
+		})
+	}
+}
+
+func TestEncryptedData(t *testing.T) {
+	t.Parallel()
+
+	key := bytes.Repeat([]byte{1}, 32)
+	otherKey := bytes.Repeat([]byte{2}, 32)
+	data := []byte(`{"some": "secret"}`)
+
+	tests := map[string]struct {
+		storeKey []byte
+		loadKey  []byte
+
+		wantEncrypted bool
+		wantErr       bool
+	}{
+		"Successfully_store_and_load_encrypted_data":      {storeKey: key, loadKey: key, wantEncrypted: true},
+		"Successfully_store_and_load_plaintext_data":      {},
+		"Successfully_load_plaintext_data_with_a_key_set": {loadKey: key},
+
+		"Error_when_data_is_encrypted_with_another_key":  {storeKey: key, loadKey: otherKey, wantEncrypted: true, wantErr: true},
+		"Error_when_data_is_encrypted_but_no_key_is_set": {storeKey: key, wantEncrypted: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "dir", "data.json")
+
+			var storeOpts []token.Option
+			if tc.storeKey != nil {
+				storeOpts = append(storeOpts, token.WithEncryptionKey(tc.storeKey))
+			}
+			err := token.StoreData(path, data, storeOpts...)
+			require.NoError(t, err, "StoreData should not return an error")
+
+			content, err := os.ReadFile(path)
+			require.NoError(t, err, "ReadFile should not return an error")
+			require.Equal(t, tc.wantEncrypted, !bytes.Equal(content, data), "Stored data should be encrypted only if expected")
+
+			var loadOpts []token.Option
+			if tc.loadKey != nil {
+				loadOpts = append(loadOpts, token.WithEncryptionKey(tc.loadKey))
+			}
+			got, err := token.LoadData(path, loadOpts...)
+			if tc.wantErr {
+				require.ErrorIs(t, err, token.ErrInvalidCache, "LoadData should return an invalid cache error")
+				return
+			}
+			require.NoError(t, err, "LoadData should not return an error")
+			require.Equal(t, data, got, "LoadData should return the stored data")
+		})
+	}
+}
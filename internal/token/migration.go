@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -16,16 +17,13 @@ import (
 const saltLen = 32
 
 // UseOldEncryptedToken checks if the password file or the old encrypted token file exists. It returns false if the
-// password file exists, true if only the old encrypted token file exists, and an error if neither exists.
-func UseOldEncryptedToken(passwordPath, tokenPath, oldEncryptedTokenPath string) (bool, error) {
+// password file exists along with a token, true if only the old encrypted token file exists, and an error if neither
+// exists. tokenExists tells whether a token is stored for the user, wherever the tokens are stored.
+func UseOldEncryptedToken(passwordPath string, tokenExists bool, oldEncryptedTokenPath string) (bool, error) {
 	passwordExists, err := fileutils.FileExists(passwordPath)
 	if err != nil {
 		return false, fmt.Errorf("could not check password file: %w", err)
 	}
-	tokenExists, err := fileutils.FileExists(tokenPath)
-	if err != nil {
-		return false, fmt.Errorf("could not check token file: %w", err)
-	}
 	if passwordExists && tokenExists {
 		return false, nil
 	}
@@ -40,8 +38,8 @@ func UseOldEncryptedToken(passwordPath, tokenPath, oldEncryptedTokenPath string)
 			// is only used for backward compatibility, so if it doesn't exist, the missing password file is the real issue.
 			return false, fmt.Errorf("password file %q does not exist", passwordPath)
 		}
-		// We only get here if the password file exists and the token file does not exist.
-		return false, fmt.Errorf("token file %q does not exist", tokenPath)
+		// We only get here if the password file exists and the token does not exist.
+		return false, errors.New("no token is stored for the user")
 	}
 
 	return true, nil
@@ -39,23 +39,18 @@ func TestUseOldEncryptedToken(t *testing.T) {
 			t.Parallel()
 
 			passwordPath := t.TempDir() + "/password"
-			tokenPath := t.TempDir() + "/token"
 			oldEncryptedTokenPath := t.TempDir() + "/oldtoken"
 
 			if tc.passwordFileExists {
 				err := os.WriteFile(passwordPath, []byte("password"), 0600)
 				require.NoError(t, err, "WriteFile should not return an error")
 			}
-			if tc.newTokenFileExists {
-				err := os.WriteFile(tokenPath, []byte("token"), 0600)
-				require.NoError(t, err, "WriteFile should not return an error")
-			}
 			if tc.oldEncryptedTokenFileExists {
 				err := os.WriteFile(oldEncryptedTokenPath, []byte("encryptedtoken"), 0600)
 				require.NoError(t, err, "WriteFile should not return an error")
 			}
 
-			got, err := token.UseOldEncryptedToken(passwordPath, tokenPath, oldEncryptedTokenPath)
+			got, err := token.UseOldEncryptedToken(passwordPath, tc.newTokenFileExists, oldEncryptedTokenPath)
 			if tc.wantError {
 				require.Error(t, err, "UseOldEncryptedToken should return an error")
 				return
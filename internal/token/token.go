@@ -4,9 +4,11 @@ package token
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 
+	"github.com/ubuntu/authd-oidc-brokers/internal/fileutils"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers"
 	"github.com/ubuntu/authd-oidc-brokers/internal/providers/info"
 	"golang.org/x/oauth2"
@@ -18,6 +20,9 @@ type AuthCachedInfo struct {
 	ExtraFields map[string]interface{}
 	RawIDToken  string
 	UserInfo    info.User
+	// RefreshTokenRevoked is true if the refresh token was revoked and cleared from the cache at the end of a session, in
+	// which case the token is used as it is, without being refreshed.
+	RefreshTokenRevoked bool `json:",omitempty"`
 }
 
 // NewAuthCachedInfo creates a new AuthCachedInfo. It sets the provided token and rawIDToken and the provider-specific
@@ -31,18 +36,33 @@ func NewAuthCachedInfo(token *oauth2.Token, rawIDToken string, provider provider
 }
 
 // CacheAuthInfo saves the token to the given path.
-func CacheAuthInfo(path string, token AuthCachedInfo) (err error) {
+//
+// The token is written to a temporary file which then replaces the cached one, so that the cache always contains
+// either the previous token or the new one, even if the broker is stopped while writing it.
+func CacheAuthInfo(path string, token AuthCachedInfo, args ...Option) (err error) {
+	var opts options
+	for _, arg := range args {
+		arg(&opts)
+	}
+
 	jsonData, err := json.Marshal(token)
 	if err != nil {
 		return fmt.Errorf("could not marshal token: %v", err)
 	}
 
+	if opts.key != nil {
+		jsonData, err = encryptToken(jsonData, opts.key)
+		if err != nil {
+			return fmt.Errorf("could not encrypt token: %v", err)
+		}
+	}
+
 	// Create issuer specific cache directory if it doesn't exist.
 	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 		return fmt.Errorf("could not create token directory: %v", err)
 	}
 
-	if err = os.WriteFile(path, jsonData, 0600); err != nil {
+	if err = fileutils.WriteFileAtomically(path, jsonData); err != nil {
 		return fmt.Errorf("could not save token: %v", err)
 	}
 
@@ -50,15 +70,62 @@ func CacheAuthInfo(path string, token AuthCachedInfo) (err error) {
 }
 
 // LoadAuthInfo reads the token from the given path.
-func LoadAuthInfo(path string) (AuthCachedInfo, error) {
+//
+// If an encryption key is given, a plaintext token is migrated by storing it encrypted. Tokens which can not be
+// decrypted or parsed return an error wrapping ErrInvalidCache, and missing ones an error wrapping fs.ErrNotExist.
+func LoadAuthInfo(path string, args ...Option) (AuthCachedInfo, error) {
+	cachedInfo, encrypted, err := readAuthInfo(path, args...)
+	if err != nil {
+		return AuthCachedInfo{}, err
+	}
+
+	var opts options
+	for _, arg := range args {
+		arg(&opts)
+	}
+	if !encrypted && opts.key != nil {
+		if err := CacheAuthInfo(path, cachedInfo, args...); err != nil {
+			slog.Warn(fmt.Sprintf("Could not encrypt the plaintext token %q: %v", path, err))
+		} else {
+			slog.Info(fmt.Sprintf("Encrypted the plaintext token %q", path))
+		}
+	}
+
+	return cachedInfo, nil
+}
+
+// ReadAuthInfo reads the token from the given path like LoadAuthInfo, but never writes it: a plaintext token is not
+// migrated, e.g. when the cache is only inspected.
+func ReadAuthInfo(path string, args ...Option) (AuthCachedInfo, error) {
+	cachedInfo, _, err := readAuthInfo(path, args...)
+	return cachedInfo, err
+}
+
+// readAuthInfo reads the token from the given path, and returns whether it was encrypted.
+func readAuthInfo(path string, args ...Option) (cachedInfo AuthCachedInfo, encrypted bool, err error) {
+	var opts options
+	for _, arg := range args {
+		arg(&opts)
+	}
+
 	jsonData, err := os.ReadFile(path)
 	if err != nil {
-		return AuthCachedInfo{}, fmt.Errorf("could not read token: %v", err)
+		return AuthCachedInfo{}, false, fmt.Errorf("could not read token: %w", err)
+	}
+
+	encrypted = isEncrypted(jsonData)
+	if encrypted {
+		if opts.key == nil {
+			return AuthCachedInfo{}, true, fmt.Errorf("%w: token is encrypted but no encryption key is configured", ErrInvalidCache)
+		}
+		jsonData, err = decryptToken(jsonData, opts.key)
+		if err != nil {
+			return AuthCachedInfo{}, true, fmt.Errorf("%w: could not decrypt token: %v", ErrInvalidCache, err)
+		}
 	}
 
-	var cachedInfo AuthCachedInfo
 	if err := json.Unmarshal(jsonData, &cachedInfo); err != nil {
-		return AuthCachedInfo{}, fmt.Errorf("could not unmarshal token: %v", err)
+		return AuthCachedInfo{}, encrypted, fmt.Errorf("%w: could not unmarshal token: %v", ErrInvalidCache, err)
 	}
 
 	// Set the extra fields of the token.
@@ -66,5 +133,55 @@ func LoadAuthInfo(path string) (AuthCachedInfo, error) {
 		cachedInfo.Token = cachedInfo.Token.WithExtra(cachedInfo.ExtraFields)
 	}
 
-	return cachedInfo, nil
+	return cachedInfo, encrypted, nil
+}
+
+// StoreData saves other secret data than tokens to the given path, encrypted like the tokens if an encryption key is
+// given.
+func StoreData(path string, data []byte, args ...Option) (err error) {
+	var opts options
+	for _, arg := range args {
+		arg(&opts)
+	}
+
+	if opts.key != nil {
+		data, err = encryptToken(data, opts.key)
+		if err != nil {
+			return fmt.Errorf("could not encrypt data: %v", err)
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("could not create data directory: %v", err)
+	}
+	if err = fileutils.WriteFileAtomically(path, data); err != nil {
+		return fmt.Errorf("could not save data: %v", err)
+	}
+	return nil
+}
+
+// LoadData reads the data saved by StoreData. Data which can not be decrypted returns an error wrapping
+// ErrInvalidCache.
+func LoadData(path string, args ...Option) ([]byte, error) {
+	var opts options
+	for _, arg := range args {
+		arg(&opts)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read data: %v", err)
+	}
+	if !isEncrypted(data) {
+		return data, nil
+	}
+
+	if opts.key == nil {
+		return nil, fmt.Errorf("%w: data is encrypted but no encryption key is configured", ErrInvalidCache)
+	}
+	data, err = decryptToken(data, opts.key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not decrypt data: %v", ErrInvalidCache, err)
+	}
+	return data, nil
 }
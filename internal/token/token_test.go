@@ -37,12 +37,15 @@ func TestCacheAuthInfo(t *testing.T) {
 		existingFile      bool
 		fileIsDir         bool
 		parentIsFile      bool
+		// interruptedWrite leaves a partially written temporary file, as if the broker was stopped while writing.
+		interruptedWrite bool
 
 		wantError bool
 	}{
 		"Successfully_store_token_with_non_existing_parent_directory": {},
 		"Successfully_store_token_with_existing_parent_directory":     {existingParentDir: true},
 		"Successfully_store_token_with_existing_file":                 {existingParentDir: true, existingFile: true},
+		"Successfully_store_token_after_an_interrupted_write":         {existingParentDir: true, existingFile: true, interruptedWrite: true},
 
 		"Error_when_file_exists_and_is_a_directory": {existingParentDir: true, existingFile: true, fileIsDir: true, wantError: true},
 		"Error_when_parent_directory_is_a_file":     {existingParentDir: true, parentIsFile: true, wantError: true},
@@ -72,12 +75,35 @@ func TestCacheAuthInfo(t *testing.T) {
 				require.NoError(t, err, "WriteFile should not return an error")
 			}
 
+			if tc.interruptedWrite {
+				err := os.WriteFile(tokenPath+".interrupted.tmp", []byte(`{"Token":`), 0600)
+				require.NoError(t, err, "WriteFile should not return an error")
+			}
+
 			err := token.CacheAuthInfo(tokenPath, testToken)
 			if tc.wantError {
 				require.Error(t, err, "CacheAuthInfo should return an error")
 				return
 			}
 			require.NoError(t, err, "CacheAuthInfo should not return an error")
+
+			got, err := token.LoadAuthInfo(tokenPath)
+			require.NoError(t, err, "LoadAuthInfo should not return an error")
+			require.Equal(t, testToken, got, "LoadAuthInfo should return the stored token")
+
+			entries, err := os.ReadDir(filepath.Dir(tokenPath))
+			require.NoError(t, err, "ReadDir should not return an error")
+			var tempFiles int
+			for _, e := range entries {
+				if filepath.Ext(e.Name()) == ".tmp" {
+					tempFiles++
+				}
+			}
+			wantTempFiles := 0
+			if tc.interruptedWrite {
+				wantTempFiles = 1
+			}
+			require.Equal(t, wantTempFiles, tempFiles, "CacheAuthInfo should not leave temporary files behind")
 		})
 	}
 }